@@ -0,0 +1,257 @@
+// Package anchor stores signed checkpoints of the chain of Blocks. Every N
+// final Blocks, an Anchor is recorded with everything a light client or a
+// fast-forwarding peer needs to trust the Block without replaying the
+// hashgraph.
+package anchor
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"strconv"
+
+	"github.com/bolaxy/config"
+	"github.com/bolaxy/core/db"
+	"github.com/bolaxy/core/hashgraph"
+	"github.com/bolaxy/core/logger"
+	"github.com/bolaxy/core/store"
+	"github.com/bolaxy/core/types"
+	"github.com/bolaxy/errors"
+)
+
+const anchorPrefix = "anchor"
+
+// Anchor is a checkpoint of the chain at a final Block
+type Anchor struct {
+	BlockIndex    int
+	RoundReceived int
+	BlockHash     []byte // hash of the Block's body, which is what validators sign
+	StateHash     []byte
+	Peers         []*conf.Peer      // PeerSet which signed the Block
+	Signatures    map[string]string // [validator] => signature of the Block
+	Block         *types.Block
+	Threshold     *ThresholdSignature `json:",omitempty"`
+}
+
+// ThresholdSignature is a single signature of the BlockHash of an Anchor by
+// the group key of the validators, combined from the shares of a threshold of
+// them. It is verified by the threshold package.
+type ThresholdSignature struct {
+	Epoch     int    // block index at which the group key was generated
+	GroupKey  []byte // BLS public key, on BLS12-381 G2
+	Signature []byte // BLS signature, on BLS12-381 G1
+}
+
+// NewAnchor creates the Anchor of a Block signed by a PeerSet
+func NewAnchor(block *types.Block, peerSet *conf.PeerSet) (*Anchor, error) {
+	hash, err := block.Body.Hash()
+	if err != nil {
+		return nil, err
+	}
+
+	sigs := make(map[string]string, len(block.Signatures))
+	for k, v := range block.Signatures {
+		sigs[k] = v
+	}
+
+	return &Anchor{
+		BlockIndex:    block.Index(),
+		RoundReceived: block.RoundReceived(),
+		BlockHash:     hash,
+		StateHash:     block.StateHash(),
+		Peers:         peerSet.Peers,
+		Signatures:    sigs,
+		Block:         block,
+	}, nil
+}
+
+// Verify checks that the Anchor's Block matches its hash and was signed by a
+// SuperMajority of the Anchor's PeerSet. The caller must check that the
+// PeerSet is the one it expects.
+func (a *Anchor) Verify() error {
+	if a.Block == nil {
+		return fmt.Errorf("anchor %d has no block", a.BlockIndex)
+	}
+
+	hash, err := a.Block.Body.Hash()
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(hash, a.BlockHash) {
+		return fmt.Errorf("anchor %d: block hash mismatch", a.BlockIndex)
+	}
+
+	peerSet := conf.NewPeerSet(a.Peers)
+
+	valid := 0
+	for validator, sig := range a.Signatures {
+		if _, ok := peerSet.ByPubKey[validator]; !ok {
+			continue
+		}
+
+		bs, err := a.Block.GetSignature(validator)
+		if err != nil || bs.Signature != sig {
+			continue
+		}
+
+		if ok, err := a.Block.Verify(bs); err == nil && ok {
+			valid++
+		}
+	}
+
+	if valid < peerSet.SuperMajority() {
+		return fmt.Errorf("anchor %d: %d valid signatures, %d required", a.BlockIndex, valid, peerSet.SuperMajority())
+	}
+
+	return nil
+}
+
+// Marshal ...
+func (a *Anchor) Marshal() ([]byte, error) {
+	return json.Marshal(a)
+}
+
+// Unmarshal ...
+func (a *Anchor) Unmarshal(data []byte) error {
+	return json.Unmarshal(data, a)
+}
+
+// Checkpointer records an Anchor every Interval final Blocks
+type Checkpointer struct {
+	db       db.Sinker
+	store    store.Store
+	interval int
+	logger   logger.Logger
+	onRecord func(*Anchor) //set by the Notary
+}
+
+// NewCheckpointer records Anchors in sinker for every final Block whose index
+// is a multiple of interval
+func NewCheckpointer(sinker db.Sinker, s store.Store, interval int) *Checkpointer {
+	if interval <= 0 {
+		interval = 1
+	}
+	return &Checkpointer{
+		db:       sinker,
+		store:    s,
+		interval: interval,
+		logger:   logger.Nop,
+	}
+}
+
+// Interval returns the number of Blocks between two Anchors
+func (c *Checkpointer) Interval() int {
+	return c.interval
+}
+
+// SetLogger ...
+func (c *Checkpointer) SetLogger(l logger.Logger) {
+	c.logger = logger.OrNop(l).With(logger.Component, "Checkpointer")
+}
+
+func anchorKey(blockIndex int) []byte {
+	return []byte(fmt.Sprintf("%s_%09d", anchorPrefix, blockIndex))
+}
+
+// Wrap returns a FinalityCallback which records Anchors before calling next.
+// It is meant to be passed to Hashgraph.SetFinalityCallback.
+func (c *Checkpointer) Wrap(next hashgraph.FinalityCallback) hashgraph.FinalityCallback {
+	return func(ctx context.Context, block *types.Block) error {
+		if err := c.OnFinal(ctx, block); err != nil {
+			return err
+		}
+		if next != nil {
+			return next(ctx, block)
+		}
+		return nil
+	}
+}
+
+// OnFinal records the Anchor of a final Block if its index is a multiple of
+// the interval
+func (c *Checkpointer) OnFinal(ctx context.Context, block *types.Block) error {
+	if block.Index()%c.interval != 0 {
+		return nil
+	}
+
+	peerSet, err := c.store.GetPeerSet(block.RoundReceived())
+	if err != nil {
+		return err
+	}
+
+	a, err := NewAnchor(block, peerSet)
+	if err != nil {
+		return err
+	}
+
+	return c.Put(ctx, a)
+}
+
+// Put persists an Anchor. Anchors are overwritten, so that a later version
+// with more Signatures replaces an earlier one.
+func (c *Checkpointer) Put(ctx context.Context, a *Anchor) error {
+	data, err := a.Marshal()
+	if err != nil {
+		return err
+	}
+
+	if err := c.db.Put(ctx, anchorKey(a.BlockIndex), data); err != nil {
+		return err
+	}
+
+	c.logger.Info("anchor recorded",
+		logger.Block, a.BlockIndex,
+		logger.Round, a.RoundReceived,
+		"signatures", len(a.Signatures))
+
+	if c.onRecord != nil {
+		c.onRecord(a)
+	}
+
+	return nil
+}
+
+// Get returns the Anchor of a Block
+func (c *Checkpointer) Get(ctx context.Context, blockIndex int) (*Anchor, error) {
+	data, err := c.db.Get(ctx, anchorKey(blockIndex))
+	if err != nil {
+		if err == db.ErrKeyNotFound {
+			return nil, errors.NewStoreErr("Anchors", errors.KeyNotFound, strconv.Itoa(blockIndex))
+		}
+		return nil, err
+	}
+
+	a := new(Anchor)
+	if err := a.Unmarshal(data); err != nil {
+		return nil, err
+	}
+
+	return a, nil
+}
+
+// Latest returns the Anchor with the highest Block index
+func (c *Checkpointer) Latest() (*Anchor, error) {
+	prefix := []byte(anchorPrefix + "_")
+
+	it := c.db.NewIterator(true)
+	defer it.Close()
+
+	//in reverse, seek to the end of the prefix range
+	it.Seek([]byte(anchorPrefix + "_\xff"))
+	if !it.ValidForPrefix(prefix) {
+		return nil, errors.NewStoreErr("Anchors", errors.Empty, "")
+	}
+
+	data, err := it.Item().Value()
+	if err != nil {
+		return nil, err
+	}
+
+	a := new(Anchor)
+	if err := a.Unmarshal(data); err != nil {
+		return nil, err
+	}
+
+	return a, nil
+}
@@ -0,0 +1,234 @@
+package anchor
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/bolaxy/core/logger"
+)
+
+const receiptPrefix = "anchorreceipt"
+
+// Publisher pushes Anchors to an external notary, for example by writing the
+// Block hash in a transaction on another chain
+type Publisher interface {
+	// Name identifies the Publisher in Receipts. It must be stable.
+	Name() string
+	// Publish returns a reference to the publication, like a transaction
+	// hash, which is recorded in the Receipt
+	Publish(ctx context.Context, a *Anchor) (string, error)
+}
+
+// Receipt records the publication of an Anchor by a Publisher
+type Receipt struct {
+	Publisher  string
+	BlockIndex int
+	Reference  string
+	Attempts   int
+	Time       time.Time
+}
+
+// Backoff configures the retries of failed publications
+type Backoff struct {
+	Initial     time.Duration
+	Max         time.Duration
+	MaxAttempts int // 0 for unlimited
+}
+
+// DefaultBackoff ...
+func DefaultBackoff() Backoff {
+	return Backoff{
+		Initial:     time.Second,
+		Max:         time.Minute,
+		MaxAttempts: 0,
+	}
+}
+
+// DefaultQueueSize is the number of Anchors waiting for publication after
+// which new Anchors are dropped
+const DefaultQueueSize = 64
+
+// Notary publishes the Anchors recorded by a Checkpointer with all its
+// Publishers, in the background, and records the Receipts in the
+// Checkpointer's db. Publications are retried with exponential backoff.
+type Notary struct {
+	checkpointer *Checkpointer
+	publishers   []Publisher
+	backoff      Backoff
+	queue        chan *Anchor
+	logger       logger.Logger
+
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+}
+
+// NewNotary creates a Notary and registers it with the Checkpointer, so that
+// every recorded Anchor is published. Start must be called to begin
+// publishing.
+func NewNotary(c *Checkpointer, backoff Backoff, publishers ...Publisher) *Notary {
+	ctx, cancel := context.WithCancel(context.Background())
+
+	n := &Notary{
+		checkpointer: c,
+		publishers:   publishers,
+		backoff:      backoff,
+		queue:        make(chan *Anchor, DefaultQueueSize),
+		logger:       c.logger.With(logger.Component, "Notary"),
+		ctx:          ctx,
+		cancel:       cancel,
+	}
+
+	c.onRecord = n.enqueue
+
+	return n
+}
+
+// SetLogger ...
+func (n *Notary) SetLogger(l logger.Logger) {
+	n.logger = logger.OrNop(l).With(logger.Component, "Notary")
+}
+
+// Start launches one publishing goroutine per Publisher
+func (n *Notary) Start() {
+	fan := make([]chan *Anchor, len(n.publishers))
+	for i, p := range n.publishers {
+		fan[i] = make(chan *Anchor, DefaultQueueSize)
+		n.wg.Add(1)
+		go n.publishLoop(p, fan[i])
+	}
+
+	n.wg.Add(1)
+	go func() {
+		defer n.wg.Done()
+		defer func() {
+			for _, c := range fan {
+				close(c)
+			}
+		}()
+		for {
+			select {
+			case a := <-n.queue:
+				for _, c := range fan {
+					select {
+					case c <- a:
+					default:
+						n.logger.Warn("publisher queue full, anchor dropped", logger.Block, a.BlockIndex)
+					}
+				}
+			case <-n.ctx.Done():
+				return
+			}
+		}
+	}()
+}
+
+// Close stops publishing. Pending publications are abandoned.
+func (n *Notary) Close() {
+	n.cancel()
+	n.wg.Wait()
+}
+
+func (n *Notary) enqueue(a *Anchor) {
+	select {
+	case n.queue <- a:
+	default:
+		n.logger.Warn("notary queue full, anchor dropped", logger.Block, a.BlockIndex)
+	}
+}
+
+func (n *Notary) publishLoop(p Publisher, anchors <-chan *Anchor) {
+	defer n.wg.Done()
+
+	for a := range anchors {
+		if _, err := n.checkpointer.GetReceipt(n.ctx, p.Name(), a.BlockIndex); err == nil {
+			continue //already published
+		}
+
+		if err := n.publish(p, a); err != nil {
+			n.logger.Error("anchor not published",
+				"publisher", p.Name(),
+				logger.Block, a.BlockIndex,
+				logger.Err, err)
+		}
+	}
+}
+
+func (n *Notary) publish(p Publisher, a *Anchor) error {
+	delay := n.backoff.Initial
+	for attempt := 1; ; attempt++ {
+		ref, err := p.Publish(n.ctx, a)
+		if err == nil {
+			return n.checkpointer.putReceipt(n.ctx, Receipt{
+				Publisher:  p.Name(),
+				BlockIndex: a.BlockIndex,
+				Reference:  ref,
+				Attempts:   attempt,
+				Time:       time.Now().UTC(),
+			})
+		}
+
+		if n.backoff.MaxAttempts > 0 && attempt >= n.backoff.MaxAttempts {
+			return fmt.Errorf("giving up after %d attempts: %v", attempt, err)
+		}
+
+		n.logger.Debug("anchor publication failed, retrying",
+			"publisher", p.Name(),
+			logger.Block, a.BlockIndex,
+			"attempt", attempt,
+			"delay", delay,
+			logger.Err, err)
+
+		select {
+		case <-time.After(delay):
+		case <-n.ctx.Done():
+			return n.ctx.Err()
+		}
+
+		delay *= 2
+		if n.backoff.Max > 0 && delay > n.backoff.Max {
+			delay = n.backoff.Max
+		}
+	}
+}
+
+func receiptKey(publisher string, blockIndex int) []byte {
+	return []byte(fmt.Sprintf("%s_%s_%09d", receiptPrefix, publisher, blockIndex))
+}
+
+func (c *Checkpointer) putReceipt(ctx context.Context, r Receipt) error {
+	data, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+
+	if err := c.db.Put(ctx, receiptKey(r.Publisher, r.BlockIndex), data); err != nil {
+		return err
+	}
+
+	c.logger.Info("anchor published",
+		"publisher", r.Publisher,
+		logger.Block, r.BlockIndex,
+		"reference", r.Reference)
+
+	return nil
+}
+
+// GetReceipt returns the Receipt of the publication of an Anchor by a
+// Publisher
+func (c *Checkpointer) GetReceipt(ctx context.Context, publisher string, blockIndex int) (*Receipt, error) {
+	data, err := c.db.Get(ctx, receiptKey(publisher, blockIndex))
+	if err != nil {
+		return nil, err
+	}
+
+	r := new(Receipt)
+	if err := json.Unmarshal(data, r); err != nil {
+		return nil, err
+	}
+
+	return r, nil
+}
@@ -0,0 +1,221 @@
+// Package audit records how the transactions of every committed Block were
+// ordered: the Event which carried each transaction into the hashgraph, its
+// creator, and its Lamport timestamp. Operators can check from these records
+// that no validator systematically gets its transactions ordered first.
+package audit
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+
+	"github.com/bolaxy/core/db"
+	"github.com/bolaxy/core/hashgraph"
+	"github.com/bolaxy/core/logger"
+	"github.com/bolaxy/core/store"
+	"github.com/bolaxy/core/txindex"
+	"github.com/bolaxy/core/types"
+	"github.com/bolaxy/errors"
+)
+
+const auditPrefix = "audit"
+
+// MaxSummaryBlocks bounds the range of Blocks of a Summary
+const MaxSummaryBlocks = 10000
+
+// Entry is the ordering record of a transaction
+type Entry struct {
+	Offset           int    // position in the Block's transactions
+	TxHash           string // hex of txindex.Hash
+	EventHex         string // Event which carried the transaction
+	Creator          uint32 // creator of the Event
+	LamportTimestamp int
+	Round            int // round created of the Event
+}
+
+// BlockAudit is the ordering record of a Block
+type BlockAudit struct {
+	BlockIndex    int
+	RoundReceived int
+	Entries       []Entry
+}
+
+// CreatorStats summarizes the positions of the transactions of a creator.
+// Position is the offset of a transaction in its Block, scaled from 0 for the
+// first to 1 for the last, and 0.5 for the only one. A creator whose
+// MeanPosition stays well below the one of the others gets its transactions
+// ordered first.
+type CreatorStats struct {
+	Creator      uint32
+	Txs          int
+	Blocks       int
+	First        int // transactions ordered first in a Block of several
+	MeanPosition float64
+}
+
+// Auditor records a BlockAudit for every committed Block. The records are
+// written under the audit prefix of the Sinker, which can be shared with a
+// CachedStore.
+type Auditor struct {
+	db     db.Sinker
+	store  store.Store
+	logger logger.Logger
+}
+
+// NewAuditor creates an Auditor which persists the records in sinker and
+// reads Blocks and Frames from s
+func NewAuditor(sinker db.Sinker, s store.Store) *Auditor {
+	return &Auditor{
+		db:     sinker,
+		store:  s,
+		logger: logger.Nop,
+	}
+}
+
+// SetLogger ...
+func (a *Auditor) SetLogger(l logger.Logger) {
+	a.logger = logger.OrNop(l).With(logger.Component, "Auditor")
+}
+
+func auditKey(blockIndex int) []byte {
+	return []byte(fmt.Sprintf("%s_%010d", auditPrefix, blockIndex))
+}
+
+// Wrap returns a CommitCallback which records a Block before passing it to
+// cb
+func (a *Auditor) Wrap(cb hashgraph.CommitCallback) hashgraph.CommitCallback {
+	return func(ctx context.Context, block *types.Block) error {
+		if err := a.Record(ctx, block); err != nil {
+			return err
+		}
+		if cb != nil {
+			return cb(ctx, block)
+		}
+		return nil
+	}
+}
+
+// Record writes the BlockAudit of a Block. The Blocks without transactions
+// are not recorded. If the Frame of the Block is not in the Store, which
+// happens after a fast-sync, the Block is skipped.
+func (a *Auditor) Record(ctx context.Context, block *types.Block) error {
+	txs := block.Transactions()
+	if len(txs) == 0 {
+		return nil
+	}
+
+	carriers, err := txindex.Carriers(a.store, block)
+	if err != nil {
+		a.logger.Warn("carrying events not found, block not audited",
+			logger.Block, block.Index(),
+			logger.Round, block.RoundReceived(),
+			logger.Err, err)
+		return nil
+	}
+
+	ba := &BlockAudit{
+		BlockIndex:    block.Index(),
+		RoundReceived: block.RoundReceived(),
+		Entries:       make([]Entry, 0, len(txs)),
+	}
+
+	for i, tx := range txs {
+		if i >= len(carriers) {
+			break
+		}
+		fe := carriers[i]
+		ba.Entries = append(ba.Entries, Entry{
+			Offset:           i,
+			TxHash:           fmt.Sprintf("%X", txindex.Hash(tx)),
+			EventHex:         fe.Core.GetHex(),
+			Creator:          fe.Core.GetCreatorID(),
+			LamportTimestamp: fe.LamportTimestamp,
+			Round:            fe.Round,
+		})
+	}
+
+	data, err := json.Marshal(ba)
+	if err != nil {
+		return err
+	}
+
+	return a.db.Put(ctx, auditKey(block.Index()), data)
+}
+
+// Get returns the BlockAudit of a Block
+func (a *Auditor) Get(ctx context.Context, blockIndex int) (*BlockAudit, error) {
+	data, err := a.db.Get(ctx, auditKey(blockIndex))
+	if err != nil {
+		if err == db.ErrKeyNotFound {
+			return nil, errors.NewStoreErr("Audits", errors.KeyNotFound, strconv.Itoa(blockIndex))
+		}
+		return nil, err
+	}
+
+	ba := new(BlockAudit)
+	if err := json.Unmarshal(data, ba); err != nil {
+		return nil, err
+	}
+
+	return ba, nil
+}
+
+// Summary aggregates the BlockAudits of the Blocks from to to, both included,
+// per creator, sorted by creator. The Blocks which were not recorded are
+// skipped.
+func (a *Auditor) Summary(ctx context.Context, from, to int) ([]CreatorStats, error) {
+	if from < 0 || to < from {
+		return nil, fmt.Errorf("invalid range [%d, %d]", from, to)
+	}
+	if to-from+1 > MaxSummaryBlocks {
+		return nil, fmt.Errorf("range of %d blocks, at most %d", to-from+1, MaxSummaryBlocks)
+	}
+
+	stats := make(map[uint32]*CreatorStats)
+	sums := make(map[uint32]float64)
+
+	for i := from; i <= to; i++ {
+		ba, err := a.Get(ctx, i)
+		if err != nil {
+			if errors.Is(err, errors.KeyNotFound) {
+				continue
+			}
+			return nil, err
+		}
+
+		seen := make(map[uint32]bool)
+		for _, e := range ba.Entries {
+			s, ok := stats[e.Creator]
+			if !ok {
+				s = &CreatorStats{Creator: e.Creator}
+				stats[e.Creator] = s
+			}
+
+			s.Txs++
+			if !seen[e.Creator] {
+				s.Blocks++
+				seen[e.Creator] = true
+			}
+			//a lone transaction is neither first nor last
+			if len(ba.Entries) == 1 {
+				sums[e.Creator] += 0.5
+				continue
+			}
+			if e.Offset == 0 {
+				s.First++
+			}
+			sums[e.Creator] += float64(e.Offset) / float64(len(ba.Entries)-1)
+		}
+	}
+
+	res := make([]CreatorStats, 0, len(stats))
+	for c, s := range stats {
+		s.MeanPosition = sums[c] / float64(s.Txs)
+		res = append(res, *s)
+	}
+	sort.Slice(res, func(i, j int) bool { return res[i].Creator < res[j].Creator })
+
+	return res, nil
+}
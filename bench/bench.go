@@ -0,0 +1,279 @@
+package bench
+
+import (
+	"context"
+	"regexp"
+	"sync"
+	"testing"
+
+	"github.com/bolaxy/core/db"
+	"github.com/bolaxy/core/fuzz"
+	"github.com/bolaxy/core/hashgraph"
+	"github.com/bolaxy/core/store"
+	"github.com/bolaxy/core/types"
+)
+
+// Benchmark is a named benchmark function
+type Benchmark struct {
+	Name string
+	F    func(b *testing.B)
+}
+
+// Result is the result of a Benchmark
+type Result struct {
+	Name string
+	testing.BenchmarkResult
+}
+
+// Suite holds the benchmarks of a Load. The Load is generated, and run
+// through consensus, once for all the benchmarks, the first time it is
+// needed.
+type Suite struct {
+	load Load
+
+	once   sync.Once
+	err    error
+	net    *fuzz.Network
+	events []*types.Event
+	frames []*types.Frame
+}
+
+// NewSuite ...
+func NewSuite(load Load) *Suite {
+	return &Suite{load: load}
+}
+
+// Benchmarks returns the benchmarks of the hot paths
+func (s *Suite) Benchmarks() []Benchmark {
+	return []Benchmark{
+		{"EventHash", s.EventHash},
+		{"SignatureVerification", s.SignatureVerification},
+		{"StoreInsertInmem", s.StoreInsertInmem},
+		{"StoreInsertCached", s.StoreInsertCached},
+		{"BlockConstruction", s.BlockConstruction},
+		{"BlockPipeline", s.BlockPipeline},
+		{"Consensus", s.Consensus},
+	}
+}
+
+// Run runs the benchmarks whose name matches pattern, or all of them if
+// pattern is nil
+func (s *Suite) Run(pattern *regexp.Regexp) ([]Result, error) {
+	if err := s.prepare(); err != nil {
+		return nil, err
+	}
+
+	var res []Result
+	for _, bm := range s.Benchmarks() {
+		if pattern != nil && !pattern.MatchString(bm.Name) {
+			continue
+		}
+		res = append(res, Result{
+			Name:            bm.Name,
+			BenchmarkResult: testing.Benchmark(bm.F),
+		})
+	}
+	return res, nil
+}
+
+// prepare generates the Load, and runs it through consensus to record the
+// Frames of its Blocks
+func (s *Suite) prepare() error {
+	s.once.Do(func() {
+		s.net, s.events, s.err = s.load.Generate()
+		if s.err != nil {
+			return
+		}
+
+		var blocks []*types.Block
+		hg, err := s.hashgraph(func(ctx context.Context, b *types.Block) error {
+			blocks = append(blocks, b)
+			return nil
+		})
+		if err != nil {
+			s.err = err
+			return
+		}
+
+		if s.err = insert(hg, copyEvents(s.events)); s.err != nil {
+			return
+		}
+
+		for _, b := range blocks {
+			frame, err := hg.Store.GetFrame(b.RoundReceived())
+			if err != nil {
+				s.err = err
+				return
+			}
+			s.frames = append(s.frames, frame)
+		}
+	})
+	return s.err
+}
+
+// hashgraph returns a Hashgraph of the Network whose caches hold the whole
+// Load
+func (s *Suite) hashgraph(commit hashgraph.CommitCallback) (*hashgraph.Hashgraph, error) {
+	hg := hashgraph.NewHashgraph(store.NewInmemStore(len(s.events)+1), commit)
+	if err := hg.Init(s.net.Peers); err != nil {
+		return nil, err
+	}
+	return hg, nil
+}
+
+func insert(hg *hashgraph.Hashgraph, events []*types.Event) error {
+	for _, ev := range events {
+		if err := hg.InsertEvent(ev, true); err != nil {
+			return err
+		}
+	}
+	return hg.RunConsensus(context.Background())
+}
+
+// EventHash measures the hashing of Event bodies
+func (s *Suite) EventHash(b *testing.B) {
+	if err := s.prepare(); err != nil {
+		b.Fatal(err)
+	}
+	b.ReportAllocs()
+
+	for i := 0; i < b.N; i++ {
+		ev := &types.Event{Body: s.events[i%len(s.events)].Body}
+		if _, err := ev.GetHash(); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// SignatureVerification measures the verification of Event signatures
+func (s *Suite) SignatureVerification(b *testing.B) {
+	if err := s.prepare(); err != nil {
+		b.Fatal(err)
+	}
+	b.ReportAllocs()
+
+	for i := 0; i < b.N; i++ {
+		if ok, err := s.events[i%len(s.events)].Verify(); err != nil || !ok {
+			b.Fatalf("event %d: %v", i%len(s.events), err)
+		}
+	}
+}
+
+// StoreInsertInmem measures the insertion of Events in an InmemStore
+func (s *Suite) StoreInsertInmem(b *testing.B) {
+	s.storeInsert(b, func() (store.Store, error) {
+		return store.NewInmemStore(len(s.events) + 1), nil
+	})
+}
+
+// StoreInsertCached measures the insertion of Events in a CachedStore on top
+// of a MemDatabase, without its flushes
+func (s *Suite) StoreInsertCached(b *testing.B) {
+	s.storeInsert(b, func() (store.Store, error) {
+		return store.NewCachedStore(db.NewMemDatabase(), len(s.events)+1, 0, 0), nil
+	})
+}
+
+// storeInsert inserts the Events of the Load, in order, in Stores created by
+// newStore when all of them were inserted in the previous one
+func (s *Suite) storeInsert(b *testing.B, newStore func() (store.Store, error)) {
+	if err := s.prepare(); err != nil {
+		b.Fatal(err)
+	}
+	b.ReportAllocs()
+
+	var st store.Store
+	var events []*types.Event
+	for i := 0; i < b.N; i++ {
+		if i%len(s.events) == 0 {
+			b.StopTimer()
+			if st != nil {
+				st.Close()
+			}
+			var err error
+			if st, err = newStore(); err != nil {
+				b.Fatal(err)
+			}
+			if err := st.SetPeerSet(0, s.net.Peers); err != nil {
+				b.Fatal(err)
+			}
+			events = copyEvents(s.events)
+			b.StartTimer()
+		}
+
+		if err := st.SetEvent(events[i%len(s.events)]); err != nil {
+			b.Fatal(err)
+		}
+	}
+
+	b.StopTimer()
+	if st != nil {
+		st.Close()
+	}
+}
+
+// BlockConstruction measures the creation of Blocks from the Frames of the
+// Load
+func (s *Suite) BlockConstruction(b *testing.B) {
+	if err := s.prepare(); err != nil {
+		b.Fatal(err)
+	}
+	if len(s.frames) == 0 {
+		b.Skip("the load produces no blocks")
+	}
+	b.ReportAllocs()
+
+	for i := 0; i < b.N; i++ {
+		if _, err := types.NewBlocksFromFrame(i, s.frames[i%len(s.frames)], types.BlockLimits{}); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// BlockPipeline measures the creation of Blocks from the Frames of the Load
+// by a BlockPipeline of GOMAXPROCS workers, including the hashes of the Blocks
+func (s *Suite) BlockPipeline(b *testing.B) {
+	if err := s.prepare(); err != nil {
+		b.Fatal(err)
+	}
+	if len(s.frames) == 0 {
+		b.Skip("the load produces no blocks")
+	}
+	b.ReportAllocs()
+
+	p := types.NewBlockPipeline(0)
+	for i := 0; i < b.N; i++ {
+		if _, err := p.NewBlocksFromFrame(i, s.frames[i%len(s.frames)], types.BlockLimits{}); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// Consensus measures the insertion of Events in a Hashgraph, followed by the
+// consensus methods, per Event
+func (s *Suite) Consensus(b *testing.B) {
+	if err := s.prepare(); err != nil {
+		b.Fatal(err)
+	}
+	b.ReportAllocs()
+
+	ctx := context.Background()
+
+	var hg *hashgraph.Hashgraph
+	var events []*types.Event
+	for i := 0; i < b.N; i++ {
+		if i%len(s.events) == 0 {
+			b.StopTimer()
+			var err error
+			if hg, err = s.hashgraph(nil); err != nil {
+				b.Fatal(err)
+			}
+			events = copyEvents(s.events)
+			b.StartTimer()
+		}
+
+		if err := hg.InsertEventAndRunConsensus(ctx, events[i%len(s.events)], true); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
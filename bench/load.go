@@ -0,0 +1,116 @@
+// Package bench measures the hot paths of the consensus: event hashing,
+// signature verification, store insertion, and block construction, on
+// synthetic Event DAGs. The benchmarks are run with testing.Benchmark, by the
+// corebench command, so that they do not need a test binary.
+package bench
+
+import (
+	"fmt"
+	"math/rand"
+
+	"github.com/bolaxy/core/fuzz"
+	"github.com/bolaxy/core/types"
+	"github.com/bolaxy/crypto"
+)
+
+// Load describes a synthetic workload
+type Load struct {
+	Participants int
+	Events       int
+	// TxsPerEvent is the maximum number of transactions of an Event. The
+	// number of each Event is uniform between 0 and TxsPerEvent.
+	TxsPerEvent int
+	TxSize      int
+	Seed        int64
+}
+
+// DefaultLoad resembles a small network under moderate load
+func DefaultLoad() Load {
+	return Load{
+		Participants: 7,
+		Events:       2000,
+		TxsPerEvent:  20,
+		TxSize:       200,
+		Seed:         1,
+	}
+}
+
+// Generate returns the participants of the Load, and its Events in
+// topological order. Each Event is created by a random participant on top of
+// the last Event of another one, which is often the creator of the previous
+// Event, since gossip spreads the recent Events first. Inserted in order into
+// a Hashgraph of the Network, the Events make consensus progress.
+func (l Load) Generate() (*fuzz.Network, []*types.Event, error) {
+	if l.Participants < 2 {
+		return nil, nil, fmt.Errorf("load of %d participants", l.Participants)
+	}
+
+	net, err := fuzz.NewNetwork(l.Participants, l.Seed)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	r := rand.New(rand.NewSource(l.Seed))
+	n := l.Participants
+
+	last := make([]*types.Event, n)
+	events := make([]*types.Event, 0, l.Events)
+
+	prev := -1
+	for i := 0; i < l.Events; i++ {
+		creator := r.Intn(n)
+		other := (creator + 1 + r.Intn(n-1)) % n
+		if prev >= 0 && prev != creator && r.Intn(2) == 0 {
+			other = prev
+		}
+
+		selfParent, index := "", 0
+		if last[creator] != nil {
+			selfParent = last[creator].GetHex()
+			index = last[creator].Index() + 1
+		}
+		otherParent := ""
+		if last[other] != nil {
+			otherParent = last[other].GetHex()
+		}
+
+		txs := make([][]byte, r.Intn(l.TxsPerEvent+1))
+		for j := range txs {
+			txs[j] = make([]byte, l.TxSize)
+			r.Read(txs[j])
+		}
+
+		ev := types.NewEvent(txs,
+			nil,
+			nil,
+			[]string{selfParent, otherParent},
+			crypto.FromECDSAPub(&net.Keys[creator].PublicKey),
+			index)
+		if err := ev.Sign(net.Keys[creator]); err != nil {
+			return nil, nil, err
+		}
+		ev.GetHex()
+
+		last[creator] = ev
+		events = append(events, ev)
+		prev = creator
+	}
+
+	return net, events, nil
+}
+
+// copyEvents returns copies of Events which can be inserted into a
+// Hashgraph, which modifies them. The hashes are kept: they cover fields of
+// the Body which insertion sets.
+func copyEvents(events []*types.Event) []*types.Event {
+	res := make([]*types.Event, len(events))
+	for i, ev := range events {
+		res[i] = &types.Event{
+			Body:      ev.Body,
+			Signature: ev.Signature,
+			Hash:      ev.Hash,
+			Hex:       ev.Hex,
+		}
+	}
+	return res
+}
@@ -0,0 +1,178 @@
+// Command corebench runs the benchmarks of the hot paths of the consensus on a
+// synthetic load, without a test binary. The results can be saved, and
+// compared with saved results to catch regressions on machines without CI.
+//
+// Usage:
+//
+//	corebench [-bench regexp] [-benchtime d] [load flags]
+//	          [-cpuprofile file] [-memprofile file]
+//	          [-save file] [-baseline file [-threshold percent]]
+//
+// With -cpuprofile, the hot paths are labelled with their phase, which can be
+// selected with go tool pprof -tagfocus phase=<phase>. With -baseline, the
+// command fails if a benchmark is slower than its baseline by more than the
+// threshold.
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"regexp"
+	"runtime"
+	"runtime/pprof"
+	"testing"
+
+	"github.com/bolaxy/core/bench"
+	"github.com/bolaxy/core/profiling"
+)
+
+// baseline is the saved result of a benchmark
+type baseline struct {
+	Name        string
+	NsPerOp     int64
+	BytesPerOp  int64
+	AllocsPerOp int64
+}
+
+func main() {
+	//registers the flags read by testing.Benchmark, such as test.benchtime
+	testing.Init()
+
+	load := bench.DefaultLoad()
+	pattern := flag.String("bench", ".", "run the benchmarks matching the regexp")
+	benchTime := flag.String("benchtime", "1s", "run each benchmark for this duration, or Nx iterations")
+	flag.IntVar(&load.Participants, "participants", load.Participants, "participants of the load")
+	flag.IntVar(&load.Events, "events", load.Events, "events of the load")
+	flag.IntVar(&load.TxsPerEvent, "txs", load.TxsPerEvent, "maximum transactions per event")
+	flag.IntVar(&load.TxSize, "tx-size", load.TxSize, "size of the transactions")
+	flag.Int64Var(&load.Seed, "seed", load.Seed, "seed of the load")
+	cpuProfile := flag.String("cpuprofile", "", "write a labelled CPU profile to file")
+	memProfile := flag.String("memprofile", "", "write a heap profile to file")
+	save := flag.String("save", "", "save the results to file")
+	baselineFile := flag.String("baseline", "", "compare the results with the ones saved in file")
+	threshold := flag.Float64("threshold", 10, "tolerated slowdown against the baseline, in percent")
+	flag.Parse()
+
+	re, err := regexp.Compile(*pattern)
+	if err != nil {
+		fatalf("invalid -bench: %v", err)
+	}
+	if err := flag.Set("test.benchtime", *benchTime); err != nil {
+		fatalf("invalid -benchtime: %v", err)
+	}
+
+	if *cpuProfile != "" {
+		f, err := os.Create(*cpuProfile)
+		if err != nil {
+			fatalf("%v", err)
+		}
+		defer f.Close()
+
+		profiling.Enable(true)
+		if err := pprof.StartCPUProfile(f); err != nil {
+			fatalf("%v", err)
+		}
+	}
+
+	results, err := bench.NewSuite(load).Run(re)
+
+	if *cpuProfile != "" {
+		pprof.StopCPUProfile()
+	}
+	if err != nil {
+		fatalf("%v", err)
+	}
+
+	if *memProfile != "" {
+		if err := writeHeapProfile(*memProfile); err != nil {
+			fatalf("%v", err)
+		}
+	}
+
+	saved := make([]baseline, len(results))
+	for i, r := range results {
+		fmt.Printf("Benchmark%s\t%s\t%s\n", r.Name, r.String(), r.MemString())
+		saved[i] = baseline{
+			Name:        r.Name,
+			NsPerOp:     r.NsPerOp(),
+			BytesPerOp:  r.AllocedBytesPerOp(),
+			AllocsPerOp: r.AllocsPerOp(),
+		}
+	}
+
+	if *save != "" {
+		data, err := json.MarshalIndent(saved, "", "  ")
+		if err != nil {
+			fatalf("%v", err)
+		}
+		if err := ioutil.WriteFile(*save, data, 0644); err != nil {
+			fatalf("%v", err)
+		}
+	}
+
+	if *baselineFile != "" {
+		regressions, err := compare(*baselineFile, saved, *threshold)
+		if err != nil {
+			fatalf("%v", err)
+		}
+		if regressions > 0 {
+			fatalf("%d benchmarks regressed by more than %.1f%%", regressions, *threshold)
+		}
+	}
+}
+
+// compare prints the change of each result against the baseline, and returns
+// the number of results slower than the threshold
+func compare(file string, results []baseline, threshold float64) (int, error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return 0, err
+	}
+
+	var base []baseline
+	if err := json.Unmarshal(data, &base); err != nil {
+		return 0, fmt.Errorf("reading %s: %v", file, err)
+	}
+
+	byName := make(map[string]baseline, len(base))
+	for _, b := range base {
+		byName[b.Name] = b
+	}
+
+	regressions := 0
+	for _, r := range results {
+		b, ok := byName[r.Name]
+		if !ok || b.NsPerOp == 0 {
+			continue
+		}
+
+		delta := 100 * float64(r.NsPerOp-b.NsPerOp) / float64(b.NsPerOp)
+		status := "ok"
+		if delta > threshold {
+			status = "REGRESSION"
+			regressions++
+		}
+		fmt.Printf("%s\t%d -> %d ns/op\t%+.1f%%\t%s\n", r.Name, b.NsPerOp, r.NsPerOp, delta, status)
+	}
+
+	return regressions, nil
+}
+
+func writeHeapProfile(file string) error {
+	f, err := os.Create(file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	runtime.GC()
+	return pprof.WriteHeapProfile(f)
+}
+
+func fatalf(format string, args ...interface{}) {
+	fmt.Fprintf(os.Stderr, "corebench: "+format+"\n", args...)
+	os.Exit(1)
+}
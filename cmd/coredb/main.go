@@ -0,0 +1,341 @@
+// Command coredb inspects and maintains the database of a node. It must not
+// be run against the database of a running node, unless -readonly is set.
+// With -readonly, the database is opened read-only, or a copy of it is
+// opened when it is held by a running node or was not closed cleanly, and
+// the commands which write to it fail.
+//
+// Usage:
+//
+//	coredb -db <path> [-bodies <path>] [-readonly] <command> [flags]
+//
+// Commands:
+//
+//	event <hex>                     print an Event
+//	blocks [-from i] [-to j]        print a range of Blocks
+//	export [-format json|dot] [-from-round r] [-to-round r]
+//	                                export a range of rounds as a graph
+//	peersets                        print the PeerSet history
+//	record                          export the Events and Blocks as a stream
+//	replay [-stream file] [-stop]   re-run consensus on the Events of the
+//	                                database, or of a recorded stream, and
+//	                                compare the Blocks with the originals
+//	verify [-truncate]              check the consistency of the database
+//	prune -below-round r            delete Round and Frame records, and the
+//	                                external transaction bodies, below r,
+//	                                unless the database is archival
+//	compact [-discard-ratio f]      compact the database files
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+
+	"github.com/bolaxy/core/db"
+	"github.com/bolaxy/core/export"
+	"github.com/bolaxy/core/replay"
+	"github.com/bolaxy/core/store"
+)
+
+func main() {
+	dbPath := flag.String("db", "", "path of the badger database")
+	cacheSize := flag.Int("cache", 1000, "size of the store caches")
+	readOnly := flag.Bool("readonly", false, "open the database read-only")
+	bodiesPath := flag.String("bodies", "", "path of the database of the external transaction bodies, if not in -db")
+	flag.Usage = usage
+	flag.Parse()
+
+	if *dbPath == "" || flag.NArg() == 0 {
+		usage()
+		os.Exit(2)
+	}
+
+	var database *db.BadgerDatabase
+	var err error
+	if *readOnly {
+		database, err = db.OpenBadgerReadOnly(*dbPath, true)
+	} else {
+		database, err = db.NewBadgerDatabase(*dbPath)
+	}
+	if err != nil {
+		fatalf("opening %s: %v", *dbPath, err)
+	}
+
+	cmd, args := flag.Arg(0), flag.Args()[1:]
+
+	//compact works on the raw database
+	if cmd == "compact" {
+		err = compact(database, args)
+		if cerr := database.Close(); err == nil {
+			err = cerr
+		}
+		if err != nil {
+			fatalf("%v", err)
+		}
+		return
+	}
+
+	s := store.NewCachedStore(database, *cacheSize, 0, 0)
+
+	var bodies *db.BadgerDatabase
+	if *bodiesPath != "" {
+		if *readOnly {
+			bodies, err = db.OpenBadgerReadOnly(*bodiesPath, true)
+		} else {
+			bodies, err = db.NewBadgerDatabase(*bodiesPath)
+		}
+		if err != nil {
+			fatalf("opening %s: %v", *bodiesPath, err)
+		}
+		s.SetExternalBodies(bodies, 0)
+	}
+
+	switch cmd {
+	case "event":
+		err = dumpEvent(s, args)
+	case "blocks":
+		err = listBlocks(s, args)
+	case "export":
+		err = exportGraph(s, args)
+	case "peersets":
+		err = peerSets(s)
+	case "record":
+		err = record(s)
+	case "replay":
+		err = replayEvents(s, args)
+	case "verify":
+		err = verify(s, args)
+	case "prune":
+		err = prune(s, args)
+	default:
+		usage()
+		s.Close()
+		if bodies != nil {
+			bodies.Close()
+		}
+		os.Exit(2)
+	}
+
+	if cerr := s.Close(); err == nil {
+		err = cerr
+	}
+	if bodies != nil {
+		if cerr := bodies.Close(); err == nil {
+			err = cerr
+		}
+	}
+	if err != nil {
+		fatalf("%v", err)
+	}
+}
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "usage: coredb -db <path> [-bodies <path>] [-readonly] <event|blocks|export|peersets|record|replay|verify|prune|compact> [flags]\n")
+	flag.PrintDefaults()
+}
+
+func fatalf(format string, args ...interface{}) {
+	fmt.Fprintf(os.Stderr, "coredb: "+format+"\n", args...)
+	os.Exit(1)
+}
+
+func printJSON(w io.Writer, v interface{}) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(v)
+}
+
+func dumpEvent(s *store.CachedStore, args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("usage: event <hex>")
+	}
+
+	event, err := s.GetEvent(args[0])
+	if err != nil {
+		return err
+	}
+
+	return printJSON(os.Stdout, event)
+}
+
+func listBlocks(s *store.CachedStore, args []string) error {
+	fs := flag.NewFlagSet("blocks", flag.ExitOnError)
+	from := fs.Int("from", 0, "first block index")
+	to := fs.Int("to", -1, "last block index; -1 for the last checkpointed block")
+	fs.Parse(args)
+
+	last := *to
+	if last < 0 {
+		cp, err := s.LastCheckpoint()
+		if err != nil {
+			return err
+		}
+		last = cp.LastBlockIndex
+	}
+
+	for i := *from; i <= last; i++ {
+		block, err := s.GetBlock(i)
+		if err != nil {
+			return err
+		}
+		if err := printJSON(os.Stdout, block); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func exportGraph(s *store.CachedStore, args []string) error {
+	fs := flag.NewFlagSet("export", flag.ExitOnError)
+	format := fs.String("format", "json", "json or dot")
+	from := fs.Int("from-round", 0, "first exported round")
+	to := fs.Int("to-round", -1, "last exported round; -1 for the last checkpointed round")
+	fs.Parse(args)
+
+	last := *to
+	if last < 0 {
+		cp, err := s.LastCheckpoint()
+		if err != nil {
+			return err
+		}
+		last = cp.LastRound
+	}
+
+	g, err := export.Build(s, export.Options{FromRound: *from, ToRound: last})
+	if err != nil {
+		return err
+	}
+
+	switch *format {
+	case "json":
+		return g.WriteJSON(os.Stdout)
+	case "dot":
+		return g.WriteDOT(os.Stdout)
+	default:
+		return fmt.Errorf("unknown format %q", *format)
+	}
+}
+
+func peerSets(s *store.CachedStore) error {
+	history, err := s.PeerSetHistory()
+	if err != nil {
+		return err
+	}
+
+	rounds := make([]int, 0, len(history))
+	for r := range history {
+		rounds = append(rounds, r)
+	}
+	sort.Ints(rounds)
+
+	for _, r := range rounds {
+		fmt.Printf("round %d: %d peers\n", r, len(history[r]))
+		for _, p := range history[r] {
+			fmt.Printf("  %d %s\n", p.ID(), p.PubKeyString())
+		}
+	}
+
+	return nil
+}
+
+func record(s *store.CachedStore) error {
+	rec, err := replay.FromStore(s)
+	if err != nil {
+		return err
+	}
+
+	return rec.Write(os.Stdout)
+}
+
+func replayEvents(s *store.CachedStore, args []string) error {
+	fs := flag.NewFlagSet("replay", flag.ExitOnError)
+	stream := fs.String("stream", "", "replay a stream written by record instead of the database")
+	stop := fs.Bool("stop", false, "stop at the first divergent block")
+	fs.Parse(args)
+
+	var rec *replay.Recording
+	var err error
+	if *stream != "" {
+		f, ferr := os.Open(*stream)
+		if ferr != nil {
+			return ferr
+		}
+		rec, err = replay.Read(f)
+		f.Close()
+	} else {
+		rec, err = replay.FromStore(s)
+	}
+	if err != nil {
+		return err
+	}
+
+	opts := replay.DefaultOptions()
+	opts.StopAtDivergence = *stop
+
+	report, err := replay.Run(context.Background(), rec, opts)
+	if err != nil {
+		return err
+	}
+
+	if err := printJSON(os.Stdout, report); err != nil {
+		return err
+	}
+
+	if !report.OK() {
+		return fmt.Errorf("%d divergent and %d missing blocks", len(report.Divergences), len(report.Missing))
+	}
+
+	return nil
+}
+
+func verify(s *store.CachedStore, args []string) error {
+	fs := flag.NewFlagSet("verify", flag.ExitOnError)
+	truncate := fs.Bool("truncate", false, "delete the blocks after the last consistent block")
+	fs.Parse(args)
+
+	report, err := s.Verify(store.VerifyOptions{Truncate: *truncate})
+	if err != nil {
+		return err
+	}
+
+	if err := printJSON(os.Stdout, report); err != nil {
+		return err
+	}
+
+	if !report.OK() && !*truncate {
+		return fmt.Errorf("%d corruptions found", len(report.Corruptions))
+	}
+
+	return nil
+}
+
+func prune(s *store.CachedStore, args []string) error {
+	fs := flag.NewFlagSet("prune", flag.ExitOnError)
+	below := fs.Int("below-round", -1, "delete Round and Frame records below this round")
+	fs.Parse(args)
+
+	if *below < 0 {
+		return fmt.Errorf("prune: -below-round is required")
+	}
+
+	n, err := s.Prune(*below)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("deleted %d records\n", n)
+	return nil
+}
+
+func compact(database *db.BadgerDatabase, args []string) error {
+	fs := flag.NewFlagSet("compact", flag.ExitOnError)
+	ratio := fs.Float64("discard-ratio", 0.5, "rewrite value log files with at least this fraction of stale data")
+	fs.Parse(args)
+
+	return database.Compact(*ratio)
+}
@@ -1,14 +1,29 @@
 package db
 
 import (
+	"context"
+	"errors"
+	"os"
+	"sync"
+
 	"github.com/dgraph-io/badger"
 )
 
 var ErrKeyNotFound = badger.ErrKeyNotFound
 
+//ErrClosed is returned by the operations issued after Close
+var ErrClosed = errors.New("database is closed")
+
 type BadgerDatabase struct {
-	db *badger.DB
-	fn string
+	db       *badger.DB
+	fn       string
+	readOnly bool
+	tmpDir   string //copy opened by OpenBadgerReadOnly, removed on Close
+
+	//Close waits for the operations in progress, and later operations fail
+	//with ErrClosed
+	closeLock sync.RWMutex
+	closed    bool
 }
 
 //NewBadgerDatabase opens an existing database or creates a new one if nothing is
@@ -31,21 +46,72 @@ func NewBadgerDatabase(path string) (*BadgerDatabase, error) {
 }
 
 func (db *BadgerDatabase) Close() error {
-	return db.db.Close()
+	db.closeLock.Lock()
+	defer db.closeLock.Unlock()
+
+	if db.closed {
+		return nil
+	}
+	db.closed = true
+
+	err := db.db.Close()
+	if db.tmpDir != "" {
+		os.RemoveAll(db.tmpDir)
+	}
+	return err
+}
+
+func (db *BadgerDatabase) ReadOnly() bool {
+	return db.readOnly
 }
 
 func (db *BadgerDatabase) DBPath() string {
 	return db.fn
 }
 
-func (db *BadgerDatabase) Put(key, val []byte) error {
+//acquire checks ctx and prevents Close until release is called
+func (db *BadgerDatabase) acquire(ctx context.Context) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	db.closeLock.RLock()
+	if db.closed {
+		db.closeLock.RUnlock()
+		return ErrClosed
+	}
+
+	return nil
+}
+
+func (db *BadgerDatabase) release() {
+	db.closeLock.RUnlock()
+}
+
+func (db *BadgerDatabase) Put(ctx context.Context, key, val []byte) error {
+	if db.readOnly {
+		return ErrReadOnly
+	}
+
+	if err := db.acquire(ctx); err != nil {
+		return err
+	}
+	defer db.release()
+
 	return db.db.Update(func(txn *badger.Txn) error {
 		return txn.Set(key, val)
 	})
 }
 
-func (db *BadgerDatabase) Get(key []byte) ([]byte, error) {
+func (db *BadgerDatabase) Get(ctx context.Context, key []byte) ([]byte, error) {
+	if err := db.acquire(ctx); err != nil {
+		return nil, err
+	}
+	defer db.release()
+
 	txn := db.db.NewTransaction(false)
+	defer txn.Discard()
+
 	item, err := txn.Get(key)
 	if err != nil {
 		return nil, err
@@ -54,8 +120,15 @@ func (db *BadgerDatabase) Get(key []byte) ([]byte, error) {
 	return item.ValueCopy(nil)
 }
 
-func (db *BadgerDatabase) Has(key []byte) (bool, error) {
+func (db *BadgerDatabase) Has(ctx context.Context, key []byte) (bool, error) {
+	if err := db.acquire(ctx); err != nil {
+		return false, err
+	}
+	defer db.release()
+
 	txn := db.db.NewTransaction(false)
+	defer txn.Discard()
+
 	_, err := txn.Get(key)
 	if err != nil {
 		if err == badger.ErrKeyNotFound {
@@ -68,7 +141,16 @@ func (db *BadgerDatabase) Has(key []byte) (bool, error) {
 	return true, nil
 }
 
-func (db *BadgerDatabase) Delete(key []byte) error {
+func (db *BadgerDatabase) Delete(ctx context.Context, key []byte) error {
+	if db.readOnly {
+		return ErrReadOnly
+	}
+
+	if err := db.acquire(ctx); err != nil {
+		return err
+	}
+	defer db.release()
+
 	return db.db.Update(func(txn *badger.Txn) error {
 		return txn.Delete(key)
 	})
@@ -83,7 +165,10 @@ func (db *BadgerDatabase) NewIterator(reverse bool) Iterator {
 }
 
 func (db *BadgerDatabase) NewBatch() Batch {
-	return &BadgerBatch{db.db.NewWriteBatch()}
+	if db.readOnly {
+		return readOnlyBatch{}
+	}
+	return &BadgerBatch{batch: db.db.NewWriteBatch(), db: db}
 }
 
 type BadgerIterator struct {
@@ -120,6 +205,7 @@ func (it *BadgerIterator) Rewind() {
 
 type BadgerBatch struct {
 	batch *badger.WriteBatch
+	db    *BadgerDatabase
 }
 
 func (batch *BadgerBatch) Set(key, value []byte) error {
@@ -130,7 +216,13 @@ func (batch *BadgerBatch) Delete(key []byte) error {
 	return batch.batch.Delete(key)
 }
 
-func (batch *BadgerBatch) Commit() error {
+func (batch *BadgerBatch) Commit(ctx context.Context) error {
+	if err := batch.db.acquire(ctx); err != nil {
+		batch.batch.Cancel()
+		return err
+	}
+	defer batch.db.release()
+
 	return batch.batch.Flush()
 }
 
@@ -149,3 +241,58 @@ type item struct {
 func (i *item) Value() ([]byte, error) {
 	return i.Item.ValueCopy(nil)
 }
+
+//Compact flattens the LSM tree and garbage-collects the value log until
+//there is nothing left to rewrite. It is meant to be run offline.
+func (db *BadgerDatabase) Compact(discardRatio float64) error {
+	if db.readOnly {
+		return ErrReadOnly
+	}
+
+	if err := db.db.Flatten(1); err != nil {
+		return err
+	}
+
+	for {
+		err := db.db.RunValueLogGC(discardRatio)
+		if err == badger.ErrNoRewrite {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+//Stats describes the LSM tree and the value log of a BadgerDatabase
+type Stats struct {
+	LSMSize  int64
+	VLogSize int64
+	//Levels is the number of tables of each level of the LSM tree
+	Levels []int
+	//Level0Stall is the number of level 0 tables at which the writes stall
+	//until the compaction catches up
+	Level0Stall int
+}
+
+//Stats returns ErrClosed once the database is closed
+func (db *BadgerDatabase) Stats() (Stats, error) {
+	if err := db.acquire(context.Background()); err != nil {
+		return Stats{}, err
+	}
+	defer db.release()
+
+	stats := Stats{
+		Level0Stall: badger.DefaultOptions("").NumLevelZeroTablesStall,
+	}
+	stats.LSMSize, stats.VLogSize = db.db.Size()
+
+	for _, t := range db.db.Tables(false) {
+		for len(stats.Levels) <= t.Level {
+			stats.Levels = append(stats.Levels, 0)
+		}
+		stats.Levels[t.Level]++
+	}
+
+	return stats, nil
+}
@@ -0,0 +1,246 @@
+package db
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"errors"
+	"strconv"
+	"sync"
+
+	"github.com/bolaxy/crypto"
+)
+
+const (
+	blobPrefix    = "blob_"
+	blobRefPrefix = "blobref_"
+)
+
+// ErrBlobCorrupted is returned by BlobStore.Get for a blob whose content does
+// not match its hash
+var ErrBlobCorrupted = errors.New("blob does not match its hash")
+
+// BlobStore is a content-addressed store of blobs on top of a Sinker. A blob
+// is keyed by the Keccak256 hash of its content, so the owners which Put the
+// same content share it. Each Put adds a reference to the blob, which its
+// owner gives back with Release; GC deletes the blobs left without
+// references. The Sinker can be a Partition of a larger db.
+type BlobStore struct {
+	sinker Sinker
+	lock   sync.Mutex //serialises the updates of the reference counts
+}
+
+// NewBlobStore ...
+func NewBlobStore(sinker Sinker) *BlobStore {
+	return &BlobStore{sinker: sinker}
+}
+
+func blobKey(hash []byte) []byte {
+	return []byte(blobPrefix + hex.EncodeToString(hash))
+}
+
+func blobRefKey(hash []byte) []byte {
+	return []byte(blobRefPrefix + hex.EncodeToString(hash))
+}
+
+// Put stores data, if it is not stored yet, adds a reference to it and
+// returns its hash
+func (b *BlobStore) Put(ctx context.Context, data []byte) ([]byte, error) {
+	hash := crypto.Keccak256(data)
+
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	refs, err := b.refs(ctx, hash)
+	if err != nil {
+		return nil, err
+	}
+
+	batch := b.sinker.NewBatch()
+	//a blob released to 0 but not collected yet is still there
+	if ok, err := b.sinker.Has(ctx, blobKey(hash)); err != nil || !ok {
+		if err != nil {
+			batch.Cancel()
+			return nil, err
+		}
+		if err := batch.Set(blobKey(hash), data); err != nil {
+			batch.Cancel()
+			return nil, err
+		}
+	}
+	if err := batch.Set(blobRefKey(hash), []byte(strconv.Itoa(refs+1))); err != nil {
+		batch.Cancel()
+		return nil, err
+	}
+
+	if err := batch.Commit(ctx); err != nil {
+		return nil, err
+	}
+
+	return hash, nil
+}
+
+// Get returns the blob of a hash, or ErrKeyNotFound
+func (b *BlobStore) Get(ctx context.Context, hash []byte) ([]byte, error) {
+	data, err := b.sinker.Get(ctx, blobKey(hash))
+	if err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(crypto.Keccak256(data), hash) {
+		return nil, ErrBlobCorrupted
+	}
+	return data, nil
+}
+
+// Has ...
+func (b *BlobStore) Has(ctx context.Context, hash []byte) (bool, error) {
+	return b.sinker.Has(ctx, blobKey(hash))
+}
+
+// Ref adds a reference to a stored blob, or returns ErrKeyNotFound
+func (b *BlobStore) Ref(ctx context.Context, hash []byte) error {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	ok, err := b.sinker.Has(ctx, blobKey(hash))
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return ErrKeyNotFound
+	}
+
+	refs, err := b.refs(ctx, hash)
+	if err != nil {
+		return err
+	}
+
+	return b.sinker.Put(ctx, blobRefKey(hash), []byte(strconv.Itoa(refs+1)))
+}
+
+// Release gives back a reference to a blob. The blob is deleted by the next
+// GC once it has no reference left, unless it is Put again meanwhile.
+// Releasing a blob without references is a no-op.
+func (b *BlobStore) Release(ctx context.Context, hash []byte) error {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	refs, err := b.refs(ctx, hash)
+	if err != nil {
+		return err
+	}
+	if refs == 0 {
+		return nil
+	}
+
+	return b.sinker.Put(ctx, blobRefKey(hash), []byte(strconv.Itoa(refs-1)))
+}
+
+// Refs returns the number of references to a blob
+func (b *BlobStore) Refs(ctx context.Context, hash []byte) (int, error) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return b.refs(ctx, hash)
+}
+
+func (b *BlobStore) refs(ctx context.Context, hash []byte) (int, error) {
+	data, err := b.sinker.Get(ctx, blobRefKey(hash))
+	if err == ErrKeyNotFound {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	return strconv.Atoi(string(data))
+}
+
+// Delete removes a blob whatever its references, like when all its owners
+// are gone
+func (b *BlobStore) Delete(ctx context.Context, hash []byte) error {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	batch := b.sinker.NewBatch()
+	if err := batch.Delete(blobKey(hash)); err != nil {
+		batch.Cancel()
+		return err
+	}
+	if err := batch.Delete(blobRefKey(hash)); err != nil {
+		batch.Cancel()
+		return err
+	}
+	return batch.Commit(ctx)
+}
+
+// Each calls fn with the hash and the references of every blob, until fn
+// returns an error. It must not be called from fn.
+func (b *BlobStore) Each(ctx context.Context, fn func(hash []byte, refs int) error) error {
+	hashes := [][]byte{}
+
+	prefix := []byte(blobPrefix)
+	it := b.sinker.NewIterator(false)
+	for it.Seek(prefix); it.ValidForPrefix(prefix); it.Next() {
+		hash, err := hex.DecodeString(string(it.Item().Key()[len(prefix):]))
+		if err != nil {
+			continue
+		}
+		hashes = append(hashes, hash)
+	}
+	it.Close()
+
+	for _, hash := range hashes {
+		refs, err := b.Refs(ctx, hash)
+		if err != nil {
+			return err
+		}
+		if err := fn(hash, refs); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// GC deletes the blobs without references, and returns their number
+func (b *BlobStore) GC(ctx context.Context) (int, error) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	keys := [][]byte{}
+
+	prefix := []byte(blobPrefix)
+	it := b.sinker.NewIterator(false)
+	for it.Seek(prefix); it.ValidForPrefix(prefix); it.Next() {
+		hash, err := hex.DecodeString(string(it.Item().Key()[len(prefix):]))
+		if err != nil {
+			continue
+		}
+		refs, err := b.refs(ctx, hash)
+		if err != nil {
+			it.Close()
+			return 0, err
+		}
+		if refs == 0 {
+			keys = append(keys, blobKey(hash), blobRefKey(hash))
+		}
+	}
+	it.Close()
+
+	if len(keys) == 0 {
+		return 0, nil
+	}
+
+	batch := b.sinker.NewBatch()
+	for _, k := range keys {
+		if err := batch.Delete(k); err != nil {
+			batch.Cancel()
+			return 0, err
+		}
+	}
+
+	if err := batch.Commit(ctx); err != nil {
+		return 0, err
+	}
+
+	return len(keys) / 2, nil
+}
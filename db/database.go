@@ -1,16 +1,23 @@
 package db
 
+import "context"
+
 const IdealBatchSize = 25
 
+// Sinker is a key-value database. The context of an operation is checked
+// before it starts, so that operations issued after a shutdown began fail
+// with the context's error instead of racing with Close.
 type Sinker interface {
-	Put(key, val []byte) error
-	Get(key []byte) ([]byte, error)
-	Has(key []byte) (bool, error)
-	Delete(key []byte) error
+	Put(ctx context.Context, key, val []byte) error
+	Get(ctx context.Context, key []byte) ([]byte, error)
+	Has(ctx context.Context, key []byte) (bool, error)
+	Delete(ctx context.Context, key []byte) error
 	NewIterator(reverse bool) Iterator
 	NewBatch() Batch
 	Close() error
 	DBPath() string
+	// ReadOnly is true when writes are refused with ErrReadOnly
+	ReadOnly() bool
 }
 
 type Iterator interface {
@@ -31,17 +38,18 @@ type Item interface {
 type Batch interface {
 	Set(key, value []byte) error
 	Delete(key []byte) error
-	Commit() error
+	// Commit writes the batch. If ctx is done, the batch is cancelled instead.
+	Commit(ctx context.Context) error
 	Cancel()
 	SetMaxPendingTxns(max int)
 }
 
 // Putter wraps the database write operation supported by both batches and regular databases.
 type Putter interface {
-	Put(key []byte, value []byte) error
+	Put(ctx context.Context, key []byte, value []byte) error
 }
 
 // Deleter wraps the database delete operation supported by both batches and regular databases.
 type Deleter interface {
-	Delete(key []byte) error
+	Delete(ctx context.Context, key []byte) error
 }
\ No newline at end of file
@@ -1,7 +1,9 @@
 package db
 
 import (
-	"errors"
+	"bytes"
+	"context"
+	"sort"
 	"sync"
 
 	"github.com/bolaxy/common"
@@ -16,8 +18,30 @@ func (db *MemDatabase) Close() error {
 	return nil
 }
 
+// NewIterator iterates over a snapshot of the database taken when it is
+// created. Like badger's, a reverse iterator seeks to the largest key smaller
+// than or equal to the given key.
 func (db *MemDatabase) NewIterator(reverse bool) Iterator {
-	panic("implement me")
+	db.lock.RLock()
+	defer db.lock.RUnlock()
+
+	items := make([]memItem, 0, len(db.db))
+	for k, v := range db.db {
+		items = append(items, memItem{key: []byte(k), value: v})
+	}
+
+	sort.Slice(items, func(i, j int) bool {
+		if reverse {
+			return bytes.Compare(items[i].key, items[j].key) > 0
+		}
+		return bytes.Compare(items[i].key, items[j].key) < 0
+	})
+
+	return &memIterator{items: items, reverse: reverse}
+}
+
+func (db *MemDatabase) ReadOnly() bool {
+	return false
 }
 
 func (db *MemDatabase) DBPath() string {
@@ -36,7 +60,11 @@ func NewMemDatabaseWithCap(size int) *MemDatabase {
 	}
 }
 
-func (db *MemDatabase) Put(key []byte, value []byte) error {
+func (db *MemDatabase) Put(ctx context.Context, key []byte, value []byte) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
 	db.lock.Lock()
 	defer db.lock.Unlock()
 
@@ -44,7 +72,11 @@ func (db *MemDatabase) Put(key []byte, value []byte) error {
 	return nil
 }
 
-func (db *MemDatabase) Has(key []byte) (bool, error) {
+func (db *MemDatabase) Has(ctx context.Context, key []byte) (bool, error) {
+	if err := ctx.Err(); err != nil {
+		return false, err
+	}
+
 	db.lock.RLock()
 	defer db.lock.RUnlock()
 
@@ -52,14 +84,18 @@ func (db *MemDatabase) Has(key []byte) (bool, error) {
 	return ok, nil
 }
 
-func (db *MemDatabase) Get(key []byte) ([]byte, error) {
+func (db *MemDatabase) Get(ctx context.Context, key []byte) ([]byte, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
 	db.lock.RLock()
 	defer db.lock.RUnlock()
 
 	if entry, ok := db.db[string(key)]; ok {
 		return common.CopyBytes(entry), nil
 	}
-	return nil, errors.New("not found")
+	return nil, ErrKeyNotFound
 }
 
 func (db *MemDatabase) Keys() [][]byte {
@@ -73,7 +109,11 @@ func (db *MemDatabase) Keys() [][]byte {
 	return keys
 }
 
-func (db *MemDatabase) Delete(key []byte) error {
+func (db *MemDatabase) Delete(ctx context.Context, key []byte) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
 	db.lock.Lock()
 	defer db.lock.Unlock()
 
@@ -112,7 +152,11 @@ func (b *memBatch) Delete(key []byte) error {
 	return nil
 }
 
-func (b *memBatch) Commit() error {
+func (b *memBatch) Commit(ctx context.Context) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
 	b.db.lock.Lock()
 	defer b.db.lock.Unlock()
 
@@ -127,3 +171,48 @@ func (b *memBatch) Commit() error {
 }
 
 func (b *memBatch) Cancel() {}
+
+type memItem struct {
+	key, value []byte
+}
+
+func (i *memItem) Key() []byte { return i.key }
+
+func (i *memItem) Value() ([]byte, error) { return common.CopyBytes(i.value), nil }
+
+type memIterator struct {
+	items   []memItem
+	pos     int
+	reverse bool
+}
+
+func (it *memIterator) Item() Item {
+	return &it.items[it.pos]
+}
+
+func (it *memIterator) Valid() bool {
+	return it.pos >= 0 && it.pos < len(it.items)
+}
+
+func (it *memIterator) ValidForPrefix(prefix []byte) bool {
+	return it.Valid() && bytes.HasPrefix(it.items[it.pos].key, prefix)
+}
+
+func (it *memIterator) Close() {}
+
+func (it *memIterator) Next() {
+	it.pos++
+}
+
+func (it *memIterator) Seek(key []byte) {
+	it.pos = sort.Search(len(it.items), func(i int) bool {
+		if it.reverse {
+			return bytes.Compare(it.items[i].key, key) <= 0
+		}
+		return bytes.Compare(it.items[i].key, key) >= 0
+	})
+}
+
+func (it *memIterator) Rewind() {
+	it.pos = 0
+}
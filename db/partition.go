@@ -0,0 +1,174 @@
+package db
+
+import (
+	"context"
+)
+
+// Partition is a Sinker whose keys are stored under a prefix of a parent
+// Sinker, so that several consensus instances can share one database. The
+// keys it returns are stripped of the prefix. Closing a Partition does not
+// close the parent, which is owned by the caller.
+type Partition struct {
+	parent Sinker
+	prefix []byte
+}
+
+// NewPartition returns the Partition of parent under prefix. An empty prefix
+// gives access to the whole parent, except Close.
+func NewPartition(parent Sinker, prefix string) *Partition {
+	return &Partition{
+		parent: parent,
+		prefix: []byte(prefix),
+	}
+}
+
+// Prefix ...
+func (p *Partition) Prefix() string {
+	return string(p.prefix)
+}
+
+func (p *Partition) key(key []byte) []byte {
+	res := make([]byte, 0, len(p.prefix)+len(key))
+	return append(append(res, p.prefix...), key...)
+}
+
+// Put ...
+func (p *Partition) Put(ctx context.Context, key, val []byte) error {
+	return p.parent.Put(ctx, p.key(key), val)
+}
+
+// Get ...
+func (p *Partition) Get(ctx context.Context, key []byte) ([]byte, error) {
+	return p.parent.Get(ctx, p.key(key))
+}
+
+// Has ...
+func (p *Partition) Has(ctx context.Context, key []byte) (bool, error) {
+	return p.parent.Has(ctx, p.key(key))
+}
+
+// Delete ...
+func (p *Partition) Delete(ctx context.Context, key []byte) error {
+	return p.parent.Delete(ctx, p.key(key))
+}
+
+// NewIterator returns an Iterator over the keys of the Partition
+func (p *Partition) NewIterator(reverse bool) Iterator {
+	return &partitionIterator{
+		it:      p.parent.NewIterator(reverse),
+		p:       p,
+		reverse: reverse,
+	}
+}
+
+// NewBatch ...
+func (p *Partition) NewBatch() Batch {
+	return &partitionBatch{batch: p.parent.NewBatch(), p: p}
+}
+
+// Close does nothing: the parent is closed by its owner
+func (p *Partition) Close() error {
+	return nil
+}
+
+// DBPath returns the path of the parent
+func (p *Partition) DBPath() string {
+	return p.parent.DBPath()
+}
+
+// ReadOnly ...
+func (p *Partition) ReadOnly() bool {
+	return p.parent.ReadOnly()
+}
+
+type partitionIterator struct {
+	it      Iterator
+	p       *Partition
+	reverse bool
+}
+
+func (it *partitionIterator) Item() Item {
+	return partitionItem{it.it.Item(), len(it.p.prefix)}
+}
+
+func (it *partitionIterator) Valid() bool {
+	return it.it.ValidForPrefix(it.p.prefix)
+}
+
+func (it *partitionIterator) ValidForPrefix(prefix []byte) bool {
+	return it.it.ValidForPrefix(it.p.key(prefix))
+}
+
+func (it *partitionIterator) Close() {
+	it.it.Close()
+}
+
+func (it *partitionIterator) Next() {
+	it.it.Next()
+}
+
+func (it *partitionIterator) Seek(key []byte) {
+	it.it.Seek(it.p.key(key))
+}
+
+// Rewind moves to the first key of the Partition, or to its last key in
+// reverse
+func (it *partitionIterator) Rewind() {
+	if len(it.p.prefix) == 0 {
+		it.it.Rewind()
+		return
+	}
+	if !it.reverse {
+		it.it.Seek(it.p.prefix)
+		return
+	}
+
+	//the smallest key after all the keys of the prefix
+	end := append([]byte{}, it.p.prefix...)
+	for i := len(end) - 1; i >= 0; i-- {
+		if end[i] < 0xff {
+			end[i]++
+			it.it.Seek(end[:i+1])
+			return
+		}
+	}
+	it.it.Rewind()
+}
+
+type partitionItem struct {
+	item   Item
+	prefix int
+}
+
+func (i partitionItem) Key() []byte {
+	return i.item.Key()[i.prefix:]
+}
+
+func (i partitionItem) Value() ([]byte, error) {
+	return i.item.Value()
+}
+
+type partitionBatch struct {
+	batch Batch
+	p     *Partition
+}
+
+func (b *partitionBatch) Set(key, value []byte) error {
+	return b.batch.Set(b.p.key(key), value)
+}
+
+func (b *partitionBatch) Delete(key []byte) error {
+	return b.batch.Delete(b.p.key(key))
+}
+
+func (b *partitionBatch) Commit(ctx context.Context) error {
+	return b.batch.Commit(ctx)
+}
+
+func (b *partitionBatch) Cancel() {
+	b.batch.Cancel()
+}
+
+func (b *partitionBatch) SetMaxPendingTxns(max int) {
+	b.batch.SetMaxPendingTxns(max)
+}
@@ -0,0 +1,142 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/dgraph-io/badger"
+)
+
+// ErrReadOnly is returned by the write operations of a read-only Sinker
+var ErrReadOnly = errors.New("database is read-only")
+
+// OpenBadgerReadOnly opens the database in path for reading only. Badger can
+// open a database read-only only if no process holds it and it was closed
+// cleanly. Otherwise, if copyOnFail is true, the files are copied to a
+// temporary directory where the database is recovered, and the copy is
+// opened instead. This gives access to the database of a running or crashed
+// node, as of the time of the copy. The copy is removed on Close.
+func OpenBadgerReadOnly(path string, copyOnFail bool) (*BadgerDatabase, error) {
+	if _, err := os.Stat(path); err != nil {
+		return nil, err
+	}
+
+	opts := badger.DefaultOptions(path).
+		WithReadOnly(true).
+		WithLogger(nil)
+	handle, err := badger.Open(opts)
+	if err == nil {
+		return &BadgerDatabase{
+			db:       handle,
+			fn:       path,
+			readOnly: true,
+		}, nil
+	}
+	if !copyOnFail {
+		return nil, err
+	}
+
+	tmpDir, err := ioutil.TempDir("", "badger-readonly-")
+	if err != nil {
+		return nil, err
+	}
+
+	if err := copyDBFiles(path, tmpDir); err != nil {
+		os.RemoveAll(tmpDir)
+		return nil, err
+	}
+
+	opts = badger.DefaultOptions(tmpDir).
+		WithTruncate(true).
+		WithLogger(nil)
+	handle, err = badger.Open(opts)
+	if err != nil {
+		os.RemoveAll(tmpDir)
+		return nil, err
+	}
+
+	return &BadgerDatabase{
+		db:       handle,
+		fn:       path,
+		readOnly: true,
+		tmpDir:   tmpDir,
+	}, nil
+}
+
+// copyDBFiles copies the regular files of a badger directory, except the lock
+// file of the process holding it
+func copyDBFiles(src, dst string) error {
+	infos, err := ioutil.ReadDir(src)
+	if err != nil {
+		return err
+	}
+
+	for _, info := range infos {
+		if !info.Mode().IsRegular() || info.Name() == "LOCK" {
+			continue
+		}
+		if err := copyFile(filepath.Join(src, info.Name()), filepath.Join(dst, info.Name())); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func copyFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+
+	return out.Close()
+}
+
+/*******************************************************************************
+Read-only wrapper
+*******************************************************************************/
+
+// NewReadOnlySinker wraps a Sinker so that all its write operations fail with
+// ErrReadOnly. Closing it closes the wrapped Sinker.
+func NewReadOnlySinker(s Sinker) Sinker {
+	return readOnlySinker{s}
+}
+
+type readOnlySinker struct {
+	Sinker
+}
+
+func (readOnlySinker) Put(ctx context.Context, key, val []byte) error { return ErrReadOnly }
+
+func (readOnlySinker) Delete(ctx context.Context, key []byte) error { return ErrReadOnly }
+
+func (readOnlySinker) NewBatch() Batch { return readOnlyBatch{} }
+
+func (readOnlySinker) ReadOnly() bool { return true }
+
+type readOnlyBatch struct{}
+
+func (readOnlyBatch) Set(key, value []byte) error { return ErrReadOnly }
+
+func (readOnlyBatch) Delete(key []byte) error { return ErrReadOnly }
+
+func (readOnlyBatch) Commit(ctx context.Context) error { return ErrReadOnly }
+
+func (readOnlyBatch) Cancel() {}
+
+func (readOnlyBatch) SetMaxPendingTxns(max int) {}
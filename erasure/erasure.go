@@ -0,0 +1,166 @@
+// Package erasure splits a payload in shards with a systematic Reed-Solomon
+// code over GF(2^8), so that any DataShards of the shards reconstruct it.
+// Events with large payloads are disseminated this way, so that their creator
+// does not upload the whole payload to every peer.
+package erasure
+
+import (
+	"errors"
+	"fmt"
+)
+
+// MaxShards bounds the total number of shards of a Code
+const MaxShards = 256
+
+var (
+	// ErrTooFewShards is returned when fewer than DataShards shards are given
+	// to Reconstruct
+	ErrTooFewShards = errors.New("too few shards to reconstruct the payload")
+	// ErrShardSize is returned for shards of different sizes
+	ErrShardSize = errors.New("shards of different sizes")
+)
+
+// Code encodes payloads in DataShards shards holding the payload itself,
+// followed by ParityShards shards computed from them. It is safe for
+// concurrent use.
+type Code struct {
+	DataShards   int
+	ParityShards int
+	parity       [][]byte // [ParityShards][DataShards] Cauchy matrix
+}
+
+// New returns the Code of dataShards data shards and parityShards parity
+// shards
+func New(dataShards, parityShards int) (*Code, error) {
+	if dataShards <= 0 {
+		return nil, fmt.Errorf("data shards must be positive, got %d", dataShards)
+	}
+	if parityShards < 0 {
+		return nil, fmt.Errorf("parity shards must not be negative, got %d", parityShards)
+	}
+	if dataShards+parityShards > MaxShards {
+		return nil, fmt.Errorf("at most %d shards, got %d", MaxShards, dataShards+parityShards)
+	}
+
+	//Cauchy matrix 1/(x_i + y_j) with x_i = dataShards+i and y_j = j, all
+	//distinct, so that every square submatrix of the generator is invertible
+	parity := make([][]byte, parityShards)
+	for i := range parity {
+		parity[i] = make([]byte, dataShards)
+		for j := range parity[i] {
+			parity[i][j] = gfInv(byte(dataShards+i) ^ byte(j))
+		}
+	}
+
+	return &Code{
+		DataShards:   dataShards,
+		ParityShards: parityShards,
+		parity:       parity,
+	}, nil
+}
+
+// Shards returns the total number of shards
+func (c *Code) Shards() int {
+	return c.DataShards + c.ParityShards
+}
+
+// ShardSize returns the size of the shards of a payload of size bytes
+func (c *Code) ShardSize(size int) int {
+	return (size + c.DataShards - 1) / c.DataShards
+}
+
+// Encode splits payload in Shards shards of ShardSize bytes. The last data
+// shard is padded with zeros.
+func (c *Code) Encode(payload []byte) [][]byte {
+	size := c.ShardSize(len(payload))
+
+	shards := make([][]byte, c.Shards())
+	for i := 0; i < c.DataShards; i++ {
+		shards[i] = make([]byte, size)
+		if start := i * size; start < len(payload) {
+			copy(shards[i], payload[start:])
+		}
+	}
+
+	for i, row := range c.parity {
+		out := make([]byte, size)
+		for j, coef := range row {
+			gfMulAdd(out, shards[j], coef)
+		}
+		shards[c.DataShards+i] = out
+	}
+
+	return shards
+}
+
+// Reconstruct returns the payload of size bytes encoded in shards, which has
+// one entry per shard, nil for the missing ones
+func (c *Code) Reconstruct(shards [][]byte, size int) ([]byte, error) {
+	if len(shards) != c.Shards() {
+		return nil, fmt.Errorf("expected %d shards, got %d", c.Shards(), len(shards))
+	}
+
+	//the first DataShards shards available, data shards first since they
+	//need no decoding
+	rows := make([]int, 0, c.DataShards)
+	for i := range shards {
+		if shards[i] == nil {
+			continue
+		}
+		if len(shards[i]) != c.ShardSize(size) {
+			return nil, ErrShardSize
+		}
+		if len(rows) < c.DataShards {
+			rows = append(rows, i)
+		}
+	}
+	if len(rows) < c.DataShards {
+		return nil, ErrTooFewShards
+	}
+
+	data := make([][]byte, c.DataShards)
+	missing := false
+	for _, r := range rows {
+		if r < c.DataShards {
+			data[r] = shards[r]
+		} else {
+			missing = true
+		}
+	}
+
+	if missing {
+		//the rows of the generator matrix of the available shards
+		m := make([][]byte, c.DataShards)
+		for i, r := range rows {
+			if r < c.DataShards {
+				m[i] = make([]byte, c.DataShards)
+				m[i][r] = 1
+			} else {
+				m[i] = append([]byte{}, c.parity[r-c.DataShards]...)
+			}
+		}
+
+		inv, err := gfInvert(m)
+		if err != nil {
+			return nil, err
+		}
+
+		for j := range data {
+			if data[j] != nil {
+				continue
+			}
+			out := make([]byte, c.ShardSize(size))
+			for i, r := range rows {
+				gfMulAdd(out, shards[r], inv[j][i])
+			}
+			data[j] = out
+		}
+	}
+
+	payload := make([]byte, 0, c.DataShards*c.ShardSize(size))
+	for _, d := range data {
+		payload = append(payload, d...)
+	}
+
+	return payload[:size], nil
+}
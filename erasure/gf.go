@@ -0,0 +1,93 @@
+package erasure
+
+import "errors"
+
+// Arithmetic in GF(2^8) with the polynomial x^8+x^4+x^3+x^2+1, through the
+// tables of the powers of the generator 2.
+
+var (
+	gfExp [510]byte
+	gfLog [256]int
+)
+
+func init() {
+	x := 1
+	for i := 0; i < 255; i++ {
+		gfExp[i] = byte(x)
+		gfExp[i+255] = byte(x)
+		gfLog[x] = i
+		x <<= 1
+		if x&0x100 != 0 {
+			x ^= 0x11d
+		}
+	}
+}
+
+func gfMul(a, b byte) byte {
+	if a == 0 || b == 0 {
+		return 0
+	}
+	return gfExp[gfLog[a]+gfLog[b]]
+}
+
+// gfInv returns the inverse of a, which must not be 0
+func gfInv(a byte) byte {
+	return gfExp[255-gfLog[a]]
+}
+
+// gfMulAdd adds coef*in to out, byte by byte
+func gfMulAdd(out, in []byte, coef byte) {
+	if coef == 0 {
+		return
+	}
+	l := gfLog[coef]
+	for i, b := range in {
+		if b != 0 {
+			out[i] ^= gfExp[gfLog[b]+l]
+		}
+	}
+}
+
+// gfInvert returns the inverse of the square matrix m, by Gauss-Jordan
+// elimination. m is modified.
+func gfInvert(m [][]byte) ([][]byte, error) {
+	n := len(m)
+	inv := make([][]byte, n)
+	for i := range inv {
+		inv[i] = make([]byte, n)
+		inv[i][i] = 1
+	}
+
+	for col := 0; col < n; col++ {
+		pivot := -1
+		for r := col; r < n; r++ {
+			if m[r][col] != 0 {
+				pivot = r
+				break
+			}
+		}
+		if pivot < 0 {
+			return nil, errors.New("singular matrix")
+		}
+		m[col], m[pivot] = m[pivot], m[col]
+		inv[col], inv[pivot] = inv[pivot], inv[col]
+
+		if f := gfInv(m[col][col]); f != 1 {
+			for j := 0; j < n; j++ {
+				m[col][j] = gfMul(m[col][j], f)
+				inv[col][j] = gfMul(inv[col][j], f)
+			}
+		}
+
+		for r := 0; r < n; r++ {
+			if r == col || m[r][col] == 0 {
+				continue
+			}
+			f := m[r][col]
+			gfMulAdd(m[r], m[col], f)
+			gfMulAdd(inv[r], inv[col], f)
+		}
+	}
+
+	return inv, nil
+}
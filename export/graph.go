@@ -0,0 +1,200 @@
+// Package export renders a range of rounds of the hashgraph as a graph, in
+// Graphviz DOT or in a compact JSON format, for visualizing consensus.
+package export
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+
+	"github.com/bolaxy/common"
+	"github.com/bolaxy/core/store"
+)
+
+// Options bound the exported rounds
+type Options struct {
+	FromRound int
+	ToRound   int // inclusive; negative for the last round
+}
+
+// Node is an Event annotated with consensus information
+type Node struct {
+	Hex           string
+	Creator       string
+	Index         int
+	Round         int
+	Witness       bool   `json:",omitempty"`
+	Famous        string `json:",omitempty"` // True, False, or Undefined, for witnesses
+	RoundReceived *int   `json:",omitempty"`
+}
+
+// Edge links an Event to one of its parents
+type Edge struct {
+	From string
+	To   string
+	Self bool `json:",omitempty"` // true for self-parent edges
+}
+
+// Graph is the compact JSON graph format
+type Graph struct {
+	FromRound int
+	ToRound   int
+	Nodes     []Node
+	Edges     []Edge
+}
+
+// Build walks the rounds of the store in [opts.FromRound, opts.ToRound] and
+// collects their Events. Edges to Events outside of the range are omitted.
+func Build(s store.Store, opts Options) (*Graph, error) {
+	to := opts.ToRound
+	if to < 0 {
+		to = s.LastRound()
+	}
+
+	g := &Graph{
+		FromRound: opts.FromRound,
+		ToRound:   to,
+		Nodes:     []Node{},
+		Edges:     []Edge{},
+	}
+
+	type parents struct{ self, other string }
+	links := make(map[string]parents)
+
+	for r := opts.FromRound; r <= to; r++ {
+		round, err := s.GetRound(r)
+		if err != nil {
+			return nil, fmt.Errorf("round %d: %v", r, err)
+		}
+
+		for x, re := range round.CreatedEvents {
+			event, err := s.GetEvent(x)
+			if err != nil {
+				return nil, fmt.Errorf("event %s: %v", x, err)
+			}
+
+			n := Node{
+				Hex:           x,
+				Creator:       event.GetCreator(),
+				Index:         event.Index(),
+				Round:         r,
+				Witness:       re.Witness,
+				RoundReceived: event.RoundReceived,
+			}
+			if re.Witness {
+				n.Famous = re.Famous.String()
+			}
+
+			g.Nodes = append(g.Nodes, n)
+			links[x] = parents{event.SelfParent(), event.OtherParent()}
+		}
+	}
+
+	//deterministic output
+	sort.Slice(g.Nodes, func(i, j int) bool {
+		a, b := g.Nodes[i], g.Nodes[j]
+		if a.Creator != b.Creator {
+			return a.Creator < b.Creator
+		}
+		return a.Index < b.Index
+	})
+
+	for _, n := range g.Nodes {
+		p := links[n.Hex]
+		if _, ok := links[p.self]; ok {
+			g.Edges = append(g.Edges, Edge{From: n.Hex, To: p.self, Self: true})
+		}
+		if _, ok := links[p.other]; ok {
+			g.Edges = append(g.Edges, Edge{From: n.Hex, To: p.other})
+		}
+	}
+
+	return g, nil
+}
+
+// WriteJSON ...
+func (g *Graph) WriteJSON(w io.Writer) error {
+	return json.NewEncoder(w).Encode(g)
+}
+
+// WriteDOT writes the graph in Graphviz DOT. Each creator is drawn as a
+// column; witnesses are boxes, filled according to their fame.
+func (g *Graph) WriteDOT(w io.Writer) error {
+	ew := &errWriter{w: w}
+
+	ew.printf("digraph hashgraph {\n")
+	ew.printf("  rankdir=BT;\n")
+	ew.printf("  node [fontname=monospace, fontsize=10];\n")
+
+	creators := []string{}
+	byCreator := make(map[string][]Node)
+	for _, n := range g.Nodes {
+		if _, ok := byCreator[n.Creator]; !ok {
+			creators = append(creators, n.Creator)
+		}
+		byCreator[n.Creator] = append(byCreator[n.Creator], n)
+	}
+
+	for i, c := range creators {
+		ew.printf("  subgraph cluster_%d {\n", i)
+		ew.printf("    label=%q; style=dotted;\n", shortHex(c))
+		for _, n := range byCreator[c] {
+			ew.printf("    %q [%s];\n", n.Hex, nodeAttributes(n))
+		}
+		ew.printf("  }\n")
+	}
+
+	for _, e := range g.Edges {
+		if e.Self {
+			ew.printf("  %q -> %q [weight=10];\n", e.From, e.To)
+		} else {
+			ew.printf("  %q -> %q [style=dashed];\n", e.From, e.To)
+		}
+	}
+
+	ew.printf("}\n")
+
+	return ew.err
+}
+
+func nodeAttributes(n Node) string {
+	label := fmt.Sprintf("%s\\n%d r%d", shortHex(n.Hex), n.Index, n.Round)
+	if n.RoundReceived != nil {
+		label += fmt.Sprintf(" rr%d", *n.RoundReceived)
+	}
+
+	attrs := fmt.Sprintf("label=\"%s\"", label)
+	if !n.Witness {
+		return attrs
+	}
+
+	color := "orange" //undecided
+	switch n.Famous {
+	case common.True.String():
+		color = "red"
+	case common.False.String():
+		color = "lightgray"
+	}
+
+	return attrs + fmt.Sprintf(", shape=box, style=filled, fillcolor=%s", color)
+}
+
+func shortHex(h string) string {
+	if len(h) > 10 {
+		return h[:10]
+	}
+	return h
+}
+
+type errWriter struct {
+	w   io.Writer
+	err error
+}
+
+func (ew *errWriter) printf(format string, args ...interface{}) {
+	if ew.err != nil {
+		return
+	}
+	_, ew.err = fmt.Fprintf(ew.w, format, args...)
+}
@@ -0,0 +1,156 @@
+package fuzz
+
+import (
+	"crypto/ecdsa"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/bolaxy/common/hexutil"
+	"github.com/bolaxy/config"
+	"github.com/bolaxy/core/hashgraph"
+	"github.com/bolaxy/core/store"
+	"github.com/bolaxy/core/types"
+	"github.com/bolaxy/crypto"
+)
+
+// Network is a set of participants whose keys are derived from a seed, so
+// that the inputs generated for them are reproducible
+type Network struct {
+	Keys  []*ecdsa.PrivateKey
+	Peers *conf.PeerSet
+}
+
+// NewNetwork derives n participants from seed
+func NewNetwork(n int, seed int64) (*Network, error) {
+	if n <= 0 {
+		return nil, fmt.Errorf("network of %d participants", n)
+	}
+
+	r := rand.New(rand.NewSource(seed))
+
+	net := &Network{}
+	peers := make([]*conf.Peer, n)
+	for i := 0; i < n; i++ {
+		var key *ecdsa.PrivateKey
+		for key == nil {
+			d := make([]byte, 32)
+			r.Read(d)
+			//ToECDSA refuses the rare values outside of the curve order
+			key, _ = crypto.ToECDSA(d)
+		}
+		net.Keys = append(net.Keys, key)
+
+		pubKey := strings.ToUpper(hexutil.Encode(crypto.CompressPubkey(&key.PublicKey)))
+		peers[i] = conf.NewPeer(pubKey, fmt.Sprintf("fuzz%d", i), fmt.Sprintf("fuzz%d", i), "0", "0")
+	}
+	net.Peers = conf.NewPeerSet(peers)
+
+	return net, nil
+}
+
+// NewHashgraph returns a Hashgraph initialised with the PeerSet of the
+// Network, in an InmemStore, into which harnesses can insert Events
+func (net *Network) NewHashgraph(commit hashgraph.CommitCallback) (*hashgraph.Hashgraph, error) {
+	hg := hashgraph.NewHashgraph(store.NewInmemStore(1000), commit)
+	if err := hg.Init(net.Peers); err != nil {
+		return nil, err
+	}
+	return hg, nil
+}
+
+// Events generates count valid Events, in topological order. Each Event is
+// created by a participant chosen from seed, on top of its last Event and of
+// the last Event of another participant, and carries a transaction. Inserted
+// in order into a Hashgraph of the Network, they make consensus progress.
+func (net *Network) Events(count int, seed int64) ([]*types.Event, error) {
+	r := rand.New(rand.NewSource(seed))
+
+	n := len(net.Keys)
+	last := make([]*types.Event, n)
+	res := make([]*types.Event, 0, count)
+
+	for i := 0; i < count; i++ {
+		creator := r.Intn(n)
+
+		selfParent, index := "", 0
+		if last[creator] != nil {
+			selfParent = last[creator].GetHex()
+			index = last[creator].Index() + 1
+		}
+
+		otherParent := ""
+		if n > 1 {
+			other := (creator + 1 + r.Intn(n-1)) % n
+			if last[other] != nil {
+				otherParent = last[other].GetHex()
+			}
+		}
+
+		ev := types.NewEvent(
+			[][]byte{[]byte(fmt.Sprintf("tx%d", i))},
+			nil,
+			nil,
+			[]string{selfParent, otherParent},
+			crypto.FromECDSAPub(&net.Keys[creator].PublicKey),
+			index)
+
+		if err := ev.Sign(net.Keys[creator]); err != nil {
+			return nil, err
+		}
+		//the hash is computed before insertion sets the wire fields of the
+		//Body, which it covers, and is carried by the encoding
+		ev.GetHex()
+
+		last[creator] = ev
+		res = append(res, ev)
+	}
+
+	return res, nil
+}
+
+// MarshalEvents returns the encoding of Events, as read by Event.Unmarshal
+func MarshalEvents(events []*types.Event) ([][]byte, error) {
+	res := make([][]byte, len(events))
+	for i, ev := range events {
+		data, err := ev.Marshal()
+		if err != nil {
+			return nil, err
+		}
+		res[i] = data
+	}
+	return res, nil
+}
+
+// MarshalBlocks returns the encoding of Blocks, as read by Block.Unmarshal
+func MarshalBlocks(blocks []*types.Block) ([][]byte, error) {
+	res := make([][]byte, len(blocks))
+	for i, b := range blocks {
+		data, err := b.Marshal()
+		if err != nil {
+			return nil, err
+		}
+		res[i] = data
+	}
+	return res, nil
+}
+
+// WriteCorpus writes each input in its own file of dir, named after its hash
+// like go-fuzz does, so that a corpus can be regenerated without duplicates
+func WriteCorpus(dir string, inputs [][]byte) error {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+
+	for _, in := range inputs {
+		name := hexutil.Encode(crypto.Keccak256(in))[2:42]
+		if err := ioutil.WriteFile(filepath.Join(dir, name), in, 0644); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
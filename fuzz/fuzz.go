@@ -0,0 +1,99 @@
+// +build gofuzz
+
+package fuzz
+
+import (
+	"context"
+	"sync"
+
+	"github.com/bolaxy/core/types"
+)
+
+// The Fuzz functions follow the go-fuzz convention: they return 1 when the
+// input is interesting, 0 otherwise, and panic on a bug. Build them with
+// go-fuzz-build -func FuzzEvent, or -libfuzzer for libFuzzer.
+
+var (
+	seedOnce   sync.Once
+	seedNet    *Network
+	seedEvents []*types.Event
+)
+
+// seed returns the Network and the Events which FuzzInsert inserts before
+// the fuzzed Event
+func seed() (*Network, []*types.Event) {
+	seedOnce.Do(func() {
+		var err error
+		if seedNet, err = NewNetwork(4, 1); err != nil {
+			panic(err)
+		}
+		if seedEvents, err = seedNet.Events(20, 1); err != nil {
+			panic(err)
+		}
+	})
+	return seedNet, seedEvents
+}
+
+// FuzzEvent decodes an Event and checks its invariants
+func FuzzEvent(data []byte) int {
+	ev := new(types.Event)
+	if err := ev.Unmarshal(data); err != nil {
+		return 0
+	}
+
+	if err := CheckEventInvariants(ev); err != nil {
+		return 0
+	}
+
+	return 1
+}
+
+// FuzzBlock decodes a Block and checks its invariants
+func FuzzBlock(data []byte) int {
+	b := new(types.Block)
+	if err := b.Unmarshal(data); err != nil {
+		return 0
+	}
+
+	if err := CheckBlockInvariants(b, nil); err != nil {
+		return 0
+	}
+
+	return 1
+}
+
+// FuzzInsert decodes an Event and inserts it, whether or not it satisfies
+// CheckEventInvariants, into a Hashgraph holding the seed Events, then runs
+// consensus. The Store must still satisfy CheckStoreInvariants afterwards.
+func FuzzInsert(data []byte) int {
+	ev := new(types.Event)
+	if err := ev.Unmarshal(data); err != nil {
+		return 0
+	}
+
+	net, events := seed()
+
+	hg, err := net.NewHashgraph(nil)
+	if err != nil {
+		panic(err)
+	}
+
+	for _, e := range events {
+		//the seed Events are copied, since the Hashgraph modifies them. Their
+		//hash is kept: it covers fields of the Body which insertion sets.
+		c := &types.Event{Body: e.Body, Signature: e.Signature, Hash: e.Hash, Hex: e.Hex}
+		if err := hg.InsertEventAndRunConsensus(context.Background(), c, true); err != nil {
+			panic(err)
+		}
+	}
+
+	if err := hg.InsertEventAndRunConsensus(context.Background(), ev, true); err != nil {
+		return 0
+	}
+
+	if err := CheckStoreInvariants(hg.Store); err != nil {
+		panic(err)
+	}
+
+	return 1
+}
@@ -0,0 +1,236 @@
+// Package fuzz helps fuzzing harnesses, such as go-fuzz or libFuzzer ones,
+// target the decoding and insertion paths of the consensus from outside of
+// its packages. It provides invariant checks on Events, Blocks, and Stores,
+// and helpers generating valid inputs for a seed corpus.
+package fuzz
+
+import (
+	"bytes"
+	"fmt"
+
+	"github.com/bolaxy/common/hexutil"
+	"github.com/bolaxy/config"
+	"github.com/bolaxy/core/store"
+	"github.com/bolaxy/core/types"
+	"github.com/bolaxy/crypto"
+	"github.com/bolaxy/errors"
+)
+
+// CheckEventInvariants checks the invariants of an Event decoded from
+// untrusted input, in the order in which a violation would otherwise crash
+// or corrupt the consensus: the shape of its body, then its signatures.
+func CheckEventInvariants(ev *types.Event) error {
+	body := &ev.Body
+
+	if len(body.Parents) != 2 {
+		return fmt.Errorf("event has %d parents", len(body.Parents))
+	}
+	if body.Index < 0 {
+		return fmt.Errorf("negative index %d", body.Index)
+	}
+	if body.Index > 0 && body.Parents[0] == "" {
+		return fmt.Errorf("event %d has no self-parent", body.Index)
+	}
+	if body.Parents[0] != "" && body.Parents[0] == body.Parents[1] {
+		return fmt.Errorf("self-parent and other-parent are the same")
+	}
+
+	if _, err := crypto.UnmarshalPubkey(body.Creator); err != nil {
+		return fmt.Errorf("invalid creator: %v", err)
+	}
+
+	if len(body.PayloadTypes) != 0 && len(body.PayloadTypes) != len(body.Transactions) {
+		return fmt.Errorf("%d payload types for %d transactions", len(body.PayloadTypes), len(body.Transactions))
+	}
+
+	for i, bs := range body.BlockSignatures {
+		if !bytes.Equal(bs.Validator, body.Creator) {
+			return fmt.Errorf("block signature %d is not from the creator", i)
+		}
+		if err := checkSignature(bs.Signature); err != nil {
+			return fmt.Errorf("block signature %d: %v", i, err)
+		}
+	}
+
+	for i, itx := range body.InternalTransactions {
+		if !itx.Body.Type.SignedByPeer() {
+			continue
+		}
+		if err := checkSignature(itx.Signature); err != nil {
+			return fmt.Errorf("internal transaction %d: %v", i, err)
+		}
+	}
+
+	if err := checkSignature(ev.Signature); err != nil {
+		return err
+	}
+
+	ok, err := ev.Verify()
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return fmt.Errorf("invalid event signature")
+	}
+
+	return nil
+}
+
+// CheckBlockInvariants checks the invariants of a Block. If peerSet is not
+// nil, it must be the PeerSet of the Block's round: the Block must commit to
+// it, and its signatures must be valid signatures of its members.
+func CheckBlockInvariants(b *types.Block, peerSet *conf.PeerSet) error {
+	body := &b.Body
+
+	if body.Index < 0 {
+		return fmt.Errorf("negative index %d", body.Index)
+	}
+	if body.RoundReceived < 0 {
+		return fmt.Errorf("block %d: negative round received %d", body.Index, body.RoundReceived)
+	}
+
+	if len(body.PayloadTypes) != 0 && len(body.PayloadTypes) != len(body.Transactions) {
+		return fmt.Errorf("block %d: %d payload types for %d transactions", body.Index, len(body.PayloadTypes), len(body.Transactions))
+	}
+
+	receipts := body.InternalTransactionReceipts
+	if len(receipts) != 0 {
+		if len(receipts) != len(body.InternalTransactions) {
+			return fmt.Errorf("block %d: %d receipts for %d internal transactions", body.Index, len(receipts), len(body.InternalTransactions))
+		}
+		for i, r := range receipts {
+			if r.InternalTransaction.HashString() != body.InternalTransactions[i].HashString() {
+				return fmt.Errorf("block %d: receipt %d does not match its internal transaction", body.Index, i)
+			}
+		}
+	}
+
+	if peerSet == nil {
+		return nil
+	}
+
+	peersHash, err := peerSet.Hash()
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(peersHash, body.PeersHash) {
+		return fmt.Errorf("block %d does not commit to the peer-set of its round", body.Index)
+	}
+
+	for validator := range b.Signatures {
+		if _, ok := peerSet.ByPubKey[validator]; !ok {
+			return fmt.Errorf("block %d: signature from non-member %s", body.Index, validator)
+		}
+
+		bs, err := b.GetSignature(validator)
+		if err != nil {
+			return err
+		}
+		if err := checkSignature(bs.Signature); err != nil {
+			return fmt.Errorf("block %d: %v", body.Index, err)
+		}
+
+		ok, err := b.Verify(bs)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			return fmt.Errorf("block %d: invalid signature from %s", body.Index, validator)
+		}
+	}
+
+	return nil
+}
+
+// CheckStoreInvariants checks that the Blocks of a Store are consecutive,
+// in round order, and satisfy CheckBlockInvariants, and that the Events of
+// each participant form a chain consistent with KnownEvents. Blocks below the
+// first one are ignored, since a Store which was Reset does not hold them.
+func CheckStoreInvariants(s store.Store) error {
+	lastRound := -1
+	first := true
+	for i := 0; i <= s.LastBlockIndex(); i++ {
+		block, err := s.GetBlock(i)
+		if err != nil {
+			if first && errors.Is(err, errors.KeyNotFound) {
+				continue
+			}
+			return fmt.Errorf("block %d: %v", i, err)
+		}
+		first = false
+
+		if block.Index() != i {
+			return fmt.Errorf("block %d stored at index %d", block.Index(), i)
+		}
+		if block.RoundReceived() < lastRound {
+			return fmt.Errorf("block %d of round %d follows a block of round %d", i, block.RoundReceived(), lastRound)
+		}
+		lastRound = block.RoundReceived()
+
+		peerSet, err := s.GetPeerSet(block.RoundReceived())
+		if err != nil {
+			return fmt.Errorf("peer-set of block %d: %v", i, err)
+		}
+		if err := CheckBlockInvariants(block, peerSet); err != nil {
+			return err
+		}
+	}
+
+	known := s.KnownEvents()
+	for pubKey, peer := range s.RepertoireByPubKey() {
+		if err := checkParticipantEvents(s, pubKey, known[peer.ID()]); err != nil {
+			return fmt.Errorf("events of %d: %v", peer.ID(), err)
+		}
+	}
+
+	return nil
+}
+
+// checkParticipantEvents checks that the cached Events of a participant are
+// chained by their self-parents, and end at its known index
+func checkParticipantEvents(s store.Store, pubKey string, known int) error {
+	hashes, err := s.ParticipantEvents(pubKey, -1)
+	if err != nil {
+		return err
+	}
+
+	prevHex := ""
+	prevIndex := -1
+	for _, h := range hashes {
+		ev, err := s.GetEvent(h)
+		if err != nil {
+			return err
+		}
+
+		if prevIndex >= 0 {
+			if ev.Index() != prevIndex+1 {
+				return fmt.Errorf("event %d follows event %d", ev.Index(), prevIndex)
+			}
+			if ev.SelfParent() != prevHex {
+				return fmt.Errorf("event %d is not chained to its self-parent", ev.Index())
+			}
+		}
+
+		prevHex = ev.GetHex()
+		prevIndex = ev.Index()
+	}
+
+	if len(hashes) > 0 && prevIndex != known {
+		return fmt.Errorf("last event %d, known %d", prevIndex, known)
+	}
+
+	return nil
+}
+
+// checkSignature checks that a signature decodes to the 65 bytes of an
+// [R || S || V] signature, which Verify expects
+func checkSignature(sig string) error {
+	data, err := hexutil.Decode(sig)
+	if err != nil {
+		return fmt.Errorf("invalid signature: %v", err)
+	}
+	if len(data) != 65 {
+		return fmt.Errorf("signature of %d bytes", len(data))
+	}
+	return nil
+}
@@ -8,5 +8,8 @@ require (
 	github.com/bolaxy/crypto v1.0.2
 	github.com/bolaxy/errors v1.0.0
 	github.com/dgraph-io/badger v1.6.0
+	github.com/kilic/bls12-381 v0.1.0
 	github.com/ugorji/go/codec v1.1.7
+	golang.org/x/crypto v0.0.0-20200109152110-61a87790db17
+	golang.org/x/sys v0.10.0 // indirect
 )
@@ -0,0 +1,358 @@
+package hashgraph
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+
+	"github.com/bolaxy/core/store"
+	"github.com/bolaxy/core/types"
+)
+
+var (
+	// ErrInvalidSignature is returned for an Event which was not signed by
+	// its creator
+	ErrInvalidSignature = errors.New("invalid event signature")
+	// ErrParentRejected is returned by InsertEventBatch for an Event whose
+	// parent in the batch was not inserted
+	ErrParentRejected = errors.New("parent rejected in the same batch")
+	// ErrParentCycle is returned by InsertEventBatch for the Events whose
+	// parents in the batch form a cycle, which only forged Events can do
+	ErrParentCycle = errors.New("cycle of parents in the batch")
+)
+
+// MissingParentError is returned for a WireEvent whose parent was not
+// inserted yet: the parent has a greater index than the last known Event of
+// its creator
+type MissingParentError struct {
+	CreatorID uint32
+	Index     int
+}
+
+func (e *MissingParentError) Error() string {
+	return fmt.Sprintf("parent %d of creator %d not known yet", e.Index, e.CreatorID)
+}
+
+// parentError returns a MissingParentError if the parent which could not be
+// looked up is ahead of the known Events of its creator, and err otherwise
+func (h *Hashgraph) parentError(parent wireRef, err error) error {
+	if known, ok := h.Store.KnownEvents()[parent.creator]; !ok || parent.index > known {
+		return &MissingParentError{CreatorID: parent.creator, Index: parent.index}
+	}
+	return err
+}
+
+// wireRef identifies an Event by its creator and index, as WireEvents refer to
+// their parents
+type wireRef struct {
+	creator uint32
+	index   int
+}
+
+// batchParents returns, for every WireEvent, the positions of its parents in
+// the batch. The first of several WireEvents with the same creator and index
+// is the one referred to.
+func batchParents(wevents []types.WireEvent) [][]int {
+	positions := batchPositions(wevents)
+
+	parents := make([][]int, len(wevents))
+	for i, we := range wevents {
+		for _, ref := range wireParents(we) {
+			if p, ok := positions[ref]; ok && p != i {
+				parents[i] = append(parents[i], p)
+			}
+		}
+	}
+
+	return parents
+}
+
+// batchPositions returns the position of every WireEvent of a batch, the
+// first one for several WireEvents with the same creator and index
+func batchPositions(wevents []types.WireEvent) map[wireRef]int {
+	positions := make(map[wireRef]int, len(wevents))
+	for i := len(wevents) - 1; i >= 0; i-- {
+		positions[wireRef{wevents[i].Body.CreatorID, wevents[i].Body.Index}] = i
+	}
+	return positions
+}
+
+// wireParents returns the references of the parents of a WireEvent
+func wireParents(we types.WireEvent) []wireRef {
+	refs := []wireRef{}
+	if we.Body.SelfParentIndex >= 0 {
+		refs = append(refs, wireRef{we.Body.CreatorID, we.Body.SelfParentIndex})
+	}
+	if we.Body.OtherParentIndex >= 0 {
+		refs = append(refs, wireRef{we.Body.OtherParentCreatorID, we.Body.OtherParentIndex})
+	}
+	return refs
+}
+
+// sortBatch orders the positions of a batch so that every WireEvent comes
+// after its parents in the batch, keeping the order of the batch otherwise.
+// The positions in, or descending from, a cycle are returned apart.
+func sortBatch(parents [][]int) (order []int, cyclic []int) {
+	const (
+		unvisited = iota
+		visiting
+		sorted
+		broken
+	)
+
+	state := make([]int, len(parents))
+
+	var visit func(i int) bool
+	visit = func(i int) bool {
+		switch state[i] {
+		case sorted:
+			return true
+		case visiting, broken:
+			return false
+		}
+
+		state[i] = visiting
+		ok := true
+		for _, p := range parents[i] {
+			if !visit(p) {
+				ok = false
+			}
+		}
+
+		if !ok {
+			state[i] = broken
+			cyclic = append(cyclic, i)
+			return false
+		}
+
+		state[i] = sorted
+		order = append(order, i)
+		return true
+	}
+
+	for i := range parents {
+		visit(i)
+	}
+
+	return order, cyclic
+}
+
+// InsertEventBatch inserts the WireEvents of a SyncResponse, which need not be
+// sorted. The batch is sorted topologically, the parents are resolved in the
+// batch or in the Store, and the signatures are verified concurrently, on as
+// many goroutines as the hash workers, before the Events are inserted in
+// order. It returns the Event and the error of every WireEvent, nil for the
+// Events which were inserted; an Event whose parent in the batch was not
+// inserted fails with ErrParentRejected. The Events are inserted together
+// by a Store which is an EventBatcher, so that a CachedStore writes them to
+// the db in a single batch.
+func (h *Hashgraph) InsertEventBatch(wevents []types.WireEvent) ([]*types.Event, []error) {
+	events := make([]*types.Event, len(wevents))
+	errs := make([]error, len(wevents))
+	rejected := make([]bool, len(wevents))
+
+	parents := batchParents(wevents)
+	order, cyclic := sortBatch(parents)
+
+	for _, i := range cyclic {
+		errs[i] = ErrParentCycle
+		rejected[i] = true
+	}
+
+	reject := func(i int, err error) {
+		errs[i] = err
+		rejected[i] = true
+	}
+
+	parentRejected := func(i int) bool {
+		for _, p := range parents[i] {
+			if rejected[p] {
+				return true
+			}
+		}
+		return false
+	}
+
+	//resolve the parents, in order, as the hashes of the parents in the batch
+	//are only known once they are resolved themselves
+	resolved := make(map[wireRef]string, len(wevents))
+	for _, i := range order {
+		if parentRejected(i) {
+			reject(i, ErrParentRejected)
+			continue
+		}
+
+		ev, err := h.readWireInfo(wevents[i], resolved)
+		if err != nil {
+			reject(i, err)
+			continue
+		}
+
+		events[i] = ev
+		ref := wireRef{wevents[i].Body.CreatorID, wevents[i].Body.Index}
+		if _, ok := resolved[ref]; !ok {
+			resolved[ref] = ev.GetHex()
+		}
+	}
+
+	h.verifyBatch(events, errs)
+
+	insert := func() {
+		for _, i := range order {
+			if events[i] == nil {
+				continue
+			}
+			if errs[i] != nil {
+				rejected[i] = true
+				continue
+			}
+			if parentRejected(i) {
+				reject(i, ErrParentRejected)
+				continue
+			}
+			if err := h.insertVerified(events[i], false); err != nil {
+				reject(i, err)
+			}
+		}
+	}
+
+	if b, ok := h.Store.(store.EventBatcher); ok {
+		b.InsertEventBatch(insert)
+	} else {
+		insert()
+	}
+
+	return events, errs
+}
+
+// verifyBatch verifies the signatures of the resolved Events of a batch
+// concurrently, and sets the errors of the invalid ones
+func (h *Hashgraph) verifyBatch(events []*types.Event, errs []error) {
+	workers := h.blockPipeline.Workers()
+	if workers > len(events) {
+		workers = len(events)
+	}
+
+	next := int64(-1)
+
+	var wg sync.WaitGroup
+	wg.Add(workers)
+	for w := 0; w < workers; w++ {
+		go func() {
+			defer wg.Done()
+			for {
+				i := int(atomic.AddInt64(&next, 1))
+				if i >= len(events) {
+					return
+				}
+				if events[i] == nil {
+					continue
+				}
+
+				ok, err := events[i].Verify()
+				if err != nil {
+					errs[i] = fmt.Errorf("verifying signature: %v", err)
+				} else if !ok {
+					errs[i] = ErrInvalidSignature
+				}
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+// DropStale drops the WireEvents of a SyncResponse whose parents are all more
+// than the stale horizon older than the last consensus round, before their
+// signatures are verified, so that replays of ancient history cost no more
+// than a lookup. The last consensus round differs between nodes, so the
+// staleness only filters gossip, and the insertion of an Event never depends
+// on it: a stale WireEvent which a recent one of the batch descends from is
+// kept, so that all the nodes insert the Events which their peers build on.
+// It returns the kept WireEvents, in order, and the number dropped.
+func (h *Hashgraph) DropStale(wevents []types.WireEvent) ([]types.WireEvent, int) {
+	if h.staleHorizon <= 0 || h.LastConsensusRound == nil || h.bootstrapping {
+		return wevents, 0
+	}
+
+	positions := batchPositions(wevents)
+	parents := batchParents(wevents)
+	order, _ := sortBatch(parents)
+
+	//the parents first, as a WireEvent is as stale as its parents in the batch
+	stale := make([]bool, len(wevents))
+	for _, i := range order {
+		stale[i] = h.isStale(wevents[i], positions, stale)
+	}
+
+	//then the descendants first, which keep their parents
+	keep := make([]bool, len(wevents))
+	for i := range wevents {
+		keep[i] = !stale[i]
+	}
+	for k := len(order) - 1; k >= 0; k-- {
+		i := order[k]
+		if !keep[i] {
+			continue
+		}
+		for _, p := range parents[i] {
+			keep[p] = true
+		}
+	}
+
+	kept := make([]types.WireEvent, 0, len(wevents))
+	for i := range wevents {
+		if keep[i] {
+			kept = append(kept, wevents[i])
+		}
+	}
+
+	return kept, len(wevents) - len(kept)
+}
+
+// isStale tells if the most recent parent of a WireEvent is beyond the stale
+// horizon. A parent in the batch is as stale as itself, and the parents which
+// are not known are left to the insertion. Rounds are not computed here: a
+// parent inserted since the last DivideRounds may have no round yet, and is
+// recent. A parent inserted before without a round has an unknown round, which
+// is treated as stale.
+func (h *Hashgraph) isStale(we types.WireEvent, batch map[wireRef]int, stale []bool) bool {
+	known := false
+	parentRound := -1
+	for _, ref := range wireParents(we) {
+		if p, ok := batch[ref]; ok {
+			if !stale[p] {
+				return false
+			}
+			known = true
+			continue
+		}
+
+		creator, ok := h.Store.RepertoireByID()[ref.creator]
+		if !ok {
+			continue
+		}
+		hex, err := h.Store.ParticipantEvent(creator.PubKeyString(), ref.index)
+		if err != nil {
+			continue
+		}
+		ev, err := h.Store.GetEvent(hex)
+		if err != nil {
+			continue
+		}
+		known = true
+
+		r := ev.GetRound()
+		if r == nil {
+			if ev.TopologicalIndex >= h.dividedIndex {
+				return false
+			}
+			continue
+		}
+		if *r > parentRound {
+			parentRound = *r
+		}
+	}
+
+	return known && (parentRound < 0 || parentRound < *h.LastConsensusRound-h.staleHorizon)
+}
@@ -0,0 +1,376 @@
+package hashgraph
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/bolaxy/core/logger"
+	"github.com/bolaxy/core/store"
+	"github.com/bolaxy/core/types"
+	"github.com/bolaxy/errors"
+)
+
+const (
+	// bootstrapBatch is the number of Events inserted between two runs of the
+	// consensus methods during a Bootstrap
+	bootstrapBatch = 1000
+
+	// DefaultCacheCheckpointInterval is the default number of Rounds between
+	// two CacheCheckpoints
+	DefaultCacheCheckpointInterval = 10
+)
+
+// Bootstrap reloads the Hashgraph from the db of a PersistentStore after a
+// restart or a crash. The PeerSets are loaded, and the Events are inserted
+// again in topological order, which rebuilds the in-memory indexes and the
+// pending Rounds without gossiping the history again. If the db holds a
+// CacheCheckpoint, the Hashgraph is restored from its Frame and only the
+// Events which had not reached consensus are replayed. The Blocks committed
+// before the restart are not passed to the commit callback again. It returns
+// false if the db holds no state, in which case the Hashgraph must be
+// initialised with Init instead.
+func (h *Hashgraph) Bootstrap(ctx context.Context) (bool, error) {
+	ps, ok := h.Store.(store.PersistentStore)
+	if !ok {
+		return false, fmt.Errorf("bootstrap requires a PersistentStore")
+	}
+
+	empty, err := ps.Empty()
+	if err != nil || empty {
+		return false, err
+	}
+
+	checkpoint, err := ps.LastCheckpoint()
+	if err != nil {
+		return false, err
+	}
+
+	start := time.Now()
+
+	ps.SetReplay(true)
+	defer ps.SetReplay(false)
+
+	h.committedBlock = checkpoint.LastBlockIndex
+	h.bootstrapping = true
+	defer func() {
+		h.committedBlock = -1
+		h.bootstrapping = false
+	}()
+
+	from := 0
+	cp, err := ps.GetCacheCheckpoint()
+	switch {
+	case err == nil:
+		if err := h.restore(cp); err != nil {
+			return false, fmt.Errorf("restoring checkpoint of round %d: %v", cp.Round, err)
+		}
+		from = cp.TopologicalIndex
+	case errors.Is(err, errors.KeyNotFound):
+		//a store which was Reset only holds the Events above its base Frame
+		frame, block, err := ps.Base()
+		switch {
+		case err == nil:
+			if err := h.Reset(block, frame); err != nil {
+				return false, err
+			}
+			from = len(frame.Events)
+		case !errors.Is(err, errors.KeyNotFound):
+			return false, err
+		}
+	default:
+		return false, err
+	}
+
+	if err := ps.LoadPeerSets(); err != nil {
+		return false, err
+	}
+
+	//the Events which are already in the hot tier, or below its Roots, are
+	//skipped
+	known := h.Store.KnownEvents()
+	if cp != nil {
+		for id, index := range cp.Known {
+			if index > known[id] {
+				known[id] = index
+			}
+		}
+	}
+
+	events := 0
+	next := h.topologicalIndex
+	var insertErr error
+	err = ps.IterateEvents(from, func(ev *types.Event) bool {
+		if insertErr = ctx.Err(); insertErr != nil {
+			return false
+		}
+
+		if ev.TopologicalIndex >= next {
+			next = ev.TopologicalIndex + 1
+		}
+
+		if index, ok := known[ev.Body.CreatorID]; ok && ev.Index() <= index {
+			return true
+		}
+
+		//only the signed part of the Event is kept, the rest is recomputed
+		event := &types.Event{
+			Body:      ev.Body,
+			Signature: ev.Signature,
+		}
+
+		//the Event keeps its position in the db
+		h.topologicalIndex = ev.TopologicalIndex
+
+		if insertErr = h.InsertEvent(event, true); insertErr != nil {
+			insertErr = fmt.Errorf("inserting event %s: %v", ev.GetHex(), insertErr)
+			return false
+		}
+
+		events++
+		if events%bootstrapBatch == 0 {
+			insertErr = h.RunConsensus(ctx)
+		}
+
+		return insertErr == nil
+	})
+	if err == nil {
+		err = insertErr
+	}
+	if err == nil {
+		h.topologicalIndex = next
+		err = h.RunConsensus(ctx)
+	}
+	if err != nil {
+		return false, err
+	}
+
+	if cp != nil {
+		h.checkPendingRounds(cp)
+	}
+
+	h.logger.Info("hashgraph bootstrapped",
+		"from", from,
+		"events", events,
+		logger.Block, h.Store.LastBlockIndex(),
+		logger.Round, h.Store.LastRound(),
+		"duration", time.Since(start))
+
+	return true, nil
+}
+
+// restore rebuilds the hot tier from a CacheCheckpoint like Reset, but without
+// writing to the db. The Frame Events keep their topological index.
+func (h *Hashgraph) restore(cp *store.CacheCheckpoint) error {
+	ps := h.Store.(store.PersistentStore)
+
+	frame, err := ps.GetFrame(cp.Round)
+	if err != nil {
+		return err
+	}
+
+	if err := ps.ResetCache(frame); err != nil {
+		return err
+	}
+
+	for _, fe := range frame.SortedFrameEvents() {
+		//the Frame may come from a peer, so its indexes are not ours
+		stored, err := ps.GetEvent(fe.Core.GetHex())
+		if err != nil {
+			return err
+		}
+
+		h.topologicalIndex = stored.TopologicalIndex
+		if err := h.insertFrameEvent(fe); err != nil {
+			return err
+		}
+	}
+
+	if cp.BlockIndex >= 0 {
+		block, err := ps.GetBlock(cp.BlockIndex)
+		if err != nil {
+			return err
+		}
+
+		if err := ps.SetBlock(block); err != nil {
+			return err
+		}
+	}
+
+	h.setLastConsensusRound(cp.Round)
+	h.lastCacheCheckpoint = cp.Round
+	h.snapshot = cp.Snapshot
+
+	return nil
+}
+
+// checkPendingRounds warns about the Rounds which were pending in a
+// CacheCheckpoint and were neither decided nor queued again by the replay
+func (h *Hashgraph) checkPendingRounds(cp *store.CacheCheckpoint) {
+	for _, pr := range cp.PendingRounds {
+		if pr.Index <= *h.LastConsensusRound || h.PendingRounds.Queued(pr.Index) {
+			continue
+		}
+
+		h.logger.Warn("pending round of the checkpoint not recomputed",
+			logger.Round, pr.Index,
+			"checkpoint", cp.Round)
+	}
+}
+
+/*******************************************************************************
+Cache checkpoints
+*******************************************************************************/
+
+// SetCacheCheckpointInterval sets the number of Rounds between two
+// CacheCheckpoints written to a PersistentStore. 0 disables them, in which
+// case a Bootstrap replays all the Events.
+func (h *Hashgraph) SetCacheCheckpointInterval(rounds int) {
+	h.cacheCheckpointInterval = rounds
+}
+
+// SetSnapshot records the reference of the latest snapshot of the application
+// state, which is saved with the next CacheCheckpoint
+func (h *Hashgraph) SetSnapshot(ref *store.SnapshotRef) {
+	h.snapshot = ref
+}
+
+// Snapshot returns the reference of the latest snapshot of the application
+// state, restored from the last CacheCheckpoint by a Bootstrap. It is nil if
+// no snapshot was recorded.
+func (h *Hashgraph) Snapshot() *store.SnapshotRef {
+	return h.snapshot
+}
+
+// maybeSaveCacheCheckpoint saves a CacheCheckpoint if the LastConsensusRound
+// is far enough from the last one
+func (h *Hashgraph) maybeSaveCacheCheckpoint() error {
+	if h.cacheCheckpointInterval <= 0 ||
+		h.LastConsensusRound == nil ||
+		*h.LastConsensusRound < h.lastCacheCheckpoint+h.cacheCheckpointInterval {
+		return nil
+	}
+
+	return h.saveCacheCheckpoint()
+}
+
+// saveCacheCheckpoint stages a CacheCheckpoint at the LastConsensusRound if
+// the Store is a PersistentStore
+func (h *Hashgraph) saveCacheCheckpoint() error {
+	ps, ok := h.Store.(store.PersistentStore)
+	if !ok || h.LastConsensusRound == nil {
+		return nil
+	}
+
+	from, err := h.firstUnprocessedEvent()
+	if err != nil {
+		return err
+	}
+
+	known, err := h.consensusKnown()
+	if err != nil {
+		return err
+	}
+
+	cp := &store.CacheCheckpoint{
+		Round:            *h.LastConsensusRound,
+		BlockIndex:       h.Store.LastBlockIndex(),
+		TopologicalIndex: from,
+		Known:            known,
+		Snapshot:         h.snapshot,
+	}
+
+	for _, pr := range h.PendingRounds.GetOrderedPendingRounds() {
+		if pr.Index > cp.Round {
+			cp.PendingRounds = append(cp.PendingRounds, *pr)
+		}
+	}
+
+	if err := ps.SetCacheCheckpoint(cp); err != nil {
+		return err
+	}
+
+	h.lastCacheCheckpoint = cp.Round
+
+	h.logger.Debug("cache checkpoint saved",
+		logger.Round, cp.Round,
+		logger.Block, cp.BlockIndex,
+		"from", cp.TopologicalIndex)
+
+	return nil
+}
+
+// firstUnprocessedEvent returns the lowest topological index of the Events
+// which are not in a processed Round: the undetermined Events, and the Events
+// received by a decided Round which was not processed yet.
+func (h *Hashgraph) firstUnprocessedEvent() (int, error) {
+	first := h.topologicalIndex
+
+	check := func(hashes []string) error {
+		for _, x := range hashes {
+			ev, err := h.Store.GetEvent(x)
+			if err != nil {
+				return err
+			}
+			if ev.TopologicalIndex < first {
+				first = ev.TopologicalIndex
+			}
+		}
+		return nil
+	}
+
+	if err := check(h.UndeterminedEvents); err != nil {
+		return 0, err
+	}
+
+	for _, pr := range h.PendingRounds.GetOrderedPendingRounds() {
+		if pr.Index <= *h.LastConsensusRound {
+			continue
+		}
+
+		round, err := h.Store.GetRound(pr.Index)
+		if err != nil {
+			if errors.Is(err, errors.KeyNotFound) {
+				continue
+			}
+			return 0, err
+		}
+
+		if err := check(round.ReceivedEvents); err != nil {
+			return 0, err
+		}
+	}
+
+	return first, nil
+}
+
+// consensusKnown returns the index of the last consensus Event of each
+// participant, or of its Root when it has none
+func (h *Hashgraph) consensusKnown() (map[uint32]int, error) {
+	known := make(map[uint32]int)
+
+	for id, peer := range h.Store.RepertoireByID() {
+		pk := peer.PubKeyString()
+		known[id] = -1
+
+		hash, err := h.Store.LastConsensusEventFrom(pk)
+		if err == nil {
+			ev, err := h.Store.GetEvent(hash)
+			if err != nil {
+				return nil, err
+			}
+			known[id] = ev.Index()
+			continue
+		}
+		if !errors.Is(err, errors.KeyNotFound) {
+			return nil, err
+		}
+
+		root, err := h.Store.GetRoot(pk)
+		if err == nil && len(root.Events) > 0 {
+			known[id] = root.Events[len(root.Events)-1].Core.Index()
+		}
+	}
+
+	return known, nil
+}
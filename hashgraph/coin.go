@@ -0,0 +1,109 @@
+package hashgraph
+
+import (
+	"encoding/binary"
+	"fmt"
+
+	"github.com/bolaxy/common/hexutil"
+	"github.com/bolaxy/core/types"
+	"github.com/bolaxy/crypto"
+)
+
+// CoinSource provides the pseudo-random vote cast by a witness in a coin
+// round of the fame election. Every honest node must obtain the same coin for
+// the same witness, so implementations must only depend on the witness and
+// the round.
+type CoinSource interface {
+	Flip(witness *types.Event, round int) (bool, error)
+}
+
+// SignatureCoin is the default CoinSource. The coin is the middle bit of the
+// witness's signature, which the other participants can not predict before
+// the witness is created.
+type SignatureCoin struct{}
+
+// Flip ...
+func (SignatureCoin) Flip(witness *types.Event, round int) (bool, error) {
+	sig, err := hexutil.Decode(witness.Signature)
+	if err != nil {
+		return false, err
+	}
+
+	if len(sig) == 0 {
+		return false, nil
+	}
+
+	return sig[len(sig)/2]&1 == 1, nil
+}
+
+// VRF verifies a Verifiable Random Function proof created by the owner of
+// pubKey over input, and returns the corresponding output.
+type VRF interface {
+	Verify(pubKey []byte, input []byte, proof []byte) ([]byte, error)
+}
+
+// InvalidProofCallback is notified of a witness whose VRF proof is missing or
+// invalid, to record the offence of its creator
+type InvalidProofCallback func(witness *types.Event, err error)
+
+// VRFCoin derives the coin from a VRF evaluated by the witness's creator over
+// the witness's self-parent and the round number. Unlike signatures, VRF
+// outputs can not be ground by the creator. Proof extracts the VRF proof
+// carried by the witness. A witness without a valid proof gets the coin of
+// SignatureCoin instead, which every node computes alike, so that one
+// creator can not stop the fame election; OnInvalidProof, if set, is
+// notified.
+type VRFCoin struct {
+	VRF            VRF
+	Proof          func(witness *types.Event) ([]byte, error)
+	OnInvalidProof InvalidProofCallback
+}
+
+// NewVRFCoin ...
+func NewVRFCoin(vrf VRF, proof func(witness *types.Event) ([]byte, error)) *VRFCoin {
+	return &VRFCoin{
+		VRF:   vrf,
+		Proof: proof,
+	}
+}
+
+// VRFInput returns the message over which the creator of a witness evaluates
+// the VRF.
+func VRFInput(selfParent string, round int) []byte {
+	r := make([]byte, 8)
+	binary.BigEndian.PutUint64(r, uint64(round))
+	return crypto.Keccak256([]byte(selfParent), r)
+}
+
+// Flip ...
+func (c *VRFCoin) Flip(witness *types.Event, round int) (bool, error) {
+	proof, err := c.Proof(witness)
+	if err != nil {
+		return c.fallback(witness, round, fmt.Errorf("no VRF proof from %s: %v", witness.GetCreator(), err))
+	}
+
+	selfParent := ""
+	if len(witness.Body.Parents) > 0 {
+		selfParent = witness.SelfParent()
+	}
+
+	output, err := c.VRF.Verify(witness.Body.Creator, VRFInput(selfParent, round), proof)
+	if err != nil {
+		return c.fallback(witness, round, fmt.Errorf("invalid VRF proof from %s: %v", witness.GetCreator(), err))
+	}
+
+	if len(output) == 0 {
+		return false, nil
+	}
+
+	return output[0]&1 == 1, nil
+}
+
+// fallback records the offence of a witness without a valid proof, and flips
+// the SignatureCoin instead
+func (c *VRFCoin) fallback(witness *types.Event, round int, err error) (bool, error) {
+	if c.OnInvalidProof != nil {
+		c.OnInvalidProof(witness, err)
+	}
+	return SignatureCoin{}.Flip(witness, round)
+}
@@ -0,0 +1,58 @@
+package hashgraph
+
+import "github.com/bolaxy/core/logger"
+
+// EmptyBlockMode ...
+type EmptyBlockMode int
+
+const (
+	// SkipEmptyBlocks does not produce Blocks for Frames without transactions
+	// or internal transactions. It is the default.
+	SkipEmptyBlocks EmptyBlockMode = iota
+	// ProduceEmptyBlocks produces a Block for every Frame
+	ProduceEmptyBlocks
+	// HeartbeatEmptyBlocks produces an empty Block when no Block was produced
+	// for HeartbeatRounds rounds, so that observers can tell an idle network
+	// from a stalled one.
+	HeartbeatEmptyBlocks
+)
+
+// EmptyBlockPolicy decides whether an empty Frame produces a Block.
+//
+// Block indexes are always consecutive: a suppressed Frame does not consume a
+// Block index, so the RoundReceived of consecutive Blocks can have gaps, but
+// their indexes never do.
+type EmptyBlockPolicy struct {
+	Mode            EmptyBlockMode
+	HeartbeatRounds int
+}
+
+// produce returns true if the empty Frame of a round should produce a Block,
+// given the RoundReceived of the last Block, or -1.
+func (p EmptyBlockPolicy) produce(round, lastBlockRound int) bool {
+	switch p.Mode {
+	case ProduceEmptyBlocks:
+		return true
+	case HeartbeatEmptyBlocks:
+		return p.HeartbeatRounds > 0 && round-lastBlockRound >= p.HeartbeatRounds
+	default:
+		return false
+	}
+}
+
+// lastBlockRound returns the RoundReceived of the last Block. When the Block
+// can not be read, it falls back to the round of the last Reset, or -1.
+func (h *Hashgraph) lastBlockRound() int {
+	last := h.Store.LastBlockIndex()
+	if last < 0 {
+		return h.resetRound
+	}
+
+	block, err := h.Store.GetBlock(last)
+	if err != nil {
+		h.logger.Warn("last block not found", logger.Block, last, logger.Err, err)
+		return h.resetRound
+	}
+
+	return block.RoundReceived()
+}
@@ -0,0 +1,1667 @@
+package hashgraph
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+
+	"github.com/bolaxy/config"
+	"github.com/bolaxy/core/logger"
+	"github.com/bolaxy/core/metrics"
+	"github.com/bolaxy/core/profiling"
+	"github.com/bolaxy/core/store"
+	"github.com/bolaxy/core/trace"
+	"github.com/bolaxy/core/types"
+	"github.com/bolaxy/crypto"
+	"github.com/bolaxy/errors"
+)
+
+// CommitCallback is called by the Hashgraph every time a new Block is
+// produced. ctx is the context given to RunConsensus; a callback doing
+// long-running work should give up when it is done.
+type CommitCallback func(ctx context.Context, block *types.Block) error
+
+// FinalityCallback is called by the Hashgraph when a Block collects the
+// Signatures of a SuperMajority of its PeerSet.
+type FinalityCallback func(ctx context.Context, block *types.Block) error
+
+// Hashgraph is the consensus engine. It inserts Events in the Store and runs
+// the consensus methods (rounds, fame, round-received) to produce an ordered
+// sequence of Frames and Blocks.
+type Hashgraph struct {
+	Store                   store.Store
+	UndeterminedEvents      []string                  //[index] => hash, in topological order
+	PendingRounds           *types.PendingRoundsCache //FIFO queue of Rounds which have not attained consensus yet
+	PendingSignatures       *types.SigPool            //Pool of Block signatures that need to be processed
+	LastConsensusRound      *int                      //index of last consensus round
+	FirstConsensusRound     *int                      //index of first consensus round
+	LastCommitedRoundEvents int                       //number of events in round before LastConsensusRound
+	ConsensusTransactions   int                       //number of consensus transactions
+	PendingLoadedEvents     int                       //number of loaded events that are not yet committed
+
+	commitCallback   CommitCallback
+	finalityCallback FinalityCallback
+	coin             CoinSource
+	tieBreak         types.TieBreak
+	tieBreakFrom     int //first round received ordered with tieBreak
+	staleHorizon     int //rounds behind the last consensus round, 0 for no limit
+	blockLimits      types.BlockLimits
+	txQuota          TxQuota
+	maxEventPayload  int //0 for no limit
+	bootstrapping    bool
+	blockPipeline    *types.BlockPipeline
+	emptyBlocks      EmptyBlockPolicy
+	metrics          *metrics.ConsensusMetrics
+	stats            *metrics.Stats
+	tracer           *eventTracer
+	logger           logger.Logger
+	topologicalIndex int
+	dividedIndex     int //topological index of the first Event not recorded by DivideRounds
+	committedBlock   int //during a Bootstrap, last Block committed before the restart
+	resetRound       int //RoundReceived of the Block of the last Reset, or -1
+	awaitingAck      map[int]struct{}
+
+	cacheCheckpointInterval int
+	lastCacheCheckpoint     int //Round of the last CacheCheckpoint
+	snapshot                *store.SnapshotRef
+
+	stronglySeeCache *store.LRU
+}
+
+// NewHashgraph instantiates a Hashgraph with a Store and a commit callback
+func NewHashgraph(s store.Store, commitCallback CommitCallback) *Hashgraph {
+	return &Hashgraph{
+		Store:                   s,
+		PendingRounds:           types.NewPendingRoundsCache(),
+		PendingSignatures:       types.NewSigPool(),
+		commitCallback:          commitCallback,
+		committedBlock:          -1,
+		resetRound:              -1,
+		awaitingAck:             make(map[int]struct{}),
+		cacheCheckpointInterval: DefaultCacheCheckpointInterval,
+		lastCacheCheckpoint:     -1,
+		coin:                    SignatureCoin{},
+		logger:                  logger.Nop,
+		stronglySeeCache:        newStronglySeeCache(s.CacheSize()),
+		blockPipeline:           types.NewBlockPipeline(0),
+	}
+}
+
+func newStronglySeeCache(size int) *store.LRU {
+	return store.NewLRU(size, nil)
+}
+
+// SetFinalityCallback registers a callback for Blocks which become final
+func (h *Hashgraph) SetFinalityCallback(cb FinalityCallback) {
+	h.finalityCallback = cb
+}
+
+// AwaitAck marks a Block passed to the commit callback whose commit the
+// application will acknowledge later, with the state hash of the Block. Its
+// signatures wait in the SigPool until AckBlock.
+func (h *Hashgraph) AwaitAck(index int) {
+	h.awaitingAck[index] = struct{}{}
+}
+
+// AckBlock releases the signatures of a Block marked by AwaitAck, whose state
+// hash was set
+func (h *Hashgraph) AckBlock(index int) {
+	delete(h.awaitingAck, index)
+}
+
+// SetBlockLimits bounds the size of the Blocks. A Frame with too many
+// transactions is split across consecutive Blocks. All the nodes of a network
+// must use the same limits. The ConsensusParams in force at the round of a
+// Frame override them.
+func (h *Hashgraph) SetBlockLimits(limits types.BlockLimits) {
+	h.blockLimits = limits
+}
+
+// protocolVersion returns the ProtocolVersion in force at a round
+func (h *Hashgraph) protocolVersion(round int) int {
+	params, err := h.Store.GetParams(round)
+	if err != nil {
+		return types.ProtocolInitial
+	}
+	return params.Version()
+}
+
+// blockLimitsAt returns the limits of the Blocks of a round
+func (h *Hashgraph) blockLimitsAt(round int) types.BlockLimits {
+	params, err := h.Store.GetParams(round)
+	if err != nil || params == nil {
+		return h.blockLimits
+	}
+	return params.BlockLimits(h.blockLimits)
+}
+
+// SetHashWorkers sets the number of goroutines which hash the Frames and
+// Blocks of the decided rounds, and verify the Events of an InsertEventBatch.
+// 0, the default, uses GOMAXPROCS.
+func (h *Hashgraph) SetHashWorkers(workers int) {
+	h.blockPipeline = types.NewBlockPipeline(workers)
+}
+
+// SetEmptyBlockPolicy decides which Frames without transactions produce a
+// Block. All the nodes of a network must use the same policy.
+func (h *Hashgraph) SetEmptyBlockPolicy(policy EmptyBlockPolicy) {
+	h.emptyBlocks = policy
+}
+
+// SetCoinSource replaces the source of the votes cast in coin rounds. All the
+// nodes of a network must use the same CoinSource.
+func (h *Hashgraph) SetCoinSource(coin CoinSource) {
+	h.coin = coin
+}
+
+// SetTieBreak selects the order of the Events of a Frame with the same
+// Lamport timestamp, from the round received fromRound. The Frames of the
+// earlier rounds keep TieBreakSignature, so that a running network can switch
+// at an agreed round. All the nodes of a network must use the same TieBreak
+// and round. The activation of ProtocolWhitened also selects
+// TieBreakWhitened.
+func (h *Hashgraph) SetTieBreak(t types.TieBreak, fromRound int) {
+	h.tieBreak = t
+	h.tieBreakFrom = fromRound
+}
+
+// SetStaleHorizon makes DropStale drop the WireEvents whose parents are all
+// more than horizon rounds older than the last consensus round, which are
+// replays of ancient history rather than gossip. 0, the default, drops none.
+func (h *Hashgraph) SetStaleHorizon(horizon int) {
+	h.staleHorizon = horizon
+}
+
+// SetMaxEventPayload rejects the Events whose transactions total more than
+// max bytes. 0, the default, accepts all the Events. All the nodes of a
+// network must use the same limit.
+func (h *Hashgraph) SetMaxEventPayload(max int) {
+	h.maxEventPayload = max
+}
+
+// SetMetrics enables the reporting of consensus progress
+func (h *Hashgraph) SetMetrics(m *metrics.ConsensusMetrics) {
+	h.metrics = m
+}
+
+// SetStats enables the moving averages of the pace of consensus
+func (h *Hashgraph) SetStats(s *metrics.Stats) {
+	h.stats = s
+}
+
+// Stats returns the Stats set by SetStats, or nil
+func (h *Hashgraph) Stats() *metrics.Stats {
+	return h.stats
+}
+
+// SetLogger ...
+func (h *Hashgraph) SetLogger(l logger.Logger) {
+	h.logger = logger.OrNop(l).With(logger.Component, "Hashgraph")
+}
+
+// SetTracer instruments the lifecycle of events with trace spans. Tracing is
+// only enabled if config.Enabled is true.
+func (h *Hashgraph) SetTracer(t trace.Tracer, config trace.Config) {
+	h.tracer = newEventTracer(t, config)
+}
+
+// Init sets the initial PeerSet, which is the PeerSet of round 0
+func (h *Hashgraph) Init(peerSet *conf.PeerSet) error {
+	return h.Store.SetPeerSet(0, peerSet)
+}
+
+/*******************************************************************************
+Private Methods
+*******************************************************************************/
+
+// true if y is an ancestor of x
+func (h *Hashgraph) ancestor(x, y string) (bool, error) {
+	if x == y {
+		return true, nil
+	}
+
+	ex, err := h.Store.GetEvent(x)
+	if err != nil {
+		return false, err
+	}
+
+	ey, err := h.Store.GetEvent(y)
+	if err != nil {
+		return false, err
+	}
+
+	entry, ok := ex.LastAncestors[ey.GetCreator()]
+
+	return ok && entry.Index >= ey.Index(), nil
+}
+
+// true if y is a self-ancestor of x
+func (h *Hashgraph) selfAncestor(x, y string) (bool, error) {
+	if x == y {
+		return true, nil
+	}
+
+	ex, err := h.Store.GetEvent(x)
+	if err != nil {
+		return false, err
+	}
+
+	ey, err := h.Store.GetEvent(y)
+	if err != nil {
+		return false, err
+	}
+
+	return ex.GetCreatorID() == ey.GetCreatorID() && ex.Index() >= ey.Index(), nil
+}
+
+// true if x sees y
+func (h *Hashgraph) see(x, y string) (bool, error) {
+	return h.ancestor(x, y)
+	//it is not necessary to detect forks because we assume that the InsertEvent
+	//function makes it impossible to insert two Events at the same height for
+	//the same participant.
+}
+
+// true if x strongly sees y based on the peer set of a round
+func (h *Hashgraph) stronglySee(x, y string, round int) (bool, error) {
+	key := types.TreKey{X: x, Y: y, Z: strconv.Itoa(round)}
+	if c, ok := h.stronglySeeCache.Get(key); ok {
+		return c.(bool), nil
+	}
+
+	peers, err := h.Store.GetPeerSet(round)
+	if err != nil {
+		return false, err
+	}
+
+	ss, err := h._stronglySee(x, y, peers)
+	if err != nil {
+		return false, err
+	}
+
+	h.stronglySeeCache.Add(key, ss)
+
+	return ss, nil
+}
+
+func (h *Hashgraph) _stronglySee(x, y string, peers *conf.PeerSet) (bool, error) {
+	ex, err := h.Store.GetEvent(x)
+	if err != nil {
+		return false, err
+	}
+
+	ey, err := h.Store.GetEvent(y)
+	if err != nil {
+		return false, err
+	}
+
+	c := 0
+	for p := range peers.ByPubKey {
+		xla, xlaok := ex.LastAncestors[p]
+		yfd, yfdok := ey.FirstDescendants[p]
+		if xlaok && yfdok && xla.Index >= yfd.Index {
+			c++
+		}
+	}
+
+	return c >= peers.SuperMajority(), nil
+}
+
+// round computes the round of an Event and memoizes it on the Event
+func (h *Hashgraph) round(x string) (int, error) {
+	ex, err := h.Store.GetEvent(x)
+	if err != nil {
+		return math.MinInt32, err
+	}
+
+	if r := ex.GetRound(); r != nil {
+		return *r, nil
+	}
+
+	r, err := h._round(ex)
+	if err != nil {
+		return math.MinInt32, err
+	}
+
+	ex.SetRound(r)
+
+	return r, nil
+}
+
+func (h *Hashgraph) _round(ex *types.Event) (int, error) {
+	parentRound := -1
+
+	if sp := ex.SelfParent(); sp != "" {
+		spRound, err := h.round(sp)
+		if err != nil {
+			return math.MinInt32, err
+		}
+		parentRound = spRound
+	}
+
+	if op := ex.OtherParent(); op != "" {
+		opRound, err := h.round(op)
+		if err != nil {
+			return math.MinInt32, err
+		}
+		if opRound > parentRound {
+			parentRound = opRound
+		}
+	}
+
+	//The Event has no parents. It belongs to the first round of its creator.
+	if parentRound == -1 {
+		id := ex.GetCreatorID()
+		if _, ok := h.Store.RepertoireByID()[id]; !ok {
+			return math.MinInt32, fmt.Errorf("creator %s not found", ex.GetCreator())
+		}
+
+		if fr, ok := h.Store.FirstRound(id); ok {
+			return fr, nil
+		}
+
+		return 0, nil
+	}
+
+	peerSet, err := h.Store.GetPeerSet(parentRound)
+	if err != nil {
+		return math.MinInt32, err
+	}
+
+	//Count how many of the parent-round's witnesses are strongly seen
+	c := 0
+	for _, w := range h.Store.RoundWitnesses(parentRound) {
+		ss, err := h.stronglySee(ex.GetHex(), w, parentRound)
+		if err != nil {
+			return math.MinInt32, err
+		}
+		if ss {
+			c++
+		}
+	}
+
+	if c >= peerSet.SuperMajority() {
+		parentRound++
+	}
+
+	return parentRound, nil
+}
+
+// true if x is a witness (first event of a round for the owner)
+func (h *Hashgraph) witness(x string) (bool, error) {
+	ex, err := h.Store.GetEvent(x)
+	if err != nil {
+		return false, err
+	}
+
+	xRound, err := h.round(x)
+	if err != nil {
+		return false, err
+	}
+
+	if ex.SelfParent() == "" {
+		return true, nil
+	}
+
+	spRound, err := h.round(ex.SelfParent())
+	if err != nil {
+		return false, err
+	}
+
+	return xRound > spRound, nil
+}
+
+// lamportTimestamp computes the Lamport timestamp of an Event and memoizes it
+// on the Event
+func (h *Hashgraph) lamportTimestamp(x string) (int, error) {
+	ex, err := h.Store.GetEvent(x)
+	if err != nil {
+		return math.MinInt32, err
+	}
+
+	if ex.LamportTimestamp != nil {
+		return *ex.LamportTimestamp, nil
+	}
+
+	plt := -1
+
+	if sp := ex.SelfParent(); sp != "" {
+		spLT, err := h.lamportTimestamp(sp)
+		if err != nil {
+			return math.MinInt32, err
+		}
+		plt = spLT
+	}
+
+	if op := ex.OtherParent(); op != "" {
+		opLT, err := h.lamportTimestamp(op)
+		if err != nil {
+			return math.MinInt32, err
+		}
+		if opLT > plt {
+			plt = opLT
+		}
+	}
+
+	ex.SetLamportTimestamp(plt + 1)
+
+	return plt + 1, nil
+}
+
+// Check the SelfParent is the Creator's last known Event
+func (h *Hashgraph) checkSelfParent(event *types.Event) error {
+	selfParent := event.SelfParent()
+	creator := event.GetCreator()
+
+	creatorLastKnown, err := h.Store.LastEventFrom(creator)
+	if err != nil && !errors.Is(err, errors.Empty) {
+		return err
+	}
+
+	if selfParent != creatorLastKnown {
+		return fmt.Errorf("self-parent not last known event by creator")
+	}
+
+	return nil
+}
+
+// ForkError is returned by InsertEvent when an Event has the same creator and
+// index as a known Event. The evidence has already been recorded in the Store.
+type ForkError struct {
+	Evidence *types.ForkEvidence
+}
+
+func (e *ForkError) Error() string {
+	return fmt.Sprintf("fork detected: creator %s signed two events with index %d",
+		e.Evidence.Creator(), e.Evidence.Index())
+}
+
+// Check that the creator has not already signed another Event with the same
+// index
+func (h *Hashgraph) checkFork(event *types.Event) error {
+	known, err := h.Store.ParticipantEvent(event.GetCreator(), event.Index())
+	if err != nil || known == event.GetHex() {
+		return nil
+	}
+
+	other, err := h.Store.GetEvent(known)
+	if err != nil {
+		return nil
+	}
+
+	evidence, err := types.NewForkEvidence(other, event)
+	if err != nil {
+		return nil
+	}
+
+	if err := h.Store.SetForkEvidence(evidence); err != nil {
+		return err
+	}
+
+	h.logger.Warn("fork detected",
+		logger.Creator, evidence.Creator(),
+		logger.EventHex, event.GetHex(),
+		"index", evidence.Index())
+
+	return &ForkError{Evidence: evidence}
+}
+
+// PayloadError is returned by InsertEvent for an Event whose transactions
+// exceed the maximum payload
+type PayloadError struct {
+	Size int
+	Max  int
+}
+
+func (e *PayloadError) Error() string {
+	return fmt.Sprintf("event payload of %d bytes, above %d", e.Size, e.Max)
+}
+
+// Check that the transactions of the Event fit in the maximum payload. The
+// Events replayed by a Bootstrap were accepted before, and are not checked.
+func (h *Hashgraph) checkPayload(event *types.Event) error {
+	if h.maxEventPayload <= 0 || h.bootstrapping {
+		return nil
+	}
+
+	if size := event.PayloadSize(); size > h.maxEventPayload {
+		return &PayloadError{Size: size, Max: h.maxEventPayload}
+	}
+
+	return nil
+}
+
+// Check if we know the OtherParent
+func (h *Hashgraph) checkOtherParent(event *types.Event) error {
+	otherParent := event.OtherParent()
+	if otherParent == "" {
+		return nil
+	}
+
+	if _, err := h.Store.GetEvent(otherParent); err != nil {
+		return fmt.Errorf("other-parent not known")
+	}
+
+	return nil
+}
+
+// initEventCoordinates computes the LastAncestors of an Event by merging the
+// ones of its parents. The FirstDescendants start with the Event itself.
+func (h *Hashgraph) initEventCoordinates(event *types.Event) error {
+	event.LastAncestors = types.NewCoordinatesMap()
+	event.FirstDescendants = types.NewCoordinatesMap()
+
+	selfParent, selfParentError := h.Store.GetEvent(event.SelfParent())
+	otherParent, otherParentError := h.Store.GetEvent(event.OtherParent())
+
+	switch {
+	case selfParentError != nil && otherParentError != nil:
+	case selfParentError != nil:
+		event.LastAncestors = otherParent.LastAncestors.Copy()
+	case otherParentError != nil:
+		event.LastAncestors = selfParent.LastAncestors.Copy()
+	default:
+		event.LastAncestors = selfParent.LastAncestors.Copy()
+		for p, ola := range otherParent.LastAncestors {
+			if sla, ok := event.LastAncestors[p]; !ok || sla.Index < ola.Index {
+				event.LastAncestors[p] = ola
+			}
+		}
+	}
+
+	coords := types.EventCoordinates{
+		Hash:  event.GetHex(),
+		Index: event.Index(),
+	}
+
+	event.FirstDescendants[event.GetCreator()] = coords
+	event.LastAncestors[event.GetCreator()] = coords
+
+	return nil
+}
+
+// updateAncestorFirstDescendant walks down the self-parent chains of the
+// Event's last ancestors and records the Event as their first descendant
+func (h *Hashgraph) updateAncestorFirstDescendant(event *types.Event) error {
+	creator := event.GetCreator()
+	coords := types.EventCoordinates{
+		Hash:  event.GetHex(),
+		Index: event.Index(),
+	}
+
+	for _, la := range event.LastAncestors {
+		ah := la.Hash
+		for ah != "" {
+			a, err := h.Store.GetEvent(ah)
+			if err != nil {
+				break
+			}
+
+			if a.FirstDescendants == nil {
+				a.FirstDescendants = types.NewCoordinatesMap()
+			}
+
+			if _, ok := a.FirstDescendants[creator]; ok {
+				break
+			}
+
+			a.FirstDescendants[creator] = coords
+			if err := h.Store.SetEvent(a); err != nil {
+				return err
+			}
+
+			ah = a.SelfParent()
+		}
+	}
+
+	return nil
+}
+
+// setWireInfo computes the wire information of an Event from its parents
+func (h *Hashgraph) setWireInfo(event *types.Event) error {
+	selfParentIndex := -1
+	otherParentCreatorID := uint32(0)
+	otherParentIndex := -1
+
+	creator, ok := h.Store.RepertoireByID()[event.GetCreatorID()]
+	if !ok {
+		return fmt.Errorf("creator %s not found", event.GetCreator())
+	}
+
+	if sp := event.SelfParent(); sp != "" {
+		selfParent, err := h.Store.GetEvent(sp)
+		if err != nil {
+			return err
+		}
+		selfParentIndex = selfParent.Index()
+	}
+
+	if op := event.OtherParent(); op != "" {
+		otherParent, err := h.Store.GetEvent(op)
+		if err != nil {
+			return err
+		}
+
+		otherParentCreator, ok := h.Store.RepertoireByID()[otherParent.GetCreatorID()]
+		if !ok {
+			return fmt.Errorf("creator %s not found", otherParent.GetCreator())
+		}
+
+		otherParentCreatorID = otherParentCreator.ID()
+		otherParentIndex = otherParent.Index()
+	}
+
+	event.SetWireInfo(selfParentIndex,
+		otherParentCreatorID,
+		otherParentIndex,
+		creator.ID())
+
+	return nil
+}
+
+func (h *Hashgraph) setLastConsensusRound(i int) {
+	if h.LastConsensusRound == nil {
+		h.LastConsensusRound = new(int)
+	}
+	*h.LastConsensusRound = i
+
+	if h.FirstConsensusRound == nil {
+		h.FirstConsensusRound = new(int)
+		*h.FirstConsensusRound = i
+	}
+}
+
+func (h *Hashgraph) createFrameEvent(x string) (*types.FrameEvent, error) {
+	ev, err := h.Store.GetEvent(x)
+	if err != nil {
+		return nil, err
+	}
+
+	round, err := h.round(x)
+	if err != nil {
+		return nil, err
+	}
+
+	witness, err := h.witness(x)
+	if err != nil {
+		return nil, err
+	}
+
+	lamportTimestamp, err := h.lamportTimestamp(x)
+	if err != nil {
+		return nil, err
+	}
+
+	return &types.FrameEvent{
+		Core:             ev,
+		Round:            round,
+		LamportTimestamp: lamportTimestamp,
+		Witness:          witness,
+	}, nil
+}
+
+// createRoot creates a Root for a participant from its head Event
+func (h *Hashgraph) createRoot(head string) (*types.Root, error) {
+	root := types.NewRoot()
+
+	if head != "" {
+		headEvent, err := h.createFrameEvent(head)
+		if err != nil {
+			return nil, err
+		}
+		root.Insert(headEvent)
+	}
+
+	return root, nil
+}
+
+/*******************************************************************************
+Public Methods
+*******************************************************************************/
+
+// InsertEvent verifies an Event and inserts it in the Store. setWireInfo
+// should be true for Events that were not read from the wire.
+func (h *Hashgraph) InsertEvent(event *types.Event, setWireInfo bool) error {
+	ok, err := event.Verify()
+	if err != nil {
+		return err
+	} else if !ok {
+		return ErrInvalidSignature
+	}
+
+	return h.insertVerified(event, setWireInfo)
+}
+
+// insertVerified inserts an Event whose signature was verified
+func (h *Hashgraph) insertVerified(event *types.Event, setWireInfo bool) error {
+	var err error
+
+	if err := h.checkFork(event); err != nil {
+		return err
+	}
+
+	if err := h.checkSelfParent(event); err != nil {
+		return fmt.Errorf("CheckSelfParent: %s", err)
+	}
+
+	if err := h.checkOtherParent(event); err != nil {
+		return fmt.Errorf("CheckOtherParent: %s", err)
+	}
+
+	if err := h.checkPayload(event); err != nil {
+		return err
+	}
+
+	if err := h.checkQuota(event); err != nil {
+		return err
+	}
+
+	event.TopologicalIndex = h.topologicalIndex
+	h.topologicalIndex++
+
+	if setWireInfo {
+		if err := h.setWireInfo(event); err != nil {
+			return fmt.Errorf("SetWireInfo: %s", err)
+		}
+	}
+
+	if err := h.initEventCoordinates(event); err != nil {
+		return fmt.Errorf("InitEventCoordinates: %s", err)
+	}
+
+	profiling.Do(context.Background(), profiling.StoreInsert, func(context.Context) {
+		err = h.Store.SetEvent(event)
+	})
+	if err != nil {
+		return fmt.Errorf("SetEvent: %s", err)
+	}
+
+	if err := h.updateAncestorFirstDescendant(event); err != nil {
+		return fmt.Errorf("UpdateAncestorFirstDescendant: %s", err)
+	}
+
+	h.UndeterminedEvents = append(h.UndeterminedEvents, event.GetHex())
+
+	h.metrics.EventInserted(event.GetHex())
+	h.stats.EventInserted(event.GetHex())
+	h.logger.Debug("event inserted",
+		logger.EventHex, event.GetHex(),
+		logger.CreatorID, event.Body.CreatorID,
+		"index", event.Index())
+	h.tracer.inserted(event.GetHex(), event.GetCreator(), event.Index())
+
+	if event.IsLoaded() {
+		h.PendingLoadedEvents++
+	}
+
+	for _, bs := range event.BlockSignatures() {
+		h.PendingSignatures.Add(bs)
+	}
+
+	return nil
+}
+
+// InsertEventAndRunConsensus inserts an Event and runs all the consensus
+// methods.
+func (h *Hashgraph) InsertEventAndRunConsensus(ctx context.Context, event *types.Event, setWireInfo bool) error {
+	if err := h.InsertEvent(event, setWireInfo); err != nil {
+		return err
+	}
+	return h.RunConsensus(ctx)
+}
+
+// RunConsensus runs the consensus methods in order. ctx is passed to the
+// commit and finality callbacks.
+func (h *Hashgraph) RunConsensus(ctx context.Context) error {
+	if err := h.DivideRounds(); err != nil {
+		return err
+	}
+	if err := h.DecideFame(); err != nil {
+		return err
+	}
+	if err := h.DecideRoundReceived(); err != nil {
+		return err
+	}
+	if err := h.ProcessDecidedRounds(ctx); err != nil {
+		return err
+	}
+	return h.ProcessSigPool(ctx)
+}
+
+// DivideRounds assigns a Round and LamportTimestamp to Events, and flags them
+// as witnesses if necessary. Pushes Rounds in the PendingRounds queue if
+// necessary.
+func (h *Hashgraph) DivideRounds() error {
+	for _, hash := range h.UndeterminedEvents {
+		ev, err := h.Store.GetEvent(hash)
+		if err != nil {
+			return err
+		}
+
+		updateEvent := false
+
+		//the Events inserted since the last DivideRounds are recorded in
+		//their round, which quotaBase may have computed already
+		if ev.GetRound() == nil || ev.TopologicalIndex >= h.dividedIndex {
+			roundNumber, err := h.round(hash)
+			if err != nil {
+				return err
+			}
+
+			ev.SetRound(roundNumber)
+			updateEvent = true
+
+			roundInfo, err := h.Store.GetRound(roundNumber)
+			if err != nil && !errors.Is(err, errors.KeyNotFound) {
+				return err
+			}
+			if roundInfo == nil {
+				roundInfo = types.NewRoundInfo()
+			}
+
+			//Rounds below the last consensus round are already processed
+			if !h.PendingRounds.Queued(roundNumber) &&
+				!roundInfo.Decided &&
+				(h.LastConsensusRound == nil || roundNumber >= *h.LastConsensusRound) {
+
+				h.PendingRounds.Set(&types.PendingRound{Index: roundNumber, Decided: false})
+				roundInfo.SetQueued()
+			}
+
+			witness, err := h.witness(hash)
+			if err != nil {
+				return err
+			}
+
+			roundInfo.AddCreatedEvent(hash, witness)
+
+			h.tracer.annotate(hash, "round.assigned",
+				trace.Int("round", roundNumber),
+				trace.Bool("witness", witness))
+
+			if err := h.Store.SetRound(roundNumber, roundInfo); err != nil {
+				return err
+			}
+		}
+
+		if ev.LamportTimestamp == nil {
+			if _, err := h.lamportTimestamp(hash); err != nil {
+				return err
+			}
+			updateEvent = true
+		}
+
+		if updateEvent {
+			if err := h.Store.SetEvent(ev); err != nil {
+				return err
+			}
+		}
+	}
+
+	h.dividedIndex = h.topologicalIndex
+
+	return nil
+}
+
+// DecideFame decides if witnesses are famous
+func (h *Hashgraph) DecideFame() error {
+	//Initialize the vote map
+	votes := make(map[string]map[string]bool) //[x][y] => vote(x,y)
+	setVote := func(x, y string, vote bool) {
+		if votes[x] == nil {
+			votes[x] = make(map[string]bool)
+		}
+		votes[x][y] = vote
+	}
+
+	decidedRounds := []int{}
+
+	for _, r := range h.PendingRounds.GetOrderedPendingRounds() {
+		roundIndex := r.Index
+
+		rRoundInfo, err := h.Store.GetRound(roundIndex)
+		if err != nil {
+			return err
+		}
+
+		rPeerSet, err := h.Store.GetPeerSet(roundIndex)
+		if err != nil {
+			return err
+		}
+
+		for _, x := range rRoundInfo.UndecidedWitnesses() {
+		VOTE_LOOP:
+			for j := roundIndex + 1; j <= h.Store.LastRound(); j++ {
+				jPeerSet, err := h.Store.GetPeerSet(j)
+				if err != nil {
+					return err
+				}
+
+				for _, y := range h.Store.RoundWitnesses(j) {
+					diff := j - roundIndex
+
+					if diff == 1 {
+						ycx, err := h.see(y, x)
+						if err != nil {
+							return err
+						}
+						setVote(y, x, ycx)
+						continue
+					}
+
+					//count votes of the witnesses of round j-1 that y strongly sees
+					yays := 0
+					nays := 0
+					for _, w := range h.Store.RoundWitnesses(j - 1) {
+						ss, err := h.stronglySee(y, w, j-1)
+						if err != nil {
+							return err
+						}
+						if !ss {
+							continue
+						}
+						if votes[w][x] {
+							yays++
+						} else {
+							nays++
+						}
+					}
+
+					v := false
+					t := nays
+					if yays >= nays {
+						v = true
+						t = yays
+					}
+
+					if diff%len(jPeerSet.Peers) > 0 {
+						//normal round
+						if t >= jPeerSet.SuperMajority() {
+							rRoundInfo.SetFame(x, v)
+							setVote(y, x, v)
+							h.tracer.annotate(x, "fame.decided",
+								trace.Int("round", roundIndex),
+								trace.Bool("famous", v))
+							break VOTE_LOOP
+						}
+						setVote(y, x, v)
+					} else {
+						//coin round
+						if t >= jPeerSet.SuperMajority() {
+							setVote(y, x, v)
+						} else {
+							ey, err := h.Store.GetEvent(y)
+							if err != nil {
+								return err
+							}
+							coin, err := h.coin.Flip(ey, j)
+							if err != nil {
+								return err
+							}
+							setVote(y, x, coin)
+						}
+					}
+				}
+			}
+		}
+
+		//only the rounds which were undecided until now are reported
+		if !r.Decided && rRoundInfo.WitnessesDecided(rPeerSet) {
+			decidedRounds = append(decidedRounds, roundIndex)
+		}
+
+		if err := h.Store.SetRound(roundIndex, rRoundInfo); err != nil {
+			return err
+		}
+	}
+
+	h.PendingRounds.Update(decidedRounds)
+
+	h.metrics.RoundsDecidedN(len(decidedRounds))
+	for _, r := range decidedRounds {
+		h.logger.Debug("round decided", logger.Round, r)
+	}
+	undecided := 0
+	for _, pr := range h.PendingRounds.GetOrderedPendingRounds() {
+		if !pr.Decided {
+			undecided++
+		}
+	}
+	h.metrics.SetUndecidedRounds(undecided)
+
+	return nil
+}
+
+// DecideRoundReceived assigns a RoundReceived to undetermined events when
+// they reach consensus. An event is "received" in the first round where all
+// the unique famous witnesses have received it, if all earlier rounds have
+// the fame of all witnesses decided.
+func (h *Hashgraph) DecideRoundReceived() error {
+	newUndeterminedEvents := []string{}
+
+	for _, x := range h.UndeterminedEvents {
+		received := false
+
+		r, err := h.round(x)
+		if err != nil {
+			return err
+		}
+
+		for i := r + 1; i <= h.Store.LastRound(); i++ {
+			tr, err := h.Store.GetRound(i)
+			if err != nil {
+				//Can happen after a Reset
+				if h.LastConsensusRound != nil && r < *h.LastConsensusRound {
+					received = true
+					break
+				}
+				return err
+			}
+
+			tPeers, err := h.Store.GetPeerSet(i)
+			if err != nil {
+				return err
+			}
+
+			//Rounds are visited in order so, if a round is undecided, x can
+			//not be received yet.
+			if !tr.WitnessesDecided(tPeers) {
+				break
+			}
+
+			fws := tr.FamousWitnesses()
+
+			s := 0
+			for _, w := range fws {
+				see, err := h.see(w, x)
+				if err != nil {
+					return err
+				}
+				if see {
+					s++
+				}
+			}
+
+			if s == len(fws) && s > 0 {
+				received = true
+
+				ex, err := h.Store.GetEvent(x)
+				if err != nil {
+					return err
+				}
+				ex.SetRoundReceived(i)
+
+				if err := h.Store.SetEvent(ex); err != nil {
+					return err
+				}
+
+				tr.AddReceivedEvent(x)
+
+				h.tracer.annotate(x, "round.received", trace.Int("round_received", i))
+				if err := h.Store.SetRound(i, tr); err != nil {
+					return err
+				}
+
+				break
+			}
+		}
+
+		if !received {
+			newUndeterminedEvents = append(newUndeterminedEvents, x)
+		}
+	}
+
+	h.UndeterminedEvents = newUndeterminedEvents
+
+	return nil
+}
+
+// ProcessDecidedRounds takes Rounds whose witnesses are decided, computes the
+// corresponding Frames, maps them into Blocks, and commits the Blocks via the
+// commit callback. When ctx is done, it stops before the next Round, which
+// stays pending.
+func (h *Hashgraph) ProcessDecidedRounds(ctx context.Context) error {
+	processedRounds := []int{}
+	defer func() {
+		h.PendingRounds.Clean(processedRounds)
+	}()
+
+	for _, r := range h.PendingRounds.GetOrderedPendingRounds() {
+		//A decided round is never processed before all the previous rounds
+		if !r.Decided {
+			break
+		}
+
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		//After a Reset, LastConsensusRound is re-queued but its events are
+		//already committed.
+		if h.LastConsensusRound != nil && r.Index == *h.LastConsensusRound {
+			processedRounds = append(processedRounds, r.Index)
+			continue
+		}
+
+		//The rules of a later version are unknown, and the Blocks would differ
+		//from the ones of the upgraded peers
+		if v := h.protocolVersion(r.Index); v > types.ProtocolLatest {
+			return fmt.Errorf("round %d runs protocol version %d, which is not supported", r.Index, v)
+		}
+
+		var frame *types.Frame
+		var err error
+		profiling.Do(ctx, profiling.BlockConstruction, func(context.Context) {
+			frame, err = h.GetFrame(r.Index)
+		})
+		if err != nil {
+			return fmt.Errorf("getting frame %d: %v", r.Index, err)
+		}
+
+		eventHashes := make([]string, len(frame.Events))
+		for i, e := range frame.Events {
+			if err := h.Store.AddConsensusEvent(e.Core); err != nil {
+				return err
+			}
+
+			eventHashes[i] = e.Core.GetHex()
+
+			h.ConsensusTransactions += len(e.Core.Transactions())
+
+			if e.Core.IsLoaded() {
+				h.PendingLoadedEvents--
+			}
+		}
+
+		h.stats.RoundProcessed(eventHashes)
+
+		var blocks []*types.Block
+		profiling.Do(ctx, profiling.BlockConstruction, func(context.Context) {
+			blocks, err = h.blockPipeline.NewBlocksFromFrame(h.Store.LastBlockIndex()+1, frame, h.blockLimitsAt(frame.Round))
+		})
+		if err != nil {
+			return err
+		}
+
+		empty := len(blocks[0].Transactions()) == 0 && len(blocks[0].InternalTransactions()) == 0
+
+		if !empty || h.emptyBlocks.produce(frame.Round, h.lastBlockRound()) {
+			for i, block := range blocks {
+				if err := h.Store.SetBlock(block); err != nil {
+					return err
+				}
+
+				if i == 0 {
+					h.metrics.BlockCommitted(eventHashes)
+				} else {
+					h.metrics.BlockCommitted(nil)
+				}
+				h.stats.BlockCommitted(len(block.Transactions()))
+				h.logger.Info("block committed",
+					logger.Block, block.Index(),
+					logger.Round, frame.Round,
+					"txs", len(block.Transactions()),
+					"itxs", len(block.InternalTransactions()))
+
+				if h.commitCallback != nil && block.Index() > h.committedBlock {
+					if err := h.commitCallback(ctx, block); err != nil {
+						return err
+					}
+				}
+			}
+
+			for _, eh := range eventHashes {
+				h.tracer.end(eh, trace.Int("frame", frame.Round), trace.Int("block", blocks[0].Index()))
+			}
+		} else {
+			h.metrics.EventsCommitted(eventHashes)
+			for _, eh := range eventHashes {
+				h.tracer.end(eh, trace.Int("frame", frame.Round), trace.Int("block", -1))
+			}
+		}
+
+		processedRounds = append(processedRounds, r.Index)
+
+		if h.LastConsensusRound == nil || r.Index > *h.LastConsensusRound {
+			h.setLastConsensusRound(r.Index)
+		}
+	}
+
+	return h.maybeSaveCacheCheckpoint()
+}
+
+// roundSeed is the randomness of a round whose fame is decided: the hash of
+// its famous witnesses. The Events it receives are ancestors of all of them,
+// so their creators could not know it.
+func roundSeed(round *types.RoundInfo) []byte {
+	famous := round.FamousWitnesses()
+	sort.Strings(famous)
+
+	data := make([][]byte, len(famous))
+	for i, w := range famous {
+		data[i] = []byte(w)
+	}
+	return crypto.Keccak256(data...)
+}
+
+// RoundSeed returns the randomness of a round whose fame is decided, the hash
+// of its famous witnesses, which was unpredictable before the round was
+// decided
+func (h *Hashgraph) RoundSeed(round int) ([]byte, error) {
+	if h.LastConsensusRound == nil || round > *h.LastConsensusRound {
+		return nil, fmt.Errorf("fame of round %d not decided", round)
+	}
+	info, err := h.Store.GetRound(round)
+	if err != nil {
+		return nil, err
+	}
+	return roundSeed(info), nil
+}
+
+// GetFrame computes the Frame corresponding to a RoundReceived.
+func (h *Hashgraph) GetFrame(roundReceived int) (*types.Frame, error) {
+	//Try to get it from the Store first
+	frame, err := h.Store.GetFrame(roundReceived)
+	if err == nil || !errors.Is(err, errors.KeyNotFound) {
+		return frame, err
+	}
+
+	round, err := h.Store.GetRound(roundReceived)
+	if err != nil {
+		return nil, err
+	}
+
+	events := []*types.FrameEvent{}
+	for _, eh := range round.ReceivedEvents {
+		fe, err := h.createFrameEvent(eh)
+		if err != nil {
+			return nil, err
+		}
+		events = append(events, fe)
+	}
+
+	sorter := types.SortedFrameEvents(events).SortCache()
+	whitened := h.tieBreak == types.TieBreakWhitened && roundReceived >= h.tieBreakFrom
+	if whitened || h.protocolVersion(roundReceived) >= types.ProtocolWhitened {
+		sorter = types.SortedFrameEvents(events).WhitenedSortCache(roundSeed(round))
+	}
+	sort.Sort(sorter)
+
+	//The events are in topological order. Each time we run into the first
+	//Event of a participant, we create a Root for it from its self-parent.
+	roots := make(map[string]*types.Root)
+	for _, ev := range events {
+		p := ev.Core.GetCreator()
+		if _, ok := roots[p]; !ok {
+			root, err := h.createRoot(ev.Core.SelfParent())
+			if err != nil {
+				return nil, err
+			}
+			roots[p] = root
+		}
+	}
+
+	peerSet, err := h.Store.GetPeerSet(roundReceived)
+	if err != nil {
+		return nil, err
+	}
+
+	//Every participant needs a Root in the Frame. For participants with no
+	//Events in this Frame, the Root is built from their last consensus Event,
+	//or their current Root.
+	for _, peer := range peerSet.Peers {
+		p := peer.PubKeyString()
+		if _, ok := roots[p]; ok {
+			continue
+		}
+
+		var root *types.Root
+		lastConsensusEventHash, err := h.Store.LastConsensusEventFrom(p)
+		if err == nil {
+			root, err = h.createRoot(lastConsensusEventHash)
+		} else if errors.Is(err, errors.KeyNotFound) {
+			root, err = h.Store.GetRoot(p)
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		roots[p] = root
+	}
+
+	allPeerSets, err := h.Store.GetAllPeerSets()
+	if err != nil {
+		return nil, err
+	}
+
+	allParams, err := h.Store.GetAllParams()
+	if err != nil {
+		return nil, err
+	}
+	if len(allParams) == 0 {
+		allParams = nil
+	}
+
+	res := &types.Frame{
+		Round:    roundReceived,
+		Peers:    peerSet.Peers,
+		Roots:    roots,
+		Events:   events,
+		PeerSets: allPeerSets,
+		Params:   allParams,
+	}
+
+	if err := h.Store.SetFrame(res); err != nil {
+		return nil, err
+	}
+
+	return res, nil
+}
+
+// BlockFinal returns true if the Block of index is known and signed by a
+// SuperMajority of its PeerSet, so that more signatures for it are useless
+func (h *Hashgraph) BlockFinal(index int) bool {
+	block, err := h.Store.GetBlock(index)
+	if err != nil {
+		return false
+	}
+
+	peerSet, err := h.Store.GetPeerSet(block.RoundReceived())
+	if err != nil {
+		return false
+	}
+
+	return block.IsFinal(peerSet)
+}
+
+// ProcessSigPool runs through the SignaturePool and tries to map a Signature
+// to a known Block. If a Signature is valid, it is appended to the block and
+// removed from the SignaturePool.
+func (h *Hashgraph) ProcessSigPool(ctx context.Context) error {
+	processedSignatures := []types.BlockSignature{}
+	defer func() {
+		h.PendingSignatures.RemoveSlice(processedSignatures)
+		h.metrics.SetSigPoolDepth(h.PendingSignatures.Len())
+	}()
+
+	for _, bs := range h.PendingSignatures.Slice() {
+		//the state hash of the block is not known yet
+		if _, ok := h.awaitingAck[bs.Index]; ok {
+			continue
+		}
+
+		block, err := h.Store.GetBlock(bs.Index)
+		if err != nil {
+			//the block might not be produced yet
+			continue
+		}
+
+		peerSet, err := h.Store.GetPeerSet(block.RoundReceived())
+		if err != nil {
+			return err
+		}
+
+		//only keep signatures from validators of the block's peer-set
+		if _, ok := peerSet.ByPubKey[bs.ValidatorCompressHex()]; !ok {
+			processedSignatures = append(processedSignatures, bs)
+			continue
+		}
+
+		valid, err := block.Verify(bs)
+		if err != nil {
+			return err
+		}
+
+		if !valid {
+			h.logger.Warn("invalid block signature",
+				logger.Block, bs.Index,
+				"validator", bs.ValidatorCompressHex())
+		}
+
+		if valid {
+			wasFinal := block.IsFinal(peerSet)
+
+			block.SetSignature(bs)
+			if err := h.Store.SetBlock(block); err != nil {
+				return err
+			}
+
+			if !wasFinal && block.IsFinal(peerSet) {
+				h.logger.Info("block final",
+					logger.Block, block.Index(),
+					"signatures", len(block.Signatures))
+
+				if h.finalityCallback != nil {
+					if err := h.finalityCallback(ctx, block); err != nil {
+						return err
+					}
+				}
+			}
+		}
+
+		processedSignatures = append(processedSignatures, bs)
+	}
+
+	return nil
+}
+
+// ConsensusState returns the state of the Hashgraph which is not persisted
+// as Events are inserted, to be saved in a PersistentStore on shutdown
+func (h *Hashgraph) ConsensusState() *store.ConsensusState {
+	state := &store.ConsensusState{
+		PendingSignatures: h.PendingSignatures.Slice(),
+	}
+
+	if h.LastConsensusRound != nil {
+		lcr := *h.LastConsensusRound
+		state.LastConsensusRound = &lcr
+	}
+
+	for _, pr := range h.PendingRounds.GetOrderedPendingRounds() {
+		state.PendingRounds = append(state.PendingRounds, *pr)
+	}
+
+	return state
+}
+
+// Reset clears the Hashgraph and resets it from a new base, a Block and the
+// corresponding Frame.
+func (h *Hashgraph) Reset(block *types.Block, frame *types.Frame) error {
+	h.LastConsensusRound = nil
+	h.FirstConsensusRound = nil
+	h.UndeterminedEvents = []string{}
+	h.PendingRounds = types.NewPendingRoundsCache()
+	h.PendingLoadedEvents = 0
+	h.topologicalIndex = 0
+	h.dividedIndex = 0
+	h.stronglySeeCache = newStronglySeeCache(h.Store.CacheSize())
+	h.tracer.reset()
+
+	if err := h.Store.Reset(frame); err != nil {
+		return err
+	}
+
+	for _, fe := range frame.SortedFrameEvents() {
+		if err := h.insertFrameEvent(fe); err != nil {
+			return err
+		}
+	}
+
+	if err := h.Store.SetBlock(block); err != nil {
+		return err
+	}
+
+	h.setLastConsensusRound(block.RoundReceived())
+	h.resetRound = block.RoundReceived()
+
+	//the CacheCheckpoints written before the Reset point to Events which
+	//were renumbered
+	if err := h.saveCacheCheckpoint(); err != nil {
+		return err
+	}
+
+	h.logger.Info("hashgraph reset",
+		logger.Block, block.Index(),
+		logger.Round, block.RoundReceived())
+
+	return nil
+}
+
+// insertFrameEvent inserts an Event from a Frame, with its Round and
+// LamportTimestamp already set, without running the consensus methods.
+func (h *Hashgraph) insertFrameEvent(frameEvent *types.FrameEvent) error {
+	event := frameEvent.Core
+
+	event.SetRound(frameEvent.Round)
+	event.SetLamportTimestamp(frameEvent.LamportTimestamp)
+
+	roundInfo, err := h.Store.GetRound(frameEvent.Round)
+	if err != nil && !errors.Is(err, errors.KeyNotFound) {
+		return err
+	}
+	if roundInfo == nil {
+		roundInfo = types.NewRoundInfo()
+	}
+
+	roundInfo.AddCreatedEvent(event.GetHex(), frameEvent.Witness)
+
+	if err := h.Store.SetRound(frameEvent.Round, roundInfo); err != nil {
+		return err
+	}
+
+	event.TopologicalIndex = h.topologicalIndex
+	h.topologicalIndex++
+
+	//The parents of Root Events are below the Frame, so they keep the wire
+	//info carried by the Frame
+	root, err := h.isRootEvent(event)
+	if err != nil {
+		return err
+	}
+	if !root {
+		if err := h.setWireInfo(event); err != nil {
+			return err
+		}
+	}
+
+	if err := h.initEventCoordinates(event); err != nil {
+		return err
+	}
+
+	if err := h.Store.SetEvent(event); err != nil {
+		return err
+	}
+
+	return h.updateAncestorFirstDescendant(event)
+}
+
+// isRootEvent reports whether a parent of a Frame Event is missing from the
+// Store, because it lies below the Frame, in the Root of its creator
+func (h *Hashgraph) isRootEvent(event *types.Event) (bool, error) {
+	for _, p := range event.Body.Parents {
+		if p == "" {
+			continue
+		}
+		if _, err := h.Store.GetEvent(p); err != nil {
+			if errors.Is(err, errors.KeyNotFound) {
+				return true, nil
+			}
+			return false, err
+		}
+	}
+	return false, nil
+}
+
+// ReadWireInfo converts a WireEvent to an Event by replacing the parent IDs
+// and indexes with the corresponding hashes.
+func (h *Hashgraph) ReadWireInfo(wevent types.WireEvent) (*types.Event, error) {
+	return h.readWireInfo(wevent, nil)
+}
+
+// readWireInfo is ReadWireInfo with the parents looked up in batch before the
+// Store
+func (h *Hashgraph) readWireInfo(wevent types.WireEvent, batch map[wireRef]string) (*types.Event, error) {
+	var err error
+
+	selfParent := ""
+	otherParent := ""
+
+	if wevent.Body.Coded != nil {
+		return nil, types.ErrCodedPayload
+	}
+	if wevent.Body.TxHashes != nil {
+		return nil, types.ErrDigestedPayload
+	}
+
+	creator, ok := h.Store.RepertoireByID()[wevent.Body.CreatorID]
+	if !ok {
+		return nil, fmt.Errorf("creator %d not found", wevent.Body.CreatorID)
+	}
+
+	creatorBytes, err := uncompressedPubKey(creator.PubKeyBytes())
+	if err != nil {
+		return nil, err
+	}
+
+	if wevent.Body.SelfParentIndex >= 0 {
+		ref := wireRef{wevent.Body.CreatorID, wevent.Body.SelfParentIndex}
+		if hex, ok := batch[ref]; ok {
+			selfParent = hex
+		} else if selfParent, err = h.Store.ParticipantEvent(creator.PubKeyString(), wevent.Body.SelfParentIndex); err != nil {
+			return nil, h.parentError(ref, err)
+		}
+	}
+
+	if wevent.Body.OtherParentIndex >= 0 {
+		otherParentCreator, ok := h.Store.RepertoireByID()[wevent.Body.OtherParentCreatorID]
+		if !ok {
+			return nil, fmt.Errorf("creator %d not found", wevent.Body.OtherParentCreatorID)
+		}
+
+		ref := wireRef{wevent.Body.OtherParentCreatorID, wevent.Body.OtherParentIndex}
+		if hex, ok := batch[ref]; ok {
+			otherParent = hex
+		} else if otherParent, err = h.Store.ParticipantEvent(otherParentCreator.PubKeyString(), wevent.Body.OtherParentIndex); err != nil {
+			return nil, h.parentError(ref, err)
+		}
+	}
+
+	body := types.EventBody{
+		Transactions:         wevent.Body.Transactions,
+		InternalTransactions: wevent.Body.InternalTransactions,
+		PayloadTypes:         wevent.Body.PayloadTypes,
+		Parents:              []string{selfParent, otherParent},
+		Creator:              creatorBytes,
+		Index:                wevent.Body.Index,
+		BlockSignatures:      wevent.BlockSignatures(creatorBytes),
+	}
+
+	event := &types.Event{
+		Body:      body,
+		Signature: wevent.Signature,
+	}
+
+	event.SetWireInfo(wevent.Body.SelfParentIndex,
+		wevent.Body.OtherParentCreatorID,
+		wevent.Body.OtherParentIndex,
+		wevent.Body.CreatorID)
+
+	return event, nil
+}
+
+// uncompressedPubKey returns the uncompressed form of a public key, which is
+// the form used in EventBody.Creator and BlockSignature.Validator.
+func uncompressedPubKey(pub []byte) ([]byte, error) {
+	if _, err := crypto.UnmarshalPubkey(pub); err == nil {
+		return pub, nil
+	}
+
+	pubKey, err := crypto.DecompressPubkey(pub)
+	if err != nil {
+		return nil, err
+	}
+
+	return crypto.FromECDSAPub(pubKey), nil
+}
@@ -0,0 +1,43 @@
+package hashgraph
+
+import (
+	"context"
+	"sort"
+
+	"github.com/bolaxy/core/types"
+)
+
+// PayloadHandler processes the transactions of one PayloadType of a committed
+// Block
+type PayloadHandler func(ctx context.Context, block *types.Block, txs [][]byte) error
+
+// RoutePayloads returns a CommitCallback which passes the transactions of
+// each committed Block to the handler of their PayloadType, in PayloadType
+// order, before calling next. Types without a handler are only seen by next.
+func RoutePayloads(handlers map[types.PayloadType]PayloadHandler, next CommitCallback) CommitCallback {
+	order := make([]types.PayloadType, 0, len(handlers))
+	for t := range handlers {
+		order = append(order, t)
+	}
+	sort.Slice(order, func(i, j int) bool { return order[i] < order[j] })
+
+	return func(ctx context.Context, block *types.Block) error {
+		for _, t := range order {
+			handler := handlers[t]
+
+			txs := block.TransactionsOfType(t)
+			if len(txs) == 0 {
+				continue
+			}
+
+			if err := handler(ctx, block, txs); err != nil {
+				return err
+			}
+		}
+
+		if next != nil {
+			return next(ctx, block)
+		}
+		return nil
+	}
+}
@@ -0,0 +1,154 @@
+package hashgraph
+
+import (
+	"fmt"
+
+	"github.com/bolaxy/core/types"
+)
+
+// TxQuota bounds the transactions that each creator puts in its Events per
+// round, so that a single validator cannot flood the Blocks. Zero values mean
+// no limit. InternalTransactions and Block signatures are not counted.
+type TxQuota struct {
+	MaxTxs   int // transactions per round
+	MaxBytes int // total size of the transactions per round
+}
+
+func (q TxQuota) enabled() bool {
+	return q.MaxTxs > 0 || q.MaxBytes > 0
+}
+
+// QuotaError is returned for an Event whose transactions take its creator over
+// its TxQuota
+type QuotaError struct {
+	Creator string
+	Round   int
+	Txs     int // in the round, the Event included
+	Bytes   int
+}
+
+func (e *QuotaError) Error() string {
+	return fmt.Sprintf("creator %s over its quota in round %d: %d txs, %d bytes",
+		e.Creator, e.Round, e.Txs, e.Bytes)
+}
+
+// quotaUsage is the payload of the Events of a creator in a round
+type quotaUsage struct {
+	round int
+	txs   int
+	bytes int
+}
+
+// SetTxQuota bounds the transactions of the Events of each creator per round.
+// The round of an Event is not known when it is inserted, so an Event counts
+// in the round of its self-parent, which is where it lands unless it is a
+// witness. The usage is summed over the self-parents, whose rounds depend on
+// their ancestry only and are kept in the Store, so that all the nodes reach
+// the same decision. All the nodes of a network must use the same quota.
+func (h *Hashgraph) SetTxQuota(quota TxQuota) {
+	h.txQuota = quota
+}
+
+// quotaRound returns the round in which the child of an Event counts, and
+// whether it is known
+func (h *Hashgraph) quotaRound(ev *types.Event) (int, bool) {
+	if ev.SelfParent() == "" {
+		return -1, true
+	}
+	r, err := h.round(ev.SelfParent())
+	if err != nil {
+		return 0, false
+	}
+	return r, true
+}
+
+// quotaBase returns the usage of a creator in the round of its next Event,
+// on top of selfParent, before that Event. The rounds of the Events inserted
+// since the last DivideRounds are computed, and recorded by the next one. The
+// Events before the base of a Store which was reset are not counted.
+func (h *Hashgraph) quotaBase(selfParent string) (quotaUsage, error) {
+	if selfParent == "" {
+		return quotaUsage{round: -1}, nil
+	}
+
+	round, err := h.round(selfParent)
+	if err != nil {
+		return quotaUsage{}, err
+	}
+
+	sp, err := h.Store.GetEvent(selfParent)
+	if err != nil {
+		return quotaUsage{}, err
+	}
+
+	u := quotaUsage{round: round}
+	for ev := sp; ; {
+		if r, ok := h.quotaRound(ev); !ok || r != u.round {
+			break
+		}
+		u.txs += len(ev.Body.Transactions)
+		u.bytes += ev.PayloadSize()
+
+		if ev, err = h.Store.GetEvent(ev.SelfParent()); err != nil {
+			break
+		}
+	}
+
+	return u, nil
+}
+
+func (h *Hashgraph) overQuota(u quotaUsage) bool {
+	return (h.txQuota.MaxTxs > 0 && u.txs > h.txQuota.MaxTxs) ||
+		(h.txQuota.MaxBytes > 0 && u.bytes > h.txQuota.MaxBytes)
+}
+
+// QuotaFit returns the number of leading transactions of txs which a creator
+// can put in its next Event, on top of selfParent, without going over its
+// TxQuota
+func (h *Hashgraph) QuotaFit(selfParent string, txs [][]byte) int {
+	if !h.txQuota.enabled() {
+		return len(txs)
+	}
+
+	u, err := h.quotaBase(selfParent)
+	if err != nil {
+		return len(txs)
+	}
+
+	for i, tx := range txs {
+		u.txs++
+		u.bytes += len(tx)
+		if h.overQuota(u) {
+			return i
+		}
+	}
+	return len(txs)
+}
+
+// checkQuota returns a QuotaError if the transactions of an Event take its
+// creator over its TxQuota. The Events replayed by a Bootstrap were accepted
+// before, and are not checked.
+func (h *Hashgraph) checkQuota(event *types.Event) error {
+	if !h.txQuota.enabled() || h.bootstrapping {
+		return nil
+	}
+
+	u, err := h.quotaBase(event.SelfParent())
+	if err != nil {
+		return err
+	}
+
+	u.txs += len(event.Body.Transactions)
+	u.bytes += event.PayloadSize()
+
+	if h.overQuota(u) {
+		return &QuotaError{
+			Creator: event.GetCreator(),
+			Round:   u.round,
+			Txs:     u.txs,
+			Bytes:   u.bytes,
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,83 @@
+package hashgraph
+
+import (
+	"context"
+
+	"github.com/bolaxy/core/trace"
+)
+
+// eventTracer keeps one open span per event, from its insertion to the commit
+// of its block, and annotates it at each consensus step. All methods are safe
+// to call on a nil *eventTracer, which disables tracing.
+type eventTracer struct {
+	tracer trace.Tracer
+	max    int
+	spans  map[string]trace.Span
+}
+
+func newEventTracer(t trace.Tracer, config trace.Config) *eventTracer {
+	if !config.Enabled || t == nil {
+		return nil
+	}
+
+	max := config.MaxTrackedEvents
+	if max <= 0 {
+		max = trace.DefaultMaxTrackedEvents
+	}
+
+	return &eventTracer{
+		tracer: t,
+		max:    max,
+		spans:  make(map[string]trace.Span),
+	}
+}
+
+func (et *eventTracer) inserted(hex string, creator string, index int) {
+	if et == nil || len(et.spans) >= et.max {
+		return
+	}
+
+	_, span := et.tracer.Start(context.Background(), "event",
+		trace.String("event.hash", hex),
+		trace.String("event.creator", creator),
+		trace.Int("event.index", index))
+
+	span.AddEvent("inserted")
+
+	et.spans[hex] = span
+}
+
+func (et *eventTracer) annotate(hex string, name string, attrs ...trace.Attribute) {
+	if et == nil {
+		return
+	}
+
+	if span, ok := et.spans[hex]; ok {
+		span.AddEvent(name, attrs...)
+	}
+}
+
+func (et *eventTracer) end(hex string, attrs ...trace.Attribute) {
+	if et == nil {
+		return
+	}
+
+	if span, ok := et.spans[hex]; ok {
+		span.SetAttributes(attrs...)
+		span.End()
+		delete(et.spans, hex)
+	}
+}
+
+// reset ends all the open spans, for example after a Reset of the Hashgraph
+func (et *eventTracer) reset() {
+	if et == nil {
+		return
+	}
+
+	for hex, span := range et.spans {
+		span.AddEvent("reset")
+		span.End()
+		delete(et.spans, hex)
+	}
+}
@@ -0,0 +1,362 @@
+// Package keystore stores the private keys of validators encrypted with a
+// passphrase, instead of in plain key files. The key is derived from the
+// passphrase with scrypt, and encrypts the private key with AES-256-GCM. A
+// decrypted key is used through a signer.Signer.
+package keystore
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdsa"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/bolaxy/common/hexutil"
+	"github.com/bolaxy/core/signer"
+	"github.com/bolaxy/crypto"
+	"golang.org/x/crypto/scrypt"
+)
+
+const (
+	version    = 1
+	kdfScrypt  = "scrypt"
+	cipherName = "aes-256-gcm"
+	keyLen     = 32
+	saltLen    = 32
+	fileSuffix = ".json"
+)
+
+var (
+	// ErrDecrypt is returned for a wrong passphrase, or a corrupted key file
+	ErrDecrypt = errors.New("could not decrypt key with the given passphrase")
+	// ErrNoKey is returned for a public key which is not in the Keystore
+	ErrNoKey = errors.New("no key for the given public key")
+	// ErrKeyExists is returned when a key is created or imported twice
+	ErrKeyExists = errors.New("key already exists")
+)
+
+// ScryptParams are the costs of the derivation of the encryption key from
+// the passphrase. They are recorded in every key file, so changing them only
+// affects the keys written afterwards.
+type ScryptParams struct {
+	N int
+	R int
+	P int
+}
+
+var (
+	// StandardScrypt takes about a second and 256MB to decrypt a key
+	StandardScrypt = ScryptParams{N: 1 << 18, R: 8, P: 1}
+	// LightScrypt takes a few milliseconds, for test networks
+	LightScrypt = ScryptParams{N: 1 << 12, R: 8, P: 1}
+)
+
+// keyFile is the JSON content of the file of a key
+type keyFile struct {
+	Version   int
+	PublicKey string //upper case hex of the compressed key, as in PeerSets
+	Crypto    cryptoJSON
+}
+
+type cryptoJSON struct {
+	KDF        string
+	KDFParams  ScryptParams
+	Salt       []byte
+	Cipher     string
+	Nonce      []byte
+	Ciphertext []byte
+}
+
+// Keystore is a directory of encrypted keys, one file per key, named after
+// the public key
+type Keystore struct {
+	dir    string
+	scrypt ScryptParams
+}
+
+// New opens the Keystore of dir, which is created if it does not exist
+func New(dir string) (*Keystore, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	return &Keystore{
+		dir:    dir,
+		scrypt: StandardScrypt,
+	}, nil
+}
+
+// SetScrypt overrides StandardScrypt for the keys written afterwards
+func (ks *Keystore) SetScrypt(p ScryptParams) {
+	ks.scrypt = p
+}
+
+// Dir ...
+func (ks *Keystore) Dir() string {
+	return ks.dir
+}
+
+// PublicKeyHex returns the upper case hex of the compressed key pub, which
+// names its private key in the Keystore
+func PublicKeyHex(pub *ecdsa.PublicKey) string {
+	return strings.ToUpper(hexutil.Encode(crypto.CompressPubkey(pub)))
+}
+
+// path returns the file of pubKey, which must be hex, so that it can not
+// name a file outside of the directory
+func (ks *Keystore) path(pubKey string) (string, error) {
+	if _, err := hexutil.Decode(strings.ToLower(pubKey)); err != nil {
+		return "", fmt.Errorf("invalid public key %q: %v", pubKey, err)
+	}
+	return filepath.Join(ks.dir, strings.ToUpper(pubKey)+fileSuffix), nil
+}
+
+// List returns the public keys of the Keystore, sorted
+func (ks *Keystore) List() ([]string, error) {
+	files, err := ioutil.ReadDir(ks.dir)
+	if err != nil {
+		return nil, err
+	}
+
+	res := []string{}
+	for _, f := range files {
+		if f.IsDir() || !strings.HasSuffix(f.Name(), fileSuffix) {
+			continue
+		}
+		res = append(res, strings.TrimSuffix(f.Name(), fileSuffix))
+	}
+	sort.Strings(res)
+
+	return res, nil
+}
+
+// Create generates a key, stores it encrypted with passphrase, and returns
+// its public key
+func (ks *Keystore) Create(passphrase string) (string, error) {
+	key, err := crypto.GenerateKey()
+	if err != nil {
+		return "", err
+	}
+	return ks.Import(key, passphrase)
+}
+
+// Import stores key encrypted with passphrase, and returns its public key
+func (ks *Keystore) Import(key *ecdsa.PrivateKey, passphrase string) (string, error) {
+	pubKey := PublicKeyHex(&key.PublicKey)
+
+	path, err := ks.path(pubKey)
+	if err != nil {
+		return "", err
+	}
+	if _, err := os.Stat(path); err == nil {
+		return "", ErrKeyExists
+	}
+
+	if err := ks.write(key, passphrase); err != nil {
+		return "", err
+	}
+
+	return pubKey, nil
+}
+
+// Export returns the decrypted key of pubKey
+func (ks *Keystore) Export(pubKey, passphrase string) (*ecdsa.PrivateKey, error) {
+	kf, err := ks.read(pubKey)
+	if err != nil {
+		return nil, err
+	}
+	return decrypt(kf, passphrase)
+}
+
+// ChangePassphrase encrypts the key of pubKey again, with newPassphrase and
+// the current ScryptParams
+func (ks *Keystore) ChangePassphrase(pubKey, oldPassphrase, newPassphrase string) error {
+	key, err := ks.Export(pubKey, oldPassphrase)
+	if err != nil {
+		return err
+	}
+	return ks.write(key, newPassphrase)
+}
+
+// Delete removes the key of pubKey, once its passphrase is checked
+func (ks *Keystore) Delete(pubKey, passphrase string) error {
+	if _, err := ks.Export(pubKey, passphrase); err != nil {
+		return err
+	}
+	path, err := ks.path(pubKey)
+	if err != nil {
+		return err
+	}
+	return os.Remove(path)
+}
+
+// Signer decrypts the key of pubKey and returns a Signer which holds it
+func (ks *Keystore) Signer(pubKey, passphrase string) (signer.Signer, error) {
+	key, err := ks.Export(pubKey, passphrase)
+	if err != nil {
+		return nil, err
+	}
+	return signer.NewLocal(key), nil
+}
+
+func (ks *Keystore) read(pubKey string) (*keyFile, error) {
+	path, err := ks.path(pubKey)
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, ErrNoKey
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	kf := new(keyFile)
+	if err := json.Unmarshal(data, kf); err != nil {
+		return nil, fmt.Errorf("key file of %s: %v", pubKey, err)
+	}
+	if kf.Version != version {
+		return nil, fmt.Errorf("key file of %s: unsupported version %d", pubKey, kf.Version)
+	}
+
+	return kf, nil
+}
+
+// write encrypts key into a temporary file which replaces its key file, so
+// that a crash does not leave a truncated key
+func (ks *Keystore) write(key *ecdsa.PrivateKey, passphrase string) error {
+	kf, err := encrypt(key, passphrase, ks.scrypt)
+	if err != nil {
+		return err
+	}
+
+	data, err := json.MarshalIndent(kf, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	tmp, err := ioutil.TempFile(ks.dir, ".key-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	path, err := ks.path(kf.PublicKey)
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), path)
+}
+
+/*******************************************************************************
+Encryption
+*******************************************************************************/
+
+func encrypt(key *ecdsa.PrivateKey, passphrase string, params ScryptParams) (*keyFile, error) {
+	salt := make([]byte, saltLen)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+
+	aead, err := newAEAD(passphrase, salt, params)
+	if err != nil {
+		return nil, err
+	}
+
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+
+	pubKey := PublicKeyHex(&key.PublicKey)
+
+	plain := crypto.FromECDSA(key)
+	defer zero(plain)
+
+	return &keyFile{
+		Version:   version,
+		PublicKey: pubKey,
+		Crypto: cryptoJSON{
+			KDF:        kdfScrypt,
+			KDFParams:  params,
+			Salt:       salt,
+			Cipher:     cipherName,
+			Nonce:      nonce,
+			Ciphertext: aead.Seal(nil, nonce, plain, []byte(pubKey)),
+		},
+	}, nil
+}
+
+func decrypt(kf *keyFile, passphrase string) (*ecdsa.PrivateKey, error) {
+	c := kf.Crypto
+	if c.KDF != kdfScrypt || c.Cipher != cipherName {
+		return nil, fmt.Errorf("unsupported key encryption %s/%s", c.KDF, c.Cipher)
+	}
+
+	aead, err := newAEAD(passphrase, c.Salt, c.KDFParams)
+	if err != nil {
+		return nil, err
+	}
+	if len(c.Nonce) != aead.NonceSize() {
+		return nil, ErrDecrypt
+	}
+
+	plain, err := aead.Open(nil, c.Nonce, c.Ciphertext, []byte(kf.PublicKey))
+	if err != nil {
+		return nil, ErrDecrypt
+	}
+	defer zero(plain)
+
+	key, err := crypto.ToECDSA(plain)
+	if err != nil {
+		return nil, ErrDecrypt
+	}
+
+	if PublicKeyHex(&key.PublicKey) != kf.PublicKey {
+		return nil, ErrDecrypt
+	}
+
+	return key, nil
+}
+
+func newAEAD(passphrase string, salt []byte, params ScryptParams) (cipher.AEAD, error) {
+	derived, err := scrypt.Key([]byte(passphrase), salt, params.N, params.R, params.P, keyLen)
+	if err != nil {
+		return nil, err
+	}
+	defer zero(derived)
+
+	block, err := aes.NewCipher(derived)
+	if err != nil {
+		return nil, err
+	}
+
+	return cipher.NewGCM(block)
+}
+
+func zero(b []byte) {
+	for i := range b {
+		b[i] = 0
+	}
+}
@@ -0,0 +1,203 @@
+// Package logger defines the structured Logger accepted by the store, the
+// caches, and the consensus engine.
+package logger
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Common field keys, so that log lines can be correlated across components
+const (
+	EventHex  = "event"
+	Round     = "round"
+	CreatorID = "creator_id"
+	Creator   = "creator"
+	Block     = "block"
+	Component = "component"
+	Err       = "err"
+)
+
+// Logger writes structured messages. kv is a list of alternating keys and
+// values.
+type Logger interface {
+	Debug(msg string, kv ...interface{})
+	Info(msg string, kv ...interface{})
+	Warn(msg string, kv ...interface{})
+	Error(msg string, kv ...interface{})
+	// With returns a Logger that adds kv to every message
+	With(kv ...interface{}) Logger
+}
+
+// Level ...
+type Level int32
+
+const (
+	// DebugLevel ...
+	DebugLevel Level = iota
+	// InfoLevel ...
+	InfoLevel
+	// WarnLevel ...
+	WarnLevel
+	// ErrorLevel ...
+	ErrorLevel
+)
+
+// String ...
+func (l Level) String() string {
+	switch l {
+	case DebugLevel:
+		return "debug"
+	case InfoLevel:
+		return "info"
+	case WarnLevel:
+		return "warn"
+	case ErrorLevel:
+		return "error"
+	default:
+		return "unknown"
+	}
+}
+
+// ParseLevel ...
+func ParseLevel(s string) (Level, error) {
+	switch strings.ToLower(s) {
+	case "debug":
+		return DebugLevel, nil
+	case "info":
+		return InfoLevel, nil
+	case "warn", "warning":
+		return WarnLevel, nil
+	case "error":
+		return ErrorLevel, nil
+	default:
+		return InfoLevel, fmt.Errorf("unknown log level %q", s)
+	}
+}
+
+// Leveled is implemented by the Loggers whose level can be changed at
+// runtime, like TextLogger
+type Leveled interface {
+	SetLevel(level Level)
+	GetLevel() Level
+}
+
+/*******************************************************************************
+Nop
+*******************************************************************************/
+
+// Nop is the default Logger. It discards everything.
+var Nop Logger = nopLogger{}
+
+type nopLogger struct{}
+
+func (nopLogger) Debug(msg string, kv ...interface{}) {}
+func (nopLogger) Info(msg string, kv ...interface{})  {}
+func (nopLogger) Warn(msg string, kv ...interface{})  {}
+func (nopLogger) Error(msg string, kv ...interface{}) {}
+func (n nopLogger) With(kv ...interface{}) Logger     { return n }
+
+// OrNop returns l, or Nop if l is nil
+func OrNop(l Logger) Logger {
+	if l == nil {
+		return Nop
+	}
+	return l
+}
+
+/*******************************************************************************
+Text
+*******************************************************************************/
+
+// TextLogger writes logfmt-style lines to an io.Writer. Its level can be
+// changed at runtime.
+type TextLogger struct {
+	out    io.Writer
+	lock   *sync.Mutex
+	level  *int32
+	fields []interface{}
+}
+
+// NewTextLogger ...
+func NewTextLogger(out io.Writer, level Level) *TextLogger {
+	l := int32(level)
+	return &TextLogger{
+		out:   out,
+		lock:  &sync.Mutex{},
+		level: &l,
+	}
+}
+
+// SetLevel changes the level of the logger and of all the loggers derived
+// from it with With
+func (t *TextLogger) SetLevel(level Level) {
+	atomic.StoreInt32(t.level, int32(level))
+}
+
+// GetLevel ...
+func (t *TextLogger) GetLevel() Level {
+	return Level(atomic.LoadInt32(t.level))
+}
+
+// Debug ...
+func (t *TextLogger) Debug(msg string, kv ...interface{}) { t.log(DebugLevel, msg, kv) }
+
+// Info ...
+func (t *TextLogger) Info(msg string, kv ...interface{}) { t.log(InfoLevel, msg, kv) }
+
+// Warn ...
+func (t *TextLogger) Warn(msg string, kv ...interface{}) { t.log(WarnLevel, msg, kv) }
+
+// Error ...
+func (t *TextLogger) Error(msg string, kv ...interface{}) { t.log(ErrorLevel, msg, kv) }
+
+// With ...
+func (t *TextLogger) With(kv ...interface{}) Logger {
+	fields := make([]interface{}, 0, len(t.fields)+len(kv))
+	fields = append(fields, t.fields...)
+	fields = append(fields, kv...)
+
+	return &TextLogger{
+		out:    t.out,
+		lock:   t.lock,
+		level:  t.level,
+		fields: fields,
+	}
+}
+
+func (t *TextLogger) log(level Level, msg string, kv []interface{}) {
+	if level < t.GetLevel() {
+		return
+	}
+
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "time=%s level=%s msg=%q", time.Now().UTC().Format(time.RFC3339Nano), level, msg)
+	writeKV(&b, t.fields)
+	writeKV(&b, kv)
+	b.WriteByte('\n')
+
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	t.out.Write(b.Bytes())
+}
+
+func writeKV(b *bytes.Buffer, kv []interface{}) {
+	for i := 0; i < len(kv); i += 2 {
+		key := fmt.Sprint(kv[i])
+		if i+1 >= len(kv) {
+			fmt.Fprintf(b, " %s=MISSING", key)
+			break
+		}
+
+		val := fmt.Sprint(kv[i+1])
+		if strings.ContainsAny(val, " \"=") {
+			val = fmt.Sprintf("%q", val)
+		}
+		fmt.Fprintf(b, " %s=%s", key, val)
+	}
+}
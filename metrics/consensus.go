@@ -0,0 +1,132 @@
+package metrics
+
+import (
+	"sync"
+	"time"
+)
+
+// maxTrackedEvents bounds the number of insertion times kept to compute block
+// latencies. Events that never reach consensus are dropped beyond this.
+const maxTrackedEvents = 100000
+
+// ConsensusMetrics groups the metrics of consensus progress. All methods are
+// safe to call on a nil *ConsensusMetrics, which disables metrics.
+type ConsensusMetrics struct {
+	EventsInserted  *Counter
+	RoundsDecided   *Counter
+	BlocksCommitted *Counter
+	BlockLatency    *Histogram
+	UndecidedRounds *Gauge
+	SyncRTT         *Histogram
+	SigPoolDepth    *Gauge
+
+	lock     sync.Mutex
+	inserted map[string]time.Time
+}
+
+// NewConsensusMetrics creates the consensus metrics and registers them
+func NewConsensusMetrics(reg *Registry) *ConsensusMetrics {
+	m := &ConsensusMetrics{
+		EventsInserted:  NewCounter("core_events_inserted_total", "Number of events inserted in the hashgraph."),
+		RoundsDecided:   NewCounter("core_rounds_decided_total", "Number of rounds whose witnesses are all decided."),
+		BlocksCommitted: NewCounter("core_blocks_committed_total", "Number of blocks committed."),
+		BlockLatency:    NewHistogram("core_block_latency_seconds", "Time between the insertion of an event and the commit of its block.", DefaultBuckets),
+		UndecidedRounds: NewGauge("core_undecided_rounds", "Number of pending rounds that are not decided."),
+		SyncRTT:         NewHistogram("core_sync_rtt_seconds", "Round-trip time of sync requests.", DefaultBuckets),
+		SigPoolDepth:    NewGauge("core_sigpool_depth", "Number of block signatures waiting to be processed."),
+		inserted:        make(map[string]time.Time),
+	}
+
+	reg.MustRegister(
+		m.EventsInserted,
+		m.RoundsDecided,
+		m.BlocksCommitted,
+		m.BlockLatency,
+		m.UndecidedRounds,
+		m.SyncRTT,
+		m.SigPoolDepth,
+	)
+
+	return m
+}
+
+// EventInserted records the insertion of an event
+func (m *ConsensusMetrics) EventInserted(hash string) {
+	if m == nil {
+		return
+	}
+
+	m.EventsInserted.Inc()
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if len(m.inserted) < maxTrackedEvents {
+		m.inserted[hash] = time.Now()
+	}
+}
+
+// BlockCommitted records the commit of a block containing the given events
+func (m *ConsensusMetrics) BlockCommitted(eventHashes []string) {
+	if m == nil {
+		return
+	}
+
+	m.BlocksCommitted.Inc()
+
+	now := time.Now()
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	for _, h := range eventHashes {
+		if t, ok := m.inserted[h]; ok {
+			m.BlockLatency.Observe(now.Sub(t).Seconds())
+			delete(m.inserted, h)
+		}
+	}
+}
+
+// EventsCommitted forgets the insertion times of events that reached
+// consensus without producing a block
+func (m *ConsensusMetrics) EventsCommitted(eventHashes []string) {
+	if m == nil {
+		return
+	}
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	for _, h := range eventHashes {
+		delete(m.inserted, h)
+	}
+}
+
+// RoundsDecidedN ...
+func (m *ConsensusMetrics) RoundsDecidedN(n int) {
+	if m == nil || n <= 0 {
+		return
+	}
+	m.RoundsDecided.Add(uint64(n))
+}
+
+// SetUndecidedRounds ...
+func (m *ConsensusMetrics) SetUndecidedRounds(n int) {
+	if m == nil {
+		return
+	}
+	m.UndecidedRounds.Set(float64(n))
+}
+
+// SetSigPoolDepth ...
+func (m *ConsensusMetrics) SetSigPoolDepth(n int) {
+	if m == nil {
+		return
+	}
+	m.SigPoolDepth.Set(float64(n))
+}
+
+// ObserveSyncRTT ...
+func (m *ConsensusMetrics) ObserveSyncRTT(d time.Duration) {
+	if m == nil {
+		return
+	}
+	m.SyncRTT.Observe(d.Seconds())
+}
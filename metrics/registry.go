@@ -0,0 +1,242 @@
+package metrics
+
+import (
+	"bytes"
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+)
+
+// Collector is a metric that can be written in the Prometheus text
+// exposition format.
+type Collector interface {
+	Name() string
+	Help() string
+	Type() string
+	Write(buf *bytes.Buffer)
+}
+
+// Registry holds Collectors and serves them to a Prometheus scraper
+type Registry struct {
+	lock       sync.RWMutex
+	collectors map[string]Collector
+}
+
+// NewRegistry ...
+func NewRegistry() *Registry {
+	return &Registry{
+		collectors: make(map[string]Collector),
+	}
+}
+
+// Register adds a Collector. Names must be unique.
+func (r *Registry) Register(c Collector) error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	if _, ok := r.collectors[c.Name()]; ok {
+		return fmt.Errorf("metric %s already registered", c.Name())
+	}
+	r.collectors[c.Name()] = c
+	return nil
+}
+
+// MustRegister is like Register but panics on duplicates
+func (r *Registry) MustRegister(cs ...Collector) {
+	for _, c := range cs {
+		if err := r.Register(c); err != nil {
+			panic(err)
+		}
+	}
+}
+
+// Gather writes all the metrics, sorted by name, in the text exposition
+// format.
+func (r *Registry) Gather() []byte {
+	r.lock.RLock()
+	names := make([]string, 0, len(r.collectors))
+	for n := range r.collectors {
+		names = append(names, n)
+	}
+	r.lock.RUnlock()
+
+	sort.Strings(names)
+
+	buf := new(bytes.Buffer)
+	for _, n := range names {
+		r.lock.RLock()
+		c := r.collectors[n]
+		r.lock.RUnlock()
+
+		fmt.Fprintf(buf, "# HELP %s %s\n", c.Name(), c.Help())
+		fmt.Fprintf(buf, "# TYPE %s %s\n", c.Name(), c.Type())
+		c.Write(buf)
+	}
+	return buf.Bytes()
+}
+
+// ServeHTTP implements http.Handler so the Registry can be mounted at
+// /metrics
+func (r *Registry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	w.Write(r.Gather())
+}
+
+/*******************************************************************************
+Counter
+*******************************************************************************/
+
+// Counter is a monotonically increasing value
+type Counter struct {
+	name, help string
+	value      uint64
+}
+
+// NewCounter ...
+func NewCounter(name, help string) *Counter {
+	return &Counter{name: name, help: help}
+}
+
+// Inc ...
+func (c *Counter) Inc() {
+	atomic.AddUint64(&c.value, 1)
+}
+
+// Add ...
+func (c *Counter) Add(n uint64) {
+	atomic.AddUint64(&c.value, n)
+}
+
+// Value ...
+func (c *Counter) Value() uint64 {
+	return atomic.LoadUint64(&c.value)
+}
+
+// Name ...
+func (c *Counter) Name() string { return c.name }
+
+// Help ...
+func (c *Counter) Help() string { return c.help }
+
+// Type ...
+func (c *Counter) Type() string { return "counter" }
+
+// Write ...
+func (c *Counter) Write(buf *bytes.Buffer) {
+	fmt.Fprintf(buf, "%s %d\n", c.name, c.Value())
+}
+
+/*******************************************************************************
+Gauge
+*******************************************************************************/
+
+// Gauge is a value that can go up and down
+type Gauge struct {
+	name, help string
+	bits       uint64
+}
+
+// NewGauge ...
+func NewGauge(name, help string) *Gauge {
+	return &Gauge{name: name, help: help}
+}
+
+// Set ...
+func (g *Gauge) Set(v float64) {
+	atomic.StoreUint64(&g.bits, math.Float64bits(v))
+}
+
+// Value ...
+func (g *Gauge) Value() float64 {
+	return math.Float64frombits(atomic.LoadUint64(&g.bits))
+}
+
+// Name ...
+func (g *Gauge) Name() string { return g.name }
+
+// Help ...
+func (g *Gauge) Help() string { return g.help }
+
+// Type ...
+func (g *Gauge) Type() string { return "gauge" }
+
+// Write ...
+func (g *Gauge) Write(buf *bytes.Buffer) {
+	fmt.Fprintf(buf, "%s %s\n", g.name, formatFloat(g.Value()))
+}
+
+/*******************************************************************************
+Histogram
+*******************************************************************************/
+
+// DefaultBuckets are latency buckets in seconds
+var DefaultBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// Histogram counts observations in cumulative buckets
+type Histogram struct {
+	name, help string
+	buckets    []float64
+
+	lock   sync.Mutex
+	counts []uint64
+	sum    float64
+	count  uint64
+}
+
+// NewHistogram creates a Histogram with sorted upper bounds
+func NewHistogram(name, help string, buckets []float64) *Histogram {
+	b := make([]float64, len(buckets))
+	copy(b, buckets)
+	sort.Float64s(b)
+
+	return &Histogram{
+		name:    name,
+		help:    help,
+		buckets: b,
+		counts:  make([]uint64, len(b)),
+	}
+}
+
+// Observe ...
+func (h *Histogram) Observe(v float64) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	for i, ub := range h.buckets {
+		if v <= ub {
+			h.counts[i]++
+		}
+	}
+	h.sum += v
+	h.count++
+}
+
+// Name ...
+func (h *Histogram) Name() string { return h.name }
+
+// Help ...
+func (h *Histogram) Help() string { return h.help }
+
+// Type ...
+func (h *Histogram) Type() string { return "histogram" }
+
+// Write ...
+func (h *Histogram) Write(buf *bytes.Buffer) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	for i, ub := range h.buckets {
+		fmt.Fprintf(buf, "%s_bucket{le=\"%s\"} %d\n", h.name, formatFloat(ub), h.counts[i])
+	}
+	fmt.Fprintf(buf, "%s_bucket{le=\"+Inf\"} %d\n", h.name, h.count)
+	fmt.Fprintf(buf, "%s_sum %s\n", h.name, formatFloat(h.sum))
+	fmt.Fprintf(buf, "%s_count %d\n", h.name, h.count)
+}
+
+func formatFloat(f float64) string {
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
@@ -0,0 +1,193 @@
+package metrics
+
+import (
+	"sync"
+	"time"
+)
+
+// DefaultStatsWindow is the number of samples of the moving averages of Stats
+const DefaultStatsWindow = 100
+
+// StatsSnapshot holds the moving averages of Stats. The durations are zero
+// until two samples were recorded.
+type StatsSnapshot struct {
+	RoundDuration  time.Duration // between the consensus of two rounds
+	EventsPerRound float64
+	BlockInterval  time.Duration // between the commits of two Blocks
+	TxsPerBlock    float64
+	CommitLatency  time.Duration // from the insertion of an Event to its commit
+	Rounds         int           // number of rounds in the averages
+	Blocks         int           // number of Blocks in the averages
+}
+
+// window is a simple moving average over the last samples
+type window struct {
+	samples []float64
+	next    int
+	sum     float64
+}
+
+func newWindow(size int) *window {
+	return &window{samples: make([]float64, 0, size)}
+}
+
+func (w *window) add(v float64) {
+	if len(w.samples) < cap(w.samples) {
+		w.samples = append(w.samples, v)
+	} else {
+		w.sum -= w.samples[w.next]
+		w.samples[w.next] = v
+		w.next = (w.next + 1) % len(w.samples)
+	}
+	w.sum += v
+}
+
+func (w *window) mean() float64 {
+	if len(w.samples) == 0 {
+		return 0
+	}
+	return w.sum / float64(len(w.samples))
+}
+
+// Stats computes moving averages of the pace of consensus, from which
+// applications can predict confirmation times. All methods are safe to call
+// on a nil *Stats, which disables them.
+type Stats struct {
+	RoundDurationGauge  *Gauge
+	EventsPerRoundGauge *Gauge
+	BlockIntervalGauge  *Gauge
+	TxsPerBlockGauge    *Gauge
+	CommitLatencyGauge  *Gauge
+
+	lock           sync.Mutex
+	roundDuration  *window
+	eventsPerRound *window
+	blockInterval  *window
+	txsPerBlock    *window
+	commitLatency  *window
+	lastRound      time.Time
+	lastBlock      time.Time
+	inserted       map[string]time.Time
+}
+
+// NewStats averages the last size samples, DefaultStatsWindow if size <= 0.
+// The averages are also registered as gauges in reg, unless it is nil.
+func NewStats(size int, reg *Registry) *Stats {
+	if size <= 0 {
+		size = DefaultStatsWindow
+	}
+
+	s := &Stats{
+		RoundDurationGauge:  NewGauge("core_round_duration_seconds_avg", "Moving average of the time between the consensus of two rounds."),
+		EventsPerRoundGauge: NewGauge("core_events_per_round_avg", "Moving average of the number of events received in a round."),
+		BlockIntervalGauge:  NewGauge("core_block_interval_seconds_avg", "Moving average of the time between the commits of two blocks."),
+		TxsPerBlockGauge:    NewGauge("core_txs_per_block_avg", "Moving average of the number of transactions of a block."),
+		CommitLatencyGauge:  NewGauge("core_commit_latency_seconds_avg", "Moving average of the time between the insertion of an event and its commit."),
+		roundDuration:       newWindow(size),
+		eventsPerRound:      newWindow(size),
+		blockInterval:       newWindow(size),
+		txsPerBlock:         newWindow(size),
+		commitLatency:       newWindow(size),
+		inserted:            make(map[string]time.Time),
+	}
+
+	if reg != nil {
+		reg.MustRegister(
+			s.RoundDurationGauge,
+			s.EventsPerRoundGauge,
+			s.BlockIntervalGauge,
+			s.TxsPerBlockGauge,
+			s.CommitLatencyGauge,
+		)
+	}
+
+	return s
+}
+
+// EventInserted records the insertion time of an Event
+func (s *Stats) EventInserted(hash string) {
+	if s == nil {
+		return
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if len(s.inserted) < maxTrackedEvents {
+		s.inserted[hash] = time.Now()
+	}
+}
+
+// RoundProcessed records the consensus of a round, and of the Events it
+// received
+func (s *Stats) RoundProcessed(eventHashes []string) {
+	if s == nil {
+		return
+	}
+
+	now := time.Now()
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if !s.lastRound.IsZero() {
+		s.roundDuration.add(now.Sub(s.lastRound).Seconds())
+		s.RoundDurationGauge.Set(s.roundDuration.mean())
+	}
+	s.lastRound = now
+
+	s.eventsPerRound.add(float64(len(eventHashes)))
+	s.EventsPerRoundGauge.Set(s.eventsPerRound.mean())
+
+	for _, h := range eventHashes {
+		if t, ok := s.inserted[h]; ok {
+			s.commitLatency.add(now.Sub(t).Seconds())
+			delete(s.inserted, h)
+		}
+	}
+	s.CommitLatencyGauge.Set(s.commitLatency.mean())
+}
+
+// BlockCommitted records the commit of a Block of txs transactions
+func (s *Stats) BlockCommitted(txs int) {
+	if s == nil {
+		return
+	}
+
+	now := time.Now()
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if !s.lastBlock.IsZero() {
+		s.blockInterval.add(now.Sub(s.lastBlock).Seconds())
+		s.BlockIntervalGauge.Set(s.blockInterval.mean())
+	}
+	s.lastBlock = now
+
+	s.txsPerBlock.add(float64(txs))
+	s.TxsPerBlockGauge.Set(s.txsPerBlock.mean())
+}
+
+// Snapshot returns the current averages
+func (s *Stats) Snapshot() StatsSnapshot {
+	if s == nil {
+		return StatsSnapshot{}
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	return StatsSnapshot{
+		RoundDuration:  seconds(s.roundDuration.mean()),
+		EventsPerRound: s.eventsPerRound.mean(),
+		BlockInterval:  seconds(s.blockInterval.mean()),
+		TxsPerBlock:    s.txsPerBlock.mean(),
+		CommitLatency:  seconds(s.commitLatency.mean()),
+		Rounds:         len(s.eventsPerRound.samples),
+		Blocks:         len(s.txsPerBlock.samples),
+	}
+}
+
+func seconds(v float64) time.Duration {
+	return time.Duration(v * float64(time.Second))
+}
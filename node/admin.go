@@ -0,0 +1,143 @@
+package node
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/bolaxy/config"
+	"github.com/bolaxy/core/logger"
+	"github.com/bolaxy/core/store"
+	"github.com/bolaxy/core/transport"
+)
+
+// Prune deletes the Round and Frame records of the Store below a round, like
+// CachedStore.Prune. The rounds from the RoundReceived of the last Block are
+// kept, since they are needed to fast-forward the peers which join.
+func (n *Node) Prune(belowRound int) (int, error) {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+
+	cs, ok := n.hg.Store.(*store.CachedStore)
+	if !ok {
+		return 0, fmt.Errorf("pruning requires a CachedStore, got %T", n.hg.Store)
+	}
+
+	last, err := n.hg.Store.GetBlock(n.hg.Store.LastBlockIndex())
+	if err != nil {
+		return 0, fmt.Errorf("no block to prune below: %v", err)
+	}
+	if belowRound > last.RoundReceived() {
+		return 0, fmt.Errorf("round %d is after the round %d of the last block", belowRound, last.RoundReceived())
+	}
+
+	return cs.Prune(belowRound)
+}
+
+// Snapshot takes a snapshot of the application state after the last Block,
+// with the AppProxy, and records it for the next CacheCheckpoint. With an
+// AsyncApp, the application must have applied the last Block.
+func (n *Node) Snapshot() (*store.SnapshotRef, error) {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+
+	if n.app == nil {
+		return nil, fmt.Errorf("the application takes no snapshots")
+	}
+
+	index := n.hg.Store.LastBlockIndex()
+	if index < 0 {
+		return nil, fmt.Errorf("no block committed")
+	}
+
+	snapshot, err := n.app.GetSnapshot(index)
+	if err != nil {
+		return nil, fmt.Errorf("application snapshot of block %d: %v", index, err)
+	}
+
+	ref := snapshotRef(index, snapshot)
+	n.hg.SetSnapshot(ref)
+
+	n.logger.Info("application snapshot taken",
+		logger.Block, index,
+		"size", len(snapshot))
+
+	return ref, nil
+}
+
+// Peers returns the PeerSet of the last round
+func (n *Node) Peers() ([]*conf.Peer, error) {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+
+	peerSet, err := n.hg.Store.GetPeerSet(n.hg.Store.LastRound())
+	if err != nil {
+		return nil, err
+	}
+	return peerSet.Peers, nil
+}
+
+// Ban stops syncing with a peer and refuses its requests for d
+func (n *Node) Ban(peer uint32, d time.Duration) error {
+	if d <= 0 {
+		return fmt.Errorf("ban duration must be positive, got %v", d)
+	}
+
+	n.limiter.Ban(peer, d)
+
+	n.logger.Info("peer banned",
+		"peer", peer,
+		"duration", d)
+
+	return nil
+}
+
+// Unban lifts the ban of a peer
+func (n *Node) Unban(peer uint32) {
+	n.limiter.Unban(peer)
+	n.logger.Info("peer unbanned", "peer", peer)
+}
+
+// Banned returns true if a peer is banned
+func (n *Node) Banned(peer uint32) bool {
+	return n.limiter.Banned(peer)
+}
+
+// Traffic returns the bytes exchanged with each peer, by ID
+func (n *Node) Traffic() map[uint32]transport.PeerTraffic {
+	return n.bandwidth.Traffic()
+}
+
+// Reload applies the tunables of config which can change while the Node
+// runs: SyncLimit, SuspendLimit, StaleHorizon, SignatureFallback, RateLimits,
+// Bandwidth, and Creator. The other fields are only read by NewNode, and are ignored.
+// config must Validate. The ConsensusParams in force override it.
+func (n *Node) Reload(config Config) error {
+	if err := config.Validate(); err != nil {
+		return fmt.Errorf("invalid config: %v", err)
+	}
+	if config.SuspendLimit > n.config.CacheSize {
+		return fmt.Errorf("SuspendLimit (%d) must not exceed CacheSize (%d)", config.SuspendLimit, n.config.CacheSize)
+	}
+
+	n.lock.Lock()
+	defer n.lock.Unlock()
+
+	n.config.SyncLimit = config.SyncLimit
+	n.config.SuspendLimit = config.SuspendLimit
+	n.config.StaleHorizon = config.StaleHorizon
+	n.config.SignatureFallback = config.SignatureFallback
+	n.config.RateLimits = config.RateLimits
+	n.config.Bandwidth = config.Bandwidth
+	n.config.Creator = config.Creator
+
+	n.hg.SetStaleHorizon(config.StaleHorizon)
+	n.hg.SetMaxEventPayload(config.Creator.MaxEventPayload)
+	n.pool.SetMaxTxSize(config.Creator.MaxEventPayload)
+	n.limiter.SetLimits(config.RateLimits)
+	n.bandwidth.SetCaps(config.Bandwidth)
+	n.creator.SetConfig(n.creatorConfig())
+
+	n.logger.Info("config reloaded")
+
+	return nil
+}
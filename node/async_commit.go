@@ -0,0 +1,289 @@
+package node
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/bolaxy/core/logger"
+	"github.com/bolaxy/core/types"
+)
+
+// appLagSuspension is the reason of the suspensions caused by an AsyncApp
+// which does not acknowledge the commits fast enough
+const appLagSuspension = "application lagging behind commits"
+
+// AsyncApp is implemented by the applications which acknowledge the commits
+// of Blocks asynchronously, instead of returning from the CommitCallback once
+// the Block was applied
+type AsyncApp interface {
+	// CommitBlock hands a Block to the application, which acknowledges it
+	// through the returned CommitTicket once it is applied. The Blocks are
+	// handed in order, and must be applied in order. An error stops the
+	// processing of consensus, like an error of the CommitCallback, unless
+	// the Node has a commit outbox.
+	CommitBlock(ctx context.Context, block *types.Block) (*CommitTicket, error)
+}
+
+// CommitTicket is the future of the asynchronous commit of a Block
+type CommitTicket struct {
+	once      sync.Once
+	done      chan struct{}
+	stateHash []byte
+	err       error
+}
+
+// NewCommitTicket ...
+func NewCommitTicket() *CommitTicket {
+	return &CommitTicket{done: make(chan struct{})}
+}
+
+// Ack acknowledges the commit with the state hash of the application after
+// the Block, or with the error which prevented the application from applying
+// it. Only the first call counts.
+func (t *CommitTicket) Ack(stateHash []byte, err error) {
+	t.once.Do(func() {
+		t.stateHash = stateHash
+		t.err = err
+		close(t.done)
+	})
+}
+
+// Done is closed when the commit is acknowledged
+func (t *CommitTicket) Done() <-chan struct{} {
+	return t.done
+}
+
+// Result returns the state hash and the error given to Ack
+func (t *CommitTicket) Result() ([]byte, error) {
+	<-t.done
+	return t.stateHash, t.err
+}
+
+type pendingCommit struct {
+	block  *types.Block
+	ticket *CommitTicket //nil until the Block is handed to the AsyncApp
+	since  time.Time     //when the Block was handed to the AsyncApp
+	queued time.Time     //when the Block entered the commit outbox
+}
+
+// asyncCommits queues the Blocks handed to an AsyncApp until they are
+// acknowledged. With an outbox, the queue also holds the Blocks which are not
+// handed yet, after the ones which are.
+type asyncCommits struct {
+	app    AsyncApp
+	max    int
+	outbox *outbox //nil if the queue is only kept in memory
+
+	//handing serialises the hand-over of Blocks to the AsyncApp by deliver
+	//and by a Replay, so that they are handed in order
+	handing sync.Mutex
+
+	lock    sync.Mutex
+	pending []pendingCommit
+	wake    chan struct{}
+	alarm   bool //the outbox exceeds its bounds
+}
+
+// delivered returns the number of queued Blocks handed to the AsyncApp. It
+// must be called with the lock.
+func (a *asyncCommits) delivered() int {
+	for i, p := range a.pending {
+		if p.ticket == nil {
+			return i
+		}
+	}
+	return len(a.pending)
+}
+
+// SetAsyncApp hands the committed Blocks to app, after the CommitCallback
+// given to NewNode, which may be nil. The Blocks are signed when app
+// acknowledges them, with their state hash. When MaxPendingCommits Blocks
+// are not acknowledged, the Node is suspended until app catches up; the
+// bound is soft, as the Blocks of the rounds already decided are still
+// committed. The Blocks which are not acknowledged when the Node stops are
+// not handed again after a Bootstrap, unless SetCommitOutbox keeps them. It
+// must be called before Run.
+func (n *Node) SetAsyncApp(app AsyncApp) {
+	n.async = &asyncCommits{
+		app:  app,
+		max:  n.config.MaxPendingCommits,
+		wake: make(chan struct{}, 1),
+	}
+	n.commitCb = n.membership.Wrap(n.asyncCommit(n.appCommit))
+}
+
+// PendingCommits returns the number of Blocks handed to the AsyncApp which it
+// did not acknowledge
+func (n *Node) PendingCommits() int {
+	if n.async == nil {
+		return 0
+	}
+
+	n.async.lock.Lock()
+	defer n.async.lock.Unlock()
+	return len(n.async.pending)
+}
+
+// asyncCommit returns a CommitCallback which hands the Blocks to the AsyncApp
+// after cb, and suspends the Node when too many are not acknowledged
+func (n *Node) asyncCommit(cb func(ctx context.Context, block *types.Block) error) func(ctx context.Context, block *types.Block) error {
+	return func(ctx context.Context, block *types.Block) error {
+		if cb != nil {
+			if err := cb(ctx, block); err != nil {
+				return err
+			}
+		}
+
+		if n.async.outbox != nil {
+			return n.enqueue(ctx, block)
+		}
+
+		ticket, err := n.async.app.CommitBlock(ctx, block)
+		if err != nil {
+			return err
+		}
+
+		n.hg.AwaitAck(block.Index())
+
+		a := n.async
+		a.lock.Lock()
+		a.pending = append(a.pending, pendingCommit{block: block, ticket: ticket, since: time.Now()})
+		lagging := len(a.pending) >= a.max
+		a.lock.Unlock()
+
+		select {
+		case a.wake <- struct{}{}:
+		default:
+		}
+
+		if lagging {
+			n.suspend(appLagSuspension)
+		}
+
+		return nil
+	}
+}
+
+// acknowledge waits for the acknowledgments of the AsyncApp, in Block order,
+// and signs the acknowledged Blocks. With an outbox, it also hands the queued
+// Blocks to the AsyncApp, and retries while the AsyncApp refuses them.
+func (n *Node) acknowledge() {
+	defer n.wg.Done()
+
+	a := n.async
+	refused := false
+	for {
+		if a.outbox != nil {
+			err := n.deliver(n.ctx)
+			switch {
+			case err != nil && !refused:
+				n.logger.Warn("application refuses blocks, keeping them in the outbox",
+					"retry", outboxRetry,
+					logger.Err, err)
+			case err == nil && refused:
+				n.logger.Info("application accepts blocks again")
+			}
+			refused = err != nil
+		}
+
+		a.lock.Lock()
+		var next *pendingCommit
+		if len(a.pending) > 0 && a.pending[0].ticket != nil {
+			next = &a.pending[0]
+		}
+		a.lock.Unlock()
+
+		if next == nil && refused {
+			select {
+			case <-time.After(outboxRetry):
+				continue
+			case <-n.shutdownCh:
+				return
+			}
+		}
+
+		if next == nil {
+			select {
+			case <-a.wake:
+				continue
+			case <-n.shutdownCh:
+				return
+			}
+		}
+
+		//the queue is replaced by a Replay
+		select {
+		case <-next.ticket.Done():
+		case <-a.wake:
+			continue
+		case <-n.shutdownCh:
+			return
+		}
+
+		caughtUp, err := n.applyAck(*next)
+		if err != nil {
+			n.logger.Error("block commit not acknowledged",
+				logger.Block, next.block.Index(),
+				logger.Err, err)
+			n.suspend(fmt.Sprintf("commit of block %d failed: %v", next.block.Index(), err))
+			return
+		}
+
+		if caughtUp {
+			n.resume(appLagSuspension)
+		}
+	}
+}
+
+// applyAck sets the state hash of an acknowledged Block, signs it, and
+// removes it from the queue, unless a Replay replaced the queue meanwhile. It
+// reports whether the queue is back under the bound.
+func (n *Node) applyAck(p pendingCommit) (bool, error) {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+
+	a := n.async
+	a.lock.Lock()
+	stale := len(a.pending) == 0 || a.pending[0].ticket != p.ticket
+	a.lock.Unlock()
+	if stale {
+		return false, nil
+	}
+
+	stateHash, err := p.ticket.Result()
+	if err != nil {
+		return false, err
+	}
+
+	p.block.SetStateHash(stateHash)
+	if err := n.hg.Store.SetBlock(p.block); err != nil {
+		return false, err
+	}
+	n.hg.AckBlock(p.block.Index())
+
+	if err := n.sign(n.ctx, p.block); err != nil {
+		return false, err
+	}
+
+	if a.outbox != nil {
+		if err := a.outbox.ack(n.ctx, p.block.Index()); err != nil {
+			return false, err
+		}
+	}
+
+	a.lock.Lock()
+	a.pending = a.pending[1:]
+	caughtUp := len(a.pending) < a.max
+	if a.outbox != nil {
+		a.outbox.acked = p.block.Index()
+	}
+	a.lock.Unlock()
+
+	if a.outbox != nil {
+		n.watchOutbox(time.Now())
+	}
+
+	return caughtUp, nil
+}
@@ -0,0 +1,298 @@
+package node
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/bolaxy/config"
+	"github.com/bolaxy/core/db"
+	"github.com/bolaxy/core/hashgraph"
+	"github.com/bolaxy/core/store"
+	"github.com/bolaxy/core/transport"
+)
+
+// DefaultCacheSize is the default size of the caches of the Store
+const DefaultCacheSize = 10000
+
+// DefaultSyncBytesLimit is the default SyncBytesLimit of a Config
+const DefaultSyncBytesLimit = 8 << 20
+
+// Config holds the tunables of a Node. DefaultConfig gives sane values, and
+// NewNode refuses a Config which does not Validate.
+type Config struct {
+	// GossipInterval is the time between two syncs with a peer
+	GossipInterval time.Duration
+	// SyncLimit bounds the number of Events of a SyncResponse. 0 for no
+	// limit.
+	SyncLimit int
+	// SyncBytesLimit bounds the size in bytes of the Events of a
+	// SyncResponse, which holds at least one Event. 0 for no limit.
+	SyncBytesLimit int
+	// SuspendLimit suspends the Node when the number of undetermined Events
+	// exceeds it. 0 disables automatic suspension.
+	SuspendLimit int
+	// CacheSize is the size of the caches of the hot tier of the Store,
+	// among which the ParticipantEventsCache. It is used by NewStore.
+	CacheSize int
+	// MemoryBudget bounds, in bytes, the estimated memory held by the caches
+	// of a CachedStore, whose cold items are then evicted to the db. 0 for
+	// no bound. It is used by NewStore.
+	MemoryBudget int64
+	// ReadCacheSize bounds, in bytes, the read cache of a CachedStore, which
+	// keeps the Blocks and Frames read repeatedly from the db decoded. 0
+	// disables it. It is used by NewStore.
+	ReadCacheSize int64
+	// ExternalBodies is the size, in bytes, from which the transactions of
+	// the Blocks are kept in a content-addressed Partition of the db of a
+	// CachedStore, the Blocks keeping their hashes, so that large payloads
+	// are written once and dropped by Prune. 0 keeps the Blocks whole. It is
+	// used by NewStore.
+	ExternalBodies int
+	// CacheCheckpointInterval is the number of Rounds between two
+	// CacheCheckpoints of a PersistentStore. 0 disables them.
+	CacheCheckpointInterval int
+	// StaleHorizon drops from the sync responses the Events whose parents
+	// are all more than StaleHorizon rounds older than the last consensus
+	// round, unless a recent Event of the response descends from them. 0
+	// keeps all the Events.
+	StaleHorizon int
+	// TxQuota bounds the transactions of the Events of each creator per
+	// round. Over-quota Events are rejected, and recorded in the Reputation
+	// of their creator. All the nodes of a network must use the same quota.
+	TxQuota hashgraph.TxQuota
+	// SeenFilterSize is the number of Events of each of the two generations
+	// of the SeenFilter, which drops the Events of a SyncResponse that were
+	// already inserted. 0 disables the filter.
+	SeenFilterSize int
+	// KnownDiff is the number of participants from which the SyncRequests to
+	// a peer carry the changes of our Known map since the previous sync with
+	// it, instead of the full map. 0 always sends the full map.
+	KnownDiff int
+	// BatchEvents asks the peers to send the Events of their SyncResponses in
+	// a WireEventBatch, which groups the consecutive Events of a creator
+	BatchEvents bool
+	// PullTxs asks the peers to send the Events of their SyncResponses with
+	// the hashes of their transactions, which we then pull with GetTxs unless
+	// we already know them
+	PullTxs bool
+	// TxCacheSize is the number of transactions kept to fill the Events
+	// received with hashes, and to serve the peers which pull them
+	TxCacheSize int
+	// OrphanPoolSize is the number of Events, arrived before their parents,
+	// which are held until the parents arrive. 0 disables the OrphanPool.
+	OrphanPoolSize int
+	// OrphanTTL is the time after which an orphan Event is evicted
+	OrphanTTL time.Duration
+	// Bootstrap reloads the Hashgraph from the Store, which must be a
+	// PersistentStore, instead of starting from the initial PeerSet. An
+	// empty Store is initialised normally.
+	Bootstrap bool
+	// RateLimits bound the sync requests served to peers, and ban the
+	// peers which misbehave
+	RateLimits transport.Limits
+	// Bandwidth deprioritises the peers which take more than their share of
+	// the traffic: we pull from them less often, and serve them smaller
+	// SyncResponses
+	Bandwidth transport.BandwidthCaps
+	// MaxClockSkew bounds the difference between the timestamp of a signed
+	// sync message and our clock
+	MaxClockSkew time.Duration
+	// ClockSkewWarning is the estimated offset of the clock of a peer beyond
+	// which a warning is logged, see PeerSkew. It should be below
+	// MaxClockSkew, at which the messages of the peer are rejected. 0
+	// disables the warnings.
+	ClockSkewWarning time.Duration
+	// Observer runs the Node without taking part in consensus: it pulls and
+	// verifies Events and Blocks, and keeps the full Store, but never
+	// creates Events nor signs Blocks. An observer is not in the PeerSet.
+	Observer bool
+	// Observers are the nodes, outside the PeerSet, which are allowed to
+	// sync from this Node
+	Observers []*conf.Peer
+	// Seeds are the targets of the nodes from which the Node learns the
+	// addresses of the members of the PeerSet, which then need none in
+	// their conf.Peer
+	Seeds []string
+	// DiscoveryInterval is the time between two exchanges of PeerRecords
+	// with the Seeds and a random peer. 0 disables discovery.
+	DiscoveryInterval time.Duration
+	// Archival marks the Store, which must be a CachedStore, as archival:
+	// it is never pruned, and keeps all the Frames and PeerSets for the
+	// nodes which fetch history
+	Archival bool
+	// SignatureFallback is the time after which a committed Block which is
+	// still not final has its signatures requested directly from a peer,
+	// when too few of them ride on the gossiped Events. 0 disables the
+	// requests.
+	SignatureFallback time.Duration
+	// SnapshotChunkSize is the size of the chunks of the application
+	// snapshots served to the nodes which join. A snapshot which fits in one
+	// chunk is sent along with the FastForward response.
+	SnapshotChunkSize int
+	// SnapshotFetchWorkers is the number of chunks of an application
+	// snapshot downloaded in parallel by Join
+	SnapshotFetchWorkers int
+	// MaxPendingCommits is the number of Blocks passed to an AsyncApp which
+	// it did not acknowledge, beyond which the Node is suspended until the
+	// application catches up
+	MaxPendingCommits int
+	// Erasure enables the erasure-coded broadcast of our Events with large
+	// payloads
+	Erasure ErasureConfig
+	// Voting decides the membership changes by vote. It must be the same on
+	// all the peers.
+	Voting VotingConfig
+	// Health sets the thresholds of the liveness and readiness checks
+	Health  HealthConfig
+	Creator CreatorConfig
+}
+
+// DefaultConfig ...
+func DefaultConfig() Config {
+	return Config{
+		GossipInterval:          100 * time.Millisecond,
+		SyncLimit:               1000,
+		SyncBytesLimit:          DefaultSyncBytesLimit,
+		SuspendLimit:            5000,
+		CacheSize:               DefaultCacheSize,
+		SeenFilterSize:          DefaultCacheSize,
+		KnownDiff:               DefaultKnownDiff,
+		BatchEvents:             true,
+		TxCacheSize:             DefaultTxCacheSize,
+		OrphanPoolSize:          1000,
+		OrphanTTL:               10 * time.Second,
+		CacheCheckpointInterval: hashgraph.DefaultCacheCheckpointInterval,
+		RateLimits:              transport.DefaultLimits(),
+		Bandwidth:               transport.DefaultBandwidthCaps(),
+		MaxClockSkew:            transport.DefaultMaxClockSkew,
+		ClockSkewWarning:        DefaultClockSkewWarning,
+		DiscoveryInterval:       DefaultDiscoveryInterval,
+		SignatureFallback:       5 * time.Second,
+		SnapshotChunkSize:       DefaultSnapshotChunkSize,
+		SnapshotFetchWorkers:    4,
+		MaxPendingCommits:       16,
+		Erasure:                 DefaultErasureConfig(),
+		Voting:                  DefaultVotingConfig(),
+		Health:                  DefaultHealthConfig(),
+		Creator:                 DefaultCreatorConfig(),
+	}
+}
+
+// Validate checks that the values of the Config are usable together
+func (c Config) Validate() error {
+	if c.GossipInterval <= 0 {
+		return fmt.Errorf("GossipInterval must be positive, got %v", c.GossipInterval)
+	}
+	if c.SyncLimit < 0 {
+		return fmt.Errorf("SyncLimit must not be negative, got %d", c.SyncLimit)
+	}
+	if c.SyncBytesLimit < 0 {
+		return fmt.Errorf("SyncBytesLimit must not be negative, got %d", c.SyncBytesLimit)
+	}
+	if c.SuspendLimit < 0 {
+		return fmt.Errorf("SuspendLimit must not be negative, got %d", c.SuspendLimit)
+	}
+	if c.CacheSize <= 0 {
+		return fmt.Errorf("CacheSize must be positive, got %d", c.CacheSize)
+	}
+	//undetermined Events must not be evicted from the caches
+	if c.SuspendLimit > c.CacheSize {
+		return fmt.Errorf("SuspendLimit (%d) must not exceed CacheSize (%d)", c.SuspendLimit, c.CacheSize)
+	}
+	if c.MemoryBudget < 0 {
+		return fmt.Errorf("MemoryBudget must not be negative, got %d", c.MemoryBudget)
+	}
+	if c.ReadCacheSize < 0 {
+		return fmt.Errorf("ReadCacheSize must not be negative, got %d", c.ReadCacheSize)
+	}
+	if c.ExternalBodies < 0 {
+		return fmt.Errorf("ExternalBodies must not be negative, got %d", c.ExternalBodies)
+	}
+	if c.CacheCheckpointInterval < 0 {
+		return fmt.Errorf("CacheCheckpointInterval must not be negative, got %d", c.CacheCheckpointInterval)
+	}
+	if c.StaleHorizon < 0 {
+		return fmt.Errorf("StaleHorizon must not be negative, got %d", c.StaleHorizon)
+	}
+	if c.TxQuota.MaxTxs < 0 || c.TxQuota.MaxBytes < 0 {
+		return fmt.Errorf("TxQuota must not be negative, got %+v", c.TxQuota)
+	}
+	if c.TxCacheSize <= 0 {
+		return fmt.Errorf("TxCacheSize must be positive, got %d", c.TxCacheSize)
+	}
+	if c.SeenFilterSize < 0 {
+		return fmt.Errorf("SeenFilterSize must not be negative, got %d", c.SeenFilterSize)
+	}
+	if c.KnownDiff < 0 {
+		return fmt.Errorf("KnownDiff must not be negative, got %d", c.KnownDiff)
+	}
+	if c.OrphanPoolSize < 0 {
+		return fmt.Errorf("OrphanPoolSize must not be negative, got %d", c.OrphanPoolSize)
+	}
+	if c.OrphanPoolSize > 0 && c.OrphanTTL <= 0 {
+		return fmt.Errorf("OrphanTTL must be positive, got %v", c.OrphanTTL)
+	}
+	if c.MaxClockSkew <= 0 {
+		return fmt.Errorf("MaxClockSkew must be positive, got %v", c.MaxClockSkew)
+	}
+	if c.ClockSkewWarning < 0 {
+		return fmt.Errorf("ClockSkewWarning must not be negative, got %v", c.ClockSkewWarning)
+	}
+	if c.DiscoveryInterval < 0 {
+		return fmt.Errorf("DiscoveryInterval must not be negative, got %v", c.DiscoveryInterval)
+	}
+	if c.SignatureFallback < 0 {
+		return fmt.Errorf("SignatureFallback must not be negative, got %v", c.SignatureFallback)
+	}
+	if c.SnapshotChunkSize <= 0 {
+		return fmt.Errorf("SnapshotChunkSize must be positive, got %d", c.SnapshotChunkSize)
+	}
+	if c.SnapshotFetchWorkers <= 0 {
+		return fmt.Errorf("SnapshotFetchWorkers must be positive, got %d", c.SnapshotFetchWorkers)
+	}
+	if c.MaxPendingCommits <= 0 {
+		return fmt.Errorf("MaxPendingCommits must be positive, got %d", c.MaxPendingCommits)
+	}
+	for _, o := range c.Observers {
+		if o == nil {
+			return fmt.Errorf("Observers must not contain nil peers")
+		}
+	}
+	if err := c.RateLimits.Validate(); err != nil {
+		return err
+	}
+	if err := c.Bandwidth.Validate(); err != nil {
+		return err
+	}
+	if err := c.Erasure.Validate(); err != nil {
+		return err
+	}
+	if err := c.Voting.Validate(); err != nil {
+		return err
+	}
+	if err := c.Health.Validate(); err != nil {
+		return err
+	}
+
+	return c.Creator.Validate()
+}
+
+// NewStore creates a Store whose caches have the CacheSize of the Config: a
+// CachedStore on top of sinker, with the MemoryBudget, the ReadCacheSize and
+// the ExternalBodies of the Config, or an InmemStore if sinker is nil.
+func (c Config) NewStore(sinker db.Sinker) store.Store {
+	if sinker == nil {
+		return store.NewInmemStore(c.CacheSize)
+	}
+	s := store.NewCachedStore(sinker, c.CacheSize, 0, 0)
+	if c.MemoryBudget > 0 {
+		s.SetMemoryBudget(store.NewMemoryBudget(c.MemoryBudget))
+	}
+	if c.ReadCacheSize > 0 {
+		s.SetReadCache(store.NewReadCache(c.ReadCacheSize))
+	}
+	if c.ExternalBodies > 0 {
+		s.SetExternalBodies(nil, c.ExternalBodies)
+	}
+	return s
+}
@@ -0,0 +1,342 @@
+package node
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/bolaxy/common/hexutil"
+	"github.com/bolaxy/core/hashgraph"
+	"github.com/bolaxy/core/logger"
+	"github.com/bolaxy/core/signer"
+	"github.com/bolaxy/core/types"
+	"github.com/bolaxy/crypto"
+)
+
+var (
+	// ErrTooManyInFlight is returned by Create when too many of our Events are
+	// not committed yet
+	ErrTooManyInFlight = errors.New("too many in-flight events")
+	// ErrUndecidedBacklog is returned by Create when too many rounds are
+	// undecided
+	ErrUndecidedBacklog = errors.New("undecided round backlog exceeded")
+)
+
+// CreatorConfig ...
+type CreatorConfig struct {
+	// HeartbeatInterval is the time after which an Event is created even if
+	// there is nothing to include, so that consensus progresses
+	HeartbeatInterval time.Duration
+	// MaxInFlightEvents bounds the number of our Events which are not
+	// committed yet. 0 for no limit.
+	MaxInFlightEvents int
+	// MaxUndecidedRounds stops Event creation while more rounds are pending.
+	// 0 for no limit.
+	MaxUndecidedRounds int
+	// MaxTxsPerEvent bounds the number of transactions of an Event. 0 for no
+	// limit.
+	MaxTxsPerEvent int
+	// MaxEventPayload bounds the total size in bytes of the transactions of
+	// an Event. A larger transaction is refused, and the Events of peers
+	// above it are rejected, so all the nodes of a network must use the same
+	// limit. 0 for no limit.
+	MaxEventPayload int
+	// MaxSigsPerEvent bounds the number of Block signatures of an Event. The
+	// signatures of the newest Blocks are included first, and the ones of
+	// final Blocks are dropped. 0 for no limit.
+	MaxSigsPerEvent int
+}
+
+// DefaultCreatorConfig ...
+func DefaultCreatorConfig() CreatorConfig {
+	return CreatorConfig{
+		HeartbeatInterval:  time.Second,
+		MaxInFlightEvents:  1000,
+		MaxUndecidedRounds: 50,
+		MaxTxsPerEvent:     10000,
+		MaxEventPayload:    1 << 20,
+		MaxSigsPerEvent:    100,
+	}
+}
+
+// Validate ...
+func (c CreatorConfig) Validate() error {
+	if c.HeartbeatInterval < 0 {
+		return fmt.Errorf("HeartbeatInterval must not be negative, got %v", c.HeartbeatInterval)
+	}
+	if c.MaxInFlightEvents < 0 {
+		return fmt.Errorf("MaxInFlightEvents must not be negative, got %d", c.MaxInFlightEvents)
+	}
+	if c.MaxUndecidedRounds < 0 {
+		return fmt.Errorf("MaxUndecidedRounds must not be negative, got %d", c.MaxUndecidedRounds)
+	}
+	if c.MaxTxsPerEvent < 0 {
+		return fmt.Errorf("MaxTxsPerEvent must not be negative, got %d", c.MaxTxsPerEvent)
+	}
+	if c.MaxEventPayload < 0 {
+		return fmt.Errorf("MaxEventPayload must not be negative, got %d", c.MaxEventPayload)
+	}
+	if c.MaxSigsPerEvent < 0 {
+		return fmt.Errorf("MaxSigsPerEvent must not be negative, got %d", c.MaxSigsPerEvent)
+	}
+	return nil
+}
+
+// OtherParentStrategy chooses the other-parent of new Events
+type OtherParentStrategy interface {
+	// OtherParent returns the hash of an Event from another peer, or "" if
+	// there is none
+	OtherParent(hg *hashgraph.Hashgraph, self string) (string, error)
+}
+
+// MostRecentStrategy chooses the last Event inserted in the Hashgraph among
+// the last Events of the other peers. It is the default strategy.
+type MostRecentStrategy struct{}
+
+// OtherParent ...
+func (MostRecentStrategy) OtherParent(hg *hashgraph.Hashgraph, self string) (string, error) {
+	res := ""
+	best := -1
+
+	for pk := range hg.Store.RepertoireByPubKey() {
+		if pk == self {
+			continue
+		}
+
+		last, err := hg.Store.LastEventFrom(pk)
+		if err != nil || last == "" {
+			continue
+		}
+
+		ev, err := hg.Store.GetEvent(last)
+		if err != nil {
+			continue
+		}
+
+		if ev.TopologicalIndex > best {
+			best = ev.TopologicalIndex
+			res = last
+		}
+	}
+
+	return res, nil
+}
+
+// Creator builds our Events from the TxPool and inserts them in the
+// Hashgraph. It is not safe for concurrent use; calls must be serialised with
+// all the other operations on the Hashgraph, except sign.
+type Creator struct {
+	hg       *hashgraph.Hashgraph
+	signer   signer.Signer
+	self     string //hex of the compressed public key, as in Event.GetCreator
+	pool     *TxPool
+	strategy OtherParentStrategy
+	config   CreatorConfig
+	logger   logger.Logger
+
+	lastCreated time.Time
+}
+
+// NewCreator ...
+func NewCreator(hg *hashgraph.Hashgraph, s signer.Signer, pool *TxPool, config CreatorConfig) *Creator {
+	return &Creator{
+		hg:       hg,
+		signer:   s,
+		self:     strings.ToUpper(hexutil.Encode(crypto.CompressPubkey(s.PublicKey()))),
+		pool:     pool,
+		strategy: MostRecentStrategy{},
+		config:   config,
+		logger:   logger.Nop,
+	}
+}
+
+// SetOtherParentStrategy ...
+func (c *Creator) SetOtherParentStrategy(s OtherParentStrategy) {
+	c.strategy = s
+}
+
+// SetConfig replaces the CreatorConfig, which must Validate
+func (c *Creator) SetConfig(config CreatorConfig) {
+	c.config = config
+}
+
+// SetLogger ...
+func (c *Creator) SetLogger(l logger.Logger) {
+	c.logger = logger.OrNop(l).With(logger.Component, "Creator")
+}
+
+// ShouldCreate returns true if there is something to include in an Event, or
+// if the heartbeat interval elapsed since the last Event, and creation is not
+// refused by backpressure. Pending InternalTransactions bypass backpressure.
+func (c *Creator) ShouldCreate(now time.Time) bool {
+	if c.backpressure() != nil {
+		return c.pool.InternalLen() > 0
+	}
+
+	if c.pool.Len() > 0 {
+		return true
+	}
+
+	return c.config.HeartbeatInterval > 0 && now.Sub(c.lastCreated) >= c.config.HeartbeatInterval
+}
+
+// backpressure returns an error if Event creation should be refused
+func (c *Creator) backpressure() error {
+	if max := c.config.MaxUndecidedRounds; max > 0 {
+		undecided := 0
+		for _, r := range c.hg.PendingRounds.GetOrderedPendingRounds() {
+			if !r.Decided {
+				undecided++
+			}
+		}
+		if undecided > max {
+			return ErrUndecidedBacklog
+		}
+	}
+
+	if max := c.config.MaxInFlightEvents; max > 0 && c.inFlight() > max {
+		return ErrTooManyInFlight
+	}
+
+	return nil
+}
+
+// inFlight returns the number of our Events which are not committed yet
+func (c *Creator) inFlight() int {
+	last := c.lastIndex(c.hg.Store.LastEventFrom)
+	committed := c.lastIndex(c.hg.Store.LastConsensusEventFrom)
+	return last - committed
+}
+
+func (c *Creator) lastIndex(lookup func(string) (string, error)) int {
+	h, err := lookup(c.self)
+	if err != nil || h == "" {
+		return -1
+	}
+
+	ev, err := c.hg.Store.GetEvent(h)
+	if err != nil {
+		return -1
+	}
+
+	return ev.Index()
+}
+
+// Create builds, signs, and inserts a new Event. Items taken from the TxPool
+// are returned to it if the Event can not be inserted. ctx is passed to the
+// consensus methods run after the insertion.
+//
+// The pending InternalTransactions always go in the next Event, so that
+// membership changes are not starved by large transactions: when backpressure
+// refuses a full Event, an Event carrying only the InternalTransactions is
+// created instead.
+func (c *Creator) Create(ctx context.Context) (*types.Event, error) {
+	d, err := c.draft()
+	if err != nil {
+		return nil, err
+	}
+
+	if err := c.sign(d); err != nil {
+		return nil, err
+	}
+
+	return c.insert(ctx, d)
+}
+
+// draft is an Event built by Create, with the items it took from the TxPool
+type draft struct {
+	event        *types.Event
+	txs          [][]byte
+	payloadTypes []types.PayloadType
+	itxs         []types.InternalTransaction
+	sigs         []types.BlockSignature
+	priority     bool //built under backpressure
+}
+
+// giveBack returns the items of the draft to the TxPool
+func (c *Creator) giveBack(d *draft) {
+	c.pool.Return(d.txs, d.payloadTypes, d.itxs, d.sigs)
+}
+
+// draft builds the next Event, unsigned
+func (c *Creator) draft() (*draft, error) {
+	pressure := c.backpressure()
+	if pressure != nil && c.pool.InternalLen() == 0 {
+		return nil, pressure
+	}
+
+	selfParent, err := c.hg.Store.LastEventFrom(c.self)
+	if err != nil {
+		selfParent = ""
+	}
+
+	index := c.lastIndex(c.hg.Store.LastEventFrom) + 1
+
+	otherParent, err := c.strategy.OtherParent(c.hg, c.self)
+	if err != nil {
+		return nil, err
+	}
+
+	d := &draft{priority: pressure != nil}
+	if pressure != nil {
+		d.itxs = c.pool.TakeInternal()
+	} else {
+		d.txs, d.payloadTypes, d.itxs, d.sigs = c.pool.Take(c.config.MaxTxsPerEvent,
+			c.config.MaxEventPayload,
+			c.config.MaxSigsPerEvent,
+			c.hg.BlockFinal)
+	}
+
+	//the transactions beyond the quota of the round wait for the next one
+	if fit := c.hg.QuotaFit(selfParent, d.txs); fit < len(d.txs) {
+		c.pool.Return(d.txs[fit:], d.payloadTypes[fit:], nil, nil)
+		d.txs, d.payloadTypes = d.txs[:fit], d.payloadTypes[:fit]
+	}
+
+	d.event = types.NewEvent(d.txs,
+		d.itxs,
+		d.sigs,
+		[]string{selfParent, otherParent},
+		signer.PublicKeyBytes(c.signer),
+		index)
+
+	if err := d.event.SetPayloadTypes(d.payloadTypes); err != nil {
+		c.giveBack(d)
+		return nil, err
+	}
+
+	return d, nil
+}
+
+// sign signs a draft. It does not use the Hashgraph, so it can run without
+// the lock which serialises the operations on it, while a remote signer
+// answers.
+func (c *Creator) sign(d *draft) error {
+	if err := d.event.SignWith(c.signer); err != nil {
+		c.giveBack(d)
+		return err
+	}
+	return nil
+}
+
+// insert inserts a signed draft in the Hashgraph and runs consensus
+func (c *Creator) insert(ctx context.Context, d *draft) (*types.Event, error) {
+	if err := c.hg.InsertEventAndRunConsensus(ctx, d.event, true); err != nil {
+		c.giveBack(d)
+		return nil, err
+	}
+
+	c.lastCreated = time.Now()
+
+	c.logger.Debug("event created",
+		logger.EventHex, d.event.GetHex(),
+		"index", d.event.Index(),
+		"txs", len(d.txs),
+		"itxs", len(d.itxs),
+		"sigs", len(d.sigs),
+		"priority", d.priority)
+
+	return d.event, nil
+}
@@ -0,0 +1,215 @@
+package node
+
+import (
+	"context"
+	"math/rand"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bolaxy/config"
+	"github.com/bolaxy/core/logger"
+	"github.com/bolaxy/core/transport"
+)
+
+// DefaultDiscoveryInterval is the default time between two exchanges of
+// PeerRecords
+const DefaultDiscoveryInterval = 10 * time.Second
+
+// discovery holds the latest PeerRecord of each member of the PeerSet, and of
+// the observers, which give their addresses in place of the ones of their
+// conf.Peer
+type discovery struct {
+	lock    sync.Mutex
+	records map[string]*transport.PeerRecord // [pubkey]
+}
+
+func newDiscovery() *discovery {
+	return &discovery{
+		records: make(map[string]*transport.PeerRecord),
+	}
+}
+
+// add keeps rec if it is newer than the record of its peer, and valid. It
+// returns whether rec was kept.
+func (d *discovery) add(rec transport.PeerRecord) bool {
+	rec.PubKey = strings.ToUpper(rec.PubKey)
+
+	d.lock.Lock()
+	old, ok := d.records[rec.PubKey]
+	d.lock.Unlock()
+	if ok && old.Seq >= rec.Seq {
+		return false
+	}
+
+	if rec.Verify() != nil {
+		return false
+	}
+
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	//checked again, as the lock was released for the verification
+	if old, ok := d.records[rec.PubKey]; ok && old.Seq >= rec.Seq {
+		return false
+	}
+	d.records[rec.PubKey] = &rec
+	return true
+}
+
+// list returns the records
+func (d *discovery) list() []transport.PeerRecord {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	res := make([]transport.PeerRecord, 0, len(d.records))
+	for _, r := range d.records {
+		res = append(res, *r)
+	}
+	return res
+}
+
+// target returns the target of the RPCs to p: the addresses of its record, or
+// of p itself
+func (d *discovery) target(p *conf.Peer) string {
+	d.lock.Lock()
+	rec, ok := d.records[p.PubKeyString()]
+	d.lock.Unlock()
+
+	if ok {
+		if t := transport.PeerTarget(rec.Peer()); t != "" {
+			return t
+		}
+	}
+	return transport.PeerTarget(p)
+}
+
+// retain drops the records of the peers for which keep returns false, like
+// the ones which left the PeerSet
+func (d *discovery) retain(keep func(pubKey string) bool) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	for k := range d.records {
+		if !keep(k) {
+			delete(d.records, k)
+		}
+	}
+}
+
+/*******************************************************************************
+Node
+*******************************************************************************/
+
+// SetAddress changes the addresses which the Node advertises in its
+// PeerRecord, in the format of the Address and TcpPort of a conf.Peer. The
+// new record replaces the previous one at the peers with the next exchanges.
+func (n *Node) SetAddress(address, tcpPort string) error {
+	rec, err := transport.NewPeerRecord(n.pubKey, address, tcpPort, uint64(time.Now().UnixNano()), n.signer)
+	if err != nil {
+		return err
+	}
+	n.discovery.add(*rec)
+	return nil
+}
+
+// PeerRecords returns the PeerRecords known by the Node, its own included
+func (n *Node) PeerRecords() []transport.PeerRecord {
+	return n.discovery.list()
+}
+
+// target returns the target of the RPCs to peer
+func (n *Node) target(peer *conf.Peer) string {
+	return n.discovery.target(peer)
+}
+
+// discover exchanges PeerRecords with the seeds and a random peer, once per
+// DiscoveryInterval
+func (n *Node) discover() {
+	defer n.wg.Done()
+
+	ticker := time.NewTicker(n.config.DiscoveryInterval)
+	defer ticker.Stop()
+
+	for {
+		n.exchangeRecords()
+
+		select {
+		case <-n.shutdownCh:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// exchangeRecords sends our PeerRecords to the seeds and to a random peer,
+// and keeps the ones they return
+func (n *Node) exchangeRecords() {
+	targets := append([]string{}, n.config.Seeds...)
+
+	n.lock.Lock()
+	peers := []*conf.Peer{}
+	if n.peerSet != nil {
+		for _, p := range n.peerSet.Peers {
+			if p.ID() != n.self.ID() {
+				peers = append(peers, p)
+			}
+		}
+	}
+	n.lock.Unlock()
+
+	if len(peers) > 0 {
+		if t := n.target(peers[rand.Intn(len(peers))]); t != "" {
+			targets = append(targets, t)
+		}
+	}
+
+	req := &transport.DiscoverRequest{Records: n.discovery.list()}
+
+	for _, target := range targets {
+		ctx, cancel := context.WithTimeout(n.ctx, n.config.DiscoveryInterval)
+		var resp transport.DiscoverResponse
+		err := n.trans.Discover(ctx, target, req, &resp)
+		cancel()
+
+		if err != nil {
+			n.logger.Debug("discovery failed", "target", target, logger.Err, err)
+			continue
+		}
+
+		n.lock.Lock()
+		added := n.addRecords(resp.Records)
+		n.lock.Unlock()
+
+		if added > 0 {
+			n.logger.Debug("peer records discovered", "target", target, "records", added)
+		}
+	}
+}
+
+// processDiscover keeps the PeerRecords of a DiscoverRequest, and returns
+// ours. It must be called with the lock.
+func (n *Node) processDiscover(req *transport.DiscoverRequest) *transport.DiscoverResponse {
+	n.addRecords(req.Records)
+	return &transport.DiscoverResponse{Records: n.discovery.list()}
+}
+
+// addRecords keeps the PeerRecords of the members and observers which are
+// newer than ours, and returns their number. It must be called with the lock.
+func (n *Node) addRecords(records []transport.PeerRecord) int {
+	added := 0
+	for _, rec := range records {
+		p := rec.Peer()
+		if m := n.member(p.ID()); m == nil || m.PubKeyString() != p.PubKeyString() {
+			continue
+		}
+		//our own record is only changed by SetAddress
+		if p.PubKeyString() == n.pubKey {
+			continue
+		}
+		if n.discovery.add(rec) {
+			added++
+		}
+	}
+	return added
+}
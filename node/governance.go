@@ -0,0 +1,262 @@
+package node
+
+import (
+	"bytes"
+	"fmt"
+	"math"
+
+	"github.com/bolaxy/config"
+	"github.com/bolaxy/core/types"
+)
+
+// VotingConfig decides the membership changes by vote, see SetVoting
+type VotingConfig struct {
+	// Quorum is the fraction of the validators, in (0, 1], whose approval
+	// a proposal needs
+	Quorum float64
+	// Window is the number of rounds after a proposal whose Blocks count
+	// votes on it. 0 disables voting.
+	Window int
+}
+
+// DefaultVotingConfig ...
+func DefaultVotingConfig() VotingConfig {
+	return VotingConfig{
+		Quorum: 2.0 / 3,
+	}
+}
+
+// Validate ...
+func (c VotingConfig) Validate() error {
+	if c.Window < 0 {
+		return fmt.Errorf("Window must not be negative, got %d", c.Window)
+	}
+	if c.Window > 0 && (c.Quorum <= 0 || c.Quorum > 1) {
+		return fmt.Errorf("Quorum must be in (0, 1], got %v", c.Quorum)
+	}
+	return nil
+}
+
+// Proposal is a membership change, or a PARAM_UPDATE, committed while the
+// changes are decided by vote, which awaits the votes of the validators
+type Proposal struct {
+	Transaction types.InternalTransaction
+	BlockIndex  int // Block which committed the proposal
+	Round       int // RoundReceived of that Block
+	Deadline    int // last round whose Blocks count votes
+	Approvals   int
+	Rejections  int
+}
+
+type openProposal struct {
+	Proposal
+	hash   []byte
+	voters map[string]bool // [pubkey] => voted
+}
+
+// voting tallies the votes on the membership changes. Its state derives from
+// the committed Blocks only, so that all the peers decide alike.
+type voting struct {
+	quorum float64
+	window int
+	open   []*openProposal // commit order
+	loaded bool
+}
+
+// governs returns true for the changes decided by vote. PEER_SLASH and
+// PEER_EVICT are decided on their evidence.
+func governs(itx types.InternalTransaction) bool {
+	switch itx.Body.Type {
+	case types.PEERADD, types.PEERREMOVE, types.PARAMUPDATE:
+		return true
+	default:
+		return false
+	}
+}
+
+func (v *voting) find(hash []byte) *openProposal {
+	for _, p := range v.open {
+		if bytes.Equal(p.hash, hash) {
+			return p
+		}
+	}
+	return nil
+}
+
+// propose opens a vote on itx, unless it is open already
+func (v *voting) propose(itx types.InternalTransaction, blockIndex, round int) {
+	hash, err := itx.Body.Hash()
+	if err != nil || v.find(hash) != nil {
+		return
+	}
+
+	v.open = append(v.open, &openProposal{
+		Proposal: Proposal{
+			Transaction: itx,
+			BlockIndex:  blockIndex,
+			Round:       round,
+			Deadline:    round + v.window,
+		},
+		hash:   hash,
+		voters: make(map[string]bool),
+	})
+}
+
+// expire closes the proposals whose deadline precedes round
+func (v *voting) expire(round int) []*openProposal {
+	expired := []*openProposal{}
+	open := v.open[:0]
+	for _, p := range v.open {
+		if p.Deadline < round {
+			expired = append(expired, p)
+		} else {
+			open = append(open, p)
+		}
+	}
+	v.open = open
+	return expired
+}
+
+// vote counts a vote of a member of peers, the PeerSet of the round of the
+// vote, and returns the proposal if the vote decides it, with the decision.
+// The votes of non-members, votes which they did not sign, second votes, and
+// votes on proposals which are not open are ignored.
+func (v *voting) vote(itx types.InternalTransaction, peers *conf.PeerSet) (*openProposal, bool) {
+	voter := itx.Body.Peer.PubKeyString()
+	if _, ok := peers.ByPubKey[voter]; !ok {
+		return nil, false
+	}
+	if ok, err := itx.Verify(); err != nil || !ok {
+		return nil, false
+	}
+
+	p := v.find(itx.Body.Proposal)
+	if p == nil || p.voters[voter] {
+		return nil, false
+	}
+	p.voters[voter] = true
+
+	if itx.Body.Approve {
+		p.Approvals++
+	} else {
+		p.Rejections++
+	}
+
+	needed := int(math.Ceil(v.quorum * float64(peers.Len())))
+	switch {
+	case p.Approvals >= needed:
+		v.close(p)
+		return p, true
+	case p.Rejections > peers.Len()-needed:
+		v.close(p)
+		return p, false
+	}
+
+	return nil, false
+}
+
+func (v *voting) close(p *openProposal) {
+	for i, o := range v.open {
+		if o == p {
+			v.open = append(v.open[:i], v.open[i+1:]...)
+			return
+		}
+	}
+}
+
+// SetVoting makes the PEER_ADD, PEER_REMOVE, and PARAM_UPDATE transactions
+// proposals, which take effect once approved by PEER_VOTE transactions of a
+// fraction quorum of the validators, committed within window rounds of the
+// proposal. A proposal is refused when enough validators reject it that it
+// cannot be approved, or when its window closes. The receipt recorded in the
+// Block of a proposal only tells whether the AcceptFunc let it be voted on;
+// the receipt sent to the waiters of Await is the outcome of the vote. It
+// must be the same on all the peers. A window of 0 disables voting. The
+// quorum must be in (0, 1].
+func (m *Membership) SetVoting(quorum float64, window int) error {
+	config := VotingConfig{Quorum: quorum, Window: window}
+	if err := config.Validate(); err != nil {
+		return err
+	}
+
+	if window == 0 {
+		m.voting = nil
+		return nil
+	}
+	m.voting = &voting{quorum: quorum, window: window}
+	return nil
+}
+
+// Proposals returns the proposals open to votes, in commit order. It must be
+// serialised with the other operations on the Hashgraph.
+func (m *Membership) Proposals() []Proposal {
+	if m.voting == nil {
+		return nil
+	}
+
+	res := make([]Proposal, 0, len(m.voting.open))
+	for _, p := range m.voting.open {
+		res = append(res, p.Proposal)
+	}
+	return res
+}
+
+// loadVoting recovers the open proposals after a restart, from the Blocks
+// committed within the window before block. Proposals committed before the
+// base of a Store which was fast-forwarded cannot be recovered.
+func (m *Membership) loadVoting(block *types.Block) error {
+	v := m.voting
+	if v.loaded {
+		return nil
+	}
+	v.loaded = true
+
+	past := []*types.Block{} //newest first
+	for i := block.Index() - 1; i >= 0; i-- {
+		b, err := m.hg.Store.GetBlock(i)
+		if err != nil || b.RoundReceived() < block.RoundReceived()-v.window {
+			break
+		}
+		past = append(past, b)
+	}
+
+	for i := len(past) - 1; i >= 0; i-- {
+		b := past[i]
+		v.expire(b.RoundReceived())
+
+		members, err := m.hg.Store.GetPeerSet(b.RoundReceived())
+		if err != nil {
+			return err
+		}
+
+		for _, r := range b.InternalTransactionReceipts() {
+			if !r.Accepted {
+				continue
+			}
+			switch itx := r.InternalTransaction; {
+			case governs(itx):
+				v.propose(itx, b.Index(), b.RoundReceived())
+			case itx.Body.Type == types.PEERVOTE:
+				v.vote(itx, members)
+			}
+		}
+	}
+
+	return nil
+}
+
+// Vote submits our vote on a proposal returned by Proposals
+func (n *Node) Vote(proposal types.InternalTransaction, approve bool) error {
+	if n.config.Observer {
+		return ErrObserver
+	}
+
+	itx := types.NewInternalTransactionVote(*n.self, proposal, approve)
+	if err := itx.SignWith(n.signer); err != nil {
+		return err
+	}
+
+	n.pool.AddInternalTransaction(itx)
+
+	return nil
+}
@@ -0,0 +1,328 @@
+package node
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/bolaxy/config"
+	"github.com/bolaxy/core/query"
+	"github.com/bolaxy/core/store"
+)
+
+// HealthConfig sets the thresholds of the checks of Health and Ready
+type HealthConfig struct {
+	// MaxRoundAge is the time without a decided round after which the Node
+	// is not ready
+	MaxRoundAge time.Duration
+	// PeerTimeout is the time since the last successful sync with a peer
+	// after which it no longer counts as connected
+	PeerTimeout time.Duration
+	// MaxCommitTime is the time the application may take to apply a Block,
+	// synchronously or asynchronously, before it is deemed stuck and the
+	// Node unhealthy
+	MaxCommitTime time.Duration
+	// IntakeRounds is the number of last rounds in which we must know Events
+	// of MinCreators distinct creators other than us. Below, the Node may be
+	// eclipsed by its peers: it pulls from the missing creators directly,
+	// and is not ready. 0 disables the check.
+	IntakeRounds int
+	// MinCreators is the number of distinct creators of IntakeRounds. 0
+	// requires the others of a supermajority of the PeerSet.
+	MinCreators int
+	// MaxOutboxBlocks is the number of Blocks in the commit outbox above
+	// which the Node is not ready. 0 disables the bound.
+	MaxOutboxBlocks int
+	// MaxOutboxAge is the time a Block may wait in the commit outbox before
+	// the Node is not ready. 0 disables the bound.
+	MaxOutboxAge time.Duration
+}
+
+// DefaultHealthConfig ...
+func DefaultHealthConfig() HealthConfig {
+	return HealthConfig{
+		MaxRoundAge:     30 * time.Second,
+		PeerTimeout:     30 * time.Second,
+		MaxCommitTime:   time.Minute,
+		IntakeRounds:    10,
+		MaxOutboxBlocks: 1000,
+		MaxOutboxAge:    10 * time.Minute,
+	}
+}
+
+// Validate ...
+func (c HealthConfig) Validate() error {
+	if c.MaxRoundAge <= 0 {
+		return fmt.Errorf("MaxRoundAge must be positive, got %v", c.MaxRoundAge)
+	}
+	if c.PeerTimeout <= 0 {
+		return fmt.Errorf("PeerTimeout must be positive, got %v", c.PeerTimeout)
+	}
+	if c.MaxCommitTime <= 0 {
+		return fmt.Errorf("MaxCommitTime must be positive, got %v", c.MaxCommitTime)
+	}
+	if c.IntakeRounds < 0 {
+		return fmt.Errorf("IntakeRounds must not be negative, got %d", c.IntakeRounds)
+	}
+	if c.MinCreators < 0 {
+		return fmt.Errorf("MinCreators must not be negative, got %d", c.MinCreators)
+	}
+	if c.MaxOutboxBlocks < 0 {
+		return fmt.Errorf("MaxOutboxBlocks must not be negative, got %d", c.MaxOutboxBlocks)
+	}
+	if c.MaxOutboxAge < 0 {
+		return fmt.Errorf("MaxOutboxAge must not be negative, got %v", c.MaxOutboxAge)
+	}
+	return nil
+}
+
+// healthState is what the checks need from the consensus. It is recorded as
+// the consensus goes, so that the checks never wait for the lock of the Node,
+// which is held during the commits.
+type healthState struct {
+	lock        sync.Mutex
+	round       int                  //last decided round, -1 if none
+	decided     time.Time            //when round was decided, or the Node created
+	contacts    map[uint32]time.Time //last successful sync with each peer
+	peerSet     *conf.PeerSet
+	commitSince time.Time //start of the commit in progress, zero if none
+	intake      intake
+}
+
+func newHealthState() *healthState {
+	return &healthState{
+		round:    -1,
+		decided:  time.Now(),
+		contacts: make(map[uint32]time.Time),
+	}
+}
+
+func (h *healthState) contact(peer uint32) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	h.contacts[peer] = time.Now()
+}
+
+func (h *healthState) committing(since time.Time) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	h.commitSince = since
+}
+
+// observeConsensus records the time at which the last round was decided,
+// the current PeerSet, and the intake of Events. It must be called with the
+// lock.
+func (n *Node) observeConsensus() {
+	round := -1
+	if lcr := n.hg.LastConsensusRound; lcr != nil {
+		round = *lcr
+	}
+
+	in := n.measureIntake()
+
+	h := n.health
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	if round != h.round {
+		h.round = round
+		h.decided = time.Now()
+	}
+	h.peerSet = n.peerSet
+
+	if in.eclipsed && !h.intake.eclipsed {
+		n.logger.Warn("events of too few creators, pulling from the missing ones",
+			"creators", in.creators,
+			"required", in.required,
+			"missing", in.missing)
+	} else if !in.eclipsed && h.intake.eclipsed {
+		n.logger.Info("events of enough creators again", "creators", in.creators)
+	}
+	h.intake = in
+}
+
+// Health implements query.HealthSource. It reports whether the Node is
+// alive: its Store accepts writes and the application applies the Blocks. A
+// Node which fails it needs a restart.
+func (n *Node) Health() query.HealthReport {
+	now := time.Now()
+	return newHealthReport(now,
+		n.checkStore(),
+		n.checkApp(now))
+}
+
+// Ready implements query.HealthSource. It reports whether the Node is alive
+// and keeps up with the network: it is not suspended, rounds are decided,
+// it syncs with its peers, and the application keeps up with the commit
+// outbox. A Node which fails it should not be sent
+// transactions nor queries.
+func (n *Node) Ready() query.HealthReport {
+	now := time.Now()
+	return newHealthReport(now,
+		n.checkStore(),
+		n.checkApp(now),
+		n.checkState(),
+		n.checkConsensus(now),
+		n.checkPeers(now),
+		n.checkIntake(),
+		n.checkOutbox(now))
+}
+
+func newHealthReport(now time.Time, checks ...query.HealthCheck) query.HealthReport {
+	report := query.HealthReport{
+		OK:     true,
+		Time:   now,
+		Checks: checks,
+	}
+	for _, c := range checks {
+		report.OK = report.OK && c.OK
+	}
+	return report
+}
+
+// checkStore fails when the writes of the Store are refused or stalled
+func (n *Node) checkStore() query.HealthCheck {
+	c := query.HealthCheck{Name: "db", OK: true}
+
+	cs, ok := n.hg.Store.(*store.CachedStore)
+	if !ok {
+		return c
+	}
+
+	h := cs.Health()
+	c.Details = map[string]interface{}{
+		"Dirty":    h.Dirty,
+		"MaxDirty": h.MaxDirty,
+	}
+	if h.DB != nil {
+		c.Details["LSMSize"] = h.DB.LSMSize
+		c.Details["VLogSize"] = h.DB.VLogSize
+		c.Details["Levels"] = h.DB.Levels
+	}
+
+	switch {
+	case h.FlushErr != nil:
+		c.OK, c.Reason = false, fmt.Sprintf("flush failed: %v", h.FlushErr)
+	case h.DBErr != nil:
+		c.OK, c.Reason = false, h.DBErr.Error()
+	case h.DB != nil && len(h.DB.Levels) > 0 && h.DB.Levels[0] >= h.DB.Level0Stall:
+		c.OK, c.Reason = false, fmt.Sprintf("%d level 0 tables stall the writes", h.DB.Levels[0])
+	}
+
+	return c
+}
+
+// checkApp fails when a commit, or the acknowledgment of a Block by an
+// AsyncApp, takes longer than MaxCommitTime
+func (n *Node) checkApp(now time.Time) query.HealthCheck {
+	c := query.HealthCheck{Name: "app", OK: true}
+	max := n.config.Health.MaxCommitTime
+
+	n.health.lock.Lock()
+	since := n.health.commitSince
+	n.health.lock.Unlock()
+
+	if !since.IsZero() && now.Sub(since) > max {
+		c.OK, c.Reason = false, fmt.Sprintf("block commit in progress for %v", now.Sub(since).Round(time.Second))
+	}
+
+	if n.async == nil {
+		return c
+	}
+
+	a := n.async
+	a.lock.Lock()
+	pending := len(a.pending)
+	var oldest pendingCommit
+	if pending > 0 {
+		oldest = a.pending[0]
+	}
+	a.lock.Unlock()
+
+	c.Details = map[string]interface{}{
+		"PendingCommits":    pending,
+		"MaxPendingCommits": a.max,
+	}
+
+	//the Blocks of the outbox which are not handed yet fail checkOutbox
+	if c.OK && pending > 0 && oldest.ticket != nil && now.Sub(oldest.since) > max {
+		c.OK, c.Reason = false, fmt.Sprintf("block %d not acknowledged for %v",
+			oldest.block.Index(), now.Sub(oldest.since).Round(time.Second))
+	}
+
+	return c
+}
+
+// checkState fails when the Node is suspended or shut down
+func (n *Node) checkState() query.HealthCheck {
+	status := n.Status()
+
+	c := query.HealthCheck{
+		Name:    "state",
+		OK:      status.State == Babbling.String(),
+		Details: map[string]interface{}{"State": status.State},
+	}
+	if !c.OK {
+		c.Reason = status.State
+		if status.Reason != "" {
+			c.Reason += ": " + status.Reason
+		}
+	}
+
+	return c
+}
+
+// checkConsensus fails when no round was decided for MaxRoundAge
+func (n *Node) checkConsensus(now time.Time) query.HealthCheck {
+	n.health.lock.Lock()
+	round, age := n.health.round, now.Sub(n.health.decided)
+	n.health.lock.Unlock()
+
+	c := query.HealthCheck{
+		Name: "consensus",
+		OK:   age <= n.config.Health.MaxRoundAge,
+		Details: map[string]interface{}{
+			"LastConsensusRound": round,
+			"Age":                age.Round(time.Millisecond).String(),
+		},
+	}
+	if !c.OK {
+		c.Reason = fmt.Sprintf("no round decided for %v", age.Round(time.Second))
+	}
+
+	return c
+}
+
+// checkPeers fails when we did not sync with any of the other peers of the
+// PeerSet within PeerTimeout
+func (n *Node) checkPeers(now time.Time) query.HealthCheck {
+	n.health.lock.Lock()
+	defer n.health.lock.Unlock()
+
+	others, connected := 0, 0
+	if n.health.peerSet != nil {
+		for _, p := range n.health.peerSet.Peers {
+			if p.ID() == n.self.ID() {
+				continue
+			}
+			others++
+			if t, ok := n.health.contacts[p.ID()]; ok && now.Sub(t) <= n.config.Health.PeerTimeout {
+				connected++
+			}
+		}
+	}
+
+	c := query.HealthCheck{
+		Name: "peers",
+		OK:   others == 0 || connected > 0,
+		Details: map[string]interface{}{
+			"Peers":     others,
+			"Connected": connected,
+		},
+	}
+	if !c.OK {
+		c.Reason = fmt.Sprintf("no sync with any of %d peers within %v", others, n.config.Health.PeerTimeout)
+	}
+
+	return c
+}
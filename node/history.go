@@ -0,0 +1,311 @@
+package node
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/bolaxy/config"
+	"github.com/bolaxy/core/anchor"
+	"github.com/bolaxy/core/logger"
+	"github.com/bolaxy/core/reputation"
+	"github.com/bolaxy/core/store"
+	"github.com/bolaxy/core/transport"
+	"github.com/bolaxy/core/types"
+)
+
+var (
+	// ErrNoArchive is returned to the HistoryRequests received by a Node
+	// whose Store does not export history
+	ErrNoArchive = errors.New("store does not export history")
+	// ErrNoHistory is returned by FetchHistory when no peer served a valid
+	// history
+	ErrNoHistory = errors.New("no peer served the history")
+)
+
+// AnchorSource provides the Anchors against which fetched Blocks are checked.
+// It is implemented by anchor.Checkpointer.
+type AnchorSource interface {
+	Get(ctx context.Context, blockIndex int) (*anchor.Anchor, error)
+}
+
+// SetAnchors sets the Anchors which the Blocks fetched by FetchHistory must
+// match. It must be called before Run.
+func (n *Node) SetAnchors(a AnchorSource) {
+	n.anchors = a
+}
+
+// FetchHistory fetches the Frames and Blocks of the rounds fromRound to
+// toRound from the observers, then from the members of the current PeerSet,
+// until one of them serves a history which verifies. The Blocks must be
+// signed by a SuperMajority of the PeerSet of their round, and match our
+// Blocks and Anchors, and the Frames must contain the transactions of the
+// Blocks. Peers which serve an invalid history are penalised.
+func (n *Node) FetchHistory(ctx context.Context, fromRound, toRound int) (*store.HistoryRange, error) {
+	n.lock.Lock()
+	candidates := n.historyPeers()
+	n.lock.Unlock()
+
+	for _, peer := range candidates {
+		res, err := n.fetchHistory(ctx, peer, fromRound, toRound)
+		if err == nil {
+			return res, nil
+		}
+
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+
+		n.logger.Debug("history not fetched",
+			"peer", peer.ID(),
+			logger.Err, err)
+	}
+
+	return nil, ErrNoHistory
+}
+
+// historyPeers returns the peers which may serve history. It must be called
+// with the lock.
+func (n *Node) historyPeers() []*conf.Peer {
+	res := []*conf.Peer{}
+	for _, p := range n.observers {
+		res = append(res, p)
+	}
+
+	peerSet, err := n.hg.Store.GetPeerSet(n.hg.Store.LastRound())
+	if err != nil {
+		return res
+	}
+
+	for _, p := range peerSet.Peers {
+		if p.ID() != n.self.ID() {
+			res = append(res, p)
+		}
+	}
+
+	return res
+}
+
+func (n *Node) fetchHistory(ctx context.Context, peer *conf.Peer, fromRound, toRound int) (*store.HistoryRange, error) {
+	req := &transport.HistoryRequest{
+		FromID:    n.self.ID(),
+		FromRound: fromRound,
+		ToRound:   toRound,
+	}
+	if err := transport.SealWith(req, n.signer); err != nil {
+		return nil, err
+	}
+
+	var resp transport.HistoryResponse
+	if err := n.trans.History(ctx, n.target(peer), req, &resp); err != nil {
+		return nil, err
+	}
+
+	if resp.FromID != peer.ID() {
+		return nil, fmt.Errorf("history response from %d instead of %d", resp.FromID, peer.ID())
+	}
+	if err := n.verifier.Verify(&resp, peer.PubKeyBytes()); err != nil {
+		if err == transport.ErrBadSignature {
+			n.report(peer.ID(), reputation.InvalidSignature)
+			n.penalize(peer, transport.PenaltyInvalidEvent, "invalid history response signature")
+		}
+		return nil, err
+	}
+
+	n.lock.Lock()
+	res, err := n.verifyHistory(ctx, req, &resp)
+	n.lock.Unlock()
+
+	if err != nil {
+		n.report(peer.ID(), reputation.InvalidSignature)
+		n.penalize(peer, transport.PenaltyInvalidEvent, "invalid history")
+		return nil, err
+	}
+
+	return res, nil
+}
+
+// verifyHistory checks a HistoryResponse against the PeerSets, Blocks, and
+// Anchors we hold. It must be called with the lock.
+func (n *Node) verifyHistory(ctx context.Context, req *transport.HistoryRequest, resp *transport.HistoryResponse) (*store.HistoryRange, error) {
+	if len(resp.Frames) != req.ToRound-req.FromRound+1 {
+		return nil, fmt.Errorf("%d frames for rounds [%d, %d]", len(resp.Frames), req.FromRound, req.ToRound)
+	}
+
+	res := &store.HistoryRange{
+		FromRound: req.FromRound,
+		ToRound:   req.ToRound,
+		PeerSets:  make(map[int][]*conf.Peer),
+	}
+
+	byRound := make(map[int][]*types.Block)
+	for i := range resp.Blocks {
+		block := &resp.Blocks[i]
+
+		r := block.RoundReceived()
+		if r < req.FromRound || r > req.ToRound {
+			return nil, fmt.Errorf("block %d of round %d is out of range", block.Index(), r)
+		}
+
+		if err := n.verifyHistoryBlock(ctx, block); err != nil {
+			return nil, err
+		}
+
+		byRound[r] = append(byRound[r], block)
+		res.Blocks = append(res.Blocks, block)
+	}
+
+	var last *conf.PeerSet
+	for i := range resp.Frames {
+		frame := &resp.Frames[i]
+
+		if frame.Round != req.FromRound+i {
+			return nil, fmt.Errorf("frame %d at position %d", frame.Round, i)
+		}
+
+		if err := verifyHistoryFrame(frame, byRound[frame.Round]); err != nil {
+			return nil, err
+		}
+
+		res.Frames = append(res.Frames, frame)
+
+		peerSet, err := n.hg.Store.GetPeerSet(frame.Round)
+		if err == nil && peerSet != last {
+			res.PeerSets[frame.Round] = peerSet.Peers
+			last = peerSet
+		}
+	}
+
+	return res, nil
+}
+
+// verifyHistoryBlock checks that a Block is signed by a SuperMajority of the
+// PeerSet of its round, and matches the Block and the Anchor we hold for its
+// index, if any
+func (n *Node) verifyHistoryBlock(ctx context.Context, block *types.Block) error {
+	peerSet, err := n.hg.Store.GetPeerSet(block.RoundReceived())
+	if err != nil {
+		return fmt.Errorf("peer-set of block %d: %v", block.Index(), err)
+	}
+
+	a, err := anchor.NewAnchor(block, peerSet)
+	if err != nil {
+		return err
+	}
+	if err := a.Verify(); err != nil {
+		return err
+	}
+
+	if local, err := n.hg.Store.GetBlock(block.Index()); err == nil {
+		hash, err := local.Body.Hash()
+		if err != nil {
+			return err
+		}
+		if !bytes.Equal(hash, a.BlockHash) {
+			return fmt.Errorf("block %d differs from ours", block.Index())
+		}
+	}
+
+	if n.anchors != nil {
+		if stored, err := n.anchors.Get(ctx, block.Index()); err == nil && !bytes.Equal(stored.BlockHash, a.BlockHash) {
+			return fmt.Errorf("block %d differs from its anchor", block.Index())
+		}
+	}
+
+	return nil
+}
+
+// verifyHistoryFrame checks the signatures of the Events of a Frame, and that
+// they carry the transactions of the verified Blocks of its round, of which
+// there are none if the Frame produced an empty Block which was skipped
+func verifyHistoryFrame(frame *types.Frame, blocks []*types.Block) error {
+	txs := [][]byte{}
+	itxs := []types.InternalTransaction{}
+	for _, fe := range frame.Events {
+		if fe.Core == nil {
+			return fmt.Errorf("frame %d has an empty event", frame.Round)
+		}
+		if ok, err := fe.Core.Verify(); !ok || err != nil {
+			return fmt.Errorf("frame %d: invalid event signature", frame.Round)
+		}
+		txs = append(txs, fe.Core.Transactions()...)
+		itxs = append(itxs, fe.Core.InternalTransactions()...)
+	}
+
+	blockTxs := [][]byte{}
+	blockItxs := []types.InternalTransaction{}
+	for _, b := range blocks {
+		blockTxs = append(blockTxs, b.Transactions()...)
+		blockItxs = append(blockItxs, b.InternalTransactions()...)
+
+		peersHash, err := conf.NewPeerSet(frame.Peers).Hash()
+		if err != nil {
+			return err
+		}
+		if !bytes.Equal(peersHash, b.Body.PeersHash) {
+			return fmt.Errorf("frame %d: peers differ from block %d", frame.Round, b.Index())
+		}
+
+		//the Blocks before ProtocolPeerSetRoot have none
+		root, err := frame.BlockPeerSetRoot()
+		if err != nil {
+			return err
+		}
+		if !bytes.Equal(root, b.Body.PeerSetRoot) {
+			return fmt.Errorf("frame %d: peer-set history differs from block %d", frame.Round, b.Index())
+		}
+	}
+
+	if len(txs) != len(blockTxs) {
+		return fmt.Errorf("frame %d has %d transactions, its blocks %d", frame.Round, len(txs), len(blockTxs))
+	}
+	for i := range txs {
+		if !bytes.Equal(txs[i], blockTxs[i]) {
+			return fmt.Errorf("frame %d: transaction %d differs from its block", frame.Round, i)
+		}
+	}
+
+	frameItxs, err := json.Marshal(itxs)
+	if err != nil {
+		return err
+	}
+	blocksItxs, err := json.Marshal(blockItxs)
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(frameItxs, blocksItxs) {
+		return fmt.Errorf("frame %d: internal transactions differ from its blocks", frame.Round)
+	}
+
+	return nil
+}
+
+// processHistoryRequest exports the requested rounds. It must be called with
+// the lock.
+func (n *Node) processHistoryRequest(req *transport.HistoryRequest) (*transport.HistoryResponse, error) {
+	archive, ok := n.hg.Store.(store.Archive)
+	if !ok {
+		return nil, ErrNoArchive
+	}
+
+	history, err := archive.ExportRange(req.FromRound, req.ToRound)
+	if err != nil {
+		return nil, err
+	}
+
+	resp := &transport.HistoryResponse{
+		FromID: n.self.ID(),
+		Frames: make([]types.Frame, len(history.Frames)),
+		Blocks: make([]types.Block, len(history.Blocks)),
+	}
+	for i, f := range history.Frames {
+		resp.Frames[i] = *f
+	}
+	for i, b := range history.Blocks {
+		resp.Blocks[i] = *b
+	}
+
+	return resp, nil
+}
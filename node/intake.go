@@ -0,0 +1,114 @@
+package node
+
+import (
+	"fmt"
+	"math/rand"
+
+	"github.com/bolaxy/config"
+	"github.com/bolaxy/core/query"
+)
+
+// intake is the number of distinct creators, other than us, of which we know
+// Events in the last IntakeRounds. Peers which eclipse a node, by only
+// relaying the Events of some creators, keep it below MinCreators.
+type intake struct {
+	round    int // last round of the Hashgraph
+	creators int
+	required int
+	missing  []uint32 // the creators without recent Events
+	eclipsed bool
+}
+
+// measureIntake counts the creators of the PeerSet of which we know Events
+// in the last IntakeRounds. The Node is not deemed eclipsed before there are
+// that many rounds. It must be called with the lock.
+func (n *Node) measureIntake() intake {
+	in := intake{round: n.hg.Store.LastRound()}
+
+	rounds := n.config.Health.IntakeRounds
+	if rounds <= 0 || n.peerSet == nil {
+		return in
+	}
+
+	others := 0
+	for _, p := range n.peerSet.Peers {
+		if p.ID() == n.self.ID() {
+			continue
+		}
+		others++
+
+		if n.recentCreator(p, in.round-rounds) {
+			in.creators++
+		} else {
+			in.missing = append(in.missing, p.ID())
+		}
+	}
+
+	in.required = n.config.Health.MinCreators
+	if in.required == 0 {
+		in.required = n.peerSet.SuperMajority()
+		if _, member := n.peerSet.ByID[n.self.ID()]; member {
+			in.required--
+		}
+	}
+	if in.required > others {
+		in.required = others
+	}
+
+	in.eclipsed = in.round >= rounds && in.creators < in.required
+
+	return in
+}
+
+// recentCreator returns whether we know an Event of p from round from or
+// later. It must be called with the lock.
+func (n *Node) recentCreator(p *conf.Peer, from int) bool {
+	last, err := n.hg.Store.LastEventFrom(p.PubKeyString())
+	if err != nil || last == "" {
+		return false
+	}
+	ev, err := n.hg.Store.GetEvent(last)
+	if err != nil || ev.GetRound() == nil {
+		return false
+	}
+	return *ev.GetRound() >= from
+}
+
+// missingCreator returns, when the Node is eclipsed, a random creator without
+// recent Events to pull from instead of the choice of the selector, or nil.
+// It must be called with the lock.
+func (n *Node) missingCreator() *conf.Peer {
+	n.health.lock.Lock()
+	in := n.health.intake
+	n.health.lock.Unlock()
+
+	if !in.eclipsed || len(in.missing) == 0 || n.peerSet == nil {
+		return nil
+	}
+
+	return n.peerSet.ByID[in.missing[rand.Intn(len(in.missing))]]
+}
+
+// checkIntake fails when the Node is eclipsed
+func (n *Node) checkIntake() query.HealthCheck {
+	n.health.lock.Lock()
+	in := n.health.intake
+	n.health.lock.Unlock()
+
+	c := query.HealthCheck{
+		Name: "intake",
+		OK:   !in.eclipsed,
+		Details: map[string]interface{}{
+			"Creators":    in.creators,
+			"MinCreators": in.required,
+			"Rounds":      n.config.Health.IntakeRounds,
+		},
+	}
+	if !c.OK {
+		c.Reason = fmt.Sprintf("events of %d creators in the last %d rounds, %d required",
+			in.creators, n.config.Health.IntakeRounds, in.required)
+		c.Details["Missing"] = in.missing
+	}
+
+	return c
+}
@@ -0,0 +1,470 @@
+package node
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/bolaxy/common/hexutil"
+	"github.com/bolaxy/config"
+	"github.com/bolaxy/core/db"
+	"github.com/bolaxy/core/hashgraph"
+	"github.com/bolaxy/core/logger"
+	"github.com/bolaxy/core/signer"
+	"github.com/bolaxy/core/store"
+	"github.com/bolaxy/core/transport"
+	"github.com/bolaxy/core/types"
+	"github.com/bolaxy/crypto"
+)
+
+var (
+	// ErrJoinRefused is returned by Joiner.Join when the network refused the
+	// candidate
+	ErrJoinRefused = errors.New("join request refused")
+	// ErrSnapshotTooOld is returned when no snapshot including the Block which
+	// committed the join request is served
+	ErrSnapshotTooOld = errors.New("snapshot precedes accepted round")
+	// ErrLeaveRefused is returned by Leave when the network refused the
+	// removal
+	ErrLeaveRefused = errors.New("leave request refused")
+)
+
+/*******************************************************************************
+JoinHandler
+*******************************************************************************/
+
+// JoinHandler serves the Join and FastForward RPCs of a member of the
+// network. Join requests are submitted to consensus through the TxPool, and
+// answered when the Membership commits them.
+type JoinHandler struct {
+	hg         *hashgraph.Hashgraph
+	pool       *TxPool
+	membership *Membership
+	signer     signer.Signer
+	selfID     uint32
+	app        AppProxy //nil if the application takes no snapshots
+	chunkSize  int
+	served     []*servedSnapshot //oldest first
+	timeout    time.Duration
+	logger     logger.Logger
+}
+
+// NewJoinHandler creates a JoinHandler which signs its FastForward responses
+// with s, the Signer of selfID
+func NewJoinHandler(hg *hashgraph.Hashgraph, pool *TxPool, membership *Membership, s signer.Signer, selfID uint32) *JoinHandler {
+	return &JoinHandler{
+		hg:         hg,
+		pool:       pool,
+		membership: membership,
+		signer:     s,
+		selfID:     selfID,
+		chunkSize:  DefaultSnapshotChunkSize,
+		timeout:    transport.DefaultJoinTimeout,
+		logger:     logger.Nop,
+	}
+}
+
+// SetTimeout bounds the time waited for a join request to be committed
+func (j *JoinHandler) SetTimeout(timeout time.Duration) {
+	j.timeout = timeout
+}
+
+// SetAppProxy adds a snapshot of the application state to the FastForward
+// responses
+func (j *JoinHandler) SetAppProxy(app AppProxy) {
+	j.app = app
+}
+
+// SetSnapshotChunkSize sets the size of the chunks of the application
+// snapshots
+func (j *JoinHandler) SetSnapshotChunkSize(size int) {
+	j.chunkSize = size
+}
+
+// SetLogger ...
+func (j *JoinHandler) SetLogger(l logger.Logger) {
+	j.logger = logger.OrNop(l).With(logger.Component, "JoinHandler")
+}
+
+// Process answers rpc if it is a Join or FastForward request, and returns
+// false otherwise. It must be serialised with the other operations on the
+// Hashgraph. Join requests are answered asynchronously, once committed, or
+// refused by the PreProcessFunc of the Membership, or with the error of ctx if
+// it is done first.
+func (j *JoinHandler) Process(ctx context.Context, rpc transport.RPC) bool {
+	switch cmd := rpc.Command.(type) {
+	case *transport.JoinRequest:
+		j.join(ctx, rpc, cmd)
+	case *transport.FastForwardRequest:
+		resp, err := j.FastForward(cmd)
+		rpc.Respond(resp, err)
+	default:
+		return false
+	}
+	return true
+}
+
+func (j *JoinHandler) join(ctx context.Context, rpc transport.RPC, req *transport.JoinRequest) {
+	itx := req.InternalTransaction
+
+	if itx.Body.Type != types.PEERADD {
+		rpc.Respond(nil, fmt.Errorf("join request with %s transaction", itx.Body.Type))
+		return
+	}
+
+	if ok, err := itx.Verify(); err != nil || !ok {
+		rpc.Respond(nil, fmt.Errorf("invalid join request signature"))
+		return
+	}
+
+	if err := transport.CheckPeerAddresses(&itx.Body.Peer); err != nil {
+		rpc.Respond(nil, fmt.Errorf("invalid join request: %v", err))
+		return
+	}
+
+	j.logger.Info("join request",
+		"peer", itx.Body.Peer.PubKeyString(),
+		"addr", transport.PeerTarget(&itx.Body.Peer))
+
+	//the check runs out of the lock of the Hashgraph
+	go func() {
+		timer := time.NewTimer(j.timeout)
+		defer timer.Stop()
+
+		checkCtx, cancel := context.WithTimeout(ctx, j.timeout)
+		err := j.membership.PreProcess(checkCtx, itx)
+		cancel()
+		if err != nil {
+			j.logger.Info("join request refused",
+				"peer", itx.Body.Peer.PubKeyString(),
+				logger.Err, err)
+			rpc.Respond(&transport.JoinResponse{
+				FromID:        j.selfID,
+				Accepted:      false,
+				AcceptedRound: -1,
+				BlockIndex:    -1,
+			}, nil)
+			return
+		}
+
+		ch := j.membership.Await(itx)
+		j.pool.AddInternalTransaction(itx)
+
+		select {
+		case r := <-ch:
+			rpc.Respond(&transport.JoinResponse{
+				FromID:        j.selfID,
+				Accepted:      r.Receipt.Accepted,
+				AcceptedRound: r.EffectiveRound,
+				BlockIndex:    r.BlockIndex,
+				Peers:         r.Peers,
+			}, nil)
+		case <-timer.C:
+			j.membership.Cancel(itx)
+			rpc.Respond(nil, transport.ErrTimeout)
+		case <-ctx.Done():
+			j.membership.Cancel(itx)
+			rpc.Respond(nil, ctx.Err())
+		}
+	}()
+}
+
+// FastForward returns the last Block and its Frame, with a snapshot of the
+// application state if there is an AppProxy, in a signed response. The
+// reference of the snapshot is saved with the next CacheCheckpoint.
+func (j *JoinHandler) FastForward(req *transport.FastForwardRequest) (*transport.FastForwardResponse, error) {
+	block, err := j.hg.Store.GetBlock(j.hg.Store.LastBlockIndex())
+	if err != nil {
+		return nil, err
+	}
+
+	frame, err := j.hg.GetFrame(block.RoundReceived())
+	if err != nil {
+		return nil, err
+	}
+
+	resp := &transport.FastForwardResponse{
+		FromID: j.selfID,
+		Block:  *block,
+		Frame:  *frame,
+	}
+
+	if j.app != nil {
+		if err := j.addSnapshot(resp); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := transport.SealWith(resp, j.signer); err != nil {
+		return nil, err
+	}
+
+	return resp, nil
+}
+
+/*******************************************************************************
+Joiner
+*******************************************************************************/
+
+// JoinReceipt reports a successful join
+type JoinReceipt struct {
+	AcceptedRound int
+	BlockIndex    int // Block which committed the join request
+	Snapshot      int // Block from which the Hashgraph was Reset
+	// AppSnapshot is the application snapshot which was restored, nil
+	// without AppProxy
+	AppSnapshot *store.SnapshotRef `json:",omitempty"`
+}
+
+// Joiner runs the join flow of a candidate: it submits a signed PEER_ADD
+// InternalTransaction to a member of the network, waits until it is
+// committed, and resets the Hashgraph from a snapshot taken after the
+// commit. With an AppProxy, the application state is restored from the
+// snapshot too.
+type Joiner struct {
+	hg        *hashgraph.Hashgraph
+	trans     transport.Transport
+	signer    signer.Signer
+	self      *conf.Peer
+	app       AppProxy
+	chunks    *db.BlobStore
+	workers   int
+	verifier  *transport.Verifier
+	retries   int
+	retryWait time.Duration
+	logger    logger.Logger
+}
+
+// NewJoiner ...
+func NewJoiner(hg *hashgraph.Hashgraph, trans transport.Transport, s signer.Signer, self *conf.Peer) *Joiner {
+	return &Joiner{
+		hg:        hg,
+		trans:     trans,
+		signer:    s,
+		self:      self,
+		chunks:    newChunkStore(db.NewMemDatabase()),
+		workers:   4,
+		verifier:  transport.NewVerifier(transport.DefaultMaxClockSkew),
+		retries:   10,
+		retryWait: time.Second,
+		logger:    logger.Nop,
+	}
+}
+
+// SetRetries configures how snapshots are polled until one includes the
+// commit of the join request
+func (j *Joiner) SetRetries(retries int, wait time.Duration) {
+	j.retries = retries
+	j.retryWait = wait
+}
+
+// SetAppProxy restores the application state from the snapshot, which the
+// target must then provide
+func (j *Joiner) SetAppProxy(app AppProxy) {
+	j.app = app
+}
+
+// SetSnapshotFetch configures the download of the chunks of a large
+// application snapshot: the number of chunks downloaded in parallel, and the
+// db where the chunks are kept until the snapshot is complete, so that an
+// interrupted download resumes where it stopped. By default, the chunks are
+// kept in memory.
+func (j *Joiner) SetSnapshotFetch(workers int, chunks db.Sinker) {
+	j.workers = workers
+	if chunks != nil {
+		j.chunks = newChunkStore(chunks)
+	}
+}
+
+// SetLogger ...
+func (j *Joiner) SetLogger(l logger.Logger) {
+	j.logger = logger.OrNop(l).With(logger.Component, "Joiner")
+}
+
+// Join submits the join request to target, and resets the Hashgraph from a
+// snapshot served by target once the request is accepted. It gives up when
+// ctx is done.
+func (j *Joiner) Join(ctx context.Context, target string) (*JoinReceipt, error) {
+	itx := types.NewInternalTransactionJoin(*j.self)
+	if err := itx.SignWith(j.signer); err != nil {
+		return nil, err
+	}
+
+	var resp transport.JoinResponse
+	if err := j.trans.Join(ctx, target, &transport.JoinRequest{InternalTransaction: itx}, &resp); err != nil {
+		return nil, err
+	}
+
+	if !resp.Accepted {
+		return nil, ErrJoinRefused
+	}
+
+	j.logger.Info("join request accepted",
+		logger.Round, resp.AcceptedRound,
+		logger.Block, resp.BlockIndex)
+
+	snapshot, err := j.fastForward(ctx, target, &resp)
+	if err != nil {
+		return nil, err
+	}
+
+	return &JoinReceipt{
+		AcceptedRound: resp.AcceptedRound,
+		BlockIndex:    resp.BlockIndex,
+		Snapshot:      snapshot,
+		AppSnapshot:   j.hg.Snapshot(),
+	}, nil
+}
+
+// fastForward polls target until it serves a snapshot which includes the
+// Block that committed the join request, and resets the Hashgraph from it.
+// The snapshot's Frame may precede the scheduling of the new PeerSet, which
+// is then set from the JoinResponse. It returns the index of the snapshot
+// Block.
+func (j *Joiner) fastForward(ctx context.Context, target string, join *transport.JoinResponse) (int, error) {
+	self := strings.ToUpper(hexutil.Encode(crypto.CompressPubkey(j.signer.PublicKey())))
+
+	peerSet := conf.NewPeerSet(join.Peers)
+	if _, ok := peerSet.ByPubKey[self]; !ok {
+		return -1, fmt.Errorf("accepted peer-set does not include the candidate")
+	}
+
+	//a response whose chunked snapshot could not be fetched is retried
+	//once, to resume the download while target still serves it
+	var resume *transport.FastForwardResponse
+
+	for attempt := 0; ; attempt++ {
+		resp, resumed := resume, resume != nil
+		resume = nil
+
+		if !resumed {
+			var err error
+			if resp, err = j.requestFastForward(ctx, target, peerSet); err != nil {
+				return -1, err
+			}
+		}
+
+		if resp.Block.Index() >= join.BlockIndex {
+			err := j.restoreApp(ctx, target, resp)
+			if err != nil {
+				if ctx.Err() != nil || attempt >= j.retries {
+					return -1, err
+				}
+
+				j.logger.Warn("application snapshot not restored, retrying",
+					logger.Block, resp.Block.Index(),
+					logger.Err, err)
+
+				if resp.Manifest != nil && !resumed {
+					resume = resp
+				}
+
+				select {
+				case <-time.After(j.retryWait):
+				case <-ctx.Done():
+					return -1, ctx.Err()
+				}
+				continue
+			}
+
+			if err := j.hg.Reset(&resp.Block, &resp.Frame); err != nil {
+				return -1, err
+			}
+
+			if _, ok := resp.Frame.PeerSets[join.AcceptedRound]; !ok {
+				if err := j.hg.Store.SetPeerSet(join.AcceptedRound, peerSet); err != nil {
+					return -1, err
+				}
+			}
+
+			j.logger.Info("reset from snapshot",
+				logger.Block, resp.Block.Index(),
+				logger.Round, resp.Block.RoundReceived())
+
+			return resp.Block.Index(), nil
+		}
+
+		if attempt >= j.retries {
+			return -1, ErrSnapshotTooOld
+		}
+
+		select {
+		case <-time.After(j.retryWait):
+		case <-ctx.Done():
+			return -1, ctx.Err()
+		}
+	}
+}
+
+// requestFastForward requests a snapshot from target, which must be signed by
+// a member of peerSet
+func (j *Joiner) requestFastForward(ctx context.Context, target string, peerSet *conf.PeerSet) (*transport.FastForwardResponse, error) {
+	caps, err := transport.PeerCapabilities(ctx, j.trans, target)
+	if err != nil {
+		return nil, err
+	}
+	if !caps.Has(transport.FeatureFastForward) {
+		return nil, fmt.Errorf("%s does not serve fast-forward", target)
+	}
+
+	req := &transport.FastForwardRequest{FromID: j.self.ID()}
+	if err := transport.SealWith(req, j.signer); err != nil {
+		return nil, err
+	}
+
+	resp := new(transport.FastForwardResponse)
+	if err := j.trans.FastForward(ctx, target, req, resp); err != nil {
+		return nil, err
+	}
+
+	//the snapshot must come from a member of the accepted PeerSet
+	sender, ok := peerSet.ByID[resp.FromID]
+	if !ok {
+		return nil, fmt.Errorf("snapshot from unknown peer %d", resp.FromID)
+	}
+	if err := j.verifier.Verify(resp, sender.PubKeyBytes()); err != nil {
+		return nil, fmt.Errorf("snapshot from peer %d: %v", resp.FromID, err)
+	}
+
+	return resp, nil
+}
+
+// restoreApp restores the application state from the snapshot of a
+// FastForwardResponse, fetching its chunks from target if it has a Manifest,
+// and records its reference before the Reset saves a CacheCheckpoint
+func (j *Joiner) restoreApp(ctx context.Context, target string, resp *transport.FastForwardResponse) error {
+	if j.app == nil {
+		return nil
+	}
+
+	snapshot := resp.Snapshot
+	if resp.Manifest != nil {
+		if resp.Manifest.BlockIndex != resp.Block.Index() {
+			return fmt.Errorf("manifest of block %d with block %d", resp.Manifest.BlockIndex, resp.Block.Index())
+		}
+
+		var err error
+		if snapshot, err = j.fetchSnapshot(ctx, target, resp.Manifest); err != nil {
+			return err
+		}
+	}
+
+	if snapshot == nil {
+		return fmt.Errorf("no application snapshot from peer %d", resp.FromID)
+	}
+
+	if err := j.app.RestoreSnapshot(snapshot); err != nil {
+		return fmt.Errorf("restoring application snapshot of block %d: %v", resp.Block.Index(), err)
+	}
+
+	ref := snapshotRef(resp.Block.Index(), snapshot)
+	j.hg.SetSnapshot(ref)
+
+	j.logger.Info("application snapshot restored",
+		logger.Block, ref.BlockIndex,
+		"size", len(snapshot))
+
+	return nil
+}
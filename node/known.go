@@ -0,0 +1,101 @@
+package node
+
+import (
+	"bytes"
+	"sync"
+
+	"github.com/bolaxy/core/transport"
+)
+
+// DefaultKnownDiff is the default number of participants from which the
+// SyncRequests carry a KnownDiff
+const DefaultKnownDiff = 64
+
+// knownBases holds the Known maps of the previous syncs with each peer, from
+// which the KnownDiffs are computed and applied
+type knownBases struct {
+	lock sync.Mutex
+	sent map[uint32]map[uint32]int // [peer] => last Known map the peer answered
+	recv map[uint32]map[uint32]int // [peer] => last Known map received from the peer
+}
+
+func newKnownBases() *knownBases {
+	return &knownBases{
+		sent: make(map[uint32]map[uint32]int),
+		recv: make(map[uint32]map[uint32]int),
+	}
+}
+
+// request sets the Known map of a SyncRequest to peer, as a diff from the
+// last one it answered if there is one and known has at least threshold
+// entries
+func (k *knownBases) request(req *transport.SyncRequest, peer uint32, known map[uint32]int, threshold int) {
+	k.lock.Lock()
+	base := k.sent[peer]
+	k.lock.Unlock()
+
+	if base == nil || threshold <= 0 || len(known) < threshold {
+		req.Known = known
+		return
+	}
+
+	req.KnownDiff = transport.EncodeKnownDiff(base, known)
+	req.KnownHash = transport.KnownHash(known)
+}
+
+// answered records the Known map of a request which peer answered, or
+// forgets the base of peer if it did not have it
+func (k *knownBases) answered(peer uint32, known map[uint32]int, mismatch bool) {
+	k.lock.Lock()
+	defer k.lock.Unlock()
+
+	if mismatch {
+		delete(k.sent, peer)
+		return
+	}
+	k.sent[peer] = known
+}
+
+// resolve returns the Known map of a SyncRequest, or false if its KnownDiff
+// does not apply to the last map received from the requester
+func (k *knownBases) resolve(req *transport.SyncRequest) (map[uint32]int, bool) {
+	k.lock.Lock()
+	defer k.lock.Unlock()
+
+	if req.KnownHash == nil {
+		k.recv[req.FromID] = req.Known
+		return req.Known, true
+	}
+
+	base, ok := k.recv[req.FromID]
+	if !ok {
+		return nil, false
+	}
+
+	known, err := transport.ApplyKnownDiff(base, req.KnownDiff)
+	if err != nil || !bytes.Equal(transport.KnownHash(known), req.KnownHash) {
+		delete(k.recv, req.FromID)
+		return nil, false
+	}
+
+	k.recv[req.FromID] = known
+	return known, true
+}
+
+// retain drops the bases of the peers for which keep returns false, like the
+// ones which left the PeerSet
+func (k *knownBases) retain(keep func(peer uint32) bool) {
+	k.lock.Lock()
+	defer k.lock.Unlock()
+
+	for id := range k.sent {
+		if !keep(id) {
+			delete(k.sent, id)
+		}
+	}
+	for id := range k.recv {
+		if !keep(id) {
+			delete(k.recv, id)
+		}
+	}
+}
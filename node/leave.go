@@ -0,0 +1,157 @@
+package node
+
+import (
+	"context"
+	"strings"
+	"time"
+
+	"github.com/bolaxy/common/hexutil"
+	"github.com/bolaxy/config"
+	"github.com/bolaxy/core/hashgraph"
+	"github.com/bolaxy/core/logger"
+	"github.com/bolaxy/core/signer"
+	"github.com/bolaxy/core/store"
+	"github.com/bolaxy/core/transport"
+	"github.com/bolaxy/core/types"
+	"github.com/bolaxy/crypto"
+)
+
+// Leave submits a PEER_REMOVE InternalTransaction for self, signed by s,
+// and waits until it is committed. The node must keep creating Events until
+// then, so Leave must not be called from the goroutine which runs the
+// Hashgraph. The peer can stop once the returned EffectiveRound is decided.
+func Leave(pool *TxPool, membership *Membership, s signer.Signer, self *conf.Peer, timeout time.Duration) (MembershipReceipt, error) {
+	itx := types.NewInternalTransactionLeave(*self)
+	if err := itx.SignWith(s); err != nil {
+		return MembershipReceipt{}, err
+	}
+
+	ch := membership.Await(itx)
+	pool.AddInternalTransaction(itx)
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	select {
+	case r := <-ch:
+		if !r.Receipt.Accepted {
+			return r, ErrLeaveRefused
+		}
+		return r, nil
+	case <-timer.C:
+		membership.Cancel(itx)
+		return MembershipReceipt{}, transport.ErrTimeout
+	}
+}
+
+/*******************************************************************************
+Liveness
+*******************************************************************************/
+
+// Inactive reports whether peer has no committed Event in the last rounds
+// up to round, and was a member for at least as many rounds. Only committed
+// Events are considered, so that all the peers reach the same conclusion when
+// checking while committing round.
+func Inactive(s store.Store, peer *conf.Peer, round, rounds int) bool {
+	if first, ok := s.FirstRound(peer.ID()); ok && round-first < rounds {
+		return false
+	}
+
+	last, err := s.LastConsensusEventFrom(strings.ToUpper(peer.PubKeyHex))
+	if err != nil || last == "" {
+		return true
+	}
+
+	ev, err := s.GetEvent(last)
+	if err != nil || ev.GetRound() == nil {
+		return false
+	}
+
+	return round-*ev.GetRound() >= rounds
+}
+
+// LivenessMonitor proposes the eviction of the peers which have been
+// Inactive for a number of rounds. Dead peers count in the PeerSet's
+// SuperMajority without contributing to strongly-seeing paths, so evicting
+// them keeps consensus live when more peers fail later.
+type LivenessMonitor struct {
+	hg       *hashgraph.Hashgraph
+	pool     *TxPool
+	rounds   int
+	self     string
+	logger   logger.Logger
+	proposed map[string]int // [pubkey] => round of the last proposal
+}
+
+// NewLivenessMonitor proposes evictions after rounds rounds of inactivity.
+// The Membership of the peers must have eviction enabled with the same value
+// for the proposals to be accepted.
+func NewLivenessMonitor(hg *hashgraph.Hashgraph, pool *TxPool, s signer.Signer, rounds int) *LivenessMonitor {
+	return &LivenessMonitor{
+		hg:       hg,
+		pool:     pool,
+		rounds:   rounds,
+		self:     strings.ToUpper(hexutil.Encode(crypto.CompressPubkey(s.PublicKey()))),
+		logger:   logger.Nop,
+		proposed: make(map[string]int),
+	}
+}
+
+// SetLogger ...
+func (l *LivenessMonitor) SetLogger(lg logger.Logger) {
+	l.logger = logger.OrNop(lg).With(logger.Component, "LivenessMonitor")
+}
+
+// Wrap returns a CommitCallback which calls next, and then checks the
+// liveness of the peers at the Block's RoundReceived
+func (l *LivenessMonitor) Wrap(next hashgraph.CommitCallback) hashgraph.CommitCallback {
+	return func(ctx context.Context, block *types.Block) error {
+		if next != nil {
+			if err := next(ctx, block); err != nil {
+				return err
+			}
+		}
+		_, err := l.Check(block.RoundReceived())
+		return err
+	}
+}
+
+// Check proposes the eviction of the members of the PeerSet of round which
+// are Inactive. A peer is proposed again only if it is still a member
+// rounds rounds after the previous proposal. It returns the proposed peers.
+func (l *LivenessMonitor) Check(round int) ([]*conf.Peer, error) {
+	peerSet, err := l.hg.Store.GetPeerSet(round)
+	if err != nil {
+		return nil, err
+	}
+
+	if peerSet.Len() <= 1 {
+		return nil, nil
+	}
+
+	res := []*conf.Peer{}
+	for _, p := range peerSet.Peers {
+		pk := p.PubKeyString()
+		if pk == l.self {
+			continue
+		}
+
+		if last, ok := l.proposed[pk]; ok && round-last < l.rounds {
+			continue
+		}
+
+		if !Inactive(l.hg.Store, p, round, l.rounds) {
+			continue
+		}
+
+		l.pool.AddInternalTransaction(types.NewInternalTransactionEvict(*p))
+		l.proposed[pk] = round
+		res = append(res, p)
+
+		l.logger.Warn("proposing eviction of inactive peer",
+			"peer", pk,
+			logger.Round, round)
+	}
+
+	return res, nil
+}
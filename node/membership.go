@@ -0,0 +1,448 @@
+package node
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/bolaxy/config"
+	"github.com/bolaxy/core/hashgraph"
+	"github.com/bolaxy/core/logger"
+	"github.com/bolaxy/core/types"
+)
+
+// DefaultEffectiveRoundDelay is the number of rounds between the
+// RoundReceived of the Block which commits a membership change and the round
+// from which the new PeerSet applies. It leaves time for the change to be
+// committed by all the peers before the rounds it affects are decided.
+const DefaultEffectiveRoundDelay = 6
+
+// AcceptFunc decides whether a committed InternalTransaction is accepted,
+// given the PeerSet it would modify. It must be deterministic, since all the
+// peers must reach the same decision.
+type AcceptFunc func(itx types.InternalTransaction, peers *conf.PeerSet) bool
+
+// DefaultAccept accepts correctly signed PEER_ADD and PEER_REMOVE
+// transactions which change the PeerSet, PEER_SLASH transactions with valid
+// evidence against a member, PEER_EVICT transactions against a member,
+// whose inactivity is checked by the Membership, valid PARAM_UPDATE and
+// UPGRADE_SIGNAL transactions signed by a member, and PEER_VOTE transactions
+// signed by a member, whose proposal is checked by the Membership. Other
+// types are accepted since they do not modify the PeerSet.
+func DefaultAccept(itx types.InternalTransaction, peers *conf.PeerSet) bool {
+	_, member := peers.ByPubKey[strings.ToUpper(itx.Body.Peer.PubKeyHex)]
+
+	switch itx.Body.Type {
+	case types.PEERADD:
+		ok, err := itx.Verify()
+		return err == nil && ok && !member
+	case types.PEERREMOVE:
+		ok, err := itx.Verify()
+		return err == nil && ok && member && peers.Len() > 1
+	case types.PEERSLASH:
+		if itx.Body.Evidence == nil || itx.Body.Evidence.Creator() != strings.ToUpper(itx.Body.Peer.PubKeyHex) {
+			return false
+		}
+		ok, err := itx.Body.Evidence.Verify()
+		return err == nil && ok && member && peers.Len() > 1
+	case types.PEEREVICT:
+		return member && peers.Len() > 1
+	case types.PARAMUPDATE:
+		//the ProtocolVersion is activated by UPGRADE_SIGNAL only
+		if itx.Body.Params == nil || itx.Body.Params.Validate() != nil || itx.Body.Params.ProtocolVersion != 0 {
+			return false
+		}
+		ok, err := itx.Verify()
+		return err == nil && ok && member
+	case types.UPGRADESIGNAL:
+		if itx.Body.Version <= types.ProtocolInitial {
+			return false
+		}
+		ok, err := itx.Verify()
+		return err == nil && ok && member
+	case types.PEERVOTE:
+		if len(itx.Body.Proposal) == 0 {
+			return false
+		}
+		ok, err := itx.Verify()
+		return err == nil && ok && member
+	default:
+		return true
+	}
+}
+
+// PreProcessFunc checks an InternalTransaction before the peer which
+// received it submits it to consensus, like the reachability of a candidate
+// peer or the fee of a parachain registration. Unlike the AcceptFunc, it need
+// not be deterministic, since the other peers do not run it. An error keeps
+// the transaction out of consensus.
+type PreProcessFunc func(ctx context.Context, itx types.InternalTransaction) error
+
+// MembershipReceipt reports the outcome of a committed InternalTransaction
+type MembershipReceipt struct {
+	Receipt        types.InternalTransactionReceipt
+	BlockIndex     int
+	RoundReceived  int
+	EffectiveRound int          // -1 if the transaction was refused
+	Peers          []*conf.Peer // the PeerSet from EffectiveRound; nil for PARAM_UPDATE
+}
+
+// Membership applies the InternalTransactions of committed Blocks to the
+// PeerSets of the Hashgraph. Receipts set on the Block by the commit
+// callbacks it wraps are used as they are; otherwise they are computed with
+// the AcceptFunc and recorded in the Block. Accepted changes take effect
+// EffectiveRoundDelay rounds after the Block's RoundReceived. Accepted
+// PARAM_UPDATE transactions are recorded in the Store, and take effect at the
+// first epoch boundary from that round. So does a protocol version, once the
+// UPGRADE_SIGNAL transactions of a SuperMajority of the PeerSet are
+// committed within the signal window.
+//
+// PEER_EVICT transactions are refused unless eviction is enabled with
+// SetEvictionRounds, and the peer is Inactive when the Block is committed.
+type Membership struct {
+	hg         *hashgraph.Hashgraph
+	delay      int
+	evictAfter int
+	epoch      int
+	accept     AcceptFunc
+	preProcess PreProcessFunc //nil if the transactions are not checked
+	voting     *voting        //nil if the changes are not decided by vote
+	signals    *signals
+	logger     logger.Logger
+
+	lock    sync.Mutex
+	waiting map[string][]chan MembershipReceipt // [itx hash] => waiters
+}
+
+// NewMembership ...
+func NewMembership(hg *hashgraph.Hashgraph) *Membership {
+	return &Membership{
+		hg:      hg,
+		delay:   DefaultEffectiveRoundDelay,
+		epoch:   DefaultParamsEpoch,
+		signals: newSignals(DefaultSignalWindow),
+		accept:  DefaultAccept,
+		logger:  logger.Nop,
+		waiting: make(map[string][]chan MembershipReceipt),
+	}
+}
+
+// SetAcceptFunc ...
+func (m *Membership) SetAcceptFunc(f AcceptFunc) {
+	m.accept = f
+}
+
+// SetPreProcessFunc ...
+func (m *Membership) SetPreProcessFunc(f PreProcessFunc) {
+	m.preProcess = f
+}
+
+// PreProcess checks itx with the PreProcessFunc, if any, before it is
+// submitted
+func (m *Membership) PreProcess(ctx context.Context, itx types.InternalTransaction) error {
+	if m.preProcess == nil {
+		return nil
+	}
+	if err := m.preProcess(ctx, itx); err != nil {
+		return fmt.Errorf("%s transaction of %s refused: %v", itx.Body.Type, itx.Body.Peer.PubKeyString(), err)
+	}
+	return nil
+}
+
+// SetEffectiveRoundDelay ...
+func (m *Membership) SetEffectiveRoundDelay(delay int) {
+	m.delay = delay
+}
+
+// SetEvictionRounds enables the eviction of peers with no committed Events in
+// the last rounds. It must be the same on all the peers. 0 disables eviction.
+func (m *Membership) SetEvictionRounds(rounds int) {
+	m.evictAfter = rounds
+}
+
+// SetParamsEpoch sets the number of rounds of the epochs, at whose start the
+// ConsensusParams change. It must be the same on all the peers.
+func (m *Membership) SetParamsEpoch(rounds int) {
+	m.epoch = rounds
+}
+
+// epochStart returns the first round of an epoch from round
+func (m *Membership) epochStart(round int) int {
+	return (round + m.epoch - 1) / m.epoch * m.epoch
+}
+
+// SetLogger ...
+func (m *Membership) SetLogger(l logger.Logger) {
+	m.logger = logger.OrNop(l).With(logger.Component, "Membership")
+}
+
+// Wrap returns a CommitCallback which calls next, and then processes the
+// InternalTransactions of the Block
+func (m *Membership) Wrap(next hashgraph.CommitCallback) hashgraph.CommitCallback {
+	return func(ctx context.Context, block *types.Block) error {
+		if next != nil {
+			if err := next(ctx, block); err != nil {
+				return err
+			}
+		}
+		return m.ProcessBlock(block)
+	}
+}
+
+// Await returns a channel on which the MembershipReceipt of itx is sent when
+// a Block containing it is committed. It must be called before itx is
+// submitted.
+func (m *Membership) Await(itx types.InternalTransaction) <-chan MembershipReceipt {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	ch := make(chan MembershipReceipt, 1)
+	key := itx.HashString()
+	m.waiting[key] = append(m.waiting[key], ch)
+	return ch
+}
+
+// Cancel stops waiting for all the receipts of itx
+func (m *Membership) Cancel(itx types.InternalTransaction) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	delete(m.waiting, itx.HashString())
+}
+
+// ProcessBlock applies the InternalTransactions of a committed Block. It
+// must be serialised with the other operations on the Hashgraph, which is
+// the case when it is called from the commit callback.
+func (m *Membership) ProcessBlock(block *types.Block) error {
+	m.loadSignals(block)
+
+	decided := []types.InternalTransactionReceipt{}
+	if m.voting != nil {
+		if err := m.loadVoting(block); err != nil {
+			return err
+		}
+		for _, p := range m.voting.expire(block.RoundReceived()) {
+			m.logger.Info("proposal expired",
+				logger.Block, block.Index(),
+				"type", p.Transaction.Body.Type,
+				"peer", p.Transaction.Body.Peer.PubKeyString())
+			decided = append(decided, p.Transaction.AsRefused())
+		}
+	}
+
+	itxs := block.InternalTransactions()
+	if len(itxs) == 0 {
+		m.notifyAll(decided, block, -1, nil)
+		return nil
+	}
+
+	effectiveRound := block.RoundReceived() + m.delay
+
+	//Changes scheduled by previous Blocks apply before this one's
+	peerSet, err := m.hg.Store.GetPeerSet(effectiveRound)
+	if err != nil {
+		return err
+	}
+
+	receipts := block.InternalTransactionReceipts()
+	if len(receipts) == 0 {
+		receipts = make([]types.InternalTransactionReceipt, len(itxs))
+		candidate := peerSet
+		for i, itx := range itxs {
+			if m.decide(itx, candidate, block.RoundReceived()) {
+				receipts[i] = itx.AsAccepted()
+				if m.voting == nil || !governs(itx) {
+					candidate = applyInternalTransaction(candidate, itx)
+				}
+			} else {
+				receipts[i] = itx.AsRefused()
+			}
+		}
+
+		block.Body.InternalTransactionReceipts = receipts
+		if err := m.hg.Store.SetBlock(block); err != nil {
+			return err
+		}
+	}
+
+	newPeerSet := peerSet
+	var params *types.ConsensusParams
+	apply := func(itx types.InternalTransaction) {
+		switch itx.Body.Type {
+		case types.PARAMUPDATE:
+			params = itx.Body.Params
+		case types.UPGRADESIGNAL:
+			m.signals.add(itx, block.RoundReceived())
+		default:
+			newPeerSet = applyInternalTransaction(newPeerSet, itx)
+		}
+	}
+
+	for _, r := range receipts {
+		itx := r.InternalTransaction
+
+		switch {
+		case !r.Accepted:
+		case m.voting != nil && governs(itx):
+			//the outcome is notified once voted
+			m.voting.propose(itx, block.Index(), block.RoundReceived())
+			continue
+		case m.voting != nil && itx.Body.Type == types.PEERVOTE:
+			members, err := m.hg.Store.GetPeerSet(block.RoundReceived())
+			if err != nil {
+				return err
+			}
+			p, approved := m.voting.vote(itx, members)
+			if p == nil {
+				break
+			}
+
+			m.logger.Info("proposal decided",
+				logger.Block, block.Index(),
+				"type", p.Transaction.Body.Type,
+				"peer", p.Transaction.Body.Peer.PubKeyString(),
+				"approvals", p.Approvals,
+				"rejections", p.Rejections)
+
+			//the AcceptFunc is checked again against the PeerSet it modifies
+			if approved && m.accept(p.Transaction, newPeerSet) {
+				apply(p.Transaction)
+				decided = append(decided, p.Transaction.AsAccepted())
+			} else {
+				decided = append(decided, p.Transaction.AsRefused())
+			}
+		default:
+			apply(itx)
+		}
+
+		decided = append(decided, r)
+	}
+
+	changed := newPeerSet != peerSet
+	if changed {
+		if err := m.hg.Store.SetPeerSet(effectiveRound, newPeerSet); err != nil {
+			return err
+		}
+
+		m.logger.Info("peer-set change scheduled",
+			logger.Block, block.Index(),
+			logger.Round, effectiveRound,
+			"peers", newPeerSet.Len())
+	}
+
+	version, activated, err := m.activate(block, effectiveRound)
+	if err != nil {
+		return err
+	}
+
+	if params != nil || activated {
+		round := m.epochStart(effectiveRound)
+		current, err := m.hg.Store.GetParams(round)
+		if err != nil {
+			return err
+		}
+
+		//an update keeps the ProtocolVersion, and an activation the params
+		next := &types.ConsensusParams{}
+		if params != nil {
+			*next = *params
+		} else if current != nil {
+			*next = *current
+		}
+		next.ProtocolVersion = current.Version()
+		if activated {
+			next.ProtocolVersion = version
+		}
+
+		if err := m.hg.Store.SetParams(round, next); err != nil {
+			return err
+		}
+
+		m.logger.Info("params change scheduled",
+			logger.Block, block.Index(),
+			logger.Round, round,
+			"version", next.ProtocolVersion)
+	}
+
+	m.notifyAll(decided, block, effectiveRound, newPeerSet)
+
+	return nil
+}
+
+// decide applies the AcceptFunc, checks the inactivity of the peers targeted
+// by PEER_EVICT transactions, and refuses the UPGRADE_SIGNAL transactions for
+// versions already activated, and the PEER_VOTE transactions on proposals
+// which are not open
+func (m *Membership) decide(itx types.InternalTransaction, peers *conf.PeerSet, round int) bool {
+	switch itx.Body.Type {
+	case types.PEERVOTE:
+		if m.voting == nil || m.voting.find(itx.Body.Proposal) == nil {
+			return false
+		}
+	case types.PEEREVICT:
+		if m.evictAfter <= 0 || !Inactive(m.hg.Store, &itx.Body.Peer, round, m.evictAfter) {
+			return false
+		}
+	case types.UPGRADESIGNAL:
+		if itx.Body.Version <= m.scheduledVersion(round+m.delay) {
+			return false
+		}
+	}
+	return m.accept(itx, peers)
+}
+
+// notifyAll sends the MembershipReceipts of the decisions taken when block
+// was committed. The accepted changes apply from effectiveRound, with peers.
+func (m *Membership) notifyAll(receipts []types.InternalTransactionReceipt, block *types.Block, effectiveRound int, peers *conf.PeerSet) {
+	for _, r := range receipts {
+		res := MembershipReceipt{
+			Receipt:        r,
+			BlockIndex:     block.Index(),
+			RoundReceived:  block.RoundReceived(),
+			EffectiveRound: -1,
+		}
+		switch {
+		case !r.Accepted:
+		case r.InternalTransaction.Body.Type == types.PARAMUPDATE:
+			res.EffectiveRound = m.epochStart(effectiveRound)
+		default:
+			res.EffectiveRound = effectiveRound
+			res.Peers = peers.Peers
+		}
+		m.notify(r.InternalTransaction, res)
+	}
+}
+
+func (m *Membership) notify(itx types.InternalTransaction, res MembershipReceipt) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	key := itx.HashString()
+	for _, ch := range m.waiting[key] {
+		ch <- res
+	}
+	delete(m.waiting, key)
+}
+
+// applyInternalTransaction returns the PeerSet modified by an accepted
+// InternalTransaction. The PeerSet is returned as is if it is not modified.
+func applyInternalTransaction(peerSet *conf.PeerSet, itx types.InternalTransaction) *conf.PeerSet {
+	peer := itx.Body.Peer
+	peer.PubKeyHex = strings.ToUpper(peer.PubKeyHex)
+	_, member := peerSet.ByPubKey[peer.PubKeyString()]
+
+	switch itx.Body.Type {
+	case types.PEERADD:
+		if !member {
+			//copy, so that the new PeerSet does not share its array
+			peers := append(append([]*conf.Peer{}, peerSet.Peers...), &peer)
+			return conf.NewPeerSet(peers)
+		}
+	case types.PEERREMOVE, types.PEERSLASH, types.PEEREVICT:
+		if member {
+			return peerSet.WithRemovedPeer(&peer)
+		}
+	}
+
+	return peerSet
+}
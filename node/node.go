@@ -0,0 +1,1309 @@
+package node
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bolaxy/common/hexutil"
+	"github.com/bolaxy/config"
+	"github.com/bolaxy/core/db"
+	"github.com/bolaxy/core/erasure"
+	"github.com/bolaxy/core/hashgraph"
+	"github.com/bolaxy/core/logger"
+	"github.com/bolaxy/core/query"
+	"github.com/bolaxy/core/reputation"
+	"github.com/bolaxy/core/signer"
+	"github.com/bolaxy/core/store"
+	"github.com/bolaxy/core/transport"
+	"github.com/bolaxy/core/types"
+	"github.com/bolaxy/crypto"
+)
+
+var (
+	// ErrShutdown is returned by Shutdown when the Node is already shut down
+	ErrShutdown = errors.New("node is shut down")
+	// ErrNotMember is returned to the senders of sync messages which are
+	// neither in the current PeerSet nor observers
+	ErrNotMember = errors.New("sender is not a member of the peer-set")
+	// ErrObserver is returned by the membership operations of an observer
+	ErrObserver = errors.New("observers are not in the peer-set")
+)
+
+// State is the participation of a Node in consensus
+type State int32
+
+const (
+	// Babbling nodes gossip and create Events
+	Babbling State = iota
+	// Suspended nodes only serve the RPCs of their peers
+	Suspended
+	// Shutdown nodes are closed
+	Shutdown
+)
+
+// String ...
+func (s State) String() string {
+	switch s {
+	case Babbling:
+		return "Babbling"
+	case Suspended:
+		return "Suspended"
+	case Shutdown:
+		return "Shutdown"
+	default:
+		return "Unknown"
+	}
+}
+
+// Node runs consensus for a validator. It pulls Events from its peers,
+// creates Events, signs committed Blocks, and serves the RPCs of its
+// Transport. An observer Node only pulls Events and serves RPCs. All the
+// operations on the Hashgraph are serialised by the Node's lock, which must
+// be the lock given to a QueryService.
+type Node struct {
+	config Config
+
+	lock        sync.Mutex
+	hg          *hashgraph.Hashgraph
+	trans       transport.Transport
+	signer      signer.Signer
+	self        *conf.Peer
+	pubKey      string //hex of the compressed public key, as in PeerSet.ByPubKey
+	pool        *TxPool
+	creator     *Creator
+	selector    PeerSelector
+	peerSet     *conf.PeerSet //PeerSet given to the selector
+	membership  *Membership
+	joinHandler *JoinHandler
+	observers   map[uint32]*conf.Peer
+	limiter     *transport.Limiter
+	verifier    *transport.Verifier
+	seen        *SeenFilter //nil if disabled
+	known       *knownBases
+	discovery   *discovery
+	skew        *skewTracker
+	orphans     *OrphanPool //nil if disabled
+	shards      *shardCache
+	bandwidth   *transport.Bandwidth
+	txs         *txCache
+	code        *erasure.Code //nil if our Events are not erasure-coded
+	reputation  *reputation.Reputation
+	anchors     AnchorSource
+	app         AppProxy //nil if the application takes no snapshots
+	chunks      db.Sinker
+	signGuard   *SignGuard
+	appCommit   hashgraph.CommitCallback //given to NewNode
+	commitCb    hashgraph.CommitCallback
+	async       *asyncCommits //nil if the application commits synchronously
+	health      *healthState
+	params      *types.ConsensusParams //in force at the last round
+	logger      logger.Logger
+
+	// sigWatch is the index of the oldest Block which may not be final, and
+	// sigSince the time since which it is the oldest
+	sigWatch int
+	sigSince time.Time
+
+	statusLock sync.Mutex
+	state      State
+	reason     string
+	since      time.Time
+
+	// shutdownCh stops the gossip and RPC loops after their current
+	// operation. ctx interrupts the operation: the RPCs in progress, the
+	// commit callbacks, and the processing of the decided rounds.
+	shutdownCh chan struct{}
+	ctx        context.Context
+	cancel     context.CancelFunc
+	wg         sync.WaitGroup
+}
+
+// ShutdownReport describes the state persisted by Shutdown
+type ShutdownReport struct {
+	LastBlockIndex     int
+	LastRound          int
+	LastConsensusRound int // -1 if no Round was decided
+	PendingRounds      int
+	PendingSignatures  int
+	Store              store.ShutdownReport // zero if the Store is not a PersistentStore
+	Duration           time.Duration
+}
+
+// NewNode creates a Node which signs with key. See NewNodeWithSigner.
+func NewNode(config Config,
+	s store.Store,
+	trans transport.Transport,
+	key *ecdsa.PrivateKey,
+	self *conf.Peer,
+	peers *conf.PeerSet,
+	commit hashgraph.CommitCallback) (*Node, error) {
+
+	return NewNodeWithSigner(config, s, trans, signer.NewLocal(key), self, peers, commit)
+}
+
+// NewNodeWithSigner creates a Node whose Hashgraph is initialised with peers,
+// or bootstrapped from the Store if config.Bootstrap is set. Its Events,
+// Blocks, InternalTransactions, and messages are signed by sgn, which may
+// hold the key outside the node. Committed Blocks go through the Membership,
+// then commit, before being signed. It fails if the config does not
+// Validate.
+func NewNodeWithSigner(config Config,
+	s store.Store,
+	trans transport.Transport,
+	sgn signer.Signer,
+	self *conf.Peer,
+	peers *conf.PeerSet,
+	commit hashgraph.CommitCallback) (*Node, error) {
+
+	if err := config.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid config: %v", err)
+	}
+
+	bandwidth := transport.NewBandwidth(config.Bandwidth)
+
+	n := &Node{
+		config:    config,
+		trans:     transport.NewMeteredTransport(trans, bandwidth),
+		bandwidth: bandwidth,
+		signer:    sgn,
+		self:      self,
+		pubKey:    strings.ToUpper(hexutil.Encode(crypto.CompressPubkey(sgn.PublicKey()))),
+		pool:      NewTxPool(),
+		observers: make(map[uint32]*conf.Peer),
+		limiter:   transport.NewLimiter(config.RateLimits),
+		verifier:  transport.NewVerifier(config.MaxClockSkew),
+		health:    newHealthState(),
+		logger:    logger.Nop,
+		state:     Babbling,
+		since:     time.Now(),
+
+		shutdownCh: make(chan struct{}),
+	}
+	n.ctx, n.cancel = context.WithCancel(context.Background())
+
+	if config.SeenFilterSize > 0 {
+		n.seen = NewSeenFilter(config.SeenFilterSize)
+	}
+	if config.OrphanPoolSize > 0 {
+		n.orphans = NewOrphanPool(config.OrphanPoolSize, config.OrphanTTL)
+	}
+	n.known = newKnownBases()
+	n.discovery = newDiscovery()
+	n.skew = newSkewTracker()
+	n.shards = newShardCache(config.Erasure.CacheSize)
+	n.txs = newTxCache(config.TxCacheSize)
+	if config.Erasure.MinPayload > 0 {
+		code, err := erasure.New(config.Erasure.DataShards, config.Erasure.ParityShards)
+		if err != nil {
+			return nil, fmt.Errorf("erasure: %v", err)
+		}
+		n.code = code
+	}
+
+	if _, ok := peers.ByID[self.ID()]; ok && config.Observer {
+		return nil, fmt.Errorf("observer %d is in the peer-set", self.ID())
+	}
+	for _, o := range config.Observers {
+		n.observers[o.ID()] = o
+	}
+
+	n.hg = hashgraph.NewHashgraph(s, n.commit)
+	n.hg.SetCacheCheckpointInterval(config.CacheCheckpointInterval)
+	n.hg.SetStaleHorizon(config.StaleHorizon)
+	n.hg.SetTxQuota(config.TxQuota)
+	n.hg.SetMaxEventPayload(config.Creator.MaxEventPayload)
+	n.pool.SetMaxTxSize(config.Creator.MaxEventPayload)
+	n.membership = NewMembership(n.hg)
+	if err := n.membership.SetVoting(config.Voting.Quorum, config.Voting.Window); err != nil {
+		return nil, fmt.Errorf("voting: %v", err)
+	}
+	n.appCommit = commit
+	n.commitCb = n.membership.Wrap(commit)
+	n.creator = NewCreator(n.hg, sgn, n.pool, config.Creator)
+	n.joinHandler = NewJoinHandler(n.hg, n.pool, n.membership, sgn, self.ID())
+	n.joinHandler.SetSnapshotChunkSize(config.SnapshotChunkSize)
+	n.selector = NewRandomPeerSelector(peers, self.ID())
+	n.peerSet = peers
+
+	rep, err := reputation.NewReputation(nil)
+	if err != nil {
+		return nil, fmt.Errorf("reputation: %v", err)
+	}
+	n.reputation = rep
+	n.signGuard = NewSignGuard(nil)
+	n.limiter.SetTrust(n.reputation.Trust)
+	n.selector.SetTrust(n.reputation.Trust)
+
+	if config.Archival {
+		cs, ok := s.(*store.CachedStore)
+		if !ok {
+			return nil, fmt.Errorf("archival mode requires a CachedStore, got %T", s)
+		}
+		if err := cs.SetArchival(true); err != nil {
+			return nil, fmt.Errorf("archival: %v", err)
+		}
+	}
+
+	bootstrapped := false
+	if config.Bootstrap {
+		var err error
+		if bootstrapped, err = n.hg.Bootstrap(n.ctx); err != nil {
+			return nil, fmt.Errorf("bootstrap: %v", err)
+		}
+	}
+
+	if !bootstrapped {
+		if err := n.hg.Init(peers); err != nil {
+			return nil, err
+		}
+	}
+
+	n.initSignatureWatch()
+	n.observeConsensus()
+
+	return n, nil
+}
+
+// SetLogger ...
+func (n *Node) SetLogger(l logger.Logger) {
+	n.logger = logger.OrNop(l).With(logger.Component, "Node")
+	n.hg.SetLogger(l)
+	n.creator.SetLogger(l)
+	n.membership.SetLogger(l)
+	n.joinHandler.SetLogger(l)
+	n.reputation.SetLogger(l)
+}
+
+// SetPeerSelector replaces the default RandomPeerSelector. It must be called
+// before Run.
+func (n *Node) SetPeerSelector(s PeerSelector) {
+	s.SetTrust(n.reputation.Trust)
+	n.selector = s
+}
+
+// SetReputation replaces the default in-memory Reputation, for example with
+// one persisted in the db. The selector and the rate limits consult it. It
+// must be called before Run.
+func (n *Node) SetReputation(r *reputation.Reputation) {
+	n.reputation = r
+	n.limiter.SetTrust(r.Trust)
+	n.selector.SetTrust(r.Trust)
+}
+
+// SetSignGuard replaces the default in-memory SignGuard, for example with one
+// persisted in the db, so that the Blocks we signed are not signed again
+// differently after a restart. It must be called before Run.
+func (n *Node) SetSignGuard(g *SignGuard) {
+	n.signGuard = g
+}
+
+// SetAppProxy lets the Node serve snapshots of the application state to the
+// nodes which join, and restore it in Join. It must be called before Run.
+func (n *Node) SetAppProxy(app AppProxy) {
+	n.app = app
+	n.joinHandler.SetAppProxy(app)
+}
+
+// SetSnapshotChunks keeps the chunks of the application snapshot downloaded
+// by Join in a db, so that an interrupted download resumes after a restart.
+// They are kept in memory otherwise.
+func (n *Node) SetSnapshotChunks(chunks db.Sinker) {
+	n.chunks = chunks
+}
+
+// Reputation ...
+func (n *Node) Reputation() *reputation.Reputation {
+	return n.reputation
+}
+
+// Hashgraph returns the consensus engine. It must only be used while holding
+// the Node's lock.
+func (n *Node) Hashgraph() *hashgraph.Hashgraph {
+	return n.hg
+}
+
+// Locker returns the lock which serialises the operations on the Hashgraph
+func (n *Node) Locker() sync.Locker {
+	return &n.lock
+}
+
+// Membership ...
+func (n *Node) Membership() *Membership {
+	return n.membership
+}
+
+// Creator ...
+func (n *Node) Creator() *Creator {
+	return n.creator
+}
+
+// SubmitTx adds a transaction to the next Event. A transaction larger than
+// the MaxEventPayload of the CreatorConfig is dropped.
+func (n *Node) SubmitTx(tx []byte) {
+	if !n.pool.AddTransaction(tx) {
+		n.logger.Warn("transaction larger than the event payload dropped", "size", len(tx))
+		return
+	}
+	n.txs.add(tx)
+}
+
+// SubmitTypedTx adds a transaction tagged with a PayloadType to the next
+// Event, so that it is routed to the handler of its type when committed. A
+// transaction larger than the MaxEventPayload of the CreatorConfig is dropped.
+func (n *Node) SubmitTypedTx(tx []byte, t types.PayloadType) {
+	if !n.pool.AddTypedTransaction(tx, t) {
+		n.logger.Warn("transaction larger than the event payload dropped", "size", len(tx))
+		return
+	}
+	n.txs.add(tx)
+}
+
+// SubmitInternalTx adds an InternalTransaction to the next Event, unless the
+// PreProcessFunc of the Membership refuses it. It must not be called from the
+// goroutine which runs the Hashgraph, since the check may take time.
+func (n *Node) SubmitInternalTx(ctx context.Context, itx types.InternalTransaction) error {
+	if err := n.membership.PreProcess(ctx, itx); err != nil {
+		return err
+	}
+
+	n.pool.AddInternalTransaction(itx)
+
+	return nil
+}
+
+// Join runs the join flow against target. It must be called before Run. It
+// gives up when ctx is done or the Node is closed.
+func (n *Node) Join(ctx context.Context, target string) (*JoinReceipt, error) {
+	if n.config.Observer {
+		return nil, ErrObserver
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	go func() {
+		select {
+		case <-n.ctx.Done():
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	joiner := NewJoiner(n.hg, n.trans, n.signer, n.self)
+	joiner.SetLogger(n.logger)
+	joiner.SetAppProxy(n.app)
+	joiner.SetSnapshotFetch(n.config.SnapshotFetchWorkers, n.chunks)
+	return joiner.Join(ctx, target)
+}
+
+// Leave submits our removal from the PeerSet and waits until it is
+// committed. The Node keeps running until it is closed.
+func (n *Node) Leave(timeout time.Duration) (MembershipReceipt, error) {
+	if n.config.Observer {
+		return MembershipReceipt{}, ErrObserver
+	}
+
+	return Leave(n.pool, n.membership, n.signer, n.self, timeout)
+}
+
+// Run starts serving RPCs and gossiping in the background
+func (n *Node) Run() {
+	n.wg.Add(2)
+	go n.serve()
+	go n.babble()
+
+	if n.async != nil {
+		n.wg.Add(1)
+		go n.acknowledge()
+	}
+
+	if n.config.DiscoveryInterval > 0 {
+		if err := n.SetAddress(n.self.Address, n.self.TcpPort); err != nil {
+			n.logger.Error("peer record not signed", logger.Err, err)
+		}
+		n.wg.Add(1)
+		go n.discover()
+	}
+}
+
+// Close stops the Node and its Transport. The RPCs and commit callbacks in
+// progress are cancelled, and Close waits for them to return. The Store is
+// left open.
+func (n *Node) Close() error {
+	if !n.stop() {
+		return nil
+	}
+
+	n.cancel()
+	n.wg.Wait()
+
+	return n.trans.Close()
+}
+
+// Shutdown stops gossip and the RPC server, and lets the operations in
+// progress complete. The pending Rounds and Signatures of the Hashgraph are
+// then saved in the Store if it is a PersistentStore, and the Store is
+// flushed and closed, followed by the Transport. If ctx is done first, the
+// operations in progress are cancelled, and the report tells what was
+// persisted.
+func (n *Node) Shutdown(ctx context.Context) (ShutdownReport, error) {
+	start := time.Now()
+	report := ShutdownReport{LastConsensusRound: -1}
+
+	if !n.stop() {
+		return report, ErrShutdown
+	}
+
+	done := make(chan struct{})
+	go func() {
+		n.wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-ctx.Done():
+		n.cancel()
+		<-done
+	}
+	n.cancel()
+
+	n.lock.Lock()
+	defer n.lock.Unlock()
+
+	state := n.hg.ConsensusState()
+	report.LastBlockIndex = n.hg.Store.LastBlockIndex()
+	report.LastRound = n.hg.Store.LastRound()
+	if state.LastConsensusRound != nil {
+		report.LastConsensusRound = *state.LastConsensusRound
+	}
+	report.PendingRounds = len(state.PendingRounds)
+	report.PendingSignatures = len(state.PendingSignatures)
+
+	var err error
+	if ps, ok := n.hg.Store.(store.PersistentStore); ok {
+		err = ps.SetConsensusState(state)
+
+		storeReport, shutdownErr := ps.Shutdown(ctx)
+		report.Store = storeReport
+		if err == nil {
+			err = shutdownErr
+		}
+	} else {
+		err = n.hg.Store.Close()
+	}
+
+	if transErr := n.trans.Close(); err == nil {
+		err = transErr
+	}
+
+	report.Duration = time.Since(start)
+
+	n.logger.Info("node shut down",
+		logger.Block, report.LastBlockIndex,
+		logger.Round, report.LastRound,
+		"pending_rounds", report.PendingRounds,
+		"pending_signatures", report.PendingSignatures,
+		"flushed", report.Store.Flushed,
+		"unflushed", report.Store.Unflushed,
+		"duration", report.Duration,
+		logger.Err, err)
+
+	return report, err
+}
+
+// stop moves to the Shutdown state and stops the gossip and RPC loops. It
+// returns false if the Node was already shut down.
+func (n *Node) stop() bool {
+	n.statusLock.Lock()
+	defer n.statusLock.Unlock()
+
+	if n.state == Shutdown {
+		return false
+	}
+	n.setState(Shutdown, "")
+	close(n.shutdownCh)
+
+	return true
+}
+
+/*******************************************************************************
+Suspend/Resume
+*******************************************************************************/
+
+// appSuspension is the reason of the suspensions requested by the application
+const appSuspension = "suspended by application"
+
+// Suspend stops Event creation and gossip. The Node keeps serving the RPCs
+// of its peers, so that they are not slowed down.
+func (n *Node) Suspend() {
+	n.suspend(appSuspension)
+}
+
+// Resume restarts Event creation and gossip after a suspension
+func (n *Node) Resume() {
+	n.resume("")
+}
+
+// State ...
+func (n *Node) State() State {
+	n.statusLock.Lock()
+	defer n.statusLock.Unlock()
+	return n.state
+}
+
+// Status implements query.StatusSource
+func (n *Node) Status() query.NodeStatus {
+	n.health.lock.Lock()
+	eclipsed := n.health.intake.eclipsed
+	n.health.lock.Unlock()
+
+	n.statusLock.Lock()
+	defer n.statusLock.Unlock()
+
+	return query.NodeStatus{
+		State:    n.state.String(),
+		Reason:   n.reason,
+		Since:    n.since,
+		Observer: n.config.Observer,
+		Eclipsed: eclipsed,
+	}
+}
+
+func (n *Node) suspend(reason string) {
+	n.statusLock.Lock()
+	defer n.statusLock.Unlock()
+
+	if n.state == Babbling {
+		n.setState(Suspended, reason)
+		n.logger.Warn("node suspended", "reason", reason)
+	}
+}
+
+// resume ends a suspension for reason, or any suspension if reason is empty
+func (n *Node) resume(reason string) {
+	n.statusLock.Lock()
+	defer n.statusLock.Unlock()
+
+	if n.state == Suspended && (reason == "" || n.reason == reason) {
+		n.setState(Babbling, "")
+		n.logger.Info("node resumed")
+	}
+}
+
+// setState must be called with the statusLock
+func (n *Node) setState(state State, reason string) {
+	n.state = state
+	n.reason = reason
+	n.since = time.Now()
+}
+
+/*******************************************************************************
+Gossip
+*******************************************************************************/
+
+func (n *Node) babble() {
+	defer n.wg.Done()
+
+	ticker := time.NewTicker(n.config.GossipInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-n.shutdownCh:
+			return
+		case <-ticker.C:
+			if n.State() == Babbling {
+				n.gossip()
+			}
+		}
+	}
+}
+
+// gossip pulls the Events of a peer, creates an Event if necessary unless we
+// are an observer, and suspends the Node if too many Events are undetermined
+func (n *Node) gossip() {
+	n.lock.Lock()
+	n.updatePeers()
+	n.updateParams()
+	peer := n.missingCreator()
+	if peer == nil {
+		peer = n.selector.Next()
+		//a peer beyond its share of the bandwidth gets a second chance only
+		if peer != nil && n.bandwidth.Capped(peer.ID()) {
+			peer = n.selector.Next()
+		}
+	}
+	due := n.signaturesDue(time.Now())
+	n.lock.Unlock()
+
+	if peer != nil && n.limiter.Banned(peer.ID()) {
+		peer = nil
+	}
+
+	if peer != nil {
+		err := n.pull(peer)
+		n.selector.UpdateLast(peer.ID(), err == nil)
+		if err == nil {
+			n.health.contact(peer.ID())
+		} else {
+			n.logger.Debug("sync failed",
+				"peer", peer.ID(),
+				logger.Err, err)
+		}
+	}
+
+	//too few signatures were gossiped for the oldest Block to be final
+	if peer != nil && due >= 0 {
+		if err := n.fetchSignatures(peer, due); err != nil {
+			n.logger.Debug("signatures not fetched",
+				"peer", peer.ID(),
+				logger.Err, err)
+		}
+	}
+
+	n.lock.Lock()
+	var d *draft
+	if !n.config.Observer && n.creator.ShouldCreate(time.Now()) {
+		var err error
+		if d, err = n.creator.draft(); err != nil {
+			n.logger.Debug("event not created", logger.Err, err)
+		}
+	}
+	n.lock.Unlock()
+
+	//the signer can be remote, so the Event is signed without the lock. Only
+	//this goroutine creates Events, so the draft stays our next Event.
+	if d != nil {
+		if err := n.creator.sign(d); err != nil {
+			n.logger.Debug("event not signed", logger.Err, err)
+			d = nil
+		}
+	}
+
+	n.lock.Lock()
+	defer n.lock.Unlock()
+
+	if d != nil {
+		if ev, err := n.creator.insert(n.ctx, d); err != nil {
+			n.logger.Debug("event not created", logger.Err, err)
+		} else {
+			n.disperse(ev)
+		}
+	}
+
+	n.observeConsensus()
+
+	if limit := n.suspendLimit(); limit > 0 && len(n.hg.UndeterminedEvents) > limit {
+		n.suspend(fmt.Sprintf("%d undetermined events", len(n.hg.UndeterminedEvents)))
+	}
+}
+
+// updatePeers gives the current PeerSet to the selector when it changed. It
+// must be called with the lock.
+func (n *Node) updatePeers() {
+	peerSet, err := n.hg.Store.GetPeerSet(n.hg.Store.LastRound())
+	if err != nil || peerSet == n.peerSet {
+		return
+	}
+
+	n.selector.SetPeers(peerSet)
+	n.peerSet = peerSet
+
+	n.known.retain(func(id uint32) bool {
+		_, member := peerSet.ByID[id]
+		return member || n.observers[id] != nil
+	})
+	n.skew.retain(func(id uint32) bool {
+		_, member := peerSet.ByID[id]
+		return member
+	})
+	n.bandwidth.Retain(func(id uint32) bool {
+		_, member := peerSet.ByID[id]
+		return member || n.observers[id] != nil
+	})
+
+	n.discovery.retain(func(pubKey string) bool {
+		if _, member := peerSet.ByPubKey[pubKey]; member || pubKey == n.pubKey {
+			return true
+		}
+		for _, o := range n.observers {
+			if o.PubKeyString() == pubKey {
+				return true
+			}
+		}
+		return false
+	})
+}
+
+// pull requests the Events we do not know from peer, inserts them, and runs
+// consensus. A fork detected in the response is reported with a PEER_SLASH
+// InternalTransaction. The peer is penalised if the response is larger than
+// requested or contains invalid Events, and its timeouts are reported to its
+// Reputation.
+func (n *Node) pull(peer *conf.Peer) error {
+	n.lock.Lock()
+	known := n.hg.Store.KnownEvents()
+	syncLimit := n.syncLimit()
+	n.lock.Unlock()
+
+	resp, err := n.requestSync(peer, known, syncLimit, n.config.KnownDiff)
+	if err == nil && resp.KnownMismatch {
+		//the peer lost track of our Known map
+		resp, err = n.requestSync(peer, known, syncLimit, 0)
+	}
+	if err != nil {
+		return err
+	}
+	if resp.KnownMismatch {
+		return fmt.Errorf("sync response without events from %d", peer.ID())
+	}
+
+	if limit := syncLimit; limit > 0 && len(resp.Events) > limit {
+		n.report(peer.ID(), reputation.OversizedPayload)
+		n.penalize(peer, transport.PenaltyOversized, "oversized sync response")
+		return fmt.Errorf("sync response of %d events exceeds the limit of %d", len(resp.Events), limit)
+	}
+
+	events := n.reassembleEvents(peer, resp.Events)
+	events = n.fillEvents(peer, events)
+
+	n.lock.Lock()
+	defer n.lock.Unlock()
+
+	events, stale := n.hg.DropStale(events)
+	if stale > 0 {
+		n.logger.Debug("stale events dropped", "peer", peer.ID(), "count", stale)
+	}
+
+	insertErr := n.insertEvents(peer, events)
+
+	if err := n.hg.RunConsensus(n.ctx); err != nil {
+		return err
+	}
+
+	return insertErr
+}
+
+// requestSync sends a SyncRequest to peer, with known as a KnownDiff if it
+// has at least diffThreshold entries, and returns the verified response
+func (n *Node) requestSync(peer *conf.Peer, known map[uint32]int, syncLimit int, diffThreshold int) (*transport.SyncResponse, error) {
+	//a peer which can not handshake gets the Events in full
+	caps, err := transport.PeerCapabilities(n.ctx, n.trans, n.target(peer))
+	if err != nil {
+		caps = transport.LegacyCapabilities()
+	}
+
+	req := &transport.SyncRequest{
+		FromID:    n.self.ID(),
+		SyncLimit: syncLimit,
+		Batched:   n.config.BatchEvents && caps.Has(transport.FeatureBatchEvents),
+		PullTxs:   n.config.PullTxs && caps.Has(transport.FeatureSelectiveGossip),
+	}
+	n.known.request(req, peer.ID(), known, diffThreshold)
+	if err := transport.SealWith(req, n.signer); err != nil {
+		return nil, err
+	}
+
+	var resp transport.SyncResponse
+	sent := time.Now()
+	if err := n.trans.Sync(n.ctx, n.target(peer), req, &resp); err != nil {
+		if err == transport.ErrTimeout || errors.Is(err, context.DeadlineExceeded) {
+			n.report(peer.ID(), reputation.SyncTimeout)
+		}
+		return nil, err
+	}
+
+	if resp.FromID != peer.ID() {
+		return nil, fmt.Errorf("sync response from %d instead of %d", resp.FromID, peer.ID())
+	}
+	if err := n.verifier.Verify(&resp, peer.PubKeyBytes()); err != nil {
+		if err == transport.ErrBadSignature {
+			n.report(peer.ID(), reputation.InvalidSignature)
+			n.penalize(peer, transport.PenaltyInvalidEvent, "invalid sync response signature")
+		}
+		return nil, err
+	}
+
+	n.known.answered(peer.ID(), known, resp.KnownMismatch)
+	n.observeSkew(peer.ID(), &resp, sent, time.Now())
+	resp.Unbatch()
+
+	return &resp, nil
+}
+
+// insertEvents inserts the Events of a SyncResponse of peer. The Events which
+// were already inserted are dropped, and the ones which arrived before their
+// parents are held in the OrphanPool, and inserted with the parents. It
+// returns the first error which is not an orphan.
+func (n *Node) insertEvents(peer *conf.Peer, wevents []types.WireEvent) error {
+	if n.orphans != nil {
+		if expired := n.orphans.Expire(); expired > 0 {
+			n.logger.Debug("orphan events expired", "count", expired)
+		}
+	}
+
+	var insertErr error
+	for len(wevents) > 0 {
+		batch := make([]types.WireEvent, 0, len(wevents))
+		for i := range wevents {
+			if n.seen != nil && n.seen.Test(&wevents[i]) {
+				continue
+			}
+			batch = append(batch, wevents[i])
+		}
+		if duplicates := len(wevents) - len(batch); duplicates > 0 {
+			n.logger.Debug("duplicate events dropped", "peer", peer.ID(), "count", duplicates)
+		}
+
+		events, errs := n.hg.InsertEventBatch(batch)
+
+		//the orphans first, in order, as their descendants wait for them
+		orphaned := make([]bool, len(batch))
+		for i, err := range errs {
+			if err != nil {
+				orphaned[i] = n.holdOrphan(batch[i], err)
+			}
+		}
+
+		var released []types.WireEvent
+		for i, err := range errs {
+			if err == nil {
+				if n.seen != nil {
+					n.seen.Add(&batch[i])
+				}
+				if n.orphans != nil {
+					released = append(released, n.orphans.Release(batch[i].Body.CreatorID, batch[i].Body.Index)...)
+				}
+				continue
+			}
+			if orphaned[i] {
+				continue
+			}
+
+			var forkErr *hashgraph.ForkError
+			if errors.As(err, &forkErr) {
+				n.reportFork(forkErr.Evidence)
+			}
+			if insertErr != nil {
+				continue
+			}
+			insertErr = err
+
+			var (
+				quotaErr   *hashgraph.QuotaError
+				payloadErr *hashgraph.PayloadError
+			)
+			switch {
+			case forkErr != nil, err == hashgraph.ErrParentRejected:
+			case errors.As(err, &quotaErr):
+				n.logger.Debug("over-quota event rejected",
+					"peer", peer.ID(),
+					"creator", batch[i].Body.CreatorID,
+					"index", batch[i].Body.Index,
+					logger.Round, quotaErr.Round)
+				n.report(batch[i].Body.CreatorID, reputation.QuotaExceeded)
+			case errors.As(err, &payloadErr):
+				n.logger.Debug("oversized event rejected",
+					"peer", peer.ID(),
+					"creator", batch[i].Body.CreatorID,
+					"index", batch[i].Body.Index,
+					"size", payloadErr.Size)
+				n.report(batch[i].Body.CreatorID, reputation.OversizedPayload)
+			case err == hashgraph.ErrInvalidSignature:
+				n.report(peer.ID(), reputation.InvalidSignature)
+				n.penalize(peer, transport.PenaltyInvalidEvent, "invalid event signature")
+			case events[i] == nil:
+				n.penalize(peer, transport.PenaltyInvalidEvent, "unreadable event")
+			}
+		}
+
+		wevents = released
+	}
+
+	return insertErr
+}
+
+// holdOrphan adds a WireEvent which failed to insert to the OrphanPool if it
+// waits for a missing parent, or for a parent which is an orphan itself
+func (n *Node) holdOrphan(we types.WireEvent, err error) bool {
+	if n.orphans == nil {
+		return false
+	}
+
+	var missing *hashgraph.MissingParentError
+	if errors.As(err, &missing) {
+		n.orphans.Add(we, missing.CreatorID, missing.Index)
+		return true
+	}
+
+	if err != hashgraph.ErrParentRejected {
+		return false
+	}
+	if we.Body.SelfParentIndex >= 0 && n.orphans.Holds(we.Body.CreatorID, we.Body.SelfParentIndex) {
+		n.orphans.Add(we, we.Body.CreatorID, we.Body.SelfParentIndex)
+		return true
+	}
+	if we.Body.OtherParentIndex >= 0 && n.orphans.Holds(we.Body.OtherParentCreatorID, we.Body.OtherParentIndex) {
+		n.orphans.Add(we, we.Body.OtherParentCreatorID, we.Body.OtherParentIndex)
+		return true
+	}
+
+	return false
+}
+
+// penalize adds points to the score of a peer, which is banned from gossip
+// and sync serving if it reaches the limit
+func (n *Node) penalize(peer *conf.Peer, points int, reason string) {
+	if n.limiter.Penalize(peer.ID(), points) {
+		n.logger.Warn("peer banned",
+			"peer", peer.ID(),
+			"reason", reason,
+			"duration", n.config.RateLimits.BanDuration)
+	}
+}
+
+// report records an offence in the Reputation of a peer
+func (n *Node) report(id uint32, o reputation.Offence) {
+	if _, err := n.reputation.Report(n.ctx, id, o); err != nil {
+		n.logger.Warn("reputation not saved",
+			"peer", id,
+			"offence", o,
+			logger.Err, err)
+	}
+}
+
+func (n *Node) reportFork(evidence *types.ForkEvidence) {
+	peer, ok := n.hg.Store.RepertoireByPubKey()[evidence.Creator()]
+	if !ok {
+		return
+	}
+
+	n.report(peer.ID(), reputation.Fork)
+
+	n.logger.Warn("fork detected", "peer", peer.ID(), "index", evidence.Index())
+	n.pool.AddInternalTransaction(types.NewInternalTransactionSlash(*peer, evidence))
+}
+
+// commit is the CommitCallback of the Hashgraph. It signs the Blocks, unless
+// they are signed once an AsyncApp acknowledges them.
+func (n *Node) commit(ctx context.Context, block *types.Block) error {
+	n.health.committing(time.Now())
+	defer n.health.committing(time.Time{})
+
+	if err := n.commitCb(ctx, block); err != nil {
+		return err
+	}
+
+	if n.async != nil {
+		return nil
+	}
+
+	return n.sign(ctx, block)
+}
+
+// sign signs the Blocks of the rounds in which we are a member, which an
+// observer never is
+func (n *Node) sign(ctx context.Context, block *types.Block) error {
+	if n.config.Observer {
+		return nil
+	}
+
+	peerSet, err := n.hg.Store.GetPeerSet(block.RoundReceived())
+	if err != nil {
+		return err
+	}
+
+	if _, ok := peerSet.ByPubKey[n.pubKey]; !ok {
+		return nil
+	}
+
+	sig, err := n.signGuard.Sign(ctx, block, n.signer)
+	if err == ErrDoubleSign {
+		n.logger.Error("block not signed",
+			logger.Block, block.Index(),
+			logger.Err, err)
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	n.pool.AddBlockSignature(sig)
+
+	return nil
+}
+
+/*******************************************************************************
+RPCs
+*******************************************************************************/
+
+func (n *Node) serve() {
+	defer n.wg.Done()
+
+	for {
+		select {
+		case <-n.shutdownCh:
+			return
+		case rpc := <-n.trans.Consumer():
+			n.processRPC(rpc)
+		}
+	}
+}
+
+func (n *Node) processRPC(rpc transport.RPC) {
+	if msg, ok := rpc.Command.(transport.Signed); ok {
+		if err := n.admit(msg); err != nil {
+			n.logger.Debug("request refused",
+				"peer", msg.Sender(),
+				logger.Err, err)
+			rpc.Respond(nil, err)
+			return
+		}
+	}
+
+	n.lock.Lock()
+	defer n.lock.Unlock()
+
+	if n.joinHandler.Process(n.ctx, rpc) {
+		return
+	}
+
+	switch cmd := rpc.Command.(type) {
+	case *transport.SyncRequest:
+		resp, err := n.processSyncRequest(cmd)
+		if err == nil {
+			err = transport.SealWith(resp, n.signer)
+		}
+		if err == nil {
+			n.limiter.Charge(cmd.FromID, resp)
+		}
+		rpc.Respond(resp, err)
+	case *transport.HistoryRequest:
+		resp, err := n.processHistoryRequest(cmd)
+		if err == nil {
+			err = transport.SealWith(resp, n.signer)
+		}
+		if err == nil {
+			n.limiter.Charge(cmd.FromID, resp)
+		}
+		rpc.Respond(resp, err)
+	case *transport.SignaturesRequest:
+		resp, err := n.processSignaturesRequest(cmd)
+		if err == nil {
+			err = transport.SealWith(resp, n.signer)
+		}
+		if err == nil {
+			n.limiter.Charge(cmd.FromID, resp)
+		}
+		rpc.Respond(resp, err)
+	case *transport.SnapshotChunkRequest:
+		resp, err := n.joinHandler.SnapshotChunk(cmd)
+		if err == nil {
+			n.limiter.Charge(cmd.FromID, resp)
+		}
+		rpc.Respond(resp, err)
+	case *transport.PushShardsRequest:
+		rpc.Respond(n.processPushShards(cmd), nil)
+	case *transport.DiscoverRequest:
+		rpc.Respond(n.processDiscover(cmd), nil)
+	case *transport.FetchShardsRequest:
+		resp := n.processFetchShardsRequest(cmd)
+		err := transport.SealWith(resp, n.signer)
+		if err == nil {
+			n.limiter.Charge(cmd.FromID, resp)
+		}
+		rpc.Respond(resp, err)
+	case *transport.GetTxsRequest:
+		resp := n.processGetTxsRequest(cmd)
+		err := transport.SealWith(resp, n.signer)
+		if err == nil {
+			n.limiter.Charge(cmd.FromID, resp)
+		}
+		rpc.Respond(resp, err)
+	default:
+		rpc.Respond(nil, fmt.Errorf("unexpected command %T", cmd))
+	}
+}
+
+// admit verifies the Envelope of a signed request against the PeerSet and the
+// observers, then applies the rate limits to sync, history, signatures, and
+// snapshot chunk requests. The signature is checked first so that a spoofed
+// sender can not exhaust the limits of a peer.
+func (n *Node) admit(msg transport.Signed) error {
+	n.lock.Lock()
+	peer := n.member(msg.Sender())
+	n.lock.Unlock()
+
+	if peer == nil {
+		return ErrNotMember
+	}
+
+	if err := n.verifier.Verify(msg, peer.PubKeyBytes()); err != nil {
+		return err
+	}
+
+	switch msg.(type) {
+	case *transport.SyncRequest, *transport.HistoryRequest, *transport.SignaturesRequest, *transport.SnapshotChunkRequest,
+		*transport.PushShardsRequest, *transport.FetchShardsRequest, *transport.GetTxsRequest:
+		return n.limiter.Allow(msg.Sender())
+	}
+
+	return nil
+}
+
+// member returns the peer with the given id in the current PeerSet, or in a
+// PeerSet accepted for a later round, or among the observers, or nil. It must
+// be called with the lock.
+func (n *Node) member(id uint32) *conf.Peer {
+	peerSets, err := n.hg.Store.GetAllPeerSets()
+	if err != nil {
+		return nil
+	}
+
+	last := n.hg.Store.LastRound()
+	current := -1
+	for r := range peerSets {
+		if r <= last && r > current {
+			current = r
+		}
+	}
+
+	for r, peers := range peerSets {
+		if r < current {
+			continue
+		}
+		for _, p := range peers {
+			if p.ID() == id {
+				return p
+			}
+		}
+	}
+
+	return n.observers[id]
+}
+
+// eventChain holds the hashes of the Events of a creator which a SyncRequest
+// misses, in index order, and the first one once it is read
+type eventChain struct {
+	hashes []string
+	next   *types.Event
+}
+
+// readEvents merges the chains in topological order, which is the index order
+// within each chain, and stops reading from the Store once limit Events, or
+// maxBytes of them, are read. 0 means no limit. At least one Event is read
+// if the chains are not empty.
+func (n *Node) readEvents(chains []*eventChain, limit, maxBytes int) ([]*types.Event, error) {
+	events := []*types.Event{}
+	size := 0
+
+	for len(chains) > 0 && (limit <= 0 || len(events) < limit) && (maxBytes <= 0 || size < maxBytes) {
+		first := -1
+		for i, c := range chains {
+			if c.next == nil {
+				ev, err := n.hg.Store.GetEvent(c.hashes[0])
+				if err != nil {
+					return nil, err
+				}
+				c.next = ev
+			}
+			if first < 0 || c.next.TopologicalIndex < chains[first].next.TopologicalIndex {
+				first = i
+			}
+		}
+
+		c := chains[first]
+		events = append(events, c.next)
+		size += c.next.SerializedSize()
+
+		c.next, c.hashes = nil, c.hashes[1:]
+		if len(c.hashes) == 0 {
+			chains = append(chains[:first], chains[first+1:]...)
+		}
+	}
+
+	return events, nil
+}
+
+// processSyncRequest returns the Events unknown to the requester, in
+// topological order, up to the smallest of its SyncLimit and ours, and up to
+// our SyncBytesLimit. It must be called with the lock.
+func (n *Node) processSyncRequest(req *transport.SyncRequest) (*transport.SyncResponse, error) {
+	reqKnown, ok := n.known.resolve(req)
+	if !ok {
+		return &transport.SyncResponse{
+			FromID:        n.self.ID(),
+			KnownMismatch: true,
+		}, nil
+	}
+
+	chains := []*eventChain{}
+	total := 0
+	for id, peer := range n.hg.Store.RepertoireByID() {
+		known, ok := reqKnown[id]
+		if !ok {
+			known = -1
+		}
+
+		hashes, err := n.hg.Store.ParticipantEvents(peer.PubKeyString(), known)
+		if err != nil {
+			return nil, err
+		}
+		if len(hashes) > 0 {
+			chains = append(chains, &eventChain{hashes: hashes})
+			total += len(hashes)
+		}
+	}
+
+	limit := req.SyncLimit
+	if max := n.syncLimit(); max > 0 && (limit <= 0 || limit > max) {
+		limit = max
+	}
+
+	//a peer beyond its share of the bandwidth is served half of the Events
+	if n.bandwidth.Capped(req.FromID) {
+		if limit <= 0 || limit > total {
+			limit = total
+		}
+		limit = (limit + 1) / 2
+	}
+
+	events, err := n.readEvents(chains, limit, n.config.SyncBytesLimit)
+	if err != nil {
+		return nil, err
+	}
+
+	//the erasure-coded payloads are fetched from their holders
+	wireEvents := make([]types.WireEvent, len(events))
+	for i, ev := range events {
+		wireEvents[i] = ev.ToWire()
+		if coded := n.shards.coded(ev.Signature); coded != nil {
+			wireEvents[i] = wireEvents[i].Coded(coded)
+		}
+	}
+
+	if req.PullTxs {
+		n.digest(wireEvents)
+	}
+
+	resp := &transport.SyncResponse{
+		FromID: n.self.ID(),
+	}
+	if req.Batched {
+		resp.Batch = types.NewWireEventBatch(wireEvents)
+	} else {
+		resp.Events = wireEvents
+	}
+	//a requester which sends diffs does not need ours
+	if req.KnownHash == nil {
+		resp.Known = n.hg.Store.KnownEvents()
+	}
+
+	return resp, nil
+}
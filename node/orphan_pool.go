@@ -0,0 +1,132 @@
+package node
+
+import (
+	"container/list"
+	"time"
+
+	"github.com/bolaxy/core/types"
+)
+
+// orphanRef identifies an Event by its creator and index
+type orphanRef struct {
+	creator uint32
+	index   int
+}
+
+type orphan struct {
+	event   types.WireEvent
+	ref     orphanRef
+	missing orphanRef
+	added   time.Time
+	elem    *list.Element
+}
+
+// OrphanPool holds the WireEvents which arrived before one of their parents,
+// indexed by the parent they wait for, so that they are inserted when the
+// parent arrives instead of being requested again from a peer. The orphans
+// are evicted after a TTL, and the oldest ones when the pool is full. It is
+// not thread-safe.
+type OrphanPool struct {
+	size int
+	ttl  time.Duration
+
+	byRef     map[orphanRef]*orphan
+	byMissing map[orphanRef][]*orphan
+	queue     *list.List //oldest first
+}
+
+// NewOrphanPool creates an OrphanPool of at most size orphans, each kept for
+// ttl
+func NewOrphanPool(size int, ttl time.Duration) *OrphanPool {
+	return &OrphanPool{
+		size:      size,
+		ttl:       ttl,
+		byRef:     make(map[orphanRef]*orphan),
+		byMissing: make(map[orphanRef][]*orphan),
+		queue:     list.New(),
+	}
+}
+
+// Len returns the number of orphans
+func (p *OrphanPool) Len() int {
+	return p.queue.Len()
+}
+
+// Add holds a WireEvent until the parent of creator and index arrives. An
+// Event which is already held is not added again.
+func (p *OrphanPool) Add(we types.WireEvent, creator uint32, index int) {
+	ref := orphanRef{we.Body.CreatorID, we.Body.Index}
+	if _, ok := p.byRef[ref]; ok {
+		return
+	}
+
+	if p.queue.Len() >= p.size {
+		p.remove(p.queue.Front().Value.(*orphan))
+	}
+
+	o := &orphan{
+		event:   we,
+		ref:     ref,
+		missing: orphanRef{creator, index},
+		added:   time.Now(),
+	}
+	o.elem = p.queue.PushBack(o)
+	p.byRef[ref] = o
+	p.byMissing[o.missing] = append(p.byMissing[o.missing], o)
+}
+
+// Holds reports whether the Event of creator and index is an orphan, whose
+// descendants must wait for it too
+func (p *OrphanPool) Holds(creator uint32, index int) bool {
+	_, ok := p.byRef[orphanRef{creator, index}]
+	return ok
+}
+
+// Release removes and returns the orphans which wait for the Event of creator
+// and index
+func (p *OrphanPool) Release(creator uint32, index int) []types.WireEvent {
+	waiting := p.byMissing[orphanRef{creator, index}]
+
+	res := make([]types.WireEvent, 0, len(waiting))
+	for _, o := range waiting {
+		res = append(res, o.event)
+		p.remove(o)
+	}
+
+	return res
+}
+
+// Expire evicts the orphans older than the TTL and returns their number
+func (p *OrphanPool) Expire() int {
+	deadline := time.Now().Add(-p.ttl)
+
+	count := 0
+	for e := p.queue.Front(); e != nil; e = p.queue.Front() {
+		o := e.Value.(*orphan)
+		if o.added.After(deadline) {
+			break
+		}
+		p.remove(o)
+		count++
+	}
+
+	return count
+}
+
+func (p *OrphanPool) remove(o *orphan) {
+	p.queue.Remove(o.elem)
+	delete(p.byRef, o.ref)
+
+	waiting := p.byMissing[o.missing]
+	for i, w := range waiting {
+		if w == o {
+			waiting = append(waiting[:i], waiting[i+1:]...)
+			break
+		}
+	}
+	if len(waiting) == 0 {
+		delete(p.byMissing, o.missing)
+	} else {
+		p.byMissing[o.missing] = waiting
+	}
+}
@@ -0,0 +1,294 @@
+package node
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/bolaxy/core/db"
+	"github.com/bolaxy/core/query"
+	"github.com/bolaxy/core/types"
+)
+
+const (
+	outboxPrefix   = "outbox"
+	outboxAckedKey = "outboxacked"
+)
+
+// outboxRetry is the interval between the attempts to hand the Blocks of the
+// outbox to an AsyncApp which refuses them
+const outboxRetry = 5 * time.Second
+
+// outboxEntry is a Block of the outbox, with the time it was committed
+type outboxEntry struct {
+	Block  *types.Block
+	Queued time.Time
+}
+
+// outbox persists the committed Blocks until the AsyncApp acknowledges them,
+// and the index of the last acknowledged one. The Blocks are delivered at
+// least once: a Block acknowledged just before a crash is handed again.
+type outbox struct {
+	db    db.Sinker
+	acked int //-1 before the first acknowledgment
+}
+
+func outboxKey(index int) []byte {
+	return []byte(fmt.Sprintf("%s_%010d", outboxPrefix, index))
+}
+
+// openOutbox returns the outbox of sinker, with the Blocks it holds which
+// were not acknowledged, in order. The ones which were are deleted.
+func openOutbox(ctx context.Context, sinker db.Sinker) (*outbox, []outboxEntry, error) {
+	o := &outbox{db: sinker, acked: -1}
+
+	val, err := sinker.Get(ctx, []byte(outboxAckedKey))
+	switch {
+	case err == nil:
+		if o.acked, err = strconv.Atoi(string(val)); err != nil {
+			return nil, nil, fmt.Errorf("acknowledged offset: %v", err)
+		}
+	case err != db.ErrKeyNotFound:
+		return nil, nil, err
+	}
+
+	entries := []outboxEntry{}
+	stale := [][]byte{}
+
+	prefix := []byte(outboxPrefix + "_")
+	it := sinker.NewIterator(false)
+	for it.Seek(prefix); it.ValidForPrefix(prefix); it.Next() {
+		key := append([]byte{}, it.Item().Key()...)
+		val, err := it.Item().Value()
+		if err != nil {
+			it.Close()
+			return nil, nil, err
+		}
+
+		var e outboxEntry
+		if err := json.Unmarshal(val, &e); err != nil {
+			it.Close()
+			return nil, nil, fmt.Errorf("outbox entry %s: %v", key, err)
+		}
+
+		if e.Block.Index() <= o.acked {
+			stale = append(stale, key)
+			continue
+		}
+		entries = append(entries, e)
+	}
+	it.Close()
+
+	for _, key := range stale {
+		if err := sinker.Delete(ctx, key); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	return o, entries, nil
+}
+
+// push persists a committed Block
+func (o *outbox) push(ctx context.Context, block *types.Block, queued time.Time) error {
+	val, err := json.Marshal(outboxEntry{Block: block, Queued: queued})
+	if err != nil {
+		return err
+	}
+	return o.db.Put(ctx, outboxKey(block.Index()), val)
+}
+
+// ack persists index as the acknowledged offset, and deletes the Block. The
+// offset in memory is moved by the caller, with the lock of the queue.
+func (o *outbox) ack(ctx context.Context, index int) error {
+	batch := o.db.NewBatch()
+	if err := batch.Set([]byte(outboxAckedKey), []byte(strconv.Itoa(index))); err != nil {
+		batch.Cancel()
+		return err
+	}
+	if err := batch.Delete(outboxKey(index)); err != nil {
+		batch.Cancel()
+		return err
+	}
+	return batch.Commit(ctx)
+}
+
+// SetCommitOutbox keeps the committed Blocks in a db until the AsyncApp
+// acknowledges them, instead of in memory. The Blocks which it did not
+// acknowledge before the Node stopped are handed again once it runs, so that
+// an application which is down, or crashed with the Node, receives every
+// Block at least once; it must recognise the ones it already applied. The
+// Blocks which the AsyncApp refuses stay in the outbox and are handed again
+// later, in order, without stopping the consensus; beyond MaxPendingCommits
+// Blocks awaiting acknowledgment, the next ones wait in the outbox instead of
+// suspending the Node. The outbox must be kept with the Store, and the Node
+// bootstrapped from it. It must be called after SetAsyncApp and before Run.
+func (n *Node) SetCommitOutbox(sinker db.Sinker) error {
+	if n.async == nil {
+		return fmt.Errorf("commit outbox without an AsyncApp")
+	}
+
+	o, entries, err := openOutbox(n.ctx, sinker)
+	if err != nil {
+		return fmt.Errorf("commit outbox: %v", err)
+	}
+
+	n.lock.Lock()
+	for _, e := range entries {
+		n.hg.AwaitAck(e.Block.Index())
+	}
+	n.lock.Unlock()
+
+	a := n.async
+	a.lock.Lock()
+	for _, e := range entries {
+		a.pending = append(a.pending, pendingCommit{block: e.Block, queued: e.Queued})
+	}
+	a.outbox = o
+	a.lock.Unlock()
+
+	if len(entries) > 0 {
+		n.logger.Info("blocks not acknowledged before the restart",
+			"from", entries[0].Block.Index(),
+			"count", len(entries))
+	}
+
+	return nil
+}
+
+// enqueue persists a committed Block in the outbox and queues it, to be
+// handed to the AsyncApp by acknowledge
+func (n *Node) enqueue(ctx context.Context, block *types.Block) error {
+	a := n.async
+	now := time.Now()
+
+	if err := a.outbox.push(ctx, block, now); err != nil {
+		return err
+	}
+
+	n.hg.AwaitAck(block.Index())
+
+	a.lock.Lock()
+	a.pending = append(a.pending, pendingCommit{block: block, queued: now})
+	a.lock.Unlock()
+
+	n.watchOutbox(now)
+
+	select {
+	case a.wake <- struct{}{}:
+	default:
+	}
+
+	return nil
+}
+
+// deliver hands the queued Blocks to the AsyncApp, in order, while fewer than
+// MaxPendingCommits await acknowledgment. The Blocks are taken from the queue
+// with its lock, and handed without the lock of the Node, so that a slow
+// AsyncApp does not hold up the consensus.
+func (n *Node) deliver(ctx context.Context) error {
+	a := n.async
+
+	a.handing.Lock()
+	defer a.handing.Unlock()
+
+	a.lock.Lock()
+	end := len(a.pending)
+	if end > a.max {
+		end = a.max
+	}
+	blocks := []*types.Block{}
+	for i := a.delivered(); i < end; i++ {
+		blocks = append(blocks, a.pending[i].block)
+	}
+	a.lock.Unlock()
+
+	for _, block := range blocks {
+		ticket, err := a.app.CommitBlock(ctx, block)
+		if err != nil {
+			return fmt.Errorf("block %d: %v", block.Index(), err)
+		}
+
+		a.lock.Lock()
+		//the queue is replaced by a Replay
+		i := a.delivered()
+		if i == len(a.pending) || a.pending[i].block != block {
+			a.lock.Unlock()
+			return nil
+		}
+		a.pending[i].ticket = ticket
+		a.pending[i].since = time.Now()
+		a.lock.Unlock()
+	}
+
+	return nil
+}
+
+// outboxAlarm returns why the outbox exceeds the MaxOutboxBlocks or the
+// MaxOutboxAge of the HealthConfig, or ""
+func (n *Node) outboxAlarm(now time.Time) string {
+	a := n.async
+	a.lock.Lock()
+	size := len(a.pending)
+	var oldest pendingCommit
+	if size > 0 {
+		oldest = a.pending[0]
+	}
+	a.lock.Unlock()
+
+	max, maxAge := n.config.Health.MaxOutboxBlocks, n.config.Health.MaxOutboxAge
+	switch {
+	case max > 0 && size > max:
+		return fmt.Sprintf("%d blocks in the outbox, above %d", size, max)
+	case maxAge > 0 && size > 0 && now.Sub(oldest.queued) > maxAge:
+		return fmt.Sprintf("block %d in the outbox for %v", oldest.block.Index(),
+			now.Sub(oldest.queued).Round(time.Second))
+	}
+	return ""
+}
+
+// watchOutbox warns when the outbox crosses its bounds, and when it is back
+// under them
+func (n *Node) watchOutbox(now time.Time) {
+	reason := n.outboxAlarm(now)
+
+	a := n.async
+	a.lock.Lock()
+	was := a.alarm
+	a.alarm = reason != ""
+	a.lock.Unlock()
+
+	if reason != "" && !was {
+		n.logger.Warn("application lagging behind the commit outbox", "reason", reason)
+	} else if reason == "" && was {
+		n.logger.Info("commit outbox back within bounds")
+	}
+}
+
+// checkOutbox fails when the outbox exceeds its bounds
+func (n *Node) checkOutbox(now time.Time) query.HealthCheck {
+	c := query.HealthCheck{Name: "outbox", OK: true}
+
+	if n.async == nil || n.async.outbox == nil {
+		return c
+	}
+
+	a := n.async
+	a.lock.Lock()
+	size := len(a.pending)
+	acked := a.outbox.acked
+	a.lock.Unlock()
+
+	c.Details = map[string]interface{}{
+		"Blocks":          size,
+		"Acknowledged":    acked,
+		"MaxOutboxBlocks": n.config.Health.MaxOutboxBlocks,
+	}
+
+	if reason := n.outboxAlarm(now); reason != "" {
+		c.OK, c.Reason = false, reason
+	}
+
+	return c
+}
@@ -0,0 +1,116 @@
+package node
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/bolaxy/core/transport"
+	"github.com/bolaxy/core/types"
+)
+
+// DefaultParamsEpoch is the default number of rounds of the epochs, at whose
+// start the ConsensusParams change
+const DefaultParamsEpoch = 100
+
+var (
+	// ErrParamsRefused is returned by UpdateParams when the network refused
+	// the update
+	ErrParamsRefused = errors.New("params update refused")
+	// ErrUnsupportedVersion is returned by SignalUpgrade for a protocol
+	// version which this node does not implement
+	ErrUnsupportedVersion = errors.New("unsupported protocol version")
+)
+
+// UpdateParams submits a PARAM_UPDATE InternalTransaction, and waits until it
+// is committed, or decided if the changes are decided by vote. The returned
+// EffectiveRound is the first round of the epoch from which the params
+// apply.
+func (n *Node) UpdateParams(params types.ConsensusParams, timeout time.Duration) (MembershipReceipt, error) {
+	if n.config.Observer {
+		return MembershipReceipt{}, ErrObserver
+	}
+
+	itx := types.NewInternalTransactionParams(*n.self, params)
+	if err := itx.SignWith(n.signer); err != nil {
+		return MembershipReceipt{}, err
+	}
+
+	ch := n.membership.Await(itx)
+	n.pool.AddInternalTransaction(itx)
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	select {
+	case r := <-ch:
+		if !r.Receipt.Accepted {
+			return r, ErrParamsRefused
+		}
+		return r, nil
+	case <-timer.C:
+		n.membership.Cancel(itx)
+		return MembershipReceipt{}, transport.ErrTimeout
+	}
+}
+
+// Params returns the ConsensusParams in force, or nil if none were set
+func (n *Node) Params() *types.ConsensusParams {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	return n.params
+}
+
+// updateParams applies the ConsensusParams in force at the last round when
+// they changed. It must be called with the lock.
+func (n *Node) updateParams() {
+	params, err := n.hg.Store.GetParams(n.hg.Store.LastRound())
+	if err != nil || params == n.params {
+		return
+	}
+
+	n.params = params
+	n.creator.SetConfig(n.creatorConfig())
+
+	//the Hashgraph stops producing Blocks at the activation round
+	if v := params.Version(); v > types.ProtocolLatest {
+		n.logger.Error("unsupported protocol version activated", "version", v)
+		n.suspend(fmt.Sprintf("protocol version %d not supported", v))
+	}
+
+	n.logger.Info("params applied",
+		"sync_limit", n.syncLimit(),
+		"suspend_limit", n.suspendLimit(),
+		"heartbeat", n.creatorConfig().HeartbeatInterval,
+		"version", params.Version())
+}
+
+// The tunables set by the ConsensusParams override the Config, including
+// the values given to Reload.
+
+func (n *Node) syncLimit() int {
+	if n.params != nil && n.params.SyncLimit > 0 {
+		return n.params.SyncLimit
+	}
+	return n.config.SyncLimit
+}
+
+// suspendLimit is bounded by the CacheSize, since undetermined Events must
+// not be evicted from the caches
+func (n *Node) suspendLimit() int {
+	if n.params != nil && n.params.SuspendLimit > 0 {
+		if n.params.SuspendLimit > n.config.CacheSize {
+			return n.config.CacheSize
+		}
+		return n.params.SuspendLimit
+	}
+	return n.config.SuspendLimit
+}
+
+func (n *Node) creatorConfig() CreatorConfig {
+	config := n.config.Creator
+	if n.params != nil && n.params.HeartbeatInterval > 0 {
+		config.HeartbeatInterval = n.params.HeartbeatInterval
+	}
+	return config
+}
@@ -0,0 +1,481 @@
+package node
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math/rand"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/bolaxy/config"
+	"github.com/bolaxy/core/hashgraph"
+	"github.com/bolaxy/crypto"
+)
+
+// PeerSelector chooses the peer to sync with next and, through
+// SelectorStrategy, the other-parent of new Events. Implementations are safe
+// for concurrent use.
+type PeerSelector interface {
+	// SetPeers replaces the candidate peers, for example when the PeerSet
+	// changes
+	SetPeers(peers *conf.PeerSet)
+	// Next returns the next peer, or nil if there is no other peer
+	Next() *conf.Peer
+	// UpdateLast records the outcome of an interaction with a peer
+	UpdateLast(id uint32, ok bool)
+	// Stats returns per-peer statistics
+	Stats() map[uint32]PeerStats
+	// SetTrust makes the selector avoid the peers whose trust is below
+	// MinTrust
+	SetTrust(trust TrustFunc)
+}
+
+// TrustFunc returns the trust in a peer, between 0 and 1. It is implemented
+// by reputation.Reputation.Trust.
+type TrustFunc func(id uint32) float64
+
+// MinTrust is the trust below which a peer is only selected if no other peer
+// is trusted
+const MinTrust = 0.5
+
+// PeerStats ...
+type PeerStats struct {
+	Selected     int
+	Failures     int
+	LastSelected time.Time
+	LastSuccess  time.Time
+}
+
+// selectorBase holds the candidate peers and the statistics shared by all
+// the selectors
+type selectorBase struct {
+	lock   sync.Mutex
+	selfID uint32
+	peers  []*conf.Peer //excluding self
+	stats  map[uint32]PeerStats
+	trust  TrustFunc
+}
+
+func (b *selectorBase) init(peers *conf.PeerSet, selfID uint32) {
+	b.selfID = selfID
+	b.stats = make(map[uint32]PeerStats)
+	b.setPeers(peers)
+}
+
+func (b *selectorBase) setPeers(peers *conf.PeerSet) {
+	b.peers = b.peers[:0]
+	for _, p := range peers.Peers {
+		if p.ID() != b.selfID {
+			b.peers = append(b.peers, p)
+		}
+	}
+}
+
+func (b *selectorBase) selected(p *conf.Peer) *conf.Peer {
+	if p == nil {
+		return nil
+	}
+	st := b.stats[p.ID()]
+	st.Selected++
+	st.LastSelected = time.Now()
+	b.stats[p.ID()] = st
+	return p
+}
+
+// SetPeers ...
+func (b *selectorBase) SetPeers(peers *conf.PeerSet) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.setPeers(peers)
+}
+
+// SetTrust ...
+func (b *selectorBase) SetTrust(trust TrustFunc) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.trust = trust
+}
+
+// candidates returns the trusted peers, or all of them if none is trusted
+func (b *selectorBase) candidates() []*conf.Peer {
+	if b.trust == nil {
+		return b.peers
+	}
+
+	res := make([]*conf.Peer, 0, len(b.peers))
+	for _, p := range b.peers {
+		if b.trust(p.ID()) >= MinTrust {
+			res = append(res, p)
+		}
+	}
+
+	if len(res) == 0 {
+		return b.peers
+	}
+
+	return res
+}
+
+// UpdateLast ...
+func (b *selectorBase) UpdateLast(id uint32, ok bool) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	st := b.stats[id]
+	if ok {
+		st.LastSuccess = time.Now()
+	} else {
+		st.Failures++
+	}
+	b.stats[id] = st
+}
+
+// Stats ...
+func (b *selectorBase) Stats() map[uint32]PeerStats {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	res := make(map[uint32]PeerStats, len(b.stats))
+	for k, v := range b.stats {
+		res[k] = v
+	}
+	return res
+}
+
+/*******************************************************************************
+Random
+*******************************************************************************/
+
+// RandomPeerSelector chooses a random peer, avoiding the previous choice when
+// possible
+type RandomPeerSelector struct {
+	selectorBase
+	last uint32
+	rand *rand.Rand
+}
+
+// NewRandomPeerSelector ...
+func NewRandomPeerSelector(peers *conf.PeerSet, selfID uint32) *RandomPeerSelector {
+	s := &RandomPeerSelector{
+		rand: rand.New(rand.NewSource(time.Now().UnixNano())),
+	}
+	s.init(peers, selfID)
+	return s
+}
+
+// Next ...
+func (s *RandomPeerSelector) Next() *conf.Peer {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	peers := s.candidates()
+	if len(peers) == 0 {
+		return nil
+	}
+
+	candidates := peers
+	if len(candidates) > 1 {
+		candidates = make([]*conf.Peer, 0, len(peers)-1)
+		for _, p := range peers {
+			if p.ID() != s.last {
+				candidates = append(candidates, p)
+			}
+		}
+	}
+
+	p := candidates[s.rand.Intn(len(candidates))]
+	s.last = p.ID()
+
+	return s.selected(p)
+}
+
+/*******************************************************************************
+Least recently used
+*******************************************************************************/
+
+// LRUPeerSelector chooses the peer which was selected least recently,
+// preferring peers with fewer failures on ties. It spreads syncs evenly over
+// large PeerSets.
+type LRUPeerSelector struct {
+	selectorBase
+}
+
+// NewLRUPeerSelector ...
+func NewLRUPeerSelector(peers *conf.PeerSet, selfID uint32) *LRUPeerSelector {
+	s := &LRUPeerSelector{}
+	s.init(peers, selfID)
+	return s
+}
+
+// Next ...
+func (s *LRUPeerSelector) Next() *conf.Peer {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	var best *conf.Peer
+	for _, p := range s.candidates() {
+		if best == nil {
+			best = p
+			continue
+		}
+		st, bst := s.stats[p.ID()], s.stats[best.ID()]
+		if st.LastSelected.Before(bst.LastSelected) ||
+			(st.LastSelected.Equal(bst.LastSelected) && st.Failures < bst.Failures) {
+			best = p
+		}
+	}
+
+	return s.selected(best)
+}
+
+/*******************************************************************************
+Lagging peer priority
+*******************************************************************************/
+
+// LagFunc returns how far behind a peer appears to be. Higher is further
+// behind.
+type LagFunc func(id uint32) int
+
+// HashgraphLag measures the lag of a peer as the number of rounds between the
+// last round of the Hashgraph and the round of the peer's last known Event.
+// It must be called with the same serialisation as the Hashgraph.
+func HashgraphLag(hg *hashgraph.Hashgraph) LagFunc {
+	return func(id uint32) int {
+		peer, ok := hg.Store.RepertoireByID()[id]
+		if !ok {
+			return 0
+		}
+
+		last, err := hg.Store.LastEventFrom(peer.PubKeyString())
+		if err != nil || last == "" {
+			return hg.Store.LastRound() + 1
+		}
+
+		ev, err := hg.Store.GetEvent(last)
+		if err != nil || ev.GetRound() == nil {
+			return 0
+		}
+
+		return hg.Store.LastRound() - *ev.GetRound()
+	}
+}
+
+// LaggingPeerSelector chooses the peer which lags the most, so that it
+// catches up sooner and stops slowing down the strongly-seeing thresholds.
+// Ties are broken by least recent selection.
+type LaggingPeerSelector struct {
+	selectorBase
+	lag LagFunc
+}
+
+// NewLaggingPeerSelector ...
+func NewLaggingPeerSelector(peers *conf.PeerSet, selfID uint32, lag LagFunc) *LaggingPeerSelector {
+	s := &LaggingPeerSelector{lag: lag}
+	s.init(peers, selfID)
+	return s
+}
+
+// Next ...
+func (s *LaggingPeerSelector) Next() *conf.Peer {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	peers := s.candidates()
+	if len(peers) == 0 {
+		return nil
+	}
+
+	type scored struct {
+		peer *conf.Peer
+		lag  int
+	}
+
+	candidates := make([]scored, len(peers))
+	for i, p := range peers {
+		candidates[i] = scored{p, s.lag(p.ID())}
+	}
+
+	sort.SliceStable(candidates, func(i, j int) bool {
+		if candidates[i].lag != candidates[j].lag {
+			return candidates[i].lag > candidates[j].lag
+		}
+		return s.stats[candidates[i].peer.ID()].LastSelected.Before(s.stats[candidates[j].peer.ID()].LastSelected)
+	})
+
+	return s.selected(candidates[0].peer)
+}
+
+/*******************************************************************************
+Sampled
+*******************************************************************************/
+
+// SeedFunc returns the last round whose randomness is known, and that
+// randomness, or false if there is none yet
+type SeedFunc func() (round int, seed []byte, ok bool)
+
+// HashgraphSeed returns the seed of the last consensus round of the
+// Hashgraph. It must be called with the same serialisation as the Hashgraph.
+func HashgraphSeed(hg *hashgraph.Hashgraph) SeedFunc {
+	return func() (int, []byte, bool) {
+		if hg.LastConsensusRound == nil {
+			return 0, nil, false
+		}
+		round := *hg.LastConsensusRound
+		seed, err := hg.RoundSeed(round)
+		if err != nil {
+			return 0, nil, false
+		}
+		return round, seed, true
+	}
+}
+
+// SamplePartner returns the gossip partner of selfID among peers for the
+// draw-th sync after a round seed: the peer with the lowest hash of the seed,
+// selfID, draw, and its ID. Anyone can check the partners of a validator
+// once the seed is known, but not before.
+func SamplePartner(seed []byte, selfID uint32, draw uint64, peers []*conf.Peer) *conf.Peer {
+	buf := make([]byte, 16)
+	binary.BigEndian.PutUint32(buf, selfID)
+	binary.BigEndian.PutUint64(buf[4:], draw)
+
+	var best *conf.Peer
+	var bestRank []byte
+	for _, p := range peers {
+		if p.ID() == selfID {
+			continue
+		}
+		binary.BigEndian.PutUint32(buf[12:], p.ID())
+		rank := crypto.Keccak256(seed, buf)
+		if best == nil || bytes.Compare(rank, bestRank) < 0 {
+			best, bestRank = p, rank
+		}
+	}
+	return best
+}
+
+// maxSampleDraws bounds the draws skipped by a SampledPeerSelector for the
+// partners which failed, before it falls back to a random peer
+const maxSampleDraws = 16
+
+// SampledPeerSelector syncs with the sequence of partners drawn by
+// SamplePartner from the seed of the last consensus round. Outsiders cannot
+// predict the partners of a validator, to surround it, while the
+// communication graph of each round can be audited after the fact. The
+// partners below MinTrust, when others are trusted, and the ones whose sync
+// failed during the round, are skipped. Before the first seed, it chooses
+// random peers.
+type SampledPeerSelector struct {
+	selectorBase
+	seed     SeedFunc
+	round    int
+	draw     uint64
+	failed   map[uint32]bool
+	fallback *rand.Rand
+}
+
+// NewSampledPeerSelector ...
+func NewSampledPeerSelector(peers *conf.PeerSet, selfID uint32, seed SeedFunc) *SampledPeerSelector {
+	s := &SampledPeerSelector{
+		seed:     seed,
+		round:    -1,
+		failed:   make(map[uint32]bool),
+		fallback: rand.New(rand.NewSource(time.Now().UnixNano())),
+	}
+	s.init(peers, selfID)
+	return s
+}
+
+// Draw returns the round of the current seed, or -1 before the first one,
+// and the number of partners drawn from it
+func (s *SampledPeerSelector) Draw() (int, uint64) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.round, s.draw
+}
+
+// Next ...
+func (s *SampledPeerSelector) Next() *conf.Peer {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if len(s.peers) == 0 {
+		return nil
+	}
+
+	round, seed, ok := s.seed()
+	if !ok {
+		return s.random()
+	}
+
+	if round != s.round {
+		s.round = round
+		s.draw = 0
+		s.failed = make(map[uint32]bool)
+	}
+
+	trusted := s.candidates()
+	for i := 0; i < maxSampleDraws; i++ {
+		p := SamplePartner(seed, s.selfID, s.draw, s.peers)
+		s.draw++
+
+		if s.failed[p.ID()] || (len(trusted) < len(s.peers) && !contains(trusted, p)) {
+			continue
+		}
+		return s.selected(p)
+	}
+
+	return s.random()
+}
+
+// UpdateLast ...
+func (s *SampledPeerSelector) UpdateLast(id uint32, ok bool) {
+	s.selectorBase.UpdateLast(id, ok)
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if !ok {
+		s.failed[id] = true
+	}
+}
+
+// random returns a random candidate. It must be called with the lock.
+func (s *SampledPeerSelector) random() *conf.Peer {
+	peers := s.candidates()
+	return s.selected(peers[s.fallback.Intn(len(peers))])
+}
+
+func contains(peers []*conf.Peer, p *conf.Peer) bool {
+	for _, q := range peers {
+		if q.ID() == p.ID() {
+			return true
+		}
+	}
+	return false
+}
+
+/*******************************************************************************
+OtherParentStrategy
+*******************************************************************************/
+
+// SelectorStrategy is an OtherParentStrategy which uses the last Event of the
+// peer chosen by a PeerSelector
+type SelectorStrategy struct {
+	Selector PeerSelector
+}
+
+// OtherParent ...
+func (s SelectorStrategy) OtherParent(hg *hashgraph.Hashgraph, self string) (string, error) {
+	peer := s.Selector.Next()
+	if peer == nil {
+		return "", nil
+	}
+
+	last, err := hg.Store.LastEventFrom(peer.PubKeyString())
+	if err != nil {
+		//we know nothing from this peer yet
+		return "", nil
+	}
+
+	return last, nil
+}
@@ -0,0 +1,126 @@
+package node
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/bolaxy/core/logger"
+)
+
+// Replay hands the Blocks committed after lastApplied to an application which
+// restarted independently of the Node, in order, from the Store, so that it
+// catches up without diverging. The Blocks go to the CommitCallback given to
+// NewNode, and the state hashes it sets must match the ones of the first
+// commit; the Membership, which already processed the Blocks, does not see
+// them again. With an AsyncApp, the Blocks it did not acknowledge before the
+// restart are handed again even if lastApplied covers them, and it must
+// acknowledge them without applying them twice. No Block is committed while
+// Replay runs. It returns the number of Blocks handed.
+func (n *Node) Replay(ctx context.Context, lastApplied int) (int, error) {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+
+	last := n.hg.Store.LastBlockIndex()
+	if lastApplied > last {
+		return 0, fmt.Errorf("application applied block %d, after the last block %d", lastApplied, last)
+	}
+	if lastApplied < -1 {
+		lastApplied = -1
+	}
+
+	var (
+		count int
+		err   error
+	)
+	switch {
+	case n.async != nil:
+		count, err = n.replayAsync(ctx, lastApplied, last)
+	case n.appCommit != nil:
+		count, err = n.replay(ctx, lastApplied, last)
+	default:
+		return 0, fmt.Errorf("no application to replay blocks to")
+	}
+
+	n.logger.Info("blocks replayed",
+		"from", lastApplied+1,
+		"count", count,
+		logger.Err, err)
+
+	return count, err
+}
+
+func (n *Node) replay(ctx context.Context, lastApplied, last int) (int, error) {
+	count := 0
+	for i := lastApplied + 1; i <= last; i++ {
+		block, err := n.hg.Store.GetBlock(i)
+		if err != nil {
+			return count, fmt.Errorf("block %d: %v", i, err)
+		}
+
+		stateHash := block.StateHash()
+		if err := n.appCommit(ctx, block); err != nil {
+			block.SetStateHash(stateHash)
+			return count, err
+		}
+
+		if !bytes.Equal(block.StateHash(), stateHash) {
+			block.SetStateHash(stateHash)
+			return count, fmt.Errorf("state hash of block %d diverged from its first commit", i)
+		}
+
+		count++
+	}
+
+	return count, nil
+}
+
+// replayAsync hands the Blocks to the AsyncApp, and replaces the queue of the
+// Blocks awaiting acknowledgment by the ones handed again. The tickets of the
+// Blocks which were acknowledged already are dropped.
+func (n *Node) replayAsync(ctx context.Context, lastApplied, last int) (int, error) {
+	a := n.async
+
+	a.handing.Lock()
+	defer a.handing.Unlock()
+
+	a.lock.Lock()
+	from := lastApplied + 1
+	awaiting := make(map[int]pendingCommit, len(a.pending))
+	for _, p := range a.pending {
+		awaiting[p.block.Index()] = p
+		if p.block.Index() < from {
+			from = p.block.Index()
+		}
+	}
+	a.lock.Unlock()
+
+	queue := []pendingCommit{}
+	for i := from; i <= last; i++ {
+		block, err := n.hg.Store.GetBlock(i)
+		if err != nil {
+			return i - from, fmt.Errorf("block %d: %v", i, err)
+		}
+
+		ticket, err := a.app.CommitBlock(ctx, block)
+		if err != nil {
+			return i - from, err
+		}
+
+		if p, ok := awaiting[i]; ok {
+			queue = append(queue, pendingCommit{block: block, ticket: ticket, since: time.Now(), queued: p.queued})
+		}
+	}
+
+	a.lock.Lock()
+	a.pending = queue
+	a.lock.Unlock()
+
+	select {
+	case a.wake <- struct{}{}:
+	default:
+	}
+
+	return last - from + 1, nil
+}
@@ -0,0 +1,106 @@
+package node
+
+import (
+	"encoding/binary"
+	"hash/fnv"
+	"math"
+
+	"github.com/bolaxy/core/types"
+)
+
+// seenFalsePositives is the target false positive rate of a SeenFilter
+const seenFalsePositives = 1e-6
+
+// SeenFilter is a bloom filter of the recently inserted Events, consulted
+// before the store lookups and the signature verification of the Events of a
+// SyncResponse, so that the Events gossiped again during bursts are dropped
+// cheaply. It holds two generations of capacity Events each: when the current
+// one is full, it replaces the previous one, which forgets the oldest Events.
+// A false positive drops a new Event until its generation is forgotten, so
+// the rate is kept around one in a million. It is not thread-safe.
+type SeenFilter struct {
+	capacity int
+	bits     uint64 //bits of a generation
+	hashes   int
+
+	current  []uint64
+	previous []uint64
+	count    int //Events added to current
+}
+
+// NewSeenFilter creates a SeenFilter whose generations hold capacity Events
+func NewSeenFilter(capacity int) *SeenFilter {
+	if capacity < 1 {
+		capacity = 1
+	}
+
+	bits := math.Ceil(-float64(capacity) * math.Log(seenFalsePositives) / (math.Ln2 * math.Ln2))
+	hashes := int(math.Round(bits / float64(capacity) * math.Ln2))
+
+	f := &SeenFilter{
+		capacity: capacity,
+		bits:     uint64(bits),
+		hashes:   hashes,
+	}
+	f.current = f.generation()
+	f.previous = f.generation()
+
+	return f
+}
+
+func (f *SeenFilter) generation() []uint64 {
+	return make([]uint64, (f.bits+63)/64)
+}
+
+// seenKey identifies a WireEvent without looking up its parents: a creator
+// signs a single Event per index, unless it forks, and forks differ by their
+// signature
+func seenKey(we *types.WireEvent) []byte {
+	key := make([]byte, 12, 12+len(we.Signature))
+	binary.BigEndian.PutUint32(key, we.Body.CreatorID)
+	binary.BigEndian.PutUint64(key[4:], uint64(we.Body.Index))
+	return append(key, we.Signature...)
+}
+
+// positions returns the two hashes from which the bit positions of key are
+// derived, h1 + i*h2
+func positions(key []byte) (uint64, uint64) {
+	h := fnv.New128a()
+	h.Write(key)
+	sum := h.Sum(nil)
+	return binary.BigEndian.Uint64(sum[:8]), binary.BigEndian.Uint64(sum[8:]) | 1
+}
+
+// Add records a WireEvent as seen
+func (f *SeenFilter) Add(we *types.WireEvent) {
+	if f.count >= f.capacity {
+		f.previous, f.current = f.current, f.previous
+		for i := range f.current {
+			f.current[i] = 0
+		}
+		f.count = 0
+	}
+
+	h1, h2 := positions(seenKey(we))
+	for i := 0; i < f.hashes; i++ {
+		p := (h1 + uint64(i)*h2) % f.bits
+		f.current[p/64] |= 1 << (p % 64)
+	}
+	f.count++
+}
+
+// Test reports whether a WireEvent was probably seen
+func (f *SeenFilter) Test(we *types.WireEvent) bool {
+	h1, h2 := positions(seenKey(we))
+	return f.test(f.current, h1, h2) || f.test(f.previous, h1, h2)
+}
+
+func (f *SeenFilter) test(g []uint64, h1, h2 uint64) bool {
+	for i := 0; i < f.hashes; i++ {
+		p := (h1 + uint64(i)*h2) % f.bits
+		if g[p/64]&(1<<(p%64)) == 0 {
+			return false
+		}
+	}
+	return true
+}
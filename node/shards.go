@@ -0,0 +1,449 @@
+package node
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/bolaxy/config"
+	"github.com/bolaxy/core/erasure"
+	"github.com/bolaxy/core/logger"
+	"github.com/bolaxy/core/transport"
+	"github.com/bolaxy/core/types"
+)
+
+// ErasureConfig enables the erasure-coded broadcast of our Events with large
+// payloads. Their transactions are split in DataShards+ParityShards shards,
+// handed round-robin to the other peers, and the Events are gossiped without
+// them. A peer which receives such an Event reassembles the transactions
+// from any DataShards shards, fetched from the peers which hold them, so that
+// the creator uploads the payload about once instead of once per peer.
+type ErasureConfig struct {
+	// MinPayload is the size of the transactions of an Event from which
+	// they are erasure-coded. 0 disables the coding of our Events; the coded
+	// Events of the other peers are reassembled regardless.
+	MinPayload   int
+	DataShards   int
+	ParityShards int
+	// CacheSize is the number of payloads whose shards are kept, to be
+	// served to the peers
+	CacheSize int
+}
+
+// DefaultErasureConfig ...
+func DefaultErasureConfig() ErasureConfig {
+	return ErasureConfig{
+		DataShards:   4,
+		ParityShards: 2,
+		CacheSize:    1000,
+	}
+}
+
+// Validate ...
+func (c ErasureConfig) Validate() error {
+	if c.MinPayload < 0 {
+		return fmt.Errorf("MinPayload must not be negative, got %d", c.MinPayload)
+	}
+	if c.CacheSize <= 0 {
+		return fmt.Errorf("CacheSize must be positive, got %d", c.CacheSize)
+	}
+	if c.MinPayload == 0 {
+		return nil
+	}
+	if _, err := erasure.New(c.DataShards, c.ParityShards); err != nil {
+		return err
+	}
+	return nil
+}
+
+// codedEntry holds the shards of a CodedPayload known to us
+type codedEntry struct {
+	coded     types.CodedPayload
+	shards    [][]byte //nil for the missing ones
+	held      int
+	signature string //of the Event, once bound
+}
+
+// shardCache keeps the shards of the most recent CodedPayloads, and the
+// Events whose payload they are. It is safe for concurrent use.
+type shardCache struct {
+	lock    sync.Mutex
+	max     int
+	entries map[string]*codedEntry // [payload key]
+	order   []string               //oldest first
+	events  map[string]string      // [Event signature] => payload key
+}
+
+func newShardCache(max int) *shardCache {
+	return &shardCache{
+		max:     max,
+		entries: make(map[string]*codedEntry),
+		events:  make(map[string]string),
+	}
+}
+
+// entry returns the entry of coded, created if necessary. It must be called
+// with the lock.
+func (c *shardCache) entry(coded types.CodedPayload) *codedEntry {
+	key := coded.Key()
+	if e, ok := c.entries[key]; ok {
+		return e
+	}
+
+	e := &codedEntry{
+		coded:  coded,
+		shards: make([][]byte, len(coded.Shards)),
+	}
+	c.entries[key] = e
+	c.order = append(c.order, key)
+
+	for len(c.order) > c.max {
+		old := c.entries[c.order[0]]
+		delete(c.entries, c.order[0])
+		delete(c.events, old.signature)
+		c.order = c.order[1:]
+	}
+
+	return e
+}
+
+// add stores the shards which match the CodedPayload of the same key as
+// coded, and returns their number
+func (c *shardCache) add(coded types.CodedPayload, indexes []int, shards [][]byte) int {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	e := c.entry(coded)
+	stored := 0
+	for k, i := range indexes {
+		if k >= len(shards) || !e.coded.CheckShard(i, shards[k]) {
+			continue
+		}
+		if e.shards[i] == nil {
+			e.shards[i] = shards[k]
+			e.held++
+		}
+		stored++
+	}
+	return stored
+}
+
+// bind records that coded is the payload of the Event of the given signature
+func (c *shardCache) bind(signature string, coded types.CodedPayload) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	e := c.entry(coded)
+	e.signature = signature
+	c.events[signature] = coded.Key()
+}
+
+// coded returns the CodedPayload of the Event of the given signature, or nil
+func (c *shardCache) coded(signature string) *types.CodedPayload {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	e, ok := c.entries[c.events[signature]]
+	if !ok {
+		return nil
+	}
+	coded := e.coded
+	return &coded
+}
+
+// get returns the shards among indexes which are held for the payload of the
+// given key
+func (c *shardCache) get(key string, indexes []int) ([]int, [][]byte) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	resIndexes, resShards := []int{}, [][]byte{}
+	e, ok := c.entries[key]
+	if !ok {
+		return resIndexes, resShards
+	}
+
+	for _, i := range indexes {
+		if i >= 0 && i < len(e.shards) && e.shards[i] != nil {
+			resIndexes = append(resIndexes, i)
+			resShards = append(resShards, e.shards[i])
+		}
+	}
+	return resIndexes, resShards
+}
+
+// missing returns the number of shards held for coded, and the indexes of
+// the missing ones
+func (c *shardCache) missing(coded types.CodedPayload) (int, []int) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	e := c.entry(coded)
+	res := []int{}
+	for i, s := range e.shards {
+		if s == nil {
+			res = append(res, i)
+		}
+	}
+	return e.held, res
+}
+
+// shards returns a copy of the shards held for coded, nil for the missing
+// ones
+func (c *shardCache) shards(coded types.CodedPayload) [][]byte {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	return append([][]byte{}, c.entry(coded).shards...)
+}
+
+// shardHolder returns the peer which the creator of an Event hands the shard
+// of the given index: the other peers of the PeerSet take the shards in
+// turn. It returns nil if the creator is alone.
+func shardHolder(peers *conf.PeerSet, creator uint32, index int) *conf.Peer {
+	others := make([]*conf.Peer, 0, len(peers.Peers))
+	for _, p := range peers.Peers {
+		if p.ID() != creator {
+			others = append(others, p)
+		}
+	}
+	if len(others) == 0 {
+		return nil
+	}
+	return others[index%len(others)]
+}
+
+// disperse erasure-codes the transactions of an Event we created, if they
+// are large enough, and hands the shards to their holders in the background.
+// It must be called with the lock.
+func (n *Node) disperse(ev *types.Event) {
+	if n.code == nil || ev.PayloadSize() < n.config.Erasure.MinPayload {
+		return
+	}
+
+	coded, shards, err := types.NewCodedPayload(ev.Body.Transactions, n.code)
+	if err != nil {
+		n.logger.Error("coding event payload", logger.Err, err)
+		return
+	}
+
+	all := make([]int, len(shards))
+	for i := range all {
+		all[i] = i
+	}
+	n.shards.add(*coded, all, shards)
+	n.shards.bind(ev.Signature, *coded)
+
+	holders := make(map[*conf.Peer][]int)
+	for i := range shards {
+		if h := shardHolder(n.peerSet, n.self.ID(), i); h != nil {
+			holders[h] = append(holders[h], i)
+		}
+	}
+
+	n.wg.Add(1)
+	go func() {
+		defer n.wg.Done()
+		for peer, indexes := range holders {
+			if err := n.pushShards(peer, *coded, shards, indexes); err != nil {
+				n.logger.Debug("shards not pushed",
+					"peer", peer.ID(),
+					logger.Err, err)
+			}
+		}
+	}()
+}
+
+func (n *Node) pushShards(peer *conf.Peer, coded types.CodedPayload, shards [][]byte, indexes []int) error {
+	req := &transport.PushShardsRequest{
+		FromID:  n.self.ID(),
+		Coded:   coded,
+		Indexes: indexes,
+		Shards:  make([][]byte, len(indexes)),
+	}
+	for k, i := range indexes {
+		req.Shards[k] = shards[i]
+	}
+	if err := transport.SealWith(req, n.signer); err != nil {
+		return err
+	}
+
+	var resp transport.PushShardsResponse
+	return n.trans.PushShards(n.ctx, n.target(peer), req, &resp)
+}
+
+// reassembleEvents replaces the erasure-coded Events of a SyncResponse of
+// peer by the Events with their transactions. The Events which were already
+// inserted are left to insertEvents, and the ones which could not be
+// reassembled are dropped, to be gossiped again.
+func (n *Node) reassembleEvents(peer *conf.Peer, wevents []types.WireEvent) []types.WireEvent {
+	n.lock.Lock()
+	peers := n.peerSet
+	coded := make([]bool, len(wevents))
+	found := false
+	for i := range wevents {
+		if wevents[i].Body.Coded == nil {
+			continue
+		}
+		if n.seen != nil && n.seen.Test(&wevents[i]) {
+			continue
+		}
+		coded[i] = true
+		found = true
+	}
+	n.lock.Unlock()
+
+	if !found {
+		return wevents
+	}
+
+	res := make([]types.WireEvent, 0, len(wevents))
+	for i, we := range wevents {
+		if !coded[i] {
+			res = append(res, we)
+			continue
+		}
+
+		full, err := n.reassemble(peer, peers, we)
+		if err != nil {
+			n.logger.Debug("event payload not reassembled",
+				"peer", peer.ID(),
+				"creator", we.Body.CreatorID,
+				"index", we.Body.Index,
+				logger.Err, err)
+			continue
+		}
+		res = append(res, full)
+	}
+
+	return res
+}
+
+// reassemble fetches the missing shards of the payload of a coded Event sent
+// by peer, from their holders first, then from peer, and last from the
+// creator of the Event. The shards are only checked against the
+// CodedPayload; the signature of the Event vouches for the transactions once
+// it is inserted.
+func (n *Node) reassemble(peer *conf.Peer, peers *conf.PeerSet, we types.WireEvent) (types.WireEvent, error) {
+	coded := *we.Body.Coded
+	code, err := coded.Code()
+	if err != nil {
+		return we, err
+	}
+
+	held, missing := n.shards.missing(coded)
+
+	//as many holders as there are shards to fetch
+	if needed := code.DataShards - held; needed > 0 {
+		holders := make(map[*conf.Peer][]int)
+		for _, i := range missing {
+			h := shardHolder(peers, we.Body.CreatorID, i)
+			if h == nil || h.ID() == n.self.ID() {
+				continue
+			}
+			holders[h] = append(holders[h], i)
+			if needed--; needed == 0 {
+				break
+			}
+		}
+		n.fetchShardsFrom(holders, coded)
+	}
+
+	fallbacks := []*conf.Peer{peer}
+	if creator, ok := peers.ByID[we.Body.CreatorID]; ok && creator.ID() != peer.ID() {
+		fallbacks = append(fallbacks, creator)
+	}
+	for _, p := range fallbacks {
+		held, missing = n.shards.missing(coded)
+		if held >= code.DataShards {
+			break
+		}
+		n.fetchShardsFrom(map[*conf.Peer][]int{p: missing}, coded)
+	}
+
+	txs, err := coded.Reassemble(n.shards.shards(coded))
+	if err != nil {
+		return we, err
+	}
+
+	//all the shards, to serve the peers which ask us
+	if _, shards, err := types.NewCodedPayload(txs, code); err == nil {
+		all := make([]int, len(shards))
+		for i := range all {
+			all[i] = i
+		}
+		n.shards.add(coded, all, shards)
+	}
+	n.shards.bind(we.Signature, coded)
+
+	return we.Reassembled(txs), nil
+}
+
+// fetchShardsFrom requests shards from peers in parallel, and stores the
+// valid ones. The peers which send invalid shards are penalised.
+func (n *Node) fetchShardsFrom(requests map[*conf.Peer][]int, coded types.CodedPayload) {
+	var wg sync.WaitGroup
+	for peer, indexes := range requests {
+		if len(indexes) == 0 {
+			continue
+		}
+
+		wg.Add(1)
+		go func(peer *conf.Peer, indexes []int) {
+			defer wg.Done()
+			if err := n.fetchShards(peer, coded, indexes); err != nil {
+				n.logger.Debug("shards not fetched",
+					"peer", peer.ID(),
+					logger.Err, err)
+			}
+		}(peer, indexes)
+	}
+	wg.Wait()
+}
+
+func (n *Node) fetchShards(peer *conf.Peer, coded types.CodedPayload, indexes []int) error {
+	req := &transport.FetchShardsRequest{
+		FromID:  n.self.ID(),
+		Hash:    coded.Hash,
+		Indexes: indexes,
+	}
+	if err := transport.SealWith(req, n.signer); err != nil {
+		return err
+	}
+
+	var resp transport.FetchShardsResponse
+	if err := n.trans.FetchShards(n.ctx, n.target(peer), req, &resp); err != nil {
+		return err
+	}
+
+	if resp.FromID != peer.ID() {
+		return fmt.Errorf("shards response from %d instead of %d", resp.FromID, peer.ID())
+	}
+	if err := n.verifier.Verify(&resp, peer.PubKeyBytes()); err != nil {
+		return err
+	}
+
+	if stored := n.shards.add(coded, resp.Indexes, resp.Shards); stored < len(resp.Indexes) {
+		n.penalize(peer, transport.PenaltyInvalidEvent, "invalid shards")
+		return fmt.Errorf("%d invalid shards", len(resp.Indexes)-stored)
+	}
+
+	return nil
+}
+
+// processPushShards stores the shards handed by the creator of an Event
+func (n *Node) processPushShards(req *transport.PushShardsRequest) *transport.PushShardsResponse {
+	return &transport.PushShardsResponse{
+		FromID: n.self.ID(),
+		Stored: n.shards.add(req.Coded, req.Indexes, req.Shards),
+	}
+}
+
+// processFetchShardsRequest returns the requested shards which we hold
+func (n *Node) processFetchShardsRequest(req *transport.FetchShardsRequest) *transport.FetchShardsResponse {
+	indexes, shards := n.shards.get(string(req.Hash), req.Indexes)
+	return &transport.FetchShardsResponse{
+		FromID:  n.self.ID(),
+		Indexes: indexes,
+		Shards:  shards,
+	}
+}
@@ -0,0 +1,93 @@
+package node
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/bolaxy/core/db"
+	"github.com/bolaxy/core/signer"
+	"github.com/bolaxy/core/types"
+)
+
+const signGuardPrefix = "signguard"
+
+// ErrDoubleSign is returned by SignGuard.Sign for a Block whose index was
+// already signed with a different body
+var ErrDoubleSign = errors.New("block index already signed with a different body")
+
+// SignGuard prevents a validator from signing two different Blocks with the
+// same index. The hash of the body of every Block is recorded before the
+// Block is signed, and a Block whose index was recorded with another hash is
+// refused. With a Sinker, the records survive restarts, so that a node whose
+// state is restored from an old backup does not sign the Blocks it produces
+// again differently. It is safe for concurrent use.
+type SignGuard struct {
+	db db.Sinker
+
+	lock   sync.Mutex
+	signed map[int][]byte //used without a Sinker
+}
+
+// NewSignGuard records the signed Blocks in sinker. A nil sinker keeps the
+// records in memory, which only protects the running process.
+func NewSignGuard(sinker db.Sinker) *SignGuard {
+	return &SignGuard{
+		db:     sinker,
+		signed: make(map[int][]byte),
+	}
+}
+
+func signGuardKey(index int) []byte {
+	return []byte(fmt.Sprintf("%s_%010d", signGuardPrefix, index))
+}
+
+// Sign records the body hash of block, then signs it with s, unless its index
+// was recorded with another hash. Signing the same Block again is allowed.
+func (g *SignGuard) Sign(ctx context.Context, block *types.Block, s signer.Signer) (types.BlockSignature, error) {
+	hash, err := block.Body.Hash()
+	if err != nil {
+		return types.BlockSignature{}, err
+	}
+
+	if err := g.record(ctx, block.Index(), hash); err != nil {
+		return types.BlockSignature{}, err
+	}
+
+	return block.SignWith(s)
+}
+
+// record persists the hash of the body of the Block of index, or returns
+// ErrDoubleSign if another one is recorded
+func (g *SignGuard) record(ctx context.Context, index int, hash []byte) error {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+
+	if g.db == nil {
+		if prev, ok := g.signed[index]; ok {
+			if !bytes.Equal(prev, hash) {
+				return ErrDoubleSign
+			}
+			return nil
+		}
+		g.signed[index] = hash
+		return nil
+	}
+
+	key := signGuardKey(index)
+
+	prev, err := g.db.Get(ctx, key)
+	switch {
+	case err == nil:
+		if !bytes.Equal(prev, hash) {
+			return ErrDoubleSign
+		}
+		return nil
+	case err != db.ErrKeyNotFound:
+		return err
+	}
+
+	return g.db.Put(ctx, key, hash)
+}
@@ -0,0 +1,167 @@
+package node
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/bolaxy/config"
+	"github.com/bolaxy/core/logger"
+	"github.com/bolaxy/core/reputation"
+	"github.com/bolaxy/core/transport"
+	"github.com/bolaxy/core/types"
+	"github.com/bolaxy/crypto"
+)
+
+// maxSignatureBlocks bounds the number of Blocks whose signatures are served
+// by a SignaturesResponse
+const maxSignatureBlocks = 100
+
+// initSignatureWatch starts watching the finality of the last Blocks of the
+// Store, which may lack signatures after a bootstrap. It must be called with
+// the lock.
+func (n *Node) initSignatureWatch() {
+	n.sigWatch = n.hg.Store.LastBlockIndex() - maxSignatureBlocks + 1
+	if n.sigWatch < 0 {
+		n.sigWatch = 0
+	}
+	n.sigSince = time.Now()
+}
+
+// signaturesDue returns the index of the oldest Block which has not been
+// final for SignatureFallback, or -1, in which case the signatures gossiped
+// on Events are enough. The Blocks which are not in the Store are skipped. It
+// must be called with the lock.
+func (n *Node) signaturesDue(now time.Time) int {
+	if n.config.SignatureFallback == 0 {
+		return -1
+	}
+
+	last := n.hg.Store.LastBlockIndex()
+
+	index := n.sigWatch
+	for ; index <= last; index++ {
+		block, err := n.hg.Store.GetBlock(index)
+		if err != nil {
+			continue
+		}
+
+		peerSet, err := n.hg.Store.GetPeerSet(block.RoundReceived())
+		if err != nil || !block.IsFinal(peerSet) {
+			break
+		}
+	}
+
+	if index != n.sigWatch || index > last {
+		n.sigWatch = index
+		n.sigSince = now
+		return -1
+	}
+
+	if now.Sub(n.sigSince) < n.config.SignatureFallback {
+		return -1
+	}
+
+	n.sigSince = now
+	return index
+}
+
+// fetchSignatures requests the signatures of the Blocks from fromIndex from
+// peer, and adds the ones of our non-final Blocks to the signature pool
+func (n *Node) fetchSignatures(peer *conf.Peer, fromIndex int) error {
+	req := &transport.SignaturesRequest{
+		FromID:    n.self.ID(),
+		FromIndex: fromIndex,
+	}
+	if err := transport.SealWith(req, n.signer); err != nil {
+		return err
+	}
+
+	var resp transport.SignaturesResponse
+	if err := n.trans.Signatures(n.ctx, n.target(peer), req, &resp); err != nil {
+		return err
+	}
+
+	if resp.FromID != peer.ID() {
+		return fmt.Errorf("signatures response from %d instead of %d", resp.FromID, peer.ID())
+	}
+	if err := n.verifier.Verify(&resp, peer.PubKeyBytes()); err != nil {
+		if err == transport.ErrBadSignature {
+			n.report(peer.ID(), reputation.InvalidSignature)
+			n.penalize(peer, transport.PenaltyInvalidEvent, "invalid signatures response signature")
+		}
+		return err
+	}
+
+	n.lock.Lock()
+	defer n.lock.Unlock()
+
+	//signatures of unknown Blocks would stay in the pool
+	last := n.hg.Store.LastBlockIndex()
+	added := 0
+	for _, bs := range resp.Signatures {
+		if bs.Index < fromIndex || bs.Index > last || n.hg.BlockFinal(bs.Index) {
+			continue
+		}
+		n.hg.PendingSignatures.Add(bs)
+		added++
+	}
+
+	n.logger.Debug("signatures fetched",
+		"peer", peer.ID(),
+		logger.Block, fromIndex,
+		"signatures", len(resp.Signatures),
+		"added", added)
+
+	if added == 0 {
+		return nil
+	}
+
+	return n.hg.ProcessSigPool(n.ctx)
+}
+
+// processSignaturesRequest returns the signatures of at most
+// maxSignatureBlocks Blocks from the requested index: the ones set on the
+// Blocks, and the ones not gossiped or processed yet, among which ours. It
+// must be called with the lock.
+func (n *Node) processSignaturesRequest(req *transport.SignaturesRequest) (*transport.SignaturesResponse, error) {
+	from := req.FromIndex
+	if from < 0 {
+		from = 0
+	}
+
+	resp := &transport.SignaturesResponse{
+		FromID:     n.self.ID(),
+		Signatures: []types.BlockSignature{},
+	}
+
+	to := n.hg.Store.LastBlockIndex()
+	if to >= from+maxSignatureBlocks {
+		to = from + maxSignatureBlocks - 1
+	}
+
+	for i := from; i <= to; i++ {
+		block, err := n.hg.Store.GetBlock(i)
+		if err != nil {
+			continue
+		}
+		for _, bs := range block.GetSignatures() {
+			//the Blocks hold the compressed keys, the Events the full ones
+			key, err := crypto.DecompressPubkey(bs.Validator)
+			if err != nil {
+				continue
+			}
+			bs.Validator = crypto.FromECDSAPub(key)
+			resp.Signatures = append(resp.Signatures, bs)
+		}
+	}
+
+	for _, bs := range n.hg.PendingSignatures.Slice() {
+		if bs.Index >= from && bs.Index <= to {
+			resp.Signatures = append(resp.Signatures, bs)
+		}
+	}
+
+	resp.Signatures = append(resp.Signatures, n.pool.BlockSignatures(from, to)...)
+
+	return resp, nil
+}
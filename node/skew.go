@@ -0,0 +1,160 @@
+package node
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/bolaxy/core/metrics"
+	"github.com/bolaxy/core/transport"
+)
+
+// DefaultClockSkewWarning is the default ClockSkewWarning of a Config
+const DefaultClockSkewWarning = 5 * time.Second
+
+// skewSmoothing is the weight of a new sample in the estimated skew of a peer
+const skewSmoothing = 0.2
+
+// PeerSkew estimates the offset of the clock of a peer from ours, positive if
+// it is ahead. Events carry no creation time, so the samples are the signed
+// timestamps of the SyncResponses of the peer, against the middle of the
+// round-trip of the request.
+type PeerSkew struct {
+	Offset     time.Duration
+	Samples    int
+	LastSample time.Time
+	Exceeded   bool // whether |Offset| is beyond the ClockSkewWarning
+}
+
+// skewTracker holds the PeerSkews of the peers we sync with
+type skewTracker struct {
+	lock  sync.Mutex
+	peers map[uint32]*PeerSkew
+}
+
+func newSkewTracker() *skewTracker {
+	return &skewTracker{
+		peers: make(map[uint32]*PeerSkew),
+	}
+}
+
+// observe adds a sample to the skew of peer, and returns the skew and
+// whether it just went beyond bound, or back within it
+func (t *skewTracker) observe(peer uint32, sample time.Duration, bound time.Duration) (PeerSkew, bool) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	s, ok := t.peers[peer]
+	if !ok {
+		s = &PeerSkew{Offset: sample}
+		t.peers[peer] = s
+	} else {
+		s.Offset += time.Duration(skewSmoothing * float64(sample-s.Offset))
+	}
+	s.Samples++
+	s.LastSample = time.Now()
+
+	offset := s.Offset
+	if offset < 0 {
+		offset = -offset
+	}
+	exceeded := bound > 0 && offset > bound
+	changed := exceeded != s.Exceeded
+	s.Exceeded = exceeded
+
+	return *s, changed
+}
+
+// all returns a copy of the skews
+func (t *skewTracker) all() map[uint32]PeerSkew {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	res := make(map[uint32]PeerSkew, len(t.peers))
+	for id, s := range t.peers {
+		res[id] = *s
+	}
+	return res
+}
+
+// retain drops the skews of the peers for which keep returns false
+func (t *skewTracker) retain(keep func(peer uint32) bool) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	for id := range t.peers {
+		if !keep(id) {
+			delete(t.peers, id)
+		}
+	}
+}
+
+/*******************************************************************************
+Node
+*******************************************************************************/
+
+// ClockSkew returns the estimated offsets of the clocks of the peers we sync
+// with, by ID
+func (n *Node) ClockSkew() map[uint32]PeerSkew {
+	return n.skew.all()
+}
+
+// RegisterMetrics registers in reg the estimated clock offset of each peer,
+// and the bytes exchanged with it, labelled by peer ID
+func (n *Node) RegisterMetrics(reg *metrics.Registry) {
+	reg.MustRegister(&skewMetric{n.skew})
+	n.bandwidth.Register(reg)
+}
+
+// observeSkew samples the clock of peer from the signed timestamp of its
+// SyncResponse, received between sent and received, and warns when the
+// estimate crosses the ClockSkewWarning
+func (n *Node) observeSkew(peer uint32, resp *transport.SyncResponse, sent, received time.Time) {
+	mid := sent.Add(received.Sub(sent) / 2)
+	sample := time.Unix(0, resp.Timestamp).Sub(mid)
+
+	s, changed := n.skew.observe(peer, sample, n.config.ClockSkewWarning)
+	if !changed {
+		return
+	}
+
+	if s.Exceeded {
+		n.logger.Warn("peer clock skewed",
+			"peer", peer,
+			"offset", s.Offset,
+			"bound", n.config.ClockSkewWarning)
+	} else {
+		n.logger.Info("peer clock back within bound",
+			"peer", peer,
+			"offset", s.Offset)
+	}
+}
+
+// skewMetric is a Collector of the clock offsets of the peers
+type skewMetric struct {
+	t *skewTracker
+}
+
+func (m *skewMetric) Name() string { return "core_peer_clock_skew_seconds" }
+
+func (m *skewMetric) Help() string {
+	return "Estimated offset of the clock of a peer from ours, positive if it is ahead."
+}
+
+func (m *skewMetric) Type() string { return "gauge" }
+
+func (m *skewMetric) Write(buf *bytes.Buffer) {
+	skews := m.t.all()
+
+	ids := make([]uint32, 0, len(skews))
+	for id := range skews {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+
+	for _, id := range ids {
+		fmt.Fprintf(buf, "%s{peer=\"%d\"} %g\n", m.Name(), id, skews[id].Offset.Seconds())
+	}
+}
@@ -0,0 +1,377 @@
+package node
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/bolaxy/core/db"
+	"github.com/bolaxy/core/logger"
+	"github.com/bolaxy/core/store"
+	"github.com/bolaxy/core/transport"
+	"github.com/bolaxy/crypto"
+)
+
+const (
+	// DefaultSnapshotChunkSize is the default size of the chunks of the
+	// application snapshots
+	DefaultSnapshotChunkSize = 1 << 20
+
+	// maxServedSnapshots is the number of chunked snapshots whose chunks are
+	// served
+	maxServedSnapshots = 2
+	// chunkAttempts is the number of requests for a chunk, a retry wait
+	// apart, before a download fails
+	chunkAttempts = 3
+
+	snapshotChunkPrefix = "snapchunk"
+)
+
+// AppProxy is the part of the contract of the application, beside the
+// CommitCallback, which lets the nodes joining the network recover the
+// application state along with the consensus state
+type AppProxy interface {
+	// GetSnapshot returns the state of the application after the Block
+	// blockIndex, which is the last Block it committed. It is called with the
+	// lock of the Node, so no Block is committed meanwhile.
+	GetSnapshot(blockIndex int) ([]byte, error)
+	// RestoreSnapshot replaces the state of the application by a snapshot
+	// returned by the GetSnapshot of a peer. The Blocks after the snapshot
+	// are committed next.
+	RestoreSnapshot(snapshot []byte) error
+}
+
+// snapshotRef returns the reference of a snapshot taken after a Block
+func snapshotRef(blockIndex int, snapshot []byte) *store.SnapshotRef {
+	return &store.SnapshotRef{
+		BlockIndex: blockIndex,
+		Hash:       crypto.Keccak256(snapshot),
+	}
+}
+
+// NewSnapshotManifest splits a snapshot taken after a Block in chunks of
+// chunkSize bytes, and returns its SnapshotManifest
+func NewSnapshotManifest(blockIndex int, snapshot []byte, chunkSize int) *transport.SnapshotManifest {
+	m := &transport.SnapshotManifest{
+		BlockIndex: blockIndex,
+		Size:       len(snapshot),
+		ChunkSize:  chunkSize,
+		Hash:       crypto.Keccak256(snapshot),
+	}
+
+	for start := 0; start < len(snapshot); start += chunkSize {
+		m.Chunks = append(m.Chunks, crypto.Keccak256(snapshot[start:chunkEnd(m, start)]))
+	}
+
+	return m
+}
+
+func chunkEnd(m *transport.SnapshotManifest, start int) int {
+	end := start + m.ChunkSize
+	if end > m.Size {
+		end = m.Size
+	}
+	return end
+}
+
+// checkManifest checks that the chunks of a SnapshotManifest cover its size
+func checkManifest(m *transport.SnapshotManifest) error {
+	if m.Size <= 0 || m.ChunkSize <= 0 {
+		return fmt.Errorf("manifest of %d bytes in chunks of %d", m.Size, m.ChunkSize)
+	}
+	if count := (m.Size + m.ChunkSize - 1) / m.ChunkSize; len(m.Chunks) != count {
+		return fmt.Errorf("manifest of %d bytes with %d chunks, %d expected", m.Size, len(m.Chunks), count)
+	}
+	return nil
+}
+
+/*******************************************************************************
+Serving
+*******************************************************************************/
+
+// servedSnapshot is a chunked snapshot whose chunks are served
+type servedSnapshot struct {
+	manifest *transport.SnapshotManifest
+	data     []byte
+}
+
+// addSnapshot adds the application snapshot of the Block of a FastForward
+// response, inline if it fits in one chunk, and otherwise as a Manifest whose
+// chunks are kept to be served. A chunked snapshot of a Block is only taken
+// once.
+func (j *JoinHandler) addSnapshot(resp *transport.FastForwardResponse) error {
+	index := resp.Block.Index()
+
+	for _, s := range j.served {
+		if s.manifest.BlockIndex == index {
+			resp.Manifest = s.manifest
+			return nil
+		}
+	}
+
+	snapshot, err := j.app.GetSnapshot(index)
+	if err != nil {
+		return fmt.Errorf("application snapshot of block %d: %v", index, err)
+	}
+
+	j.hg.SetSnapshot(snapshotRef(index, snapshot))
+
+	if len(snapshot) <= j.chunkSize {
+		resp.Snapshot = snapshot
+		return nil
+	}
+
+	m := NewSnapshotManifest(index, snapshot, j.chunkSize)
+	if len(j.served) >= maxServedSnapshots {
+		j.served = j.served[1:]
+	}
+	j.served = append(j.served, &servedSnapshot{manifest: m, data: snapshot})
+	resp.Manifest = m
+
+	j.logger.Debug("application snapshot served in chunks",
+		logger.Block, index,
+		"size", len(snapshot),
+		"chunks", len(m.Chunks))
+
+	return nil
+}
+
+// SnapshotChunk returns a chunk of an application snapshot served by
+// FastForward, in a signed response
+func (j *JoinHandler) SnapshotChunk(req *transport.SnapshotChunkRequest) (*transport.SnapshotChunkResponse, error) {
+	var served *servedSnapshot
+	for _, s := range j.served {
+		if s.manifest.BlockIndex == req.BlockIndex {
+			served = s
+		}
+	}
+	if served == nil {
+		return nil, fmt.Errorf("no snapshot of block %d served", req.BlockIndex)
+	}
+
+	m := served.manifest
+	if req.Index < 0 || req.Index >= len(m.Chunks) {
+		return nil, fmt.Errorf("chunk %d of a snapshot of %d chunks", req.Index, len(m.Chunks))
+	}
+
+	start := req.Index * m.ChunkSize
+	resp := &transport.SnapshotChunkResponse{
+		FromID:     j.selfID,
+		BlockIndex: req.BlockIndex,
+		Index:      req.Index,
+		Data:       served.data[start:chunkEnd(m, start)],
+	}
+
+	if err := transport.SealWith(resp, j.signer); err != nil {
+		return nil, err
+	}
+
+	return resp, nil
+}
+
+/*******************************************************************************
+Fetching
+*******************************************************************************/
+
+// newChunkStore keeps the chunks in a BlobStore, under a prefix of chunks
+// which can be the db of the node. The chunks are addressed by the hashes of
+// the SnapshotManifest, and the identical chunks of a snapshot are stored
+// once.
+func newChunkStore(chunks db.Sinker) *db.BlobStore {
+	return db.NewBlobStore(db.NewPartition(chunks, snapshotChunkPrefix+"_"))
+}
+
+// readChunk returns a chunk which was fetched before, or nil
+func (j *Joiner) readChunk(ctx context.Context, m *transport.SnapshotManifest, index int) ([]byte, error) {
+	data, err := j.chunks.Get(ctx, m.Chunks[index])
+	switch err {
+	case nil:
+		return data, nil
+	case db.ErrKeyNotFound:
+		return nil, nil
+	case db.ErrBlobCorrupted:
+		//a corrupted chunk is fetched again
+		return nil, j.chunks.Delete(ctx, m.Chunks[index])
+	default:
+		return nil, err
+	}
+}
+
+// fetchSnapshot downloads the chunks of a snapshot from target, except the
+// ones fetched by a previous attempt, and returns the snapshot. The chunks
+// are checked against the SnapshotManifest, whose Envelope was verified, so
+// the chunk responses need not be. The chunks are deleted once the snapshot
+// is complete, and the chunks of other snapshots when the download starts.
+func (j *Joiner) fetchSnapshot(ctx context.Context, target string, m *transport.SnapshotManifest) ([]byte, error) {
+	if err := checkManifest(m); err != nil {
+		return nil, err
+	}
+
+	if err := j.dropChunks(ctx, m); err != nil {
+		return nil, err
+	}
+
+	missing := []int{}
+	for i := range m.Chunks {
+		data, err := j.readChunk(ctx, m, i)
+		if err != nil {
+			return nil, err
+		}
+		if data == nil {
+			missing = append(missing, i)
+		}
+	}
+
+	j.logger.Info("fetching application snapshot",
+		logger.Block, m.BlockIndex,
+		"size", m.Size,
+		"chunks", len(m.Chunks),
+		"missing", len(missing))
+
+	if err := j.fetchChunks(ctx, target, m, missing); err != nil {
+		return nil, err
+	}
+
+	snapshot := make([]byte, 0, m.Size)
+	for i := range m.Chunks {
+		data, err := j.readChunk(ctx, m, i)
+		if err != nil {
+			return nil, err
+		}
+		if data == nil {
+			return nil, fmt.Errorf("chunk %d of the snapshot of block %d lost", i, m.BlockIndex)
+		}
+		snapshot = append(snapshot, data...)
+	}
+
+	if !bytes.Equal(crypto.Keccak256(snapshot), m.Hash) {
+		return nil, fmt.Errorf("snapshot of block %d does not match its hash", m.BlockIndex)
+	}
+
+	for _, hash := range m.Chunks {
+		if err := j.chunks.Release(ctx, hash); err != nil {
+			return nil, err
+		}
+	}
+	if _, err := j.chunks.GC(ctx); err != nil {
+		return nil, err
+	}
+
+	return snapshot, nil
+}
+
+// dropChunks deletes the chunks of the snapshots other than m, whose
+// download was abandoned
+func (j *Joiner) dropChunks(ctx context.Context, m *transport.SnapshotManifest) error {
+	keep := make(map[string]bool, len(m.Chunks))
+	for _, hash := range m.Chunks {
+		keep[string(hash)] = true
+	}
+
+	stale := [][]byte{}
+	err := j.chunks.Each(ctx, func(hash []byte, refs int) error {
+		if !keep[string(hash)] {
+			stale = append(stale, hash)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, hash := range stale {
+		if err := j.chunks.Delete(ctx, hash); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// fetchChunks downloads chunks in parallel, with the workers of the Joiner,
+// and stores them as they arrive. It stops at the first chunk which could not
+// be fetched.
+func (j *Joiner) fetchChunks(ctx context.Context, target string, m *transport.SnapshotManifest, indexes []int) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	queue := make(chan int, len(indexes))
+	for _, i := range indexes {
+		queue <- i
+	}
+	close(queue)
+
+	var (
+		wg       sync.WaitGroup
+		errLock  sync.Mutex
+		firstErr error
+	)
+
+	for w := 0; w < j.workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			for i := range queue {
+				err := j.fetchChunk(ctx, target, m, i)
+				if err == nil {
+					continue
+				}
+
+				errLock.Lock()
+				if firstErr == nil {
+					firstErr = err
+				}
+				errLock.Unlock()
+
+				cancel()
+				return
+			}
+		}()
+	}
+
+	wg.Wait()
+
+	return firstErr
+}
+
+func (j *Joiner) fetchChunk(ctx context.Context, target string, m *transport.SnapshotManifest, index int) error {
+	var err error
+	for attempt := 0; attempt < chunkAttempts; attempt++ {
+		//a refusal by the rate limits of target is likely
+		if attempt > 0 {
+			select {
+			case <-time.After(j.retryWait):
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		}
+
+		req := &transport.SnapshotChunkRequest{
+			FromID:     j.self.ID(),
+			BlockIndex: m.BlockIndex,
+			Index:      index,
+		}
+		if err = transport.SealWith(req, j.signer); err != nil {
+			return err
+		}
+
+		var resp transport.SnapshotChunkResponse
+		if err = j.trans.SnapshotChunk(ctx, target, req, &resp); err != nil {
+			continue
+		}
+
+		if resp.BlockIndex != m.BlockIndex || resp.Index != index ||
+			!bytes.Equal(crypto.Keccak256(resp.Data), m.Chunks[index]) {
+			err = fmt.Errorf("invalid chunk")
+			continue
+		}
+
+		_, err = j.chunks.Put(ctx, resp.Data)
+		return err
+	}
+
+	return fmt.Errorf("chunk %d of the snapshot of block %d: %v", index, m.BlockIndex, err)
+}
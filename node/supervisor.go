@@ -0,0 +1,533 @@
+package node
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/bolaxy/core/anchor"
+	"github.com/bolaxy/core/logger"
+	"github.com/bolaxy/core/metrics"
+)
+
+// Engine is a running consensus instance of a Supervisor
+type Engine struct {
+	Node *Node
+	// Close releases the resources of the Node which Shutdown does not, like
+	// a db. It is called after the Node shut down, and may be nil.
+	Close func() error
+}
+
+// ChainSpec describes a chain run by a Supervisor
+type ChainSpec struct {
+	ChainID string
+	Config  Config
+	// New creates the Engine of the chain, with its Store and Transport, when
+	// the chain starts and on every restart. The Node must not be running.
+	// The Store of a restart must be a new one, on the same db, since
+	// Shutdown closed the previous one: the Config then has Bootstrap set.
+	New func(ctx context.Context, config Config) (*Engine, error)
+	// Check reports an unhealthy Node, which is restarted, in addition to
+	// the checks of the Supervisor. It may be nil.
+	Check func(*Node) error
+}
+
+// SupervisorConfig holds the tunables of a Supervisor
+type SupervisorConfig struct {
+	// HealthInterval is the time between two health checks of a chain
+	HealthInterval time.Duration
+	// StallTimeout is the time after which a Node suspended by itself, not
+	// by the application, is restarted
+	StallTimeout time.Duration
+	// ShutdownTimeout bounds the Shutdown of a Node
+	ShutdownTimeout time.Duration
+	// Backoff delays the restarts of a chain. A chain which failed
+	// MaxAttempts times in a row is left stopped. The delay is reset once a
+	// Node ran for Backoff.Max.
+	Backoff anchor.Backoff
+}
+
+// DefaultSupervisorConfig ...
+func DefaultSupervisorConfig() SupervisorConfig {
+	return SupervisorConfig{
+		HealthInterval:  time.Second,
+		StallTimeout:    time.Minute,
+		ShutdownTimeout: 10 * time.Second,
+		Backoff:         anchor.DefaultBackoff(),
+	}
+}
+
+// ChainState is the lifecycle state of a chain of a Supervisor
+type ChainState int
+
+const (
+	// ChainStarting chains are creating their Engine
+	ChainStarting ChainState = iota
+	// ChainRunning chains have a running Node
+	ChainRunning
+	// ChainRestarting chains wait for the backoff delay before a restart
+	ChainRestarting
+	// ChainStopped chains were stopped by Stop or Close
+	ChainStopped
+	// ChainFailed chains exhausted the attempts of the Backoff
+	ChainFailed
+)
+
+// String ...
+func (s ChainState) String() string {
+	switch s {
+	case ChainStarting:
+		return "Starting"
+	case ChainRunning:
+		return "Running"
+	case ChainRestarting:
+		return "Restarting"
+	case ChainStopped:
+		return "Stopped"
+	case ChainFailed:
+		return "Failed"
+	default:
+		return "Unknown"
+	}
+}
+
+// ChainHealth describes a chain of a Supervisor
+type ChainHealth struct {
+	ChainID        string
+	State          string
+	Node           string `json:",omitempty"` //State of the Node, when running
+	Since          time.Time
+	Restarts       int
+	LastError      string `json:",omitempty"`
+	LastBlockIndex int
+	LastRound      int
+}
+
+type supervised struct {
+	spec   ChainSpec
+	cancel context.CancelFunc
+	done   chan struct{}
+
+	//protected by the lock of the Supervisor
+	state    ChainState
+	since    time.Time
+	engine   *Engine
+	restarts int
+	lastErr  error
+}
+
+// Supervisor runs the consensus instances of several chains in one process,
+// like a main chain and its parachains. Each chain has its own Config, Node,
+// Store, and Transport, created by its ChainSpec. The Supervisor checks the
+// health of the Nodes, and restarts the ones which shut down or stalled, with
+// backoff. The state of the chains is aggregated in metrics labelled by
+// chain.
+type Supervisor struct {
+	config SupervisorConfig
+	logger logger.Logger
+
+	lock    sync.Mutex
+	chains  map[string]*supervised
+	started bool
+	closed  bool
+
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+}
+
+// NewSupervisor creates a Supervisor, whose chains are started by Start
+func NewSupervisor(config SupervisorConfig) *Supervisor {
+	ctx, cancel := context.WithCancel(context.Background())
+
+	return &Supervisor{
+		config: config,
+		logger: logger.Nop,
+		chains: make(map[string]*supervised),
+		ctx:    ctx,
+		cancel: cancel,
+	}
+}
+
+// SetLogger ...
+func (s *Supervisor) SetLogger(l logger.Logger) {
+	s.logger = logger.OrNop(l).With(logger.Component, "Supervisor")
+}
+
+// Add adds a chain, which is started right away if the Supervisor was
+// started. It fails if the Config of the chain does not Validate.
+func (s *Supervisor) Add(spec ChainSpec) error {
+	if spec.New == nil {
+		return fmt.Errorf("chain %q: no engine constructor", spec.ChainID)
+	}
+	if err := spec.Config.Validate(); err != nil {
+		return fmt.Errorf("chain %q: invalid config: %v", spec.ChainID, err)
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.closed {
+		return fmt.Errorf("supervisor closed")
+	}
+	if _, ok := s.chains[spec.ChainID]; ok {
+		return fmt.Errorf("chain %q already added", spec.ChainID)
+	}
+
+	c := &supervised{
+		spec:  spec,
+		state: ChainStarting,
+		since: time.Now(),
+	}
+	s.chains[spec.ChainID] = c
+
+	if s.started {
+		s.launch(c)
+	}
+
+	return nil
+}
+
+// Start starts all the chains
+func (s *Supervisor) Start() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.started || s.closed {
+		return
+	}
+	s.started = true
+
+	for _, c := range s.chains {
+		if c.state != ChainStopped {
+			s.launch(c)
+		}
+	}
+}
+
+// launch must be called with the lock
+func (s *Supervisor) launch(c *supervised) {
+	ctx, cancel := context.WithCancel(s.ctx)
+	c.cancel = cancel
+	c.done = make(chan struct{})
+
+	s.wg.Add(1)
+	go s.supervise(ctx, c)
+}
+
+// Stop shuts the Node of a chain down, and stops supervising it. The chain
+// can not be started again.
+func (s *Supervisor) Stop(chainID string) error {
+	s.lock.Lock()
+	c, ok := s.chains[chainID]
+	if !ok {
+		s.lock.Unlock()
+		return fmt.Errorf("unknown chain %q", chainID)
+	}
+	if c.cancel == nil {
+		//not launched yet
+		c.state = ChainStopped
+		c.since = time.Now()
+		s.lock.Unlock()
+		return nil
+	}
+	cancel, done := c.cancel, c.done
+	s.lock.Unlock()
+
+	cancel()
+	<-done
+
+	return nil
+}
+
+// Close shuts the Nodes of all the chains down
+func (s *Supervisor) Close() {
+	s.lock.Lock()
+	if s.closed {
+		s.lock.Unlock()
+		return
+	}
+	s.closed = true
+	s.lock.Unlock()
+
+	s.cancel()
+	s.wg.Wait()
+}
+
+// Node returns the Node of a chain, nil if it is not running
+func (s *Supervisor) Node(chainID string) *Node {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	c, ok := s.chains[chainID]
+	if !ok || c.engine == nil {
+		return nil
+	}
+	return c.engine.Node
+}
+
+// Health returns the ChainHealth of all the chains, sorted by ChainID
+func (s *Supervisor) Health() []ChainHealth {
+	s.lock.Lock()
+	ids := make([]string, 0, len(s.chains))
+	for id := range s.chains {
+		ids = append(ids, id)
+	}
+	s.lock.Unlock()
+
+	sort.Strings(ids)
+
+	res := make([]ChainHealth, 0, len(ids))
+	for _, id := range ids {
+		res = append(res, s.health(id))
+	}
+	return res
+}
+
+func (s *Supervisor) health(chainID string) ChainHealth {
+	s.lock.Lock()
+	c := s.chains[chainID]
+	h := ChainHealth{
+		ChainID:        chainID,
+		State:          c.state.String(),
+		Since:          c.since,
+		Restarts:       c.restarts,
+		LastBlockIndex: -1,
+		LastRound:      -1,
+	}
+	if c.lastErr != nil {
+		h.LastError = c.lastErr.Error()
+	}
+	engine := c.engine
+	s.lock.Unlock()
+
+	if engine != nil {
+		n := engine.Node
+		h.Node = n.State().String()
+
+		n.lock.Lock()
+		h.LastBlockIndex = n.hg.Store.LastBlockIndex()
+		h.LastRound = n.hg.Store.LastRound()
+		n.lock.Unlock()
+	}
+
+	return h
+}
+
+func (s *Supervisor) setState(c *supervised, state ChainState, err error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	c.state = state
+	c.since = time.Now()
+	if err != nil {
+		c.lastErr = err
+	}
+}
+
+// supervise runs the Engines of a chain until ctx is done, or the Backoff
+// gives up
+func (s *Supervisor) supervise(ctx context.Context, c *supervised) {
+	defer s.wg.Done()
+	defer close(c.done)
+
+	id := c.spec.ChainID
+	backoff := s.config.Backoff
+	delay := backoff.Initial
+	failures := 0
+
+	for restart := false; ; restart = true {
+		started := time.Now()
+		err := s.runEngine(ctx, c, restart)
+
+		if ctx.Err() != nil {
+			s.setState(c, ChainStopped, nil)
+			s.logger.Info("chain stopped", "chain", id)
+			return
+		}
+
+		if backoff.Max > 0 && time.Since(started) >= backoff.Max {
+			delay = backoff.Initial
+			failures = 0
+		}
+		failures++
+
+		if backoff.MaxAttempts > 0 && failures >= backoff.MaxAttempts {
+			s.setState(c, ChainFailed, err)
+			s.logger.Error("chain failed, giving up",
+				"chain", id,
+				"attempts", failures,
+				logger.Err, err)
+			return
+		}
+
+		s.setState(c, ChainRestarting, err)
+		s.logger.Warn("chain unhealthy, restarting",
+			"chain", id,
+			"delay", delay,
+			logger.Err, err)
+
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			s.setState(c, ChainStopped, nil)
+			return
+		}
+
+		delay *= 2
+		if backoff.Max > 0 && delay > backoff.Max {
+			delay = backoff.Max
+		}
+
+		s.lock.Lock()
+		c.restarts++
+		c.state = ChainStarting
+		c.since = time.Now()
+		s.lock.Unlock()
+	}
+}
+
+// runEngine creates and runs an Engine until it is unhealthy or ctx is done,
+// and then shuts it down. It returns why the Engine stopped.
+func (s *Supervisor) runEngine(ctx context.Context, c *supervised, restart bool) error {
+	config := c.spec.Config
+	if restart {
+		config.Bootstrap = true
+	}
+
+	engine, err := c.spec.New(ctx, config)
+	if err != nil {
+		return fmt.Errorf("creating engine: %v", err)
+	}
+
+	engine.Node.Run()
+
+	s.lock.Lock()
+	c.engine = engine
+	c.state = ChainRunning
+	c.since = time.Now()
+	s.lock.Unlock()
+
+	s.logger.Info("chain started", "chain", c.spec.ChainID, "bootstrap", config.Bootstrap)
+
+	err = s.watch(ctx, c, engine.Node)
+
+	s.lock.Lock()
+	c.engine = nil
+	c.state = ChainRestarting
+	if ctx.Err() != nil {
+		c.state = ChainStopped
+	}
+	c.since = time.Now()
+	s.lock.Unlock()
+
+	s.shutdown(c, engine)
+
+	return err
+}
+
+// watch checks the health of a Node until it is unhealthy or ctx is done
+func (s *Supervisor) watch(ctx context.Context, c *supervised, n *Node) error {
+	ticker := time.NewTicker(s.config.HealthInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+
+		if err := s.check(c, n); err != nil {
+			return err
+		}
+	}
+}
+
+func (s *Supervisor) check(c *supervised, n *Node) error {
+	status := n.Status()
+
+	switch n.State() {
+	case Shutdown:
+		return fmt.Errorf("node shut down")
+	case Suspended:
+		if status.Reason != appSuspension && time.Since(status.Since) >= s.config.StallTimeout {
+			return fmt.Errorf("node suspended for %v: %s", time.Since(status.Since).Round(time.Second), status.Reason)
+		}
+	}
+
+	if c.spec.Check != nil {
+		return c.spec.Check(n)
+	}
+
+	return nil
+}
+
+func (s *Supervisor) shutdown(c *supervised, engine *Engine) {
+	ctx, cancel := context.WithTimeout(context.Background(), s.config.ShutdownTimeout)
+	defer cancel()
+
+	_, err := engine.Node.Shutdown(ctx)
+	if err == ErrShutdown {
+		//closed by itself: the Store is still open
+		err = engine.Node.hg.Store.Close()
+	}
+	if err != nil {
+		s.logger.Warn("node shutdown", "chain", c.spec.ChainID, logger.Err, err)
+	}
+
+	if engine.Close != nil {
+		if err := engine.Close(); err != nil {
+			s.logger.Warn("engine close", "chain", c.spec.ChainID, logger.Err, err)
+		}
+	}
+}
+
+/*******************************************************************************
+Metrics
+*******************************************************************************/
+
+// RegisterMetrics registers in reg the metrics of the chains, labelled by
+// chain: whether their Node is running, their restarts, and their last Block
+// and Round
+func (s *Supervisor) RegisterMetrics(reg *metrics.Registry) {
+	reg.MustRegister(
+		&chainMetric{s, "core_chain_up", "Whether the node of the chain is running.", "gauge",
+			func(h ChainHealth) float64 {
+				if h.State == ChainRunning.String() {
+					return 1
+				}
+				return 0
+			}},
+		&chainMetric{s, "core_chain_restarts_total", "Number of restarts of the node of the chain.", "counter",
+			func(h ChainHealth) float64 { return float64(h.Restarts) }},
+		&chainMetric{s, "core_chain_last_block_index", "Index of the last block of the chain, -1 if its node is not running.", "gauge",
+			func(h ChainHealth) float64 { return float64(h.LastBlockIndex) }},
+		&chainMetric{s, "core_chain_last_round", "Last round of the chain, -1 if its node is not running.", "gauge",
+			func(h ChainHealth) float64 { return float64(h.LastRound) }},
+	)
+}
+
+// chainMetric is a Collector of a value of the ChainHealth of every chain
+type chainMetric struct {
+	s     *Supervisor
+	name  string
+	help  string
+	typ   string
+	value func(ChainHealth) float64
+}
+
+func (m *chainMetric) Name() string { return m.name }
+
+func (m *chainMetric) Help() string { return m.help }
+
+func (m *chainMetric) Type() string { return m.typ }
+
+func (m *chainMetric) Write(buf *bytes.Buffer) {
+	for _, h := range m.s.Health() {
+		fmt.Fprintf(buf, "%s{chain=%q} %g\n", m.name, h.ChainID, m.value(h))
+	}
+}
@@ -0,0 +1,200 @@
+package node
+
+import (
+	"sort"
+	"sync"
+
+	"github.com/bolaxy/core/types"
+)
+
+// TxPool holds the transactions, internal transactions, and Block signatures
+// waiting to be included in an Event. It is safe for concurrent use.
+type TxPool struct {
+	lock            sync.Mutex
+	txs             [][]byte
+	payloadTypes    []types.PayloadType //parallel to txs
+	internalTxs     []types.InternalTransaction
+	blockSignatures []types.BlockSignature
+	maxTxSize       int //0 for no limit
+}
+
+// NewTxPool ...
+func NewTxPool() *TxPool {
+	return &TxPool{}
+}
+
+// SetMaxTxSize refuses the transactions larger than max bytes, which do not
+// fit in an Event. 0 for no limit.
+func (p *TxPool) SetMaxTxSize(max int) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.maxTxSize = max
+}
+
+// AddTransaction ...
+func (p *TxPool) AddTransaction(tx []byte) bool {
+	return p.AddTypedTransaction(tx, types.PayloadApp)
+}
+
+// AddTypedTransaction adds a transaction tagged with a PayloadType. It returns
+// false if the transaction is larger than the maximum size, and is refused.
+func (p *TxPool) AddTypedTransaction(tx []byte, t types.PayloadType) bool {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if p.maxTxSize > 0 && len(tx) > p.maxTxSize {
+		return false
+	}
+	p.txs = append(p.txs, tx)
+	p.payloadTypes = append(p.payloadTypes, t)
+	return true
+}
+
+// AddInternalTransaction ...
+func (p *TxPool) AddInternalTransaction(itx types.InternalTransaction) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.internalTxs = append(p.internalTxs, itx)
+}
+
+// AddBlockSignature ...
+func (p *TxPool) AddBlockSignature(bs types.BlockSignature) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.blockSignatures = append(p.blockSignatures, bs)
+}
+
+// Len returns the number of pending items of all kinds
+func (p *TxPool) Len() int {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	return len(p.txs) + len(p.internalTxs) + len(p.blockSignatures)
+}
+
+// InternalLen returns the number of pending internal transactions
+func (p *TxPool) InternalLen() int {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	return len(p.internalTxs)
+}
+
+// BlockSignatures returns, without removing them, the pending signatures of
+// the Blocks of index from to to
+func (p *TxPool) BlockSignatures(from, to int) []types.BlockSignature {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	res := []types.BlockSignature{}
+	for _, bs := range p.blockSignatures {
+		if bs.Index >= from && bs.Index <= to {
+			res = append(res, bs)
+		}
+	}
+	return res
+}
+
+// Take removes and returns at most maxTxs transactions totalling at most
+// maxBytes with their PayloadTypes, all the internal transactions, and at most maxSigs Block
+// signatures. A limit <= 0 means no limit. The transactions larger than
+// maxBytes, which no Event can hold, are dropped.
+//
+// The signatures of the newest Blocks are taken first, because the older
+// ones are more likely to have reached a quorum through other peers. The
+// signatures for which final returns true are dropped, and the ones beyond
+// maxSigs stay in the pool. final may be nil.
+func (p *TxPool) Take(maxTxs, maxBytes, maxSigs int, final func(index int) bool) ([][]byte, []types.PayloadType, []types.InternalTransaction, []types.BlockSignature) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	if maxBytes > 0 {
+		p.dropLarger(maxBytes)
+	}
+
+	n := len(p.txs)
+	if maxTxs > 0 && n > maxTxs {
+		n = maxTxs
+	}
+
+	if maxBytes > 0 {
+		size := 0
+		for i := 0; i < n; i++ {
+			size += len(p.txs[i])
+			if size > maxBytes {
+				n = i
+				break
+			}
+		}
+	}
+
+	txs := p.txs[:n:n]
+	p.txs = p.txs[n:]
+	payloadTypes := p.payloadTypes[:n:n]
+	p.payloadTypes = p.payloadTypes[n:]
+
+	itxs := p.internalTxs
+	p.internalTxs = nil
+
+	sigs := p.takeSignatures(maxSigs, final)
+
+	return txs, payloadTypes, itxs, sigs
+}
+
+// dropLarger removes the transactions larger than max bytes
+func (p *TxPool) dropLarger(max int) {
+	txs, payloadTypes := p.txs[:0], p.payloadTypes[:0]
+	for i, tx := range p.txs {
+		if len(tx) <= max {
+			txs = append(txs, tx)
+			payloadTypes = append(payloadTypes, p.payloadTypes[i])
+		}
+	}
+	p.txs, p.payloadTypes = txs, payloadTypes
+}
+
+// TakeInternal removes and returns all the internal transactions, leaving the
+// other items in the pool
+func (p *TxPool) TakeInternal() []types.InternalTransaction {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	itxs := p.internalTxs
+	p.internalTxs = nil
+
+	return itxs
+}
+
+// takeSignatures selects the signatures of Take. It must be called with the
+// lock held.
+func (p *TxPool) takeSignatures(max int, final func(index int) bool) []types.BlockSignature {
+	pending := p.blockSignatures[:0]
+	for _, bs := range p.blockSignatures {
+		if final == nil || !final(bs.Index) {
+			pending = append(pending, bs)
+		}
+	}
+
+	sort.SliceStable(pending, func(i, j int) bool {
+		return pending[i].Index > pending[j].Index
+	})
+
+	n := len(pending)
+	if max > 0 && n > max {
+		n = max
+	}
+
+	sigs := append([]types.BlockSignature{}, pending[:n]...)
+	p.blockSignatures = append([]types.BlockSignature{}, pending[n:]...)
+
+	return sigs
+}
+
+// Return puts back items which could not be included in an Event, ahead of
+// the items added since they were taken
+func (p *TxPool) Return(txs [][]byte, payloadTypes []types.PayloadType, itxs []types.InternalTransaction, sigs []types.BlockSignature) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	p.txs = append(append([][]byte{}, txs...), p.txs...)
+	p.payloadTypes = append(append([]types.PayloadType{}, payloadTypes...), p.payloadTypes...)
+	p.internalTxs = append(append([]types.InternalTransaction{}, itxs...), p.internalTxs...)
+	p.blockSignatures = append(append([]types.BlockSignature{}, sigs...), p.blockSignatures...)
+}
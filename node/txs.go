@@ -0,0 +1,204 @@
+package node
+
+import (
+	"bytes"
+	"fmt"
+	"sync"
+
+	"github.com/bolaxy/config"
+	"github.com/bolaxy/core/logger"
+	"github.com/bolaxy/core/transport"
+	"github.com/bolaxy/core/types"
+)
+
+// DefaultTxCacheSize is the default TxCacheSize of a Config
+const DefaultTxCacheSize = 10000
+
+// txCache keeps the most recent transactions by hash, to fill the Events
+// which were gossiped with the hashes of their transactions, and to serve
+// the peers which pull them. It is safe for concurrent use.
+type txCache struct {
+	lock  sync.Mutex
+	max   int
+	txs   map[string][]byte
+	order []string //oldest first
+}
+
+func newTxCache(max int) *txCache {
+	return &txCache{
+		max: max,
+		txs: make(map[string][]byte),
+	}
+}
+
+// add keeps tx
+func (c *txCache) add(tx []byte) {
+	key := string(types.TxHash(tx))
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if _, ok := c.txs[key]; ok {
+		return
+	}
+	c.txs[key] = tx
+	c.order = append(c.order, key)
+
+	for len(c.order) > c.max {
+		delete(c.txs, c.order[0])
+		c.order = c.order[1:]
+	}
+}
+
+// get returns the transaction of the given hash, or nil
+func (c *txCache) get(hash []byte) []byte {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	return c.txs[string(hash)]
+}
+
+// digestable returns whether the hashes of the transactions of we are smaller
+// than the transactions themselves
+func digestable(we *types.WireEvent) bool {
+	size := 0
+	for _, tx := range we.Body.Transactions {
+		size += len(tx)
+	}
+	return size > len(we.Body.Transactions)*len(types.TxHash(nil))
+}
+
+// digest replaces the transactions of the Events of a SyncResponse by their
+// hashes, when it saves bytes. The transactions are kept, to serve the
+// GetTxsRequest which follows.
+func (n *Node) digest(wevents []types.WireEvent) {
+	for i := range wevents {
+		if !digestable(&wevents[i]) {
+			continue
+		}
+		for _, tx := range wevents[i].Body.Transactions {
+			n.txs.add(tx)
+		}
+		wevents[i] = wevents[i].Digested()
+	}
+}
+
+// fillEvents replaces the Events of a SyncResponse of peer which carry the
+// hashes of their transactions by the Events with their transactions, taken
+// from the txCache or pulled from peer. The Events which were already
+// inserted are left to insertEvents, and the ones which could not be filled
+// are dropped, to be gossiped again.
+func (n *Node) fillEvents(peer *conf.Peer, wevents []types.WireEvent) []types.WireEvent {
+	n.lock.Lock()
+	digested := make([]bool, len(wevents))
+	missing := [][]byte{}
+	for i := range wevents {
+		if wevents[i].Body.TxHashes == nil {
+			continue
+		}
+		if n.seen != nil && n.seen.Test(&wevents[i]) {
+			continue
+		}
+		digested[i] = true
+		for _, h := range wevents[i].Body.TxHashes {
+			if n.txs.get(h) == nil {
+				missing = append(missing, h)
+			}
+		}
+	}
+	n.lock.Unlock()
+
+	if len(missing) > 0 {
+		if err := n.getTxs(peer, missing); err != nil {
+			n.logger.Debug("transactions not pulled",
+				"peer", peer.ID(),
+				"count", len(missing),
+				logger.Err, err)
+		}
+	}
+
+	res := make([]types.WireEvent, 0, len(wevents))
+	for i, we := range wevents {
+		if !digested[i] {
+			res = append(res, we)
+			continue
+		}
+
+		txs := make([][]byte, 0, len(we.Body.TxHashes))
+		for _, h := range we.Body.TxHashes {
+			tx := n.txs.get(h)
+			if tx == nil {
+				break
+			}
+			txs = append(txs, tx)
+		}
+		if len(txs) < len(we.Body.TxHashes) {
+			n.logger.Debug("event transactions not pulled",
+				"peer", peer.ID(),
+				"creator", we.Body.CreatorID,
+				"index", we.Body.Index)
+			continue
+		}
+		res = append(res, we.Filled(txs))
+	}
+
+	return res
+}
+
+// getTxs pulls the transactions of the given hashes from peer, and keeps the
+// ones which match their hash. The peer is penalised if it sends others.
+func (n *Node) getTxs(peer *conf.Peer, hashes [][]byte) error {
+	req := &transport.GetTxsRequest{
+		FromID: n.self.ID(),
+		Hashes: hashes,
+	}
+	if err := transport.SealWith(req, n.signer); err != nil {
+		return err
+	}
+
+	var resp transport.GetTxsResponse
+	if err := n.trans.GetTxs(n.ctx, n.target(peer), req, &resp); err != nil {
+		return err
+	}
+
+	if resp.FromID != peer.ID() {
+		return fmt.Errorf("transactions response from %d instead of %d", resp.FromID, peer.ID())
+	}
+	if err := n.verifier.Verify(&resp, peer.PubKeyBytes()); err != nil {
+		return err
+	}
+	if len(resp.Txs) != len(hashes) {
+		n.penalize(peer, transport.PenaltyInvalidEvent, "invalid transactions response")
+		return fmt.Errorf("%d transactions for %d hashes", len(resp.Txs), len(hashes))
+	}
+
+	invalid := 0
+	for i, tx := range resp.Txs {
+		if tx == nil {
+			continue
+		}
+		if !bytes.Equal(types.TxHash(tx), hashes[i]) {
+			invalid++
+			continue
+		}
+		n.txs.add(tx)
+	}
+	if invalid > 0 {
+		n.penalize(peer, transport.PenaltyInvalidEvent, "invalid transactions")
+		return fmt.Errorf("%d invalid transactions", invalid)
+	}
+
+	return nil
+}
+
+// processGetTxsRequest returns the requested transactions which we hold
+func (n *Node) processGetTxsRequest(req *transport.GetTxsRequest) *transport.GetTxsResponse {
+	txs := make([][]byte, len(req.Hashes))
+	for i, h := range req.Hashes {
+		txs[i] = n.txs.get(h)
+	}
+	return &transport.GetTxsResponse{
+		FromID: n.self.ID(),
+		Txs:    txs,
+	}
+}
@@ -0,0 +1,191 @@
+package node
+
+import (
+	"github.com/bolaxy/config"
+	"github.com/bolaxy/core/logger"
+	"github.com/bolaxy/core/types"
+)
+
+// DefaultSignalWindow is the default number of rounds for which an
+// UPGRADE_SIGNAL counts. Validators which are still ready after that signal
+// again.
+const DefaultSignalWindow = 1000
+
+// signals tallies the UPGRADE_SIGNAL transactions of the validators. Like
+// voting, its state derives from the committed Blocks only, so that all the
+// peers activate the same version at the same round.
+type signals struct {
+	window    int
+	byVersion map[int]map[string]int // [version][pubkey] => round of the signal
+	loaded    bool
+}
+
+func newSignals(window int) *signals {
+	return &signals{
+		window:    window,
+		byVersion: make(map[int]map[string]int),
+	}
+}
+
+func (s *signals) add(itx types.InternalTransaction, round int) {
+	v := itx.Body.Version
+	if s.byVersion[v] == nil {
+		s.byVersion[v] = make(map[string]int)
+	}
+	s.byVersion[v][itx.Body.Peer.PubKeyString()] = round
+}
+
+// expire drops the signals older than the window before round, and the ones
+// for versions up to active
+func (s *signals) expire(round, active int) {
+	for v, signers := range s.byVersion {
+		for pk, r := range signers {
+			if r < round-s.window {
+				delete(signers, pk)
+			}
+		}
+		if v <= active || len(signers) == 0 {
+			delete(s.byVersion, v)
+		}
+	}
+}
+
+// count returns the number of members of peers which signalled version
+func (s *signals) count(version int, peers *conf.PeerSet) int {
+	n := 0
+	for pk := range s.byVersion[version] {
+		if _, ok := peers.ByPubKey[pk]; ok {
+			n++
+		}
+	}
+	return n
+}
+
+// ready returns the highest version signalled by a SuperMajority of peers,
+// or false if there is none
+func (s *signals) ready(peers *conf.PeerSet) (int, bool) {
+	res, ok := 0, false
+	for v := range s.byVersion {
+		if v > res && s.count(v, peers) >= peers.SuperMajority() {
+			res, ok = v, true
+		}
+	}
+	return res, ok
+}
+
+// SetSignalWindow sets the number of rounds for which an UPGRADE_SIGNAL
+// counts. It must be the same on all the peers.
+func (m *Membership) SetSignalWindow(rounds int) {
+	m.signals = newSignals(rounds)
+}
+
+// UpgradeSignals returns the number of validators of the last PeerSet which
+// signalled each protocol version not activated yet. It must be serialised
+// with the other operations on the Hashgraph.
+func (m *Membership) UpgradeSignals() map[int]int {
+	res := make(map[int]int)
+
+	peers, err := m.hg.Store.GetPeerSet(m.hg.Store.LastRound())
+	if err != nil {
+		return res
+	}
+	all, err := m.hg.Store.GetAllParams()
+	if err != nil {
+		return res
+	}
+
+	//the versions only grow
+	active := types.ProtocolInitial
+	for _, p := range all {
+		if p.Version() > active {
+			active = p.Version()
+		}
+	}
+
+	for v := range m.signals.byVersion {
+		if v > active {
+			res[v] = m.signals.count(v, peers)
+		}
+	}
+	return res
+}
+
+// scheduledVersion returns the ProtocolVersion of the last params scheduled
+// by the Blocks up to the one whose changes take effect at effectiveRound
+func (m *Membership) scheduledVersion(effectiveRound int) int {
+	params, err := m.hg.Store.GetParams(m.epochStart(effectiveRound))
+	if err != nil {
+		return types.ProtocolInitial
+	}
+	return params.Version()
+}
+
+// loadSignals recovers the signals after a restart, from the Blocks
+// committed within the window before block
+func (m *Membership) loadSignals(block *types.Block) {
+	s := m.signals
+	if s.loaded {
+		return
+	}
+	s.loaded = true
+
+	for i := block.Index() - 1; i >= 0; i-- {
+		b, err := m.hg.Store.GetBlock(i)
+		if err != nil || b.RoundReceived() < block.RoundReceived()-s.window {
+			break
+		}
+		for _, r := range b.InternalTransactionReceipts() {
+			itx := r.InternalTransaction
+			if !r.Accepted || itx.Body.Type != types.UPGRADESIGNAL {
+				continue
+			}
+			//newest first: a later signal of the same validator is kept
+			if _, ok := s.byVersion[itx.Body.Version][itx.Body.Peer.PubKeyString()]; !ok {
+				s.add(itx, b.RoundReceived())
+			}
+		}
+	}
+}
+
+// activate returns the version signalled by a SuperMajority of the PeerSet
+// of the round of block, if it is not active yet
+func (m *Membership) activate(block *types.Block, effectiveRound int) (int, bool, error) {
+	peers, err := m.hg.Store.GetPeerSet(block.RoundReceived())
+	if err != nil {
+		return 0, false, err
+	}
+
+	m.signals.expire(block.RoundReceived(), m.scheduledVersion(effectiveRound))
+
+	version, ok := m.signals.ready(peers)
+	if !ok {
+		return 0, false, nil
+	}
+
+	m.logger.Info("protocol upgrade ready",
+		logger.Block, block.Index(),
+		"version", version,
+		"signals", m.signals.count(version, peers))
+
+	return version, true, nil
+}
+
+// SignalUpgrade submits our UPGRADE_SIGNAL for a protocol version, which
+// must be implemented by this node
+func (n *Node) SignalUpgrade(version int) error {
+	if n.config.Observer {
+		return ErrObserver
+	}
+	if version <= types.ProtocolInitial || version > types.ProtocolLatest {
+		return ErrUnsupportedVersion
+	}
+
+	itx := types.NewInternalTransactionUpgrade(*n.self, version)
+	if err := itx.SignWith(n.signer); err != nil {
+		return err
+	}
+
+	n.pool.AddInternalTransaction(itx)
+
+	return nil
+}
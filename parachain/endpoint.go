@@ -0,0 +1,61 @@
+package parachain
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+
+	"github.com/bolaxy/core/types"
+)
+
+// HTTPEndpoint delivers SyncBlocks by POSTing their JSON to a URL. The body
+// of a successful response is the reference of the delivery.
+type HTTPEndpoint struct {
+	URL    string
+	Client *http.Client // http.DefaultClient if nil
+}
+
+// NewHTTPEndpoint ...
+func NewHTTPEndpoint(url string) *HTTPEndpoint {
+	return &HTTPEndpoint{URL: url}
+}
+
+// Deliver implements Endpoint
+func (e *HTTPEndpoint) Deliver(ctx context.Context, sb *types.SyncBlock) (string, error) {
+	data, err := json.Marshal(sb)
+	if err != nil {
+		return "", err
+	}
+
+	req, err := http.NewRequest(http.MethodPost, e.URL, bytes.NewReader(data))
+	if err != nil {
+		return "", err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", "application/json")
+
+	client := e.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return "", err
+	}
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return "", fmt.Errorf("%s: %s", resp.Status, bytes.TrimSpace(body))
+	}
+
+	return string(bytes.TrimSpace(body)), nil
+}
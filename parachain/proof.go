@@ -0,0 +1,171 @@
+// Package parachain carries messages from the Blocks of this chain to
+// parachains. A message is a PayloadParachain transaction naming its
+// destination chain. The destination verifies a source Block once, against
+// the PeerSet it tracks, and keeps its Header; each message then comes with a
+// Merkle proof against the TxRoot of the Header, so that the relay which
+// delivers it need not be trusted.
+package parachain
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+
+	"github.com/bolaxy/config"
+	"github.com/bolaxy/core/types"
+)
+
+// messagePrefix starts the transactions which encode a Message. The Merkle
+// proof of a transaction does not cover its PayloadType, so a Message is
+// recognised by its prefix; the applications must not commit untagged
+// transactions which carry it.
+var messagePrefix = []byte("bolaxy-parachain:")
+
+// Message is the payload of a PayloadParachain transaction
+type Message struct {
+	ChainID string
+	Data    []byte
+}
+
+// NewTransaction encodes a Message, to be submitted with PayloadParachain
+func NewTransaction(chainID string, data []byte) ([]byte, error) {
+	if chainID == "" {
+		return nil, fmt.Errorf("empty chain id")
+	}
+
+	raw, err := json.Marshal(&Message{ChainID: chainID, Data: data})
+	if err != nil {
+		return nil, err
+	}
+
+	return append(append([]byte{}, messagePrefix...), raw...), nil
+}
+
+// ParseTransaction decodes the Message of a transaction
+func ParseTransaction(tx []byte) (*Message, error) {
+	if !bytes.HasPrefix(tx, messagePrefix) {
+		return nil, fmt.Errorf("not a parachain message")
+	}
+
+	m := new(Message)
+	if err := json.Unmarshal(tx[len(messagePrefix):], m); err != nil {
+		return nil, err
+	}
+
+	return m, nil
+}
+
+// Header is what a destination chain keeps of a verified source Block
+type Header struct {
+	BlockIndex    int
+	RoundReceived int
+	PeersHash     []byte
+	StateHash     []byte
+	TxRoot        []byte
+}
+
+// VerifyBlock checks that a Block was signed by a SuperMajority of peerSet,
+// which must be the PeerSet of the Block, and returns its Header. The caller
+// must check that peerSet is the one it expects.
+func VerifyBlock(block *types.Block, peerSet *conf.PeerSet) (*Header, error) {
+	peersHash, err := peerSet.Hash()
+	if err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(peersHash, block.PeersHash()) {
+		return nil, fmt.Errorf("block %d: peer-set hash mismatch", block.Index())
+	}
+
+	valid := 0
+	for validator := range block.Signatures {
+		if _, ok := peerSet.ByPubKey[validator]; !ok {
+			continue
+		}
+
+		bs, err := block.GetSignature(validator)
+		if err != nil {
+			continue
+		}
+
+		if ok, err := block.Verify(bs); err == nil && ok {
+			valid++
+		}
+	}
+
+	if valid < peerSet.SuperMajority() {
+		return nil, fmt.Errorf("block %d: %d valid signatures, %d required", block.Index(), valid, peerSet.SuperMajority())
+	}
+
+	return &Header{
+		BlockIndex:    block.Index(),
+		RoundReceived: block.RoundReceived(),
+		PeersHash:     block.PeersHash(),
+		StateHash:     block.StateHash(),
+		TxRoot:        block.TxRoot(),
+	}, nil
+}
+
+// Proof proves that a transaction encoding a Message was committed at an
+// offset of a Block
+type Proof struct {
+	BlockIndex int
+	Offset     int // position in the Block's transactions
+	Tx         []byte
+	Merkle     *types.MerkleProof // links Tx to the TxRoot of the Block
+}
+
+// Extract returns the Proofs of the Messages of a Block destined for chainID,
+// in Block order
+func Extract(block *types.Block, chainID string) ([]*Proof, error) {
+	txs := block.Transactions()
+	res := []*Proof{}
+
+	for i, t := range block.PayloadTypes() {
+		if t != types.PayloadParachain {
+			continue
+		}
+
+		m, err := ParseTransaction(txs[i])
+		if err != nil || m.ChainID != chainID {
+			continue
+		}
+
+		merkle, err := types.NewMerkleProof(txs, i)
+		if err != nil {
+			return nil, err
+		}
+
+		res = append(res, &Proof{
+			BlockIndex: block.Index(),
+			Offset:     i,
+			Tx:         txs[i],
+			Merkle:     merkle,
+		})
+	}
+
+	return res, nil
+}
+
+// Verify checks that the Proof links its transaction to the TxRoot of the
+// Header of its Block, and returns the Message if it is destined for chainID
+func (p *Proof) Verify(h *Header, chainID string) (*Message, error) {
+	if p.BlockIndex != h.BlockIndex {
+		return nil, fmt.Errorf("proof of block %d against header %d", p.BlockIndex, h.BlockIndex)
+	}
+	if p.Merkle == nil || p.Merkle.Index != p.Offset {
+		return nil, fmt.Errorf("proof of offset %d has no matching merkle proof", p.Offset)
+	}
+	if !p.Merkle.Verify(h.TxRoot, p.Tx) {
+		return nil, fmt.Errorf("merkle proof does not match the root of block %d", h.BlockIndex)
+	}
+
+	m, err := ParseTransaction(p.Tx)
+	if err != nil {
+		return nil, err
+	}
+	if m.ChainID != chainID {
+		return nil, fmt.Errorf("message destined for %q, not %q", m.ChainID, chainID)
+	}
+
+	return m, nil
+}
@@ -0,0 +1,464 @@
+package parachain
+
+import (
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/bolaxy/core/anchor"
+	"github.com/bolaxy/core/db"
+	"github.com/bolaxy/core/hashgraph"
+	"github.com/bolaxy/core/logger"
+	"github.com/bolaxy/core/types"
+	"github.com/bolaxy/errors"
+)
+
+const (
+	outboxPrefix  = "paraoutbox"
+	headPrefix    = "parahead"
+	cursorPrefix  = "paracursor"
+	receiptPrefix = "parareceipt"
+	blobPrefix    = "parablob_"
+)
+
+// DefaultBatchSize is the maximum number of Blocks of a SyncBlock
+const DefaultBatchSize = 16
+
+// Endpoint delivers SyncBlocks to a parachain
+type Endpoint interface {
+	// Deliver returns a reference to the delivery, like a transaction hash
+	// on the parachain, which is recorded in the Receipts. A SyncBlock may
+	// be delivered again after a failure or a restart.
+	Deliver(ctx context.Context, sb *types.SyncBlock) (string, error)
+}
+
+// Receipt records the delivery of a Block to a parachain
+type Receipt struct {
+	ChainID    string
+	BlockIndex int
+	Messages   int // Messages of the Block destined for the chain
+	Reference  string
+	Attempts   int
+	Time       time.Time
+}
+
+type chain struct {
+	id       string
+	endpoint Endpoint
+	head     int //sequence of the last Block queued, written by the callback
+	wake     chan struct{}
+}
+
+// Relay pushes the final Blocks which carry Messages for a registered
+// parachain to its Endpoint, in SyncBlocks of up to DefaultBatchSize Blocks,
+// in the order in which they became final. The Blocks are queued in the db
+// by the finality callback, and delivered by a goroutine per parachain, with
+// retries; the cursor of each parachain is persisted, so that the delivery is
+// at least once across restarts. A Block queued for several parachains is
+// stored once, in a BlobStore, with a reference per parachain.
+type Relay struct {
+	db      db.Sinker
+	blobs   *db.BlobStore
+	backoff anchor.Backoff
+	logger  logger.Logger
+
+	lock   sync.Mutex
+	chains map[string]*chain
+
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+}
+
+// NewRelay creates a Relay which queues the Blocks and records the Receipts
+// in sinker. Failed deliveries are retried with backoff, forever if its
+// MaxAttempts is 0, and otherwise again at the next Block.
+func NewRelay(sinker db.Sinker, backoff anchor.Backoff) *Relay {
+	ctx, cancel := context.WithCancel(context.Background())
+
+	return &Relay{
+		db:      sinker,
+		blobs:   db.NewBlobStore(db.NewPartition(sinker, blobPrefix)),
+		backoff: backoff,
+		logger:  logger.Nop,
+		chains:  make(map[string]*chain),
+		ctx:     ctx,
+		cancel:  cancel,
+	}
+}
+
+// SetLogger ...
+func (r *Relay) SetLogger(l logger.Logger) {
+	r.logger = logger.OrNop(l).With(logger.Component, "Relay")
+}
+
+func chainKey(prefix, chainID string) string {
+	return fmt.Sprintf("%s_%s", prefix, hex.EncodeToString([]byte(chainID)))
+}
+
+func outboxKey(chainID string, seq int) []byte {
+	return []byte(fmt.Sprintf("%s_%010d", chainKey(outboxPrefix, chainID), seq))
+}
+
+func receiptKey(chainID string, blockIndex int) []byte {
+	return []byte(fmt.Sprintf("%s_%010d", chainKey(receiptPrefix, chainID), blockIndex))
+}
+
+// Register delivers the Messages for chainID to ep, from the next final Block
+// on, after the ones queued before a restart. It must be called before Start.
+func (r *Relay) Register(chainID string, ep Endpoint) error {
+	head, err := r.getInt(r.ctx, chainKey(headPrefix, chainID))
+	if err != nil {
+		return err
+	}
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	if _, ok := r.chains[chainID]; ok {
+		return fmt.Errorf("chain %q already registered", chainID)
+	}
+
+	r.chains[chainID] = &chain{
+		id:       chainID,
+		endpoint: ep,
+		head:     head,
+		wake:     make(chan struct{}, 1),
+	}
+
+	return nil
+}
+
+// Wrap returns a FinalityCallback which queues a final Block for the
+// parachains it carries Messages for, before passing it to cb
+func (r *Relay) Wrap(cb hashgraph.FinalityCallback) hashgraph.FinalityCallback {
+	return func(ctx context.Context, block *types.Block) error {
+		if err := r.queue(ctx, block); err != nil {
+			return err
+		}
+		if cb != nil {
+			return cb(ctx, block)
+		}
+		return nil
+	}
+}
+
+func (r *Relay) queue(ctx context.Context, block *types.Block) error {
+	if len(block.TransactionsOfType(types.PayloadParachain)) == 0 {
+		return nil
+	}
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	var data []byte
+	for _, c := range r.chains {
+		proofs, err := Extract(block, c.id)
+		if err != nil {
+			return err
+		}
+		if len(proofs) == 0 {
+			continue
+		}
+
+		if data == nil {
+			if data, err = block.Marshal(); err != nil {
+				return err
+			}
+		}
+
+		hash, err := r.blobs.Put(ctx, data)
+		if err != nil {
+			return err
+		}
+		if err := r.db.Put(ctx, outboxKey(c.id, c.head+1), []byte(hex.EncodeToString(hash))); err != nil {
+			return err
+		}
+		if err := r.putInt(ctx, chainKey(headPrefix, c.id), c.head+1); err != nil {
+			return err
+		}
+		c.head++
+
+		r.logger.Debug("block queued for parachain",
+			"chain", c.id,
+			logger.Block, block.Index(),
+			"messages", len(proofs))
+
+		select {
+		case c.wake <- struct{}{}:
+		default:
+		}
+	}
+
+	return nil
+}
+
+// Start launches one delivery goroutine per registered parachain
+func (r *Relay) Start() {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	for _, c := range r.chains {
+		r.wg.Add(1)
+		go r.deliverLoop(c)
+	}
+}
+
+// Close stops the deliveries. The Blocks which were not delivered stay
+// queued.
+func (r *Relay) Close() {
+	r.cancel()
+	r.wg.Wait()
+}
+
+func (r *Relay) deliverLoop(c *chain) {
+	defer r.wg.Done()
+
+	for {
+		if err := r.deliverPending(c); err != nil && r.ctx.Err() == nil {
+			r.logger.Error("blocks not delivered to parachain",
+				"chain", c.id,
+				logger.Err, err)
+		}
+
+		select {
+		case <-c.wake:
+		case <-r.ctx.Done():
+			return
+		}
+	}
+}
+
+// deliverPending delivers the queued Blocks of a parachain, in batches
+func (r *Relay) deliverPending(c *chain) error {
+	for {
+		cursor, err := r.Cursor(r.ctx, c.id)
+		if err != nil {
+			return err
+		}
+		head, err := r.getInt(r.ctx, chainKey(headPrefix, c.id))
+		if err != nil {
+			return err
+		}
+		if cursor >= head {
+			return nil
+		}
+
+		last := cursor + DefaultBatchSize
+		if last > head {
+			last = head
+		}
+
+		sb := &types.SyncBlock{
+			ChainId: c.id,
+			Type:    types.Create,
+		}
+		hashes := [][]byte{}
+		for seq := cursor + 1; seq <= last; seq++ {
+			data, hash, err := r.queued(c.id, seq)
+			if err != nil {
+				return fmt.Errorf("queued block %d: %v", seq, err)
+			}
+			if hash != nil {
+				hashes = append(hashes, hash)
+			}
+			block := new(types.Block)
+			if err := block.Unmarshal(data); err != nil {
+				return err
+			}
+			sb.BlockArr = append(sb.BlockArr, block)
+		}
+
+		ref, attempts, err := r.deliver(c, sb)
+		if err != nil {
+			return err
+		}
+
+		if err := r.acknowledge(c, sb, cursor, last, ref, attempts); err != nil {
+			return err
+		}
+
+		if err := r.release(hashes); err != nil {
+			return err
+		}
+	}
+}
+
+// queued returns a Block of the queue of a parachain, and the hash of its
+// blob. The Blocks queued before they were kept in the BlobStore are in the
+// queue itself, and have no hash.
+func (r *Relay) queued(chainID string, seq int) ([]byte, []byte, error) {
+	data, err := r.db.Get(r.ctx, outboxKey(chainID, seq))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	hash, err := hex.DecodeString(string(data))
+	if err != nil || len(hash) != 32 {
+		return data, nil, nil
+	}
+
+	data, err = r.blobs.Get(r.ctx, hash)
+	if err != nil {
+		return nil, nil, err
+	}
+	return data, hash, nil
+}
+
+// release gives back the references of a parachain to the blobs of the
+// Blocks delivered to it, and deletes the blobs of the Blocks delivered to
+// all the parachains
+func (r *Relay) release(hashes [][]byte) error {
+	for _, hash := range hashes {
+		if err := r.blobs.Release(r.ctx, hash); err != nil {
+			return err
+		}
+	}
+	_, err := r.blobs.GC(r.ctx)
+	return err
+}
+
+func (r *Relay) deliver(c *chain, sb *types.SyncBlock) (string, int, error) {
+	delay := r.backoff.Initial
+	for attempt := 1; ; attempt++ {
+		ref, err := c.endpoint.Deliver(r.ctx, sb)
+		if err == nil {
+			return ref, attempt, nil
+		}
+
+		if r.backoff.MaxAttempts > 0 && attempt >= r.backoff.MaxAttempts {
+			return "", attempt, fmt.Errorf("giving up after %d attempts: %v", attempt, err)
+		}
+
+		r.logger.Debug("parachain delivery failed, retrying",
+			"chain", c.id,
+			"blocks", len(sb.BlockArr),
+			"attempt", attempt,
+			"delay", delay,
+			logger.Err, err)
+
+		select {
+		case <-time.After(delay):
+		case <-r.ctx.Done():
+			return "", attempt, r.ctx.Err()
+		}
+
+		delay *= 2
+		if r.backoff.Max > 0 && delay > r.backoff.Max {
+			delay = r.backoff.Max
+		}
+	}
+}
+
+// acknowledge records the Receipts of a delivered SyncBlock, advances the
+// cursor, and removes the Blocks from the queue, in one batch
+func (r *Relay) acknowledge(c *chain, sb *types.SyncBlock, cursor, last int, ref string, attempts int) error {
+	batch := r.db.NewBatch()
+
+	now := time.Now().UTC()
+	for _, block := range sb.BlockArr {
+		proofs, err := Extract(block, c.id)
+		if err != nil {
+			batch.Cancel()
+			return err
+		}
+
+		data, err := json.Marshal(&Receipt{
+			ChainID:    c.id,
+			BlockIndex: block.Index(),
+			Messages:   len(proofs),
+			Reference:  ref,
+			Attempts:   attempts,
+			Time:       now,
+		})
+		if err != nil {
+			batch.Cancel()
+			return err
+		}
+
+		if err := batch.Set(receiptKey(c.id, block.Index()), data); err != nil {
+			batch.Cancel()
+			return err
+		}
+	}
+
+	for seq := cursor + 1; seq <= last; seq++ {
+		if err := batch.Delete(outboxKey(c.id, seq)); err != nil {
+			batch.Cancel()
+			return err
+		}
+	}
+
+	if err := batch.Set([]byte(chainKey(cursorPrefix, c.id)), []byte(strconv.Itoa(last))); err != nil {
+		batch.Cancel()
+		return err
+	}
+
+	if err := batch.Commit(r.ctx); err != nil {
+		return err
+	}
+
+	r.logger.Info("blocks delivered to parachain",
+		"chain", c.id,
+		"blocks", len(sb.BlockArr),
+		"reference", ref)
+
+	return nil
+}
+
+// Cursor returns the sequence of the last Block delivered to a parachain, in
+// the order of the queue, 0 if none was
+func (r *Relay) Cursor(ctx context.Context, chainID string) (int, error) {
+	return r.getInt(ctx, chainKey(cursorPrefix, chainID))
+}
+
+// Pending returns the number of Blocks queued for a parachain which were not
+// delivered yet
+func (r *Relay) Pending(ctx context.Context, chainID string) (int, error) {
+	cursor, err := r.Cursor(ctx, chainID)
+	if err != nil {
+		return 0, err
+	}
+	head, err := r.getInt(ctx, chainKey(headPrefix, chainID))
+	if err != nil {
+		return 0, err
+	}
+	return head - cursor, nil
+}
+
+// GetReceipt returns the Receipt of the delivery of a Block to a parachain
+func (r *Relay) GetReceipt(ctx context.Context, chainID string, blockIndex int) (*Receipt, error) {
+	data, err := r.db.Get(ctx, receiptKey(chainID, blockIndex))
+	if err != nil {
+		if err == db.ErrKeyNotFound {
+			return nil, errors.NewStoreErr("ParachainReceipts", errors.KeyNotFound, strconv.Itoa(blockIndex))
+		}
+		return nil, err
+	}
+
+	rc := new(Receipt)
+	if err := json.Unmarshal(data, rc); err != nil {
+		return nil, err
+	}
+
+	return rc, nil
+}
+
+func (r *Relay) getInt(ctx context.Context, key string) (int, error) {
+	data, err := r.db.Get(ctx, []byte(key))
+	if err == db.ErrKeyNotFound {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	return strconv.Atoi(string(data))
+}
+
+func (r *Relay) putInt(ctx context.Context, key string, v int) error {
+	return r.db.Put(ctx, []byte(key), []byte(strconv.Itoa(v)))
+}
@@ -0,0 +1,48 @@
+// Package profiling labels the hot paths of the consensus for the CPU
+// profiler, so that a profile can be broken down by phase, for example with
+// go tool pprof -tagfocus phase=signature_verification. Labelling allocates
+// on every call, so it is disabled by default.
+package profiling
+
+import (
+	"context"
+	"runtime/pprof"
+	"sync/atomic"
+)
+
+// Key is the pprof label set on the hot paths
+const Key = "phase"
+
+// The phases labelled with Key
+const (
+	EventHash             = "event_hash"
+	SignatureVerification = "signature_verification"
+	StoreInsert           = "store_insert"
+	BlockConstruction     = "block_construction"
+)
+
+var enabled int32
+
+// Enable turns labelling on or off. It is safe to call at any time, but only
+// the calls to Do made while it is on are labelled.
+func Enable(on bool) {
+	var v int32
+	if on {
+		v = 1
+	}
+	atomic.StoreInt32(&enabled, v)
+}
+
+// Enabled ...
+func Enabled() bool {
+	return atomic.LoadInt32(&enabled) == 1
+}
+
+// Do calls f, with the goroutine labelled with phase if labelling is enabled
+func Do(ctx context.Context, phase string, f func(context.Context)) {
+	if !Enabled() {
+		f(ctx)
+		return
+	}
+	pprof.Do(ctx, pprof.Labels(Key, phase), f)
+}
@@ -0,0 +1,235 @@
+package pubsub
+
+import (
+	"errors"
+	"sync"
+
+	"github.com/bolaxy/config"
+	"github.com/bolaxy/core/types"
+)
+
+// DefaultBufferSize is the default capacity of a subscription's channel
+const DefaultBufferSize = 64
+
+var (
+	// ErrSlowConsumer is set on subscriptions that were evicted because their
+	// buffer was full.
+	ErrSlowConsumer = errors.New("subscription evicted: slow consumer")
+	// ErrClosed is set on subscriptions that were cancelled or whose feed was
+	// closed.
+	ErrClosed = errors.New("subscription closed")
+)
+
+// MessageType ...
+type MessageType int
+
+const (
+	// BlockCommitted is published for every committed Block
+	BlockCommitted MessageType = iota
+	// ReceiptsCommitted is published with the InternalTransactionReceipts of a
+	// committed Block
+	ReceiptsCommitted
+	// PeerSetChanged is published when a new PeerSet takes effect
+	PeerSetChanged
+	// EventCommitted is published for every Event of a committed Frame
+	EventCommitted
+)
+
+// String ...
+func (t MessageType) String() string {
+	switch t {
+	case BlockCommitted:
+		return "BLOCK"
+	case ReceiptsCommitted:
+		return "RECEIPTS"
+	case PeerSetChanged:
+		return "PEERSET"
+	case EventCommitted:
+		return "EVENT"
+	default:
+		return "Unknown MessageType"
+	}
+}
+
+// Message is what subscribers receive. Only the fields relevant to Type are
+// set. The Blocks and Events trimmed by a Filter have their Block or Event
+// replaced by the selected Transactions and InternalTransactions.
+type Message struct {
+	Type                 MessageType
+	BlockIndex           int
+	Block                *types.Block                       `json:",omitempty"`
+	Event                *types.Event                       `json:",omitempty"`
+	EventHash            string                             `json:",omitempty"`
+	Creator              string                             `json:",omitempty"` //of the Event
+	Receipts             []types.InternalTransactionReceipt `json:",omitempty"`
+	Round                int                                `json:",omitempty"`
+	Peers                []*conf.Peer                       `json:",omitempty"`
+	Transactions         []Transaction                      `json:",omitempty"`
+	InternalTransactions []types.InternalTransaction        `json:",omitempty"`
+}
+
+// Subscription receives Messages on C until it is cancelled, evicted, or the
+// Feed is closed, at which point C is closed and Err returns the reason.
+type Subscription struct {
+	C <-chan Message
+
+	c      chan Message
+	feed   *Feed
+	filter *Filter //nil to receive everything
+	err    error
+}
+
+// Err returns nil while the subscription is active
+func (s *Subscription) Err() error {
+	s.feed.lock.Lock()
+	defer s.feed.lock.Unlock()
+	return s.err
+}
+
+// Cancel unsubscribes and closes C
+func (s *Subscription) Cancel() {
+	s.feed.remove(s, ErrClosed)
+}
+
+// Feed dispatches committed Blocks, receipts, and PeerSet changes to
+// subscribers over bounded channels. Publishing never blocks: a subscriber
+// whose buffer is full is evicted.
+type Feed struct {
+	lock   sync.Mutex
+	subs   map[*Subscription]struct{}
+	closed bool
+}
+
+// NewFeed ...
+func NewFeed() *Feed {
+	return &Feed{
+		subs: make(map[*Subscription]struct{}),
+	}
+}
+
+// Subscribe creates a Subscription with a buffer of the given size
+func (f *Feed) Subscribe(bufferSize int) *Subscription {
+	return f.SubscribeFilter(bufferSize, nil)
+}
+
+// SubscribeFilter creates a Subscription which only receives the Messages
+// selected by filter, trimmed by it. A nil filter selects everything.
+func (f *Feed) SubscribeFilter(bufferSize int, filter *Filter) *Subscription {
+	if bufferSize <= 0 {
+		bufferSize = DefaultBufferSize
+	}
+
+	c := make(chan Message, bufferSize)
+	sub := &Subscription{
+		C:      c,
+		c:      c,
+		feed:   f,
+		filter: filter,
+	}
+
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	if f.closed {
+		sub.err = ErrClosed
+		close(c)
+		return sub
+	}
+
+	f.subs[sub] = struct{}{}
+
+	return sub
+}
+
+// Publish delivers a Message to all the subscribers whose Filter selects it
+func (f *Feed) Publish(msg Message) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	for sub := range f.subs {
+		m, ok := sub.filter.apply(msg)
+		if !ok {
+			continue
+		}
+		select {
+		case sub.c <- m:
+		default:
+			f.evict(sub, ErrSlowConsumer)
+		}
+	}
+}
+
+// PublishBlock ...
+func (f *Feed) PublishBlock(block *types.Block) {
+	f.Publish(Message{
+		Type:       BlockCommitted,
+		BlockIndex: block.Index(),
+		Block:      block,
+	})
+
+	if receipts := block.InternalTransactionReceipts(); len(receipts) > 0 {
+		f.Publish(Message{
+			Type:       ReceiptsCommitted,
+			BlockIndex: block.Index(),
+			Receipts:   receipts,
+		})
+	}
+}
+
+// PublishFrame publishes the Events of a committed Frame, in consensus
+// order, with the round of the Frame. The Frame of a Block is the one of its
+// RoundReceived, which the Store returns with GetFrame.
+func (f *Feed) PublishFrame(frame *types.Frame) {
+	for _, fe := range frame.Events {
+		f.Publish(Message{
+			Type:      EventCommitted,
+			Event:     fe.Core,
+			EventHash: fe.Core.GetHex(),
+			Creator:   fe.Core.GetCreator(),
+			Round:     frame.Round,
+		})
+	}
+}
+
+// PublishPeerSet ...
+func (f *Feed) PublishPeerSet(round int, peerSet *conf.PeerSet) {
+	f.Publish(Message{
+		Type:  PeerSetChanged,
+		Round: round,
+		Peers: peerSet.Peers,
+	})
+}
+
+// Len returns the number of active subscriptions
+func (f *Feed) Len() int {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	return len(f.subs)
+}
+
+// Close evicts all the subscribers
+func (f *Feed) Close() {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	f.closed = true
+	for sub := range f.subs {
+		f.evict(sub, ErrClosed)
+	}
+}
+
+func (f *Feed) remove(sub *Subscription, reason error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.evict(sub, reason)
+}
+
+// evict must be called with the lock held
+func (f *Feed) evict(sub *Subscription, reason error) {
+	if _, ok := f.subs[sub]; !ok {
+		return
+	}
+	delete(f.subs, sub)
+	sub.err = reason
+	close(sub.c)
+}
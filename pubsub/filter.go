@@ -0,0 +1,220 @@
+package pubsub
+
+import (
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/bolaxy/core/parachain"
+	"github.com/bolaxy/core/types"
+)
+
+// Transaction is a transaction of a Block or Event selected by a Filter
+type Transaction struct {
+	Offset int // in the transactions of the Block or Event
+	Type   types.PayloadType
+	Data   []byte
+}
+
+// Filter selects the Messages of a Subscription before they are delivered,
+// and trims the Blocks and Events to the transactions it selects, so that the
+// subscribers do not receive the bodies they do not need. The zero Filter
+// selects everything.
+type Filter struct {
+	// Types are the MessageTypes delivered, all if empty
+	Types []MessageType
+	// Creators are the public keys, in hex, of the creators whose Events are
+	// delivered, all if empty. They do not apply to the other MessageTypes.
+	Creators []string
+	// PayloadTypes are the types of the transactions delivered, all if
+	// empty
+	PayloadTypes []types.PayloadType
+	// ChainIDs are the parachains whose messages are delivered, all if
+	// empty. Setting them selects the PayloadParachain transactions only.
+	ChainIDs []string
+	// InternalOnly delivers the InternalTransactions of the Blocks and
+	// Events instead of their transactions
+	InternalOnly bool
+}
+
+// trims returns true if the Filter trims the Blocks and Events
+func (f *Filter) trims() bool {
+	return len(f.PayloadTypes) > 0 || len(f.ChainIDs) > 0 || f.InternalOnly
+}
+
+// apply returns the Message as delivered, or false if it is not selected. A
+// trimmed Block or Event which has nothing left is not selected.
+func (f *Filter) apply(msg Message) (Message, bool) {
+	if f == nil {
+		return msg, true
+	}
+
+	if len(f.Types) > 0 && !f.selectsType(msg.Type) {
+		return msg, false
+	}
+	if msg.Type == EventCommitted && len(f.Creators) > 0 && !f.selectsCreator(msg.Creator) {
+		return msg, false
+	}
+	if !f.trims() {
+		return msg, true
+	}
+
+	var (
+		txs  [][]byte
+		pts  []types.PayloadType
+		itxs []types.InternalTransaction
+	)
+	switch {
+	case msg.Type == BlockCommitted && msg.Block != nil:
+		txs, pts, itxs = msg.Block.Transactions(), msg.Block.PayloadTypes(), msg.Block.InternalTransactions()
+		msg.Block = nil
+	case msg.Type == EventCommitted && msg.Event != nil:
+		txs, pts, itxs = msg.Event.Transactions(), msg.Event.PayloadTypes(), msg.Event.InternalTransactions()
+		msg.Event = nil
+	default:
+		return msg, true
+	}
+
+	if f.InternalOnly {
+		msg.InternalTransactions = itxs
+		return msg, len(itxs) > 0
+	}
+
+	msg.Transactions = f.transactions(txs, pts)
+	return msg, len(msg.Transactions) > 0
+}
+
+// transactions returns the transactions selected by the PayloadTypes and
+// ChainIDs. pts is parallel to txs.
+func (f *Filter) transactions(txs [][]byte, pts []types.PayloadType) []Transaction {
+	res := []Transaction{}
+	for i, tx := range txs {
+		if len(f.PayloadTypes) > 0 && !f.selectsPayload(pts[i]) {
+			continue
+		}
+		if len(f.ChainIDs) > 0 && !f.selectsChain(tx, pts[i]) {
+			continue
+		}
+		res = append(res, Transaction{
+			Offset: i,
+			Type:   pts[i],
+			Data:   tx,
+		})
+	}
+	return res
+}
+
+func (f *Filter) selectsType(t MessageType) bool {
+	for _, s := range f.Types {
+		if s == t {
+			return true
+		}
+	}
+	return false
+}
+
+func (f *Filter) selectsCreator(creator string) bool {
+	for _, c := range f.Creators {
+		if strings.EqualFold(c, creator) {
+			return true
+		}
+	}
+	return false
+}
+
+func (f *Filter) selectsPayload(t types.PayloadType) bool {
+	for _, s := range f.PayloadTypes {
+		if s == t {
+			return true
+		}
+	}
+	return false
+}
+
+func (f *Filter) selectsChain(tx []byte, t types.PayloadType) bool {
+	if t != types.PayloadParachain {
+		return false
+	}
+	m, err := parachain.ParseTransaction(tx)
+	if err != nil {
+		return false
+	}
+	for _, id := range f.ChainIDs {
+		if id == m.ChainID {
+			return true
+		}
+	}
+	return false
+}
+
+// ParseFilter reads a Filter from the parameters of a query: type, creator,
+// payload, and chain, repeated or separated by commas, and internal. The
+// types and payload types are given by name, like BLOCK or PARACHAIN, and the
+// payload types may also be given by number.
+func ParseFilter(q url.Values) (*Filter, error) {
+	f := &Filter{
+		Creators: list(q, "creator"),
+		ChainIDs: list(q, "chain"),
+	}
+
+	for _, s := range list(q, "type") {
+		t, err := parseMessageType(s)
+		if err != nil {
+			return nil, err
+		}
+		f.Types = append(f.Types, t)
+	}
+
+	for _, s := range list(q, "payload") {
+		t, err := parsePayloadType(s)
+		if err != nil {
+			return nil, err
+		}
+		f.PayloadTypes = append(f.PayloadTypes, t)
+	}
+
+	if s := q.Get("internal"); s != "" {
+		internal, err := strconv.ParseBool(s)
+		if err != nil {
+			return nil, fmt.Errorf("invalid internal: %v", err)
+		}
+		f.InternalOnly = internal
+	}
+
+	return f, nil
+}
+
+// list returns the values of a parameter, split at the commas
+func list(q url.Values, key string) []string {
+	var res []string
+	for _, v := range q[key] {
+		for _, s := range strings.Split(v, ",") {
+			if s = strings.TrimSpace(s); s != "" {
+				res = append(res, s)
+			}
+		}
+	}
+	return res
+}
+
+func parseMessageType(s string) (MessageType, error) {
+	for _, t := range []MessageType{BlockCommitted, ReceiptsCommitted, PeerSetChanged, EventCommitted} {
+		if strings.EqualFold(s, t.String()) {
+			return t, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown message type %q", s)
+}
+
+func parsePayloadType(s string) (types.PayloadType, error) {
+	if n, err := strconv.ParseUint(s, 10, 8); err == nil {
+		return types.PayloadType(n), nil
+	}
+	for t := types.PayloadApp; t <= types.PayloadParachain; t++ {
+		if strings.EqualFold(s, t.String()) {
+			return t, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown payload type %q", s)
+}
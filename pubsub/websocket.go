@@ -0,0 +1,206 @@
+package pubsub
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	wsGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+	wsOpText  = 0x1
+	wsOpClose = 0x8
+	wsOpPing  = 0x9
+	wsOpPong  = 0xA
+
+	wsWriteTimeout = 10 * time.Second
+	// wsMaxControlPayload is the maximum payload of frames sent by clients,
+	// which are only expected to send control frames.
+	wsMaxControlPayload = 125
+)
+
+// ServeWS upgrades an HTTP request to a WebSocket connection and streams the
+// feed's Messages as JSON text frames until the client disconnects or the
+// subscription is evicted. The Messages are filtered by the Filter of the
+// query, read by ParseFilter. It implements the minimal subset of RFC 6455
+// needed for a server-push feed.
+func (f *Feed) ServeWS(w http.ResponseWriter, r *http.Request) {
+	filter, err := ParseFilter(r.URL.Query())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	conn, rw, err := wsUpgrade(w, r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	defer conn.Close()
+
+	sub := f.SubscribeFilter(DefaultBufferSize, filter)
+	defer sub.Cancel()
+
+	//read client frames in the background to answer pings and detect closes
+	done := make(chan struct{})
+	pongs := make(chan []byte, 1)
+	go func() {
+		defer close(done)
+		for {
+			op, payload, err := wsReadFrame(rw.Reader)
+			if err != nil || op == wsOpClose {
+				return
+			}
+			if op == wsOpPing {
+				select {
+				case pongs <- payload:
+				default:
+				}
+			}
+		}
+	}()
+
+	for {
+		select {
+		case msg, ok := <-sub.C:
+			if !ok {
+				wsWriteFrame(conn, rw.Writer, wsOpClose, nil)
+				return
+			}
+			data, err := json.Marshal(msg)
+			if err != nil {
+				return
+			}
+			if err := wsWriteFrame(conn, rw.Writer, wsOpText, data); err != nil {
+				return
+			}
+		case payload := <-pongs:
+			if err := wsWriteFrame(conn, rw.Writer, wsOpPong, payload); err != nil {
+				return
+			}
+		case <-done:
+			return
+		}
+	}
+}
+
+func wsUpgrade(w http.ResponseWriter, r *http.Request) (net.Conn, *bufio.ReadWriter, error) {
+	if r.Method != http.MethodGet ||
+		!strings.EqualFold(r.Header.Get("Upgrade"), "websocket") ||
+		!strings.Contains(strings.ToLower(r.Header.Get("Connection")), "upgrade") {
+		return nil, nil, errors.New("not a websocket handshake")
+	}
+
+	key := r.Header.Get("Sec-WebSocket-Key")
+	if key == "" {
+		return nil, nil, errors.New("missing Sec-WebSocket-Key")
+	}
+
+	hj, ok := w.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("connection can not be hijacked")
+	}
+
+	conn, rw, err := hj.Hijack()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	h := sha1.New()
+	h.Write([]byte(key + wsGUID))
+	accept := base64.StdEncoding.EncodeToString(h.Sum(nil))
+
+	rw.WriteString("HTTP/1.1 101 Switching Protocols\r\n")
+	rw.WriteString("Upgrade: websocket\r\n")
+	rw.WriteString("Connection: Upgrade\r\n")
+	rw.WriteString("Sec-WebSocket-Accept: " + accept + "\r\n\r\n")
+	if err := rw.Flush(); err != nil {
+		conn.Close()
+		return nil, nil, err
+	}
+
+	return conn, rw, nil
+}
+
+func wsWriteFrame(conn net.Conn, w *bufio.Writer, op byte, payload []byte) error {
+	conn.SetWriteDeadline(time.Now().Add(wsWriteTimeout))
+
+	header := []byte{0x80 | op}
+	switch l := len(payload); {
+	case l < 126:
+		header = append(header, byte(l))
+	case l <= 0xFFFF:
+		header = append(header, 126, 0, 0)
+		binary.BigEndian.PutUint16(header[2:], uint16(l))
+	default:
+		header = append(header, 127, 0, 0, 0, 0, 0, 0, 0, 0)
+		binary.BigEndian.PutUint64(header[2:], uint64(l))
+	}
+
+	if _, err := w.Write(header); err != nil {
+		return err
+	}
+	if _, err := w.Write(payload); err != nil {
+		return err
+	}
+	return w.Flush()
+}
+
+func wsReadFrame(r *bufio.Reader) (byte, []byte, error) {
+	var h [2]byte
+	if _, err := io.ReadFull(r, h[:]); err != nil {
+		return 0, nil, err
+	}
+
+	op := h[0] & 0x0F
+	masked := h[1]&0x80 != 0
+	length := uint64(h[1] & 0x7F)
+
+	switch length {
+	case 126:
+		var ext [2]byte
+		if _, err := io.ReadFull(r, ext[:]); err != nil {
+			return 0, nil, err
+		}
+		length = uint64(binary.BigEndian.Uint16(ext[:]))
+	case 127:
+		var ext [8]byte
+		if _, err := io.ReadFull(r, ext[:]); err != nil {
+			return 0, nil, err
+		}
+		length = binary.BigEndian.Uint64(ext[:])
+	}
+
+	if length > wsMaxControlPayload {
+		return 0, nil, errors.New("client frame too large")
+	}
+
+	var mask [4]byte
+	if masked {
+		if _, err := io.ReadFull(r, mask[:]); err != nil {
+			return 0, nil, err
+		}
+	}
+
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return 0, nil, err
+	}
+
+	if masked {
+		for i := range payload {
+			payload[i] ^= mask[i%4]
+		}
+	}
+
+	return op, payload, nil
+}
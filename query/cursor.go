@@ -0,0 +1,76 @@
+package query
+
+import (
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+)
+
+// cursorVersion is the first byte of the encoded Cursors
+const cursorVersion = 1
+
+var (
+	// ErrInvalidCursor is returned for a cursor which was not returned by a
+	// range query
+	ErrInvalidCursor = errors.New("invalid cursor")
+	// ErrStaleCursor is returned for a cursor whose position no longer holds
+	// the item it pointed at, after the Store was reset by a fast-forward
+	ErrStaleCursor = errors.New("stale cursor")
+)
+
+// Cursor is the position of the last item of a page of a range query, from
+// which the next page starts. The clients get it encoded, and must treat it
+// as opaque.
+type Cursor struct {
+	Index  int // of the Block, or of the Event among the ones of its creator
+	Offset int // of the receipt in the Block
+	Round  int // of the item, to detect stale cursors; -1 if unknown
+}
+
+// Encode ...
+func (c Cursor) Encode() string {
+	buf := make([]byte, 1+3*binary.MaxVarintLen64)
+	buf[0] = cursorVersion
+	n := 1
+	n += binary.PutVarint(buf[n:], int64(c.Index))
+	n += binary.PutVarint(buf[n:], int64(c.Offset))
+	n += binary.PutVarint(buf[n:], int64(c.Round))
+	return base64.RawURLEncoding.EncodeToString(buf[:n])
+}
+
+// DecodeCursor returns ErrInvalidCursor if s is not an encoded Cursor
+func DecodeCursor(s string) (Cursor, error) {
+	buf, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil || len(buf) == 0 || buf[0] != cursorVersion {
+		return Cursor{}, ErrInvalidCursor
+	}
+	buf = buf[1:]
+
+	var fields [3]int64
+	for i := range fields {
+		v, n := binary.Varint(buf)
+		if n <= 0 {
+			return Cursor{}, ErrInvalidCursor
+		}
+		fields[i] = v
+		buf = buf[n:]
+	}
+	if len(buf) != 0 || fields[0] < 0 || fields[1] < 0 {
+		return Cursor{}, ErrInvalidCursor
+	}
+
+	return Cursor{
+		Index:  int(fields[0]),
+		Offset: int(fields[1]),
+		Round:  int(fields[2]),
+	}, nil
+}
+
+// check returns ErrStaleCursor if the item at the position of the Cursor is
+// not in its round
+func (c Cursor) check(round int) error {
+	if c.Round >= 0 && round >= 0 && c.Round != round {
+		return ErrStaleCursor
+	}
+	return nil
+}
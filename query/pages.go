@@ -0,0 +1,235 @@
+package query
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/bolaxy/core/types"
+)
+
+// BlockPage is a page of Blocks, in index order
+type BlockPage struct {
+	Blocks []*types.Block
+	Next   string `json:",omitempty"` //cursor of the next page
+}
+
+// EventPage is a page of the Events of a creator, in index order
+type EventPage struct {
+	Events []*types.Event
+	Next   string `json:",omitempty"` //cursor of the next page
+}
+
+// BlockReceipt is an InternalTransactionReceipt with its position in the
+// Block which committed it
+type BlockReceipt struct {
+	BlockIndex int
+	Offset     int
+	Receipt    types.InternalTransactionReceipt
+}
+
+// ReceiptPage is a page of receipts, in Block order
+type ReceiptPage struct {
+	Receipts []BlockReceipt
+	Next     string `json:",omitempty"` //cursor of the next page
+}
+
+// The range queries return pages which end with a cursor, from which the next
+// page starts. The items are in the order in which they were committed, which
+// the later commits only extend, so the pages neither skip nor repeat items
+// while the range grows. Each page is read under the lock, and a cursor is
+// refused with ErrStaleCursor if its item changed meanwhile. The cursor of a
+// page is empty when the range is exhausted, or when the page is empty and
+// no cursor was given.
+
+// GetBlocksPage returns up to limit Blocks of the range [from, to], or from
+// from on if to is negative, starting after cursor if it is not empty
+func (qs *QueryService) GetBlocksPage(from, to int, cursor string, limit int) (*BlockPage, error) {
+	prev, err := pageStart(from, cursor, limit)
+	if err != nil {
+		return nil, err
+	}
+
+	qs.lock.Lock()
+	defer qs.lock.Unlock()
+
+	start := from
+	if prev != nil {
+		block, err := qs.hg.Store.GetBlock(prev.Index)
+		if err != nil {
+			return nil, ErrStaleCursor
+		}
+		if err := prev.check(block.RoundReceived()); err != nil {
+			return nil, err
+		}
+		start = prev.Index + 1
+	}
+
+	last := qs.hg.Store.LastBlockIndex()
+	if to >= 0 && to < last {
+		last = to
+	}
+
+	page := &BlockPage{Blocks: []*types.Block{}}
+	end := prev
+	for i := start; i <= last && len(page.Blocks) < limit; i++ {
+		block, err := qs.hg.Store.GetBlock(i)
+		if err != nil {
+			return nil, err
+		}
+		page.Blocks = append(page.Blocks, copyBlock(block))
+		end = &Cursor{Index: i, Round: block.RoundReceived()}
+	}
+
+	if end != nil && (to < 0 || end.Index < to) {
+		page.Next = end.Encode()
+	}
+
+	return page, nil
+}
+
+// GetReceiptsPage returns up to limit InternalTransactionReceipts of the
+// Blocks of the range [from, to], or from from on if to is negative, starting
+// after cursor if it is not empty
+func (qs *QueryService) GetReceiptsPage(from, to int, cursor string, limit int) (*ReceiptPage, error) {
+	prev, err := pageStart(from, cursor, limit)
+	if err != nil {
+		return nil, err
+	}
+
+	qs.lock.Lock()
+	defer qs.lock.Unlock()
+
+	start, offset := from, 0
+	if prev != nil {
+		block, err := qs.hg.Store.GetBlock(prev.Index)
+		if err != nil || prev.Offset >= len(block.InternalTransactionReceipts()) {
+			return nil, ErrStaleCursor
+		}
+		if err := prev.check(block.RoundReceived()); err != nil {
+			return nil, err
+		}
+		start, offset = prev.Index, prev.Offset+1
+	}
+
+	last := qs.hg.Store.LastBlockIndex()
+	if to >= 0 && to < last {
+		last = to
+	}
+
+	page := &ReceiptPage{Receipts: []BlockReceipt{}}
+	end := prev
+	for i := start; i <= last && len(page.Receipts) < limit; i, offset = i+1, 0 {
+		block, err := qs.hg.Store.GetBlock(i)
+		if err != nil {
+			return nil, err
+		}
+
+		receipts := block.InternalTransactionReceipts()
+		for j := offset; j < len(receipts) && len(page.Receipts) < limit; j++ {
+			page.Receipts = append(page.Receipts, BlockReceipt{
+				BlockIndex: i,
+				Offset:     j,
+				Receipt:    receipts[j],
+			})
+			end = &Cursor{Index: i, Offset: j, Round: block.RoundReceived()}
+		}
+	}
+
+	if end != nil && (to < 0 || !qs.receiptsExhausted(end, to)) {
+		page.Next = end.Encode()
+	}
+
+	return page, nil
+}
+
+// receiptsExhausted returns true if there are no receipts after end up to the
+// Block to. It must be called with the lock.
+func (qs *QueryService) receiptsExhausted(end *Cursor, to int) bool {
+	if end.Index < to {
+		return false
+	}
+	block, err := qs.hg.Store.GetBlock(end.Index)
+	return err == nil && end.Offset+1 >= len(block.InternalTransactionReceipts())
+}
+
+// GetCreatorEvents returns up to limit Events of a creator, given by the hex
+// of its public key, from its first Event in the Store, or after cursor if it
+// is not empty
+func (qs *QueryService) GetCreatorEvents(creator string, cursor string, limit int) (*EventPage, error) {
+	prev, err := pageStart(0, cursor, limit)
+	if err != nil {
+		return nil, err
+	}
+	creator = strings.ToUpper(creator)
+
+	qs.lock.Lock()
+	defer qs.lock.Unlock()
+
+	skip := -1
+	if prev != nil {
+		hash, err := qs.hg.Store.ParticipantEvent(creator, prev.Index)
+		if err != nil {
+			return nil, ErrStaleCursor
+		}
+		event, err := qs.hg.Store.GetEvent(hash)
+		if err != nil {
+			return nil, ErrStaleCursor
+		}
+		if err := prev.check(eventRound(event)); err != nil {
+			return nil, err
+		}
+		skip = prev.Index
+	}
+
+	hashes, err := qs.hg.Store.ParticipantEvents(creator, skip)
+	if err != nil {
+		return nil, err
+	}
+
+	page := &EventPage{Events: []*types.Event{}}
+	end := prev
+	for _, hash := range hashes {
+		if len(page.Events) == limit {
+			break
+		}
+		event, err := qs.hg.Store.GetEvent(hash)
+		if err != nil {
+			return nil, err
+		}
+		page.Events = append(page.Events, copyEvent(event))
+		end = &Cursor{Index: event.Index(), Round: eventRound(event)}
+	}
+
+	if end != nil {
+		page.Next = end.Encode()
+	}
+
+	return page, nil
+}
+
+// pageStart decodes the cursor of a range query, if any
+func pageStart(from int, cursor string, limit int) (*Cursor, error) {
+	if limit <= 0 {
+		return nil, fmt.Errorf("invalid limit %d", limit)
+	}
+	if from < 0 {
+		return nil, fmt.Errorf("invalid from %d", from)
+	}
+	if cursor == "" {
+		return nil, nil
+	}
+
+	c, err := DecodeCursor(cursor)
+	if err != nil {
+		return nil, err
+	}
+	return &c, nil
+}
+
+// eventRound returns -1 if the round of the Event is not determined yet
+func eventRound(e *types.Event) int {
+	if r := e.GetRound(); r != nil {
+		return *r
+	}
+	return -1
+}
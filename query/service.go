@@ -0,0 +1,440 @@
+package query
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/bolaxy/config"
+	"github.com/bolaxy/core/audit"
+	"github.com/bolaxy/core/hashgraph"
+	"github.com/bolaxy/core/metrics"
+	"github.com/bolaxy/core/reputation"
+	"github.com/bolaxy/core/store"
+	"github.com/bolaxy/core/types"
+)
+
+// PendingRoundStats summarizes the rounds that have not reached consensus yet
+type PendingRoundStats struct {
+	Count               int
+	Decided             int
+	First               int //-1 if there are no pending rounds
+	Last                int //-1 if there are no pending rounds
+	UndeterminedEvents  int
+	PendingLoadedEvents int
+	PendingSignatures   int
+}
+
+// NodeStatus describes the participation of the node in consensus
+type NodeStatus struct {
+	State  string
+	Reason string `json:",omitempty"` //why the node is suspended
+	Since  time.Time
+	// Observer is set for nodes which follow consensus without taking part
+	Observer bool `json:",omitempty"`
+	// Eclipsed is set when the node knows Events of too few distinct
+	// creators in the last rounds, as if its peers hid the others
+	Eclipsed bool `json:",omitempty"`
+}
+
+// StatusSource provides the NodeStatus. It is implemented by node.Node.
+type StatusSource interface {
+	Status() NodeStatus
+}
+
+// HealthCheck is the outcome of one of the checks of a HealthReport
+type HealthCheck struct {
+	Name    string
+	OK      bool
+	Reason  string                 `json:",omitempty"` //why the check failed
+	Details map[string]interface{} `json:",omitempty"`
+}
+
+// HealthReport is the outcome of the liveness or readiness checks of the
+// node. OK is set if all the Checks are.
+type HealthReport struct {
+	OK     bool
+	Time   time.Time
+	Checks []HealthCheck
+}
+
+// HealthSource provides the liveness and the readiness of the node, without
+// waiting for the consensus. It is implemented by node.Node.
+type HealthSource interface {
+	Health() HealthReport
+	Ready() HealthReport
+}
+
+// HistoryFetcher fetches the history of rounds from other nodes. It is
+// implemented by node.Node.
+type HistoryFetcher interface {
+	FetchHistory(ctx context.Context, fromRound, toRound int) (*store.HistoryRange, error)
+}
+
+// ReputationSource provides the misbehaviour Records of the peers. It is
+// implemented by reputation.Reputation.
+type ReputationSource interface {
+	Records() []reputation.Record
+}
+
+// AuditSource provides the ordering records of the committed Blocks. It is
+// implemented by audit.Auditor.
+type AuditSource interface {
+	Get(ctx context.Context, blockIndex int) (*audit.BlockAudit, error)
+	Summary(ctx context.Context, from, to int) ([]audit.CreatorStats, error)
+}
+
+// QueryService exposes a read-only view of the consensus state for RPC
+// servers and explorers. The Hashgraph is not thread-safe, so every query is
+// run while holding lock, which must be the same lock the consensus holds
+// while inserting events. Returned objects are copies that the consensus will
+// not modify.
+type QueryService struct {
+	hg     *hashgraph.Hashgraph
+	lock   sync.Locker
+	status StatusSource
+	rep    ReputationSource
+	audits AuditSource
+	health HealthSource
+	fetch  HistoryFetcher
+}
+
+// NewQueryService ...
+func NewQueryService(hg *hashgraph.Hashgraph, lock sync.Locker) *QueryService {
+	return &QueryService{
+		hg:   hg,
+		lock: lock,
+	}
+}
+
+// SetStatusSource ...
+func (qs *QueryService) SetStatusSource(src StatusSource) {
+	qs.status = src
+}
+
+// GetNodeStatus returns false if no StatusSource was set
+func (qs *QueryService) GetNodeStatus() (NodeStatus, bool) {
+	if qs.status == nil {
+		return NodeStatus{}, false
+	}
+	return qs.status.Status(), true
+}
+
+// SetHealthSource ...
+func (qs *QueryService) SetHealthSource(src HealthSource) {
+	qs.health = src
+}
+
+// GetHealth returns the liveness checks, or false if no HealthSource was set
+func (qs *QueryService) GetHealth() (HealthReport, bool) {
+	if qs.health == nil {
+		return HealthReport{}, false
+	}
+	return qs.health.Health(), true
+}
+
+// GetReadiness returns the readiness checks, or false if no HealthSource was
+// set
+func (qs *QueryService) GetReadiness() (HealthReport, bool) {
+	if qs.health == nil {
+		return HealthReport{}, false
+	}
+	return qs.health.Ready(), true
+}
+
+// SetReputationSource ...
+func (qs *QueryService) SetReputationSource(src ReputationSource) {
+	qs.rep = src
+}
+
+// GetPeerReputations returns false if no ReputationSource was set
+func (qs *QueryService) GetPeerReputations() ([]reputation.Record, bool) {
+	if qs.rep == nil {
+		return nil, false
+	}
+	return qs.rep.Records(), true
+}
+
+// SetAuditSource ...
+func (qs *QueryService) SetAuditSource(src AuditSource) {
+	qs.audits = src
+}
+
+// GetOrderingAudit returns the ordering record of a Block, or false if no
+// AuditSource was set
+func (qs *QueryService) GetOrderingAudit(ctx context.Context, blockIndex int) (*audit.BlockAudit, bool, error) {
+	if qs.audits == nil {
+		return nil, false, nil
+	}
+	ba, err := qs.audits.Get(ctx, blockIndex)
+	return ba, true, err
+}
+
+// GetOrderingSummary returns the ordering statistics of the creators over a
+// range of Blocks, or false if no AuditSource was set
+func (qs *QueryService) GetOrderingSummary(ctx context.Context, from, to int) ([]audit.CreatorStats, bool, error) {
+	if qs.audits == nil {
+		return nil, false, nil
+	}
+	stats, err := qs.audits.Summary(ctx, from, to)
+	return stats, true, err
+}
+
+// GetConsensusStats returns the moving averages of the pace of consensus, or
+// false if the Hashgraph has no Stats
+func (qs *QueryService) GetConsensusStats() (metrics.StatsSnapshot, bool) {
+	s := qs.hg.Stats()
+	if s == nil {
+		return metrics.StatsSnapshot{}, false
+	}
+	return s.Snapshot(), true
+}
+
+// GetEvent returns a copy of an Event by hex hash
+func (qs *QueryService) GetEvent(hash string) (*types.Event, error) {
+	qs.lock.Lock()
+	defer qs.lock.Unlock()
+
+	event, err := qs.hg.Store.GetEvent(hash)
+	if err != nil {
+		return nil, err
+	}
+
+	return copyEvent(event), nil
+}
+
+// GetBlock returns a copy of a Block by index
+func (qs *QueryService) GetBlock(index int) (*types.Block, error) {
+	qs.lock.Lock()
+	defer qs.lock.Unlock()
+
+	block, err := qs.hg.Store.GetBlock(index)
+	if err != nil {
+		return nil, err
+	}
+
+	return copyBlock(block), nil
+}
+
+// GetLastBlockIndex returns -1 if no block was produced yet
+func (qs *QueryService) GetLastBlockIndex() int {
+	qs.lock.Lock()
+	defer qs.lock.Unlock()
+
+	return qs.hg.Store.LastBlockIndex()
+}
+
+// MaxBlockRange is the largest number of Blocks which
+// GetConsensusTransactions reads in one call, under the lock
+const MaxBlockRange = 100
+
+// GetConsensusTransactions returns the transactions of the blocks in the
+// range [from, to], in consensus order. The range spans at most MaxBlockRange
+// Blocks.
+func (qs *QueryService) GetConsensusTransactions(from, to int) ([][]byte, error) {
+	if from < 0 || from > to {
+		return nil, fmt.Errorf("invalid block range [%d, %d]", from, to)
+	}
+	if to-from >= MaxBlockRange {
+		return nil, fmt.Errorf("block range [%d, %d] spans more than %d blocks", from, to, MaxBlockRange)
+	}
+
+	qs.lock.Lock()
+	defer qs.lock.Unlock()
+
+	res := [][]byte{}
+	for i := from; i <= to; i++ {
+		block, err := qs.hg.Store.GetBlock(i)
+		if err != nil {
+			return nil, err
+		}
+		res = append(res, block.Transactions()...)
+	}
+
+	return res, nil
+}
+
+// SetHistoryFetcher sets where the history missing from the Store is fetched
+func (qs *QueryService) SetHistoryFetcher(f HistoryFetcher) {
+	qs.fetch = f
+}
+
+// GetHistory exports the history of a range of rounds. If the Store is not an
+// Archive, or pruned part of the range, the history is fetched with the
+// HistoryFetcher, if any.
+func (qs *QueryService) GetHistory(ctx context.Context, fromRound, toRound int) (*store.HistoryRange, error) {
+	history, err := qs.localHistory(fromRound, toRound)
+	if err == nil || qs.fetch == nil {
+		return history, err
+	}
+
+	return qs.fetch.FetchHistory(ctx, fromRound, toRound)
+}
+
+func (qs *QueryService) localHistory(fromRound, toRound int) (*store.HistoryRange, error) {
+	archive, ok := qs.hg.Store.(store.Archive)
+	if !ok {
+		return nil, fmt.Errorf("store does not export history")
+	}
+
+	qs.lock.Lock()
+	defer qs.lock.Unlock()
+
+	return archive.ExportRange(fromRound, toRound)
+}
+
+// GetPeerSet returns the peers of the PeerSet in effect at a given round
+func (qs *QueryService) GetPeerSet(round int) ([]*conf.Peer, error) {
+	qs.lock.Lock()
+	defer qs.lock.Unlock()
+
+	peerSet, err := qs.hg.Store.GetPeerSet(round)
+	if err != nil {
+		return nil, err
+	}
+
+	res := make([]*conf.Peer, len(peerSet.Peers))
+	copy(res, peerSet.Peers)
+
+	return res, nil
+}
+
+// ParamsInfo describes the ConsensusParams in force at a round
+type ParamsInfo struct {
+	Round     int
+	Params    *types.ConsensusParams         // nil if none were set
+	Scheduled map[int]*types.ConsensusParams // [round] => params set from round
+}
+
+// GetParams returns the ConsensusParams in force at a given round, with all
+// the ones recorded
+func (qs *QueryService) GetParams(round int) (*ParamsInfo, error) {
+	qs.lock.Lock()
+	defer qs.lock.Unlock()
+
+	params, err := qs.hg.Store.GetParams(round)
+	if err != nil {
+		return nil, err
+	}
+
+	all, err := qs.hg.Store.GetAllParams()
+	if err != nil {
+		return nil, err
+	}
+
+	return &ParamsInfo{
+		Round:     round,
+		Params:    params,
+		Scheduled: all,
+	}, nil
+}
+
+// GetLastConsensusRound returns nil if no round reached consensus yet
+func (qs *QueryService) GetLastConsensusRound() *int {
+	qs.lock.Lock()
+	defer qs.lock.Unlock()
+
+	if qs.hg.LastConsensusRound == nil {
+		return nil
+	}
+
+	r := *qs.hg.LastConsensusRound
+	return &r
+}
+
+// GetLastRound ...
+func (qs *QueryService) GetLastRound() int {
+	qs.lock.Lock()
+	defer qs.lock.Unlock()
+
+	return qs.hg.Store.LastRound()
+}
+
+// GetRound returns a copy of a RoundInfo
+func (qs *QueryService) GetRound(round int) (*types.RoundInfo, error) {
+	qs.lock.Lock()
+	defer qs.lock.Unlock()
+
+	ri, err := qs.hg.Store.GetRound(round)
+	if err != nil {
+		return nil, err
+	}
+
+	res := types.NewRoundInfo()
+	for k, v := range ri.CreatedEvents {
+		res.CreatedEvents[k] = v
+	}
+	res.ReceivedEvents = append(res.ReceivedEvents, ri.ReceivedEvents...)
+	res.Decided = ri.Decided
+
+	return res, nil
+}
+
+// GetPendingRoundStats ...
+func (qs *QueryService) GetPendingRoundStats() PendingRoundStats {
+	qs.lock.Lock()
+	defer qs.lock.Unlock()
+
+	pending := qs.hg.PendingRounds.GetOrderedPendingRounds()
+
+	stats := PendingRoundStats{
+		Count:               len(pending),
+		First:               -1,
+		Last:                -1,
+		UndeterminedEvents:  len(qs.hg.UndeterminedEvents),
+		PendingLoadedEvents: qs.hg.PendingLoadedEvents,
+		PendingSignatures:   qs.hg.PendingSignatures.Len(),
+	}
+
+	if len(pending) > 0 {
+		stats.First = pending[0].Index
+		stats.Last = pending[len(pending)-1].Index
+	}
+
+	for _, pr := range pending {
+		if pr.Decided {
+			stats.Decided++
+		}
+	}
+
+	return stats
+}
+
+func copyEvent(e *types.Event) *types.Event {
+	res := &types.Event{
+		Body:             e.Body,
+		Signature:        e.Signature,
+		TopologicalIndex: e.TopologicalIndex,
+		LastAncestors:    e.LastAncestors.Copy(),
+		FirstDescendants: e.FirstDescendants.Copy(),
+		Creator:          e.Creator,
+		Hash:             e.Hash,
+		Hex:              e.Hex,
+	}
+
+	if r := e.GetRound(); r != nil {
+		res.SetRound(*r)
+	}
+	if e.LamportTimestamp != nil {
+		res.SetLamportTimestamp(*e.LamportTimestamp)
+	}
+	if e.RoundReceived != nil {
+		res.SetRoundReceived(*e.RoundReceived)
+	}
+
+	return res
+}
+
+func copyBlock(b *types.Block) *types.Block {
+	res := &types.Block{
+		Body:       b.Body,
+		Signatures: make(map[string]string, len(b.Signatures)),
+	}
+
+	for k, v := range b.Signatures {
+		res.Signatures[k] = v
+	}
+
+	return res
+}
@@ -0,0 +1,206 @@
+package query
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/bolaxy/config"
+	"github.com/bolaxy/core/types"
+)
+
+// maxReceiptScan bounds the number of Blocks searched for the receipt of a
+// validator-set change, before the round in which it took effect
+const maxReceiptScan = 1000
+
+// ValidatorSetChange is the addition or the removal of a peer
+type ValidatorSetChange struct {
+	Peer  *conf.Peer
+	Added bool
+	// EffectiveRound is the first round of the PeerSet with the change
+	EffectiveRound int
+	// BlockIndex and RoundReceived locate the Block which committed the
+	// InternalTransaction of the change, with its Receipt; -1 if it was not
+	// found, like for the changes of a pruned history
+	BlockIndex    int
+	RoundReceived int
+	Receipt       *types.InternalTransactionReceipt `json:",omitempty"`
+}
+
+// ValidatorSetDiff describes the changes of the PeerSet between two rounds
+type ValidatorSetDiff struct {
+	FromRound int
+	ToRound   int
+	// Added and Removed are the peers of the PeerSet of ToRound which are
+	// not in the one of FromRound, and conversely
+	Added   []*conf.Peer
+	Removed []*conf.Peer
+	// Changes are all the changes which took effect after FromRound, up to
+	// ToRound, in round order. A peer removed then added again appears
+	// twice.
+	Changes []ValidatorSetChange
+}
+
+// GetValidatorSetChanges returns the changes of the PeerSet between the
+// rounds fromRound and toRound, with the receipts of the InternalTransactions
+// which made them
+func (qs *QueryService) GetValidatorSetChanges(fromRound, toRound int) (*ValidatorSetDiff, error) {
+	if fromRound < 0 || fromRound > toRound {
+		return nil, fmt.Errorf("invalid round range [%d, %d]", fromRound, toRound)
+	}
+
+	qs.lock.Lock()
+	defer qs.lock.Unlock()
+
+	from, err := qs.hg.Store.GetPeerSet(fromRound)
+	if err != nil {
+		return nil, err
+	}
+	to, err := qs.hg.Store.GetPeerSet(toRound)
+	if err != nil {
+		return nil, err
+	}
+
+	all, err := qs.hg.Store.GetAllPeerSets()
+	if err != nil {
+		return nil, err
+	}
+
+	rounds := []int{}
+	for r := range all {
+		if r > fromRound && r <= toRound {
+			rounds = append(rounds, r)
+		}
+	}
+	sort.Ints(rounds)
+
+	diff := &ValidatorSetDiff{
+		FromRound: fromRound,
+		ToRound:   toRound,
+		Changes:   []ValidatorSetChange{},
+	}
+	diff.Added, diff.Removed = diffPeers(from.Peers, to.Peers)
+
+	prev := from.Peers
+	for _, r := range rounds {
+		added, removed := diffPeers(prev, all[r])
+		for _, p := range added {
+			diff.Changes = append(diff.Changes, qs.validatorSetChange(p, true, r))
+		}
+		for _, p := range removed {
+			diff.Changes = append(diff.Changes, qs.validatorSetChange(p, false, r))
+		}
+		prev = all[r]
+	}
+
+	return diff, nil
+}
+
+// validatorSetChange finds the receipt of a change, in the last Block before
+// the round in which it took effect which accepted an InternalTransaction of
+// the same kind for the peer. It must be called with the lock.
+func (qs *QueryService) validatorSetChange(peer *conf.Peer, added bool, round int) ValidatorSetChange {
+	c := ValidatorSetChange{
+		Peer:           peer,
+		Added:          added,
+		EffectiveRound: round,
+		BlockIndex:     -1,
+		RoundReceived:  -1,
+	}
+
+	for i, n := qs.lastBlockBefore(round), 0; i >= 0 && n < maxReceiptScan; i, n = i-1, n+1 {
+		block, err := qs.hg.Store.GetBlock(i)
+		if err != nil {
+			break
+		}
+
+		receipts := block.InternalTransactionReceipts()
+		for j := len(receipts) - 1; j >= 0; j-- {
+			r := receipts[j]
+			if r.Accepted && changes(r.InternalTransaction, peer, added) {
+				c.BlockIndex = block.Index()
+				c.RoundReceived = block.RoundReceived()
+				c.Receipt = &r
+				return c
+			}
+		}
+	}
+
+	return c
+}
+
+// lastBlockBefore returns the index of the last Block whose RoundReceived is
+// before round, or -1. The RoundReceived of the Blocks grows with their
+// index. It must be called with the lock.
+func (qs *QueryService) lastBlockBefore(round int) int {
+	last := qs.hg.Store.LastBlockIndex()
+	n := sort.Search(last+1, func(i int) bool {
+		block, err := qs.hg.Store.GetBlock(i)
+		return err != nil || block.RoundReceived() >= round
+	})
+	return n - 1
+}
+
+// changes returns true if itx adds the peer, or removes it
+func changes(itx types.InternalTransaction, peer *conf.Peer, added bool) bool {
+	if !strings.EqualFold(itx.Body.Peer.PubKeyHex, peer.PubKeyHex) {
+		return false
+	}
+
+	switch itx.Body.Type {
+	case types.PEERADD:
+		return added
+	case types.PEERREMOVE, types.PEERSLASH, types.PEEREVICT:
+		return !added
+	default:
+		return false
+	}
+}
+
+// diffPeers returns the peers of b which are not in a, and the ones of a which
+// are not in b
+func diffPeers(a, b []*conf.Peer) (added, removed []*conf.Peer) {
+	added, removed = []*conf.Peer{}, []*conf.Peer{}
+
+	inA := make(map[uint32]bool, len(a))
+	for _, p := range a {
+		inA[p.ID()] = true
+	}
+	inB := make(map[uint32]bool, len(b))
+	for _, p := range b {
+		inB[p.ID()] = true
+		if !inA[p.ID()] {
+			added = append(added, p)
+		}
+	}
+	for _, p := range a {
+		if !inB[p.ID()] {
+			removed = append(removed, p)
+		}
+	}
+
+	return added, removed
+}
+
+// GetPeerSetProof returns the proof that the PeerSet set at round is in the
+// history committed by the PeerSetRoot of a Block. The Frame of the Block
+// must be in the Store.
+func (qs *QueryService) GetPeerSetProof(blockIndex, round int) (*types.PeerSetProof, error) {
+	qs.lock.Lock()
+	defer qs.lock.Unlock()
+
+	block, err := qs.hg.Store.GetBlock(blockIndex)
+	if err != nil {
+		return nil, err
+	}
+	if block.PeerSetRoot() == nil {
+		return nil, fmt.Errorf("block %d commits to no peer-set history", blockIndex)
+	}
+
+	frame, err := qs.hg.Store.GetFrame(block.RoundReceived())
+	if err != nil {
+		return nil, err
+	}
+
+	return types.NewPeerSetProof(frame, round)
+}
@@ -0,0 +1,150 @@
+// Package replay re-runs consensus on a recorded stream of Events, and
+// compares the Blocks it produces with the original ones. A divergence report
+// from production can then be debugged from the db of the node, or from a
+// stream exported from it, on any machine.
+package replay
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+
+	"github.com/bolaxy/config"
+	"github.com/bolaxy/core/store"
+	"github.com/bolaxy/core/types"
+	"github.com/bolaxy/errors"
+)
+
+// Recording is the input of a replay: the initial PeerSet, the Events in the
+// topological order in which they were inserted, and the Blocks that were
+// committed from them
+type Recording struct {
+	Peers  []*conf.Peer
+	Events []*types.Event
+	Blocks []*types.Block
+}
+
+// entry is a line of an exported stream. Exactly one of its fields is set.
+type entry struct {
+	Peers []*conf.Peer `json:",omitempty"`
+	Event *event       `json:",omitempty"`
+	Block *types.Block `json:",omitempty"`
+}
+
+// event is the signed part of an Event, from which the rest is recomputed
+type event struct {
+	Body      types.EventBody
+	Signature string
+}
+
+// FromStore records the history of the db of a CachedStore. The store must
+// hold the history from the initial PeerSet: a store which was Reset from a
+// Frame can not be replayed.
+func FromStore(s *store.CachedStore) (*Recording, error) {
+	if _, _, err := s.Base(); err == nil {
+		return nil, fmt.Errorf("store was reset from a frame, its history is incomplete")
+	} else if !errors.Is(err, errors.KeyNotFound) {
+		return nil, err
+	}
+
+	peerSets, err := s.PeerSetHistory()
+	if err != nil {
+		return nil, err
+	}
+	peers, ok := peerSets[0]
+	if !ok {
+		return nil, fmt.Errorf("store has no initial peer-set")
+	}
+
+	rec := &Recording{Peers: peers}
+
+	err = s.IterateEvents(0, func(ev *types.Event) bool {
+		rec.Events = append(rec.Events, &types.Event{
+			Body:      ev.Body,
+			Signature: ev.Signature,
+		})
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	checkpoint, err := s.LastCheckpoint()
+	if err != nil {
+		return nil, err
+	}
+
+	for i := 0; i <= checkpoint.LastBlockIndex; i++ {
+		block, err := s.GetBlock(i)
+		if err != nil {
+			return nil, fmt.Errorf("block %d: %v", i, err)
+		}
+		rec.Blocks = append(rec.Blocks, block)
+	}
+
+	return rec, nil
+}
+
+// Write exports the Recording as a stream of JSON lines: the initial PeerSet,
+// then the Events, then the Blocks
+func (rec *Recording) Write(w io.Writer) error {
+	bw := bufio.NewWriter(w)
+	enc := json.NewEncoder(bw)
+
+	if err := enc.Encode(entry{Peers: rec.Peers}); err != nil {
+		return err
+	}
+
+	for _, ev := range rec.Events {
+		if err := enc.Encode(entry{Event: &event{ev.Body, ev.Signature}}); err != nil {
+			return err
+		}
+	}
+
+	for _, b := range rec.Blocks {
+		if err := enc.Encode(entry{Block: b}); err != nil {
+			return err
+		}
+	}
+
+	return bw.Flush()
+}
+
+// Read imports a Recording exported with Write
+func Read(r io.Reader) (*Recording, error) {
+	dec := json.NewDecoder(bufio.NewReader(r))
+
+	rec := &Recording{}
+	for line := 1; ; line++ {
+		var e entry
+		if err := dec.Decode(&e); err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, fmt.Errorf("line %d: %v", line, err)
+		}
+
+		switch {
+		case e.Peers != nil:
+			if rec.Peers != nil {
+				return nil, fmt.Errorf("line %d: duplicate peer-set", line)
+			}
+			rec.Peers = e.Peers
+		case e.Event != nil:
+			rec.Events = append(rec.Events, &types.Event{
+				Body:      e.Event.Body,
+				Signature: e.Event.Signature,
+			})
+		case e.Block != nil:
+			rec.Blocks = append(rec.Blocks, e.Block)
+		default:
+			return nil, fmt.Errorf("line %d: empty entry", line)
+		}
+	}
+
+	if rec.Peers == nil {
+		return nil, fmt.Errorf("stream has no peer-set")
+	}
+
+	return rec, nil
+}
@@ -0,0 +1,246 @@
+package replay
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/bolaxy/config"
+	"github.com/bolaxy/core/hashgraph"
+	"github.com/bolaxy/core/logger"
+	"github.com/bolaxy/core/node"
+	"github.com/bolaxy/core/store"
+	"github.com/bolaxy/core/types"
+)
+
+// batch is the number of Events inserted between two runs of the consensus
+// methods
+const batch = 1000
+
+// Options must match the configuration of the node which produced the
+// Recording, since they change the Blocks
+type Options struct {
+	CacheSize           int
+	BlockLimits         types.BlockLimits
+	EmptyBlocks         hashgraph.EmptyBlockPolicy
+	EffectiveRoundDelay int
+	EvictionRounds      int
+	// StopAtDivergence stops the replay at the first divergent Block
+	StopAtDivergence bool
+	Logger           logger.Logger
+}
+
+// DefaultOptions matches the defaults of a Node
+func DefaultOptions() Options {
+	return Options{
+		CacheSize:           node.DefaultCacheSize,
+		EffectiveRoundDelay: node.DefaultEffectiveRoundDelay,
+	}
+}
+
+// Divergence is a replayed Block which differs from the original
+type Divergence struct {
+	Index         int
+	RoundReceived int
+	Expected      []byte // hash of the original Block's body, nil if missing
+	Actual        []byte // hash of the replayed Block's body
+	Reason        string
+}
+
+// Report is the result of a replay
+type Report struct {
+	Events      int
+	Blocks      int   // Blocks produced by the replay
+	Matched     int   // Blocks identical to the originals
+	Missing     []int // indexes of the original Blocks which were not produced
+	Divergences []Divergence
+	Duration    time.Duration
+}
+
+// OK returns true if the replay reproduced all the original Blocks
+func (r *Report) OK() bool {
+	return len(r.Divergences) == 0 && len(r.Missing) == 0
+}
+
+// errStop interrupts the replay at the first divergence
+var errStop = errors.New("divergence")
+
+// Run replays a Recording in a fresh in-memory Hashgraph. Every produced
+// Block is compared with the original of the same index. The state hash and
+// the InternalTransaction receipts of a Block are set by the application
+// after it is built, so they are taken from the original, as the application
+// would set them, and the PeerSet changes are applied like on a Node. An
+// error is returned if the replay itself fails, for example on an invalid
+// Event; divergences are only reported.
+func Run(ctx context.Context, rec *Recording, opts Options) (*Report, error) {
+	start := time.Now()
+	report := &Report{}
+
+	if opts.CacheSize <= 0 {
+		opts.CacheSize = node.DefaultCacheSize
+	}
+
+	originals := make(map[int]*types.Block, len(rec.Blocks))
+	for _, b := range rec.Blocks {
+		originals[b.Index()] = b
+	}
+
+	compare := func(ctx context.Context, block *types.Block) error {
+		report.Blocks++
+
+		d, err := compareBlock(block, originals[block.Index()])
+		if err != nil {
+			return err
+		}
+
+		if d == nil {
+			report.Matched++
+			return nil
+		}
+
+		report.Divergences = append(report.Divergences, *d)
+		logger.OrNop(opts.Logger).Warn("divergent block",
+			logger.Block, d.Index,
+			logger.Round, d.RoundReceived,
+			"reason", d.Reason)
+
+		if opts.StopAtDivergence {
+			return errStop
+		}
+		return nil
+	}
+
+	//the Membership wraps the comparison, like it wraps the application on
+	//a Node, and needs the Hashgraph
+	var commit hashgraph.CommitCallback
+	hg := hashgraph.NewHashgraph(store.NewInmemStore(opts.CacheSize), func(ctx context.Context, block *types.Block) error {
+		return commit(ctx, block)
+	})
+	membership := node.NewMembership(hg)
+	membership.SetEffectiveRoundDelay(opts.EffectiveRoundDelay)
+	membership.SetEvictionRounds(opts.EvictionRounds)
+	commit = membership.Wrap(compare)
+
+	hg.SetBlockLimits(opts.BlockLimits)
+	hg.SetEmptyBlockPolicy(opts.EmptyBlocks)
+	hg.SetLogger(opts.Logger)
+
+	if err := hg.Init(conf.NewPeerSet(rec.Peers)); err != nil {
+		return nil, err
+	}
+
+	err := replay(ctx, hg, rec.Events, report)
+	report.Duration = time.Since(start)
+
+	if err == errStop {
+		return report, nil
+	}
+	if err != nil {
+		return report, err
+	}
+
+	for _, b := range rec.Blocks {
+		if b.Index() > hg.Store.LastBlockIndex() {
+			report.Missing = append(report.Missing, b.Index())
+		}
+	}
+
+	return report, nil
+}
+
+func replay(ctx context.Context, hg *hashgraph.Hashgraph, events []*types.Event, report *Report) error {
+	for i, ev := range events {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		//the Event is copied, since the Hashgraph modifies it
+		event := &types.Event{
+			Body:      ev.Body,
+			Signature: ev.Signature,
+		}
+
+		if err := hg.InsertEvent(event, true); err != nil {
+			return fmt.Errorf("inserting event %d: %v", i, err)
+		}
+		report.Events++
+
+		if (i+1)%batch == 0 {
+			if err := hg.RunConsensus(ctx); err != nil {
+				return err
+			}
+		}
+	}
+
+	return hg.RunConsensus(ctx)
+}
+
+// compareBlock returns the Divergence of a replayed Block from its original,
+// or nil. The original's state hash and receipts are copied to the replayed
+// Block.
+func compareBlock(block, original *types.Block) (*Divergence, error) {
+	if original == nil {
+		hash, err := block.Body.Hash()
+		if err != nil {
+			return nil, err
+		}
+		return &Divergence{
+			Index:         block.Index(),
+			RoundReceived: block.RoundReceived(),
+			Actual:        hash,
+			Reason:        "no original block",
+		}, nil
+	}
+
+	block.Body.StateHash = original.Body.StateHash
+	block.Body.InternalTransactionReceipts = original.Body.InternalTransactionReceipts
+
+	expected, err := original.Body.Hash()
+	if err != nil {
+		return nil, err
+	}
+	actual, err := block.Body.Hash()
+	if err != nil {
+		return nil, err
+	}
+
+	if bytes.Equal(expected, actual) {
+		return nil, nil
+	}
+
+	return &Divergence{
+		Index:         block.Index(),
+		RoundReceived: block.RoundReceived(),
+		Expected:      expected,
+		Actual:        actual,
+		Reason:        diff(&original.Body, &block.Body),
+	}, nil
+}
+
+// diff describes the first difference between two Block bodies
+func diff(expected, actual *types.BlockBody) string {
+	switch {
+	case expected.RoundReceived != actual.RoundReceived:
+		return fmt.Sprintf("round received %d, expected %d", actual.RoundReceived, expected.RoundReceived)
+	case !bytes.Equal(expected.PeersHash, actual.PeersHash):
+		return "different peer-set"
+	case !bytes.Equal(expected.PeerSetRoot, actual.PeerSetRoot):
+		return "different peer-set history"
+	case len(expected.Transactions) != len(actual.Transactions):
+		return fmt.Sprintf("%d transactions, expected %d", len(actual.Transactions), len(expected.Transactions))
+	}
+
+	for i := range expected.Transactions {
+		if !bytes.Equal(expected.Transactions[i], actual.Transactions[i]) {
+			return fmt.Sprintf("transaction %d differs", i)
+		}
+	}
+
+	if len(expected.InternalTransactions) != len(actual.InternalTransactions) {
+		return fmt.Sprintf("%d internal transactions, expected %d", len(actual.InternalTransactions), len(expected.InternalTransactions))
+	}
+
+	return "different body"
+}
@@ -0,0 +1,240 @@
+// Package reputation records the misbehaviour of peers and turns it into
+// scores which the gossip and the rate limits consult.
+package reputation
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/bolaxy/core/db"
+	"github.com/bolaxy/core/logger"
+)
+
+const reputationPrefix = "reputation"
+
+// DefaultHalfLife is the default time after which a score is halved
+const DefaultHalfLife = time.Hour
+
+// Offence is a kind of misbehaviour
+type Offence int
+
+const (
+	// InvalidSignature is an Event or message whose signature does not verify
+	InvalidSignature Offence = iota
+	// Fork is an Event with the same creator and index as a known Event
+	Fork
+	// OversizedPayload is a message larger than allowed
+	OversizedPayload
+	// SyncTimeout is a sync request which was not answered in time
+	SyncTimeout
+	// QuotaExceeded is an Event whose transactions exceed the quota of its
+	// creator
+	QuotaExceeded
+)
+
+// String ...
+func (o Offence) String() string {
+	switch o {
+	case InvalidSignature:
+		return "invalid_signature"
+	case Fork:
+		return "fork"
+	case OversizedPayload:
+		return "oversized_payload"
+	case SyncTimeout:
+		return "sync_timeout"
+	case QuotaExceeded:
+		return "quota_exceeded"
+	default:
+		return "unknown"
+	}
+}
+
+// weight is the number of points an Offence adds to a score
+func (o Offence) weight() float64 {
+	switch o {
+	case InvalidSignature, Fork:
+		return 100
+	case OversizedPayload, QuotaExceeded:
+		return 50
+	default:
+		return 5
+	}
+}
+
+// Record is the misbehaviour accounting of a peer. Score is the sum of the
+// weights of its offences, halved every half-life, as of ScoredAt.
+type Record struct {
+	ID                uint32
+	InvalidSignatures int
+	Forks             int
+	OversizedPayloads int
+	SyncTimeouts      int
+	QuotaViolations   int
+	Score             float64
+	ScoredAt          time.Time
+}
+
+// Reputation keeps the Records of the peers. With a Sinker, every change is
+// persisted under the reputation prefix, which can be shared with a
+// CachedStore, and the Records survive restarts. It is safe for concurrent
+// use.
+type Reputation struct {
+	db       db.Sinker
+	halfLife time.Duration
+	logger   logger.Logger
+
+	lock    sync.Mutex
+	records map[uint32]*Record
+}
+
+// NewReputation loads the Records persisted in sinker. A nil sinker keeps the
+// Records in memory.
+func NewReputation(sinker db.Sinker) (*Reputation, error) {
+	r := &Reputation{
+		db:       sinker,
+		halfLife: DefaultHalfLife,
+		logger:   logger.Nop,
+		records:  make(map[uint32]*Record),
+	}
+
+	if sinker == nil {
+		return r, nil
+	}
+
+	prefix := []byte(reputationPrefix + "_")
+
+	it := sinker.NewIterator(false)
+	defer it.Close()
+
+	for it.Seek(prefix); it.ValidForPrefix(prefix); it.Next() {
+		data, err := it.Item().Value()
+		if err != nil {
+			return nil, err
+		}
+
+		rec := new(Record)
+		if err := json.Unmarshal(data, rec); err != nil {
+			return nil, err
+		}
+		r.records[rec.ID] = rec
+	}
+
+	return r, nil
+}
+
+// SetLogger ...
+func (r *Reputation) SetLogger(l logger.Logger) {
+	r.logger = logger.OrNop(l).With(logger.Component, "Reputation")
+}
+
+// SetHalfLife overrides DefaultHalfLife
+func (r *Reputation) SetHalfLife(d time.Duration) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.halfLife = d
+}
+
+func recordKey(id uint32) []byte {
+	return []byte(fmt.Sprintf("%s_%010d", reputationPrefix, id))
+}
+
+// Report records an Offence of peer id and returns its new score
+func (r *Reputation) Report(ctx context.Context, id uint32, o Offence) (float64, error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	now := time.Now()
+
+	rec, ok := r.records[id]
+	if !ok {
+		rec = &Record{ID: id}
+		r.records[id] = rec
+	}
+
+	switch o {
+	case InvalidSignature:
+		rec.InvalidSignatures++
+	case Fork:
+		rec.Forks++
+	case OversizedPayload:
+		rec.OversizedPayloads++
+	case SyncTimeout:
+		rec.SyncTimeouts++
+	case QuotaExceeded:
+		rec.QuotaViolations++
+	}
+
+	rec.Score = r.score(rec, now) + o.weight()
+	rec.ScoredAt = now
+
+	r.logger.Debug("offence reported",
+		"peer", id,
+		"offence", o,
+		"score", rec.Score)
+
+	if r.db == nil {
+		return rec.Score, nil
+	}
+
+	data, err := json.Marshal(rec)
+	if err != nil {
+		return rec.Score, err
+	}
+
+	return rec.Score, r.db.Put(ctx, recordKey(id), data)
+}
+
+// Score returns the current score of peer id. 0 means no misbehaviour.
+func (r *Reputation) Score(id uint32) float64 {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	rec, ok := r.records[id]
+	if !ok {
+		return 0
+	}
+
+	return r.score(rec, time.Now())
+}
+
+// Trust returns the trust in peer id, between 0 and 1. It is 1 for a peer
+// which never misbehaved, and halves with every 100 points of score.
+func (r *Reputation) Trust(id uint32) float64 {
+	return math.Pow(2, -r.Score(id)/100)
+}
+
+// Records returns copies of all the Records, with their current score, by
+// increasing ID
+func (r *Reputation) Records() []Record {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	now := time.Now()
+
+	res := make([]Record, 0, len(r.records))
+	for _, rec := range r.records {
+		cp := *rec
+		cp.Score = r.score(rec, now)
+		cp.ScoredAt = now
+		res = append(res, cp)
+	}
+
+	sort.Slice(res, func(i, j int) bool {
+		return res[i].ID < res[j].ID
+	})
+
+	return res
+}
+
+func (r *Reputation) score(rec *Record, now time.Time) float64 {
+	if r.halfLife <= 0 {
+		return rec.Score
+	}
+	return rec.Score * math.Pow(0.5, now.Sub(rec.ScoredAt).Seconds()/r.halfLife.Seconds())
+}
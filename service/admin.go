@@ -0,0 +1,328 @@
+package service
+
+import (
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/bolaxy/config"
+	"github.com/bolaxy/core/logger"
+	"github.com/bolaxy/core/query"
+	"github.com/bolaxy/core/store"
+	"github.com/bolaxy/core/transport"
+)
+
+// Admin is the control surface of a validator. It is implemented by
+// node.Node.
+type Admin interface {
+	Status() query.NodeStatus
+	Suspend()
+	Resume()
+	Prune(belowRound int) (int, error)
+	Snapshot() (*store.SnapshotRef, error)
+	Peers() ([]*conf.Peer, error)
+	Ban(peer uint32, d time.Duration) error
+	Unban(peer uint32)
+	Banned(peer uint32) bool
+	Traffic() map[uint32]transport.PeerTraffic
+}
+
+// AdminPeer is a peer of the PeerSet, as listed by the AdminService
+type AdminPeer struct {
+	*conf.Peer
+	ID     uint32
+	Banned bool
+}
+
+// AdminService is an HTTP server, on a listener of its own, from which
+// operators manage a validator without access to its data directory: they
+// suspend and resume it, prune its Store, take application snapshots, list
+// and ban peers, inspect their traffic, reload its config, and change its log level. Every request
+// must carry the token of the service as a bearer token. The mutations are
+// POST requests, and all the responses are JSON.
+type AdminService struct {
+	bindAddress string
+	token       string
+	admin       Admin
+	reload      func() error
+	log         logger.Leveled
+	logger      logger.Logger
+	mux         *http.ServeMux
+	server      *http.Server
+	listener    net.Listener
+}
+
+// NewAdminService returns an AdminService which requires token, which must
+// not be empty
+func NewAdminService(bindAddress, token string, admin Admin) (*AdminService, error) {
+	if token == "" {
+		return nil, errors.New("the admin service requires a token")
+	}
+
+	s := &AdminService{
+		bindAddress: bindAddress,
+		token:       token,
+		admin:       admin,
+		logger:      logger.Nop,
+	}
+
+	mux := http.NewServeMux()
+	s.mux = mux
+	mux.HandleFunc("/admin/status", s.get(s.getStatus))
+	mux.HandleFunc("/admin/suspend", s.post(s.suspend))
+	mux.HandleFunc("/admin/resume", s.post(s.resume))
+	mux.HandleFunc("/admin/prune", s.post(s.prune))
+	mux.HandleFunc("/admin/snapshot", s.post(s.snapshot))
+	mux.HandleFunc("/admin/peers", s.get(s.getPeers))
+	mux.HandleFunc("/admin/peers/ban", s.post(s.ban))
+	mux.HandleFunc("/admin/peers/unban", s.post(s.unban))
+	mux.HandleFunc("/admin/peers/traffic", s.get(s.getTraffic))
+	mux.HandleFunc("/admin/reload", s.post(s.reloadConfig))
+	mux.HandleFunc("/admin/loglevel", s.authenticated(s.logLevel))
+
+	s.server = &http.Server{
+		Addr:         bindAddress,
+		Handler:      mux,
+		ReadTimeout:  10 * time.Second,
+		WriteTimeout: time.Minute, //pruning and snapshots may take a while
+	}
+
+	return s, nil
+}
+
+// SetReloader enables /admin/reload, which calls f to read the config again
+// and apply it, typically with node.Node.Reload. It must be called before
+// Serve.
+func (s *AdminService) SetReloader(f func() error) {
+	s.reload = f
+}
+
+// SetLogLevel enables /admin/loglevel, which reads and changes the level of
+// l. It must be called before Serve.
+func (s *AdminService) SetLogLevel(l logger.Leveled) {
+	s.log = l
+}
+
+// SetLogger ...
+func (s *AdminService) SetLogger(l logger.Logger) {
+	s.logger = logger.OrNop(l).With(logger.Component, "AdminService")
+}
+
+// Serve starts listening and blocks until the server is closed
+func (s *AdminService) Serve() error {
+	l, err := net.Listen("tcp", s.bindAddress)
+	if err != nil {
+		return err
+	}
+	s.listener = l
+
+	err = s.server.Serve(l)
+	if err == http.ErrServerClosed {
+		return nil
+	}
+	return err
+}
+
+// Addr returns the address the server listens on, once Serve was called
+func (s *AdminService) Addr() string {
+	if s.listener == nil {
+		return s.bindAddress
+	}
+	return s.listener.Addr().String()
+}
+
+// Close ...
+func (s *AdminService) Close() error {
+	return s.server.Close()
+}
+
+// authenticated checks the bearer token of a request in constant time
+func (s *AdminService) authenticated(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if subtle.ConstantTimeCompare([]byte(token), []byte(s.token)) != 1 {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		h(w, r)
+	}
+}
+
+func (s *AdminService) get(h http.HandlerFunc) http.HandlerFunc {
+	return s.authenticated(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		h(w, r)
+	})
+}
+
+// post also logs the mutations, which are audited
+func (s *AdminService) post(h http.HandlerFunc) http.HandlerFunc {
+	return s.authenticated(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		s.logger.Info("admin request",
+			"path", r.URL.Path,
+			"query", r.URL.RawQuery,
+			"remote", r.RemoteAddr)
+		h(w, r)
+	})
+}
+
+func (s *AdminService) getStatus(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, r, s.admin.Status(), false)
+}
+
+func (s *AdminService) suspend(w http.ResponseWriter, r *http.Request) {
+	s.admin.Suspend()
+	writeJSON(w, r, s.admin.Status(), false)
+}
+
+func (s *AdminService) resume(w http.ResponseWriter, r *http.Request) {
+	s.admin.Resume()
+	writeJSON(w, r, s.admin.Status(), false)
+}
+
+// prune deletes the Round and Frame records below ?below=
+func (s *AdminService) prune(w http.ResponseWriter, r *http.Request) {
+	below, err := strconv.Atoi(r.URL.Query().Get("below"))
+	if err != nil {
+		http.Error(w, fmt.Sprintf("invalid below: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	deleted, err := s.admin.Prune(below)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+
+	writeJSON(w, r, map[string]int{"Deleted": deleted}, false)
+}
+
+func (s *AdminService) snapshot(w http.ResponseWriter, r *http.Request) {
+	ref, err := s.admin.Snapshot()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+
+	writeJSON(w, r, ref, false)
+}
+
+func (s *AdminService) getPeers(w http.ResponseWriter, r *http.Request) {
+	peers, err := s.admin.Peers()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	res := make([]AdminPeer, len(peers))
+	for i, p := range peers {
+		res[i] = AdminPeer{
+			Peer:   p,
+			ID:     p.ID(),
+			Banned: s.admin.Banned(p.ID()),
+		}
+	}
+
+	writeJSON(w, r, res, false)
+}
+
+// getTraffic returns the bytes exchanged with each peer, by ID
+func (s *AdminService) getTraffic(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, r, s.admin.Traffic(), false)
+}
+
+// ban bans the peer ?id= for ?duration=, a Go duration
+func (s *AdminService) ban(w http.ResponseWriter, r *http.Request) {
+	id, err := peerParam(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	d, err := time.ParseDuration(r.URL.Query().Get("duration"))
+	if err != nil {
+		http.Error(w, fmt.Sprintf("invalid duration: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	if err := s.admin.Ban(id, d); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	writeJSON(w, r, map[string]bool{"Banned": true}, false)
+}
+
+// unban lifts the ban of the peer ?id=
+func (s *AdminService) unban(w http.ResponseWriter, r *http.Request) {
+	id, err := peerParam(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	s.admin.Unban(id)
+
+	writeJSON(w, r, map[string]bool{"Banned": false}, false)
+}
+
+func (s *AdminService) reloadConfig(w http.ResponseWriter, r *http.Request) {
+	if s.reload == nil {
+		http.Error(w, "config reload not available", http.StatusNotFound)
+		return
+	}
+
+	if err := s.reload(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	writeJSON(w, r, map[string]bool{"Reloaded": true}, false)
+}
+
+// logLevel returns the log level on GET, and sets it to ?level= on POST
+func (s *AdminService) logLevel(w http.ResponseWriter, r *http.Request) {
+	if s.log == nil {
+		http.Error(w, "log level not available", http.StatusNotFound)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		level, err := logger.ParseLevel(r.URL.Query().Get("level"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		s.log.SetLevel(level)
+		s.logger.Info("log level changed",
+			"level", level,
+			"remote", r.RemoteAddr)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	writeJSON(w, r, map[string]string{"Level": s.log.GetLevel().String()}, false)
+}
+
+func peerParam(r *http.Request) (uint32, error) {
+	id, err := strconv.ParseUint(r.URL.Query().Get("id"), 10, 32)
+	if err != nil {
+		return 0, fmt.Errorf("invalid id: %v", err)
+	}
+	return uint32(id), nil
+}
@@ -0,0 +1,630 @@
+package service
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bolaxy/common/hexutil"
+	"github.com/bolaxy/core/anchor"
+	"github.com/bolaxy/core/pubsub"
+	"github.com/bolaxy/core/query"
+	"github.com/bolaxy/crypto"
+)
+
+const (
+	defaultPageSize = 50
+	maxPageSize     = 500
+	// maxHistoryRounds bounds the rounds of a page of history, whose Frames
+	// are large
+	maxHistoryRounds = 50
+)
+
+// Page is the envelope of paginated responses
+type Page struct {
+	Items  interface{}
+	Next   *int   `json:",omitempty"` //start of the next page, if any
+	Cursor string `json:",omitempty"` //cursor of the next page, if any
+}
+
+// Service is an optional embedded HTTP server exposing the consensus state
+// as JSON, backed by a QueryService.
+type Service struct {
+	bindAddress string
+	qs          *query.QueryService
+	mux         *http.ServeMux
+	server      *http.Server
+
+	lock     sync.Mutex
+	listener net.Listener //guarded by lock, set by Serve
+}
+
+// NewService ...
+func NewService(bindAddress string, qs *query.QueryService) *Service {
+	s := &Service{
+		bindAddress: bindAddress,
+		qs:          qs,
+	}
+
+	mux := http.NewServeMux()
+	s.mux = mux
+	mux.HandleFunc("/health", s.GetHealth)
+	mux.HandleFunc("/ready", s.GetReady)
+	mux.HandleFunc("/status", s.GetStatus)
+	mux.HandleFunc("/blocks", s.GetBlocks)
+	mux.HandleFunc("/blocks/", s.GetBlock)
+	mux.HandleFunc("/events", s.GetCreatorEvents)
+	mux.HandleFunc("/events/", s.GetEvent)
+	mux.HandleFunc("/receipts", s.GetReceipts)
+	mux.HandleFunc("/peers", s.GetPeers)
+	mux.HandleFunc("/peers/reputation", s.GetPeerReputations)
+	mux.HandleFunc("/peers/changes", s.GetValidatorSetChanges)
+	mux.HandleFunc("/peers/proof", s.GetPeerSetProof)
+	mux.HandleFunc("/params", s.GetParams)
+	mux.HandleFunc("/rounds/", s.GetRound)
+	mux.HandleFunc("/rounds/pending", s.GetPendingRounds)
+	mux.HandleFunc("/history", s.GetHistory)
+	mux.HandleFunc("/audit/", s.GetOrderingAudit)
+	mux.HandleFunc("/stats", s.GetStats)
+
+	s.server = &http.Server{
+		Addr:         bindAddress,
+		Handler:      mux,
+		ReadTimeout:  10 * time.Second,
+		WriteTimeout: 10 * time.Second,
+	}
+
+	return s
+}
+
+// SetFeed exposes a pub/sub Feed as a WebSocket endpoint at /subscribe. It
+// must be called before Serve.
+func (s *Service) SetFeed(feed *pubsub.Feed) {
+	s.mux.HandleFunc("/subscribe", feed.ServeWS)
+}
+
+// SetAnchors exposes the Anchors of a Checkpointer at /anchors/{index} and
+// /anchors/latest, for light clients and fast-forwarding peers. It must be
+// called before Serve.
+func (s *Service) SetAnchors(c *anchor.Checkpointer) {
+	s.mux.HandleFunc("/anchors/", func(w http.ResponseWriter, r *http.Request) {
+		s.getAnchor(c, w, r)
+	})
+}
+
+// Serve starts listening and blocks until the server is closed
+func (s *Service) Serve() error {
+	l, err := net.Listen("tcp", s.bindAddress)
+	if err != nil {
+		return err
+	}
+	s.lock.Lock()
+	s.listener = l
+	s.lock.Unlock()
+
+	err = s.server.Serve(l)
+	if err == http.ErrServerClosed {
+		return nil
+	}
+	return err
+}
+
+// Addr returns the address the server listens on, once Serve was called
+func (s *Service) Addr() string {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.listener == nil {
+		return s.bindAddress
+	}
+	return s.listener.Addr().String()
+}
+
+// Close ...
+func (s *Service) Close() error {
+	return s.server.Close()
+}
+
+// GetHealth returns the liveness checks of the HealthSource of the
+// QueryService, with 503 if one fails. They do not wait for the consensus, so
+// that the probes do not time out during long commits. Without a
+// HealthSource, it returns the progress of the consensus.
+func (s *Service) GetHealth(w http.ResponseWriter, r *http.Request) {
+	if report, ok := s.qs.GetHealth(); ok {
+		writeHealth(w, report)
+		return
+	}
+
+	res := map[string]interface{}{
+		"Status":         "OK",
+		"LastBlockIndex": s.qs.GetLastBlockIndex(),
+		"LastRound":      s.qs.GetLastRound(),
+	}
+
+	if lcr := s.qs.GetLastConsensusRound(); lcr != nil {
+		res["LastConsensusRound"] = *lcr
+	}
+
+	if status, ok := s.qs.GetNodeStatus(); ok {
+		res["State"] = status.State
+	}
+
+	writeJSON(w, r, res, false)
+}
+
+// GetReady returns the readiness checks of the HealthSource of the
+// QueryService, with 503 if one fails, or 404 if there is no HealthSource
+func (s *Service) GetReady(w http.ResponseWriter, r *http.Request) {
+	report, ok := s.qs.GetReadiness()
+	if !ok {
+		http.Error(w, "readiness not available", http.StatusNotFound)
+		return
+	}
+
+	writeHealth(w, report)
+}
+
+// GetStatus returns the NodeStatus, or 404 if the QueryService has no
+// StatusSource
+func (s *Service) GetStatus(w http.ResponseWriter, r *http.Request) {
+	status, ok := s.qs.GetNodeStatus()
+	if !ok {
+		http.Error(w, "node status not available", http.StatusNotFound)
+		return
+	}
+
+	writeJSON(w, r, status, false)
+}
+
+// GetBlocks returns a page of blocks starting at ?from= (default 0), or after
+// ?cursor=, up to ?to= if given, with at most ?limit= items
+func (s *Service) GetBlocks(w http.ResponseWriter, r *http.Request) {
+	from, limit, err := pageParams(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	to, err := toParam(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	res, err := s.qs.GetBlocksPage(from, to, r.URL.Query().Get("cursor"), limit)
+	if err != nil {
+		pageError(w, err)
+		return
+	}
+
+	page := Page{Items: res.Blocks, Cursor: res.Next}
+	if n := len(res.Blocks); n > 0 {
+		if next := res.Blocks[n-1].Index() + 1; next <= s.qs.GetLastBlockIndex() && res.Next != "" {
+			page.Next = &next
+		}
+	}
+
+	writeJSON(w, r, page, false)
+}
+
+// GetCreatorEvents returns a page of the events of the creator ?creator=,
+// the hex of its public key, from its first event in the Store, or after
+// ?cursor=, with at most ?limit= items
+func (s *Service) GetCreatorEvents(w http.ResponseWriter, r *http.Request) {
+	creator := r.URL.Query().Get("creator")
+	if creator == "" {
+		http.Error(w, "missing creator", http.StatusBadRequest)
+		return
+	}
+
+	_, limit, err := pageParams(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	res, err := s.qs.GetCreatorEvents(creator, r.URL.Query().Get("cursor"), limit)
+	if err != nil {
+		pageError(w, err)
+		return
+	}
+
+	writeJSON(w, r, Page{Items: res.Events, Cursor: res.Next}, false)
+}
+
+// GetReceipts returns a page of the internal transaction receipts of the
+// blocks starting at ?from= (default 0), or after ?cursor=, up to ?to= if
+// given, with at most ?limit= items
+func (s *Service) GetReceipts(w http.ResponseWriter, r *http.Request) {
+	from, limit, err := pageParams(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	to, err := toParam(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	res, err := s.qs.GetReceiptsPage(from, to, r.URL.Query().Get("cursor"), limit)
+	if err != nil {
+		pageError(w, err)
+		return
+	}
+
+	writeJSON(w, r, Page{Items: res.Receipts, Cursor: res.Next}, false)
+}
+
+// GetBlock returns the block at /blocks/{index}. Committed blocks never
+// change, apart from accumulating signatures, so responses carry an ETag.
+func (s *Service) GetBlock(w http.ResponseWriter, r *http.Request) {
+	index, err := strconv.Atoi(strings.TrimPrefix(r.URL.Path, "/blocks/"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	block, err := s.qs.GetBlock(index)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	writeJSON(w, r, block, true)
+}
+
+// GetEvent returns the event at /events/{hex}
+func (s *Service) GetEvent(w http.ResponseWriter, r *http.Request) {
+	hash := strings.TrimPrefix(r.URL.Path, "/events/")
+
+	event, err := s.qs.GetEvent(hash)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	writeJSON(w, r, event, true)
+}
+
+// GetStats returns the moving averages of the pace of consensus, or 404 if
+// the Hashgraph has no Stats
+func (s *Service) GetStats(w http.ResponseWriter, r *http.Request) {
+	stats, ok := s.qs.GetConsensusStats()
+	if !ok {
+		http.Error(w, "stats not available", http.StatusNotFound)
+		return
+	}
+
+	writeJSON(w, r, stats, false)
+}
+
+// GetPeers returns the peer-set of ?round= (default: the last round)
+func (s *Service) GetPeers(w http.ResponseWriter, r *http.Request) {
+	round := s.qs.GetLastRound()
+	if q := r.URL.Query().Get("round"); q != "" {
+		var err error
+		if round, err = strconv.Atoi(q); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	peers, err := s.qs.GetPeerSet(round)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	writeJSON(w, r, peers, true)
+}
+
+// GetParams returns the ConsensusParams in force at ?round=, or at the last
+// round, with the ones scheduled by round
+func (s *Service) GetParams(w http.ResponseWriter, r *http.Request) {
+	round := s.qs.GetLastRound()
+	if q := r.URL.Query().Get("round"); q != "" {
+		var err error
+		if round, err = strconv.Atoi(q); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	info, err := s.qs.GetParams(round)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	writeJSON(w, r, info, false)
+}
+
+// GetPeerReputations returns the misbehaviour Records of the peers, or 404 if
+// the QueryService has no ReputationSource
+func (s *Service) GetPeerReputations(w http.ResponseWriter, r *http.Request) {
+	records, ok := s.qs.GetPeerReputations()
+	if !ok {
+		http.Error(w, "peer reputations not available", http.StatusNotFound)
+		return
+	}
+
+	writeJSON(w, r, records, false)
+}
+
+// GetValidatorSetChanges returns the peers added and removed between the
+// rounds ?from= and ?to=, with the receipts of the changes. The range is
+// clamped to maxPageSize rounds; the Next page is the diff from its last
+// round.
+func (s *Service) GetValidatorSetChanges(w http.ResponseWriter, r *http.Request) {
+	from, to, next, err := rangeParams(r, maxPageSize)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if next != nil {
+		*next = to
+	}
+
+	diff, err := s.qs.GetValidatorSetChanges(from, to)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	writeJSON(w, r, Page{Items: diff, Next: next}, false)
+}
+
+// GetPeerSetProof returns the proof that the peer-set set at ?round= is in the
+// history committed by the block ?block=
+func (s *Service) GetPeerSetProof(w http.ResponseWriter, r *http.Request) {
+	block, err := strconv.Atoi(r.URL.Query().Get("block"))
+	if err != nil {
+		http.Error(w, fmt.Sprintf("invalid block: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	round, err := strconv.Atoi(r.URL.Query().Get("round"))
+	if err != nil {
+		http.Error(w, fmt.Sprintf("invalid round: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	proof, err := s.qs.GetPeerSetProof(block, round)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	writeJSON(w, r, proof, true)
+}
+
+// GetRound returns the RoundInfo at /rounds/{index}
+func (s *Service) GetRound(w http.ResponseWriter, r *http.Request) {
+	index, err := strconv.Atoi(strings.TrimPrefix(r.URL.Path, "/rounds/"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	round, err := s.qs.GetRound(index)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	writeJSON(w, r, round, true)
+}
+
+// GetHistory exports the Frames, Blocks, and PeerSets of the rounds ?from= to
+// ?to=, for the nodes which pruned them, in pages of at most
+// maxHistoryRounds rounds. Only archival nodes are guaranteed to have the
+// whole history.
+func (s *Service) GetHistory(w http.ResponseWriter, r *http.Request) {
+	from, to, next, err := rangeParams(r, maxHistoryRounds)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	history, err := s.qs.GetHistory(r.Context(), from, to)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	writeJSON(w, r, Page{Items: history, Next: next}, false)
+}
+
+// GetOrderingAudit returns the ordering record of the Block at
+// /audit/{index}, or at /audit/summary?from=&to= the statistics of the
+// creators over a range of Blocks, in pages of at most maxPageSize Blocks. It
+// returns 404 if the QueryService has no AuditSource.
+func (s *Service) GetOrderingAudit(w http.ResponseWriter, r *http.Request) {
+	param := strings.TrimPrefix(r.URL.Path, "/audit/")
+
+	if param == "summary" {
+		from, to, next, err := rangeParams(r, maxPageSize)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		stats, ok, err := s.qs.GetOrderingSummary(r.Context(), from, to)
+		if !ok {
+			http.Error(w, "ordering audit not available", http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		writeJSON(w, r, Page{Items: stats, Next: next}, false)
+		return
+	}
+
+	index, err := strconv.Atoi(param)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	ba, ok, err := s.qs.GetOrderingAudit(r.Context(), index)
+	if !ok {
+		http.Error(w, "ordering audit not available", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	writeJSON(w, r, ba, true)
+}
+
+func (s *Service) getAnchor(c *anchor.Checkpointer, w http.ResponseWriter, r *http.Request) {
+	param := strings.TrimPrefix(r.URL.Path, "/anchors/")
+
+	var a *anchor.Anchor
+	var err error
+	if param == "latest" {
+		a, err = c.Latest()
+	} else {
+		index, perr := strconv.Atoi(param)
+		if perr != nil {
+			http.Error(w, perr.Error(), http.StatusBadRequest)
+			return
+		}
+		a, err = c.Get(r.Context(), index)
+	}
+
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	writeJSON(w, r, a, param != "latest")
+}
+
+// GetPendingRounds ...
+func (s *Service) GetPendingRounds(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, r, s.qs.GetPendingRoundStats(), false)
+}
+
+// toParam returns -1 if ?to= is not given
+func toParam(r *http.Request) (int, error) {
+	q := r.URL.Query().Get("to")
+	if q == "" {
+		return -1, nil
+	}
+
+	to, err := strconv.Atoi(q)
+	if err != nil || to < 0 {
+		return 0, fmt.Errorf("invalid to: %s", q)
+	}
+	return to, nil
+}
+
+// pageError answers the failure of a range query: 400 for an invalid cursor,
+// and 410 for a stale one, which the client must drop
+func pageError(w http.ResponseWriter, err error) {
+	switch err {
+	case query.ErrInvalidCursor:
+		http.Error(w, err.Error(), http.StatusBadRequest)
+	case query.ErrStaleCursor:
+		http.Error(w, err.Error(), http.StatusGone)
+	default:
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+func pageParams(r *http.Request) (from int, limit int, err error) {
+	limit = defaultPageSize
+
+	if q := r.URL.Query().Get("from"); q != "" {
+		if from, err = strconv.Atoi(q); err != nil || from < 0 {
+			return 0, 0, fmt.Errorf("invalid from: %s", q)
+		}
+	}
+
+	if q := r.URL.Query().Get("limit"); q != "" {
+		if limit, err = strconv.Atoi(q); err != nil || limit <= 0 {
+			return 0, 0, fmt.Errorf("invalid limit: %s", q)
+		}
+	}
+
+	if limit > maxPageSize {
+		limit = maxPageSize
+	}
+
+	return from, limit, nil
+}
+
+// rangeParams parses the ?from= and ?to= of a range, clamped to max items.
+// next is the start of the rest of the range, if it was clamped.
+func rangeParams(r *http.Request, max int) (from int, to int, next *int, err error) {
+	q := r.URL.Query()
+
+	if from, err = strconv.Atoi(q.Get("from")); err != nil || from < 0 {
+		return 0, 0, nil, fmt.Errorf("invalid from: %s", q.Get("from"))
+	}
+	if to, err = strconv.Atoi(q.Get("to")); err != nil || to < from {
+		return 0, 0, nil, fmt.Errorf("invalid to: %s", q.Get("to"))
+	}
+
+	if to-from >= max {
+		to = from + max - 1
+		rest := to + 1
+		next = &rest
+	}
+
+	return from, to, next, nil
+}
+
+// writeHealth writes a HealthReport with 200 if it is OK, and 503 otherwise,
+// which is what load balancers and Kubernetes probes expect
+func writeHealth(w http.ResponseWriter, report query.HealthReport) {
+	body, err := json.Marshal(report)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	if !report.OK {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	w.Write(body)
+}
+
+// writeJSON encodes v. If etag is true, the response carries an ETag derived
+// from the body, and a matching If-None-Match yields a 304.
+func writeJSON(w http.ResponseWriter, r *http.Request, v interface{}, etag bool) {
+	body, err := json.Marshal(v)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+
+	if etag {
+		tag := fmt.Sprintf("\"%s\"", hexutil.Encode(crypto.Keccak256(body)))
+		w.Header().Set("ETag", tag)
+
+		if r.Header.Get("If-None-Match") == tag {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+	}
+
+	w.Write(body)
+}
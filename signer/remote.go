@@ -0,0 +1,316 @@
+package signer
+
+import (
+	"bufio"
+	"crypto/ecdsa"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/bolaxy/core/logger"
+	"github.com/bolaxy/crypto"
+)
+
+// DefaultTimeout bounds the requests to a remote signer
+const DefaultTimeout = 5 * time.Second
+
+const (
+	methodPublicKey = "PublicKey"
+	methodSign      = "Sign"
+)
+
+var (
+	// ErrServerClosed is returned by Server.Serve once the Server is closed
+	ErrServerClosed = errors.New("signer server closed")
+	// ErrInsecureRemote is returned by DialRemote for a signer which is
+	// neither on a unix socket nor on the loopback interface
+	ErrInsecureRemote = errors.New("remote signer must be on a unix socket or a loopback address, or use DialRemoteTLS")
+)
+
+// request and response are the messages of the remote signer protocol. Every
+// request uses its own connection: the client writes the JSON encoding of a
+// request, and reads back the JSON encoding of a response.
+type request struct {
+	Method string
+	Digest []byte `json:",omitempty"`
+}
+
+type response struct {
+	PublicKey []byte `json:",omitempty"` //uncompressed
+	Signature []byte `json:",omitempty"`
+	Error     string `json:",omitempty"`
+}
+
+/*******************************************************************************
+Client
+*******************************************************************************/
+
+// Remote is a Signer which forwards the digests to a remote signer, like a
+// Server in front of an HSM, usually over a unix socket. The signatures it
+// returns are verified against the public key fetched by DialRemote.
+type Remote struct {
+	network   string
+	addr      string
+	timeout   time.Duration
+	tlsConfig *tls.Config //nil without TLS
+	pub       *ecdsa.PublicKey
+}
+
+// DialRemote fetches the public key of the remote signer listening on addr.
+// network is "unix", or "tcp" with a loopback address, since the protocol is
+// not authenticated. A signer on another host is reached with DialRemoteTLS.
+// A timeout <= 0 means DefaultTimeout.
+func DialRemote(network, addr string, timeout time.Duration) (*Remote, error) {
+	switch network {
+	case "unix":
+	case "tcp":
+		if !isLoopback(addr) {
+			return nil, ErrInsecureRemote
+		}
+	default:
+		return nil, fmt.Errorf("unsupported network %q", network)
+	}
+
+	return dialRemote(&Remote{
+		network: network,
+		addr:    addr,
+		timeout: timeout,
+	})
+}
+
+// DialRemoteTLS fetches the public key of the remote signer listening on the
+// tcp address addr, over mutual TLS. config must carry the client certificate
+// which the Server verifies.
+func DialRemoteTLS(addr string, config *tls.Config, timeout time.Duration) (*Remote, error) {
+	if config == nil || (len(config.Certificates) == 0 && config.GetClientCertificate == nil) {
+		return nil, errors.New("remote signer TLS config without a client certificate")
+	}
+
+	return dialRemote(&Remote{
+		network:   "tcp",
+		addr:      addr,
+		timeout:   timeout,
+		tlsConfig: config,
+	})
+}
+
+func dialRemote(r *Remote) (*Remote, error) {
+	if r.timeout <= 0 {
+		r.timeout = DefaultTimeout
+	}
+
+	resp, err := r.call(&request{Method: methodPublicKey})
+	if err != nil {
+		return nil, err
+	}
+
+	r.pub, err = crypto.UnmarshalPubkey(resp.PublicKey)
+	if err != nil {
+		return nil, fmt.Errorf("remote signer public key: %v", err)
+	}
+
+	return r, nil
+}
+
+// Sign ...
+func (r *Remote) Sign(digest []byte) ([]byte, error) {
+	resp, err := r.call(&request{Method: methodSign, Digest: digest})
+	if err != nil {
+		return nil, err
+	}
+
+	if err := verify(r.pub, digest, resp.Signature); err != nil {
+		return nil, err
+	}
+
+	return resp.Signature, nil
+}
+
+// PublicKey ...
+func (r *Remote) PublicKey() *ecdsa.PublicKey {
+	return r.pub
+}
+
+func (r *Remote) call(req *request) (*response, error) {
+	var (
+		conn net.Conn
+		err  error
+	)
+	if r.tlsConfig != nil {
+		conn, err = tls.DialWithDialer(&net.Dialer{Timeout: r.timeout}, r.network, r.addr, r.tlsConfig)
+	} else {
+		conn, err = net.DialTimeout(r.network, r.addr, r.timeout)
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	conn.SetDeadline(time.Now().Add(r.timeout))
+
+	if err := json.NewEncoder(conn).Encode(req); err != nil {
+		return nil, err
+	}
+
+	var resp response
+	if err := json.NewDecoder(bufio.NewReader(conn)).Decode(&resp); err != nil {
+		return nil, err
+	}
+
+	if resp.Error != "" {
+		return nil, errors.New(resp.Error)
+	}
+
+	return &resp, nil
+}
+
+/*******************************************************************************
+Server
+*******************************************************************************/
+
+// Server serves a Signer to Remote clients. It is meant to listen on a unix
+// socket whose permissions restrict it to the node, since it signs any
+// digest it is given. On tcp, it only answers loopback clients, unless the
+// listener is a TLS listener which requires and verifies client certificates,
+// in which case it answers the clients with a verified certificate.
+type Server struct {
+	signer   Signer
+	listener net.Listener
+	logger   logger.Logger
+
+	shutdownLock sync.Mutex
+	shutdown     bool
+}
+
+// NewServer serves s on l once Serve is called
+func NewServer(s Signer, l net.Listener) *Server {
+	return &Server{
+		signer:   s,
+		listener: l,
+		logger:   logger.Nop,
+	}
+}
+
+// SetLogger ...
+func (s *Server) SetLogger(l logger.Logger) {
+	s.logger = logger.OrNop(l).With(logger.Component, "SignerServer")
+}
+
+// Serve answers the requests until the Server is closed, when it returns
+// ErrServerClosed
+func (s *Server) Serve() error {
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			if s.isShutdown() {
+				return ErrServerClosed
+			}
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				s.logger.Error("accepting connection", logger.Err, err)
+				continue
+			}
+			return err
+		}
+
+		go s.handleConn(conn)
+	}
+}
+
+// Close stops the Server and closes its listener
+func (s *Server) Close() error {
+	s.shutdownLock.Lock()
+	defer s.shutdownLock.Unlock()
+
+	if s.shutdown {
+		return nil
+	}
+	s.shutdown = true
+	return s.listener.Close()
+}
+
+func (s *Server) isShutdown() bool {
+	s.shutdownLock.Lock()
+	defer s.shutdownLock.Unlock()
+	return s.shutdown
+}
+
+func (s *Server) handleConn(conn net.Conn) {
+	defer conn.Close()
+
+	conn.SetDeadline(time.Now().Add(DefaultTimeout))
+
+	if err := authorize(conn); err != nil {
+		s.logger.Warn("refusing connection",
+			"remote", conn.RemoteAddr().String(),
+			logger.Err, err)
+		return
+	}
+
+	var req request
+	if err := json.NewDecoder(bufio.NewReader(conn)).Decode(&req); err != nil {
+		s.logger.Debug("reading request", logger.Err, err)
+		return
+	}
+
+	var resp response
+	switch req.Method {
+	case methodPublicKey:
+		resp.PublicKey = PublicKeyBytes(s.signer)
+	case methodSign:
+		if len(req.Digest) != 32 {
+			resp.Error = fmt.Sprintf("digest of %d bytes instead of 32", len(req.Digest))
+			break
+		}
+		sig, err := s.signer.Sign(req.Digest)
+		if err != nil {
+			resp.Error = err.Error()
+			break
+		}
+		resp.Signature = sig
+	default:
+		resp.Error = fmt.Sprintf("unknown method %q", req.Method)
+	}
+
+	if err := json.NewEncoder(conn).Encode(&resp); err != nil {
+		s.logger.Debug("writing response", logger.Err, err)
+	}
+}
+
+// authorize accepts the connections on a unix socket, from a loopback
+// address, or over TLS with a verified client certificate
+func authorize(conn net.Conn) error {
+	switch c := conn.(type) {
+	case *net.UnixConn:
+		return nil
+	case *tls.Conn:
+		if err := c.Handshake(); err != nil {
+			return err
+		}
+		if len(c.ConnectionState().VerifiedChains) == 0 {
+			return errors.New("no verified client certificate")
+		}
+		return nil
+	}
+
+	if addr, ok := conn.RemoteAddr().(*net.TCPAddr); ok && addr.IP.IsLoopback() {
+		return nil
+	}
+	return errors.New("not a loopback client")
+}
+
+// isLoopback returns true if the host of addr is a loopback address
+func isLoopback(addr string) bool {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return false
+	}
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
@@ -0,0 +1,61 @@
+// Package signer abstracts the private key of a validator, which signs its
+// Events, Blocks, InternalTransactions, and messages, so that the key can be
+// held outside the node, like in an HSM behind a remote signer.
+package signer
+
+import (
+	"crypto/ecdsa"
+	"errors"
+
+	"github.com/bolaxy/crypto"
+)
+
+// ErrBadSignature is returned when a signer returns a signature which does
+// not verify against its public key
+var ErrBadSignature = errors.New("signer returned an invalid signature")
+
+// Signer signs digests with the key of a validator
+type Signer interface {
+	// Sign returns the 65 bytes [R || S || V] signature of a 32 bytes
+	// digest, like crypto.Sign
+	Sign(digest []byte) ([]byte, error)
+	// PublicKey returns the public key of the signatures
+	PublicKey() *ecdsa.PublicKey
+}
+
+// Local signs with a private key held in memory
+type Local struct {
+	key *ecdsa.PrivateKey
+}
+
+// NewLocal ...
+func NewLocal(key *ecdsa.PrivateKey) *Local {
+	return &Local{key: key}
+}
+
+// Sign ...
+func (l *Local) Sign(digest []byte) ([]byte, error) {
+	return crypto.Sign(digest, l.key)
+}
+
+// PublicKey ...
+func (l *Local) PublicKey() *ecdsa.PublicKey {
+	return &l.key.PublicKey
+}
+
+// PublicKeyBytes returns the uncompressed public key of s, as in the Creator
+// of an Event or the Validator of a BlockSignature
+func PublicKeyBytes(s Signer) []byte {
+	return crypto.FromECDSAPub(s.PublicKey())
+}
+
+// verify checks that sig is a signature of digest by pub
+func verify(pub *ecdsa.PublicKey, digest, sig []byte) error {
+	if len(sig) != 65 {
+		return ErrBadSignature
+	}
+	if !crypto.VerifySignature(crypto.FromECDSAPub(pub), digest, sig[:64]) {
+		return ErrBadSignature
+	}
+	return nil
+}
@@ -0,0 +1,137 @@
+package store
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/bolaxy/config"
+	"github.com/bolaxy/core/types"
+)
+
+const archivalKey = "archival"
+
+// MaxExportRounds bounds the number of Rounds exported by ExportRange
+const MaxExportRounds = 100
+
+// ErrArchival is returned by Prune on an archival store
+var ErrArchival = errors.New("store is archival and can not be pruned")
+
+// Archive is implemented by the Stores which can export their history
+type Archive interface {
+	Archival() (bool, error)
+	ExportRange(fromRound, toRound int) (*HistoryRange, error)
+}
+
+// HistoryRange is the history of the Rounds FromRound to ToRound. The Frame of
+// a Round holds the Events received in that Round, in consensus order, and
+// the Blocks are the ones produced from these Frames. PeerSets are the
+// PeerSets in effect during the range, by the round from which they apply.
+type HistoryRange struct {
+	FromRound int
+	ToRound   int
+	Frames    []*types.Frame
+	Blocks    []*types.Block
+	PeerSets  map[int][]*conf.Peer
+}
+
+// SetArchival marks the db as archival, or not. The mark is persisted, so
+// that an archival db is never pruned, whichever process opens it. All the
+// Frames, Blocks, Events, and PeerSets are then retained.
+func (s *CachedStore) SetArchival(archival bool) error {
+	if archival {
+		return s.db.Put(s.ctx, []byte(archivalKey), []byte{1})
+	}
+	return s.db.Delete(s.ctx, []byte(archivalKey))
+}
+
+// Archival returns true if the db was marked archival
+func (s *CachedStore) Archival() (bool, error) {
+	return s.db.Has(s.ctx, []byte(archivalKey))
+}
+
+// ExportRange returns the history of the Rounds fromRound to toRound, which
+// must not span more than MaxExportRounds. It fails if a Frame of the range
+// is not in the store, because it was pruned or precedes the Frame the store
+// was Reset from.
+func (s *CachedStore) ExportRange(fromRound, toRound int) (*HistoryRange, error) {
+	if fromRound < 0 || fromRound > toRound {
+		return nil, fmt.Errorf("invalid round range [%d, %d]", fromRound, toRound)
+	}
+	if toRound-fromRound >= MaxExportRounds {
+		return nil, fmt.Errorf("round range [%d, %d] exceeds %d rounds", fromRound, toRound, MaxExportRounds)
+	}
+
+	if err := s.Flush(); err != nil {
+		return nil, err
+	}
+
+	res := &HistoryRange{
+		FromRound: fromRound,
+		ToRound:   toRound,
+		Frames:    []*types.Frame{},
+		PeerSets:  make(map[int][]*conf.Peer),
+	}
+
+	for r := fromRound; r <= toRound; r++ {
+		frame, err := s.GetFrame(r)
+		if err != nil {
+			return nil, fmt.Errorf("frame %d: %v", r, err)
+		}
+		res.Frames = append(res.Frames, frame)
+	}
+
+	blocks, err := s.exportBlocks(fromRound, toRound)
+	if err != nil {
+		return nil, err
+	}
+	res.Blocks = blocks
+
+	peerSets, err := s.dbPeerSets()
+	if err != nil {
+		return nil, err
+	}
+	for i, ps := range peerSets {
+		if ps.round > toRound {
+			break
+		}
+		//the last PeerSet before the range is in effect at its start
+		if ps.round < fromRound && i+1 < len(peerSets) && peerSets[i+1].round <= fromRound {
+			continue
+		}
+		res.PeerSets[ps.round] = ps.peerSet.Peers
+	}
+
+	return res, nil
+}
+
+// exportBlocks returns the Blocks of the db produced by the Rounds fromRound
+// to toRound. Blocks are produced in Round order, so the iteration stops at
+// the first Block after the range.
+func (s *CachedStore) exportBlocks(fromRound, toRound int) ([]*types.Block, error) {
+	prefix := []byte(blockPrefix + "_")
+
+	it := s.db.NewIterator(false)
+	defer it.Close()
+
+	res := []*types.Block{}
+	for it.Seek(prefix); it.ValidForPrefix(prefix); it.Next() {
+		data, err := it.Item().Value()
+		if err != nil {
+			return nil, err
+		}
+
+		block, err := s.decodeBlock(data)
+		if err != nil {
+			return nil, err
+		}
+
+		if block.RoundReceived() > toRound {
+			break
+		}
+		if block.RoundReceived() >= fromRound {
+			res = append(res, block)
+		}
+	}
+
+	return res, nil
+}
@@ -0,0 +1,225 @@
+package store
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+
+	"github.com/bolaxy/core/db"
+	"github.com/bolaxy/core/types"
+	"github.com/bolaxy/crypto"
+)
+
+// bodyPrefix is the Partition of the db where the transaction bodies are
+// kept, unless SetExternalBodies gives another Sinker
+const bodyPrefix = "body_"
+
+// bodiesPrunedKey holds the round below which Prune released the bodies
+const bodiesPrunedKey = "bodies_pruned"
+
+// ErrBodyPruned is returned when reading a Block whose external transaction
+// bodies were deleted by Prune
+var ErrBodyPruned = errors.New("transaction body pruned")
+
+// storedBlock is the form of a Block in the db. The transactions kept in the
+// body store are left empty in the Block, and Bodies holds their hashes.
+type storedBlock struct {
+	*types.Block
+	Bodies map[int]string `json:",omitempty"` // [tx index] => hex of the hash of the body
+}
+
+// SetExternalBodies keeps the transactions of at least minSize bytes of the
+// Blocks written from now on in a BlobStore on top of bodies, while the
+// Blocks in the db only keep their hashes. bodies can be a db at another
+// path, owned by the caller; nil keeps them in a Partition of the db. A
+// minSize of 0 stores the Blocks whole again. The Blocks read back have
+// their transactions, so a db at another path must be given again when the
+// store is reopened. It must not be called concurrently with the other
+// methods.
+func (s *CachedStore) SetExternalBodies(bodies db.Sinker, minSize int) {
+	if bodies == nil {
+		bodies = db.NewPartition(s.db, bodyPrefix)
+	}
+	s.bodies = db.NewBlobStore(bodies)
+	s.minBodySize = minSize
+}
+
+// encodeBlock returns the form of block written in the db, after storing its
+// large transactions in the BlobStore. A Block holds a reference to each of
+// its bodies; the ones of the version of the Block it replaces, like before
+// new signatures were added, are carried over. It must be called with the
+// bodyLock.
+func (s *CachedStore) encodeBlock(block *types.Block) ([]byte, error) {
+	if s.minBodySize <= 0 {
+		return block.Marshal()
+	}
+
+	prev, err := s.storedBodies(block.Index())
+	if err != nil {
+		return nil, err
+	}
+
+	txs := block.Transactions()
+	stored := storedBlock{Bodies: make(map[int]string)}
+
+	copied := *block
+	copied.Body.Transactions = make([][]byte, len(txs))
+
+	for i, tx := range txs {
+		if len(tx) < s.minBodySize {
+			copied.Body.Transactions[i] = tx
+			continue
+		}
+
+		key := hex.EncodeToString(crypto.Keccak256(tx))
+		if prev[i] != key {
+			if _, err := s.bodies.Put(s.ctx, tx); err != nil {
+				return nil, err
+			}
+		}
+
+		stored.Bodies[i] = key
+	}
+
+	for i, key := range prev {
+		if stored.Bodies[i] != key {
+			if err := s.releaseBody(key); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	if len(stored.Bodies) == 0 {
+		return block.Marshal()
+	}
+
+	stored.Block = &copied
+	return json.Marshal(stored)
+}
+
+// storedBodies returns the hashes of the bodies of the Block in the dirty
+// set or the db, if any
+func (s *CachedStore) storedBodies(index int) (map[int]string, error) {
+	data, err := s.read(blockKey(index))
+	if err == db.ErrKeyNotFound {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	stored := storedBlock{Block: new(types.Block)}
+	if err := json.Unmarshal(data, &stored); err != nil {
+		return nil, err
+	}
+
+	return stored.Bodies, nil
+}
+
+func (s *CachedStore) releaseBody(key string) error {
+	hash, err := hex.DecodeString(key)
+	if err != nil {
+		return err
+	}
+	return s.bodies.Release(s.ctx, hash)
+}
+
+// decodeBlock reads a Block written by encodeBlock, with its transactions
+func (s *CachedStore) decodeBlock(data []byte) (*types.Block, error) {
+	stored := storedBlock{Block: new(types.Block)}
+	if err := json.Unmarshal(data, &stored); err != nil {
+		return nil, err
+	}
+
+	if err := s.loadBodies(stored); err != nil {
+		return nil, err
+	}
+
+	return stored.Block, nil
+}
+
+// loadBodies fills the transactions of a storedBlock from the BlobStore
+func (s *CachedStore) loadBodies(stored storedBlock) error {
+	block := stored.Block
+	for i, key := range stored.Bodies {
+		if i < 0 || i >= len(block.Body.Transactions) {
+			return fmt.Errorf("block %d: body of transaction %d out of range", block.Index(), i)
+		}
+
+		hash, err := hex.DecodeString(key)
+		if err != nil {
+			return fmt.Errorf("block %d: body of transaction %d: %v", block.Index(), i, err)
+		}
+
+		tx, err := s.bodies.Get(s.ctx, hash)
+		if err != nil {
+			if err == db.ErrKeyNotFound {
+				return ErrBodyPruned
+			}
+			return fmt.Errorf("block %d: body of transaction %d: %v", block.Index(), i, err)
+		}
+
+		block.Body.Transactions[i] = tx
+	}
+
+	return nil
+}
+
+// pruneBodies returns the bodies referenced by the Blocks of the rounds from
+// the last pruned one to belowRound, whose references Prune releases, and
+// that round
+func (s *CachedStore) pruneBodies(belowRound int) ([]string, int, error) {
+	from := 0
+	if data, err := s.db.Get(s.ctx, []byte(bodiesPrunedKey)); err == nil {
+		if from, err = strconv.Atoi(string(data)); err != nil {
+			return nil, 0, err
+		}
+	} else if err != db.ErrKeyNotFound {
+		return nil, 0, err
+	}
+
+	res := []string{}
+
+	prefix := []byte(blockPrefix + "_")
+	it := s.db.NewIterator(false)
+	defer it.Close()
+
+	for it.Seek(prefix); it.ValidForPrefix(prefix); it.Next() {
+		data, err := it.Item().Value()
+		if err != nil {
+			return nil, 0, err
+		}
+
+		stored := storedBlock{Block: new(types.Block)}
+		if err := json.Unmarshal(data, &stored); err != nil {
+			return nil, 0, err
+		}
+
+		//Blocks are produced in Round order
+		if stored.RoundReceived() >= belowRound {
+			break
+		}
+		if stored.RoundReceived() < from {
+			continue
+		}
+		for _, key := range stored.Bodies {
+			res = append(res, key)
+		}
+	}
+
+	return res, from, nil
+}
+
+// collectBodies releases the references of the pruned or truncated Blocks to
+// their bodies, and deletes the bodies left without references. It returns the number of
+// deleted bodies.
+func (s *CachedStore) collectBodies(keys []string) (int, error) {
+	for _, key := range keys {
+		if err := s.releaseBody(key); err != nil {
+			return 0, err
+		}
+	}
+	return s.bodies.GC(s.ctx)
+}
@@ -0,0 +1,240 @@
+package store
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/bolaxy/core/db"
+	"github.com/bolaxy/core/types"
+	"github.com/bolaxy/errors"
+)
+
+const baseKey = "base"
+
+// Empty returns true if nothing was ever flushed to the db
+func (s *CachedStore) Empty() (bool, error) {
+	ok, err := s.db.Has(s.ctx, []byte(checkpointKey))
+	return !ok, err
+}
+
+// LoadPeerSets loads the PeerSets of the db in the hot tier, with the
+// ConsensusParams. PeerSets which are already loaded are skipped.
+func (s *CachedStore) LoadPeerSets() error {
+	peerSets, err := s.dbPeerSets()
+	if err != nil {
+		return err
+	}
+
+	for _, ps := range peerSets {
+		if err := s.SetPeerSet(ps.round, ps.peerSet); err != nil && !errors.Is(err, errors.KeyAlreadyExists) {
+			return err
+		}
+	}
+
+	return s.loadParams()
+}
+
+// loadParams loads the ConsensusParams of the db in the hot tier
+func (s *CachedStore) loadParams() error {
+	prefix := []byte(paramsPrefix + "_")
+
+	it := s.db.NewIterator(false)
+	defer it.Close()
+
+	for it.Seek(prefix); it.ValidForPrefix(prefix); it.Next() {
+		round, err := strconv.Atoi(strings.TrimPrefix(string(it.Item().Key()), string(prefix)))
+		if err != nil {
+			continue
+		}
+
+		data, err := it.Item().Value()
+		if err != nil {
+			return err
+		}
+
+		params := new(types.ConsensusParams)
+		if err := json.Unmarshal(data, params); err != nil {
+			return err
+		}
+
+		if err := s.inmemStore.SetParams(round, params); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Base returns the Frame and the Block from which the store was Reset. The
+// Block is the first one in the db, since the Blocks below it were never
+// stored. It returns a KeyNotFound error if the store was never Reset.
+func (s *CachedStore) Base() (*types.Frame, *types.Block, error) {
+	data, err := s.read([]byte(baseKey))
+	if err != nil {
+		if err == db.ErrKeyNotFound {
+			return nil, nil, errors.NewStoreErr("CachedStore.Base", errors.KeyNotFound, baseKey)
+		}
+		return nil, nil, err
+	}
+
+	round, err := strconv.Atoi(string(data))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	frame, err := s.GetFrame(round)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	block, err := s.firstBlock()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return frame, block, nil
+}
+
+func (s *CachedStore) firstBlock() (*types.Block, error) {
+	prefix := []byte(blockPrefix + "_")
+
+	it := s.db.NewIterator(false)
+	defer it.Close()
+
+	it.Seek(prefix)
+	if !it.ValidForPrefix(prefix) {
+		return nil, errors.NewStoreErr("CachedStore.Blocks", errors.Empty, "")
+	}
+
+	data, err := it.Item().Value()
+	if err != nil {
+		return nil, err
+	}
+
+	return s.decodeBlock(data)
+}
+
+// SetReplay is set while a Hashgraph is reloaded from the db. Rounds are then
+// only read from the hot tier, where they are recomputed, and the Blocks
+// which are in the db are kept with their Signatures rather than replaced by
+// their recomputed, unsigned, version.
+func (s *CachedStore) SetReplay(replay bool) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.replay = replay
+}
+
+func (s *CachedStore) replaying() bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.replay
+}
+
+// replayBlock returns the version of a recomputed Block which is in the db,
+// after checking that they were built from the same Frame. The receipts and
+// the state hash are set after the Block is built, so they are not compared.
+func (s *CachedStore) replayBlock(block *types.Block) (*types.Block, error) {
+	data, err := s.read(blockKey(block.Index()))
+	if err != nil {
+		if err == db.ErrKeyNotFound {
+			return block, nil
+		}
+		return nil, err
+	}
+
+	stored, err := s.decodeBlock(data)
+	if err != nil {
+		return nil, err
+	}
+
+	storedBody, err := stored.Body.Hash()
+	if err != nil {
+		return nil, err
+	}
+
+	body := block.Body
+	body.StateHash = stored.Body.StateHash
+	body.InternalTransactionReceipts = stored.Body.InternalTransactionReceipts
+
+	bodyHash, err := body.Hash()
+	if err != nil {
+		return nil, err
+	}
+
+	if !bytes.Equal(storedBody, bodyHash) {
+		return nil, fmt.Errorf("replayed block %d differs from the stored one", block.Index())
+	}
+
+	//the FrameHash is not serialized
+	stored.Body.FrameHash = block.Body.FrameHash
+
+	return stored, nil
+}
+
+/*******************************************************************************
+Cache checkpoints
+*******************************************************************************/
+
+const cacheCheckpointKey = "cache_checkpoint"
+
+// SnapshotRef identifies a snapshot of the application state, taken after
+// the Block BlockIndex, by the Keccak256 hash of its bytes
+type SnapshotRef struct {
+	BlockIndex int
+	Hash       []byte
+}
+
+// CacheCheckpoint is a point from which the hot tier can be rebuilt without
+// replaying all the Events. The Frame of Round and the Block BlockIndex are in
+// the db, and so are the Events from TopologicalIndex, the first Event which
+// had not reached consensus at Round. Known is the index of the last Event of
+// each creator covered by the Frame, and PendingRounds the Rounds which were
+// waiting for consensus. Snapshot is the latest application snapshot which
+// was served or restored, if any.
+type CacheCheckpoint struct {
+	Round            int
+	BlockIndex       int
+	TopologicalIndex int
+	Known            map[uint32]int
+	PendingRounds    []types.PendingRound
+	Snapshot         *SnapshotRef `json:",omitempty"`
+}
+
+// SetCacheCheckpoint stages a CacheCheckpoint, which is written with the next
+// flush, after everything it points to.
+func (s *CachedStore) SetCacheCheckpoint(cp *CacheCheckpoint) error {
+	data, err := json.Marshal(cp)
+	if err != nil {
+		return err
+	}
+
+	return s.stage([]byte(cacheCheckpointKey), data)
+}
+
+// GetCacheCheckpoint returns the last CacheCheckpoint, or a KeyNotFound error
+// if none was written
+func (s *CachedStore) GetCacheCheckpoint() (*CacheCheckpoint, error) {
+	data, err := s.read([]byte(cacheCheckpointKey))
+	if err != nil {
+		if err == db.ErrKeyNotFound {
+			return nil, errors.NewStoreErr("CachedStore.CacheCheckpoint", errors.KeyNotFound, cacheCheckpointKey)
+		}
+		return nil, err
+	}
+
+	cp := new(CacheCheckpoint)
+	if err := json.Unmarshal(data, cp); err != nil {
+		return nil, err
+	}
+
+	return cp, nil
+}
+
+// ResetCache resets the hot tier from a Frame, like Reset, but leaves the db
+// untouched. It is used to rebuild the hot tier from a CacheCheckpoint.
+func (s *CachedStore) ResetCache(frame *types.Frame) error {
+	return s.inmemStore.Reset(frame)
+}
@@ -0,0 +1,133 @@
+package store
+
+import (
+	"github.com/bolaxy/core/metrics"
+	"github.com/bolaxy/core/types"
+)
+
+// maxEvictionScan bounds the number of items of a cache looked at by each
+// enforcement of a MemoryBudget, so that a cache full of items which can not
+// be evicted does not slow down every write
+const maxEvictionScan = 256
+
+// Estimated sizes, in bytes, of the parts of the cached items which are not
+// transactions
+const (
+	eventOverhead       = 512
+	ancestorSize        = 200 // entry of LastAncestors or FirstDescendants
+	itxSize             = 256
+	blockSignatureSize  = 256
+	blockOverhead       = 512
+	roundOverhead       = 256
+	roundEventSize      = 160 // entry of CreatedEvents
+	receivedEventSize   = 90  // entry of ReceivedEvents
+	frameOverhead       = 256
+	peerSize            = 256
+	transactionOverhead = 24
+)
+
+// MemoryBudget bounds the bytes held by the caches of the hot tier of a
+// CachedStore. When they exceed the limit, the coldest Frames, Blocks, and
+// decided Events are evicted: they are already in the dirty set or the db,
+// where the reads which miss the caches find them. The undecided Events and
+// the Rounds are never evicted, so the limit can be exceeded when they alone
+// take more than it. The sizes are estimates.
+//
+// The metrics of a MemoryBudget can be registered on a metrics.Registry. All
+// methods are safe to call on a nil *MemoryBudget, which disables it.
+type MemoryBudget struct {
+	limit int64
+
+	Used      *metrics.Gauge
+	Hits      *metrics.Counter
+	Misses    *metrics.Counter
+	Evictions *metrics.Counter
+}
+
+// NewMemoryBudget creates a MemoryBudget of limit bytes
+func NewMemoryBudget(limit int64) *MemoryBudget {
+	return &MemoryBudget{
+		limit:     limit,
+		Used:      metrics.NewGauge("core_store_cache_bytes", "Estimated bytes held by the caches of the store."),
+		Hits:      metrics.NewCounter("core_store_cache_hits_total", "Number of reads served by the caches of the store."),
+		Misses:    metrics.NewCounter("core_store_cache_misses_total", "Number of reads which missed the caches of the store."),
+		Evictions: metrics.NewCounter("core_store_cache_evictions_total", "Number of items evicted from the caches to respect the memory budget."),
+	}
+}
+
+// Register registers the metrics of the MemoryBudget
+func (b *MemoryBudget) Register(reg *metrics.Registry) {
+	if b == nil {
+		return
+	}
+	reg.MustRegister(b.Used, b.Hits, b.Misses, b.Evictions)
+}
+
+// Limit ...
+func (b *MemoryBudget) Limit() int64 {
+	if b == nil {
+		return 0
+	}
+	return b.limit
+}
+
+func (b *MemoryBudget) hit() {
+	if b != nil {
+		b.Hits.Inc()
+	}
+}
+
+func (b *MemoryBudget) miss() {
+	if b != nil {
+		b.Misses.Inc()
+	}
+}
+
+/*******************************************************************************
+Size estimates
+*******************************************************************************/
+
+func transactionsSize(txs [][]byte) int64 {
+	size := int64(0)
+	for _, tx := range txs {
+		size += int64(len(tx)) + transactionOverhead
+	}
+	return size
+}
+
+func eventSize(event *types.Event) int64 {
+	return eventOverhead +
+		transactionsSize(event.Body.Transactions) +
+		int64(len(event.Body.InternalTransactions))*itxSize +
+		int64(len(event.Body.BlockSignatures))*blockSignatureSize +
+		int64(len(event.LastAncestors)+len(event.FirstDescendants))*ancestorSize
+}
+
+func blockSize(block *types.Block) int64 {
+	return blockOverhead +
+		transactionsSize(block.Body.Transactions) +
+		int64(len(block.Body.InternalTransactions))*itxSize +
+		int64(len(block.Signatures))*blockSignatureSize
+}
+
+func roundSize(round *types.RoundInfo) int64 {
+	return roundOverhead +
+		int64(len(round.CreatedEvents))*roundEventSize +
+		int64(len(round.ReceivedEvents))*receivedEventSize
+}
+
+func frameSize(frame *types.Frame) int64 {
+	size := int64(frameOverhead) + int64(len(frame.Peers))*peerSize
+	for _, fe := range frame.Events {
+		size += eventSize(fe.Core)
+	}
+	for _, root := range frame.Roots {
+		for _, fe := range root.Events {
+			size += eventSize(fe.Core)
+		}
+	}
+	for _, peers := range frame.PeerSets {
+		size += int64(len(peers)) * peerSize
+	}
+	return size
+}
@@ -0,0 +1,1253 @@
+package store
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bolaxy/common"
+	"github.com/bolaxy/config"
+	"github.com/bolaxy/core/db"
+	"github.com/bolaxy/core/logger"
+	"github.com/bolaxy/core/types"
+	"github.com/bolaxy/errors"
+)
+
+const (
+	topoPrefix    = "topo"
+	roundPrefix   = "round"
+	blockPrefix   = "block"
+	framePrefix   = "frame"
+	rootSuffix    = "root"
+	peerSetPrefix = "peerset"
+	paramsPrefix  = "params"
+	forkPrefix    = "fork"
+	checkpointKey = "checkpoint"
+	stateKey      = "consensus_state"
+
+	// DefaultMaxDirty is the default number of pending writes after which
+	// writers block until the dirty set is flushed.
+	DefaultMaxDirty = 10000
+	// DefaultFlushPeriod is the default interval between background flushes.
+	DefaultFlushPeriod = 500 * time.Millisecond
+)
+
+// Checkpoint is written atomically with every flushed batch. Everything it
+// points to is guaranteed to be in the db.
+type Checkpoint struct {
+	LastTopologicalIndex int
+	LastRound            int
+	LastBlockIndex       int
+	LastFrameRound       int
+}
+
+// ConsensusState is the part of the state of a Hashgraph which only lives in
+// memory: the Rounds waiting for consensus and the Block Signatures not yet
+// matched to a Block. Checkpoint is the checkpoint written with it; a
+// ConsensusState is current only if it equals the checkpoint in the db.
+type ConsensusState struct {
+	LastConsensusRound *int
+	PendingRounds      []types.PendingRound
+	PendingSignatures  []types.BlockSignature
+	Checkpoint         Checkpoint
+}
+
+// ShutdownReport describes what was persisted by Shutdown
+type ShutdownReport struct {
+	Flushed    int        // writes flushed by Shutdown
+	Unflushed  int        // writes lost because the flush failed
+	Checkpoint Checkpoint // checkpoint in the db when it was closed
+	Duration   time.Duration
+}
+
+// CachedStore is a two-tier Store. The hot tail of the hashgraph is held by
+// an InmemStore while writes are queued in a bounded dirty set and flushed to
+// the db in batches by a background goroutine, keeping fsyncs off the
+// consensus critical path. Reads that miss the hot tier fall through to the
+// dirty set and then to the db.
+type CachedStore struct {
+	inmemStore  *InmemStore
+	db          db.Sinker
+	maxDirty    int
+	flushPeriod time.Duration
+	budget      *MemoryBudget
+	readCache   *ReadCache
+
+	// bodies holds the large transactions of the Blocks, see
+	// SetExternalBodies. bodyLock keeps Prune from collecting the bodies of
+	// a Block being written.
+	bodies      *db.BlobStore
+	minBodySize int
+	bodyLock    sync.Mutex
+
+	flushLock  sync.Mutex
+	lock       sync.Mutex
+	cond       *sync.Cond
+	dirty      map[string][]byte
+	flushing   map[string][]byte
+	checkpoint Checkpoint
+	flushErr   error
+	replay     bool
+	batching   bool //within InsertEventBatch
+
+	flushCh chan struct{}
+	closeCh chan struct{}
+	doneCh  chan struct{}
+
+	// ctx is passed to the operations on the db. It is cancelled by Close,
+	// after the last flush, so that concurrent reads fail instead of racing
+	// with the closing of the db.
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	logger logger.Logger
+}
+
+// NewCachedStore creates a CachedStore on top of an open db. The background
+// flusher is started immediately.
+func NewCachedStore(sinker db.Sinker, cacheSize int, maxDirty int, flushPeriod time.Duration) *CachedStore {
+	if maxDirty <= 0 {
+		maxDirty = DefaultMaxDirty
+	}
+	if flushPeriod <= 0 {
+		flushPeriod = DefaultFlushPeriod
+	}
+
+	s := &CachedStore{
+		inmemStore:  NewInmemStore(cacheSize),
+		db:          sinker,
+		maxDirty:    maxDirty,
+		flushPeriod: flushPeriod,
+		dirty:       make(map[string][]byte),
+		flushing:    make(map[string][]byte),
+		checkpoint: Checkpoint{
+			LastTopologicalIndex: -1,
+			LastRound:            -1,
+			LastBlockIndex:       -1,
+			LastFrameRound:       -1,
+		},
+		flushCh: make(chan struct{}, 1),
+		closeCh: make(chan struct{}),
+		doneCh:  make(chan struct{}),
+		logger:  logger.Nop,
+	}
+	s.bodies = db.NewBlobStore(db.NewPartition(sinker, bodyPrefix))
+	s.cond = sync.NewCond(&s.lock)
+	s.ctx, s.cancel = context.WithCancel(context.Background())
+
+	go s.flushLoop()
+
+	return s
+}
+
+// SetLogger sets the logger of the store and of its hot tier
+func (s *CachedStore) SetLogger(l logger.Logger) {
+	s.logger = logger.OrNop(l).With(logger.Component, "CachedStore")
+	s.inmemStore.SetLogger(l)
+}
+
+// SetMemoryBudget bounds the bytes held by the caches of the hot tier. The
+// items evicted to respect it are read back from the db when needed. nil
+// removes the bound. It must not be called concurrently with the other
+// methods.
+func (s *CachedStore) SetMemoryBudget(b *MemoryBudget) {
+	s.budget = b
+	s.inmemStore.enforceBudget(b)
+}
+
+// MemoryBudget ...
+func (s *CachedStore) MemoryBudget() *MemoryBudget {
+	return s.budget
+}
+
+// SetReadCache caches the Blocks and Frames decoded from the db in c. nil
+// removes the cache. It must not be called concurrently with the other
+// methods.
+func (s *CachedStore) SetReadCache(c *ReadCache) {
+	s.readCache = c
+}
+
+// ReadCache ...
+func (s *CachedStore) ReadCache() *ReadCache {
+	return s.readCache
+}
+
+// MemoryUsage returns the estimated bytes held by the caches of the hot tier
+func (s *CachedStore) MemoryUsage() int64 {
+	return s.inmemStore.MemoryUsage()
+}
+
+/*******************************************************************************
+Keys
+*******************************************************************************/
+
+func topologicalEventKey(index int) []byte {
+	return []byte(fmt.Sprintf("%s_%09d", topoPrefix, index))
+}
+
+func participantEventPrefix(participant string) []byte {
+	return []byte(fmt.Sprintf("%s__event_", participant))
+}
+
+func participantEventKey(participant string, index int) []byte {
+	return []byte(fmt.Sprintf("%s%09d", participantEventPrefix(participant), index))
+}
+
+func participantRootKey(participant string) []byte {
+	return []byte(fmt.Sprintf("%s_%s", participant, rootSuffix))
+}
+
+func roundKey(index int) []byte {
+	return []byte(fmt.Sprintf("%s_%09d", roundPrefix, index))
+}
+
+func blockKey(index int) []byte {
+	return []byte(fmt.Sprintf("%s_%09d", blockPrefix, index))
+}
+
+func frameKey(index int) []byte {
+	return []byte(fmt.Sprintf("%s_%09d", framePrefix, index))
+}
+
+func forkEvidenceKey(creator string, index int) []byte {
+	return []byte(fmt.Sprintf("%s_%s_%09d", forkPrefix, creator, index))
+}
+
+func peerSetKey(round int) []byte {
+	return []byte(fmt.Sprintf("%s_%09d", peerSetPrefix, round))
+}
+
+func paramsKey(round int) []byte {
+	return []byte(fmt.Sprintf("%s_%09d", paramsPrefix, round))
+}
+
+/*******************************************************************************
+Write-behind
+*******************************************************************************/
+
+// stage queues a write in the dirty set. It blocks while the dirty set is
+// full, which applies backpressure to the consensus when the db lags. Writes
+// are refused when the db is read-only, and while the dirty set is full after
+// a failed flush, until a retry succeeds. Within InsertEventBatch, the dirty
+// set grows beyond its bound instead.
+func (s *CachedStore) stage(key []byte, val []byte) error {
+	if s.db.ReadOnly() {
+		return db.ErrReadOnly
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	for len(s.dirty) >= s.maxDirty && !s.batching {
+		if s.flushErr != nil {
+			return s.flushErr
+		}
+		s.requestFlush()
+		s.cond.Wait()
+	}
+
+	s.dirty[string(key)] = val
+	return nil
+}
+
+// InsertEventBatch runs insert, which sets the Events of a batch, without
+// flushing in between, so that the next flush writes them to the db in a
+// single batch
+func (s *CachedStore) InsertEventBatch(insert func()) {
+	s.flushLock.Lock()
+	s.lock.Lock()
+	s.batching = true
+	s.lock.Unlock()
+
+	insert()
+
+	s.lock.Lock()
+	s.batching = false
+	full := len(s.dirty) >= s.maxDirty
+	s.lock.Unlock()
+	s.flushLock.Unlock()
+
+	if full {
+		s.requestFlush()
+	}
+}
+
+func (s *CachedStore) requestFlush() {
+	select {
+	case s.flushCh <- struct{}{}:
+	default:
+	}
+}
+
+func (s *CachedStore) flushLoop() {
+	defer close(s.doneCh)
+
+	ticker := time.NewTicker(s.flushPeriod)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-s.flushCh:
+		case <-s.closeCh:
+			s.Flush()
+			return
+		}
+		s.Flush()
+	}
+}
+
+// Flush synchronously writes the dirty set to the db in a single batch,
+// followed by the checkpoint record. After a failure, the writes are kept
+// and the flush loop retries them every flush period.
+func (s *CachedStore) Flush() error {
+	s.flushLock.Lock()
+	defer s.flushLock.Unlock()
+
+	s.lock.Lock()
+	if len(s.dirty) == 0 {
+		s.lock.Unlock()
+		return nil
+	}
+	s.flushing = s.dirty
+	s.dirty = make(map[string][]byte)
+	checkpoint := s.checkpoint
+	s.lock.Unlock()
+
+	start := time.Now()
+	err := s.writeBatch(s.flushing, checkpoint)
+
+	if err != nil {
+		s.logger.Error("flush failed", "items", len(s.flushing), logger.Err, err)
+	} else {
+		s.logger.Debug("flushed",
+			"items", len(s.flushing),
+			"duration", time.Since(start),
+			"last_topological_index", checkpoint.LastTopologicalIndex,
+			logger.Block, checkpoint.LastBlockIndex)
+	}
+
+	s.lock.Lock()
+	if err != nil {
+		// put the pending writes back so nothing is lost
+		for k, v := range s.flushing {
+			if _, ok := s.dirty[k]; !ok {
+				s.dirty[k] = v
+			}
+		}
+		s.flushErr = err
+	} else if s.flushErr != nil {
+		s.logger.Info("flush succeeded after a failure", "items", len(s.flushing))
+		s.flushErr = nil
+	}
+	s.flushing = make(map[string][]byte)
+	s.cond.Broadcast()
+	s.lock.Unlock()
+
+	return err
+}
+
+func (s *CachedStore) writeBatch(items map[string][]byte, checkpoint Checkpoint) error {
+	batch := s.db.NewBatch()
+
+	for k, v := range items {
+		if err := batch.Set([]byte(k), v); err != nil {
+			batch.Cancel()
+			return err
+		}
+	}
+
+	cpBytes, err := json.Marshal(checkpoint)
+	if err != nil {
+		batch.Cancel()
+		return err
+	}
+
+	if err := batch.Set([]byte(checkpointKey), cpBytes); err != nil {
+		batch.Cancel()
+		return err
+	}
+
+	return batch.Commit(s.ctx)
+}
+
+// read looks up a key in the dirty set, the batch being flushed, and the db,
+// in that order.
+func (s *CachedStore) read(key []byte) ([]byte, error) {
+	s.lock.Lock()
+	if v, ok := s.dirty[string(key)]; ok {
+		s.lock.Unlock()
+		return v, nil
+	}
+	if v, ok := s.flushing[string(key)]; ok {
+		s.lock.Unlock()
+		return v, nil
+	}
+	s.lock.Unlock()
+
+	return s.db.Get(s.ctx, key)
+}
+
+// LastCheckpoint returns the checkpoint found in the db, if any.
+func (s *CachedStore) LastCheckpoint() (Checkpoint, error) {
+	return s.readCheckpoint(s.ctx)
+}
+
+func (s *CachedStore) readCheckpoint(ctx context.Context) (Checkpoint, error) {
+	cp := Checkpoint{
+		LastTopologicalIndex: -1,
+		LastRound:            -1,
+		LastBlockIndex:       -1,
+		LastFrameRound:       -1,
+	}
+
+	data, err := s.db.Get(ctx, []byte(checkpointKey))
+	if err != nil {
+		return cp, err
+	}
+
+	err = json.Unmarshal(data, &cp)
+	return cp, err
+}
+
+/*******************************************************************************
+Store interface
+*******************************************************************************/
+
+// CacheSize ...
+func (s *CachedStore) CacheSize() int {
+	return s.inmemStore.CacheSize()
+}
+
+// GetPeerSet ...
+func (s *CachedStore) GetPeerSet(round int) (*conf.PeerSet, error) {
+	ps, err := s.inmemStore.GetPeerSet(round)
+	if err == nil {
+		return ps, nil
+	}
+
+	data, dbErr := s.read(peerSetKey(round))
+	if dbErr != nil {
+		return nil, err
+	}
+
+	var peers []*conf.Peer
+	if err := json.Unmarshal(data, &peers); err != nil {
+		return nil, err
+	}
+
+	return conf.NewPeerSet(peers), nil
+}
+
+// SetPeerSet ...
+func (s *CachedStore) SetPeerSet(round int, peerSet *conf.PeerSet) error {
+	if err := s.inmemStore.SetPeerSet(round, peerSet); err != nil {
+		return err
+	}
+
+	data, err := json.Marshal(peerSet.Peers)
+	if err != nil {
+		return err
+	}
+
+	if err := s.stage(peerSetKey(round), data); err != nil {
+		return err
+	}
+
+	for _, p := range peerSet.Peers {
+		root, err := s.inmemStore.GetRoot(p.PubKeyString())
+		if err != nil {
+			return err
+		}
+		if err := s.setRoot(p.PubKeyString(), root); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// GetAllPeerSets ...
+func (s *CachedStore) GetAllPeerSets() (map[int][]*conf.Peer, error) {
+	return s.inmemStore.GetAllPeerSets()
+}
+
+// GetParams reads the hot tier, where all the ConsensusParams are loaded
+func (s *CachedStore) GetParams(round int) (*types.ConsensusParams, error) {
+	return s.inmemStore.GetParams(round)
+}
+
+// SetParams ...
+func (s *CachedStore) SetParams(round int, params *types.ConsensusParams) error {
+	if err := s.inmemStore.SetParams(round, params); err != nil {
+		return err
+	}
+
+	data, err := json.Marshal(params)
+	if err != nil {
+		return err
+	}
+
+	return s.stage(paramsKey(round), data)
+}
+
+// GetAllParams ...
+func (s *CachedStore) GetAllParams() (map[int]*types.ConsensusParams, error) {
+	return s.inmemStore.GetAllParams()
+}
+
+// FirstRound ...
+func (s *CachedStore) FirstRound(id uint32) (int, bool) {
+	return s.inmemStore.FirstRound(id)
+}
+
+// RepertoireByPubKey ...
+func (s *CachedStore) RepertoireByPubKey() map[string]*conf.Peer {
+	return s.inmemStore.RepertoireByPubKey()
+}
+
+// RepertoireByID ...
+func (s *CachedStore) RepertoireByID() map[uint32]*conf.Peer {
+	return s.inmemStore.RepertoireByID()
+}
+
+// GetEvent ...
+func (s *CachedStore) GetEvent(key string) (*types.Event, error) {
+	event, err := s.inmemStore.GetEvent(key)
+	if err == nil {
+		s.budget.hit()
+		return event, nil
+	}
+	s.budget.miss()
+
+	data, dbErr := s.read([]byte(key))
+	if dbErr != nil {
+		if dbErr == db.ErrKeyNotFound {
+			return nil, err
+		}
+		return nil, dbErr
+	}
+
+	event = new(types.Event)
+	if err := event.Unmarshal(data); err != nil {
+		return nil, err
+	}
+
+	//with a budget, the cache holds the Events in use, instead of the last
+	//inserted ones
+	if s.budget != nil {
+		s.inmemStore.cacheEvent(key, event)
+		s.inmemStore.enforceBudget(s.budget)
+	}
+
+	return event, nil
+}
+
+// SetEvent ...
+func (s *CachedStore) SetEvent(event *types.Event) error {
+	if err := s.inmemStore.SetEvent(event); err != nil {
+		return err
+	}
+
+	data, err := event.Marshal()
+	if err != nil {
+		return err
+	}
+
+	eventHex := event.GetHex()
+
+	if err := s.stage([]byte(eventHex), data); err != nil {
+		return err
+	}
+
+	if err := s.stage(participantEventKey(event.GetCreator(), event.Index()), []byte(eventHex)); err != nil {
+		return err
+	}
+
+	if err := s.stage(topologicalEventKey(event.TopologicalIndex), []byte(eventHex)); err != nil {
+		return err
+	}
+
+	s.lock.Lock()
+	if event.TopologicalIndex > s.checkpoint.LastTopologicalIndex {
+		s.checkpoint.LastTopologicalIndex = event.TopologicalIndex
+	}
+	s.lock.Unlock()
+
+	s.inmemStore.enforceBudget(s.budget)
+
+	return nil
+}
+
+// ParticipantEvents returns the participant's events with index > skip. When
+// the requested range was evicted from the hot tier, it is read from the db.
+func (s *CachedStore) ParticipantEvents(participant string, skip int) ([]string, error) {
+	res, err := s.inmemStore.ParticipantEvents(participant, skip)
+	if err == nil || !errors.Is(err, errors.TooLate) {
+		return res, err
+	}
+
+	res = []string{}
+	for i := skip + 1; ; i++ {
+		data, err := s.read(participantEventKey(participant, i))
+		if err == db.ErrKeyNotFound {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+		res = append(res, string(data))
+	}
+
+	return res, nil
+}
+
+// ParticipantEvent ...
+func (s *CachedStore) ParticipantEvent(participant string, index int) (string, error) {
+	res, err := s.inmemStore.ParticipantEvent(participant, index)
+	if err == nil {
+		return res, nil
+	}
+
+	data, dbErr := s.read(participantEventKey(participant, index))
+	if dbErr != nil {
+		return "", err
+	}
+
+	return string(data), nil
+}
+
+// LastEventFrom ...
+func (s *CachedStore) LastEventFrom(participant string) (string, error) {
+	return s.inmemStore.LastEventFrom(participant)
+}
+
+// LastConsensusEventFrom ...
+func (s *CachedStore) LastConsensusEventFrom(participant string) (string, error) {
+	return s.inmemStore.LastConsensusEventFrom(participant)
+}
+
+// IterateEventsByCreator calls fn on the events of a creator, in index order,
+// starting at fromIndex, until fn returns false. The dirty set is flushed
+// first, and the creator's chain is then walked with a prefix iterator over
+// the db, so that events evicted from the cache are included.
+func (s *CachedStore) IterateEventsByCreator(creatorID uint32, fromIndex int, fn func(*types.Event) bool) error {
+	peer, ok := s.RepertoireByID()[creatorID]
+	if !ok {
+		return errors.NewStoreErr("CachedStore.IterateEventsByCreator", errors.UnknownParticipant, strconv.FormatUint(uint64(creatorID), 10))
+	}
+
+	if err := s.Flush(); err != nil {
+		return err
+	}
+
+	if fromIndex < 0 {
+		fromIndex = 0
+	}
+
+	prefix := participantEventPrefix(peer.PubKeyString())
+
+	it := s.db.NewIterator(false)
+	defer it.Close()
+
+	for it.Seek(participantEventKey(peer.PubKeyString(), fromIndex)); it.ValidForPrefix(prefix); it.Next() {
+		eventHex, err := it.Item().Value()
+		if err != nil {
+			return err
+		}
+
+		ev, err := s.GetEvent(string(eventHex))
+		if err != nil {
+			return err
+		}
+
+		if !fn(ev) {
+			return nil
+		}
+	}
+
+	return nil
+}
+
+// KnownEvents ...
+func (s *CachedStore) KnownEvents() map[uint32]int {
+	return s.inmemStore.KnownEvents()
+}
+
+// ConsensusEvents ...
+func (s *CachedStore) ConsensusEvents() []string {
+	return s.inmemStore.ConsensusEvents()
+}
+
+// ConsensusEventsCount ...
+func (s *CachedStore) ConsensusEventsCount() int {
+	return s.inmemStore.ConsensusEventsCount()
+}
+
+// AddConsensusEvent ...
+func (s *CachedStore) AddConsensusEvent(event *types.Event) error {
+	return s.inmemStore.AddConsensusEvent(event)
+}
+
+// GetRound ...
+func (s *CachedStore) GetRound(r int) (*types.RoundInfo, error) {
+	round, err := s.inmemStore.GetRound(r)
+	if err == nil || s.replaying() {
+		if err == nil {
+			s.budget.hit()
+		}
+		return round, err
+	}
+	s.budget.miss()
+
+	data, dbErr := s.read(roundKey(r))
+	if dbErr != nil {
+		if dbErr == db.ErrKeyNotFound {
+			return nil, err
+		}
+		return nil, dbErr
+	}
+
+	round = types.NewRoundInfo()
+	if err := round.Unmarshal(data); err != nil {
+		return nil, err
+	}
+
+	return round, nil
+}
+
+// SetRound persists the RoundInfo, including its witnesses and fame
+// decisions, so that the consensus can be resumed after a restart.
+func (s *CachedStore) SetRound(r int, round *types.RoundInfo) error {
+	if err := s.inmemStore.SetRound(r, round); err != nil {
+		return err
+	}
+
+	data, err := round.Marshal()
+	if err != nil {
+		return err
+	}
+
+	if err := s.stage(roundKey(r), data); err != nil {
+		return err
+	}
+
+	s.lock.Lock()
+	if r > s.checkpoint.LastRound {
+		s.checkpoint.LastRound = r
+	}
+	s.lock.Unlock()
+
+	s.inmemStore.enforceBudget(s.budget)
+
+	return nil
+}
+
+// LastRound ...
+func (s *CachedStore) LastRound() int {
+	return s.inmemStore.LastRound()
+}
+
+// RoundWitnesses ...
+func (s *CachedStore) RoundWitnesses(r int) []string {
+	round, err := s.GetRound(r)
+	if err != nil {
+		return []string{}
+	}
+	return round.Witnesses()
+}
+
+// RoundEvents ...
+func (s *CachedStore) RoundEvents(r int) int {
+	round, err := s.GetRound(r)
+	if err != nil {
+		return 0
+	}
+	return len(round.CreatedEvents)
+}
+
+// GetRoot ...
+func (s *CachedStore) GetRoot(participant string) (*types.Root, error) {
+	root, err := s.inmemStore.GetRoot(participant)
+	if err == nil {
+		return root, nil
+	}
+
+	data, dbErr := s.read(participantRootKey(participant))
+	if dbErr != nil {
+		return nil, err
+	}
+
+	root = new(types.Root)
+	if err := root.Unmarshal(data); err != nil {
+		return nil, err
+	}
+
+	return root, nil
+}
+
+func (s *CachedStore) setRoot(participant string, root *types.Root) error {
+	data, err := root.Marshal()
+	if err != nil {
+		return err
+	}
+	return s.stage(participantRootKey(participant), data)
+}
+
+// GetBlock ...
+func (s *CachedStore) GetBlock(index int) (*types.Block, error) {
+	block, err := s.inmemStore.GetBlock(index)
+	if err == nil {
+		s.budget.hit()
+		return block, nil
+	}
+	s.budget.miss()
+
+	if block, ok := s.readCache.getBlock(index); ok {
+		return block, nil
+	}
+
+	data, dbErr := s.read(blockKey(index))
+	if dbErr != nil {
+		if dbErr == db.ErrKeyNotFound {
+			return nil, errors.NewStoreErr("CachedStore.Blocks", errors.KeyNotFound, strconv.Itoa(index))
+		}
+		return nil, dbErr
+	}
+
+	block, err = s.decodeBlock(data)
+	if err != nil {
+		return nil, err
+	}
+
+	s.readCache.addBlock(block)
+
+	return block, nil
+}
+
+// SetBlock ...
+func (s *CachedStore) SetBlock(block *types.Block) error {
+	if s.replaying() {
+		stored, err := s.replayBlock(block)
+		if err != nil {
+			return err
+		}
+		block = stored
+	}
+
+	if err := s.inmemStore.SetBlock(block); err != nil {
+		return err
+	}
+	s.readCache.removeBlock(block.Index())
+
+	s.bodyLock.Lock()
+	data, err := s.encodeBlock(block)
+	if err == nil {
+		err = s.stage(blockKey(block.Index()), data)
+	}
+	s.bodyLock.Unlock()
+	if err != nil {
+		return err
+	}
+
+	s.lock.Lock()
+	if block.Index() > s.checkpoint.LastBlockIndex {
+		s.checkpoint.LastBlockIndex = block.Index()
+	}
+	s.lock.Unlock()
+
+	s.inmemStore.enforceBudget(s.budget)
+
+	return nil
+}
+
+// LastBlockIndex ...
+func (s *CachedStore) LastBlockIndex() int {
+	return s.inmemStore.LastBlockIndex()
+}
+
+// GetFrame ...
+func (s *CachedStore) GetFrame(index int) (*types.Frame, error) {
+	frame, err := s.inmemStore.GetFrame(index)
+	if err == nil {
+		s.budget.hit()
+		return frame, nil
+	}
+	s.budget.miss()
+
+	if frame, ok := s.readCache.getFrame(index); ok {
+		return frame, nil
+	}
+
+	data, dbErr := s.read(frameKey(index))
+	if dbErr != nil {
+		if dbErr == db.ErrKeyNotFound {
+			return nil, errors.NewStoreErr("CachedStore.Frames", errors.KeyNotFound, strconv.Itoa(index))
+		}
+		return nil, dbErr
+	}
+
+	frame = new(types.Frame)
+	if err := frame.Unmarshal(data); err != nil {
+		return nil, err
+	}
+
+	s.readCache.addFrame(frame)
+
+	return frame, nil
+}
+
+// SetFrame ...
+func (s *CachedStore) SetFrame(frame *types.Frame) error {
+	if err := s.inmemStore.SetFrame(frame); err != nil {
+		return err
+	}
+	s.readCache.removeFrame(frame.Round)
+
+	data, err := frame.Marshal()
+	if err != nil {
+		return err
+	}
+
+	if err := s.stage(frameKey(frame.Round), data); err != nil {
+		return err
+	}
+
+	s.lock.Lock()
+	if frame.Round > s.checkpoint.LastFrameRound {
+		s.checkpoint.LastFrameRound = frame.Round
+	}
+	s.lock.Unlock()
+
+	s.inmemStore.enforceBudget(s.budget)
+
+	return nil
+}
+
+// IterateEvents calls fn on the persisted Events in topological order,
+// starting at topological index from, until fn returns false.
+func (s *CachedStore) IterateEvents(from int, fn func(*types.Event) bool) error {
+	if err := s.Flush(); err != nil {
+		return err
+	}
+
+	if from < 0 {
+		from = 0
+	}
+
+	prefix := []byte(topoPrefix + "_")
+
+	it := s.db.NewIterator(false)
+	defer it.Close()
+
+	for it.Seek(topologicalEventKey(from)); it.ValidForPrefix(prefix); it.Next() {
+		eventHex, err := it.Item().Value()
+		if err != nil {
+			return err
+		}
+
+		ev, err := s.GetEvent(string(eventHex))
+		if err != nil {
+			return err
+		}
+
+		if !fn(ev) {
+			return nil
+		}
+	}
+
+	return nil
+}
+
+// PeerSetHistory returns all the PeerSets persisted in the db by round. Unlike
+// GetAllPeerSets, it includes PeerSets that were not loaded in the hot tier.
+func (s *CachedStore) PeerSetHistory() (map[int][]*conf.Peer, error) {
+	if err := s.Flush(); err != nil {
+		return nil, err
+	}
+
+	peerSets, err := s.dbPeerSets()
+	if err != nil {
+		return nil, err
+	}
+
+	res := make(map[int][]*conf.Peer, len(peerSets))
+	for _, ps := range peerSets {
+		res[ps.round] = ps.peerSet.Peers
+	}
+
+	return res, nil
+}
+
+// Prune deletes the Round and Frame records below a round, and the external
+// transaction bodies of the Blocks below it, which keep their hashes. Events,
+// Blocks, and PeerSets are kept. It returns the number of deleted records, or
+// ErrArchival if the db is archival.
+func (s *CachedStore) Prune(belowRound int) (int, error) {
+	archival, err := s.Archival()
+	if err != nil {
+		return 0, err
+	}
+	if archival {
+		return 0, ErrArchival
+	}
+
+	s.bodyLock.Lock()
+	defer s.bodyLock.Unlock()
+
+	if err := s.Flush(); err != nil {
+		return 0, err
+	}
+
+	keys := [][]byte{}
+	for _, prefix := range []string{roundPrefix, framePrefix} {
+		p := []byte(prefix + "_")
+
+		it := s.db.NewIterator(false)
+		for it.Seek(p); it.ValidForPrefix(p); it.Next() {
+			r, err := strconv.Atoi(strings.TrimPrefix(string(it.Item().Key()), string(p)))
+			if err != nil || r >= belowRound {
+				continue
+			}
+			keys = append(keys, common.CopyBytes(it.Item().Key()))
+		}
+		it.Close()
+	}
+
+	pruned, from, err := s.pruneBodies(belowRound)
+	if err != nil {
+		return 0, err
+	}
+
+	batch := s.db.NewBatch()
+	for _, k := range keys {
+		if err := batch.Delete(k); err != nil {
+			batch.Cancel()
+			return 0, err
+		}
+	}
+	if belowRound > from {
+		if err := batch.Set([]byte(bodiesPrunedKey), []byte(strconv.Itoa(belowRound))); err != nil {
+			batch.Cancel()
+			return 0, err
+		}
+	}
+
+	if err := batch.Commit(s.ctx); err != nil {
+		return 0, err
+	}
+
+	s.readCache.purge()
+
+	//a crash before the references are released only leaks the bodies
+	bodies, err := s.collectBodies(pruned)
+	if err != nil {
+		return 0, err
+	}
+
+	s.logger.Info("pruned", logger.Round, belowRound, "records", len(keys), "bodies", bodies)
+
+	return len(keys) + bodies, nil
+}
+
+// StateHash ...
+func (s *CachedStore) StateHash() []byte {
+	return s.inmemStore.StateHash()
+}
+
+// SetForkEvidence ...
+func (s *CachedStore) SetForkEvidence(evidence *types.ForkEvidence) error {
+	if err := s.inmemStore.SetForkEvidence(evidence); err != nil {
+		return err
+	}
+
+	data, err := evidence.Marshal()
+	if err != nil {
+		return err
+	}
+
+	return s.stage(forkEvidenceKey(evidence.Creator(), evidence.Index()), data)
+}
+
+// GetForkEvidence returns all the evidence persisted in the db, including
+// evidence recorded before a restart.
+func (s *CachedStore) GetForkEvidence() ([]*types.ForkEvidence, error) {
+	if err := s.Flush(); err != nil {
+		return nil, err
+	}
+
+	prefix := []byte(forkPrefix + "_")
+
+	it := s.db.NewIterator(false)
+	defer it.Close()
+
+	res := []*types.ForkEvidence{}
+	for it.Seek(prefix); it.ValidForPrefix(prefix); it.Next() {
+		data, err := it.Item().Value()
+		if err != nil {
+			return nil, err
+		}
+
+		evidence := new(types.ForkEvidence)
+		if err := evidence.Unmarshal(data); err != nil {
+			return nil, err
+		}
+
+		res = append(res, evidence)
+	}
+
+	return res, nil
+}
+
+// Reset ...
+func (s *CachedStore) Reset(frame *types.Frame) error {
+	if err := s.inmemStore.Reset(frame); err != nil {
+		return err
+	}
+	s.readCache.purge()
+
+	for participant, root := range frame.Roots {
+		if err := s.setRoot(participant, root); err != nil {
+			return err
+		}
+	}
+
+	for round, params := range frame.Params {
+		if err := s.SetParams(round, params); err != nil {
+			return err
+		}
+	}
+
+	if err := s.SetFrame(frame); err != nil {
+		return err
+	}
+
+	return s.stage([]byte(baseKey), []byte(strconv.Itoa(frame.Round)))
+}
+
+// SetConsensusState stages a ConsensusState, which is written with the next
+// flush
+func (s *CachedStore) SetConsensusState(state *ConsensusState) error {
+	s.lock.Lock()
+	state.Checkpoint = s.checkpoint
+	s.lock.Unlock()
+
+	data, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+
+	return s.stage([]byte(stateKey), data)
+}
+
+// GetConsensusState returns the last ConsensusState written
+func (s *CachedStore) GetConsensusState() (*ConsensusState, error) {
+	data, err := s.read([]byte(stateKey))
+	if err != nil {
+		if err == db.ErrKeyNotFound {
+			return nil, errors.NewStoreErr("CachedStore.ConsensusState", errors.KeyNotFound, stateKey)
+		}
+		return nil, err
+	}
+
+	state := new(ConsensusState)
+	if err := json.Unmarshal(data, state); err != nil {
+		return nil, err
+	}
+
+	return state, nil
+}
+
+// Shutdown stops the background flusher, flushes the remaining dirty set,
+// cancels the operations in progress, and closes the db. If ctx is done
+// before the flush completes, the flush is cancelled and the report tells
+// what was lost.
+func (s *CachedStore) Shutdown(ctx context.Context) (ShutdownReport, error) {
+	start := time.Now()
+
+	s.lock.Lock()
+	pending := len(s.dirty) + len(s.flushing)
+	s.lock.Unlock()
+
+	close(s.closeCh)
+
+	var err error
+	select {
+	case <-s.doneCh:
+	case <-ctx.Done():
+		s.cancel()
+		<-s.doneCh
+		err = ctx.Err()
+	}
+	s.cancel()
+
+	s.lock.Lock()
+	if err == nil {
+		err = s.flushErr
+	}
+	report := ShutdownReport{
+		Unflushed: len(s.dirty),
+	}
+	s.lock.Unlock()
+
+	if pending > report.Unflushed {
+		report.Flushed = pending - report.Unflushed
+	}
+	if cp, cpErr := s.readCheckpoint(context.Background()); cpErr == nil {
+		report.Checkpoint = cp
+	}
+
+	if dbErr := s.db.Close(); dbErr != nil {
+		return report, dbErr
+	}
+
+	report.Duration = time.Since(start)
+
+	return report, err
+}
+
+// Close is Shutdown without a deadline
+func (s *CachedStore) Close() error {
+	_, err := s.Shutdown(context.Background())
+	return err
+}
+
+// StorePath ...
+func (s *CachedStore) StorePath() string {
+	return s.db.DBPath()
+}
+
+// Health describes the write-behind of a CachedStore and its db
+type Health struct {
+	Dirty    int   // writes waiting for the next flush
+	MaxDirty int   // writes block when Dirty reaches MaxDirty
+	FlushErr error // failed last flush, retried until it succeeds
+	DB       *db.Stats
+	DBErr    error
+}
+
+// Health returns the Health of the Store. DB is nil if the db reports no
+// Stats.
+func (s *CachedStore) Health() Health {
+	s.lock.Lock()
+	h := Health{
+		Dirty:    len(s.dirty),
+		MaxDirty: s.maxDirty,
+		FlushErr: s.flushErr,
+	}
+	s.lock.Unlock()
+
+	if src, ok := s.db.(interface{ Stats() (db.Stats, error) }); ok {
+		stats, err := src.Stats()
+		if err != nil {
+			h.DBErr = err
+		} else {
+			h.DB = &stats
+		}
+	}
+
+	return h
+}
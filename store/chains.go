@@ -0,0 +1,139 @@
+package store
+
+import (
+	"context"
+	"encoding/hex"
+	"fmt"
+	"sort"
+	"sync"
+
+	"github.com/bolaxy/core/db"
+	"github.com/bolaxy/core/types"
+)
+
+const (
+	chainPartitionPrefix = "chain"
+	chainRegistryPrefix  = "chains"
+)
+
+// ChainManager shares one db between the Stores of several consensus
+// instances, like a main chain and its parachains, identified by the ChainId
+// of their SyncBlocks. The Store of a parachain sees the keys of a Partition
+// of the db, under a prefix derived from its ChainId; the main chain, whose
+// ChainId is empty, uses the keys of the db as they are, so that the db of a
+// single-chain node can be opened by a ChainManager. The ChainIds are
+// registered in the db, so that Chains lists them after a restart.
+type ChainManager struct {
+	root     db.Sinker
+	newStore func(db.Sinker) Store
+
+	lock   sync.Mutex
+	stores map[string]Store
+	closed bool
+}
+
+// NewChainManager creates a ChainManager on top of root, which creates the
+// Store of a chain with newStore, like Config.NewStore of the node. The
+// ChainManager owns root and closes it in Close.
+func NewChainManager(root db.Sinker, newStore func(db.Sinker) Store) *ChainManager {
+	return &ChainManager{
+		root:     root,
+		newStore: newStore,
+		stores:   make(map[string]Store),
+	}
+}
+
+func chainPrefix(chainID string) string {
+	if chainID == "" {
+		return ""
+	}
+	return fmt.Sprintf("%s/%s/", chainPartitionPrefix, hex.EncodeToString([]byte(chainID)))
+}
+
+func chainRegistryKey(chainID string) []byte {
+	return []byte(fmt.Sprintf("%s_%s", chainRegistryPrefix, hex.EncodeToString([]byte(chainID))))
+}
+
+// Sinker returns the Partition of the db which holds the keys of a chain. It
+// can hold the data of other components of the chain, beside its Store.
+func (m *ChainManager) Sinker(chainID string) db.Sinker {
+	return db.NewPartition(m.root, chainPrefix(chainID))
+}
+
+// Store returns the Store of a chain, which is created, or opened from the
+// db, on the first call. The Store must not be closed by the caller.
+func (m *ChainManager) Store(chainID string) (Store, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	if m.closed {
+		return nil, fmt.Errorf("chain manager closed")
+	}
+
+	if s, ok := m.stores[chainID]; ok {
+		return s, nil
+	}
+
+	if chainID != "" {
+		if err := m.root.Put(context.Background(), chainRegistryKey(chainID), []byte(chainID)); err != nil {
+			return nil, err
+		}
+	}
+
+	s := m.newStore(m.Sinker(chainID))
+	m.stores[chainID] = s
+
+	return s, nil
+}
+
+// StoreFor returns the Store of the chain a SyncBlock belongs to
+func (m *ChainManager) StoreFor(sb *types.SyncBlock) (Store, error) {
+	return m.Store(sb.ChainId)
+}
+
+// Chains returns the ChainIds of the parachains registered in the db, sorted.
+// The main chain is not listed.
+func (m *ChainManager) Chains() ([]string, error) {
+	prefix := []byte(chainRegistryPrefix + "_")
+
+	it := m.root.NewIterator(false)
+	defer it.Close()
+
+	res := []string{}
+	for it.Seek(prefix); it.ValidForPrefix(prefix); it.Next() {
+		val, err := it.Item().Value()
+		if err != nil {
+			return nil, err
+		}
+		res = append(res, string(val))
+	}
+
+	sort.Strings(res)
+
+	return res, nil
+}
+
+// Close closes the Stores of all the chains, and then the db. It returns the
+// first error.
+func (m *ChainManager) Close() error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	if m.closed {
+		return nil
+	}
+	m.closed = true
+
+	var res error
+	for id, s := range m.stores {
+		if err := s.Close(); err != nil && res == nil {
+			res = fmt.Errorf("closing store of chain %q: %v", id, err)
+		}
+	}
+
+	if err := m.root.Close(); err != nil && res == nil {
+		res = err
+	}
+
+	return res
+}
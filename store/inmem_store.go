@@ -0,0 +1,560 @@
+package store
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+
+	"github.com/bolaxy/common"
+	"github.com/bolaxy/config"
+	"github.com/bolaxy/core/logger"
+	"github.com/bolaxy/core/types"
+	"github.com/bolaxy/errors"
+)
+
+// InmemStore implements the Store interface with in-memory caches. When the
+// caches are full, older items are evicted, so InmemStore is not suitable for
+// long-running nodes on its own. It is used as the hot tier of CachedStore.
+type InmemStore struct {
+	cacheSize              int
+	eventCache             *LRU //hash => Event
+	roundCache             *LRU //round number => RoundInfo
+	blockCache             *LRU //index => Block
+	frameCache             *LRU //round received => Frame
+	consensusCache         *common.RollingIndex
+	totConsensusEvents     int
+	participantEventsCache *types.ParticipantEventsCache
+	rootsByParticipant     map[string]*types.Root //[participant] => Root
+	lastRound              int
+	lastConsensusEvents    map[string]string //[participant] => hex() of last consensus event
+	lastBlock              int
+	peerSetCache           *types.PeerSetCache
+	params                 map[int]*types.ConsensusParams //[round] => params set from round
+	forkEvidence           map[string]*types.ForkEvidence //[creator/index] => evidence
+	state                  *stateAccumulator
+	logger                 logger.Logger
+}
+
+// NewInmemStore creates a new InmemStore where every cache has cacheSize
+// items.
+func NewInmemStore(cacheSize int) *InmemStore {
+	return &InmemStore{
+		cacheSize:              cacheSize,
+		eventCache:             NewLRU(cacheSize, nil),
+		roundCache:             NewLRU(cacheSize, nil),
+		blockCache:             NewLRU(cacheSize, nil),
+		frameCache:             NewLRU(cacheSize, nil),
+		consensusCache:         common.NewRollingIndex("ConsensusCache", cacheSize),
+		participantEventsCache: types.NewParticipantEventsCache(cacheSize),
+		rootsByParticipant:     make(map[string]*types.Root),
+		lastRound:              -1,
+		lastConsensusEvents:    make(map[string]string),
+		lastBlock:              -1,
+		peerSetCache:           types.NewPeerSetCache(),
+		params:                 make(map[int]*types.ConsensusParams),
+		forkEvidence:           make(map[string]*types.ForkEvidence),
+		state:                  newStateAccumulator(),
+		logger:                 logger.Nop,
+	}
+}
+
+// SetLogger sets the logger of the store and of its caches
+func (s *InmemStore) SetLogger(l logger.Logger) {
+	s.logger = logger.OrNop(l).With(logger.Component, "InmemStore")
+	s.participantEventsCache.SetLogger(s.logger)
+	s.peerSetCache.SetLogger(s.logger)
+}
+
+// CacheSize ...
+func (s *InmemStore) CacheSize() int {
+	return s.cacheSize
+}
+
+// GetPeerSet ...
+func (s *InmemStore) GetPeerSet(round int) (*conf.PeerSet, error) {
+	return s.peerSetCache.Get(round)
+}
+
+// SetPeerSet updates the peerSetCache and participantEventsCache
+func (s *InmemStore) SetPeerSet(round int, peerSet *conf.PeerSet) error {
+	if err := s.peerSetCache.Set(round, peerSet); err != nil {
+		return err
+	}
+
+	peerSetHash, err := peerSet.Hash()
+	if err != nil {
+		return err
+	}
+	s.state.set("peerset", strconv.Itoa(round), peerSetHash)
+
+	for _, p := range peerSet.Peers {
+		if err := s.addParticipant(p); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (s *InmemStore) addParticipant(p *conf.Peer) error {
+	if _, ok := s.participantEventsCache.Participants.ByPubKey[p.PubKeyString()]; !ok {
+		if err := s.participantEventsCache.AddPeer(p); err != nil {
+			return err
+		}
+	}
+
+	if _, ok := s.rootsByParticipant[p.PubKeyString()]; !ok {
+		s.rootsByParticipant[p.PubKeyString()] = types.NewRoot()
+	}
+
+	return nil
+}
+
+// GetAllPeerSets ...
+func (s *InmemStore) GetAllPeerSets() (map[int][]*conf.Peer, error) {
+	return s.peerSetCache.GetAll()
+}
+
+// GetParams returns the ConsensusParams in force at round, which are the last
+// ones set from a round up to round, or nil if none were set
+func (s *InmemStore) GetParams(round int) (*types.ConsensusParams, error) {
+	from := -1
+	for r := range s.params {
+		if r <= round && r > from {
+			from = r
+		}
+	}
+	return s.params[from], nil
+}
+
+// SetParams sets the ConsensusParams in force from round
+func (s *InmemStore) SetParams(round int, params *types.ConsensusParams) error {
+	hash, err := params.Hash()
+	if err != nil {
+		return err
+	}
+
+	s.params[round] = params
+	s.state.set("params", strconv.Itoa(round), hash)
+
+	return nil
+}
+
+// GetAllParams ...
+func (s *InmemStore) GetAllParams() (map[int]*types.ConsensusParams, error) {
+	res := make(map[int]*types.ConsensusParams, len(s.params))
+	for r, p := range s.params {
+		res[r] = p
+	}
+	return res, nil
+}
+
+// FirstRound ...
+func (s *InmemStore) FirstRound(id uint32) (int, bool) {
+	return s.peerSetCache.FirstRound(id)
+}
+
+// RepertoireByPubKey ...
+func (s *InmemStore) RepertoireByPubKey() map[string]*conf.Peer {
+	return s.peerSetCache.RepertoireByPubKey()
+}
+
+// RepertoireByID ...
+func (s *InmemStore) RepertoireByID() map[uint32]*conf.Peer {
+	return s.peerSetCache.RepertoireByID()
+}
+
+// GetEvent ...
+func (s *InmemStore) GetEvent(key string) (*types.Event, error) {
+	res, ok := s.eventCache.Get(key)
+	if !ok {
+		return nil, errors.NewStoreErr("EventCache", errors.KeyNotFound, key)
+	}
+
+	return res.(*types.Event), nil
+}
+
+// SetEvent ...
+func (s *InmemStore) SetEvent(event *types.Event) error {
+	eventHex := event.GetHex()
+
+	if _, ok := s.eventCache.Get(eventHex); !ok {
+		creatorID := event.GetCreatorID()
+
+		s.state.add("event", eventHex, nil)
+
+		if err := s.participantEventsCache.SetByID(creatorID, eventHex, event.Index()); err != nil {
+			return err
+		}
+	}
+
+	s.eventCache.AddSized(eventHex, event, eventSize(event))
+
+	return nil
+}
+
+// ParticipantEvents ...
+func (s *InmemStore) ParticipantEvents(participant string, skip int) ([]string, error) {
+	return s.participantEventsCache.Get(participant, skip)
+}
+
+// ParticipantEvent ...
+func (s *InmemStore) ParticipantEvent(participant string, index int) (string, error) {
+	ev, err := s.participantEventsCache.GetItem(participant, index)
+	if err == nil {
+		return ev, nil
+	}
+
+	root, ok := s.rootsByParticipant[participant]
+	if !ok {
+		return "", errors.NewStoreErr("InmemStore.Roots", errors.NoRoot, participant)
+	}
+
+	for _, fe := range root.Events {
+		if fe.Core.Index() == index {
+			return fe.Core.GetHex(), nil
+		}
+	}
+
+	return "", err
+}
+
+// LastEventFrom returns the last event of a participant, falling back to its
+// Root when no event was inserted since the last Reset.
+func (s *InmemStore) LastEventFrom(participant string) (string, error) {
+	last, err := s.participantEventsCache.GetLast(participant)
+	if err == nil {
+		return last, nil
+	}
+
+	if !errors.Is(err, errors.Empty) {
+		return "", err
+	}
+
+	root, ok := s.rootsByParticipant[participant]
+	if !ok || len(root.Events) == 0 {
+		return "", err
+	}
+
+	return root.Events[len(root.Events)-1].Core.GetHex(), nil
+}
+
+// LastConsensusEventFrom ...
+func (s *InmemStore) LastConsensusEventFrom(participant string) (string, error) {
+	last, ok := s.lastConsensusEvents[participant]
+	if !ok {
+		return "", errors.NewStoreErr("InmemStore.LastConsensusEvents", errors.KeyNotFound, participant)
+	}
+	return last, nil
+}
+
+// IterateEventsByCreator calls fn on the events of a creator, in index order,
+// starting at fromIndex, until fn returns false. It fails with TooLate if
+// fromIndex was evicted from the cache.
+func (s *InmemStore) IterateEventsByCreator(creatorID uint32, fromIndex int, fn func(*types.Event) bool) error {
+	if _, ok := s.RepertoireByID()[creatorID]; !ok {
+		return errors.NewStoreErr("InmemStore.IterateEventsByCreator", errors.UnknownParticipant, strconv.FormatUint(uint64(creatorID), 10))
+	}
+
+	hexes, err := s.participantEventsCache.GetByID(creatorID, fromIndex-1)
+	if err != nil {
+		return err
+	}
+
+	for _, h := range hexes {
+		ev, err := s.GetEvent(h)
+		if err != nil {
+			return err
+		}
+		if !fn(ev) {
+			return nil
+		}
+	}
+
+	return nil
+}
+
+// KnownEvents returns [participant id] => last known index, taking roots into
+// account for participants with no events since the last Reset.
+func (s *InmemStore) KnownEvents() map[uint32]int {
+	known := s.participantEventsCache.Known()
+
+	for pk, root := range s.rootsByParticipant {
+		if len(root.Events) == 0 {
+			continue
+		}
+
+		peer, ok := s.participantEventsCache.Participants.ByPubKey[pk]
+		if !ok {
+			continue
+		}
+
+		rootIndex := root.Events[len(root.Events)-1].Core.Index()
+		if idx, ok := known[peer.ID()]; !ok || idx < rootIndex {
+			known[peer.ID()] = rootIndex
+		}
+	}
+
+	return known
+}
+
+// ConsensusEvents returns the last window of consensus events
+func (s *InmemStore) ConsensusEvents() []string {
+	lastWindow, _ := s.consensusCache.GetLastWindow()
+	res := make([]string, len(lastWindow))
+	for i, item := range lastWindow {
+		res[i] = item.(string)
+	}
+	return res
+}
+
+// ConsensusEventsCount ...
+func (s *InmemStore) ConsensusEventsCount() int {
+	return s.totConsensusEvents
+}
+
+// AddConsensusEvent ...
+func (s *InmemStore) AddConsensusEvent(event *types.Event) error {
+	if err := s.consensusCache.Set(event.GetHex(), s.totConsensusEvents); err != nil {
+		return err
+	}
+	s.totConsensusEvents++
+	s.lastConsensusEvents[event.GetCreator()] = event.GetHex()
+	return nil
+}
+
+// GetRound ...
+func (s *InmemStore) GetRound(r int) (*types.RoundInfo, error) {
+	res, ok := s.roundCache.Get(r)
+	if !ok {
+		return nil, errors.NewStoreErr("RoundCache", errors.KeyNotFound, strconv.Itoa(r))
+	}
+	return res.(*types.RoundInfo), nil
+}
+
+// SetRound ...
+func (s *InmemStore) SetRound(r int, round *types.RoundInfo) error {
+	data, err := round.Marshal()
+	if err != nil {
+		return err
+	}
+	s.state.set("round", strconv.Itoa(r), data)
+
+	s.roundCache.AddSized(r, round, roundSize(round))
+	if r > s.lastRound {
+		s.lastRound = r
+	}
+	return nil
+}
+
+// LastRound ...
+func (s *InmemStore) LastRound() int {
+	return s.lastRound
+}
+
+// RoundWitnesses ...
+func (s *InmemStore) RoundWitnesses(r int) []string {
+	round, err := s.GetRound(r)
+	if err != nil {
+		return []string{}
+	}
+	return round.Witnesses()
+}
+
+// RoundEvents ...
+func (s *InmemStore) RoundEvents(r int) int {
+	round, err := s.GetRound(r)
+	if err != nil {
+		return 0
+	}
+	return len(round.CreatedEvents)
+}
+
+// GetRoot ...
+func (s *InmemStore) GetRoot(participant string) (*types.Root, error) {
+	res, ok := s.rootsByParticipant[participant]
+	if !ok {
+		return nil, errors.NewStoreErr("RootCache", errors.KeyNotFound, participant)
+	}
+	return res, nil
+}
+
+// GetBlock ...
+func (s *InmemStore) GetBlock(index int) (*types.Block, error) {
+	res, ok := s.blockCache.Get(index)
+	if !ok {
+		return nil, errors.NewStoreErr("BlockCache", errors.KeyNotFound, strconv.Itoa(index))
+	}
+	return res.(*types.Block), nil
+}
+
+// SetBlock ...
+func (s *InmemStore) SetBlock(block *types.Block) error {
+	index := block.Index()
+	s.blockCache.AddSized(index, block, blockSize(block))
+	if index > s.lastBlock {
+		s.lastBlock = index
+	}
+	return nil
+}
+
+// LastBlockIndex ...
+func (s *InmemStore) LastBlockIndex() int {
+	return s.lastBlock
+}
+
+// GetFrame ...
+func (s *InmemStore) GetFrame(index int) (*types.Frame, error) {
+	res, ok := s.frameCache.Get(index)
+	if !ok {
+		return nil, errors.NewStoreErr("FrameCache", errors.KeyNotFound, strconv.Itoa(index))
+	}
+	return res.(*types.Frame), nil
+}
+
+// SetFrame ...
+func (s *InmemStore) SetFrame(frame *types.Frame) error {
+	s.frameCache.AddSized(frame.Round, frame, frameSize(frame))
+	return nil
+}
+
+// MemoryUsage returns the estimated bytes held by the caches of Events,
+// Rounds, Blocks, and Frames
+func (s *InmemStore) MemoryUsage() int64 {
+	return s.eventCache.Bytes() + s.roundCache.Bytes() + s.blockCache.Bytes() + s.frameCache.Bytes()
+}
+
+// cacheEvent adds an Event read from the db back to the cache of Events, if
+// it has room for it: making room would evict the oldest Event, which could
+// be undecided.
+func (s *InmemStore) cacheEvent(eventHex string, event *types.Event) {
+	if s.cacheSize <= 0 || s.eventCache.Len() < s.cacheSize {
+		s.eventCache.AddSized(eventHex, event, eventSize(event))
+	}
+}
+
+// enforceBudget evicts the coldest Frames, Blocks, and decided Events until
+// the caches fit in the budget. The evicted items must be readable from
+// elsewhere, which is why only a CachedStore calls it.
+func (s *InmemStore) enforceBudget(b *MemoryBudget) {
+	if b == nil {
+		return
+	}
+
+	fits := func() bool { return s.MemoryUsage() <= b.limit }
+	all := func(key, value interface{}) bool { return true }
+	decided := func(key, value interface{}) bool {
+		return value.(*types.Event).RoundReceived != nil
+	}
+
+	evicted := 0
+	if !fits() {
+		evicted += s.frameCache.EvictOldest(maxEvictionScan, all, fits)
+		evicted += s.blockCache.EvictOldest(maxEvictionScan, all, fits)
+		evicted += s.eventCache.EvictOldest(maxEvictionScan, decided, fits)
+	}
+
+	b.Evictions.Add(uint64(evicted))
+	b.Used.Set(float64(s.MemoryUsage()))
+}
+
+// StateHash returns a commitment to the Events, Rounds, and PeerSets written
+// to the store since it was created or Reset. Stores which hold the same
+// items have the same StateHash, so nodes can compare it to detect diverging
+// views of the hashgraph.
+func (s *InmemStore) StateHash() []byte {
+	return s.state.hash()
+}
+
+// SetForkEvidence records evidence of a fork. Evidence is not cleared by
+// Reset.
+func (s *InmemStore) SetForkEvidence(evidence *types.ForkEvidence) error {
+	key := fmt.Sprintf("%s/%d", evidence.Creator(), evidence.Index())
+	if _, ok := s.forkEvidence[key]; ok {
+		return nil
+	}
+
+	s.forkEvidence[key] = evidence
+
+	s.logger.Warn("fork evidence recorded",
+		logger.Creator, evidence.Creator(),
+		"index", evidence.Index())
+
+	return nil
+}
+
+// GetForkEvidence returns all the recorded evidence, sorted by creator and
+// index
+func (s *InmemStore) GetForkEvidence() ([]*types.ForkEvidence, error) {
+	keys := make([]string, 0, len(s.forkEvidence))
+	for k := range s.forkEvidence {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	res := make([]*types.ForkEvidence, len(keys))
+	for i, k := range keys {
+		res[i] = s.forkEvidence[k]
+	}
+
+	return res, nil
+}
+
+// Reset resets the store to a Frame. The roots of the frame become the new
+// bases on top of which participants' events are inserted.
+func (s *InmemStore) Reset(frame *types.Frame) error {
+	s.rootsByParticipant = make(map[string]*types.Root)
+	for pk, root := range frame.Roots {
+		s.rootsByParticipant[pk] = root
+	}
+
+	s.lastRound = -1
+	s.lastConsensusEvents = make(map[string]string)
+	s.consensusCache = common.NewRollingIndex("ConsensusCache", s.cacheSize)
+	s.totConsensusEvents = 0
+	s.participantEventsCache = types.NewParticipantEventsCache(s.cacheSize)
+	s.participantEventsCache.SetLogger(s.logger)
+	s.peerSetCache = types.NewPeerSetCache()
+	s.peerSetCache.SetLogger(s.logger)
+	s.params = make(map[int]*types.ConsensusParams)
+
+	//the Events and Rounds below the Frame are summarised by the Frame's hash
+	frameHash, err := frame.Hash()
+	if err != nil {
+		return err
+	}
+	s.state.reset()
+	s.state.add("frame", strconv.Itoa(frame.Round), frameHash)
+
+	s.logger.Info("store reset", logger.Round, frame.Round)
+
+	for round, peers := range frame.PeerSets {
+		if err := s.SetPeerSet(round, conf.NewPeerSet(peers)); err != nil {
+			return err
+		}
+	}
+
+	if _, ok := frame.PeerSets[frame.Round]; !ok {
+		if err := s.SetPeerSet(frame.Round, conf.NewPeerSet(frame.Peers)); err != nil {
+			return err
+		}
+	}
+
+	for round, params := range frame.Params {
+		if err := s.SetParams(round, params); err != nil {
+			return err
+		}
+	}
+
+	return s.SetFrame(frame)
+}
+
+// Close ...
+func (s *InmemStore) Close() error {
+	return nil
+}
+
+// StorePath ...
+func (s *InmemStore) StorePath() string {
+	return ""
+}
@@ -0,0 +1,149 @@
+package store
+
+import (
+	"container/list"
+)
+
+type lruEntry struct {
+	key   interface{}
+	value interface{}
+	size  int64
+}
+
+// LRU is a fixed-size, non thread-safe, least-recently-used cache.
+type LRU struct {
+	size    int
+	ll      *list.List
+	items   map[interface{}]*list.Element
+	bytes   int64
+	onEvict func(key, value interface{})
+}
+
+// NewLRU creates an LRU of the given size. onEvict, if not nil, is called
+// every time an item is evicted to make room for a new one.
+func NewLRU(size int, onEvict func(key, value interface{})) *LRU {
+	return &LRU{
+		size:    size,
+		ll:      list.New(),
+		items:   make(map[interface{}]*list.Element),
+		onEvict: onEvict,
+	}
+}
+
+// Add inserts or updates a value and returns true if an item was evicted.
+func (c *LRU) Add(key, value interface{}) bool {
+	return c.AddSized(key, value, 0)
+}
+
+// AddSized is Add for a value of an estimated size in bytes, which counts in
+// Bytes while the value is in the cache
+func (c *LRU) AddSized(key, value interface{}, size int64) bool {
+	if el, ok := c.items[key]; ok {
+		c.ll.MoveToFront(el)
+		entry := el.Value.(*lruEntry)
+		c.bytes += size - entry.size
+		entry.value = value
+		entry.size = size
+		return false
+	}
+
+	c.items[key] = c.ll.PushFront(&lruEntry{key, value, size})
+	c.bytes += size
+
+	if c.size > 0 && c.ll.Len() > c.size {
+		c.removeOldest()
+		return true
+	}
+	return false
+}
+
+// Get looks up a key's value and marks it as recently used.
+func (c *LRU) Get(key interface{}) (interface{}, bool) {
+	if el, ok := c.items[key]; ok {
+		c.ll.MoveToFront(el)
+		return el.Value.(*lruEntry).value, true
+	}
+	return nil, false
+}
+
+// Remove deletes a key from the cache without calling onEvict.
+func (c *LRU) Remove(key interface{}) {
+	if el, ok := c.items[key]; ok {
+		c.ll.Remove(el)
+		delete(c.items, key)
+		c.bytes -= el.Value.(*lruEntry).size
+	}
+}
+
+// Len ...
+func (c *LRU) Len() int {
+	return c.ll.Len()
+}
+
+// Bytes returns the total size of the values added with AddSized
+func (c *LRU) Bytes() int64 {
+	return c.bytes
+}
+
+// EvictOldest evicts the items for which evictable returns true, oldest
+// first, until done returns true. It looks at no more than scan items, and
+// returns the number of evicted ones.
+func (c *LRU) EvictOldest(scan int, evictable func(key, value interface{}) bool, done func() bool) int {
+	evicted := 0
+	el := c.ll.Back()
+	for i := 0; i < scan && el != nil && !done(); i++ {
+		prev := el.Prev()
+		entry := el.Value.(*lruEntry)
+		if evictable(entry.key, entry.value) {
+			c.evict(el)
+			evicted++
+		}
+		el = prev
+	}
+	return evicted
+}
+
+// Keys returns the keys from oldest to newest.
+func (c *LRU) Keys() []interface{} {
+	keys := make([]interface{}, 0, c.ll.Len())
+	for el := c.ll.Back(); el != nil; el = el.Prev() {
+		keys = append(keys, el.Value.(*lruEntry).key)
+	}
+	return keys
+}
+
+// Walk calls fn with the items from oldest to newest, and their sizes, until
+// fn returns false. fn must not modify the cache.
+func (c *LRU) Walk(fn func(key, value interface{}, size int64) bool) {
+	for el := c.ll.Back(); el != nil; el = el.Prev() {
+		entry := el.Value.(*lruEntry)
+		if !fn(entry.key, entry.value, entry.size) {
+			return
+		}
+	}
+}
+
+// Purge removes all the items without calling onEvict
+func (c *LRU) Purge() {
+	c.ll.Init()
+	c.items = make(map[interface{}]*list.Element)
+	c.bytes = 0
+}
+
+func (c *LRU) removeOldest() {
+	el := c.ll.Back()
+	if el == nil {
+		return
+	}
+	c.evict(el)
+}
+
+func (c *LRU) evict(el *list.Element) {
+	c.ll.Remove(el)
+	entry := el.Value.(*lruEntry)
+	delete(c.items, entry.key)
+	c.bytes -= entry.size
+	if c.onEvict != nil {
+		c.onEvict(entry.key, entry.value)
+	}
+}
@@ -0,0 +1,221 @@
+package store
+
+import (
+	"sync"
+
+	"github.com/bolaxy/core/metrics"
+	"github.com/bolaxy/core/types"
+)
+
+// readCacheWindow is the number of reads per item of the cache after which
+// the access counts of a ReadCache are halved, so that the items which were
+// popular long ago are not admitted forever
+const readCacheWindow = 10
+
+type readCacheKey struct {
+	frame bool
+	index int
+}
+
+// ReadCache is a read-through cache of the Blocks and Frames which a
+// CachedStore decodes from the db, when they are no longer in the hot tier,
+// like the ones of the query API or of the verification of old signatures.
+// It is bounded in bytes. When it is full, an item is only admitted if it was
+// read more often, recently, than the least recently used items it would
+// evict, so that a scan of the history does not flush the items which are
+// read repeatedly. The sizes are estimates, like the ones of a MemoryBudget.
+//
+// The metrics of a ReadCache can be registered on a metrics.Registry. All
+// methods are safe to call on a nil *ReadCache, which disables it.
+type ReadCache struct {
+	limit int64
+
+	lock   sync.Mutex
+	lru    *LRU
+	counts map[readCacheKey]int
+	reads  int
+
+	Used     *metrics.Gauge
+	Hits     *metrics.Counter
+	Misses   *metrics.Counter
+	Rejected *metrics.Counter
+}
+
+// NewReadCache creates a ReadCache of limit bytes
+func NewReadCache(limit int64) *ReadCache {
+	return &ReadCache{
+		limit:    limit,
+		lru:      NewLRU(0, nil),
+		counts:   make(map[readCacheKey]int),
+		Used:     metrics.NewGauge("core_store_read_cache_bytes", "Estimated bytes held by the read cache of the store."),
+		Hits:     metrics.NewCounter("core_store_read_cache_hits_total", "Number of reads of the db served by the read cache."),
+		Misses:   metrics.NewCounter("core_store_read_cache_misses_total", "Number of reads of the db which missed the read cache."),
+		Rejected: metrics.NewCounter("core_store_read_cache_rejected_total", "Number of decoded items not admitted in the read cache."),
+	}
+}
+
+// Register registers the metrics of the ReadCache
+func (c *ReadCache) Register(reg *metrics.Registry) {
+	if c == nil {
+		return
+	}
+	reg.MustRegister(c.Used, c.Hits, c.Misses, c.Rejected)
+}
+
+// Limit ...
+func (c *ReadCache) Limit() int64 {
+	if c == nil {
+		return 0
+	}
+	return c.limit
+}
+
+// Len returns the number of cached items
+func (c *ReadCache) Len() int {
+	if c == nil {
+		return 0
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.lru.Len()
+}
+
+func (c *ReadCache) getBlock(index int) (*types.Block, bool) {
+	v, ok := c.get(readCacheKey{index: index})
+	if !ok {
+		return nil, false
+	}
+	return v.(*types.Block), true
+}
+
+func (c *ReadCache) addBlock(block *types.Block) {
+	c.add(readCacheKey{index: block.Index()}, block, blockSize(block))
+}
+
+func (c *ReadCache) getFrame(round int) (*types.Frame, bool) {
+	v, ok := c.get(readCacheKey{frame: true, index: round})
+	if !ok {
+		return nil, false
+	}
+	return v.(*types.Frame), true
+}
+
+func (c *ReadCache) addFrame(frame *types.Frame) {
+	c.add(readCacheKey{frame: true, index: frame.Round}, frame, frameSize(frame))
+}
+
+// removeBlock drops the Block of an index, which was written again
+func (c *ReadCache) removeBlock(index int) {
+	c.remove(readCacheKey{index: index})
+}
+
+// removeFrame drops the Frame of a round, which was written again
+func (c *ReadCache) removeFrame(round int) {
+	c.remove(readCacheKey{frame: true, index: round})
+}
+
+// purge drops all the items, like when the db is pruned
+func (c *ReadCache) purge() {
+	if c == nil {
+		return
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.lru.Purge()
+	c.Used.Set(0)
+}
+
+func (c *ReadCache) get(key readCacheKey) (interface{}, bool) {
+	if c == nil {
+		return nil, false
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.count(key)
+
+	v, ok := c.lru.Get(key)
+	if ok {
+		c.Hits.Inc()
+	} else {
+		c.Misses.Inc()
+	}
+	return v, ok
+}
+
+// add admits an item read from the db, whose read was counted by get. The
+// least recently used items are evicted to make room, unless one of them was
+// read as often as the item.
+func (c *ReadCache) add(key readCacheKey, value interface{}, size int64) {
+	if c == nil {
+		return
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if size > c.limit {
+		c.Rejected.Inc()
+		return
+	}
+
+	victims := []interface{}{}
+	free := c.limit - c.lru.Bytes()
+	admit := true
+	c.lru.Walk(func(k, v interface{}, s int64) bool {
+		if free >= size {
+			return false
+		}
+		if c.counts[k.(readCacheKey)] >= c.counts[key] {
+			admit = false
+			return false
+		}
+		victims = append(victims, k)
+		free += s
+		return true
+	})
+
+	if !admit {
+		c.Rejected.Inc()
+		return
+	}
+
+	for _, k := range victims {
+		c.lru.Remove(k)
+	}
+	c.lru.AddSized(key, value, size)
+	c.Used.Set(float64(c.lru.Bytes()))
+}
+
+func (c *ReadCache) remove(key readCacheKey) {
+	if c == nil {
+		return
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.lru.Remove(key)
+	c.Used.Set(float64(c.lru.Bytes()))
+}
+
+// count records a read of key, and ages the counts at the end of each window
+func (c *ReadCache) count(key readCacheKey) {
+	c.counts[key]++
+	c.reads++
+
+	window := readCacheWindow * (c.lru.Len() + 1)
+	if c.reads < window {
+		return
+	}
+
+	c.reads = 0
+	for k, n := range c.counts {
+		if n/2 == 0 {
+			delete(c.counts, k)
+		} else {
+			c.counts[k] = n / 2
+		}
+	}
+}
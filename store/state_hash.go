@@ -0,0 +1,93 @@
+package store
+
+import (
+	"math/big"
+	"sync"
+
+	"github.com/bolaxy/crypto"
+)
+
+var stateModulus = new(big.Int).Lsh(big.NewInt(1), 256)
+
+// stateAccumulator is an order-independent commitment to a set of keyed
+// items. Each item contributes Keccak256(kind, key, value) to a sum modulo
+// 2^256, so the commitment is updated in constant time on every write and two
+// stores that hold the same items have the same commitment, regardless of the
+// order in which the items were written.
+//
+// Items whose value can change are tracked by kind and key, so that their
+// previous contribution can be subtracted. Items that never change, like
+// Events, are tracked by contribution, so that an item written again, once it
+// was evicted from the caches of the store, is only counted once.
+type stateAccumulator struct {
+	lock      sync.Mutex
+	sum       *big.Int
+	mutable   map[string][]byte //[kind/key] => contribution
+	immutable map[[32]byte]bool //contributions of the immutable items
+}
+
+func newStateAccumulator() *stateAccumulator {
+	return &stateAccumulator{
+		sum:       new(big.Int),
+		mutable:   make(map[string][]byte),
+		immutable: make(map[[32]byte]bool),
+	}
+}
+
+func contribution(kind, key string, value []byte) []byte {
+	return crypto.Keccak256([]byte(kind), []byte(key), value)
+}
+
+// add records an immutable item, unless it was already recorded
+func (a *stateAccumulator) add(kind, key string, value []byte) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	var c [32]byte
+	copy(c[:], contribution(kind, key, value))
+	if a.immutable[c] {
+		return
+	}
+	a.immutable[c] = true
+
+	a.sum.Add(a.sum, new(big.Int).SetBytes(c[:]))
+	a.sum.Mod(a.sum, stateModulus)
+}
+
+// set records a mutable item, replacing its previous value
+func (a *stateAccumulator) set(kind, key string, value []byte) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	id := kind + "/" + key
+	if prev, ok := a.mutable[id]; ok {
+		a.sum.Sub(a.sum, new(big.Int).SetBytes(prev))
+	}
+
+	c := contribution(kind, key, value)
+	a.mutable[id] = c
+
+	a.sum.Add(a.sum, new(big.Int).SetBytes(c))
+	a.sum.Mod(a.sum, stateModulus)
+}
+
+// reset clears the accumulator
+func (a *stateAccumulator) reset() {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	a.sum = new(big.Int)
+	a.mutable = make(map[string][]byte)
+	a.immutable = make(map[[32]byte]bool)
+}
+
+// hash returns the 32-byte commitment
+func (a *stateAccumulator) hash() []byte {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	b := a.sum.Bytes()
+	res := make([]byte, 32)
+	copy(res[32-len(b):], b)
+	return res
+}
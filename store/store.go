@@ -0,0 +1,79 @@
+package store
+
+import (
+	"context"
+
+	"github.com/bolaxy/config"
+	"github.com/bolaxy/core/types"
+)
+
+// Store is the interface implemented by all the storage backends of the
+// hashgraph.
+type Store interface {
+	CacheSize() int
+	GetPeerSet(int) (*conf.PeerSet, error)
+	SetPeerSet(int, *conf.PeerSet) error
+	GetAllPeerSets() (map[int][]*conf.Peer, error)
+	GetParams(int) (*types.ConsensusParams, error)
+	SetParams(int, *types.ConsensusParams) error
+	GetAllParams() (map[int]*types.ConsensusParams, error)
+	FirstRound(uint32) (int, bool)
+	RepertoireByPubKey() map[string]*conf.Peer
+	RepertoireByID() map[uint32]*conf.Peer
+	GetEvent(string) (*types.Event, error)
+	SetEvent(*types.Event) error
+	ParticipantEvents(string, int) ([]string, error)
+	ParticipantEvent(string, int) (string, error)
+	LastEventFrom(string) (string, error)
+	LastConsensusEventFrom(string) (string, error)
+	IterateEventsByCreator(uint32, int, func(*types.Event) bool) error
+	KnownEvents() map[uint32]int
+	ConsensusEvents() []string
+	ConsensusEventsCount() int
+	AddConsensusEvent(*types.Event) error
+	GetRound(int) (*types.RoundInfo, error)
+	SetRound(int, *types.RoundInfo) error
+	LastRound() int
+	RoundWitnesses(int) []string
+	RoundEvents(int) int
+	GetRoot(string) (*types.Root, error)
+	GetBlock(int) (*types.Block, error)
+	SetBlock(*types.Block) error
+	LastBlockIndex() int
+	GetFrame(int) (*types.Frame, error)
+	SetFrame(*types.Frame) error
+	SetForkEvidence(*types.ForkEvidence) error
+	GetForkEvidence() ([]*types.ForkEvidence, error)
+	StateHash() []byte
+	Reset(*types.Frame) error
+	Close() error
+	StorePath() string
+}
+
+// EventBatcher is implemented by the Stores which write the Events inserted
+// together to the db in a single batch
+type EventBatcher interface {
+	// InsertEventBatch runs insert, which sets the Events of a batch. The
+	// errors of the Events are left to insert.
+	InsertEventBatch(insert func())
+}
+
+// PersistentStore is implemented by the Stores which survive a restart. The
+// state of the consensus which can not be recomputed from the Events is
+// saved on Shutdown, and a Hashgraph can be reloaded from the Events in the
+// db with Hashgraph.Bootstrap, starting at the last CacheCheckpoint.
+type PersistentStore interface {
+	Store
+	GetConsensusState() (*ConsensusState, error)
+	SetConsensusState(*ConsensusState) error
+	Shutdown(ctx context.Context) (ShutdownReport, error)
+	Empty() (bool, error)
+	LastCheckpoint() (Checkpoint, error)
+	LoadPeerSets() error
+	Base() (*types.Frame, *types.Block, error)
+	IterateEvents(from int, fn func(*types.Event) bool) error
+	SetReplay(bool)
+	GetCacheCheckpoint() (*CacheCheckpoint, error)
+	SetCacheCheckpoint(*CacheCheckpoint) error
+	ResetCache(*types.Frame) error
+}
@@ -0,0 +1,450 @@
+package store
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/bolaxy/config"
+	"github.com/bolaxy/core/types"
+)
+
+// Kinds of Corruption
+const (
+	CorruptEvent     = "event"
+	CorruptParent    = "parent"
+	CorruptRound     = "round"
+	CorruptBlock     = "block"
+	CorruptSignature = "signature"
+)
+
+// Corruption describes one inconsistency found by Verify
+type Corruption struct {
+	Kind   string
+	Key    string
+	Detail string
+}
+
+// VerifyOptions ...
+type VerifyOptions struct {
+	// Truncate deletes the Blocks after the last consistent one
+	Truncate bool
+}
+
+// VerifyReport is the result of Verify
+type VerifyReport struct {
+	EventsChecked int
+	RoundsChecked int
+	BlocksChecked int
+	Corruptions   []Corruption
+	// LastConsistentBlock is the index of the last Block such that it and all
+	// the Blocks before it passed verification, or -1.
+	LastConsistentBlock int
+	Truncated           []int //indexes of the Blocks deleted by Truncate
+}
+
+// OK returns true if no corruption was found
+func (r *VerifyReport) OK() bool {
+	return len(r.Corruptions) == 0
+}
+
+func (r *VerifyReport) add(kind, key, format string, args ...interface{}) {
+	r.Corruptions = append(r.Corruptions, Corruption{
+		Kind:   kind,
+		Key:    key,
+		Detail: fmt.Sprintf(format, args...),
+	})
+}
+
+// Verify re-validates the content of the db: the signature and parents of
+// every Event, the received Events of every Round, and the signatures of every
+// Block against the PeerSet of its round. It is meant to be run on a store
+// that is not being written to, typically before bootstrapping a node. With
+// opts.Truncate, the Blocks after the last consistent Block are deleted so
+// that the node can resume from a sound state.
+func (s *CachedStore) Verify(opts VerifyOptions) (*VerifyReport, error) {
+	if err := s.Flush(); err != nil {
+		return nil, err
+	}
+
+	report := &VerifyReport{LastConsistentBlock: -1}
+
+	peerSets, err := s.dbPeerSets()
+	if err != nil {
+		return nil, err
+	}
+
+	roots := s.dbRootEvents(peerSets)
+
+	if err := s.verifyEvents(report, roots); err != nil {
+		return nil, err
+	}
+
+	if err := s.verifyRounds(report); err != nil {
+		return nil, err
+	}
+
+	if err := s.verifyBlocks(report, peerSets); err != nil {
+		return nil, err
+	}
+
+	if opts.Truncate {
+		if err := s.truncateBlocks(report); err != nil {
+			return report, err
+		}
+	}
+
+	s.logger.Info("store verified",
+		"events", report.EventsChecked,
+		"rounds", report.RoundsChecked,
+		"blocks", report.BlocksChecked,
+		"corruptions", len(report.Corruptions),
+		"last_consistent_block", report.LastConsistentBlock)
+
+	return report, nil
+}
+
+type roundPeerSet struct {
+	round   int
+	peerSet *conf.PeerSet
+}
+
+// dbPeerSets returns the PeerSets in the db, sorted by round
+func (s *CachedStore) dbPeerSets() ([]roundPeerSet, error) {
+	prefix := []byte(peerSetPrefix + "_")
+
+	it := s.db.NewIterator(false)
+	defer it.Close()
+
+	res := []roundPeerSet{}
+	for it.Seek(prefix); it.ValidForPrefix(prefix); it.Next() {
+		round, err := strconv.Atoi(strings.TrimPrefix(string(it.Item().Key()), string(prefix)))
+		if err != nil {
+			continue
+		}
+
+		data, err := it.Item().Value()
+		if err != nil {
+			return nil, err
+		}
+
+		var peers []*conf.Peer
+		if err := json.Unmarshal(data, &peers); err != nil {
+			return nil, err
+		}
+
+		res = append(res, roundPeerSet{round, conf.NewPeerSet(peers)})
+	}
+
+	sort.Slice(res, func(i, j int) bool { return res[i].round < res[j].round })
+
+	return res, nil
+}
+
+// peerSetAt returns the PeerSet in effect at a round
+func peerSetAt(peerSets []roundPeerSet, round int) *conf.PeerSet {
+	var res *conf.PeerSet
+	for _, ps := range peerSets {
+		if ps.round > round {
+			break
+		}
+		res = ps.peerSet
+	}
+	return res
+}
+
+// dbRootEvents returns the hashes of the Events in the participants' Roots.
+// They are the base of the stored hashgraph, so they are valid parents.
+func (s *CachedStore) dbRootEvents(peerSets []roundPeerSet) map[string]bool {
+	res := make(map[string]bool)
+	for _, ps := range peerSets {
+		for _, p := range ps.peerSet.Peers {
+			data, err := s.db.Get(s.ctx, participantRootKey(p.PubKeyString()))
+			if err != nil {
+				continue
+			}
+			root := new(types.Root)
+			if err := root.Unmarshal(data); err != nil {
+				continue
+			}
+			for _, fe := range root.Events {
+				res[fe.Core.GetHex()] = true
+			}
+		}
+	}
+	return res
+}
+
+func (s *CachedStore) verifyEvents(report *VerifyReport, roots map[string]bool) error {
+	prefix := []byte(topoPrefix + "_")
+
+	it := s.db.NewIterator(false)
+	defer it.Close()
+
+	for it.Seek(prefix); it.ValidForPrefix(prefix); it.Next() {
+		key := string(it.Item().Key())
+
+		hexBytes, err := it.Item().Value()
+		if err != nil {
+			return err
+		}
+		eventHex := string(hexBytes)
+
+		report.EventsChecked++
+
+		data, err := s.db.Get(s.ctx, hexBytes)
+		if err != nil {
+			report.add(CorruptEvent, key, "event %s not found", eventHex)
+			continue
+		}
+
+		event := new(types.Event)
+		if err := event.Unmarshal(data); err != nil {
+			report.add(CorruptEvent, eventHex, "unmarshal: %v", err)
+			continue
+		}
+
+		if event.GetHex() != eventHex {
+			report.add(CorruptEvent, eventHex, "content hashes to %s", event.GetHex())
+			continue
+		}
+
+		if ok, err := event.Verify(); err != nil || !ok {
+			report.add(CorruptSignature, eventHex, "invalid event signature (err: %v)", err)
+		}
+
+		if sp := event.SelfParent(); sp != "" && !roots[sp] {
+			prev, err := s.db.Get(s.ctx, participantEventKey(event.GetCreator(), event.Index()-1))
+			if err != nil || string(prev) != sp {
+				report.add(CorruptParent, eventHex, "self-parent %s is not event %d of creator", sp, event.Index()-1)
+			}
+		}
+
+		if op := event.OtherParent(); op != "" && !roots[op] {
+			if ok, _ := s.db.Has(s.ctx, []byte(op)); !ok {
+				report.add(CorruptParent, eventHex, "other-parent %s not found", op)
+			}
+		}
+	}
+
+	return nil
+}
+
+func (s *CachedStore) verifyRounds(report *VerifyReport) error {
+	prefix := []byte(roundPrefix + "_")
+
+	it := s.db.NewIterator(false)
+	defer it.Close()
+
+	for it.Seek(prefix); it.ValidForPrefix(prefix); it.Next() {
+		key := string(it.Item().Key())
+
+		r, err := strconv.Atoi(strings.TrimPrefix(key, string(prefix)))
+		if err != nil {
+			continue
+		}
+
+		data, err := it.Item().Value()
+		if err != nil {
+			return err
+		}
+
+		report.RoundsChecked++
+
+		round := new(types.RoundInfo)
+		if err := round.Unmarshal(data); err != nil {
+			report.add(CorruptRound, key, "unmarshal: %v", err)
+			continue
+		}
+
+		for x := range round.CreatedEvents {
+			if ok, _ := s.db.Has(s.ctx, []byte(x)); !ok {
+				report.add(CorruptRound, key, "created event %s not found", x)
+			}
+		}
+
+		for _, x := range round.ReceivedEvents {
+			data, err := s.db.Get(s.ctx, []byte(x))
+			if err != nil {
+				report.add(CorruptRound, key, "received event %s not found", x)
+				continue
+			}
+
+			event := new(types.Event)
+			if err := event.Unmarshal(data); err != nil {
+				continue
+			}
+
+			if event.RoundReceived == nil || *event.RoundReceived != r {
+				report.add(CorruptRound, key, "event %s is not assigned to round %d", x, r)
+			}
+		}
+	}
+
+	return nil
+}
+
+func (s *CachedStore) verifyBlocks(report *VerifyReport, peerSets []roundPeerSet) error {
+	prefix := []byte(blockPrefix + "_")
+
+	it := s.db.NewIterator(false)
+	defer it.Close()
+
+	consistent := true
+	expected := -1
+
+	for it.Seek(prefix); it.ValidForPrefix(prefix); it.Next() {
+		key := string(it.Item().Key())
+
+		data, err := it.Item().Value()
+		if err != nil {
+			return err
+		}
+
+		report.BlocksChecked++
+		before := len(report.Corruptions)
+
+		stored := storedBlock{Block: new(types.Block)}
+		if err := json.Unmarshal(data, &stored); err != nil {
+			report.add(CorruptBlock, key, "unmarshal: %v", err)
+			consistent = false
+			continue
+		}
+		block := stored.Block
+
+		if expected >= 0 && block.Index() != expected {
+			report.add(CorruptBlock, key, "expected block %d, found %d", expected, block.Index())
+		}
+		expected = block.Index() + 1
+
+		if frameData, err := s.db.Get(s.ctx, frameKey(block.RoundReceived())); err == nil {
+			frame := new(types.Frame)
+			if err := frame.Unmarshal(frameData); err == nil {
+				if frameHash, err := frame.Hash(); err == nil && !bytes.Equal(frameHash, block.FrameHash()) {
+					report.add(CorruptBlock, key, "frame hash does not match frame %d", block.RoundReceived())
+				}
+			}
+		}
+
+		//the signatures of a Block whose bodies were pruned can not be checked
+		err = s.loadBodies(stored)
+		pruned := err == ErrBodyPruned
+		if err != nil && !pruned {
+			report.add(CorruptBlock, key, "bodies: %v", err)
+		}
+
+		peerSet := peerSetAt(peerSets, block.RoundReceived())
+		//Signatures are keyed by the validator's compressed public key
+		for validator := range block.Signatures {
+			if peerSet != nil {
+				if _, ok := peerSet.ByPubKey[validator]; !ok {
+					report.add(CorruptSignature, key, "signature from %s, who is not a validator", validator)
+					continue
+				}
+			}
+			if pruned {
+				continue
+			}
+			sig, err := block.GetSignature(validator)
+			if err != nil {
+				continue
+			}
+			if ok, err := block.Verify(sig); err != nil || !ok {
+				report.add(CorruptSignature, key, "invalid signature from %s (err: %v)", validator, err)
+			}
+		}
+
+		if consistent && len(report.Corruptions) == before {
+			report.LastConsistentBlock = block.Index()
+		} else {
+			consistent = false
+		}
+	}
+
+	return nil
+}
+
+// truncateBlocks deletes the Blocks after LastConsistentBlock and rewinds the
+// checkpoint
+func (s *CachedStore) truncateBlocks(report *VerifyReport) error {
+	prefix := []byte(blockPrefix + "_")
+
+	//the references of the truncated Blocks to their bodies are released
+	bodies := []string{}
+
+	it := s.db.NewIterator(false)
+	for it.Seek(blockKey(report.LastConsistentBlock + 1)); it.ValidForPrefix(prefix); it.Next() {
+		index, err := strconv.Atoi(strings.TrimPrefix(string(it.Item().Key()), string(prefix)))
+		if err != nil {
+			continue
+		}
+		report.Truncated = append(report.Truncated, index)
+
+		stored := storedBlock{Block: new(types.Block)}
+		if data, err := it.Item().Value(); err == nil && json.Unmarshal(data, &stored) == nil {
+			for _, key := range stored.Bodies {
+				bodies = append(bodies, key)
+			}
+		}
+	}
+	it.Close()
+
+	if len(report.Truncated) == 0 {
+		return nil
+	}
+
+	batch := s.db.NewBatch()
+	for _, index := range report.Truncated {
+		if err := batch.Delete(blockKey(index)); err != nil {
+			batch.Cancel()
+			return err
+		}
+	}
+
+	//the checkpoint in the db is authoritative when the store was just opened
+	checkpoint, err := s.LastCheckpoint()
+	if err != nil {
+		s.lock.Lock()
+		checkpoint = s.checkpoint
+		s.lock.Unlock()
+	}
+	if checkpoint.LastBlockIndex > report.LastConsistentBlock {
+		checkpoint.LastBlockIndex = report.LastConsistentBlock
+	}
+
+	s.lock.Lock()
+	if s.checkpoint.LastBlockIndex > report.LastConsistentBlock {
+		s.checkpoint.LastBlockIndex = report.LastConsistentBlock
+	}
+	s.lock.Unlock()
+
+	cpBytes, err := json.Marshal(checkpoint)
+	if err != nil {
+		batch.Cancel()
+		return err
+	}
+
+	if err := batch.Set([]byte(checkpointKey), cpBytes); err != nil {
+		batch.Cancel()
+		return err
+	}
+
+	if err := batch.Commit(s.ctx); err != nil {
+		return err
+	}
+
+	s.readCache.purge()
+
+	if _, err := s.collectBodies(bodies); err != nil {
+		return err
+	}
+
+	s.logger.Warn("blocks truncated",
+		"from", report.Truncated[0],
+		"count", len(report.Truncated))
+
+	return nil
+}
@@ -0,0 +1,153 @@
+package testbench
+
+import (
+	"crypto/ecdsa"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/bolaxy/common/hexutil"
+	"github.com/bolaxy/config"
+	"github.com/bolaxy/core/node"
+	"github.com/bolaxy/core/transport"
+	"github.com/bolaxy/core/types"
+)
+
+// Adversary gives a Behavior the means of the byzantine node: its key, to
+// sign what it forges, and its Node, to read its Hashgraph
+type Adversary struct {
+	Key  *ecdsa.PrivateKey
+	Peer *conf.Peer
+	Node *node.Node
+}
+
+// Behavior is an adversarial behavior of a node. It tampers with the
+// SyncResponses served by the node, which it must reseal if it modifies them.
+type Behavior interface {
+	Tamper(a *Adversary, req *transport.SyncRequest, resp *transport.SyncResponse) (*transport.SyncResponse, error)
+}
+
+// BehaviorFunc is a Behavior implemented by a function
+type BehaviorFunc func(a *Adversary, req *transport.SyncRequest, resp *transport.SyncResponse) (*transport.SyncResponse, error)
+
+// Tamper ...
+func (f BehaviorFunc) Tamper(a *Adversary, req *transport.SyncRequest, resp *transport.SyncResponse) (*transport.SyncResponse, error) {
+	return f(a, req, resp)
+}
+
+// SetBehavior makes a node byzantine, or honest again with a nil Behavior
+func (tb *Testbench) SetBehavior(node int, b Behavior) {
+	n := tb.Nodes[node]
+	n.Transport.SetBehavior(b, &Adversary{
+		Key:  n.Key,
+		Peer: n.Peer,
+		Node: n.Node,
+	})
+}
+
+// Equivocate appends to every response a fork of the last Event of the node
+// which it contains: an Event with the same index and parents but another
+// transaction. The receiver gets both, detects the fork, and submits the
+// evidence.
+func Equivocate() Behavior {
+	return BehaviorFunc(func(a *Adversary, req *transport.SyncRequest, resp *transport.SyncResponse) (*transport.SyncResponse, error) {
+		index := -1
+		for _, we := range resp.Events {
+			if we.Body.CreatorID == a.Peer.ID() {
+				index = we.Body.Index
+			}
+		}
+		if index < 0 {
+			return resp, nil
+		}
+
+		lock := a.Node.Locker()
+		lock.Lock()
+		store := a.Node.Hashgraph().Store
+		hex, err := store.ParticipantEvent(a.Peer.PubKeyString(), index)
+		var ev *types.Event
+		if err == nil {
+			ev, err = store.GetEvent(hex)
+		}
+		lock.Unlock()
+
+		if err != nil {
+			return nil, err
+		}
+
+		fork := types.NewEvent(
+			[][]byte{[]byte(fmt.Sprintf("fork %d", time.Now().UnixNano()))},
+			nil,
+			nil,
+			ev.Body.Parents,
+			ev.Body.Creator,
+			ev.Index())
+		if err := fork.Sign(a.Key); err != nil {
+			return nil, err
+		}
+		fork.SetWireInfo(ev.Body.SelfParentIndex,
+			ev.Body.OtherParentCreatorID,
+			ev.Body.OtherParentIndex,
+			ev.Body.CreatorID)
+
+		resp.Events = append(resp.Events, fork.ToWire())
+
+		return resp, transport.Seal(resp, a.Key)
+	})
+}
+
+// Withhold serves the Events of the others, but stops the responses before
+// the first Event of the node, so that its Events never spread
+func Withhold() Behavior {
+	return BehaviorFunc(func(a *Adversary, req *transport.SyncRequest, resp *transport.SyncResponse) (*transport.SyncResponse, error) {
+		for i, we := range resp.Events {
+			if we.Body.CreatorID == a.Peer.ID() {
+				resp.Events = resp.Events[:i]
+				break
+			}
+		}
+
+		return resp, transport.Seal(resp, a.Key)
+	})
+}
+
+// InvalidSignatures corrupts the signatures of the Events of the node. The
+// responses themselves are validly sealed.
+func InvalidSignatures() Behavior {
+	return BehaviorFunc(func(a *Adversary, req *transport.SyncRequest, resp *transport.SyncResponse) (*transport.SyncResponse, error) {
+		for i, we := range resp.Events {
+			if we.Body.CreatorID != a.Peer.ID() {
+				continue
+			}
+
+			sig, err := hexutil.Decode(we.Signature)
+			if err != nil || len(sig) == 0 {
+				continue
+			}
+			sig[0] ^= 0xff
+			resp.Events[i].Signature = hexutil.Encode(sig)
+		}
+
+		return resp, transport.Seal(resp, a.Key)
+	})
+}
+
+// StaleReplay answers each peer with the response previously served to it,
+// as an attacker replaying recorded traffic would. The stale responses carry
+// Events of old rounds, and their Envelopes were already received.
+func StaleReplay() Behavior {
+	var lock sync.Mutex
+	last := make(map[uint32]*transport.SyncResponse)
+
+	return BehaviorFunc(func(a *Adversary, req *transport.SyncRequest, resp *transport.SyncResponse) (*transport.SyncResponse, error) {
+		lock.Lock()
+		defer lock.Unlock()
+
+		old := last[req.FromID]
+		last[req.FromID] = resp
+		if old == nil {
+			return resp, nil
+		}
+		return old, nil
+	})
+}
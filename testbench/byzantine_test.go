@@ -0,0 +1,56 @@
+package testbench
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestEquivocation(t *testing.T) {
+	tb := newTestbench(t)
+	defer closeTestbench(t, tb)
+
+	tb.SetBehavior(3, Equivocate())
+	submit(tb, 20, 0, 1, 2, 3)
+
+	//the fork is reported, and the PEER_SLASH which it triggers removes the
+	//equivocating node from the PeerSet
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	for {
+		peers, err := tb.PeerSet(0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, ok := peers.ByID[tb.Nodes[3].Peer.ID()]; !ok {
+			break
+		}
+
+		select {
+		case <-time.After(pollInterval):
+		case <-ctx.Done():
+			t.Fatal("equivocating node still in the PeerSet")
+		}
+	}
+
+	forks := 0
+	for _, rec := range tb.Nodes[0].Reputation().Records() {
+		if rec.ID == tb.Nodes[3].Peer.ID() {
+			forks = rec.Forks
+		}
+	}
+	if forks == 0 {
+		t.Fatal("no fork reported against the equivocating node")
+	}
+
+	//the remaining nodes go on without it
+	if err := tb.Stop(3); err != nil {
+		t.Fatal(err)
+	}
+	submit(tb, 20, 0, 1, 2)
+	waitBlocks(t, tb, tb.Nodes[0].App.Blocks()+1)
+
+	if err := tb.Check(); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,329 @@
+package testbench
+
+import (
+	"context"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/bolaxy/core/transport"
+)
+
+// Network connects in-memory Transports through simulated links. The
+// conditions of the links can be changed while the nodes run: every RPC is
+// delayed by the latency, on the way out and back, each way can be lost, and
+// the RPCs between two partitions never arrive, nor those to a closed
+// Transport. An RPC which does not arrive fails with transport.ErrTimeout,
+// like it would over a real network, but without waiting for the timeout.
+type Network struct {
+	lock       sync.Mutex
+	rand       *rand.Rand
+	latency    time.Duration
+	jitter     time.Duration
+	loss       float64
+	groups     map[string]int //partition of each address, if partitioned
+	transports map[string]*Transport
+}
+
+// NewNetwork creates a Network without latency, loss, or partitions. seed
+// drives the jitter and the losses.
+func NewNetwork(seed int64) *Network {
+	return &Network{
+		rand:       rand.New(rand.NewSource(seed)),
+		transports: make(map[string]*Transport),
+	}
+}
+
+// NewTransport creates a Transport listening on addr, and connects it to
+// all the Transports of the Network
+func (net *Network) NewTransport(addr string) *Transport {
+	net.lock.Lock()
+	defer net.lock.Unlock()
+
+	t := &Transport{
+		InmemTransport: transport.NewInmemTransport(addr),
+		net:            net,
+		consumerCh:     make(chan transport.RPC),
+		doneCh:         make(chan struct{}),
+	}
+	go t.intercept()
+
+	for a, other := range net.transports {
+		t.Connect(a, other.InmemTransport)
+		other.Connect(addr, t.InmemTransport)
+	}
+	net.transports[addr] = t
+
+	return t
+}
+
+// SetLatency sets the one-way delay of the links. Each message is delayed by
+// latency plus a random duration up to jitter.
+func (net *Network) SetLatency(latency, jitter time.Duration) {
+	net.lock.Lock()
+	defer net.lock.Unlock()
+	net.latency = latency
+	net.jitter = jitter
+}
+
+// SetLoss sets the probability, between 0 and 1, that a message is lost
+func (net *Network) SetLoss(p float64) {
+	net.lock.Lock()
+	defer net.lock.Unlock()
+	net.loss = p
+}
+
+// Partition splits the Network in groups of addresses which only reach each
+// other. The addresses which are not listed form a group of their own.
+func (net *Network) Partition(groups ...[]string) {
+	net.lock.Lock()
+	defer net.lock.Unlock()
+
+	net.groups = make(map[string]int)
+	for i, group := range groups {
+		for _, addr := range group {
+			net.groups[addr] = i + 1
+		}
+	}
+}
+
+// Heal removes the partitions
+func (net *Network) Heal() {
+	net.lock.Lock()
+	defer net.lock.Unlock()
+	net.groups = nil
+}
+
+// link returns the delay of a message from one address to another, and
+// whether it arrives
+func (net *Network) link(from, to string) (time.Duration, bool) {
+	net.lock.Lock()
+	defer net.lock.Unlock()
+
+	delay := net.latency
+	if net.jitter > 0 {
+		delay += time.Duration(net.rand.Int63n(int64(net.jitter)))
+	}
+
+	from, _ = net.resolve(from)
+	to, ok := net.resolve(to)
+	if !ok {
+		return delay, false
+	}
+	if net.groups != nil && net.groups[from] != net.groups[to] {
+		return delay, false
+	}
+	if net.loss > 0 && net.rand.Float64() < net.loss {
+		return delay, false
+	}
+
+	return delay, true
+}
+
+// resolve returns the first address of a target which has a Transport, like
+// InmemTransport does. It must be called with the lock.
+func (net *Network) resolve(target string) (string, bool) {
+	for _, addr := range transport.SplitTarget(target) {
+		if _, ok := net.transports[addr]; ok {
+			return addr, true
+		}
+	}
+	return target, false
+}
+
+// send carries an RPC from one address to another: the request and the
+// response each go through a link
+func (net *Network) send(ctx context.Context, from, to string, rpc func() error) error {
+	delay, ok := net.link(from, to)
+	if err := sleep(ctx, delay); err != nil {
+		return err
+	}
+	if !ok {
+		return transport.ErrTimeout
+	}
+
+	err := rpc()
+
+	delay, ok = net.link(to, from)
+	if sleepErr := sleep(ctx, delay); sleepErr != nil {
+		return sleepErr
+	}
+	if !ok {
+		return transport.ErrTimeout
+	}
+
+	return err
+}
+
+func sleep(ctx context.Context, d time.Duration) error {
+	if d <= 0 {
+		return ctx.Err()
+	}
+
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Transport is an InmemTransport whose outgoing RPCs go through the links of
+// its Network. The SyncResponses it serves go through its Behavior, if any.
+type Transport struct {
+	*transport.InmemTransport
+	net *Network
+
+	lock       sync.Mutex
+	behavior   Behavior
+	adversary  *Adversary
+	consumerCh chan transport.RPC
+	doneCh     chan struct{}
+	closeOnce  sync.Once
+}
+
+// SetBehavior makes the node behind the Transport byzantine. A nil Behavior
+// makes it honest again.
+func (t *Transport) SetBehavior(b Behavior, a *Adversary) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	t.behavior = b
+	t.adversary = a
+}
+
+// Consumer ...
+func (t *Transport) Consumer() <-chan transport.RPC {
+	return t.consumerCh
+}
+
+// intercept forwards the incoming RPCs to the consumer. The responses to the
+// SyncRequests are tampered with by the Behavior.
+func (t *Transport) intercept() {
+	for {
+		var rpc transport.RPC
+		select {
+		case rpc = <-t.InmemTransport.Consumer():
+		case <-t.doneCh:
+			return
+		}
+
+		t.lock.Lock()
+		b, a := t.behavior, t.adversary
+		t.lock.Unlock()
+
+		if req, ok := rpc.Command.(*transport.SyncRequest); ok && b != nil {
+			respCh := make(chan transport.RPCResponse, 1)
+			go tamper(b, a, req, respCh, rpc.RespChan)
+			rpc.RespChan = respCh
+		}
+
+		select {
+		case t.consumerCh <- rpc:
+		case <-t.doneCh:
+			return
+		}
+	}
+}
+
+// tamper applies a Behavior to the response of a SyncRequest before passing
+// it on
+func tamper(b Behavior, a *Adversary, req *transport.SyncRequest, in <-chan transport.RPCResponse, out chan<- transport.RPCResponse) {
+	r := <-in
+	if resp, ok := r.Response.(*transport.SyncResponse); ok && r.Error == nil {
+		//the Behaviors work on the Events, so a batch is unpacked and resealed
+		if resp.Batch != nil {
+			resp.Unbatch()
+			if err := transport.Seal(resp, a.Key); err != nil {
+				r.Response, r.Error = nil, err
+				out <- r
+				return
+			}
+		}
+		r.Response, r.Error = b.Tamper(a, req, resp)
+	}
+	out <- r
+}
+
+// Close removes the Transport from its Network, and closes it
+func (t *Transport) Close() error {
+	t.net.lock.Lock()
+	delete(t.net.transports, t.LocalAddr())
+	t.net.lock.Unlock()
+
+	t.closeOnce.Do(func() { close(t.doneCh) })
+
+	return t.InmemTransport.Close()
+}
+
+// Sync ...
+func (t *Transport) Sync(ctx context.Context, target string, args *transport.SyncRequest, resp *transport.SyncResponse) error {
+	return t.net.send(ctx, t.LocalAddr(), target, func() error {
+		return t.InmemTransport.Sync(ctx, target, args, resp)
+	})
+}
+
+// Join ...
+func (t *Transport) Join(ctx context.Context, target string, args *transport.JoinRequest, resp *transport.JoinResponse) error {
+	return t.net.send(ctx, t.LocalAddr(), target, func() error {
+		return t.InmemTransport.Join(ctx, target, args, resp)
+	})
+}
+
+// FastForward ...
+func (t *Transport) FastForward(ctx context.Context, target string, args *transport.FastForwardRequest, resp *transport.FastForwardResponse) error {
+	return t.net.send(ctx, t.LocalAddr(), target, func() error {
+		return t.InmemTransport.FastForward(ctx, target, args, resp)
+	})
+}
+
+// History ...
+func (t *Transport) History(ctx context.Context, target string, args *transport.HistoryRequest, resp *transport.HistoryResponse) error {
+	return t.net.send(ctx, t.LocalAddr(), target, func() error {
+		return t.InmemTransport.History(ctx, target, args, resp)
+	})
+}
+
+// Signatures ...
+func (t *Transport) Signatures(ctx context.Context, target string, args *transport.SignaturesRequest, resp *transport.SignaturesResponse) error {
+	return t.net.send(ctx, t.LocalAddr(), target, func() error {
+		return t.InmemTransport.Signatures(ctx, target, args, resp)
+	})
+}
+
+// SnapshotChunk ...
+func (t *Transport) SnapshotChunk(ctx context.Context, target string, args *transport.SnapshotChunkRequest, resp *transport.SnapshotChunkResponse) error {
+	return t.net.send(ctx, t.LocalAddr(), target, func() error {
+		return t.InmemTransport.SnapshotChunk(ctx, target, args, resp)
+	})
+}
+
+// PushShards ...
+func (t *Transport) PushShards(ctx context.Context, target string, args *transport.PushShardsRequest, resp *transport.PushShardsResponse) error {
+	return t.net.send(ctx, t.LocalAddr(), target, func() error {
+		return t.InmemTransport.PushShards(ctx, target, args, resp)
+	})
+}
+
+// FetchShards ...
+func (t *Transport) FetchShards(ctx context.Context, target string, args *transport.FetchShardsRequest, resp *transport.FetchShardsResponse) error {
+	return t.net.send(ctx, t.LocalAddr(), target, func() error {
+		return t.InmemTransport.FetchShards(ctx, target, args, resp)
+	})
+}
+
+// Discover ...
+func (t *Transport) Discover(ctx context.Context, target string, args *transport.DiscoverRequest, resp *transport.DiscoverResponse) error {
+	return t.net.send(ctx, t.LocalAddr(), target, func() error {
+		return t.InmemTransport.Discover(ctx, target, args, resp)
+	})
+}
+
+// GetTxs ...
+func (t *Transport) GetTxs(ctx context.Context, target string, args *transport.GetTxsRequest, resp *transport.GetTxsResponse) error {
+	return t.net.send(ctx, t.LocalAddr(), target, func() error {
+		return t.InmemTransport.GetTxs(ctx, target, args, resp)
+	})
+}
@@ -0,0 +1,333 @@
+// Package testbench runs networks of in-process nodes, connected by a
+// simulated Network whose latency, losses, and partitions can be changed
+// while they run. Each node commits to a MemDatabase, through an App which
+// hashes the transactions into a state hash, so that the consistency of the
+// nodes can be checked after chaos-style scenarios. Nodes can be made
+// byzantine with a Behavior.
+package testbench
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bolaxy/common/hexutil"
+	"github.com/bolaxy/config"
+	"github.com/bolaxy/core/db"
+	"github.com/bolaxy/core/fuzz"
+	"github.com/bolaxy/core/logger"
+	"github.com/bolaxy/core/node"
+	"github.com/bolaxy/core/store"
+	"github.com/bolaxy/core/transport"
+	"github.com/bolaxy/core/types"
+	"github.com/bolaxy/crypto"
+)
+
+// pollInterval is the interval at which WaitBlocks checks the nodes
+const pollInterval = 10 * time.Millisecond
+
+// Options configure a Testbench
+type Options struct {
+	Nodes  int
+	Config node.Config
+	// Seed drives the conditions of the Network
+	Seed   int64
+	Logger logger.Logger
+}
+
+// DefaultOptions runs 4 nodes which gossip faster than the default, to keep
+// scenarios short
+func DefaultOptions() Options {
+	config := node.DefaultConfig()
+	config.GossipInterval = 10 * time.Millisecond
+
+	return Options{
+		Nodes:  4,
+		Config: config,
+		Seed:   1,
+	}
+}
+
+// Node is a node of a Testbench, with the resources it runs on
+type Node struct {
+	*node.Node
+	Key       *ecdsa.PrivateKey
+	Peer      *conf.Peer
+	DB        *db.MemDatabase
+	Store     *store.CachedStore
+	Transport *Transport
+	App       *App
+
+	stopped bool
+}
+
+// Testbench is a network of in-process nodes
+type Testbench struct {
+	Network *Network
+	Nodes   []*Node
+	Peers   *conf.PeerSet
+
+	lock sync.Mutex
+}
+
+// New creates the nodes of a Testbench, which are started by Run
+func New(opts Options) (*Testbench, error) {
+	if opts.Nodes <= 0 {
+		return nil, fmt.Errorf("testbench of %d nodes", opts.Nodes)
+	}
+
+	tb := &Testbench{
+		Network: NewNetwork(opts.Seed),
+	}
+
+	keys := make([]*ecdsa.PrivateKey, opts.Nodes)
+	peers := make([]*conf.Peer, opts.Nodes)
+	for i := range keys {
+		key, err := crypto.GenerateKey()
+		if err != nil {
+			return nil, err
+		}
+		keys[i] = key
+
+		pubKey := strings.ToUpper(hexutil.Encode(crypto.CompressPubkey(&key.PublicKey)))
+		name := fmt.Sprintf("node%d", i)
+		peers[i] = conf.NewPeer(pubKey, name, name, "0", "1")
+	}
+	tb.Peers = conf.NewPeerSet(peers)
+
+	for i, key := range keys {
+		n := &Node{
+			Key:  key,
+			Peer: peers[i],
+			DB:   db.NewMemDatabase(),
+			App:  &App{},
+		}
+		n.Store = opts.Config.NewStore(n.DB).(*store.CachedStore)
+		n.Transport = tb.Network.NewTransport(transport.PeerTarget(n.Peer))
+
+		nd, err := node.NewNode(opts.Config, n.Store, n.Transport, key, n.Peer, tb.Peers, n.App.commit)
+		if err != nil {
+			return nil, fmt.Errorf("node %d: %v", i, err)
+		}
+		nd.SetLogger(logger.OrNop(opts.Logger).With("node", i))
+		nd.SetSignGuard(node.NewSignGuard(n.DB))
+		n.Node = nd
+
+		tb.Nodes = append(tb.Nodes, n)
+	}
+
+	return tb, nil
+}
+
+// Run starts all the nodes
+func (tb *Testbench) Run() {
+	for _, n := range tb.Nodes {
+		n.Run()
+	}
+}
+
+// Addresses returns the addresses of nodes, as given to Network.Partition
+func (tb *Testbench) Addresses(nodes ...int) []string {
+	res := make([]string, len(nodes))
+	for i, n := range nodes {
+		res[i] = tb.Nodes[n].Transport.LocalAddr()
+	}
+	return res
+}
+
+// SubmitTx submits a transaction to a node
+func (tb *Testbench) SubmitTx(node int, tx []byte) {
+	tb.Nodes[node].SubmitTx(tx)
+}
+
+// Stop crashes a node. Its Store is left as it was, and is still checked by
+// Check.
+func (tb *Testbench) Stop(node int) error {
+	tb.lock.Lock()
+	defer tb.lock.Unlock()
+
+	n := tb.Nodes[node]
+	if n.stopped {
+		return nil
+	}
+	n.stopped = true
+
+	return n.Close()
+}
+
+// running returns the nodes which were not stopped
+func (tb *Testbench) running() []*Node {
+	tb.lock.Lock()
+	defer tb.lock.Unlock()
+
+	var res []*Node
+	for _, n := range tb.Nodes {
+		if !n.stopped {
+			res = append(res, n)
+		}
+	}
+	return res
+}
+
+// PeerSet returns the PeerSet of the last round of a node, from which the
+// evictions can be observed
+func (tb *Testbench) PeerSet(node int) (*conf.PeerSet, error) {
+	n := tb.Nodes[node]
+
+	lock := n.Locker()
+	lock.Lock()
+	defer lock.Unlock()
+
+	s := n.Hashgraph().Store
+	return s.GetPeerSet(s.LastRound())
+}
+
+// WaitBlocks waits until all the running nodes committed count Blocks
+func (tb *Testbench) WaitBlocks(ctx context.Context, count int) error {
+	ticker := time.NewTicker(pollInterval)
+	defer ticker.Stop()
+
+	for {
+		done := true
+		for _, n := range tb.running() {
+			if n.App.Blocks() < count {
+				done = false
+				break
+			}
+		}
+		if done {
+			return nil
+		}
+
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return fmt.Errorf("waiting for %d blocks: %v", count, ctx.Err())
+		}
+	}
+}
+
+// Check verifies that the nodes agree on the Blocks which they all
+// committed, state hash included, and that their Stores satisfy the
+// invariants of fuzz.CheckStoreInvariants
+func (tb *Testbench) Check() error {
+	for i, n := range tb.Nodes {
+		lock := n.Locker()
+		lock.Lock()
+		err := fuzz.CheckStoreInvariants(n.Store)
+		lock.Unlock()
+
+		if err != nil {
+			return fmt.Errorf("node %d: %v", i, err)
+		}
+	}
+
+	ref := tb.Nodes[0]
+	for i, n := range tb.Nodes[1:] {
+		if err := ref.App.compare(n.App); err != nil {
+			return fmt.Errorf("nodes 0 and %d: %v", i+1, err)
+		}
+	}
+
+	return nil
+}
+
+// Close stops all the nodes and closes their Stores
+func (tb *Testbench) Close() error {
+	var err error
+	for i := range tb.Nodes {
+		if stopErr := tb.Stop(i); err == nil {
+			err = stopErr
+		}
+	}
+	for _, n := range tb.Nodes {
+		if closeErr := n.Store.Close(); err == nil {
+			err = closeErr
+		}
+	}
+	return err
+}
+
+/*******************************************************************************
+App
+*******************************************************************************/
+
+// App is the application of a node. It chains the transactions of the
+// committed Blocks into a state hash, which it sets on the Blocks, and keeps
+// the hash of each Block.
+type App struct {
+	lock   sync.Mutex
+	state  []byte
+	txs    int
+	hashes [][]byte
+}
+
+func (a *App) commit(ctx context.Context, block *types.Block) error {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	if block.Index() != len(a.hashes) {
+		return fmt.Errorf("block %d committed after %d blocks", block.Index(), len(a.hashes))
+	}
+
+	state := a.state
+	for _, tx := range block.Transactions() {
+		state = crypto.Keccak256(state, tx)
+	}
+	block.SetStateHash(state)
+
+	hash, err := block.Body.Hash()
+	if err != nil {
+		return err
+	}
+
+	a.state = state
+	a.txs += len(block.Transactions())
+	a.hashes = append(a.hashes, hash)
+
+	return nil
+}
+
+// Blocks returns the number of committed Blocks
+func (a *App) Blocks() int {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	return len(a.hashes)
+}
+
+// Transactions returns the number of committed transactions
+func (a *App) Transactions() int {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	return a.txs
+}
+
+// StateHash ...
+func (a *App) StateHash() []byte {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	return a.state
+}
+
+// compare checks that the Blocks committed by both Apps are the same
+func (a *App) compare(other *App) error {
+	a.lock.Lock()
+	hashes := a.hashes
+	a.lock.Unlock()
+
+	other.lock.Lock()
+	otherHashes := other.hashes
+	other.lock.Unlock()
+
+	for i := 0; i < len(hashes) && i < len(otherHashes); i++ {
+		if !bytes.Equal(hashes[i], otherHashes[i]) {
+			return fmt.Errorf("block %d differs", i)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,231 @@
+package testbench
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/bolaxy/config"
+	"github.com/bolaxy/core/store"
+	"github.com/bolaxy/core/types"
+	"github.com/bolaxy/crypto"
+)
+
+// newTestbench runs a Testbench of the DefaultOptions, which the test closes
+// with closeTestbench
+func newTestbench(t *testing.T) *Testbench {
+	tb, err := New(DefaultOptions())
+	if err != nil {
+		t.Fatal(err)
+	}
+	tb.Run()
+	return tb
+}
+
+func closeTestbench(t *testing.T, tb *Testbench) {
+	if err := tb.Close(); err != nil {
+		t.Error(err)
+	}
+}
+
+// submit submits count transactions, spread over nodes
+func submit(tb *Testbench, count int, nodes ...int) {
+	for i := 0; i < count; i++ {
+		tb.SubmitTx(nodes[i%len(nodes)], []byte(fmt.Sprintf("tx %d %d", time.Now().UnixNano(), i)))
+	}
+}
+
+func waitBlocks(t *testing.T, tb *Testbench, count int) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	if err := tb.WaitBlocks(ctx, count); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestLatencyAndLoss(t *testing.T) {
+	tb := newTestbench(t)
+	defer closeTestbench(t, tb)
+	tb.Network.SetLatency(5*time.Millisecond, 5*time.Millisecond)
+	tb.Network.SetLoss(0.1)
+
+	submit(tb, 20, 0, 1, 2, 3)
+	waitBlocks(t, tb, 1)
+
+	if err := tb.Check(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestPartitionHeal(t *testing.T) {
+	tb := newTestbench(t)
+	defer closeTestbench(t, tb)
+
+	//3 of 4 nodes are a supermajority, and keep committing without node 3
+	tb.Network.Partition(tb.Addresses(0, 1, 2))
+	submit(tb, 20, 0, 1, 2)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	for tb.Nodes[0].App.Blocks() == 0 {
+		select {
+		case <-time.After(pollInterval):
+		case <-ctx.Done():
+			t.Fatal("no block committed by the majority")
+		}
+	}
+	if b := tb.Nodes[3].App.Blocks(); b != 0 {
+		t.Fatalf("isolated node committed %d blocks", b)
+	}
+
+	tb.Network.Heal()
+	submit(tb, 20, 0, 1, 2, 3)
+	waitBlocks(t, tb, tb.Nodes[0].App.Blocks()+1)
+
+	if err := tb.Check(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// rounds returns the last consensus round of a node, -1 if none, and the last
+// round of its Store
+func rounds(n *Node) (int, int) {
+	lock := n.Locker()
+	lock.Lock()
+	defer lock.Unlock()
+
+	hg := n.Hashgraph()
+	last := -1
+	if hg.LastConsensusRound != nil {
+		last = *hg.LastConsensusRound
+	}
+	return last, hg.Store.LastRound()
+}
+
+// newWireEvent signs the next Event of n, on selfParent and otherParent, the
+// Event at otherIndex of otherID
+func newWireEvent(t *testing.T, n *Node, selfParent string, otherParent string, otherID uint32, otherIndex int) (*types.Event, types.WireEvent) {
+	s := n.Hashgraph().Store
+	index := s.KnownEvents()[n.Peer.ID()]
+
+	ev := types.NewEvent(nil, nil, nil,
+		[]string{selfParent, otherParent},
+		crypto.FromECDSAPub(&n.Key.PublicKey),
+		index+1)
+	if err := ev.Sign(n.Key); err != nil {
+		t.Fatal(err)
+	}
+	ev.SetWireInfo(index, otherID, otherIndex, n.Peer.ID())
+
+	return ev, ev.ToWire()
+}
+
+// participantEvent returns the hash of the Event at index of peer in s
+func participantEvent(t *testing.T, s store.Store, peer *conf.Peer, index int) string {
+	hex, err := s.ParticipantEvent(peer.PubKeyString(), index)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return hex
+}
+
+func TestStaleEventAtDifferentProgress(t *testing.T) {
+	const horizon = 1
+
+	opts := DefaultOptions()
+	opts.Config.StaleHorizon = horizon
+	tb, err := New(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tb.Run()
+	defer closeTestbench(t, tb)
+
+	submit(tb, 20, 0, 1, 2, 3)
+	waitBlocks(t, tb, 1)
+
+	//node 3 falls behind while the others go on, beyond the stale horizon
+	ahead, behind := tb.Nodes[0], tb.Nodes[3]
+	tb.Network.Partition(tb.Addresses(0, 1, 2))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	for {
+		aheadRound, _ := rounds(ahead)
+		_, behindRound := rounds(behind)
+		if aheadRound > behindRound+horizon+1 {
+			break
+		}
+
+		submit(tb, 4, 0, 1, 2)
+		select {
+		case <-time.After(pollInterval):
+		case <-ctx.Done():
+			t.Fatal("the majority did not get ahead of node 3")
+		}
+	}
+	for i := range tb.Nodes {
+		if err := tb.Stop(i); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	aheadStore := ahead.Hashgraph().Store
+	behindStore := behind.Hashgraph().Store
+	other := tb.Nodes[2].Peer
+	id := behind.Peer.ID()
+
+	//the next Event of node 3, on the last Events which it knows, is stale to
+	//node 0 only
+	last := behindStore.KnownEvents()[id]
+	otherIndex := behindStore.KnownEvents()[other.ID()]
+	stale, wstale := newWireEvent(t, behind,
+		participantEvent(t, behindStore, behind.Peer, last),
+		participantEvent(t, behindStore, other, otherIndex),
+		other.ID(), otherIndex)
+
+	//node 0 gets it with the Events of node 3 which it lacks, as from a sync
+	var batch []types.WireEvent
+	for i := aheadStore.KnownEvents()[id] + 1; i <= last; i++ {
+		ev, err := behindStore.GetEvent(participantEvent(t, behindStore, behind.Peer, i))
+		if err != nil {
+			t.Fatal(err)
+		}
+		batch = append(batch, ev.ToWire())
+	}
+	batch = append(batch, wstale)
+
+	if kept, _ := ahead.Hashgraph().DropStale(batch); len(kept) != 0 {
+		t.Fatalf("node 0 kept %d stale events from gossip", len(kept))
+	}
+	if kept, _ := behind.Hashgraph().DropStale([]types.WireEvent{wstale}); len(kept) != 1 {
+		t.Fatal("node 3 dropped its recent event from gossip")
+	}
+
+	//a recent Event on top of it keeps it in the gossip of node 0
+	_, wrecent := newWireEvent(t, ahead,
+		participantEvent(t, aheadStore, ahead.Peer, aheadStore.KnownEvents()[ahead.Peer.ID()]),
+		stale.GetHex(),
+		id, last+1)
+	batch = append(batch, wrecent)
+
+	if kept, dropped := ahead.Hashgraph().DropStale(batch); dropped != 0 {
+		t.Fatalf("node 0 dropped %d of %d events which a recent event descends from", dropped, len(kept)+dropped)
+	}
+
+	//both nodes insert the stale Event, whatever their progress
+	if _, errs := ahead.Hashgraph().InsertEventBatch(batch); errs[len(errs)-2] != nil || errs[len(errs)-1] != nil {
+		t.Fatalf("node 0 rejected the events: %v", errs)
+	}
+	if err := behind.Hashgraph().InsertEvent(stale, false); err != nil {
+		t.Fatalf("node 3 rejected its event: %v", err)
+	}
+
+	for i, n := range []*Node{ahead, behind} {
+		if hex := participantEvent(t, n.Hashgraph().Store, behind.Peer, last+1); hex != stale.GetHex() {
+			t.Fatalf("node %d holds %s instead of the event", i, hex)
+		}
+	}
+}
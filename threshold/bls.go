@@ -0,0 +1,183 @@
+package threshold
+
+import (
+	"crypto/rand"
+	"errors"
+	"math/big"
+
+	bls12381 "github.com/kilic/bls12-381"
+)
+
+// The signatures are BLS signatures on the BLS12-381 curve: the signatures
+// and the hashes of the messages are in G1, the keys in G2. Points are
+// encoded compressed, as in the zcash serialization.
+
+var (
+	// ErrInvalidPoint is returned for bytes which do not encode a point of the
+	// expected group
+	ErrInvalidPoint = errors.New("invalid curve point")
+	// ErrInvalidSignature is returned for a signature which does not verify
+	ErrInvalidSignature = errors.New("invalid threshold signature")
+)
+
+// curveOrder is the order of the groups, and the modulus of the scalars
+var curveOrder = bls12381.NewG1().Q()
+
+// hashDomain separates the hashes of checkpoints from other uses of the keys
+const hashDomain = "BOLAXY-CHECKPOINT-V1-CS01-with-BLS12381G1_XMD:SHA-256_SSWU_RO_"
+
+// hashToG1 maps msg to a point of G1 whose discrete logarithm is unknown,
+// with the hash-to-curve suite of hashDomain
+func hashToG1(msg []byte) (*bls12381.PointG1, error) {
+	return bls12381.NewG1().HashToCurve(msg, []byte(hashDomain))
+}
+
+// The groups of the library keep temporary values, so every operation uses
+// its own.
+
+func g2Base(k *big.Int) *bls12381.PointG2 {
+	g := bls12381.NewG2()
+	return g.MulScalarBig(g.New(), g.One(), k)
+}
+
+func g2Mul(p *bls12381.PointG2, k *big.Int) *bls12381.PointG2 {
+	g := bls12381.NewG2()
+	return g.MulScalarBig(g.New(), p, k)
+}
+
+func g2Add(a, b *bls12381.PointG2) *bls12381.PointG2 {
+	g := bls12381.NewG2()
+	return g.Add(g.New(), a, b)
+}
+
+func g2Equal(a, b *bls12381.PointG2) bool {
+	return bls12381.NewG2().Equal(a, b)
+}
+
+func g2Bytes(p *bls12381.PointG2) []byte {
+	return bls12381.NewG2().ToCompressed(p)
+}
+
+// parseG1 decodes a point of G1 other than the identity
+func parseG1(b []byte) (*bls12381.PointG1, error) {
+	g := bls12381.NewG1()
+	p, err := g.FromCompressed(b)
+	if err != nil || g.IsZero(p) {
+		return nil, ErrInvalidPoint
+	}
+	return p, nil
+}
+
+// parseG2 decodes a point of G2 other than the identity. Points of the
+// curve outside of the group are rejected.
+func parseG2(b []byte) (*bls12381.PointG2, error) {
+	g := bls12381.NewG2()
+	p, err := g.FromCompressed(b)
+	if err != nil || g.IsZero(p) {
+		return nil, ErrInvalidPoint
+	}
+	return p, nil
+}
+
+// randomScalar returns a random non-zero scalar
+func randomScalar() (*big.Int, error) {
+	for {
+		k, err := rand.Int(rand.Reader, curveOrder)
+		if err != nil {
+			return nil, err
+		}
+		if k.Sign() > 0 {
+			return k, nil
+		}
+	}
+}
+
+// parseScalar decodes a scalar, which must be lower than the group order
+func parseScalar(b []byte) (*big.Int, error) {
+	if len(b) > 32 {
+		return nil, errors.New("invalid scalar")
+	}
+	k := new(big.Int).SetBytes(b)
+	if k.Cmp(curveOrder) >= 0 {
+		return nil, errors.New("invalid scalar")
+	}
+	return k, nil
+}
+
+// scalarBytes encodes a scalar on 32 bytes
+func scalarBytes(k *big.Int) []byte {
+	res := make([]byte, 32)
+	b := k.Bytes()
+	copy(res[32-len(b):], b)
+	return res
+}
+
+// sign returns the BLS signature of msg by the secret key, or share, sk
+func sign(sk *big.Int, msg []byte) ([]byte, error) {
+	h, err := hashToG1(msg)
+	if err != nil {
+		return nil, err
+	}
+	g := bls12381.NewG1()
+	return g.ToCompressed(g.MulScalarBig(g.New(), h, sk)), nil
+}
+
+// verify checks the BLS signature of msg by the public key pk, which is
+// e(sig, g2) == e(H(msg), pk)
+func verify(pk *bls12381.PointG2, msg, sig []byte) error {
+	s, err := parseG1(sig)
+	if err != nil {
+		return err
+	}
+
+	h, err := hashToG1(msg)
+	if err != nil {
+		return err
+	}
+
+	e := bls12381.NewEngine()
+	e.AddPairInv(s, e.G2.One())
+	e.AddPair(h, pk)
+
+	if !e.Check() {
+		return ErrInvalidSignature
+	}
+	return nil
+}
+
+// combine interpolates the signature shares of the holders of indexes in the
+// exponent, which gives the signature of the secret they share
+func combine(shares map[int][]byte) ([]byte, error) {
+	indexes := make([]int, 0, len(shares))
+	for i := range shares {
+		indexes = append(indexes, i)
+	}
+
+	if len(indexes) == 0 {
+		return nil, errors.New("no signature shares")
+	}
+
+	g := bls12381.NewG1()
+	sum := g.Zero()
+	for _, i := range indexes {
+		s, err := parseG1(shares[i])
+		if err != nil {
+			return nil, err
+		}
+
+		term := g.MulScalarBig(g.New(), s, lagrange(i, indexes))
+		g.Add(sum, sum, term)
+	}
+
+	return g.ToCompressed(sum), nil
+}
+
+// Verify checks the signature of a message by a group key, as recorded in an
+// anchor.ThresholdSignature
+func Verify(groupKey, msg, sig []byte) error {
+	pk, err := parseG2(groupKey)
+	if err != nil {
+		return err
+	}
+	return verify(pk, msg, sig)
+}
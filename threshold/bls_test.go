@@ -0,0 +1,158 @@
+package threshold
+
+import (
+	"bytes"
+	"math/big"
+	"testing"
+)
+
+func testScalar(t *testing.T) *big.Int {
+	k, err := randomScalar()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return k
+}
+
+func TestSignVerify(t *testing.T) {
+	sk := testScalar(t)
+	pk := g2Bytes(g2Base(sk))
+	msg := []byte("checkpoint")
+
+	sig, err := sign(sk, msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := Verify(pk, msg, sig); err != nil {
+		t.Fatalf("valid signature: %v", err)
+	}
+
+	if err := Verify(pk, []byte("other checkpoint"), sig); err != ErrInvalidSignature {
+		t.Fatalf("signature of another message: got %v, want %v", err, ErrInvalidSignature)
+	}
+
+	other := g2Bytes(g2Base(testScalar(t)))
+	if err := Verify(other, msg, sig); err != ErrInvalidSignature {
+		t.Fatalf("signature by another key: got %v, want %v", err, ErrInvalidSignature)
+	}
+
+	bad := append([]byte{}, sig...)
+	bad[len(bad)-1] ^= 1
+	if err := Verify(pk, msg, bad); err == nil {
+		t.Fatal("tampered signature verified")
+	}
+}
+
+func TestParsePoints(t *testing.T) {
+	sig, err := sign(testScalar(t), []byte("checkpoint"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		name  string
+		parse func([]byte) error
+		raw   []byte
+	}{
+		{"G1 identity", parseG1Err, append([]byte{0xc0}, make([]byte, 47)...)},
+		{"G1 short", parseG1Err, sig[:47]},
+		{"G1 uncompressed", parseG1Err, make([]byte, 96)},
+		{"G2 identity", parseG2Err, append([]byte{0xc0}, make([]byte, 95)...)},
+		{"G2 short", parseG2Err, g2Bytes(g2Base(big.NewInt(2)))[:95]},
+		{"G2 from G1", parseG2Err, sig},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			if err := c.parse(c.raw); err != ErrInvalidPoint {
+				t.Fatalf("got %v, want %v", err, ErrInvalidPoint)
+			}
+		})
+	}
+}
+
+func parseG1Err(b []byte) error {
+	_, err := parseG1(b)
+	return err
+}
+
+func parseG2Err(b []byte) error {
+	_, err := parseG2(b)
+	return err
+}
+
+func TestCombine(t *testing.T) {
+	const threshold = 3
+
+	secret := testScalar(t)
+	p, err := newPoly(threshold, secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	groupKey := g2Bytes(g2Base(secret))
+	msg := []byte("checkpoint")
+
+	shares := make(map[int][]byte)
+	for i := 1; i <= 5; i++ {
+		if shares[i], err = sign(p.eval(i), msg); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	want, err := sign(secret, msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	//any threshold of shares combine into the signature of the secret
+	for _, set := range [][]int{{1, 2, 3}, {3, 4, 5}, {1, 3, 5}, {1, 2, 3, 4, 5}} {
+		subset := make(map[int][]byte)
+		for _, i := range set {
+			subset[i] = shares[i]
+		}
+
+		sig, err := combine(subset)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(sig, want) {
+			t.Fatalf("shares %v: combined signature differs from the signature of the secret", set)
+		}
+		if err := Verify(groupKey, msg, sig); err != nil {
+			t.Fatalf("shares %v: %v", set, err)
+		}
+	}
+
+	//fewer do not
+	sig, err := combine(map[int][]byte{1: shares[1], 2: shares[2]})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := Verify(groupKey, msg, sig); err != ErrInvalidSignature {
+		t.Fatalf("combination of too few shares: got %v, want %v", err, ErrInvalidSignature)
+	}
+
+	if _, err := combine(nil); err == nil {
+		t.Fatal("combination of no shares")
+	}
+}
+
+func TestVerifyShare(t *testing.T) {
+	p, err := newPoly(3, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	commitments, err := parseCommitments(p.commit())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for x := 1; x <= 4; x++ {
+		if !verifyShare(commitments, x, p.eval(x)) {
+			t.Fatalf("valid share %d rejected", x)
+		}
+	}
+	if verifyShare(commitments, 1, p.eval(2)) {
+		t.Fatal("share of another index accepted")
+	}
+}
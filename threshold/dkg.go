@@ -0,0 +1,674 @@
+package threshold
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"math/big"
+	"sort"
+
+	"github.com/bolaxy/config"
+	"github.com/bolaxy/core/logger"
+	"github.com/bolaxy/core/types"
+	"github.com/bolaxy/crypto"
+	bls12381 "github.com/kilic/bls12-381"
+)
+
+// Phase of a DKG round
+type Phase int
+
+const (
+	// Registering collects the encryption keys of the members
+	Registering Phase = iota
+	// Dealing collects the Deals
+	Dealing
+	// Complaining collects the Complaints about the Deals
+	Complaining
+	// Justifying collects the shares revealed by the accused dealers
+	Justifying
+)
+
+// String ...
+func (p Phase) String() string {
+	switch p {
+	case Registering:
+		return "Registering"
+	case Dealing:
+		return "Dealing"
+	case Complaining:
+		return "Complaining"
+	case Justifying:
+		return "Justifying"
+	default:
+		return fmt.Sprintf("Phase(%d)", int(p))
+	}
+}
+
+// Epoch is a group key and the shares of its holders, generated by a DKG
+// round. The index of a member in the polynomial is its position in Members
+// plus one.
+type Epoch struct {
+	Epoch       int // Block index at which the DKG round started
+	PeerSetHash []byte
+	Members     []uint32 // sorted
+	Holders     []uint32 // the members which hold a share, sorted
+	Threshold   int
+	Commitments [][]byte // of the group polynomial; the first is the group key
+	Share       []byte   `json:",omitempty"` // our share, if we hold one
+}
+
+// GroupKey ...
+func (e *Epoch) GroupKey() []byte {
+	return e.Commitments[0]
+}
+
+// index returns the index of a member in the polynomial, or 0
+func (e *Epoch) index(id uint32) int {
+	return memberIndex(e.Members, id)
+}
+
+// publicShare returns the public key of the share of a member
+func (e *Epoch) publicShare(id uint32) (*bls12381.PointG2, error) {
+	i := e.index(id)
+	if i == 0 || !contains(e.Holders, id) {
+		return nil, fmt.Errorf("%d holds no share of epoch %d", id, e.Epoch)
+	}
+	commitments, err := parseCommitments(e.Commitments)
+	if err != nil {
+		return nil, err
+	}
+	return evalCommitments(commitments, i), nil
+}
+
+// round is a DKG round in progress: a Joint-Feldman DKG whose messages are
+// ordered by the consensus, so that all the validators agree on its outcome.
+// A reshare round deals the shares of the previous Epoch instead of random
+// secrets, which keeps the group key.
+type round struct {
+	Epoch       int
+	PeerSetHash []byte
+	Members     []uint32
+	Threshold   int
+	Reshare     bool
+
+	Phase      Phase
+	PhaseStart int
+
+	EncryptionKeys map[uint32][]byte   // [receiver] => registered key
+	Dealers        []uint32            // set when Dealing starts
+	Deals          map[uint32][][]byte // [dealer] => valid commitments
+	Complaints     map[uint32][]uint32 // [dealer] => complainers
+	Complained     map[uint32]bool     // receivers which sent their Complaint
+	Justified      map[uint32]bool
+	Disqualified   map[uint32]bool
+
+	//secrets
+	EncryptionKey []byte            `json:",omitempty"`
+	Poly          [][]byte          `json:",omitempty"` // our polynomial, kept until the end
+	Shares        map[uint32][]byte `json:",omitempty"` // [dealer] => our share
+	Bad           []uint32          `json:",omitempty"` // dealers whose share to us is invalid
+}
+
+func memberIndex(members []uint32, id uint32) int {
+	for i, m := range members {
+		if m == id {
+			return i + 1
+		}
+	}
+	return 0
+}
+
+func contains(ids []uint32, id uint32) bool {
+	return memberIndex(ids, id) != 0
+}
+
+func sortedIDs(ids []uint32) []uint32 {
+	res := append([]uint32{}, ids...)
+	sort.Slice(res, func(i, j int) bool { return res[i] < res[j] })
+	return res
+}
+
+func sortedKeys(m map[uint32][]byte) []uint32 {
+	res := make([]uint32, 0, len(m))
+	for id := range m {
+		res = append(res, id)
+	}
+	return sortedIDs(res)
+}
+
+// shareContext binds an encrypted share to its round, dealer, and receiver
+func shareContext(epoch int, dealer, receiver uint32) []byte {
+	return []byte(fmt.Sprintf("bolaxy-dkg-share/%d/%d/%d", epoch, dealer, receiver))
+}
+
+// required returns the number of valid Deals the round needs: a threshold of
+// the new members, or, for a reshare, of the holders of the previous Epoch
+func (s *Service) required(r *round) int {
+	if r.Reshare {
+		return s.state.Current.Threshold
+	}
+	return r.Threshold
+}
+
+// eligible reports whether a member may deal in the round
+func (s *Service) eligible(r *round, id uint32) bool {
+	if r.Reshare {
+		return contains(s.state.Current.Holders, id)
+	}
+	return true
+}
+
+// startRound starts a DKG round for the PeerSet of block, which reshares the
+// current Epoch if enough of its holders remain
+func (s *Service) startRound(block *types.Block, peerSet *conf.PeerSet, hash []byte) error {
+	r := &round{
+		Epoch:          block.Index(),
+		PeerSetHash:    hash,
+		Members:        sortedIDs(peerSet.IDs()),
+		Threshold:      peerSet.SuperMajority(),
+		Phase:          Registering,
+		PhaseStart:     block.Index(),
+		EncryptionKeys: make(map[uint32][]byte),
+		Deals:          make(map[uint32][][]byte),
+		Complaints:     make(map[uint32][]uint32),
+		Complained:     make(map[uint32]bool),
+		Justified:      make(map[uint32]bool),
+		Disqualified:   make(map[uint32]bool),
+		Shares:         make(map[uint32][]byte),
+	}
+
+	if cur := s.state.Current; cur != nil {
+		remaining := 0
+		for _, id := range cur.Holders {
+			if contains(r.Members, id) {
+				remaining++
+			}
+		}
+		r.Reshare = remaining >= cur.Threshold
+	}
+
+	s.state.Round = r
+	s.dirty = true
+
+	s.logger.Info("dkg round started",
+		"epoch", r.Epoch,
+		"members", len(r.Members),
+		"threshold", r.Threshold,
+		"reshare", r.Reshare)
+
+	if !contains(r.Members, s.self) {
+		return nil
+	}
+
+	key, err := crypto.GenerateKey()
+	if err != nil {
+		return err
+	}
+	r.EncryptionKey = crypto.FromECDSA(key)
+
+	return s.submit(KindRegistration, r.Epoch, &Registration{
+		EncryptionKey: crypto.CompressPubkey(&key.PublicKey),
+	})
+}
+
+// restart abandons the current round for a new one
+func (s *Service) restart(block *types.Block, reason string) error {
+	r := s.state.Round
+
+	s.logger.Warn("dkg round failed",
+		"epoch", r.Epoch,
+		"phase", r.Phase,
+		"reason", reason)
+
+	peerSet, err := s.store.GetPeerSet(block.RoundReceived())
+	if err != nil {
+		return err
+	}
+	return s.startRound(block, peerSet, r.PeerSetHash)
+}
+
+/*******************************************************************************
+Messages
+*******************************************************************************/
+
+// onMessage processes a DKG Message of the current round. Invalid messages
+// are logged and ignored: they come from faulty validators, and must not
+// stop the commits.
+func (s *Service) onMessage(m *Message) {
+	r := s.state.Round
+	if r == nil || m.Epoch != r.Epoch || !contains(r.Members, m.From) {
+		return
+	}
+
+	var err error
+	switch m.Kind {
+	case KindRegistration:
+		err = s.onRegistration(r, m)
+	case KindDeal:
+		err = s.onDeal(r, m)
+	case KindComplaint:
+		err = s.onComplaint(r, m)
+	case KindJustification:
+		err = s.onJustification(r, m)
+	default:
+		err = fmt.Errorf("unexpected %s", m.Kind)
+	}
+
+	if err != nil {
+		s.logger.Warn("invalid dkg message",
+			"epoch", m.Epoch,
+			"from", m.From,
+			"kind", m.Kind,
+			logger.Err, err)
+		return
+	}
+
+	s.dirty = true
+}
+
+func (s *Service) onRegistration(r *round, m *Message) error {
+	if r.Phase != Registering {
+		return fmt.Errorf("registration during %s", r.Phase)
+	}
+	if _, ok := r.EncryptionKeys[m.From]; ok {
+		return fmt.Errorf("duplicate registration")
+	}
+
+	var body Registration
+	if err := m.decode(&body); err != nil {
+		return err
+	}
+	if _, err := crypto.DecompressPubkey(body.EncryptionKey); err != nil {
+		return fmt.Errorf("encryption key: %v", err)
+	}
+
+	r.EncryptionKeys[m.From] = body.EncryptionKey
+	return nil
+}
+
+func (s *Service) onDeal(r *round, m *Message) error {
+	if r.Phase != Dealing {
+		return fmt.Errorf("deal during %s", r.Phase)
+	}
+	if !contains(r.Dealers, m.From) {
+		return fmt.Errorf("not a dealer")
+	}
+	if _, ok := r.Deals[m.From]; ok {
+		return fmt.Errorf("duplicate deal")
+	}
+
+	var body Deal
+	if err := m.decode(&body); err != nil {
+		return err
+	}
+
+	if len(body.Commitments) != r.Threshold {
+		return fmt.Errorf("%d commitments, expected %d", len(body.Commitments), r.Threshold)
+	}
+	commitments, err := parseCommitments(body.Commitments)
+	if err != nil {
+		return err
+	}
+
+	if r.Reshare {
+		//the dealer must share its share of the current Epoch
+		old, err := s.state.Current.publicShare(m.From)
+		if err != nil {
+			return err
+		}
+		if !g2Equal(old, commitments[0]) {
+			return fmt.Errorf("reshared secret is not the dealer's share")
+		}
+	}
+
+	for id := range r.EncryptionKeys {
+		if _, ok := body.Shares[id]; !ok {
+			return fmt.Errorf("no share for %d", id)
+		}
+	}
+
+	r.Deals[m.From] = body.Commitments
+
+	if _, ok := r.EncryptionKeys[s.self]; !ok || len(r.EncryptionKey) == 0 {
+		return nil
+	}
+
+	//check our share, and complain if it is invalid
+	key, err := crypto.ToECDSA(r.EncryptionKey)
+	if err != nil {
+		return err
+	}
+
+	plain, err := decryptShare(key, body.Shares[s.self], shareContext(r.Epoch, m.From, s.self))
+	if err == nil {
+		var share *big.Int
+		if share, err = parseScalar(plain); err == nil {
+			if verifyShare(commitments, memberIndex(r.Members, s.self), share) {
+				r.Shares[m.From] = plain
+				return nil
+			}
+		}
+	}
+
+	s.logger.Warn("invalid dkg share", "epoch", r.Epoch, "dealer", m.From)
+	r.Bad = append(r.Bad, m.From)
+
+	return nil
+}
+
+func (s *Service) onComplaint(r *round, m *Message) error {
+	if r.Phase != Complaining {
+		return fmt.Errorf("complaint during %s", r.Phase)
+	}
+	if _, ok := r.EncryptionKeys[m.From]; !ok {
+		return fmt.Errorf("not a receiver")
+	}
+	if r.Complained[m.From] {
+		return fmt.Errorf("duplicate complaint")
+	}
+
+	var body Complaint
+	if err := m.decode(&body); err != nil {
+		return err
+	}
+
+	r.Complained[m.From] = true
+
+	for _, dealer := range body.Dealers {
+		if _, ok := r.Deals[dealer]; !ok || contains(r.Complaints[dealer], m.From) {
+			continue
+		}
+		r.Complaints[dealer] = append(r.Complaints[dealer], m.From)
+	}
+
+	return nil
+}
+
+func (s *Service) onJustification(r *round, m *Message) error {
+	if r.Phase != Justifying {
+		return fmt.Errorf("justification during %s", r.Phase)
+	}
+	complainers, ok := r.Complaints[m.From]
+	if !ok {
+		return fmt.Errorf("no complaint against the dealer")
+	}
+	if r.Justified[m.From] {
+		return fmt.Errorf("duplicate justification")
+	}
+
+	var body Justification
+	if err := m.decode(&body); err != nil {
+		return err
+	}
+
+	commitments, err := parseCommitments(r.Deals[m.From])
+	if err != nil {
+		return err
+	}
+
+	r.Justified[m.From] = true
+
+	for _, c := range complainers {
+		share, err := parseScalar(body.Shares[c])
+		if err != nil || !verifyShare(commitments, memberIndex(r.Members, c), share) {
+			r.Disqualified[m.From] = true
+			return fmt.Errorf("invalid share revealed for %d", c)
+		}
+		if c == s.self {
+			r.Shares[m.From] = scalarBytes(share)
+		}
+	}
+
+	return nil
+}
+
+/*******************************************************************************
+Phases
+*******************************************************************************/
+
+// advance closes the phase of the round when all the expected messages were
+// committed, or after PhaseBlocks Blocks if enough of them were
+func (s *Service) advance(ctx context.Context, block *types.Block) error {
+	r := s.state.Round
+	if r == nil {
+		return nil
+	}
+
+	elapsed := block.Index()-r.PhaseStart >= s.phaseBlocks
+
+	switch r.Phase {
+	case Registering:
+		dealers := []uint32{}
+		for _, id := range sortedKeys(r.EncryptionKeys) {
+			if s.eligible(r, id) {
+				dealers = append(dealers, id)
+			}
+		}
+
+		//without enough holders of the current Epoch, fall back to a new
+		//group key rather than waiting for them forever
+		if r.Reshare && elapsed && len(dealers) < s.required(r) {
+			s.logger.Warn("not enough holders to reshare, generating a new group key",
+				"epoch", r.Epoch,
+				"holders", len(dealers),
+				"required", s.required(r))
+			r.Reshare = false
+			s.dirty = true
+			dealers = sortedKeys(r.EncryptionKeys)
+		}
+
+		enough := len(r.EncryptionKeys) >= r.Threshold && len(dealers) >= s.required(r)
+		if !(len(r.EncryptionKeys) == len(r.Members) || elapsed) || !enough {
+			return nil
+		}
+
+		r.Dealers = dealers
+		s.setPhase(r, Dealing, block)
+		return s.deal(r)
+
+	case Dealing:
+		if len(r.Deals) < len(r.Dealers) && !elapsed {
+			return nil
+		}
+		if len(r.Deals) < s.required(r) {
+			return s.restart(block, fmt.Sprintf("%d deals, %d required", len(r.Deals), s.required(r)))
+		}
+
+		s.setPhase(r, Complaining, block)
+		if _, ok := r.EncryptionKeys[s.self]; !ok {
+			return nil
+		}
+		return s.submit(KindComplaint, r.Epoch, &Complaint{Dealers: sortedIDs(r.Bad)})
+
+	case Complaining:
+		if len(r.Complained) < len(r.EncryptionKeys) && !elapsed {
+			return nil
+		}
+		if len(r.Complaints) == 0 {
+			return s.finish(ctx, block)
+		}
+
+		s.setPhase(r, Justifying, block)
+		return s.justify(r)
+
+	case Justifying:
+		if len(r.Justified) < len(r.Complaints) && !elapsed {
+			return nil
+		}
+		for dealer := range r.Complaints {
+			if !r.Justified[dealer] {
+				r.Disqualified[dealer] = true
+			}
+		}
+		return s.finish(ctx, block)
+	}
+
+	return nil
+}
+
+func (s *Service) setPhase(r *round, p Phase, block *types.Block) {
+	r.Phase = p
+	r.PhaseStart = block.Index()
+	s.dirty = true
+
+	s.logger.Debug("dkg phase", "epoch", r.Epoch, "phase", p, logger.Block, block.Index())
+}
+
+// deal submits our Deal if we are a dealer of the round
+func (s *Service) deal(r *round) error {
+	if !contains(r.Dealers, s.self) {
+		return nil
+	}
+
+	var secret *big.Int
+	if r.Reshare {
+		var err error
+		if secret, err = parseScalar(s.state.Current.Share); err != nil {
+			return fmt.Errorf("current share: %v", err)
+		}
+	}
+
+	p, err := newPoly(r.Threshold, secret)
+	if err != nil {
+		return err
+	}
+
+	deal := &Deal{
+		Commitments: p.commit(),
+		Shares:      make(map[uint32][]byte, len(r.EncryptionKeys)),
+	}
+	for id, key := range r.EncryptionKeys {
+		share := scalarBytes(p.eval(memberIndex(r.Members, id)))
+		enc, err := encryptShare(key, share, shareContext(r.Epoch, s.self, id))
+		if err != nil {
+			return err
+		}
+		deal.Shares[id] = enc
+	}
+
+	r.Poly = make([][]byte, len(p))
+	for i, c := range p {
+		r.Poly[i] = scalarBytes(c)
+	}
+
+	return s.submit(KindDeal, r.Epoch, deal)
+}
+
+// justify reveals the shares we were complained about
+func (s *Service) justify(r *round) error {
+	complainers, ok := r.Complaints[s.self]
+	if !ok || len(r.Poly) == 0 {
+		return nil
+	}
+
+	p := make(poly, len(r.Poly))
+	for i, c := range r.Poly {
+		p[i] = new(big.Int).SetBytes(c)
+	}
+
+	body := &Justification{Shares: make(map[uint32][]byte, len(complainers))}
+	for _, c := range complainers {
+		body.Shares[c] = scalarBytes(p.eval(memberIndex(r.Members, c)))
+	}
+
+	return s.submit(KindJustification, r.Epoch, body)
+}
+
+// finish computes the Epoch from the Deals of the qualified dealers, or
+// restarts the round if there are not enough of them
+func (s *Service) finish(ctx context.Context, block *types.Block) error {
+	r := s.state.Round
+
+	qual := []uint32{}
+	for _, id := range r.Dealers {
+		if _, ok := r.Deals[id]; ok && !r.Disqualified[id] {
+			qual = append(qual, id)
+		}
+	}
+	if len(qual) < s.required(r) {
+		return s.restart(block, fmt.Sprintf("%d qualified dealers, %d required", len(qual), s.required(r)))
+	}
+
+	//the coefficient of each dealer: 1, or its Lagrange coefficient in the
+	//polynomial of the current Epoch for a reshare
+	coeffs := make(map[uint32]*big.Int, len(qual))
+	if r.Reshare {
+		indexes := make([]int, len(qual))
+		for i, id := range qual {
+			indexes[i] = s.state.Current.index(id)
+		}
+		for i, id := range qual {
+			coeffs[id] = lagrange(indexes[i], indexes)
+		}
+	} else {
+		for _, id := range qual {
+			coeffs[id] = big.NewInt(1)
+		}
+	}
+
+	group := make([]*bls12381.PointG2, r.Threshold)
+	for _, id := range qual {
+		commitments, err := parseCommitments(r.Deals[id])
+		if err != nil {
+			return err
+		}
+		for k, c := range commitments {
+			term := g2Mul(c, coeffs[id])
+			if group[k] == nil {
+				group[k] = term
+			} else {
+				group[k] = g2Add(group[k], term)
+			}
+		}
+	}
+
+	e := &Epoch{
+		Epoch:       r.Epoch,
+		PeerSetHash: r.PeerSetHash,
+		Members:     r.Members,
+		Holders:     sortedKeys(r.EncryptionKeys),
+		Threshold:   r.Threshold,
+		Commitments: make([][]byte, len(group)),
+	}
+	for k, g := range group {
+		e.Commitments[k] = g2Bytes(g)
+	}
+
+	if r.Reshare && !bytes.Equal(e.GroupKey(), s.state.Current.GroupKey()) {
+		return s.restart(block, "reshare changed the group key")
+	}
+
+	if _, ok := r.EncryptionKeys[s.self]; ok {
+		share := new(big.Int)
+		for _, id := range qual {
+			raw, ok := r.Shares[id]
+			if !ok {
+				share = nil
+				break
+			}
+			term := new(big.Int).Mul(new(big.Int).SetBytes(raw), coeffs[id])
+			share.Add(share, term).Mod(share, curveOrder)
+		}
+
+		if share != nil && verifyShare(group, e.index(s.self), share) {
+			e.Share = scalarBytes(share)
+		} else {
+			s.logger.Error("no valid share of the group key", "epoch", r.Epoch)
+		}
+	}
+
+	s.state.Current = e
+	s.state.Round = nil
+	s.state.Pending = make(map[int]*pending)
+	s.dirty = true
+
+	s.logger.Info("group key generated",
+		"epoch", e.Epoch,
+		"dealers", len(qual),
+		"holders", len(e.Holders),
+		"threshold", e.Threshold,
+		"reshare", r.Reshare,
+		"holder", e.Share != nil)
+
+	return nil
+}
@@ -0,0 +1,228 @@
+package threshold
+
+import (
+	"context"
+	"encoding/json"
+	"math/big"
+	"strings"
+	"testing"
+
+	"github.com/bolaxy/common/hexutil"
+	"github.com/bolaxy/config"
+	"github.com/bolaxy/core/logger"
+	"github.com/bolaxy/core/signer"
+	"github.com/bolaxy/core/types"
+	"github.com/bolaxy/crypto"
+)
+
+// dkgNet runs the DKG of a few Services, delivering the submitted messages to
+// all of them in one Block per step, as the consensus would
+type dkgNet struct {
+	peers    []*conf.Peer
+	peerSet  *conf.PeerSet
+	services []*Service
+	queue    [][]byte
+	kinds    map[Kind]int //delivered messages by Kind
+
+	//tamper can alter a message before a Service processes it
+	tamper func(to *Service, m *Message)
+}
+
+func newDKGNet(t *testing.T, n int) *dkgNet {
+	net := &dkgNet{kinds: make(map[Kind]int)}
+
+	signers := make([]signer.Signer, n)
+	for i := range signers {
+		key, err := crypto.GenerateKey()
+		if err != nil {
+			t.Fatal(err)
+		}
+		signers[i] = signer.NewLocal(key)
+		pub := strings.ToUpper(hexutil.Encode(crypto.CompressPubkey(&key.PublicKey)))
+		net.peers = append(net.peers, conf.NewPeer(pub, "peer", "peer", "0", "1"))
+	}
+	net.peerSet = conf.NewPeerSet(net.peers)
+
+	for i, p := range net.peers {
+		s := &Service{
+			signer:      signers[i],
+			self:        p.ID(),
+			phaseBlocks: DefaultPhaseBlocks,
+			logger:      logger.Nop,
+			state:       state{Pending: make(map[int]*pending)},
+		}
+		s.submitter = func(tx []byte, _ types.PayloadType) {
+			net.queue = append(net.queue, tx)
+		}
+		net.services = append(net.services, s)
+	}
+
+	return net
+}
+
+func (net *dkgNet) block(index int) *types.Block {
+	return types.NewBlock(index, index, []byte{}, net.peers, nil, nil)
+}
+
+// run starts a round and commits the messages until every Service has an
+// Epoch, or fails after maxBlocks
+func (net *dkgNet) run(t *testing.T, maxBlocks int) {
+	hash, err := net.peerSet.Hash()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, s := range net.services {
+		if err := s.startRound(net.block(0), net.peerSet, hash); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for index := 1; index <= maxBlocks; index++ {
+		txs := net.queue
+		net.queue = nil
+
+		for _, s := range net.services {
+			for _, tx := range txs {
+				m, err := parseMessage(tx, net.peerSet)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if net.tamper != nil {
+					net.tamper(s, m)
+				}
+				s.onMessage(m)
+			}
+			if err := s.advance(context.Background(), net.block(index)); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		for _, tx := range txs {
+			var m Message
+			if err := json.Unmarshal(tx, &m); err != nil {
+				t.Fatal(err)
+			}
+			net.kinds[m.Kind]++
+		}
+
+		done := true
+		for _, s := range net.services {
+			done = done && s.state.Current != nil
+		}
+		if done {
+			return
+		}
+	}
+
+	t.Fatalf("no group key after %d blocks", maxBlocks)
+}
+
+// checkEpoch checks that the Services agree on the group key, and that a
+// threshold of their shares signs for it
+func (net *dkgNet) checkEpoch(t *testing.T) *Epoch {
+	e := net.services[0].state.Current
+	for _, s := range net.services {
+		cur := s.state.Current
+		if string(cur.GroupKey()) != string(e.GroupKey()) {
+			t.Fatalf("%d has another group key", s.self)
+		}
+		if len(cur.Share) == 0 {
+			t.Fatalf("%d holds no share", s.self)
+		}
+		pub, err := cur.publicShare(s.self)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !g2Equal(pub, g2Base(new(big.Int).SetBytes(cur.Share))) {
+			t.Fatalf("share of %d does not match its public share", s.self)
+		}
+	}
+
+	msg := []byte("checkpoint")
+	shares := make(map[int][]byte)
+	for _, s := range net.services[len(net.services)-e.Threshold:] {
+		share, err := sign(new(big.Int).SetBytes(s.state.Current.Share), msg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		shares[e.index(s.self)] = share
+	}
+	sig, err := combine(shares)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := Verify(e.GroupKey(), msg, sig); err != nil {
+		t.Fatalf("threshold signature: %v", err)
+	}
+
+	return e
+}
+
+func TestDKG(t *testing.T) {
+	net := newDKGNet(t, 4)
+	net.run(t, 10)
+	net.checkEpoch(t)
+
+	if net.kinds[KindJustification] != 0 {
+		t.Fatalf("%d justifications without complaints", net.kinds[KindJustification])
+	}
+}
+
+func TestDKGComplaint(t *testing.T) {
+	net := newDKGNet(t, 4)
+	dealer, receiver := net.services[0], net.services[1]
+
+	//the share of dealer to receiver does not decrypt, so receiver complains,
+	//and dealer reveals the share in its justification
+	secrets := make(map[uint32][]byte) //[dealer] => commitment of its secret
+	net.tamper = func(to *Service, m *Message) {
+		if to != receiver || m.Kind != KindDeal {
+			return
+		}
+		var body Deal
+		if err := m.decode(&body); err != nil {
+			t.Fatal(err)
+		}
+		secrets[m.From] = body.Commitments[0]
+		if m.From != dealer.self {
+			return
+		}
+		enc := append([]byte{}, body.Shares[receiver.self]...)
+		enc[len(enc)-1] ^= 1
+		body.Shares[receiver.self] = enc
+
+		raw, err := json.Marshal(&body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		m.Body = raw
+	}
+
+	net.run(t, 10)
+	e := net.checkEpoch(t)
+
+	if net.kinds[KindJustification] != 1 {
+		t.Fatalf("%d justifications, want 1", net.kinds[KindJustification])
+	}
+
+	//the justified dealer stays qualified: the group key is the sum of the
+	//secrets of all the dealers
+	if len(secrets) != len(net.services) {
+		t.Fatalf("%d deals, want %d", len(secrets), len(net.services))
+	}
+	raw := make([][]byte, 0, len(secrets))
+	for _, c := range secrets {
+		raw = append(raw, c)
+	}
+	commitments, err := parseCommitments(raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sum := commitments[0]
+	for _, c := range commitments[1:] {
+		sum = g2Add(sum, c)
+	}
+	if string(g2Bytes(sum)) != string(e.GroupKey()) {
+		t.Fatal("group key without the secret of the justified dealer")
+	}
+}
@@ -0,0 +1,93 @@
+package threshold
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdsa"
+	"crypto/rand"
+	"errors"
+
+	"github.com/bolaxy/crypto"
+)
+
+// The shares are dealt in Blocks, which every validator reads, so each one is
+// encrypted to the encryption key its receiver registered for the epoch:
+// ECDH with an ephemeral secp256k1 key, whose secret keys AES-256-GCM.
+
+var errDecryptShare = errors.New("could not decrypt share")
+
+// encryptShare encrypts share for the holder of the compressed key to,
+// binding it to context. The result is the compressed ephemeral key, the
+// nonce, and the ciphertext.
+func encryptShare(to, share, context []byte) ([]byte, error) {
+	pub, err := crypto.DecompressPubkey(to)
+	if err != nil {
+		return nil, err
+	}
+
+	eph, err := crypto.GenerateKey()
+	if err != nil {
+		return nil, err
+	}
+
+	aead, err := shareAEAD(eph, pub)
+	if err != nil {
+		return nil, err
+	}
+
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+
+	res := crypto.CompressPubkey(&eph.PublicKey)
+	res = append(res, nonce...)
+	return aead.Seal(res, nonce, share, context), nil
+}
+
+// decryptShare reverses encryptShare with the private encryption key
+func decryptShare(key *ecdsa.PrivateKey, data, context []byte) ([]byte, error) {
+	if len(data) < 33 {
+		return nil, errDecryptShare
+	}
+
+	eph, err := crypto.DecompressPubkey(data[:33])
+	if err != nil {
+		return nil, errDecryptShare
+	}
+
+	aead, err := shareAEAD(key, eph)
+	if err != nil {
+		return nil, err
+	}
+
+	data = data[33:]
+	if len(data) < aead.NonceSize() {
+		return nil, errDecryptShare
+	}
+
+	plain, err := aead.Open(nil, data[:aead.NonceSize()], data[aead.NonceSize():], context)
+	if err != nil {
+		return nil, errDecryptShare
+	}
+	return plain, nil
+}
+
+// shareAEAD derives the cipher of the ECDH secret of priv and pub, which is
+// the same on both sides
+func shareAEAD(priv *ecdsa.PrivateKey, pub *ecdsa.PublicKey) (cipher.AEAD, error) {
+	x, _ := crypto.S256().ScalarMult(pub.X, pub.Y, priv.D.Bytes())
+	if x == nil {
+		return nil, errDecryptShare
+	}
+
+	secret := make([]byte, 32)
+	xb := x.Bytes()
+	copy(secret[32-len(xb):], xb)
+
+	block, err := aes.NewCipher(crypto.Keccak256(secret))
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
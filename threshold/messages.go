@@ -0,0 +1,153 @@
+package threshold
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/bolaxy/config"
+	"github.com/bolaxy/core/signer"
+	"github.com/bolaxy/crypto"
+)
+
+// Kind identifies the body of a Message
+type Kind uint8
+
+const (
+	// KindRegistration publishes the encryption key of a member for an epoch
+	KindRegistration Kind = iota
+	// KindDeal publishes the commitments of a dealer and its encrypted shares
+	KindDeal
+	// KindComplaint lists the dealers whose shares did not verify
+	KindComplaint
+	// KindJustification reveals the shares a dealer was complained about
+	KindJustification
+	// KindAttestation is a signature share of a checkpoint
+	KindAttestation
+)
+
+// String ...
+func (k Kind) String() string {
+	switch k {
+	case KindRegistration:
+		return "Registration"
+	case KindDeal:
+		return "Deal"
+	case KindComplaint:
+		return "Complaint"
+	case KindJustification:
+		return "Justification"
+	case KindAttestation:
+		return "Attestation"
+	default:
+		return fmt.Sprintf("Kind(%d)", uint8(k))
+	}
+}
+
+// ErrBadSignature is returned for a Message which was not signed by its
+// sender
+var ErrBadSignature = errors.New("invalid message signature")
+
+// Message is the transaction of the threshold protocol. The Blocks do not
+// record which validator submitted a transaction, so each Message is signed
+// with the key of its sender.
+type Message struct {
+	Kind      Kind
+	Epoch     int
+	From      uint32
+	Body      []byte // JSON of the body of the Kind
+	Signature []byte `json:",omitempty"`
+}
+
+// Registration ...
+type Registration struct {
+	EncryptionKey []byte // compressed secp256k1 key
+}
+
+// Deal ...
+type Deal struct {
+	Commitments [][]byte          // G2 commitments of the coefficients
+	Shares      map[uint32][]byte // [receiver] => encrypted share
+}
+
+// Complaint ...
+type Complaint struct {
+	Dealers []uint32
+}
+
+// Justification ...
+type Justification struct {
+	Shares map[uint32][]byte // [complainer] => share in clear
+}
+
+// Attestation ...
+type Attestation struct {
+	BlockIndex int
+	BlockHash  []byte
+	Share      []byte // G1 signature share of BlockHash
+}
+
+// newMessage encodes and signs a Message
+func newMessage(kind Kind, epoch int, from uint32, body interface{}, s signer.Signer) ([]byte, error) {
+	raw, err := json.Marshal(body)
+	if err != nil {
+		return nil, err
+	}
+
+	m := &Message{
+		Kind:  kind,
+		Epoch: epoch,
+		From:  from,
+		Body:  raw,
+	}
+
+	digest, err := m.digest()
+	if err != nil {
+		return nil, err
+	}
+	if m.Signature, err = s.Sign(digest); err != nil {
+		return nil, err
+	}
+
+	return json.Marshal(m)
+}
+
+// parseMessage decodes a Message and checks its signature against the key of
+// its sender in peers
+func parseMessage(data []byte, peers *conf.PeerSet) (*Message, error) {
+	m := new(Message)
+	if err := json.Unmarshal(data, m); err != nil {
+		return nil, err
+	}
+
+	peer, ok := peers.ByID[m.From]
+	if !ok {
+		return nil, fmt.Errorf("message from unknown peer %d", m.From)
+	}
+
+	digest, err := m.digest()
+	if err != nil {
+		return nil, err
+	}
+	if len(m.Signature) < 64 || !crypto.VerifySignature(peer.PubKeyBytes(), digest, m.Signature[:64]) {
+		return nil, ErrBadSignature
+	}
+
+	return m, nil
+}
+
+func (m *Message) digest() ([]byte, error) {
+	unsigned := *m
+	unsigned.Signature = nil
+
+	raw, err := json.Marshal(&unsigned)
+	if err != nil {
+		return nil, err
+	}
+	return crypto.Keccak256([]byte("bolaxy-dkg"), raw), nil
+}
+
+// decode unmarshals the body of m
+func (m *Message) decode(body interface{}) error {
+	return json.Unmarshal(m.Body, body)
+}
@@ -0,0 +1,100 @@
+package threshold
+
+import (
+	"math/big"
+
+	bls12381 "github.com/kilic/bls12-381"
+)
+
+// poly is a polynomial over the scalars of BLS12-381, lowest degree first
+type poly []*big.Int
+
+// newPoly returns a random polynomial of degree t-1 whose constant term is
+// secret, or random if secret is nil
+func newPoly(t int, secret *big.Int) (poly, error) {
+	p := make(poly, t)
+	for i := range p {
+		if i == 0 && secret != nil {
+			p[i] = new(big.Int).Set(secret)
+			continue
+		}
+		k, err := randomScalar()
+		if err != nil {
+			return nil, err
+		}
+		p[i] = k
+	}
+	return p, nil
+}
+
+// eval returns p(x)
+func (p poly) eval(x int) *big.Int {
+	bx := big.NewInt(int64(x))
+	res := new(big.Int)
+	for i := len(p) - 1; i >= 0; i-- {
+		res.Mul(res, bx)
+		res.Add(res, p[i])
+		res.Mod(res, curveOrder)
+	}
+	return res
+}
+
+// commit returns the Feldman commitments of the coefficients of p
+func (p poly) commit() [][]byte {
+	res := make([][]byte, len(p))
+	for i, c := range p {
+		res[i] = g2Bytes(g2Base(c))
+	}
+	return res
+}
+
+// parseCommitments decodes Feldman commitments
+func parseCommitments(raw [][]byte) ([]*bls12381.PointG2, error) {
+	res := make([]*bls12381.PointG2, len(raw))
+	for i, b := range raw {
+		p, err := parseG2(b)
+		if err != nil {
+			return nil, err
+		}
+		res[i] = p
+	}
+	return res, nil
+}
+
+// evalCommitments returns the commitment of p(x) given the commitments of the
+// coefficients of p
+func evalCommitments(commitments []*bls12381.PointG2, x int) *bls12381.PointG2 {
+	bx := big.NewInt(int64(x))
+	pow := big.NewInt(1)
+
+	res := bls12381.NewG2().Zero()
+	for _, c := range commitments {
+		res = g2Add(res, g2Mul(c, pow))
+		pow = new(big.Int).Mod(new(big.Int).Mul(pow, bx), curveOrder)
+	}
+	return res
+}
+
+// verifyShare checks a share for index x against the commitments of its
+// polynomial
+func verifyShare(commitments []*bls12381.PointG2, x int, share *big.Int) bool {
+	return g2Equal(g2Base(share), evalCommitments(commitments, x))
+}
+
+// lagrange returns the Lagrange coefficient of i at 0 for the set of indexes,
+// which contains i
+func lagrange(i int, indexes []int) *big.Int {
+	num := big.NewInt(1)
+	den := big.NewInt(1)
+	for _, j := range indexes {
+		if j == i {
+			continue
+		}
+		num.Mul(num, big.NewInt(int64(-j)))
+		num.Mod(num, curveOrder)
+		den.Mul(den, big.NewInt(int64(i-j)))
+		den.Mod(den, curveOrder)
+	}
+	den.ModInverse(den, curveOrder)
+	return num.Mul(num, den).Mod(num, curveOrder)
+}
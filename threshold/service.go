@@ -0,0 +1,527 @@
+// Package threshold signs the checkpoint Anchors with a single BLS signature
+// of the validator set. The validators run a distributed key generation (DKG)
+// through the consensus: its messages are transactions, so every validator
+// processes them in the same order and agrees on the group key without a
+// trusted dealer. When the PeerSet changes, the holders of the shares reshare
+// them to the new validators, which keeps the group key, or a new one is
+// generated if too few of them remain.
+//
+// Every validator then signs the hash of the checkpoint Blocks with its
+// share, and a threshold of signature shares combine into the signature of
+// the group key, which is recorded on the Anchor.
+package threshold
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"sort"
+	"sync"
+
+	"github.com/bolaxy/core/anchor"
+	"github.com/bolaxy/core/db"
+	"github.com/bolaxy/core/hashgraph"
+	"github.com/bolaxy/core/logger"
+	"github.com/bolaxy/core/signer"
+	"github.com/bolaxy/core/store"
+	"github.com/bolaxy/core/types"
+	"github.com/bolaxy/errors"
+)
+
+const (
+	dkgPrefix          = "dkg"
+	thresholdSigPrefix = "dkgsig"
+)
+
+// DefaultPhaseBlocks is the number of Blocks after which a DKG phase closes
+// without the messages of all the validators
+const DefaultPhaseBlocks = 10
+
+// maxPending bounds the checkpoints whose signature shares are collected
+const maxPending = 16
+
+// Submitter submits a transaction with a PayloadType, like
+// node.Node.SubmitTypedTx
+type Submitter func(tx []byte, t types.PayloadType)
+
+// pending collects the signature shares of a checkpoint
+type pending struct {
+	Hash   []byte
+	Shares map[int][]byte // [holder index] => signature share
+}
+
+// state is persisted in the db after every Block which changes it. It holds
+// the secrets of the validator: its share of the group key, and of the round
+// in progress.
+type state struct {
+	Current *Epoch `json:",omitempty"`
+	Round   *round `json:",omitempty"`
+	Pending map[int]*pending
+}
+
+// Service runs the DKG and signs the checkpoints of a Checkpointer
+type Service struct {
+	db           db.Sinker
+	store        store.Store
+	signer       signer.Signer
+	self         uint32
+	checkpointer *anchor.Checkpointer
+	phaseBlocks  int
+	submitter    Submitter
+	logger       logger.Logger
+
+	lock  sync.Mutex
+	state state
+	dirty bool
+}
+
+// NewService loads the DKG state of sinker. self is the ID of the validator
+// whose key is held by s. The Anchors of checkpointer receive the threshold
+// signatures.
+func NewService(sinker db.Sinker,
+	st store.Store,
+	s signer.Signer,
+	self uint32,
+	checkpointer *anchor.Checkpointer) (*Service, error) {
+
+	svc := &Service{
+		db:           sinker,
+		store:        st,
+		signer:       s,
+		self:         self,
+		checkpointer: checkpointer,
+		phaseBlocks:  DefaultPhaseBlocks,
+		logger:       logger.Nop,
+		state:        state{Pending: make(map[int]*pending)},
+	}
+
+	data, err := sinker.Get(context.Background(), []byte(dkgPrefix))
+	switch {
+	case err == db.ErrKeyNotFound:
+	case err != nil:
+		return nil, err
+	default:
+		if err := json.Unmarshal(data, &svc.state); err != nil {
+			return nil, fmt.Errorf("dkg state: %v", err)
+		}
+		if svc.state.Pending == nil {
+			svc.state.Pending = make(map[int]*pending)
+		}
+		if !svc.state.bls12381() {
+			//the keys of the bn256 curve can not be used anymore: the next
+			//Block starts a new DKG round
+			svc.state = state{Pending: make(map[int]*pending)}
+		}
+	}
+
+	return svc, nil
+}
+
+// bls12381 reports whether the commitments of the state are points of
+// BLS12-381, rather than of the bn256 curve used before
+func (st *state) bls12381() bool {
+	if st.Current != nil {
+		if _, err := parseG2(st.Current.GroupKey()); err != nil {
+			return false
+		}
+	}
+	if st.Round != nil {
+		for _, commitments := range st.Round.Deals {
+			if _, err := parseCommitments(commitments); err != nil {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// SetLogger ...
+func (s *Service) SetLogger(l logger.Logger) {
+	s.logger = logger.OrNop(l).With(logger.Component, "Threshold")
+}
+
+// SetSubmitter sets the function through which the messages are submitted.
+// Without it, the Service follows the DKG without taking part.
+func (s *Service) SetSubmitter(submit Submitter) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.submitter = submit
+}
+
+// SetPhaseBlocks overrides DefaultPhaseBlocks
+func (s *Service) SetPhaseBlocks(n int) {
+	if n <= 0 {
+		n = DefaultPhaseBlocks
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.phaseBlocks = n
+}
+
+// Current returns the last generated Epoch, or nil
+func (s *Service) Current() *Epoch {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.state.Current
+}
+
+// Wrap returns a CommitCallback which processes the DKG messages and the
+// signature shares of the committed Blocks, and signs the checkpoints, before
+// calling next. It is meant to be passed to the Node in place of next.
+func (s *Service) Wrap(next hashgraph.CommitCallback) hashgraph.CommitCallback {
+	return hashgraph.RoutePayloads(map[types.PayloadType]hashgraph.PayloadHandler{
+		types.PayloadDKG:                   s.onDKG,
+		types.PayloadCheckpointAttestation: s.onAttestations,
+	}, func(ctx context.Context, block *types.Block) error {
+		if err := s.onBlock(ctx, block); err != nil {
+			return err
+		}
+		if next != nil {
+			return next(ctx, block)
+		}
+		return nil
+	})
+}
+
+// WrapFinality returns a FinalityCallback which records the threshold
+// signature of a checkpoint combined before the Block became final, then
+// calls next. It must be called after the Checkpointer recorded the Anchor:
+//
+//	hg.SetFinalityCallback(checkpointer.Wrap(service.WrapFinality(nil)))
+func (s *Service) WrapFinality(next hashgraph.FinalityCallback) hashgraph.FinalityCallback {
+	return func(ctx context.Context, block *types.Block) error {
+		if block.Index()%s.checkpointer.Interval() == 0 {
+			ts, err := s.getSignature(ctx, block.Index())
+			if err != nil && err != db.ErrKeyNotFound {
+				return err
+			}
+			if ts != nil {
+				if err := s.attach(ctx, block.Index(), ts); err != nil {
+					return err
+				}
+			}
+		}
+		if next != nil {
+			return next(ctx, block)
+		}
+		return nil
+	}
+}
+
+// sync starts a DKG round if the PeerSet of block is not the one of the
+// current Epoch or round
+func (s *Service) sync(block *types.Block) error {
+	peerSet, err := s.store.GetPeerSet(block.RoundReceived())
+	if err != nil {
+		return err
+	}
+
+	hash, err := peerSet.Hash()
+	if err != nil {
+		return err
+	}
+
+	switch {
+	case s.state.Round != nil:
+		if bytes.Equal(s.state.Round.PeerSetHash, hash) {
+			return nil
+		}
+	case s.state.Current != nil:
+		if bytes.Equal(s.state.Current.PeerSetHash, hash) {
+			return nil
+		}
+	}
+
+	return s.startRound(block, peerSet, hash)
+}
+
+func (s *Service) onDKG(ctx context.Context, block *types.Block, txs [][]byte) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if err := s.sync(block); err != nil {
+		return err
+	}
+
+	peerSet, err := s.store.GetPeerSet(block.RoundReceived())
+	if err != nil {
+		return err
+	}
+
+	for _, tx := range txs {
+		m, err := parseMessage(tx, peerSet)
+		if err != nil {
+			s.logger.Warn("invalid dkg transaction", logger.Block, block.Index(), logger.Err, err)
+			continue
+		}
+		s.onMessage(m)
+	}
+
+	return nil
+}
+
+// onBlock advances the DKG, signs the checkpoint, and saves the state
+func (s *Service) onBlock(ctx context.Context, block *types.Block) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if err := s.sync(block); err != nil {
+		return err
+	}
+
+	if err := s.advance(ctx, block); err != nil {
+		return err
+	}
+
+	if err := s.attest(block); err != nil {
+		return err
+	}
+
+	if !s.dirty {
+		return nil
+	}
+
+	data, err := json.Marshal(&s.state)
+	if err != nil {
+		return err
+	}
+	if err := s.db.Put(ctx, []byte(dkgPrefix), data); err != nil {
+		return err
+	}
+	s.dirty = false
+
+	return nil
+}
+
+// submit signs and submits a Message
+func (s *Service) submit(kind Kind, epoch int, body interface{}) error {
+	if s.submitter == nil {
+		return nil
+	}
+
+	tx, err := newMessage(kind, epoch, s.self, body, s.signer)
+	if err != nil {
+		return err
+	}
+
+	t := types.PayloadDKG
+	if kind == KindAttestation {
+		t = types.PayloadCheckpointAttestation
+	}
+	s.submitter(tx, t)
+
+	return nil
+}
+
+/*******************************************************************************
+Checkpoints
+*******************************************************************************/
+
+// attest submits our signature share of block if it is a checkpoint
+func (s *Service) attest(block *types.Block) error {
+	e := s.state.Current
+	if e == nil || e.Share == nil || block.Index()%s.checkpointer.Interval() != 0 {
+		return nil
+	}
+
+	hash, err := block.Body.Hash()
+	if err != nil {
+		return err
+	}
+
+	share, err := sign(new(big.Int).SetBytes(e.Share), hash)
+	if err != nil {
+		return err
+	}
+
+	return s.submit(KindAttestation, e.Epoch, &Attestation{
+		BlockIndex: block.Index(),
+		BlockHash:  hash,
+		Share:      share,
+	})
+}
+
+func (s *Service) onAttestations(ctx context.Context, block *types.Block, txs [][]byte) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	peerSet, err := s.store.GetPeerSet(block.RoundReceived())
+	if err != nil {
+		return err
+	}
+
+	for _, tx := range txs {
+		m, err := parseMessage(tx, peerSet)
+		if err == nil {
+			err = s.onAttestation(ctx, m)
+		}
+		if err != nil {
+			s.logger.Warn("invalid attestation", logger.Block, block.Index(), logger.Err, err)
+		}
+	}
+
+	return nil
+}
+
+// onAttestation verifies a signature share and combines the signature of the
+// checkpoint once a threshold of shares is collected
+func (s *Service) onAttestation(ctx context.Context, m *Message) error {
+	e := s.state.Current
+	if m.Kind != KindAttestation {
+		return fmt.Errorf("unexpected %s", m.Kind)
+	}
+	if e == nil || m.Epoch != e.Epoch {
+		return nil //from an older Epoch
+	}
+
+	var body Attestation
+	if err := m.decode(&body); err != nil {
+		return err
+	}
+
+	if body.BlockIndex%s.checkpointer.Interval() != 0 {
+		return fmt.Errorf("block %d is not a checkpoint", body.BlockIndex)
+	}
+
+	if _, err := s.getSignature(ctx, body.BlockIndex); err != db.ErrKeyNotFound {
+		return err //already combined
+	}
+
+	p, ok := s.state.Pending[body.BlockIndex]
+	if !ok {
+		block, err := s.store.GetBlock(body.BlockIndex)
+		if err != nil {
+			return err
+		}
+		hash, err := block.Body.Hash()
+		if err != nil {
+			return err
+		}
+		p = &pending{Hash: hash, Shares: make(map[int][]byte)}
+	}
+
+	if !bytes.Equal(p.Hash, body.BlockHash) {
+		return fmt.Errorf("attestation of block %d with a wrong hash", body.BlockIndex)
+	}
+
+	index := e.index(m.From)
+	if _, ok := p.Shares[index]; ok {
+		return nil
+	}
+
+	pub, err := e.publicShare(m.From)
+	if err != nil {
+		return err
+	}
+	if err := verify(pub, p.Hash, body.Share); err != nil {
+		return fmt.Errorf("signature share of %d: %v", m.From, err)
+	}
+
+	p.Shares[index] = body.Share
+	s.state.Pending[body.BlockIndex] = p
+	s.prunePending()
+	s.dirty = true
+
+	if len(p.Shares) < e.Threshold {
+		return nil
+	}
+
+	sig, err := combine(p.Shares)
+	if err != nil {
+		return err
+	}
+	if err := Verify(e.GroupKey(), p.Hash, sig); err != nil {
+		return err
+	}
+
+	delete(s.state.Pending, body.BlockIndex)
+
+	ts := &anchor.ThresholdSignature{
+		Epoch:     e.Epoch,
+		GroupKey:  e.GroupKey(),
+		Signature: sig,
+	}
+	if err := s.putSignature(ctx, body.BlockIndex, ts); err != nil {
+		return err
+	}
+
+	s.logger.Info("checkpoint signed", logger.Block, body.BlockIndex, "epoch", e.Epoch)
+
+	return s.attach(ctx, body.BlockIndex, ts)
+}
+
+// prunePending drops the oldest checkpoints beyond maxPending, which will
+// never collect enough shares
+func (s *Service) prunePending() {
+	if len(s.state.Pending) <= maxPending {
+		return
+	}
+
+	indexes := make([]int, 0, len(s.state.Pending))
+	for i := range s.state.Pending {
+		indexes = append(indexes, i)
+	}
+	sort.Ints(indexes)
+
+	for _, i := range indexes[:len(indexes)-maxPending] {
+		delete(s.state.Pending, i)
+	}
+}
+
+func thresholdSigKey(blockIndex int) []byte {
+	return []byte(fmt.Sprintf("%s_%010d", thresholdSigPrefix, blockIndex))
+}
+
+func (s *Service) putSignature(ctx context.Context, blockIndex int, ts *anchor.ThresholdSignature) error {
+	data, err := json.Marshal(ts)
+	if err != nil {
+		return err
+	}
+	return s.db.Put(ctx, thresholdSigKey(blockIndex), data)
+}
+
+func (s *Service) getSignature(ctx context.Context, blockIndex int) (*anchor.ThresholdSignature, error) {
+	data, err := s.db.Get(ctx, thresholdSigKey(blockIndex))
+	if err != nil {
+		return nil, err
+	}
+
+	ts := new(anchor.ThresholdSignature)
+	if err := json.Unmarshal(data, ts); err != nil {
+		return nil, err
+	}
+	return ts, nil
+}
+
+// attach records ts on the Anchor of the Block, if it was recorded already.
+// Otherwise, WrapFinality records it when the Block becomes final.
+func (s *Service) attach(ctx context.Context, blockIndex int, ts *anchor.ThresholdSignature) error {
+	a, err := s.checkpointer.Get(ctx, blockIndex)
+	if err != nil {
+		if errors.Is(err, errors.KeyNotFound) {
+			return nil
+		}
+		return err
+	}
+
+	if a.Threshold != nil && bytes.Equal(a.Threshold.Signature, ts.Signature) {
+		return nil
+	}
+
+	a.Threshold = ts
+	return s.checkpointer.Put(ctx, a)
+}
+
+// VerifyAnchor checks the threshold signature of an Anchor against the group
+// key the caller trusts
+func VerifyAnchor(a *anchor.Anchor, groupKey []byte) error {
+	if a.Threshold == nil {
+		return fmt.Errorf("anchor %d has no threshold signature", a.BlockIndex)
+	}
+	if !bytes.Equal(a.Threshold.GroupKey, groupKey) {
+		return fmt.Errorf("anchor %d signed by another group key", a.BlockIndex)
+	}
+	return Verify(groupKey, a.BlockHash, a.Threshold.Signature)
+}
@@ -0,0 +1,189 @@
+// Package trace defines the minimal tracing API used to instrument the event
+// lifecycle. It mirrors the OpenTelemetry trace API so that an OpenTelemetry
+// tracer can be plugged in with a thin adapter, without making this module
+// depend on the OpenTelemetry SDK.
+package trace
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// DefaultMaxTrackedEvents is the default number of event lifecycles traced
+// concurrently
+const DefaultMaxTrackedEvents = 10000
+
+// Config toggles tracing
+type Config struct {
+	Enabled bool
+	// MaxTrackedEvents bounds the number of open event-lifecycle spans. New
+	// events are not traced when the bound is reached.
+	MaxTrackedEvents int
+}
+
+// DefaultConfig has tracing disabled
+func DefaultConfig() Config {
+	return Config{
+		Enabled:          false,
+		MaxTrackedEvents: DefaultMaxTrackedEvents,
+	}
+}
+
+// Attribute is a key/value pair attached to spans and span events
+type Attribute struct {
+	Key   string
+	Value interface{}
+}
+
+// String ...
+func String(k, v string) Attribute {
+	return Attribute{Key: k, Value: v}
+}
+
+// Int ...
+func Int(k string, v int) Attribute {
+	return Attribute{Key: k, Value: v}
+}
+
+// Bool ...
+func Bool(k string, v bool) Attribute {
+	return Attribute{Key: k, Value: v}
+}
+
+// Span is a unit of traced work
+type Span interface {
+	SetAttributes(attrs ...Attribute)
+	AddEvent(name string, attrs ...Attribute)
+	RecordError(err error)
+	End()
+}
+
+// Tracer creates Spans
+type Tracer interface {
+	Start(ctx context.Context, name string, attrs ...Attribute) (context.Context, Span)
+}
+
+// NopTracer creates Spans that do nothing
+type NopTracer struct{}
+
+// Start ...
+func (NopTracer) Start(ctx context.Context, name string, attrs ...Attribute) (context.Context, Span) {
+	return ctx, nopSpan{}
+}
+
+type nopSpan struct{}
+
+func (nopSpan) SetAttributes(attrs ...Attribute)         {}
+func (nopSpan) AddEvent(name string, attrs ...Attribute) {}
+func (nopSpan) RecordError(err error)                    {}
+func (nopSpan) End()                                     {}
+
+/*******************************************************************************
+RecordingTracer
+*******************************************************************************/
+
+// SpanEvent is a timestamped annotation of a RecordedSpan
+type SpanEvent struct {
+	Name       string
+	Time       time.Time
+	Attributes []Attribute
+}
+
+// RecordedSpan is a finished Span kept by a RecordingTracer
+type RecordedSpan struct {
+	Name       string
+	Start      time.Time
+	End        time.Time
+	Attributes []Attribute
+	Events     []SpanEvent
+	Errors     []string
+}
+
+// RecordingTracer keeps the last finished Spans in memory. It is useful for
+// debugging and tests when no tracing backend is available.
+type RecordingTracer struct {
+	lock  sync.Mutex
+	size  int
+	spans []RecordedSpan
+}
+
+// NewRecordingTracer keeps at most size finished spans
+func NewRecordingTracer(size int) *RecordingTracer {
+	return &RecordingTracer{size: size}
+}
+
+// Start ...
+func (t *RecordingTracer) Start(ctx context.Context, name string, attrs ...Attribute) (context.Context, Span) {
+	return ctx, &recordingSpan{
+		tracer: t,
+		span: RecordedSpan{
+			Name:       name,
+			Start:      time.Now(),
+			Attributes: attrs,
+		},
+	}
+}
+
+// Spans returns a copy of the finished spans, oldest first
+func (t *RecordingTracer) Spans() []RecordedSpan {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	res := make([]RecordedSpan, len(t.spans))
+	copy(res, t.spans)
+	return res
+}
+
+func (t *RecordingTracer) record(s RecordedSpan) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	t.spans = append(t.spans, s)
+	if t.size > 0 && len(t.spans) > t.size {
+		t.spans = t.spans[len(t.spans)-t.size:]
+	}
+}
+
+type recordingSpan struct {
+	tracer *RecordingTracer
+	lock   sync.Mutex
+	span   RecordedSpan
+	ended  bool
+}
+
+func (s *recordingSpan) SetAttributes(attrs ...Attribute) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.span.Attributes = append(s.span.Attributes, attrs...)
+}
+
+func (s *recordingSpan) AddEvent(name string, attrs ...Attribute) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.span.Events = append(s.span.Events, SpanEvent{
+		Name:       name,
+		Time:       time.Now(),
+		Attributes: attrs,
+	})
+}
+
+func (s *recordingSpan) RecordError(err error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.span.Errors = append(s.span.Errors, err.Error())
+}
+
+func (s *recordingSpan) End() {
+	s.lock.Lock()
+	if s.ended {
+		s.lock.Unlock()
+		return
+	}
+	s.ended = true
+	s.span.End = time.Now()
+	span := s.span
+	s.lock.Unlock()
+
+	s.tracer.record(span)
+}
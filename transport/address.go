@@ -0,0 +1,259 @@
+package transport
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bolaxy/config"
+)
+
+// The Address of a conf.Peer can list several hosts, separated by commas:
+// IPv4 and IPv6 addresses, and DNS names, each with its own port or else the
+// TcpPort of the Peer. The target of the RPCs to such a peer, given by
+// PeerTarget, lists all its addresses, which the Transports try in order of
+// preference until one can be reached. A peer which cannot accept inbound
+// connections lists the addresses of its relays instead, see RelayAddress.
+
+const targetSeparator = ","
+
+const (
+	// defaultDialCooldown is the time after a failed dial during which an
+	// address is tried after the healthy ones. It doubles with each
+	// consecutive failure, up to maxDialCooldown.
+	defaultDialCooldown = time.Second
+	maxDialCooldown     = time.Minute
+)
+
+// PeerAddresses returns the TCP addresses of a peer, in the order in which
+// they are listed
+func PeerAddresses(p *conf.Peer) []string {
+	res := []string{}
+	for _, host := range strings.Split(p.Address, targetSeparator) {
+		host = strings.TrimSpace(host)
+		if host == "" {
+			continue
+		}
+		if relay, ok := relayHost(host); ok {
+			res = append(res, RelayAddress(withPort(relay, p.TcpPort)))
+			continue
+		}
+		res = append(res, withPort(host, p.TcpPort))
+	}
+	return res
+}
+
+// withPort adds port to a host which has none
+func withPort(host, port string) string {
+	//a bare IPv6 address has colons but no port
+	if _, _, err := net.SplitHostPort(host); err == nil {
+		return host
+	}
+	return net.JoinHostPort(strings.Trim(host, "[]"), port)
+}
+
+// CheckPeerAddresses returns an error if a peer lists no address, or an
+// address without a host or a port
+func CheckPeerAddresses(p *conf.Peer) error {
+	addrs := PeerAddresses(p)
+	if len(addrs) == 0 {
+		return fmt.Errorf("peer without address")
+	}
+	for _, addr := range addrs {
+		if relay, ok := relayHost(addr); ok {
+			addr = relay
+		}
+		host, port, err := net.SplitHostPort(addr)
+		if err != nil {
+			return fmt.Errorf("peer address %q: %v", addr, err)
+		}
+		if host == "" || port == "" {
+			return fmt.Errorf("peer address %q: missing host or port", addr)
+		}
+	}
+	return nil
+}
+
+// PeerTarget returns the target of the RPCs to a peer, which lists its
+// addresses
+func PeerTarget(p *conf.Peer) string {
+	return strings.Join(PeerAddresses(p), targetSeparator)
+}
+
+// SplitTarget returns the addresses listed by a target
+func SplitTarget(target string) []string {
+	res := []string{}
+	for _, addr := range strings.Split(target, targetSeparator) {
+		if addr = strings.TrimSpace(addr); addr != "" {
+			res = append(res, addr)
+		}
+	}
+	return res
+}
+
+// DialPreference orders the addresses of a target
+type DialPreference int
+
+const (
+	// PreferListed keeps the order in which the addresses are listed
+	PreferListed DialPreference = iota
+	// PreferIPv4 tries the IPv4 addresses first, then the DNS names, then
+	// the IPv6 addresses
+	PreferIPv4
+	// PreferIPv6 tries the IPv6 addresses first, then the DNS names, then
+	// the IPv4 addresses
+	PreferIPv6
+)
+
+// AddressHealth records the dials of an address
+type AddressHealth struct {
+	Successes   int
+	Failures    int // consecutive
+	LastSuccess time.Time
+	LastFailure time.Time
+	LastError   string `json:",omitempty"`
+}
+
+// cooldown returns the time after the last failure during which the address
+// is tried last
+func (h *AddressHealth) cooldown(base time.Duration) time.Duration {
+	if h.Failures == 0 {
+		return 0
+	}
+	d := base
+	for i := 1; i < h.Failures && d < maxDialCooldown; i++ {
+		d *= 2
+	}
+	if d > maxDialCooldown {
+		d = maxDialCooldown
+	}
+	return d
+}
+
+// AddressBook orders the addresses of the targets by DialPreference, after
+// the healthy ones if they failed recently, and records the health of each
+// address. It is safe for concurrent use.
+type AddressBook struct {
+	lock       sync.Mutex
+	preference DialPreference
+	cooldown   time.Duration
+	health     map[string]*AddressHealth
+}
+
+// NewAddressBook ...
+func NewAddressBook(preference DialPreference) *AddressBook {
+	return &AddressBook{
+		preference: preference,
+		cooldown:   defaultDialCooldown,
+		health:     make(map[string]*AddressHealth),
+	}
+}
+
+// SetPreference ...
+func (b *AddressBook) SetPreference(p DialPreference) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.preference = p
+}
+
+// rank returns the rank of the family of an address for the preference. The
+// relay addresses come last, as they cost an extra hop.
+func (b *AddressBook) rank(addr string) int {
+	if _, ok := relayHost(addr); ok {
+		return 3
+	}
+	if b.preference == PreferListed {
+		return 0
+	}
+
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		host = addr
+	}
+	ip := net.ParseIP(host)
+
+	switch {
+	case ip == nil:
+		return 1
+	case (ip.To4() != nil) == (b.preference == PreferIPv4):
+		return 0
+	default:
+		return 2
+	}
+}
+
+// Order returns the addresses of target in the order in which they should be
+// dialed
+func (b *AddressBook) Order(target string) []string {
+	addrs := SplitTarget(target)
+	if len(addrs) <= 1 {
+		return addrs
+	}
+
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	now := time.Now()
+	cooling := func(addr string) bool {
+		h, ok := b.health[addr]
+		return ok && now.Sub(h.LastFailure) < h.cooldown(b.cooldown)
+	}
+
+	sort.SliceStable(addrs, func(i, j int) bool {
+		ci, cj := cooling(addrs[i]), cooling(addrs[j])
+		if ci != cj {
+			return cj
+		}
+		return b.rank(addrs[i]) < b.rank(addrs[j])
+	})
+
+	return addrs
+}
+
+// Success records a successful dial of addr
+func (b *AddressBook) Success(addr string) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	h := b.entry(addr)
+	h.Successes++
+	h.Failures = 0
+	h.LastSuccess = time.Now()
+}
+
+// Failure records a failed dial of addr
+func (b *AddressBook) Failure(addr string, err error) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	h := b.entry(addr)
+	h.Failures++
+	h.LastFailure = time.Now()
+	if err != nil {
+		h.LastError = err.Error()
+	}
+}
+
+func (b *AddressBook) entry(addr string) *AddressHealth {
+	h, ok := b.health[addr]
+	if !ok {
+		h = &AddressHealth{}
+		b.health[addr] = h
+	}
+	return h
+}
+
+// Health returns the health of the addresses dialed so far
+func (b *AddressBook) Health() map[string]AddressHealth {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	res := make(map[string]AddressHealth, len(b.health))
+	for addr, h := range b.health {
+		res[addr] = *h
+	}
+	return res
+}
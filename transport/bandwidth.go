@@ -0,0 +1,419 @@
+package transport
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"math"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/bolaxy/core/metrics"
+)
+
+// bandwidthWindow is the time constant of the traffic rates: the bytes older
+// than it weigh less than a third
+const bandwidthWindow = 10 * time.Second
+
+// BandwidthCaps deprioritise the peers which take more than their share of
+// the traffic, without refusing their requests
+type BandwidthCaps struct {
+	// Share is the fraction, between 0 and 1, of the traffic with all the
+	// peers above which the traffic of a peer is capped. It should exceed
+	// the fair share of a peer. 0 disables the caps.
+	Share float64
+	// MinRate is the rate, in bytes per second, below which the traffic of
+	// a peer is not capped, whatever its share
+	MinRate float64
+}
+
+// DefaultBandwidthCaps ...
+func DefaultBandwidthCaps() BandwidthCaps {
+	return BandwidthCaps{
+		MinRate: 1 << 20,
+	}
+}
+
+// Validate ...
+func (c BandwidthCaps) Validate() error {
+	if c.Share < 0 || c.Share > 1 {
+		return fmt.Errorf("bandwidth Share must be between 0 and 1, got %v", c.Share)
+	}
+	if c.MinRate < 0 {
+		return fmt.Errorf("bandwidth MinRate must not be negative, got %v", c.MinRate)
+	}
+	return nil
+}
+
+// PeerTraffic is the traffic with a peer: the bytes received from it and sent
+// to it, in total and per second over the last seconds
+type PeerTraffic struct {
+	In      uint64
+	Out     uint64
+	InRate  float64
+	OutRate float64
+	Capped  bool
+}
+
+// rate is a number of bytes which decays exponentially with bandwidthWindow
+type rate struct {
+	value float64
+	at    time.Time
+}
+
+func (r *rate) add(n float64, now time.Time) {
+	r.decay(now)
+	r.value += n
+}
+
+// perSecond returns the rate in bytes per second
+func (r *rate) perSecond(now time.Time) float64 {
+	r.decay(now)
+	return r.value / bandwidthWindow.Seconds()
+}
+
+func (r *rate) decay(now time.Time) {
+	if !r.at.IsZero() && now.After(r.at) {
+		r.value *= math.Exp(-now.Sub(r.at).Seconds() / bandwidthWindow.Seconds())
+	}
+	r.at = now
+}
+
+type peerTraffic struct {
+	in, out         uint64
+	inRate, outRate rate
+}
+
+// Bandwidth counts the bytes exchanged with each peer, identified by its ID,
+// and applies BandwidthCaps. It is safe for concurrent use.
+type Bandwidth struct {
+	lock  sync.Mutex
+	caps  BandwidthCaps
+	all   rate
+	peers map[uint32]*peerTraffic
+}
+
+// NewBandwidth ...
+func NewBandwidth(caps BandwidthCaps) *Bandwidth {
+	return &Bandwidth{
+		caps:  caps,
+		peers: make(map[uint32]*peerTraffic),
+	}
+}
+
+// SetCaps replaces the BandwidthCaps. The counts are kept.
+func (b *Bandwidth) SetCaps(caps BandwidthCaps) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.caps = caps
+}
+
+// peer returns the traffic of peer, created if necessary. It must be called
+// with the lock.
+func (b *Bandwidth) peer(peer uint32) *peerTraffic {
+	p, ok := b.peers[peer]
+	if !ok {
+		p = &peerTraffic{}
+		b.peers[peer] = p
+	}
+	return p
+}
+
+// Received counts n bytes received from peer
+func (b *Bandwidth) Received(peer uint32, n int) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	now := time.Now()
+	p := b.peer(peer)
+	p.in += uint64(n)
+	p.inRate.add(float64(n), now)
+	b.all.add(float64(n), now)
+}
+
+// Sent counts n bytes sent to peer
+func (b *Bandwidth) Sent(peer uint32, n int) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	now := time.Now()
+	p := b.peer(peer)
+	p.out += uint64(n)
+	p.outRate.add(float64(n), now)
+	b.all.add(float64(n), now)
+}
+
+// capped returns whether the traffic of p exceeds the caps. It must be called
+// with the lock.
+func (b *Bandwidth) capped(p *peerTraffic, now time.Time) bool {
+	if b.caps.Share == 0 {
+		return false
+	}
+	r := p.inRate.perSecond(now) + p.outRate.perSecond(now)
+	return r > b.caps.MinRate && r > b.caps.Share*b.all.perSecond(now)
+}
+
+// Capped returns whether peer takes more than its share of the traffic
+func (b *Bandwidth) Capped(peer uint32) bool {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	p, ok := b.peers[peer]
+	return ok && b.capped(p, time.Now())
+}
+
+// Traffic returns the traffic with each peer, by ID
+func (b *Bandwidth) Traffic() map[uint32]PeerTraffic {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	now := time.Now()
+	res := make(map[uint32]PeerTraffic, len(b.peers))
+	for id, p := range b.peers {
+		res[id] = PeerTraffic{
+			In:      p.in,
+			Out:     p.out,
+			InRate:  p.inRate.perSecond(now),
+			OutRate: p.outRate.perSecond(now),
+			Capped:  b.capped(p, now),
+		}
+	}
+	return res
+}
+
+// Retain drops the traffic of the peers for which keep returns false
+func (b *Bandwidth) Retain(keep func(peer uint32) bool) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	for id := range b.peers {
+		if !keep(id) {
+			delete(b.peers, id)
+		}
+	}
+}
+
+// Register registers in reg the bytes exchanged with each peer, labelled by
+// peer ID and direction
+func (b *Bandwidth) Register(reg *metrics.Registry) {
+	reg.MustRegister(&bandwidthMetric{b})
+}
+
+// bandwidthMetric is a Collector of the bytes exchanged with the peers
+type bandwidthMetric struct {
+	b *Bandwidth
+}
+
+func (m *bandwidthMetric) Name() string { return "core_peer_bytes_total" }
+
+func (m *bandwidthMetric) Help() string {
+	return "Bytes received from a peer (direction=in) and sent to it (direction=out)."
+}
+
+func (m *bandwidthMetric) Type() string { return "counter" }
+
+func (m *bandwidthMetric) Write(buf *bytes.Buffer) {
+	traffic := m.b.Traffic()
+
+	ids := make([]uint32, 0, len(traffic))
+	for id := range traffic {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+
+	for _, id := range ids {
+		fmt.Fprintf(buf, "%s{peer=\"%d\",direction=\"in\"} %d\n", m.Name(), id, traffic[id].In)
+		fmt.Fprintf(buf, "%s{peer=\"%d\",direction=\"out\"} %d\n", m.Name(), id, traffic[id].Out)
+	}
+}
+
+/*******************************************************************************
+MeteredTransport
+*******************************************************************************/
+
+// sender is implemented by the messages which carry the ID of their sender
+type sender interface {
+	Sender() uint32
+}
+
+// encodedSize returns the size of the JSON encoding of msg, as sent by the
+// TCPTransport
+func encodedSize(msg interface{}) int {
+	data, err := json.Marshal(msg)
+	if err != nil {
+		return 0
+	}
+	return len(data)
+}
+
+// MeteredTransport counts the traffic of a Transport in a Bandwidth, as the
+// size of the JSON encoding of the messages. The messages are attributed to
+// the sender of the incoming requests, and to the responder of the outgoing
+// ones. The messages which do not carry the ID of their sender, like the ones
+// of discovery, and the failed requests are not counted.
+type MeteredTransport struct {
+	Transport
+	meter *Bandwidth
+
+	consumerCh chan RPC
+	doneCh     chan struct{}
+	closeOnce  sync.Once
+}
+
+// NewMeteredTransport wraps t, which is closed with the MeteredTransport
+func NewMeteredTransport(t Transport, meter *Bandwidth) *MeteredTransport {
+	m := &MeteredTransport{
+		Transport:  t,
+		meter:      meter,
+		consumerCh: make(chan RPC),
+		doneCh:     make(chan struct{}),
+	}
+	go m.intercept()
+	return m
+}
+
+// Meter returns the Bandwidth of the MeteredTransport
+func (m *MeteredTransport) Meter() *Bandwidth {
+	return m.meter
+}
+
+// Consumer ...
+func (m *MeteredTransport) Consumer() <-chan RPC {
+	return m.consumerCh
+}
+
+// intercept counts the incoming RPCs, and their responses, before passing
+// them on
+func (m *MeteredTransport) intercept() {
+	for {
+		var rpc RPC
+		select {
+		case rpc = <-m.Transport.Consumer():
+		case <-m.doneCh:
+			return
+		}
+
+		if s, ok := rpc.Command.(sender); ok {
+			peer := s.Sender()
+			m.meter.Received(peer, encodedSize(rpc.Command))
+
+			respCh := make(chan RPCResponse, 1)
+			go m.respond(peer, respCh, rpc.RespChan)
+			rpc.RespChan = respCh
+		}
+
+		select {
+		case m.consumerCh <- rpc:
+		case <-m.doneCh:
+			return
+		}
+	}
+}
+
+// respond counts the response to a request of peer before passing it on
+func (m *MeteredTransport) respond(peer uint32, in <-chan RPCResponse, out chan<- RPCResponse) {
+	select {
+	case r := <-in:
+		if r.Error == nil && r.Response != nil {
+			m.meter.Sent(peer, encodedSize(r.Response))
+		}
+		out <- r
+	case <-m.doneCh:
+	}
+}
+
+// outgoing counts an outgoing request and its response
+func (m *MeteredTransport) outgoing(args interface{}, resp interface{}, err error) {
+	if err != nil {
+		return
+	}
+	s, ok := resp.(sender)
+	if !ok {
+		return
+	}
+	m.meter.Sent(s.Sender(), encodedSize(args))
+	m.meter.Received(s.Sender(), encodedSize(resp))
+}
+
+// Sync ...
+func (m *MeteredTransport) Sync(ctx context.Context, target string, args *SyncRequest, resp *SyncResponse) error {
+	err := m.Transport.Sync(ctx, target, args, resp)
+	m.outgoing(args, resp, err)
+	return err
+}
+
+// Join ...
+func (m *MeteredTransport) Join(ctx context.Context, target string, args *JoinRequest, resp *JoinResponse) error {
+	err := m.Transport.Join(ctx, target, args, resp)
+	m.outgoing(args, resp, err)
+	return err
+}
+
+// FastForward ...
+func (m *MeteredTransport) FastForward(ctx context.Context, target string, args *FastForwardRequest, resp *FastForwardResponse) error {
+	err := m.Transport.FastForward(ctx, target, args, resp)
+	m.outgoing(args, resp, err)
+	return err
+}
+
+// History ...
+func (m *MeteredTransport) History(ctx context.Context, target string, args *HistoryRequest, resp *HistoryResponse) error {
+	err := m.Transport.History(ctx, target, args, resp)
+	m.outgoing(args, resp, err)
+	return err
+}
+
+// Signatures ...
+func (m *MeteredTransport) Signatures(ctx context.Context, target string, args *SignaturesRequest, resp *SignaturesResponse) error {
+	err := m.Transport.Signatures(ctx, target, args, resp)
+	m.outgoing(args, resp, err)
+	return err
+}
+
+// SnapshotChunk ...
+func (m *MeteredTransport) SnapshotChunk(ctx context.Context, target string, args *SnapshotChunkRequest, resp *SnapshotChunkResponse) error {
+	err := m.Transport.SnapshotChunk(ctx, target, args, resp)
+	m.outgoing(args, resp, err)
+	return err
+}
+
+// PushShards ...
+func (m *MeteredTransport) PushShards(ctx context.Context, target string, args *PushShardsRequest, resp *PushShardsResponse) error {
+	err := m.Transport.PushShards(ctx, target, args, resp)
+	m.outgoing(args, resp, err)
+	return err
+}
+
+// FetchShards ...
+func (m *MeteredTransport) FetchShards(ctx context.Context, target string, args *FetchShardsRequest, resp *FetchShardsResponse) error {
+	err := m.Transport.FetchShards(ctx, target, args, resp)
+	m.outgoing(args, resp, err)
+	return err
+}
+
+// Discover ...
+func (m *MeteredTransport) Discover(ctx context.Context, target string, args *DiscoverRequest, resp *DiscoverResponse) error {
+	err := m.Transport.Discover(ctx, target, args, resp)
+	m.outgoing(args, resp, err)
+	return err
+}
+
+// GetTxs ...
+func (m *MeteredTransport) GetTxs(ctx context.Context, target string, args *GetTxsRequest, resp *GetTxsResponse) error {
+	err := m.Transport.GetTxs(ctx, target, args, resp)
+	m.outgoing(args, resp, err)
+	return err
+}
+
+// PeerCapabilities forwards to the wrapped Transport if it is a Negotiator
+func (m *MeteredTransport) PeerCapabilities(ctx context.Context, target string) (Capabilities, error) {
+	return PeerCapabilities(ctx, m.Transport, target)
+}
+
+// Close stops the interception, and closes the wrapped Transport
+func (m *MeteredTransport) Close() error {
+	m.closeOnce.Do(func() { close(m.doneCh) })
+	return m.Transport.Close()
+}
@@ -0,0 +1,236 @@
+package transport
+
+import (
+	"crypto/ecdsa"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/bolaxy/common/hexutil"
+	"github.com/bolaxy/core/signer"
+	"github.com/bolaxy/crypto"
+)
+
+var (
+	// ErrUnsigned is returned for a message without a signature
+	ErrUnsigned = errors.New("unsigned message")
+	// ErrBadSignature is returned for a message which was not signed by its
+	// sender
+	ErrBadSignature = errors.New("invalid message signature")
+	// ErrStale is returned for a message whose timestamp is too far from our
+	// clock
+	ErrStale = errors.New("message timestamp out of bounds")
+	// ErrReplayed is returned for a message which was already received
+	ErrReplayed = errors.New("replayed message")
+)
+
+// DefaultMaxClockSkew is the default bound on the difference between the
+// timestamp of a message and the clock of its receiver
+const DefaultMaxClockSkew = 30 * time.Second
+
+// Envelope authenticates a message. It is signed by the sender of the
+// message, over the hash of the message with an empty Signature. The Nonce
+// and the Timestamp prevent replays.
+type Envelope struct {
+	Nonce     uint64
+	Timestamp int64 // unix nanoseconds
+	Signature string
+}
+
+func (e *Envelope) envelope() *Envelope {
+	return e
+}
+
+// Signed is implemented by the messages which carry an Envelope
+type Signed interface {
+	// Sender returns the ID of the peer which signs the message
+	Sender() uint32
+	envelope() *Envelope
+}
+
+// Sender ...
+func (r *SyncRequest) Sender() uint32 { return r.FromID }
+
+// Sender ...
+func (r *SyncResponse) Sender() uint32 { return r.FromID }
+
+// Sender ...
+func (r *FastForwardRequest) Sender() uint32 { return r.FromID }
+
+// Sender ...
+func (r *FastForwardResponse) Sender() uint32 { return r.FromID }
+
+// Sender ...
+func (r *HistoryRequest) Sender() uint32 { return r.FromID }
+
+// Sender ...
+func (r *HistoryResponse) Sender() uint32 { return r.FromID }
+
+// Sender ...
+func (r *SignaturesRequest) Sender() uint32 { return r.FromID }
+
+// Sender ...
+func (r *SignaturesResponse) Sender() uint32 { return r.FromID }
+
+// Sender ...
+func (r *SnapshotChunkRequest) Sender() uint32 { return r.FromID }
+
+// Sender ...
+func (r *SnapshotChunkResponse) Sender() uint32 { return r.FromID }
+
+// Sender ...
+func (r *PushShardsRequest) Sender() uint32 { return r.FromID }
+
+// Sender ...
+func (r *FetchShardsRequest) Sender() uint32 { return r.FromID }
+
+// Sender ...
+func (r *FetchShardsResponse) Sender() uint32 { return r.FromID }
+
+// Sender ...
+func (r *GetTxsRequest) Sender() uint32 { return r.FromID }
+
+// Sender ...
+func (r *GetTxsResponse) Sender() uint32 { return r.FromID }
+
+// Sender ...
+func (r *PushShardsResponse) Sender() uint32 { return r.FromID }
+
+// Sender ...
+func (r *JoinResponse) Sender() uint32 { return r.FromID }
+
+// Seal fills the Envelope of msg and signs it with key, which must be the key
+// of its sender
+func Seal(msg Signed, key *ecdsa.PrivateKey) error {
+	return SealWith(msg, signer.NewLocal(key))
+}
+
+// SealWith is Seal with the key of the sender behind a Signer
+func SealWith(msg Signed, s signer.Signer) error {
+	var nonce [8]byte
+	if _, err := rand.Read(nonce[:]); err != nil {
+		return err
+	}
+
+	env := msg.envelope()
+	env.Nonce = binary.BigEndian.Uint64(nonce[:])
+	env.Timestamp = time.Now().UnixNano()
+	env.Signature = ""
+
+	hash, err := signHash(msg)
+	if err != nil {
+		return err
+	}
+
+	sig, err := s.Sign(hash)
+	if err != nil {
+		return err
+	}
+
+	env.Signature = hexutil.Encode(sig)
+
+	return nil
+}
+
+// signHash hashes the JSON encoding of msg without its Signature
+func signHash(msg Signed) ([]byte, error) {
+	env := msg.envelope()
+
+	sig := env.Signature
+	env.Signature = ""
+	data, err := json.Marshal(msg)
+	env.Signature = sig
+
+	if err != nil {
+		return nil, err
+	}
+
+	return crypto.Keccak256(data), nil
+}
+
+type seenKey struct {
+	sender uint32
+	nonce  uint64
+}
+
+// Verifier checks the Envelopes of the messages received from peers, and
+// remembers their nonces for as long as their timestamps are acceptable. It
+// is safe for concurrent use.
+type Verifier struct {
+	maxSkew time.Duration
+
+	lock      sync.Mutex
+	seen      map[seenKey]int64
+	lastPrune time.Time
+}
+
+// NewVerifier ...
+func NewVerifier(maxSkew time.Duration) *Verifier {
+	return &Verifier{
+		maxSkew:   maxSkew,
+		seen:      make(map[seenKey]int64),
+		lastPrune: time.Now(),
+	}
+}
+
+// Verify checks that msg was signed by pubKey, the public key of its sender
+// in compressed or uncompressed form, and that it is neither stale nor
+// replayed
+func (v *Verifier) Verify(msg Signed, pubKey []byte) error {
+	env := msg.envelope()
+	if env.Signature == "" {
+		return ErrUnsigned
+	}
+
+	now := time.Now()
+	ts := time.Unix(0, env.Timestamp)
+	if ts.Before(now.Add(-v.maxSkew)) || ts.After(now.Add(v.maxSkew)) {
+		return ErrStale
+	}
+
+	sig, err := hexutil.Decode(env.Signature)
+	if err != nil || len(sig) < 64 {
+		return ErrBadSignature
+	}
+
+	hash, err := signHash(msg)
+	if err != nil {
+		return err
+	}
+
+	if !crypto.VerifySignature(pubKey, hash, sig[:64]) {
+		return ErrBadSignature
+	}
+
+	v.lock.Lock()
+	defer v.lock.Unlock()
+
+	v.prune(now)
+
+	key := seenKey{msg.Sender(), env.Nonce}
+	if _, ok := v.seen[key]; ok {
+		return ErrReplayed
+	}
+	v.seen[key] = env.Timestamp
+
+	return nil
+}
+
+// prune forgets the nonces of the messages which would be rejected as stale
+// anyway. It runs at most once per maxSkew.
+func (v *Verifier) prune(now time.Time) {
+	if now.Sub(v.lastPrune) < v.maxSkew {
+		return
+	}
+	v.lastPrune = now
+
+	oldest := now.Add(-v.maxSkew).UnixNano()
+	for k, ts := range v.seen {
+		if ts < oldest {
+			delete(v.seen, k)
+		}
+	}
+}
@@ -0,0 +1,240 @@
+package transport
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ProtocolVersion is the version of the protocol spoken by the Transports of
+// this package. Version 1 introduced the handshake: the peers which do not
+// answer it speak version 0, with LegacyCapabilities.
+const ProtocolVersion = 1
+
+// Codecs of the messages
+const (
+	CodecJSON = "json"
+)
+
+// Compressions of the messages
+const (
+	CompressionGzip = "gzip"
+)
+
+// Features which the peers may not support, during an upgrade
+const (
+	// FeatureFastForward serves FastForward requests
+	FeatureFastForward = "fast-forward"
+	// FeatureBatchEvents sends the Events of Batched SyncRequests in a
+	// WireEventBatch
+	FeatureBatchEvents = "batch-events"
+	// FeatureSelectiveGossip sends the hashes of the transactions to the
+	// SyncRequests with PullTxs, and serves GetTxs requests
+	FeatureSelectiveGossip = "selective-gossip"
+)
+
+// sessionTTL is the time after which the Capabilities of a peer are
+// negotiated again, to notice its upgrades
+const sessionTTL = time.Minute
+
+// Capabilities describe the protocol spoken by a peer. Negotiated between two
+// peers, they are what both speak.
+type Capabilities struct {
+	Version     int
+	Codecs      []string
+	Compression []string
+	Features    []string
+}
+
+// DefaultCapabilities are the Capabilities of the Transports of this package
+func DefaultCapabilities() Capabilities {
+	return Capabilities{
+		Version:     ProtocolVersion,
+		Codecs:      []string{CodecJSON},
+		Compression: []string{CompressionGzip},
+		Features:    []string{FeatureFastForward, FeatureBatchEvents, FeatureSelectiveGossip},
+	}
+}
+
+// LegacyCapabilities are the Capabilities of the peers of version 0, which
+// do not answer the handshake
+func LegacyCapabilities() Capabilities {
+	return Capabilities{
+		Codecs:   []string{CodecJSON},
+		Features: []string{FeatureFastForward},
+	}
+}
+
+// Negotiate returns the Capabilities common to c and other, at the lowest
+// of their versions
+func (c Capabilities) Negotiate(other Capabilities) Capabilities {
+	version := c.Version
+	if other.Version < version {
+		version = other.Version
+	}
+	return Capabilities{
+		Version:     version,
+		Codecs:      intersect(c.Codecs, other.Codecs),
+		Compression: intersect(c.Compression, other.Compression),
+		Features:    intersect(c.Features, other.Features),
+	}
+}
+
+// Has returns whether feature is among the Features
+func (c Capabilities) Has(feature string) bool {
+	return contains(c.Features, feature)
+}
+
+// Compresses returns whether compression is among the Compression
+func (c Capabilities) Compresses(compression string) bool {
+	return contains(c.Compression, compression)
+}
+
+func contains(list []string, s string) bool {
+	for _, e := range list {
+		if e == s {
+			return true
+		}
+	}
+	return false
+}
+
+// intersect returns the elements of a which are in b, in the order of a
+func intersect(a, b []string) []string {
+	res := []string{}
+	for _, s := range a {
+		if contains(b, s) {
+			res = append(res, s)
+		}
+	}
+	return res
+}
+
+// HandshakeRequest gives the Capabilities of the requester. It is not
+// signed: the Capabilities only choose among the encodings of messages which
+// are.
+type HandshakeRequest struct {
+	Capabilities
+}
+
+// HandshakeResponse gives the Capabilities of the responder
+type HandshakeResponse struct {
+	Capabilities
+}
+
+// Negotiator is implemented by the Transports which negotiate Capabilities
+// with their peers. With the others, all the peers have the
+// DefaultCapabilities.
+type Negotiator interface {
+	// PeerCapabilities returns the Capabilities negotiated with target,
+	// after a handshake if the last one is too old
+	PeerCapabilities(ctx context.Context, target string) (Capabilities, error)
+}
+
+// PeerCapabilities returns the Capabilities negotiated by t with target, or
+// the DefaultCapabilities if t is not a Negotiator
+func PeerCapabilities(ctx context.Context, t Transport, target string) (Capabilities, error) {
+	if n, ok := t.(Negotiator); ok {
+		return n.PeerCapabilities(ctx, target)
+	}
+	return DefaultCapabilities(), nil
+}
+
+// session holds the Capabilities negotiated with a target
+type session struct {
+	caps Capabilities
+	at   time.Time
+}
+
+// sessions holds the sessions of a TCPTransport, by target
+type sessions struct {
+	lock     sync.Mutex
+	sessions map[string]session
+}
+
+func newSessions() *sessions {
+	return &sessions{
+		sessions: make(map[string]session),
+	}
+}
+
+// get returns the Capabilities negotiated with target, unless they are too
+// old
+func (s *sessions) get(target string) (Capabilities, bool) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	sess, ok := s.sessions[target]
+	if !ok || time.Since(sess.at) > sessionTTL {
+		return Capabilities{}, false
+	}
+	return sess.caps, true
+}
+
+func (s *sessions) set(target string, caps Capabilities) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.sessions[target] = session{caps: caps, at: time.Now()}
+}
+
+// drop forgets the Capabilities of target, which are negotiated again with
+// the next request
+func (s *sessions) drop(target string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	delete(s.sessions, target)
+}
+
+/*******************************************************************************
+TCPTransport
+*******************************************************************************/
+
+// SetCapabilities replaces the Capabilities which the TCPTransport gives to
+// its peers, DefaultCapabilities by default. It must be called before the
+// TCPTransport is used.
+func (t *TCPTransport) SetCapabilities(caps Capabilities) {
+	t.caps = caps
+}
+
+// PeerCapabilities negotiates the Capabilities with target, once per
+// sessionTTL. The peers which do not know the handshake get the
+// LegacyCapabilities, and so do the ones reached through a relay, whose
+// exchanges are neither negotiated nor compressed.
+func (t *TCPTransport) PeerCapabilities(ctx context.Context, target string) (Capabilities, error) {
+	if caps, ok := t.sessions.get(target); ok {
+		return caps, nil
+	}
+
+	if addrs := t.addrs.Order(target); len(addrs) > 0 {
+		if _, relayed := relayHost(addrs[0]); relayed {
+			return t.caps.Negotiate(LegacyCapabilities()), nil
+		}
+	}
+
+	var resp HandshakeResponse
+	err := t.genericRPC(ctx, target, rpcHandshake, &HandshakeRequest{t.caps}, &resp, t.timeout)
+	if err != nil && !strings.HasPrefix(err.Error(), errUnknownRPCType) {
+		return Capabilities{}, err
+	}
+	if err != nil {
+		resp.Capabilities = LegacyCapabilities()
+	}
+
+	caps := t.caps.Negotiate(resp.Capabilities)
+	if caps.Version < t.caps.Version {
+		t.logger.Debug("peer speaks an older protocol",
+			"target", target,
+			"version", resp.Version)
+	}
+	t.sessions.set(target, caps)
+
+	return caps, nil
+}
+
+// compress returns whether the requests to target are compressed. It does
+// not handshake: the requests are compressed once a handshake agreed on it.
+func (t *TCPTransport) compress(target string) bool {
+	caps, ok := t.sessions.get(target)
+	return ok && caps.Compresses(CompressionGzip)
+}
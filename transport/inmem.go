@@ -0,0 +1,288 @@
+package transport
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// InmemTransport implements the Transport interface, to allow nodes to be
+// tested in-memory without going over a network
+type InmemTransport struct {
+	lock        sync.RWMutex
+	consumerCh  chan RPC
+	localAddr   string
+	peers       map[string]*InmemTransport
+	timeout     time.Duration
+	joinTimeout time.Duration
+	shutdown    bool
+}
+
+// NewInmemTransport creates a new in-memory transport. An empty addr gets a
+// generated one.
+func NewInmemTransport(addr string) *InmemTransport {
+	if addr == "" {
+		addr = fmt.Sprintf("inmem-%d", time.Now().UnixNano())
+	}
+
+	return &InmemTransport{
+		consumerCh:  make(chan RPC, 16),
+		localAddr:   addr,
+		peers:       make(map[string]*InmemTransport),
+		timeout:     DefaultTimeout,
+		joinTimeout: DefaultJoinTimeout,
+	}
+}
+
+// SetTimeouts overrides the default RPC and Join timeouts
+func (i *InmemTransport) SetTimeouts(timeout, joinTimeout time.Duration) {
+	i.lock.Lock()
+	defer i.lock.Unlock()
+	i.timeout = timeout
+	i.joinTimeout = joinTimeout
+}
+
+// Consumer ...
+func (i *InmemTransport) Consumer() <-chan RPC {
+	return i.consumerCh
+}
+
+// LocalAddr ...
+func (i *InmemTransport) LocalAddr() string {
+	return i.localAddr
+}
+
+// Sync ...
+func (i *InmemTransport) Sync(ctx context.Context, target string, args *SyncRequest, resp *SyncResponse) error {
+	i.lock.RLock()
+	timeout := i.timeout
+	i.lock.RUnlock()
+
+	rpcResp, err := i.makeRPC(ctx, target, args, timeout)
+	if err != nil {
+		return err
+	}
+
+	out := rpcResp.Response.(*SyncResponse)
+	*resp = *out
+	return nil
+}
+
+// Join ...
+func (i *InmemTransport) Join(ctx context.Context, target string, args *JoinRequest, resp *JoinResponse) error {
+	i.lock.RLock()
+	timeout := i.joinTimeout
+	i.lock.RUnlock()
+
+	rpcResp, err := i.makeRPC(ctx, target, args, timeout)
+	if err != nil {
+		return err
+	}
+
+	out := rpcResp.Response.(*JoinResponse)
+	*resp = *out
+	return nil
+}
+
+// FastForward ...
+func (i *InmemTransport) FastForward(ctx context.Context, target string, args *FastForwardRequest, resp *FastForwardResponse) error {
+	i.lock.RLock()
+	timeout := i.timeout
+	i.lock.RUnlock()
+
+	rpcResp, err := i.makeRPC(ctx, target, args, timeout)
+	if err != nil {
+		return err
+	}
+
+	out := rpcResp.Response.(*FastForwardResponse)
+	*resp = *out
+	return nil
+}
+
+// History ...
+func (i *InmemTransport) History(ctx context.Context, target string, args *HistoryRequest, resp *HistoryResponse) error {
+	i.lock.RLock()
+	timeout := i.timeout
+	i.lock.RUnlock()
+
+	rpcResp, err := i.makeRPC(ctx, target, args, timeout)
+	if err != nil {
+		return err
+	}
+
+	out := rpcResp.Response.(*HistoryResponse)
+	*resp = *out
+	return nil
+}
+
+// Signatures ...
+func (i *InmemTransport) Signatures(ctx context.Context, target string, args *SignaturesRequest, resp *SignaturesResponse) error {
+	i.lock.RLock()
+	timeout := i.timeout
+	i.lock.RUnlock()
+
+	rpcResp, err := i.makeRPC(ctx, target, args, timeout)
+	if err != nil {
+		return err
+	}
+
+	out := rpcResp.Response.(*SignaturesResponse)
+	*resp = *out
+	return nil
+}
+
+// SnapshotChunk ...
+func (i *InmemTransport) SnapshotChunk(ctx context.Context, target string, args *SnapshotChunkRequest, resp *SnapshotChunkResponse) error {
+	i.lock.RLock()
+	timeout := i.timeout
+	i.lock.RUnlock()
+
+	rpcResp, err := i.makeRPC(ctx, target, args, timeout)
+	if err != nil {
+		return err
+	}
+
+	out := rpcResp.Response.(*SnapshotChunkResponse)
+	*resp = *out
+	return nil
+}
+
+// PushShards ...
+func (i *InmemTransport) PushShards(ctx context.Context, target string, args *PushShardsRequest, resp *PushShardsResponse) error {
+	i.lock.RLock()
+	timeout := i.timeout
+	i.lock.RUnlock()
+
+	rpcResp, err := i.makeRPC(ctx, target, args, timeout)
+	if err != nil {
+		return err
+	}
+
+	out := rpcResp.Response.(*PushShardsResponse)
+	*resp = *out
+	return nil
+}
+
+// FetchShards ...
+func (i *InmemTransport) FetchShards(ctx context.Context, target string, args *FetchShardsRequest, resp *FetchShardsResponse) error {
+	i.lock.RLock()
+	timeout := i.timeout
+	i.lock.RUnlock()
+
+	rpcResp, err := i.makeRPC(ctx, target, args, timeout)
+	if err != nil {
+		return err
+	}
+
+	out := rpcResp.Response.(*FetchShardsResponse)
+	*resp = *out
+	return nil
+}
+
+// Discover ...
+func (i *InmemTransport) Discover(ctx context.Context, target string, args *DiscoverRequest, resp *DiscoverResponse) error {
+	i.lock.RLock()
+	timeout := i.timeout
+	i.lock.RUnlock()
+
+	rpcResp, err := i.makeRPC(ctx, target, args, timeout)
+	if err != nil {
+		return err
+	}
+
+	out := rpcResp.Response.(*DiscoverResponse)
+	*resp = *out
+	return nil
+}
+
+// GetTxs ...
+func (i *InmemTransport) GetTxs(ctx context.Context, target string, args *GetTxsRequest, resp *GetTxsResponse) error {
+	i.lock.RLock()
+	timeout := i.timeout
+	i.lock.RUnlock()
+
+	rpcResp, err := i.makeRPC(ctx, target, args, timeout)
+	if err != nil {
+		return err
+	}
+
+	out := rpcResp.Response.(*GetTxsResponse)
+	*resp = *out
+	return nil
+}
+
+func (i *InmemTransport) makeRPC(ctx context.Context, target string, args interface{}, timeout time.Duration) (rpcResp RPCResponse, err error) {
+	i.lock.RLock()
+	shutdown := i.shutdown
+	var peer *InmemTransport
+	ok := false
+	for _, addr := range SplitTarget(target) {
+		if peer, ok = i.peers[addr]; ok {
+			break
+		}
+	}
+	i.lock.RUnlock()
+
+	if shutdown {
+		return rpcResp, ErrTransportShutdown
+	}
+	if !ok {
+		return rpcResp, fmt.Errorf("%v: %s", ErrUnknownTarget, target)
+	}
+
+	respCh := make(chan RPCResponse, 1)
+	req := RPC{
+		Command:  args,
+		RespChan: respCh,
+	}
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	select {
+	case peer.consumerCh <- req:
+	case <-timer.C:
+		return rpcResp, ErrTimeout
+	case <-ctx.Done():
+		return rpcResp, ctx.Err()
+	}
+
+	select {
+	case rpcResp = <-respCh:
+		if rpcResp.Error != nil {
+			err = rpcResp.Error
+		}
+	case <-timer.C:
+		err = ErrTimeout
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+
+	return rpcResp, err
+}
+
+// Connect is used to connect this transport to another transport for a given
+// peer name. This allows for local routing.
+func (i *InmemTransport) Connect(peer string, t *InmemTransport) {
+	i.lock.Lock()
+	defer i.lock.Unlock()
+	i.peers[peer] = t
+}
+
+// Disconnect is used to remove the ability to route to a given peer
+func (i *InmemTransport) Disconnect(peer string) {
+	i.lock.Lock()
+	defer i.lock.Unlock()
+	delete(i.peers, peer)
+}
+
+// Close is used to permanently disable the transport
+func (i *InmemTransport) Close() error {
+	i.lock.Lock()
+	defer i.lock.Unlock()
+	i.shutdown = true
+	i.peers = make(map[string]*InmemTransport)
+	return nil
+}
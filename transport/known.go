@@ -0,0 +1,108 @@
+package transport
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"sort"
+
+	"github.com/bolaxy/crypto"
+)
+
+// The Known map of a SyncRequest has an entry per participant, so for large
+// PeerSets it dominates the requests which return few Events. A requester
+// which synced with the same peer before can send, instead, the entries
+// which changed since the last Known map the peer received from it, in
+// KnownDiff, with KnownHash, the hash of the full map. The peer applies the
+// diff to its copy of the previous map and checks the hash; on a mismatch,
+// like after a lost request, it answers with KnownMismatch, and the
+// requester sends the full map again.
+
+// EncodeKnownDiff returns the entries of known which differ from base,
+// sorted by ID, as pairs of varints: the ID, as the delta from the previous
+// ID, and the index, as the delta from the one of base, or from -1. The
+// entries of base which are not in known are not encoded, so the hash of
+// the result does not match.
+func EncodeKnownDiff(base, known map[uint32]int) []byte {
+	ids := make([]uint32, 0, len(known))
+	for id, index := range known {
+		if b, ok := base[id]; !ok || b != index {
+			ids = append(ids, id)
+		}
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+
+	buf := make([]byte, 0, len(ids)*4)
+	tmp := make([]byte, binary.MaxVarintLen64)
+	prev := uint32(0)
+	for _, id := range ids {
+		n := binary.PutUvarint(tmp, uint64(id-prev))
+		buf = append(buf, tmp[:n]...)
+
+		b, ok := base[id]
+		if !ok {
+			b = -1
+		}
+		n = binary.PutVarint(tmp, int64(known[id]-b))
+		buf = append(buf, tmp[:n]...)
+
+		prev = id
+	}
+
+	return buf
+}
+
+// ApplyKnownDiff returns the Known map encoded by EncodeKnownDiff relative to
+// base, which is not modified
+func ApplyKnownDiff(base map[uint32]int, diff []byte) (map[uint32]int, error) {
+	res := make(map[uint32]int, len(base))
+	for id, index := range base {
+		res[id] = index
+	}
+
+	r := bytes.NewReader(diff)
+	id := uint64(0)
+	for first := true; r.Len() > 0; first = false {
+		d, err := binary.ReadUvarint(r)
+		if err != nil {
+			return nil, fmt.Errorf("known diff: %v", err)
+		}
+		if !first && d == 0 {
+			return nil, fmt.Errorf("known diff: unsorted ids")
+		}
+		id += d
+		if id > uint64(^uint32(0)) {
+			return nil, fmt.Errorf("known diff: id out of range")
+		}
+
+		delta, err := binary.ReadVarint(r)
+		if err != nil {
+			return nil, fmt.Errorf("known diff: %v", err)
+		}
+
+		b, ok := res[uint32(id)]
+		if !ok {
+			b = -1
+		}
+		res[uint32(id)] = b + int(delta)
+	}
+
+	return res, nil
+}
+
+// KnownHash returns the hash of a Known map, over its entries sorted by ID
+func KnownHash(known map[uint32]int) []byte {
+	ids := make([]uint32, 0, len(known))
+	for id := range known {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+
+	buf := make([]byte, 12*len(ids))
+	for i, id := range ids {
+		binary.BigEndian.PutUint32(buf[12*i:], id)
+		binary.BigEndian.PutUint64(buf[12*i+4:], uint64(known[id]))
+	}
+
+	return crypto.Keccak256(buf)
+}
@@ -0,0 +1,336 @@
+package transport
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"sync"
+	"time"
+)
+
+var (
+	// ErrRateLimited is returned to peers which exceed the rate limits
+	ErrRateLimited = errors.New("rate limited")
+	// ErrBanned is returned to banned peers
+	ErrBanned = errors.New("peer banned")
+)
+
+// Penalties added to the score of a misbehaving peer
+const (
+	PenaltyRateLimited  = 1
+	PenaltyOversized    = 50
+	PenaltyInvalidEvent = 100
+)
+
+// minTrust is the trust below which peers are not limited further
+const minTrust = 0.1
+
+// maxTrackedPeers bounds the number of peers whose state is kept. Beyond it,
+// the peers which are neither limited nor penalised are forgotten.
+const maxTrackedPeers = 1024
+
+// Limits bound the sync requests served to peers. Zero values mean no limit.
+type Limits struct {
+	// PeerRequests and GlobalRequests bound the number of requests served per
+	// second, to each peer and to all of them. Bursts of one second are
+	// allowed.
+	PeerRequests   float64
+	GlobalRequests float64
+	// PeerBytes and GlobalBytes bound the size of the responses, in bytes
+	// per second. A response is always served if the previous ones did not
+	// exceed the limit, and its size is charged afterwards.
+	PeerBytes   float64
+	GlobalBytes float64
+	// BanScore is the misbehaviour score at which a peer is banned for
+	// BanDuration. Scores decay by BanScore every BanDuration. 0 disables
+	// bans.
+	BanScore    int
+	BanDuration time.Duration
+}
+
+// DefaultLimits ...
+func DefaultLimits() Limits {
+	return Limits{
+		PeerRequests:   50,
+		GlobalRequests: 500,
+		PeerBytes:      10 << 20,
+		GlobalBytes:    50 << 20,
+		BanScore:       100,
+		BanDuration:    time.Minute,
+	}
+}
+
+// Validate ...
+func (l Limits) Validate() error {
+	if l.PeerRequests < 0 || l.GlobalRequests < 0 || l.PeerBytes < 0 || l.GlobalBytes < 0 {
+		return fmt.Errorf("rate limits must not be negative")
+	}
+	if l.BanScore < 0 {
+		return fmt.Errorf("BanScore must not be negative, got %d", l.BanScore)
+	}
+	if l.BanScore > 0 && l.BanDuration <= 0 {
+		return fmt.Errorf("BanDuration must be positive when BanScore is set, got %v", l.BanDuration)
+	}
+	return nil
+}
+
+// Limiter enforces Limits on the requests of peers, identified by their ID,
+// and keeps their misbehaviour scores. It is safe for concurrent use.
+type Limiter struct {
+	limits Limits
+	trust  func(peer uint32) float64
+
+	lock           sync.Mutex
+	globalRequests *bucket
+	globalBytes    *bucket
+	peers          map[uint32]*peerState
+}
+
+type peerState struct {
+	requests    *bucket
+	bytes       *bucket
+	score       float64
+	scoredAt    time.Time
+	bannedUntil time.Time
+}
+
+// NewLimiter ...
+func NewLimiter(limits Limits) *Limiter {
+	now := time.Now()
+	return &Limiter{
+		limits:         limits,
+		globalRequests: newBucket(limits.GlobalRequests, now),
+		globalBytes:    newBucket(limits.GlobalBytes, now),
+		peers:          make(map[uint32]*peerState),
+	}
+}
+
+// SetTrust makes the limits of each peer proportional to its trust, between 0
+// and 1: the requests and bytes of a peer with a trust of 0.5 cost twice as
+// much. It must be called before the Limiter is used.
+func (l *Limiter) SetTrust(trust func(peer uint32) float64) {
+	l.trust = trust
+}
+
+// cost returns the multiplier of the requests and bytes of peer
+func (l *Limiter) cost(peer uint32) float64 {
+	if l.trust == nil {
+		return 1
+	}
+	return 1 / math.Max(l.trust(peer), minTrust)
+}
+
+// Allow admits a request of peer. It returns ErrBanned if the peer is banned,
+// and ErrRateLimited if a limit is exceeded, in which case the peer is
+// penalised.
+func (l *Limiter) Allow(peer uint32) error {
+	cost := l.cost(peer)
+
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	now := time.Now()
+	p := l.peer(peer, now)
+
+	if now.Before(p.bannedUntil) {
+		return ErrBanned
+	}
+
+	//a request must remain possible with a full bucket
+	peerCost := cost
+	if p.requests.rate > 0 && peerCost > p.requests.rate {
+		peerCost = p.requests.rate
+	}
+
+	if !p.requests.ready(peerCost, now) || !l.globalRequests.ready(1, now) ||
+		!p.bytes.ready(0, now) || !l.globalBytes.ready(0, now) {
+		l.penalize(p, PenaltyRateLimited, now)
+		return ErrRateLimited
+	}
+
+	p.requests.charge(peerCost)
+	l.globalRequests.charge(1)
+
+	return nil
+}
+
+// Charge charges the size of the JSON encoding of resp, as sent by the
+// TCPTransport, to the byte limits. It does nothing if bytes are not limited.
+func (l *Limiter) Charge(peer uint32, resp interface{}) {
+	if l.limits.PeerBytes == 0 && l.limits.GlobalBytes == 0 {
+		return
+	}
+
+	data, err := json.Marshal(resp)
+	if err != nil {
+		return
+	}
+
+	cost := l.cost(peer)
+
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	now := time.Now()
+	l.peer(peer, now).bytes.charge(cost * float64(len(data)))
+	l.globalBytes.charge(float64(len(data)))
+}
+
+// Penalize adds points to the score of peer, and returns true if the peer is
+// banned as a result
+func (l *Limiter) Penalize(peer uint32, points int) bool {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	now := time.Now()
+	return l.penalize(l.peer(peer, now), points, now)
+}
+
+// Banned returns true if peer is banned
+func (l *Limiter) Banned(peer uint32) bool {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	p, ok := l.peers[peer]
+	return ok && time.Now().Before(p.bannedUntil)
+}
+
+// Ban bans peer for d, regardless of its score
+func (l *Limiter) Ban(peer uint32, d time.Duration) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	now := time.Now()
+	l.peer(peer, now).bannedUntil = now.Add(d)
+}
+
+// Unban lifts the ban of peer, and clears its score
+func (l *Limiter) Unban(peer uint32) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	if p, ok := l.peers[peer]; ok {
+		p.bannedUntil = time.Time{}
+		p.score = 0
+	}
+}
+
+// SetLimits replaces the Limits. The buckets restart full, and the scores and
+// bans are kept.
+func (l *Limiter) SetLimits(limits Limits) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	now := time.Now()
+	l.limits = limits
+	l.globalRequests = newBucket(limits.GlobalRequests, now)
+	l.globalBytes = newBucket(limits.GlobalBytes, now)
+	for _, p := range l.peers {
+		p.requests = newBucket(limits.PeerRequests, now)
+		p.bytes = newBucket(limits.PeerBytes, now)
+	}
+}
+
+func (l *Limiter) penalize(p *peerState, points int, now time.Time) bool {
+	if l.limits.BanScore == 0 {
+		return false
+	}
+
+	p.score = l.decay(p, now) + float64(points)
+	p.scoredAt = now
+
+	if p.score < float64(l.limits.BanScore) {
+		return false
+	}
+
+	p.score = 0
+	p.bannedUntil = now.Add(l.limits.BanDuration)
+
+	return true
+}
+
+// decay returns the score of a peer, reduced by the time elapsed since it was
+// last penalised
+func (l *Limiter) decay(p *peerState, now time.Time) float64 {
+	rate := float64(l.limits.BanScore) / l.limits.BanDuration.Seconds()
+	return math.Max(0, p.score-rate*now.Sub(p.scoredAt).Seconds())
+}
+
+func (l *Limiter) peer(id uint32, now time.Time) *peerState {
+	p, ok := l.peers[id]
+	if ok {
+		return p
+	}
+
+	if len(l.peers) >= maxTrackedPeers {
+		l.forget(now)
+	}
+
+	p = &peerState{
+		requests: newBucket(l.limits.PeerRequests, now),
+		bytes:    newBucket(l.limits.PeerBytes, now),
+	}
+	l.peers[id] = p
+
+	return p
+}
+
+// forget removes the peers which are not banned, not penalised, and within
+// their limits
+func (l *Limiter) forget(now time.Time) {
+	for id, p := range l.peers {
+		if now.Before(p.bannedUntil) || (l.limits.BanScore > 0 && l.decay(p, now) > 0) {
+			continue
+		}
+		if p.requests.full(now) && p.bytes.full(now) {
+			delete(l.peers, id)
+		}
+	}
+}
+
+/*******************************************************************************
+Token bucket
+*******************************************************************************/
+
+// bucket holds up to one second of tokens, refilled at rate per second. A
+// rate of 0 means no limit.
+type bucket struct {
+	rate   float64
+	tokens float64
+	last   time.Time
+}
+
+func newBucket(rate float64, now time.Time) *bucket {
+	return &bucket{
+		rate:   rate,
+		tokens: rate,
+		last:   now,
+	}
+}
+
+func (b *bucket) refill(now time.Time) {
+	b.tokens = math.Min(b.rate, b.tokens+b.rate*now.Sub(b.last).Seconds())
+	b.last = now
+}
+
+// ready returns true if at least n tokens are available
+func (b *bucket) ready(n float64, now time.Time) bool {
+	if b.rate == 0 {
+		return true
+	}
+	b.refill(now)
+	return b.tokens >= n
+}
+
+// charge takes n tokens, which can leave the bucket in debt. ready must be
+// called first to refill the bucket.
+func (b *bucket) charge(n float64) {
+	if b.rate != 0 {
+		b.tokens -= n
+	}
+}
+
+func (b *bucket) full(now time.Time) bool {
+	return b.ready(b.rate, now)
+}
@@ -0,0 +1,84 @@
+package transport
+
+import (
+	"encoding/json"
+
+	"github.com/bolaxy/common/hexutil"
+	"github.com/bolaxy/config"
+	"github.com/bolaxy/core/signer"
+	"github.com/bolaxy/crypto"
+)
+
+// PeerRecord advertises the addresses of a peer, as the Address and TcpPort
+// of its conf.Peer, so that the others can reach it without having them in
+// their configuration. It is signed by the peer, and replaces the records of
+// the same peer with a lower Seq.
+type PeerRecord struct {
+	PubKey    string // as the PubKeyHex of the conf.Peer
+	Address   string
+	TcpPort   string
+	Seq       uint64
+	Signature string
+}
+
+// NewPeerRecord creates a PeerRecord signed by s, the signer of pubKey
+func NewPeerRecord(pubKey, address, tcpPort string, seq uint64, s signer.Signer) (*PeerRecord, error) {
+	r := &PeerRecord{
+		PubKey:  pubKey,
+		Address: address,
+		TcpPort: tcpPort,
+		Seq:     seq,
+	}
+
+	hash, err := r.hash()
+	if err != nil {
+		return nil, err
+	}
+
+	sig, err := s.Sign(hash)
+	if err != nil {
+		return nil, err
+	}
+	r.Signature = hexutil.Encode(sig)
+
+	return r, nil
+}
+
+// hash hashes the JSON encoding of the record without its Signature
+func (r *PeerRecord) hash() ([]byte, error) {
+	unsigned := *r
+	unsigned.Signature = ""
+
+	data, err := json.Marshal(&unsigned)
+	if err != nil {
+		return nil, err
+	}
+	return crypto.Keccak256(data), nil
+}
+
+// Verify checks that the record was signed by the key of PubKey
+func (r *PeerRecord) Verify() error {
+	if r.Signature == "" {
+		return ErrUnsigned
+	}
+
+	sig, err := hexutil.Decode(r.Signature)
+	if err != nil || len(sig) < 64 {
+		return ErrBadSignature
+	}
+
+	hash, err := r.hash()
+	if err != nil {
+		return err
+	}
+
+	if !crypto.VerifySignature(r.Peer().PubKeyBytes(), hash, sig[:64]) {
+		return ErrBadSignature
+	}
+	return nil
+}
+
+// Peer returns a conf.Peer with the key and the addresses of the record
+func (r *PeerRecord) Peer() *conf.Peer {
+	return conf.NewPeer(r.PubKey, r.Address, "", "", r.TcpPort)
+}
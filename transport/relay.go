@@ -0,0 +1,488 @@
+package transport
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bolaxy/core/logger"
+)
+
+// A validator which cannot accept inbound connections, like behind a NAT,
+// keeps outbound connections open to a few peers which relay the RPCs of the
+// others to it. It lists the addresses of its relays in its conf.Peer, as
+// RelayAddresses, which the TCPTransports of the others dial after its
+// direct addresses. A relay only forwards an RPC on the connection
+// registered by its target, and the connection only carries the RPCs of the
+// Transport interface, so relayed RPCs are never relayed again.
+
+const relayPrefix = "relay/"
+
+const (
+	// relayRetry is the delay before the connection to a relay is opened
+	// again. It doubles with each failure, up to maxRelayRetry.
+	relayRetry    = time.Second
+	maxRelayRetry = 30 * time.Second
+)
+
+// ErrRelayUnavailable is returned by a relay which has no connection to the
+// target of an RPC
+var ErrRelayUnavailable = errors.New("relay unavailable")
+
+// RelayAddress returns the address of a peer reached through the relay at
+// addr
+func RelayAddress(addr string) string {
+	return relayPrefix + addr
+}
+
+// relayHost returns the address of the relay of a RelayAddress
+func relayHost(addr string) (string, bool) {
+	if !strings.HasPrefix(addr, relayPrefix) {
+		return "", false
+	}
+	return addr[len(relayPrefix):], true
+}
+
+// relayRegistration opens a relayed connection, on which the relay forwards
+// the RPCs to Target
+type relayRegistration struct {
+	Target string
+}
+
+// relayRequest asks a relay to forward an RPC to Target
+type relayRequest struct {
+	Target  string
+	Type    uint8
+	Request json.RawMessage
+}
+
+// relayFrame is an RPC forwarded on a relayed connection
+type relayFrame struct {
+	Type    uint8
+	Request json.RawMessage
+}
+
+// RelayStats accounts for the RPCs forwarded on a relayed connection. The
+// bytes are the ones of the requests and of the responses.
+type RelayStats struct {
+	Connected bool
+	Since     time.Time
+	Requests  int
+	Failures  int
+	BytesIn   int64
+	BytesOut  int64
+}
+
+// relayConn is a relayed connection registered on a relay. The RPCs are
+// forwarded one at a time.
+type relayConn struct {
+	lock sync.Mutex
+	conn net.Conn
+	dec  *json.Decoder
+	done chan struct{}
+	once sync.Once
+}
+
+func (c *relayConn) close() {
+	c.once.Do(func() { close(c.done) })
+}
+
+// forward sends an RPC on the connection and reads back its response
+func (c *relayConn) forward(frame *relayFrame, timeout time.Duration) (*tcpResponse, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if timeout > 0 {
+		c.conn.SetDeadline(time.Now().Add(timeout))
+		defer c.conn.SetDeadline(time.Time{})
+	}
+
+	if err := json.NewEncoder(c.conn).Encode(frame); err != nil {
+		return nil, err
+	}
+
+	var out tcpResponse
+	if err := c.dec.Decode(&out); err != nil {
+		return nil, err
+	}
+	return &out, nil
+}
+
+// relayState holds both sides of the relays of a TCPTransport: the relayed
+// connections registered by the peers it relays to, up to max, and the
+// connections it keeps open to its own relays
+type relayState struct {
+	lock    sync.Mutex
+	max     int
+	conns   map[string]*relayConn  // [target]
+	relayed map[string]*RelayStats // [target]
+	relays  map[string]*RelayStats // [relay address]
+	stop    chan struct{}
+}
+
+func newRelayState() *relayState {
+	return &relayState{
+		conns:   make(map[string]*relayConn),
+		relayed: make(map[string]*RelayStats),
+		relays:  make(map[string]*RelayStats),
+	}
+}
+
+/*******************************************************************************
+Relay
+*******************************************************************************/
+
+// SetRelayService makes the Transport relay the RPCs to up to max peers,
+// which connect to it with SetRelays. 0, the default, disables relaying.
+func (t *TCPTransport) SetRelayService(max int) {
+	t.relay.lock.Lock()
+	defer t.relay.lock.Unlock()
+	t.relay.max = max
+}
+
+// Relayed returns the accounting of the peers the Transport relays to, by
+// target
+func (t *TCPTransport) Relayed() map[string]RelayStats {
+	t.relay.lock.Lock()
+	defer t.relay.lock.Unlock()
+
+	res := make(map[string]RelayStats, len(t.relay.relayed))
+	for target, s := range t.relay.relayed {
+		res[target] = *s
+	}
+	return res
+}
+
+// handleRelayRegister registers a relayed connection, and holds it until it
+// is dropped
+func (t *TCPTransport) handleRelayRegister(conn net.Conn, r *bufio.Reader, w *bufio.Writer) {
+	dec := json.NewDecoder(r)
+
+	var reg relayRegistration
+	if err := dec.Decode(&reg); err != nil {
+		t.writeResponse(w, nil, err)
+		return
+	}
+
+	//a relay never relays to itself
+	for _, addr := range SplitTarget(reg.Target) {
+		if addr == t.advertise {
+			t.writeResponse(w, nil, fmt.Errorf("relay loop: %q", reg.Target))
+			return
+		}
+	}
+
+	rc := &relayConn{conn: conn, dec: dec, done: make(chan struct{})}
+
+	s := t.relay
+	s.lock.Lock()
+	old, replaced := s.conns[reg.Target]
+	if reg.Target == "" || (!replaced && len(s.conns) >= s.max) {
+		s.lock.Unlock()
+		t.writeResponse(w, nil, ErrRelayUnavailable)
+		return
+	}
+	s.conns[reg.Target] = rc
+	s.stats(reg.Target).Connected = true
+	s.stats(reg.Target).Since = time.Now()
+	s.lock.Unlock()
+
+	if replaced {
+		old.close()
+	}
+
+	if tc, ok := conn.(*net.TCPConn); ok {
+		tc.SetKeepAlive(true)
+	}
+
+	t.writeResponse(w, struct{}{}, nil)
+
+	t.logger.Debug("relaying", "target", reg.Target)
+
+	select {
+	case <-rc.done:
+	case <-t.shutdownCh:
+	}
+
+	s.lock.Lock()
+	if s.conns[reg.Target] == rc {
+		delete(s.conns, reg.Target)
+		s.stats(reg.Target).Connected = false
+	}
+	s.lock.Unlock()
+}
+
+// handleRelay forwards an RPC on the relayed connection of its target
+func (t *TCPTransport) handleRelay(r *bufio.Reader, w *bufio.Writer) {
+	var req relayRequest
+	if err := json.NewDecoder(r).Decode(&req); err != nil {
+		t.writeResponse(w, nil, err)
+		return
+	}
+
+	s := t.relay
+	s.lock.Lock()
+	rc, ok := s.conns[req.Target]
+	s.lock.Unlock()
+	if !ok {
+		t.writeResponse(w, nil, ErrRelayUnavailable)
+		return
+	}
+
+	timeout := t.timeout
+	if req.Type == rpcJoin {
+		timeout = t.joinTimeout
+	}
+
+	out, err := rc.forward(&relayFrame{Type: req.Type, Request: req.Request}, timeout)
+
+	s.lock.Lock()
+	stats := s.stats(req.Target)
+	stats.Requests++
+	stats.BytesIn += int64(len(req.Request))
+	if err != nil {
+		stats.Failures++
+	} else {
+		stats.BytesOut += int64(len(out.Response))
+	}
+	s.lock.Unlock()
+
+	if err != nil {
+		t.logger.Debug("relayed connection lost", "target", req.Target, logger.Err, err)
+		rc.close()
+		t.writeResponse(w, nil, ErrRelayUnavailable)
+		return
+	}
+
+	if err := json.NewEncoder(w).Encode(out); err != nil {
+		t.logger.Debug("writing response", logger.Err, err)
+		return
+	}
+	w.Flush()
+}
+
+// stats returns the accounting of a relayed target. The ones of the targets
+// which are no longer connected are forgotten beyond maxTrackedPeers. It
+// must be called with the lock.
+func (s *relayState) stats(target string) *RelayStats {
+	st, ok := s.relayed[target]
+	if ok {
+		return st
+	}
+
+	if len(s.relayed) >= maxTrackedPeers {
+		for k, v := range s.relayed {
+			if !v.Connected {
+				delete(s.relayed, k)
+			}
+		}
+	}
+
+	st = &RelayStats{}
+	s.relayed[target] = st
+	return st
+}
+
+// relayExchange sends an RPC to target through the relay on conn
+func (t *TCPTransport) relayExchange(conn net.Conn, target string, rpcType uint8, args interface{}, resp interface{}, timeout time.Duration) error {
+	data, err := json.Marshal(args)
+	if err != nil {
+		return err
+	}
+
+	req := &relayRequest{
+		Target:  target,
+		Type:    rpcType,
+		Request: data,
+	}
+
+	err = t.exchange(conn, rpcRelay, req, resp, timeout, false)
+	if err != nil && err.Error() == ErrRelayUnavailable.Error() {
+		return ErrRelayUnavailable
+	}
+	return err
+}
+
+/*******************************************************************************
+Relayed
+*******************************************************************************/
+
+// SetRelays keeps connections open to the relays at the given addresses,
+// which forward to the Transport the RPCs to self, the target under which
+// the others know it, ie the PeerTarget of its conf.Peer. The connections
+// are opened again when they are lost. It replaces the relays of a previous
+// call; no relays closes the connections.
+func (t *TCPTransport) SetRelays(self string, relays []string) {
+	s := t.relay
+
+	s.lock.Lock()
+	if s.stop != nil {
+		close(s.stop)
+	}
+	stop := make(chan struct{})
+	s.stop = stop
+	s.relays = make(map[string]*RelayStats)
+	keep := []string{}
+	for _, addr := range relays {
+		if _, ok := s.relays[addr]; ok || addr == t.advertise {
+			continue
+		}
+		s.relays[addr] = &RelayStats{}
+		keep = append(keep, addr)
+	}
+	s.lock.Unlock()
+
+	for _, addr := range keep {
+		go t.keepRelay(self, addr, stop)
+	}
+}
+
+// Relays returns the accounting of the connections to the relays of the
+// Transport, by address
+func (t *TCPTransport) Relays() map[string]RelayStats {
+	t.relay.lock.Lock()
+	defer t.relay.lock.Unlock()
+
+	res := make(map[string]RelayStats, len(t.relay.relays))
+	for addr, s := range t.relay.relays {
+		res[addr] = *s
+	}
+	return res
+}
+
+// keepRelay keeps a relayed connection open to relay, until stop or the
+// shutdown of the Transport
+func (t *TCPTransport) keepRelay(self, relay string, stop chan struct{}) {
+	retry := relayRetry
+	for {
+		conn, dec, err := t.registerRelay(self, relay)
+		if err == nil {
+			retry = relayRetry
+			t.logger.Debug("relay connected", "relay", relay)
+			err = t.serveRelay(relay, conn, dec, stop)
+		}
+
+		t.relay.lock.Lock()
+		if s, ok := t.relay.relays[relay]; ok && t.relay.stop == stop {
+			s.Connected = false
+			s.Failures++
+		}
+		t.relay.lock.Unlock()
+
+		t.logger.Debug("relay disconnected", "relay", relay, logger.Err, err)
+
+		select {
+		case <-time.After(retry):
+		case <-stop:
+			return
+		case <-t.shutdownCh:
+			return
+		}
+
+		if retry *= 2; retry > maxRelayRetry {
+			retry = maxRelayRetry
+		}
+	}
+}
+
+// registerRelay opens a relayed connection to relay
+func (t *TCPTransport) registerRelay(self, relay string) (net.Conn, *json.Decoder, error) {
+	dialer := net.Dialer{Timeout: t.timeout}
+	conn, err := dialer.Dial("tcp", relay)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	conn.SetDeadline(time.Now().Add(t.timeout))
+
+	w := bufio.NewWriter(conn)
+	if err := w.WriteByte(rpcRelayRegister); err != nil {
+		conn.Close()
+		return nil, nil, err
+	}
+	if err := json.NewEncoder(w).Encode(&relayRegistration{Target: self}); err != nil {
+		conn.Close()
+		return nil, nil, err
+	}
+	if err := w.Flush(); err != nil {
+		conn.Close()
+		return nil, nil, err
+	}
+
+	dec := json.NewDecoder(conn)
+	var out tcpResponse
+	if err := dec.Decode(&out); err != nil {
+		conn.Close()
+		return nil, nil, err
+	}
+	if out.Error != "" {
+		conn.Close()
+		return nil, nil, errors.New(out.Error)
+	}
+
+	conn.SetDeadline(time.Time{})
+
+	return conn, dec, nil
+}
+
+// serveRelay serves the RPCs forwarded on a relayed connection, until it is
+// lost
+func (t *TCPTransport) serveRelay(relay string, conn net.Conn, dec *json.Decoder, stop chan struct{}) error {
+	defer conn.Close()
+
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-stop:
+		case <-t.shutdownCh:
+		case <-done:
+		}
+		conn.Close()
+	}()
+
+	t.relay.lock.Lock()
+	if s, ok := t.relay.relays[relay]; ok && t.relay.stop == stop {
+		s.Connected = true
+		s.Since = time.Now()
+	}
+	t.relay.lock.Unlock()
+
+	w := bufio.NewWriter(conn)
+	for {
+		var frame relayFrame
+		if err := dec.Decode(&frame); err != nil {
+			return err
+		}
+
+		//only the RPCs of the Transport, which are not relayed further
+		var resp interface{}
+		var err error
+		command := newCommand(frame.Type)
+		if command == nil {
+			err = fmt.Errorf("%s %d", errUnknownRPCType, frame.Type)
+		} else if err = json.Unmarshal(frame.Request, command); err == nil {
+			resp, err = t.dispatch(command)
+		}
+
+		var data []byte
+		if err == nil {
+			data, err = json.Marshal(resp)
+		}
+
+		t.relay.lock.Lock()
+		if s, ok := t.relay.relays[relay]; ok && t.relay.stop == stop {
+			s.Requests++
+			s.BytesIn += int64(len(frame.Request))
+			s.BytesOut += int64(len(data))
+		}
+		t.relay.lock.Unlock()
+
+		t.writeResponse(w, json.RawMessage(data), err)
+	}
+}
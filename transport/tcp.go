@@ -0,0 +1,504 @@
+package transport
+
+import (
+	"bufio"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/bolaxy/core/logger"
+)
+
+const (
+	rpcSync uint8 = iota
+	rpcJoin
+	rpcFastForward
+	rpcHistory
+	rpcSignatures
+	rpcSnapshotChunk
+	rpcPushShards
+	rpcFetchShards
+	rpcRelay
+	rpcRelayRegister
+	rpcDiscover
+	rpcGetTxs
+	rpcHandshake
+)
+
+// rpcGzip flags the rpc types of the requests which are compressed, as are
+// their responses
+const rpcGzip uint8 = 0x80
+
+// MaxMessageSize bounds the size of a compressed message once decompressed,
+// so that a small gzipped body cannot expand without limit
+const MaxMessageSize = 64 << 20
+
+// errUnknownRPCType starts the error returned for unknown rpc types, like the
+// handshake with the peers of version 0
+const errUnknownRPCType = "unknown rpc type"
+
+// tcpResponse is the envelope of the responses written by TCPTransport
+type tcpResponse struct {
+	Error    string
+	Response json.RawMessage
+}
+
+// TCPTransport is a Transport over TCP. Every RPC uses its own connection: the
+// caller writes a type byte followed by the JSON encoding of the request, and
+// reads back the JSON encoding of a tcpResponse, both compressed if the
+// handshake with the target agreed on it, see PeerCapabilities. The
+// connection goes to the first address of the target which can be dialed, in
+// the order of the AddressBook, or through a relay, see SetRelays.
+type TCPTransport struct {
+	listener    net.Listener
+	advertise   string
+	addrs       *AddressBook
+	relay       *relayState
+	caps        Capabilities
+	sessions    *sessions
+	consumerCh  chan RPC
+	timeout     time.Duration
+	joinTimeout time.Duration
+	logger      logger.Logger
+
+	shutdownLock sync.Mutex
+	shutdown     bool
+	shutdownCh   chan struct{}
+}
+
+// NewTCPTransport listens on bindAddr. advertise is the address given to
+// peers, which defaults to the address of the listener.
+func NewTCPTransport(bindAddr string, advertise string, timeout, joinTimeout time.Duration) (*TCPTransport, error) {
+	listener, err := net.Listen("tcp", bindAddr)
+	if err != nil {
+		return nil, err
+	}
+
+	if advertise == "" {
+		advertise = listener.Addr().String()
+	}
+
+	t := &TCPTransport{
+		listener:    listener,
+		advertise:   advertise,
+		addrs:       NewAddressBook(PreferListed),
+		relay:       newRelayState(),
+		caps:        DefaultCapabilities(),
+		sessions:    newSessions(),
+		consumerCh:  make(chan RPC, 16),
+		timeout:     timeout,
+		joinTimeout: joinTimeout,
+		logger:      logger.Nop,
+		shutdownCh:  make(chan struct{}),
+	}
+
+	go t.listen()
+
+	return t, nil
+}
+
+// SetLogger ...
+func (t *TCPTransport) SetLogger(l logger.Logger) {
+	t.logger = logger.OrNop(l).With(logger.Component, "TCPTransport")
+}
+
+// SetDialPreference orders the addresses of the peers which list several
+func (t *TCPTransport) SetDialPreference(p DialPreference) {
+	t.addrs.SetPreference(p)
+}
+
+// AddressHealth returns the health of the addresses dialed so far
+func (t *TCPTransport) AddressHealth() map[string]AddressHealth {
+	return t.addrs.Health()
+}
+
+// Consumer ...
+func (t *TCPTransport) Consumer() <-chan RPC {
+	return t.consumerCh
+}
+
+// LocalAddr ...
+func (t *TCPTransport) LocalAddr() string {
+	return t.advertise
+}
+
+// Sync ...
+func (t *TCPTransport) Sync(ctx context.Context, target string, args *SyncRequest, resp *SyncResponse) error {
+	return t.genericRPC(ctx, target, rpcSync, args, resp, t.timeout)
+}
+
+// Join ...
+func (t *TCPTransport) Join(ctx context.Context, target string, args *JoinRequest, resp *JoinResponse) error {
+	return t.genericRPC(ctx, target, rpcJoin, args, resp, t.joinTimeout)
+}
+
+// FastForward ...
+func (t *TCPTransport) FastForward(ctx context.Context, target string, args *FastForwardRequest, resp *FastForwardResponse) error {
+	return t.genericRPC(ctx, target, rpcFastForward, args, resp, t.timeout)
+}
+
+// History ...
+func (t *TCPTransport) History(ctx context.Context, target string, args *HistoryRequest, resp *HistoryResponse) error {
+	return t.genericRPC(ctx, target, rpcHistory, args, resp, t.timeout)
+}
+
+// Signatures ...
+func (t *TCPTransport) Signatures(ctx context.Context, target string, args *SignaturesRequest, resp *SignaturesResponse) error {
+	return t.genericRPC(ctx, target, rpcSignatures, args, resp, t.timeout)
+}
+
+// SnapshotChunk ...
+func (t *TCPTransport) SnapshotChunk(ctx context.Context, target string, args *SnapshotChunkRequest, resp *SnapshotChunkResponse) error {
+	return t.genericRPC(ctx, target, rpcSnapshotChunk, args, resp, t.timeout)
+}
+
+// PushShards ...
+func (t *TCPTransport) PushShards(ctx context.Context, target string, args *PushShardsRequest, resp *PushShardsResponse) error {
+	return t.genericRPC(ctx, target, rpcPushShards, args, resp, t.timeout)
+}
+
+// FetchShards ...
+func (t *TCPTransport) FetchShards(ctx context.Context, target string, args *FetchShardsRequest, resp *FetchShardsResponse) error {
+	return t.genericRPC(ctx, target, rpcFetchShards, args, resp, t.timeout)
+}
+
+// Discover ...
+func (t *TCPTransport) Discover(ctx context.Context, target string, args *DiscoverRequest, resp *DiscoverResponse) error {
+	return t.genericRPC(ctx, target, rpcDiscover, args, resp, t.timeout)
+}
+
+// GetTxs ...
+func (t *TCPTransport) GetTxs(ctx context.Context, target string, args *GetTxsRequest, resp *GetTxsResponse) error {
+	return t.genericRPC(ctx, target, rpcGetTxs, args, resp, t.timeout)
+}
+
+// Close ...
+func (t *TCPTransport) Close() error {
+	t.shutdownLock.Lock()
+	defer t.shutdownLock.Unlock()
+
+	if !t.shutdown {
+		close(t.shutdownCh)
+		t.shutdown = true
+		return t.listener.Close()
+	}
+
+	return nil
+}
+
+func (t *TCPTransport) isShutdown() bool {
+	select {
+	case <-t.shutdownCh:
+		return true
+	default:
+		return false
+	}
+}
+
+// genericRPC sends a request to the addresses of target in turn, until one
+// answers, and decodes the response. It fails over to the next address when
+// an address cannot be dialed, or when a relay no longer relays to target;
+// the request is only served once.
+func (t *TCPTransport) genericRPC(ctx context.Context, target string, rpcType uint8, args interface{}, resp interface{}, timeout time.Duration) error {
+	if t.isShutdown() {
+		return ErrTransportShutdown
+	}
+
+	addrs := t.addrs.Order(target)
+	if len(addrs) == 0 {
+		return fmt.Errorf("%v: %q", ErrUnknownTarget, target)
+	}
+
+	dialer := net.Dialer{Timeout: t.timeout}
+	compressed := rpcType != rpcHandshake && t.compress(target)
+
+	var err error
+	for _, addr := range addrs {
+		relay, relayed := relayHost(addr)
+		host := addr
+		if relayed {
+			host = relay
+		}
+
+		var conn net.Conn
+		conn, err = dialer.DialContext(ctx, "tcp", host)
+		if err == nil {
+			err = t.call(ctx, conn, func() error {
+				if relayed {
+					return t.relayExchange(conn, target, rpcType, args, resp, timeout)
+				}
+				return t.exchange(conn, rpcType, args, resp, timeout, compressed)
+			})
+			if err != ErrRelayUnavailable {
+				t.addrs.Success(addr)
+				//the peer may have changed, the next request handshakes again
+				if err != nil && rpcType != rpcHandshake {
+					t.sessions.drop(target)
+				}
+				return err
+			}
+		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+
+		t.addrs.Failure(addr, err)
+		if len(addrs) > 1 {
+			t.logger.Debug("address unreachable, failing over", "addr", addr, logger.Err, err)
+		}
+	}
+
+	return err
+}
+
+// call runs an exchange on conn, which it closes when ctx is done to
+// interrupt the exchange
+func (t *TCPTransport) call(ctx context.Context, conn net.Conn, exchange func() error) error {
+	defer conn.Close()
+
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.Close()
+		case <-done:
+		}
+	}()
+
+	if err := exchange(); err != nil {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		return err
+	}
+
+	return nil
+}
+
+func (t *TCPTransport) exchange(conn net.Conn, rpcType uint8, args interface{}, resp interface{}, timeout time.Duration, compressed bool) error {
+	if timeout > 0 {
+		conn.SetDeadline(time.Now().Add(timeout))
+	}
+
+	w := bufio.NewWriter(conn)
+	if compressed {
+		rpcType |= rpcGzip
+	}
+	if err := w.WriteByte(rpcType); err != nil {
+		return err
+	}
+	if err := encode(w, args, compressed); err != nil {
+		return err
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+
+	var r io.Reader = bufio.NewReader(conn)
+	if compressed {
+		zr, err := decompress(r)
+		if err != nil {
+			return err
+		}
+		r = zr
+	}
+
+	var out tcpResponse
+	if err := json.NewDecoder(r).Decode(&out); err != nil {
+		if ne, ok := err.(net.Error); ok && ne.Timeout() {
+			return ErrTimeout
+		}
+		return err
+	}
+
+	if out.Error != "" {
+		return errors.New(out.Error)
+	}
+
+	return json.Unmarshal(out.Response, resp)
+}
+
+func (t *TCPTransport) listen() {
+	for {
+		conn, err := t.listener.Accept()
+		if err != nil {
+			if t.isShutdown() {
+				return
+			}
+			t.logger.Error("accepting connection", logger.Err, err)
+			continue
+		}
+
+		go t.handleConn(conn)
+	}
+}
+
+func (t *TCPTransport) handleConn(conn net.Conn) {
+	defer conn.Close()
+
+	r := bufio.NewReader(conn)
+	w := bufio.NewWriter(conn)
+
+	rpcType, err := r.ReadByte()
+	if err != nil {
+		return
+	}
+
+	switch rpcType {
+	case rpcRelay:
+		t.handleRelay(r, w)
+		return
+	case rpcRelayRegister:
+		t.handleRelayRegister(conn, r, w)
+		return
+	case rpcHandshake:
+		t.handleHandshake(r, w)
+		return
+	}
+
+	compressed := rpcType&rpcGzip != 0
+	rpcType &^= rpcGzip
+
+	command := newCommand(rpcType)
+	if command == nil {
+		t.writeResponse(w, nil, fmt.Errorf("%s %d", errUnknownRPCType, rpcType))
+		return
+	}
+
+	var in io.Reader = r
+	if compressed {
+		zr, err := decompress(r)
+		if err != nil {
+			t.writeResponse(w, nil, err)
+			return
+		}
+		in = zr
+	}
+
+	if err := json.NewDecoder(in).Decode(command); err != nil {
+		t.writeCompressedResponse(w, nil, err, compressed)
+		return
+	}
+
+	resp, err := t.dispatch(command)
+	t.writeCompressedResponse(w, resp, err, compressed)
+}
+
+// handleHandshake answers a HandshakeRequest with our Capabilities
+func (t *TCPTransport) handleHandshake(r *bufio.Reader, w *bufio.Writer) {
+	var req HandshakeRequest
+	if err := json.NewDecoder(r).Decode(&req); err != nil {
+		t.writeResponse(w, nil, err)
+		return
+	}
+	t.writeResponse(w, &HandshakeResponse{t.caps}, nil)
+}
+
+// newCommand returns the request of an rpc type, or nil for unknown types
+func newCommand(rpcType uint8) interface{} {
+	switch rpcType {
+	case rpcSync:
+		return &SyncRequest{}
+	case rpcJoin:
+		return &JoinRequest{}
+	case rpcFastForward:
+		return &FastForwardRequest{}
+	case rpcHistory:
+		return &HistoryRequest{}
+	case rpcSignatures:
+		return &SignaturesRequest{}
+	case rpcSnapshotChunk:
+		return &SnapshotChunkRequest{}
+	case rpcPushShards:
+		return &PushShardsRequest{}
+	case rpcFetchShards:
+		return &FetchShardsRequest{}
+	case rpcDiscover:
+		return &DiscoverRequest{}
+	case rpcGetTxs:
+		return &GetTxsRequest{}
+	default:
+		return nil
+	}
+}
+
+// dispatch hands a request to the consumer and waits for its response
+func (t *TCPTransport) dispatch(command interface{}) (interface{}, error) {
+	respCh := make(chan RPCResponse, 1)
+	rpc := RPC{
+		Command:  command,
+		RespChan: respCh,
+	}
+
+	select {
+	case t.consumerCh <- rpc:
+	case <-t.shutdownCh:
+		return nil, ErrTransportShutdown
+	}
+
+	select {
+	case resp := <-respCh:
+		return resp.Response, resp.Error
+	case <-t.shutdownCh:
+		return nil, ErrTransportShutdown
+	}
+}
+
+func (t *TCPTransport) writeResponse(w *bufio.Writer, resp interface{}, rpcErr error) {
+	t.writeCompressedResponse(w, resp, rpcErr, false)
+}
+
+// writeCompressedResponse writes the response of a request which was
+// compressed, or not
+func (t *TCPTransport) writeCompressedResponse(w *bufio.Writer, resp interface{}, rpcErr error, compressed bool) {
+	out := tcpResponse{}
+
+	if rpcErr != nil {
+		out.Error = rpcErr.Error()
+	} else {
+		data, err := json.Marshal(resp)
+		if err != nil {
+			out.Error = err.Error()
+		} else {
+			out.Response = data
+		}
+	}
+
+	if err := encode(w, out, compressed); err != nil {
+		t.logger.Debug("writing response", logger.Err, err)
+		return
+	}
+	w.Flush()
+}
+
+// decompress returns a reader of the gzipped message which r starts with,
+// which ends after MaxMessageSize bytes. It does not wait for another one,
+// since the connection stays open.
+func decompress(r io.Reader) (io.Reader, error) {
+	zr, err := gzip.NewReader(r)
+	if err != nil {
+		return nil, err
+	}
+	zr.Multistream(false)
+	return io.LimitReader(zr, MaxMessageSize), nil
+}
+
+// encode writes the JSON encoding of v to w, gzipped if compressed
+func encode(w io.Writer, v interface{}, compressed bool) error {
+	if !compressed {
+		return json.NewEncoder(w).Encode(v)
+	}
+
+	zw := gzip.NewWriter(w)
+	if err := json.NewEncoder(zw).Encode(v); err != nil {
+		return err
+	}
+	return zw.Close()
+}
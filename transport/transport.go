@@ -0,0 +1,311 @@
+// Package transport defines the RPCs exchanged between nodes and the
+// transports which carry them.
+package transport
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/bolaxy/config"
+	"github.com/bolaxy/core/types"
+)
+
+var (
+	// ErrTransportShutdown is returned by operations on a closed Transport
+	ErrTransportShutdown = errors.New("transport shutdown")
+	// ErrTimeout is returned when a peer does not answer in time
+	ErrTimeout = errors.New("rpc timeout")
+	// ErrUnknownTarget is returned when a target can not be reached
+	ErrUnknownTarget = errors.New("unknown target")
+)
+
+const (
+	// DefaultTimeout bounds the RPCs which are answered immediately
+	DefaultTimeout = 10 * time.Second
+	// DefaultJoinTimeout bounds Join RPCs, which are only answered once the
+	// request went through consensus
+	DefaultJoinTimeout = 2 * time.Minute
+)
+
+/*******************************************************************************
+Messages
+*******************************************************************************/
+
+// SyncRequest asks for the Events unknown to the requester. Known maps the
+// ID of each participant to the index of its last Event known by the
+// requester. It can be replaced by KnownDiff and KnownHash, see
+// EncodeKnownDiff. Batched asks for the Events in a WireEventBatch, and
+// PullTxs for the hashes of their transactions, see GetTxsRequest.
+type SyncRequest struct {
+	FromID    uint32
+	Known     map[uint32]int
+	KnownDiff []byte `json:",omitempty"`
+	KnownHash []byte `json:",omitempty"`
+	SyncLimit int
+	Batched   bool `json:",omitempty"`
+	PullTxs   bool `json:",omitempty"`
+	Envelope
+}
+
+// SyncResponse contains Events in topological order, and the Known map of
+// the responder. KnownMismatch, without Events, asks the requester to send
+// its full Known map, which the KnownDiff of the request did not give. The
+// Events of a Batched request are in Batch instead, see Unbatch.
+type SyncResponse struct {
+	FromID        uint32
+	Events        []types.WireEvent
+	Batch         *types.WireEventBatch `json:",omitempty"`
+	Known         map[uint32]int
+	KnownMismatch bool `json:",omitempty"`
+	Envelope
+}
+
+// Unbatch moves the Events of the Batch to Events. It changes the signed
+// content of the response, so it is done after its verification.
+func (r *SyncResponse) Unbatch() {
+	if r.Batch == nil {
+		return
+	}
+	r.Events = append(r.Events, r.Batch.Events()...)
+	r.Batch = nil
+}
+
+// JoinRequest asks a member of the network to submit a PEER_ADD
+// InternalTransaction, signed by the candidate, to consensus
+type JoinRequest struct {
+	InternalTransaction types.InternalTransaction
+}
+
+// JoinResponse is returned once the InternalTransaction of a JoinRequest was
+// committed. AcceptedRound is the round from which the candidate is part of
+// the PeerSet, and Peers is that PeerSet.
+type JoinResponse struct {
+	FromID        uint32
+	Accepted      bool
+	AcceptedRound int
+	BlockIndex    int
+	Peers         []*conf.Peer
+}
+
+// FastForwardRequest asks for a snapshot of the consensus state
+type FastForwardRequest struct {
+	FromID uint32
+	Envelope
+}
+
+// FastForwardResponse contains a Block and the corresponding Frame, from
+// which a Hashgraph can be Reset
+type FastForwardResponse struct {
+	FromID uint32
+	Block  types.Block
+	Frame  types.Frame
+	// Snapshot is the application state after Block, if the application of
+	// the sender takes snapshots and the snapshot fits in one chunk. Larger
+	// snapshots are described by Manifest, and their chunks fetched with
+	// SnapshotChunk requests.
+	Snapshot []byte            `json:",omitempty"`
+	Manifest *SnapshotManifest `json:",omitempty"`
+	Envelope
+}
+
+// SnapshotManifest describes an application snapshot split in chunks of
+// ChunkSize bytes, the last one possibly shorter. Chunks are the Keccak256
+// hashes of the chunks, and Hash the hash of the whole snapshot.
+type SnapshotManifest struct {
+	BlockIndex int
+	Size       int
+	ChunkSize  int
+	Chunks     [][]byte
+	Hash       []byte
+}
+
+// SnapshotChunkRequest asks for a chunk of the application snapshot of a
+// Block, described by a SnapshotManifest
+type SnapshotChunkRequest struct {
+	FromID     uint32
+	BlockIndex int
+	Index      int
+	Envelope
+}
+
+// SnapshotChunkResponse contains a chunk of an application snapshot, which
+// the requester checks against the SnapshotManifest
+type SnapshotChunkResponse struct {
+	FromID     uint32
+	BlockIndex int
+	Index      int
+	Data       []byte
+	Envelope
+}
+
+// HistoryRequest asks an archival peer for the Frames and Blocks of the
+// rounds FromRound to ToRound
+type HistoryRequest struct {
+	FromID    uint32
+	FromRound int
+	ToRound   int
+	Envelope
+}
+
+// HistoryResponse contains the Frames of the requested rounds, in round
+// order, and the Blocks produced from them
+type HistoryResponse struct {
+	FromID uint32
+	Frames []types.Frame
+	Blocks []types.Block
+	Envelope
+}
+
+// SignaturesRequest asks for the signatures of the Blocks from FromIndex
+// which are not final for the requester. It is the fallback when too few
+// signatures ride on the gossiped Events.
+type SignaturesRequest struct {
+	FromID    uint32
+	FromIndex int
+	Envelope
+}
+
+// SignaturesResponse contains the signatures known by the responder of the
+// requested Blocks
+type SignaturesResponse struct {
+	FromID     uint32
+	Signatures []types.BlockSignature
+	Envelope
+}
+
+// PushShardsRequest hands shards of the erasure-coded payload of an Event to
+// a peer, which serves them to the others. It is sent by the creator of the
+// Event.
+type PushShardsRequest struct {
+	FromID  uint32
+	Coded   types.CodedPayload
+	Indexes []int
+	Shards  [][]byte // parallel to Indexes
+	Envelope
+}
+
+// PushShardsResponse acknowledges a PushShardsRequest with the number of
+// shards which were valid
+type PushShardsResponse struct {
+	FromID uint32
+	Stored int
+}
+
+// FetchShardsRequest asks for shards of an erasure-coded payload, identified
+// by its hash
+type FetchShardsRequest struct {
+	FromID  uint32
+	Hash    []byte
+	Indexes []int
+	Envelope
+}
+
+// FetchShardsResponse contains the requested shards known by the responder,
+// which the requester checks against the CodedPayload
+type FetchShardsResponse struct {
+	FromID  uint32
+	Indexes []int
+	Shards  [][]byte // parallel to Indexes
+	Envelope
+}
+
+// GetTxsRequest asks for the transactions of the given hashes, which the
+// Events of a SyncResponse carried instead of their transactions
+type GetTxsRequest struct {
+	FromID uint32
+	Hashes [][]byte
+	Envelope
+}
+
+// GetTxsResponse contains the requested transactions, parallel to the Hashes
+// of the request, nil for the ones unknown to the responder. The requester
+// checks them against their hashes.
+type GetTxsResponse struct {
+	FromID uint32
+	Txs    [][]byte
+	Envelope
+}
+
+// DiscoverRequest hands PeerRecords to a peer, or to a seed node. It is not
+// signed, so that the nodes outside the PeerSet can discover it; the records
+// are.
+type DiscoverRequest struct {
+	Records []PeerRecord
+}
+
+// DiscoverResponse contains the PeerRecords known by the responder
+type DiscoverResponse struct {
+	Records []PeerRecord
+}
+
+/*******************************************************************************
+RPC
+*******************************************************************************/
+
+// RPCResponse captures both a response and a potential error
+type RPCResponse struct {
+	Response interface{}
+	Error    error
+}
+
+// RPC has a command, and provides a response mechanism
+type RPC struct {
+	Command  interface{}
+	RespChan chan<- RPCResponse
+}
+
+// Respond is used to respond with a response, error or both
+func (r *RPC) Respond(resp interface{}, err error) {
+	r.RespChan <- RPCResponse{resp, err}
+}
+
+// Transport provides an interface for network transports to allow a node to
+// communicate with other nodes. Incoming RPCs are delivered on the Consumer
+// channel and must be answered with RPC.Respond. Outgoing RPCs return the
+// error of their context as soon as it is done.
+type Transport interface {
+	// Consumer returns a channel that can be used to consume and respond to
+	// RPC requests
+	Consumer() <-chan RPC
+
+	// LocalAddr is used to return our local address to distinguish from our
+	// peers
+	LocalAddr() string
+
+	// Sync sends a SyncRequest to target and waits for the response
+	Sync(ctx context.Context, target string, args *SyncRequest, resp *SyncResponse) error
+
+	// Join sends a JoinRequest to target. It blocks until the request went
+	// through consensus, or the join timeout expires.
+	Join(ctx context.Context, target string, args *JoinRequest, resp *JoinResponse) error
+
+	// FastForward requests a snapshot from target
+	FastForward(ctx context.Context, target string, args *FastForwardRequest, resp *FastForwardResponse) error
+
+	// History requests old Frames and Blocks from target
+	History(ctx context.Context, target string, args *HistoryRequest, resp *HistoryResponse) error
+
+	// Signatures requests Block signatures from target
+	Signatures(ctx context.Context, target string, args *SignaturesRequest, resp *SignaturesResponse) error
+
+	// SnapshotChunk requests a chunk of an application snapshot from target
+	SnapshotChunk(ctx context.Context, target string, args *SnapshotChunkRequest, resp *SnapshotChunkResponse) error
+
+	// PushShards hands shards of an erasure-coded Event payload to target
+	PushShards(ctx context.Context, target string, args *PushShardsRequest, resp *PushShardsResponse) error
+
+	// FetchShards requests shards of an erasure-coded Event payload from
+	// target
+	FetchShards(ctx context.Context, target string, args *FetchShardsRequest, resp *FetchShardsResponse) error
+
+	// Discover exchanges PeerRecords with target
+	Discover(ctx context.Context, target string, args *DiscoverRequest, resp *DiscoverResponse) error
+
+	// GetTxs requests the transactions of the Events pulled from target
+	GetTxs(ctx context.Context, target string, args *GetTxsRequest, resp *GetTxsResponse) error
+
+	// Close permanently closes a transport, stopping any associated goroutines
+	// and freeing other resources
+	Close() error
+}
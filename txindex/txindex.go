@@ -0,0 +1,225 @@
+// Package txindex maps transaction hashes to the Blocks and Events that
+// carry them.
+package txindex
+
+import (
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+
+	"github.com/bolaxy/core/db"
+	"github.com/bolaxy/core/hashgraph"
+	"github.com/bolaxy/core/logger"
+	"github.com/bolaxy/core/store"
+	"github.com/bolaxy/core/types"
+	"github.com/bolaxy/crypto"
+	"github.com/bolaxy/errors"
+)
+
+const txPrefix = "tx"
+
+// Location is where a transaction was committed
+type Location struct {
+	BlockIndex int
+	Offset     int    // position in the Block's transactions
+	EventHex   string // Event that carried the transaction
+}
+
+// Result is returned by GetTransaction
+type Result struct {
+	Tx       []byte
+	Location Location
+	Block    *types.Block
+	Proof    *types.MerkleProof // links Tx to Block.TxRoot()
+}
+
+// TxIndex maintains a mapping from Keccak256(tx) to the Location of the
+// transaction. Entries are written under the tx prefix of the Sinker, which
+// can be shared with a CachedStore.
+type TxIndex struct {
+	db     db.Sinker
+	store  store.Store
+	logger logger.Logger
+}
+
+// NewTxIndex creates a TxIndex which persists entries in sinker and reads
+// Blocks and Frames from s.
+func NewTxIndex(sinker db.Sinker, s store.Store) *TxIndex {
+	return &TxIndex{
+		db:     sinker,
+		store:  s,
+		logger: logger.Nop,
+	}
+}
+
+// SetLogger ...
+func (ti *TxIndex) SetLogger(l logger.Logger) {
+	ti.logger = logger.OrNop(l).With(logger.Component, "txindex")
+}
+
+// Hash returns the key under which a transaction is indexed
+func Hash(tx []byte) []byte {
+	return crypto.Keccak256(tx)
+}
+
+func txKey(hash []byte) []byte {
+	return []byte(fmt.Sprintf("%s_%s", txPrefix, hex.EncodeToString(hash)))
+}
+
+// Wrap returns a CommitCallback which indexes a Block before passing it to
+// cb. It is meant to be passed to NewHashgraph so that the index is
+// maintained as Blocks are committed.
+func (ti *TxIndex) Wrap(cb hashgraph.CommitCallback) hashgraph.CommitCallback {
+	return func(ctx context.Context, block *types.Block) error {
+		if err := ti.IndexBlock(ctx, block); err != nil {
+			return err
+		}
+		if cb != nil {
+			return cb(ctx, block)
+		}
+		return nil
+	}
+}
+
+// IndexBlock writes the Locations of all the transactions of a Block, with
+// the Events returned by Carriers.
+func (ti *TxIndex) IndexBlock(ctx context.Context, block *types.Block) error {
+	txs := block.Transactions()
+	if len(txs) == 0 {
+		return nil
+	}
+
+	carriers, err := Carriers(ti.store, block)
+	if err != nil {
+		ti.logger.Warn("carrying events not found, indexing without events",
+			logger.Block, block.Index(),
+			logger.Round, block.RoundReceived(),
+			logger.Err, err)
+	}
+
+	batch := ti.db.NewBatch()
+	for i, tx := range txs {
+		loc := Location{
+			BlockIndex: block.Index(),
+			Offset:     i,
+		}
+		if i < len(carriers) {
+			loc.EventHex = carriers[i].Core.GetHex()
+		}
+
+		val, err := json.Marshal(loc)
+		if err != nil {
+			batch.Cancel()
+			return err
+		}
+		if err := batch.Set(txKey(Hash(tx)), val); err != nil {
+			batch.Cancel()
+			return err
+		}
+	}
+
+	if err := batch.Commit(ctx); err != nil {
+		return err
+	}
+
+	ti.logger.Debug("indexed block", logger.Block, block.Index(), "txs", len(txs))
+
+	return nil
+}
+
+// Carriers returns the Events of the Frame of a Block which carried its
+// transactions, one per transaction, in the same order. The Events of a Frame
+// appear in the same order as the transactions. When a Frame is split across
+// several Blocks, the Block's transactions start after those of the previous
+// Blocks of the same Frame.
+func Carriers(s store.Store, block *types.Block) ([]*types.FrameEvent, error) {
+	frame, err := s.GetFrame(block.RoundReceived())
+	if err != nil {
+		return nil, err
+	}
+
+	carriers := []*types.FrameEvent{}
+	for _, fe := range frame.Events {
+		for range fe.Core.Transactions() {
+			carriers = append(carriers, fe)
+		}
+	}
+
+	skip, err := frameOffset(s, block)
+	if err != nil {
+		return nil, err
+	}
+	if skip > len(carriers) {
+		skip = len(carriers)
+	}
+
+	return carriers[skip:], nil
+}
+
+// frameOffset returns the number of transactions of the Block's Frame which
+// are in previous Blocks
+func frameOffset(s store.Store, block *types.Block) (int, error) {
+	offset := 0
+	for i := block.Index() - 1; i >= 0; i-- {
+		prev, err := s.GetBlock(i)
+		if err != nil {
+			return 0, err
+		}
+		if prev.RoundReceived() != block.RoundReceived() {
+			break
+		}
+		offset += len(prev.Transactions())
+	}
+	return offset, nil
+}
+
+// GetLocation returns the Location of the transaction with the given hash
+func (ti *TxIndex) GetLocation(ctx context.Context, hash []byte) (Location, error) {
+	var loc Location
+
+	val, err := ti.db.Get(ctx, txKey(hash))
+	if err != nil {
+		if err == db.ErrKeyNotFound {
+			return loc, errors.NewStoreErr("TxIndex", errors.KeyNotFound, hex.EncodeToString(hash))
+		}
+		return loc, err
+	}
+
+	if err := json.Unmarshal(val, &loc); err != nil {
+		return loc, err
+	}
+
+	return loc, nil
+}
+
+// GetTransaction returns the transaction with the given hash, the Block it
+// was committed in, and a Merkle proof of its inclusion in the Block.
+func (ti *TxIndex) GetTransaction(ctx context.Context, hash []byte) (*Result, error) {
+	loc, err := ti.GetLocation(ctx, hash)
+	if err != nil {
+		return nil, err
+	}
+
+	block, err := ti.store.GetBlock(loc.BlockIndex)
+	if err != nil {
+		return nil, err
+	}
+
+	txs := block.Transactions()
+	if loc.Offset >= len(txs) {
+		return nil, fmt.Errorf("transaction offset %d out of range in block %d", loc.Offset, loc.BlockIndex)
+	}
+
+	proof, err := types.NewMerkleProof(txs, loc.Offset)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Result{
+		Tx:       txs[loc.Offset],
+		Location: loc,
+		Block:    block,
+		Proof:    proof,
+	}, nil
+}
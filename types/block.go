@@ -9,6 +9,7 @@ import (
 
 	"github.com/bolaxy/common/hexutil"
 	conf "github.com/bolaxy/config"
+	"github.com/bolaxy/core/signer"
 	"github.com/bolaxy/crypto"
 )
 
@@ -22,6 +23,17 @@ type BlockBody struct {
 	Transactions                [][]byte
 	InternalTransactions        []InternalTransaction
 	InternalTransactionReceipts []InternalTransactionReceipt
+	PayloadTypes                []PayloadType `json:",omitempty"` //empty, or the type of each transaction
+	// PeerSetRoot is the root of the MMR of the history of the PeerSets,
+	// including the ones scheduled after RoundReceived, so that light
+	// clients verify the PeerSet transitions with the signatures of the
+	// Blocks. See Frame.PeerSetRoot.
+	//
+	// It is only set from the activation of ProtocolPeerSetRoot, so that the
+	// hashes of the earlier Blocks are unchanged: a running network keeps
+	// its history, and gets PeerSetRoots once a SuperMajority of the
+	// validators signalled the version with SignalUpgrade.
+	PeerSetRoot []byte `json:",omitempty"`
 }
 
 // Marshal - json encoding of body only
@@ -65,9 +77,10 @@ func (bs *BlockSignature) ValidatorHex() string {
 	return strings.ToUpper(hexutil.Encode(bs.Validator))
 }
 
+// ValidatorCompressHex returns the upper case hex of the compressed public key
+// of the Validator, which keys the PeerSets
 func (bs *BlockSignature) ValidatorCompressHex() string {
-	pub, _ := crypto.UnmarshalPubkey(bs.Validator)
-	return strings.ToUpper(hexutil.Encode(crypto.CompressPubkey(pub)))
+	return PubKeys.Intern(bs.Validator).Hex
 }
 
 // Marshal ...
@@ -116,24 +129,115 @@ type Block struct {
 
 	hash    []byte
 	hex     string
+	txRoot  []byte
 	peerSet *conf.PeerSet
 }
 
-// NewBlockFromFrame ...
+// BlockLimits bound the size of the Blocks created from a Frame. Zero values
+// mean no limit.
+type BlockLimits struct {
+	MaxTxs   int // maximum number of transactions per Block
+	MaxBytes int // maximum total size of the transactions of a Block
+}
+
+// split divides txs in consecutive chunks which respect the limits. A
+// transaction larger than MaxBytes gets a chunk of its own. There is always at
+// least one chunk.
+func (l BlockLimits) split(txs [][]byte) [][2]int {
+	chunks := [][2]int{}
+	start, size := 0, 0
+	for i, tx := range txs {
+		full := (l.MaxTxs > 0 && i-start >= l.MaxTxs) ||
+			(l.MaxBytes > 0 && i > start && size+len(tx) > l.MaxBytes)
+		if full {
+			chunks = append(chunks, [2]int{start, i})
+			start, size = i, 0
+		}
+		size += len(tx)
+	}
+	return append(chunks, [2]int{start, len(txs)})
+}
+
+// NewBlockFromFrame creates a single Block with all the transactions of a
+// Frame
 func NewBlockFromFrame(blockIndex int, frame *Frame) (*Block, error) {
+	blocks, err := NewBlocksFromFrame(blockIndex, frame, BlockLimits{})
+	if err != nil {
+		return nil, err
+	}
+	return blocks[0], nil
+}
+
+// NewBlocksFromFrame creates the Blocks of a Frame, with consecutive indexes
+// starting at firstIndex. The transactions of the Frame are split in order
+// across as many Blocks as needed to respect the limits. All the Blocks have
+// the Frame's round as RoundReceived. The result is a deterministic function
+// of the Frame and limits.
+//
+// The InternalTransactions go to the first Block, so that they are committed
+// before the transactions of the later ones, however large. They keep the
+// consensus order of their Events, then their order within each Event, and
+// the repeats of a body already included, submitted by several peers, are
+// dropped.
+func NewBlocksFromFrame(firstIndex int, frame *Frame, limits BlockLimits) ([]*Block, error) {
 	frameHash, err := frame.Hash()
 	if err != nil {
 		return nil, err
 	}
 
+	peerSetRoot, err := frame.BlockPeerSetRoot()
+	if err != nil {
+		return nil, err
+	}
+
 	transactions := [][]byte{}
 	internalTransactions := []InternalTransaction{}
+	payloadTypes := []PayloadType{}
 	for _, e := range frame.Events {
 		transactions = append(transactions, e.Core.Transactions()...)
 		internalTransactions = append(internalTransactions, e.Core.InternalTransactions()...)
+		payloadTypes = append(payloadTypes, e.Core.PayloadTypes()...)
 	}
+	internalTransactions = uniqueInternalTransactions(internalTransactions)
 
-	return NewBlock(blockIndex, frame.Round, frameHash, frame.Peers, transactions, internalTransactions), nil
+	chunks := limits.split(transactions)
+	blocks := make([]*Block, len(chunks))
+
+	for i, c := range chunks {
+		itxs := []InternalTransaction{}
+		if i == 0 {
+			itxs = internalTransactions
+		}
+
+		txs := append([][]byte{}, transactions[c[0]:c[1]]...)
+
+		block := NewBlock(firstIndex+i, frame.Round, frameHash, frame.Peers, txs, itxs)
+		if block == nil {
+			return nil, fmt.Errorf("could not create block %d from frame %d", firstIndex+i, frame.Round)
+		}
+		block.Body.PayloadTypes = compactPayloadTypes(payloadTypes[c[0]:c[1]])
+		block.Body.PeerSetRoot = peerSetRoot
+
+		blocks[i] = block
+	}
+
+	return blocks, nil
+}
+
+// uniqueInternalTransactions drops the InternalTransactions whose body repeats
+// the one of a previous transaction
+func uniqueInternalTransactions(itxs []InternalTransaction) []InternalTransaction {
+	seen := make(map[string]bool, len(itxs))
+	res := []InternalTransaction{}
+	for _, itx := range itxs {
+		key := itx.HashString()
+		if seen[key] {
+			continue
+		}
+		seen[key] = true
+		res = append(res, itx)
+	}
+	return res
 }
 
 // NewBlock ...
@@ -178,6 +282,20 @@ func (b *Block) Transactions() [][]byte {
 	return b.Body.Transactions
 }
 
+// PayloadTypes returns the type of each transaction
+func (b *Block) PayloadTypes() []PayloadType {
+	res := make([]PayloadType, len(b.Body.Transactions))
+	for i := range res {
+		res[i] = payloadTypeAt(b.Body.PayloadTypes, i)
+	}
+	return res
+}
+
+// TransactionsOfType returns the transactions of type t, in Block order
+func (b *Block) TransactionsOfType(t PayloadType) [][]byte {
+	return FilterTransactions(b.Body.Transactions, b.Body.PayloadTypes, t)
+}
+
 // InternalTransactions ...
 func (b *Block) InternalTransactions() []InternalTransaction {
 	return b.Body.InternalTransactions
@@ -208,6 +326,27 @@ func (b *Block) PeersHash() []byte {
 	return b.Body.PeersHash
 }
 
+// PeerSetRoot ...
+func (b *Block) PeerSetRoot() []byte {
+	return b.Body.PeerSetRoot
+}
+
+// SetStateHash sets the StateHash computed by the application, and clears
+// the cached hash of the Block
+func (b *Block) SetStateHash(stateHash []byte) {
+	b.Body.StateHash = stateHash
+	b.hash = nil
+	b.hex = ""
+}
+
+// TxRoot returns the Merkle root of the Block's transactions
+func (b *Block) TxRoot() []byte {
+	if len(b.txRoot) == 0 {
+		b.txRoot = MerkleRoot(b.Body.Transactions)
+	}
+	return b.txRoot
+}
+
 // GetSignatures ...
 func (b *Block) GetSignatures() []BlockSignature {
 	res := make([]BlockSignature, len(b.Signatures))
@@ -242,6 +381,12 @@ func (b *Block) GetSignature(validator string) (res BlockSignature, err error) {
 // AppendTransactions ...
 func (b *Block) AppendTransactions(txs [][]byte) {
 	b.Body.Transactions = append(b.Body.Transactions, txs...)
+	if len(b.Body.PayloadTypes) > 0 {
+		//appended transactions are untagged
+		for range txs {
+			b.Body.PayloadTypes = append(b.Body.PayloadTypes, PayloadApp)
+		}
+	}
 	b.clear()
 }
 
@@ -289,18 +434,23 @@ func (b *Block) Hex() string {
 
 // Sign ...
 func (b *Block) Sign(privKey *ecdsa.PrivateKey) (bs BlockSignature, err error) {
+	return b.SignWith(signer.NewLocal(privKey))
+}
+
+// SignWith returns the BlockSignature of s over the body of the Block
+func (b *Block) SignWith(s signer.Signer) (bs BlockSignature, err error) {
 	signBytes, err := b.Body.Hash()
 	if err != nil {
 		return bs, err
 	}
 
-	sig, err := crypto.Sign(signBytes, privKey)
+	sig, err := s.Sign(signBytes)
 	if err != nil {
 		return bs, err
 	}
 
 	signature := BlockSignature{
-		Validator: crypto.FromECDSAPub(&privKey.PublicKey),
+		Validator: signer.PublicKeyBytes(s),
 		Index:     b.Index(),
 		Signature: hexutil.Encode(sig),
 	}
@@ -332,6 +482,7 @@ func (b *Block) Verify(sig BlockSignature) (bool, error) {
 func (b *Block) clear() {
 	b.hash = nil
 	b.hex = ""
+	b.txRoot = nil
 }
 
 type SyncType int
@@ -0,0 +1,218 @@
+package types
+
+import (
+	"bytes"
+	"fmt"
+	"runtime"
+	"sync"
+	"sync/atomic"
+
+	"github.com/bolaxy/config"
+	"github.com/bolaxy/crypto"
+	"github.com/ugorji/go/codec"
+)
+
+// BlockPipeline creates the Blocks of Frames like NewBlocksFromFrame, with the
+// hashing spread over a pool of workers: the FrameEvents are hashed and
+// encoded for the Frame hash, the transactions are hashed as Merkle leaves,
+// and the Blocks get their TxRoot and hash, concurrently. The results are
+// assembled in order, so the Blocks are the same as the serial ones.
+type BlockPipeline struct {
+	workers int
+}
+
+// NewBlockPipeline returns a BlockPipeline of workers goroutines, or of
+// GOMAXPROCS if workers is not positive
+func NewBlockPipeline(workers int) *BlockPipeline {
+	if workers <= 0 {
+		workers = runtime.GOMAXPROCS(0)
+	}
+	return &BlockPipeline{workers: workers}
+}
+
+// Workers ...
+func (p *BlockPipeline) Workers() int {
+	return p.workers
+}
+
+// run calls f for every index in [0, n), on at most p.workers goroutines, and
+// returns the error of the lowest index which failed
+func (p *BlockPipeline) run(n int, f func(i int) error) error {
+	if n == 0 {
+		return nil
+	}
+
+	workers := p.workers
+	if workers > n {
+		workers = n
+	}
+	if workers == 1 {
+		for i := 0; i < n; i++ {
+			if err := f(i); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	errs := make([]error, n)
+	next := int64(-1)
+
+	var wg sync.WaitGroup
+	wg.Add(workers)
+	for w := 0; w < workers; w++ {
+		go func() {
+			defer wg.Done()
+			for {
+				i := int(atomic.AddInt64(&next, 1))
+				if i >= n {
+					return
+				}
+				errs[i] = f(i)
+			}
+		}()
+	}
+	wg.Wait()
+
+	for _, err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// NewBlocksFromFrame returns the same Blocks as the function of the same name,
+// with their TxRoot and hash computed
+func (p *BlockPipeline) NewBlocksFromFrame(firstIndex int, frame *Frame, limits BlockLimits) ([]*Block, error) {
+	//The Frame is encoded with its Events as they are before they are
+	//hashed, like Frame.Hash would.
+	var encoded []codec.Raw
+	if frame.Events != nil {
+		encoded = make([]codec.Raw, len(frame.Events))
+	}
+	err := p.run(len(frame.Events), func(i int) error {
+		data, err := encodeFrameValue(frame.Events[i])
+		if err != nil {
+			return err
+		}
+		encoded[i] = data
+		_, err = frame.Events[i].Core.GetHash()
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	frameHash, err := hashFrame(frame, encoded)
+	if err != nil {
+		return nil, err
+	}
+
+	peerSetRoot, err := frame.BlockPeerSetRoot()
+	if err != nil {
+		return nil, err
+	}
+
+	transactions := [][]byte{}
+	internalTransactions := []InternalTransaction{}
+	payloadTypes := []PayloadType{}
+	for _, e := range frame.Events {
+		transactions = append(transactions, e.Core.Transactions()...)
+		internalTransactions = append(internalTransactions, e.Core.InternalTransactions()...)
+		payloadTypes = append(payloadTypes, e.Core.PayloadTypes()...)
+	}
+	internalTransactions = uniqueInternalTransactions(internalTransactions)
+
+	leaves := make([][]byte, len(transactions))
+	p.run(len(transactions), func(i int) error {
+		leaves[i] = MerkleLeaf(transactions[i])
+		return nil
+	})
+
+	chunks := limits.split(transactions)
+	blocks := make([]*Block, len(chunks))
+
+	for i, c := range chunks {
+		itxs := []InternalTransaction{}
+		if i == 0 {
+			itxs = internalTransactions
+		}
+
+		txs := append([][]byte{}, transactions[c[0]:c[1]]...)
+
+		block := NewBlock(firstIndex+i, frame.Round, frameHash, frame.Peers, txs, itxs)
+		if block == nil {
+			return nil, fmt.Errorf("could not create block %d from frame %d", firstIndex+i, frame.Round)
+		}
+		block.Body.PayloadTypes = compactPayloadTypes(payloadTypes[c[0]:c[1]])
+		block.Body.PeerSetRoot = peerSetRoot
+
+		blocks[i] = block
+	}
+
+	err = p.run(len(blocks), func(i int) error {
+		b, c := blocks[i], chunks[i]
+		if c[0] < c[1] {
+			b.txRoot = merkleRootFromLeaves(leaves[c[0]:c[1]])
+		} else {
+			b.txRoot = MerkleRoot(nil)
+		}
+		_, err := b.Hash()
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return blocks, nil
+}
+
+// frameEncoding mirrors Frame, with Events already encoded. The fields must
+// stay in the same order with the same names.
+type frameEncoding struct {
+	Round    int
+	Peers    []*conf.Peer
+	Roots    map[string]*Root
+	Events   []codec.Raw
+	PeerSets map[int][]*conf.Peer
+	Params   map[int]*ConsensusParams `json:",omitempty"`
+}
+
+// hashFrame returns the hash of frame, whose Events are encoded
+func hashFrame(frame *Frame, events []codec.Raw) ([]byte, error) {
+	data, err := encodeFrameValue(&frameEncoding{
+		Round:    frame.Round,
+		Peers:    frame.Peers,
+		Roots:    frame.Roots,
+		Events:   events,
+		PeerSets: frame.PeerSets,
+		Params:   frame.Params,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return crypto.Keccak256(data), nil
+}
+
+// frameHandle encodes like the handle of Frame.Marshal, and writes Raw values
+// as they are. It is shared, so that the type information it caches is
+// reused, which is safe once it is configured.
+var frameHandle = &codec.JsonHandle{}
+
+func init() {
+	frameHandle.Canonical = true
+	frameHandle.Raw = true
+}
+
+// encodeFrameValue encodes v with frameHandle
+func encodeFrameValue(v interface{}) ([]byte, error) {
+	b := new(bytes.Buffer)
+	enc := codec.NewEncoder(b, frameHandle)
+
+	if err := enc.Encode(v); err != nil {
+		return nil, err
+	}
+
+	return b.Bytes(), nil
+}
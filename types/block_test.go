@@ -0,0 +1,201 @@
+package types
+
+import (
+	"bytes"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/bolaxy/common"
+	"github.com/bolaxy/common/hexutil"
+	"github.com/bolaxy/config"
+	"github.com/bolaxy/crypto"
+)
+
+func txsOfSizes(sizes ...int) [][]byte {
+	txs := make([][]byte, len(sizes))
+	for i, s := range sizes {
+		txs[i] = bytes.Repeat([]byte{byte(i)}, s)
+	}
+	return txs
+}
+
+func TestBlockLimitsSplit(t *testing.T) {
+	cases := []struct {
+		name   string
+		limits BlockLimits
+		sizes  []int
+		chunks [][2]int
+	}{
+		{"no transactions", BlockLimits{MaxTxs: 2, MaxBytes: 10}, nil, [][2]int{{0, 0}}},
+		{"no limits", BlockLimits{}, []int{100, 100, 100}, [][2]int{{0, 3}}},
+		{"exactly MaxTxs", BlockLimits{MaxTxs: 3}, []int{1, 1, 1}, [][2]int{{0, 3}}},
+		{"one over MaxTxs", BlockLimits{MaxTxs: 3}, []int{1, 1, 1, 1}, [][2]int{{0, 3}, {3, 4}}},
+		{"exactly MaxBytes", BlockLimits{MaxBytes: 10}, []int{4, 6}, [][2]int{{0, 2}}},
+		{"one byte over MaxBytes", BlockLimits{MaxBytes: 10}, []int{4, 7}, [][2]int{{0, 1}, {1, 2}}},
+		{"transaction of MaxBytes", BlockLimits{MaxBytes: 10}, []int{10, 10}, [][2]int{{0, 1}, {1, 2}}},
+		{"transaction larger than MaxBytes", BlockLimits{MaxBytes: 10}, []int{3, 25, 3}, [][2]int{{0, 1}, {1, 2}, {2, 3}}},
+		{"first transaction larger than MaxBytes", BlockLimits{MaxBytes: 10}, []int{25}, [][2]int{{0, 1}}},
+		{"both limits", BlockLimits{MaxTxs: 2, MaxBytes: 10}, []int{1, 1, 1, 9, 1}, [][2]int{{0, 2}, {2, 4}, {4, 5}}},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			got := c.limits.split(txsOfSizes(c.sizes...))
+			if !reflect.DeepEqual(got, c.chunks) {
+				t.Fatalf("split(%v) with %+v: got %v, want %v", c.sizes, c.limits, got, c.chunks)
+			}
+		})
+	}
+}
+
+func testPeer(t *testing.T) (*conf.Peer, []byte) {
+	key, err := crypto.GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	pub := crypto.CompressPubkey(&key.PublicKey)
+	return conf.NewPeer(strings.ToUpper(hexutil.Encode(pub)), "peer", "peer", "0", "1"), pub
+}
+
+// testFrame returns a Frame of round with an Event per entry of txs, the
+// first of which carries itxs
+func testFrame(t *testing.T, round int, itxs []InternalTransaction, txs ...[][]byte) *Frame {
+	peer, pub := testPeer(t)
+
+	frame := &Frame{
+		Round: round,
+		Peers: []*conf.Peer{peer},
+		Roots: map[string]*Root{},
+	}
+	for i, etxs := range txs {
+		var its []InternalTransaction
+		if i == 0 {
+			its = itxs
+		}
+		ev := NewEvent(etxs, its, nil, []string{"", ""}, pub, i)
+		frame.Events = append(frame.Events, &FrameEvent{Core: ev, Round: round, LamportTimestamp: i})
+	}
+	return frame
+}
+
+func TestNewBlocksFromFrame(t *testing.T) {
+	peer, _ := testPeer(t)
+	itxs := []InternalTransaction{
+		NewInternalTransaction(PEERADD, *peer, common.Address{}),
+	}
+
+	cases := []struct {
+		name   string
+		limits BlockLimits
+		itxs   []InternalTransaction
+		txs    [][][]byte
+		counts []int // transactions per Block
+	}{
+		{"empty frame", BlockLimits{MaxTxs: 2}, nil, nil, []int{0}},
+		{"internal transactions only", BlockLimits{MaxTxs: 2}, itxs, [][][]byte{nil}, []int{0}},
+		{"single block", BlockLimits{MaxTxs: 4}, itxs, [][][]byte{txsOfSizes(1, 1), txsOfSizes(1, 1)}, []int{4}},
+		{"split across events", BlockLimits{MaxTxs: 3}, itxs, [][][]byte{txsOfSizes(1, 1), txsOfSizes(1, 1)}, []int{3, 1}},
+		{"transaction larger than MaxBytes", BlockLimits{MaxBytes: 8}, itxs, [][][]byte{txsOfSizes(4, 20, 4)}, []int{1, 1, 1}},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			frame := testFrame(t, 7, c.itxs, c.txs...)
+
+			blocks, err := NewBlocksFromFrame(3, frame, c.limits)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(blocks) != len(c.counts) {
+				t.Fatalf("%d blocks, want %d", len(blocks), len(c.counts))
+			}
+
+			all := [][]byte{}
+			for _, ev := range frame.Events {
+				all = append(all, ev.Core.Transactions()...)
+			}
+
+			got := [][]byte{}
+			for i, b := range blocks {
+				if b.Index() != 3+i {
+					t.Errorf("block %d has index %d", i, b.Index())
+				}
+				if b.RoundReceived() != frame.Round {
+					t.Errorf("block %d has RoundReceived %d, want %d", i, b.RoundReceived(), frame.Round)
+				}
+				if len(b.Transactions()) != c.counts[i] {
+					t.Errorf("block %d has %d transactions, want %d", i, len(b.Transactions()), c.counts[i])
+				}
+
+				wantItxs := 0
+				if i == 0 {
+					wantItxs = len(c.itxs)
+				}
+				if len(b.InternalTransactions()) != wantItxs {
+					t.Errorf("block %d has %d internal transactions, want %d", i, len(b.InternalTransactions()), wantItxs)
+				}
+
+				got = append(got, b.Transactions()...)
+			}
+
+			if !reflect.DeepEqual(got, all) {
+				t.Errorf("blocks do not hold the transactions of the frame in order")
+			}
+		})
+	}
+}
+
+func TestBlockPeerSetRoot(t *testing.T) {
+	frame := testFrame(t, 7, nil, txsOfSizes(1, 1))
+	peer, _ := testPeer(t)
+	frame.PeerSets = map[int][]*conf.Peer{0: {peer}}
+
+	root, err := frame.PeerSetRoot()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	activation := &ConsensusParams{ProtocolVersion: ProtocolPeerSetRoot}
+	cases := []struct {
+		name   string
+		params map[int]*ConsensusParams
+		root   []byte
+	}{
+		{"initial protocol", nil, nil},
+		{"earlier protocol", map[int]*ConsensusParams{0: {ProtocolVersion: ProtocolWhitened}}, nil},
+		{"activated later", map[int]*ConsensusParams{8: activation}, nil},
+		{"activated at the round", map[int]*ConsensusParams{7: activation}, root},
+		{"activated before", map[int]*ConsensusParams{3: activation}, root},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			frame.Params = c.params
+
+			blocks, err := NewBlocksFromFrame(0, frame, BlockLimits{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			pipelined, err := NewBlockPipeline(2).NewBlocksFromFrame(0, frame, BlockLimits{})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			for _, b := range []*Block{blocks[0], pipelined[0]} {
+				if !bytes.Equal(b.Body.PeerSetRoot, c.root) {
+					t.Fatalf("PeerSetRoot %x, want %x", b.Body.PeerSetRoot, c.root)
+				}
+			}
+
+			//without a PeerSetRoot, the body encodes as before the field
+			body, err := blocks[0].Body.Marshal()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := bytes.Contains(body, []byte("PeerSetRoot")); got != (c.root != nil) {
+				t.Fatalf("PeerSetRoot encoded: %v", got)
+			}
+		})
+	}
+}
@@ -8,6 +8,7 @@ import (
 
 	"github.com/bolaxy/common"
 	"github.com/bolaxy/config"
+	"github.com/bolaxy/core/logger"
 	"github.com/bolaxy/errors"
 )
 
@@ -35,6 +36,7 @@ func (k TreKey) ToString() string {
 type ParticipantEventsCache struct {
 	Participants *conf.PeerSet
 	rim          *common.RollingIndexMap
+	logger       logger.Logger
 }
 
 // NewParticipantEventsCache ...
@@ -42,12 +44,21 @@ func NewParticipantEventsCache(size int) *ParticipantEventsCache {
 	return &ParticipantEventsCache{
 		Participants: conf.NewPeerSet([]*conf.Peer{}),
 		rim:          common.NewRollingIndexMap("ParticipantEvents", size),
+		logger:       logger.Nop,
 	}
 }
 
+// SetLogger ...
+func (pec *ParticipantEventsCache) SetLogger(l logger.Logger) {
+	pec.logger = logger.OrNop(l)
+}
+
 // AddPeer ...
 func (pec *ParticipantEventsCache) AddPeer(peer *conf.Peer) error {
 	pec.Participants = pec.Participants.WithNewPeer(peer)
+	pec.logger.Debug("participant added",
+		logger.CreatorID, peer.ID(),
+		logger.Creator, peer.PubKeyString())
 	return pec.rim.AddKey(peer.ID())
 }
 
@@ -61,12 +72,28 @@ func (pec *ParticipantEventsCache) participantID(participant string) (uint32, er
 	return peer.ID(), nil
 }
 
+// checkID fails with UnknownParticipant if id is not the ID of a participant
+func (pec *ParticipantEventsCache) checkID(id uint32) error {
+	if _, ok := pec.Participants.ByID[id]; !ok {
+		return errors.NewStoreErr("ParticipantEvents", errors.UnknownParticipant, strconv.FormatUint(uint64(id), 10))
+	}
+	return nil
+}
+
 //Get returns participant events with index > skip
 func (pec *ParticipantEventsCache) Get(participant string, skipIndex int) ([]string, error) {
 	id, err := pec.participantID(participant)
 	if err != nil {
 		return []string{}, err
 	}
+	return pec.GetByID(id, skipIndex)
+}
+
+// GetByID is Get for the participant of an ID
+func (pec *ParticipantEventsCache) GetByID(id uint32, skipIndex int) ([]string, error) {
+	if err := pec.checkID(id); err != nil {
+		return []string{}, err
+	}
 
 	pe, err := pec.rim.Get(id, skipIndex)
 	if err != nil {
@@ -86,6 +113,14 @@ func (pec *ParticipantEventsCache) GetItem(participant string, index int) (strin
 	if err != nil {
 		return "", err
 	}
+	return pec.GetItemByID(id, index)
+}
+
+// GetItemByID is GetItem for the participant of an ID
+func (pec *ParticipantEventsCache) GetItemByID(id uint32, index int) (string, error) {
+	if err := pec.checkID(id); err != nil {
+		return "", err
+	}
 
 	item, err := pec.rim.GetItem(id, index)
 	if err != nil {
@@ -100,6 +135,14 @@ func (pec *ParticipantEventsCache) GetLast(participant string) (string, error) {
 	if err != nil {
 		return "", err
 	}
+	return pec.GetLastByID(id)
+}
+
+// GetLastByID is GetLast for the participant of an ID
+func (pec *ParticipantEventsCache) GetLastByID(id uint32) (string, error) {
+	if err := pec.checkID(id); err != nil {
+		return "", err
+	}
 
 	last, err := pec.rim.GetLast(id)
 	if err != nil {
@@ -115,6 +158,14 @@ func (pec *ParticipantEventsCache) Set(participant string, hash string, index in
 	if err != nil {
 		return err
 	}
+	return pec.SetByID(id, hash, index)
+}
+
+// SetByID is Set for the participant of an ID
+func (pec *ParticipantEventsCache) SetByID(id uint32, hash string, index int) error {
+	if err := pec.checkID(id); err != nil {
+		return err
+	}
 
 	return pec.rim.Set(id, hash, index)
 }
@@ -131,6 +182,7 @@ type PeerSetCache struct {
 	repertoireByPubKey map[string]*conf.Peer
 	repertoireByID     map[uint32]*conf.Peer
 	firstRounds        map[uint32]int
+	logger             logger.Logger
 }
 
 // NewPeerSetCache ...
@@ -141,9 +193,15 @@ func NewPeerSetCache() *PeerSetCache {
 		repertoireByPubKey: make(map[string]*conf.Peer),
 		repertoireByID:     make(map[uint32]*conf.Peer),
 		firstRounds:        make(map[uint32]int),
+		logger:             logger.Nop,
 	}
 }
 
+// SetLogger ...
+func (c *PeerSetCache) SetLogger(l logger.Logger) {
+	c.logger = logger.OrNop(l)
+}
+
 // Set ...
 func (c *PeerSetCache) Set(round int, peerSet *conf.PeerSet) error {
 	if _, ok := c.peerSets[round]; ok {
@@ -155,6 +213,10 @@ func (c *PeerSetCache) Set(round int, peerSet *conf.PeerSet) error {
 	c.rounds = append(c.rounds, round)
 	c.rounds.Sort()
 
+	c.logger.Info("peer-set set",
+		logger.Round, round,
+		"peers", len(peerSet.Peers))
+
 	for _, p := range peerSet.Peers {
 		c.repertoireByPubKey[p.PubKeyString()] = p
 		c.repertoireByID[p.ID()] = p
@@ -0,0 +1,110 @@
+package types
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/bolaxy/core/erasure"
+	"github.com/bolaxy/crypto"
+)
+
+// ErrCodedPayload is returned for a WireEvent whose transactions were not
+// reassembled from their shards
+var ErrCodedPayload = errors.New("event payload not reassembled")
+
+// CodedPayload describes the transactions of an Event which travel as
+// erasure-coded shards instead of in its WireEvent. Any DataShards of the
+// shards reassemble them.
+type CodedPayload struct {
+	Hash         []byte // Keccak256 of the encoded transactions
+	Size         int    // size of the encoded transactions
+	DataShards   int
+	ParityShards int
+	Shards       [][]byte // Keccak256 of each shard
+}
+
+// NewCodedPayload encodes txs with code, and returns their CodedPayload with
+// the shards
+func NewCodedPayload(txs [][]byte, code *erasure.Code) (*CodedPayload, [][]byte, error) {
+	data, err := json.Marshal(txs)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	shards := code.Encode(data)
+	hashes := make([][]byte, len(shards))
+	for i, s := range shards {
+		hashes[i] = crypto.Keccak256(s)
+	}
+
+	return &CodedPayload{
+		Hash:         crypto.Keccak256(data),
+		Size:         len(data),
+		DataShards:   code.DataShards,
+		ParityShards: code.ParityShards,
+		Shards:       hashes,
+	}, shards, nil
+}
+
+// Key identifies the payload among the ones in transit
+func (c *CodedPayload) Key() string {
+	return string(c.Hash)
+}
+
+// Code returns the erasure Code of the payload
+func (c *CodedPayload) Code() (*erasure.Code, error) {
+	code, err := erasure.New(c.DataShards, c.ParityShards)
+	if err != nil {
+		return nil, err
+	}
+	if len(c.Shards) != code.Shards() {
+		return nil, fmt.Errorf("coded payload lists %d shards instead of %d", len(c.Shards), code.Shards())
+	}
+	return code, nil
+}
+
+// CheckShard returns true if shard is the shard of the given index
+func (c *CodedPayload) CheckShard(index int, shard []byte) bool {
+	return index >= 0 && index < len(c.Shards) && bytes.Equal(crypto.Keccak256(shard), c.Shards[index])
+}
+
+// Reassemble decodes the transactions from shards, which has one entry per
+// shard, nil for the missing ones, and checked with CheckShard
+func (c *CodedPayload) Reassemble(shards [][]byte) ([][]byte, error) {
+	code, err := c.Code()
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := code.Reconstruct(shards, c.Size)
+	if err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(crypto.Keccak256(data), c.Hash) {
+		return nil, fmt.Errorf("reassembled payload does not match its hash")
+	}
+
+	var txs [][]byte
+	if err := json.Unmarshal(data, &txs); err != nil {
+		return nil, err
+	}
+	return txs, nil
+}
+
+// Coded returns a copy of the WireEvent whose transactions are replaced by
+// their CodedPayload
+func (we WireEvent) Coded(c *CodedPayload) WireEvent {
+	we.Body.Transactions = nil
+	we.Body.Coded = c
+	return we
+}
+
+// Reassembled returns a copy of the WireEvent with its transactions, once
+// reassembled from the shards of its CodedPayload
+func (we WireEvent) Reassembled(txs [][]byte) WireEvent {
+	we.Body.Transactions = txs
+	we.Body.Coded = nil
+	return we
+}
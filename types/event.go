@@ -2,13 +2,14 @@ package types
 
 import (
 	"bytes"
+	"context"
 	"crypto/ecdsa"
 	"encoding/json"
 	"fmt"
-	"math/big"
-	"strings"
 
 	"github.com/bolaxy/common/hexutil"
+	"github.com/bolaxy/core/profiling"
+	"github.com/bolaxy/core/signer"
 	"github.com/bolaxy/crypto"
 )
 
@@ -20,6 +21,7 @@ type EventBody struct {
 	Creator              []byte                //creator's public key
 	Index                int                   //index in the sequence of events created by Creator
 	BlockSignatures      []BlockSignature      //list of Block signatures signed by the Event's Creator ONLY
+	PayloadTypes         []PayloadType         `json:",omitempty"` //empty, or the type of each transaction
 
 	//These fields are not serialized
 	CreatorID            uint32
@@ -48,6 +50,7 @@ func (e *EventBody) MarshalSign() ([]byte, error) {
 		Creator :e.Creator,
 		Index :e.Index,
 		BlockSignatures :e.BlockSignatures,
+		PayloadTypes:e.PayloadTypes,
 	}
 	if err := enc.Encode(f); err != nil {
 		return nil, err
@@ -65,21 +68,16 @@ func (e *EventBody) Unmarshal(data []byte) error {
 	return nil
 }
 
-// Hash ...
+// Hash returns the Keccak256 hash of the encoding of Marshal, which it
+// computes without allocating it
 func (e *EventBody) Hash() ([]byte, error) {
-	hashBytes, err := e.Marshal()
-	if err != nil {
-		return nil, err
-	}
-	return crypto.Keccak256(hashBytes), nil
+	return hashBody(e, true)
 }
 
+// HashSign returns the Keccak256 hash of the encoding of MarshalSign, which
+// is signed by the creator
 func (e *EventBody) HashSign() ([]byte, error) {
-	hashBytes, err := e.MarshalSign()
-	if err != nil {
-		return nil, err
-	}
-	return crypto.Keccak256(hashBytes), nil
+	return hashBody(e, false)
 }
 
 // EventCoordinates ...
@@ -112,8 +110,9 @@ type Event struct {
 
 	TopologicalIndex int
 
-	//used for sorting
-	round            *int
+	//used for sorting. The round is kept in the Store, so that it is known
+	//once the Event is evicted from the cache, but not in the hash of Frames.
+	Round            *int `json:",omitempty" codec:"-"`
 	LamportTimestamp *int
 
 	RoundReceived *int
@@ -151,12 +150,17 @@ func NewEvent(transactions [][]byte,
 // Creator ...
 func (e *Event) GetCreator() string {
 	if e.Creator == "" {
-		pubKey, _ := crypto.UnmarshalPubkey(e.Body.Creator)
-		e.Creator = strings.ToUpper(hexutil.Encode(crypto.CompressPubkey(pubKey)))
+		e.Creator = PubKeys.Intern(e.Body.Creator).Hex
 	}
 	return e.Creator
 }
 
+// GetCreatorID returns the ID of the Peer of the creator, which is cheaper to
+// compare than its public key
+func (e *Event) GetCreatorID() uint32 {
+	return PubKeys.Intern(e.Body.Creator).ID
+}
+
 // SelfParent ...
 func (e *Event)  SelfParent() string {
 	return e.Body.Parents[0]
@@ -172,6 +176,30 @@ func (e *Event) Transactions() [][]byte {
 	return e.Body.Transactions
 }
 
+// PayloadTypes returns the type of each transaction
+func (e *Event) PayloadTypes() []PayloadType {
+	res := make([]PayloadType, len(e.Body.Transactions))
+	for i := range res {
+		res[i] = payloadTypeAt(e.Body.PayloadTypes, i)
+	}
+	return res
+}
+
+// SetPayloadTypes tags the transactions of the Event. It must be called before
+// the Event is signed.
+func (e *Event) SetPayloadTypes(types []PayloadType) error {
+	if err := checkPayloadTypes(e.Body.Transactions, types); err != nil {
+		return err
+	}
+	e.Body.PayloadTypes = compactPayloadTypes(types)
+	return nil
+}
+
+// TransactionsOfType ...
+func (e *Event) TransactionsOfType(t PayloadType) [][]byte {
+	return FilterTransactions(e.Body.Transactions, e.Body.PayloadTypes, t)
+}
+
 // InternalTransactions ...
 func (e *Event) InternalTransactions() []InternalTransaction {
 	return e.Body.InternalTransactions
@@ -201,31 +229,42 @@ func (e *Event) IsLoaded() bool {
 
 //Sign signs with an ecdsa sig
 func (e *Event) Sign(privKey *ecdsa.PrivateKey) error {
+	return e.SignWith(signer.NewLocal(privKey))
+}
+
+// SignWith signs the Event with s, whose key must be the Creator's
+func (e *Event) SignWith(s signer.Signer) error {
 	signBytes, err := e.Body.HashSign()
 	if err != nil {
 		return err
 	}
 
-	sig, err := crypto.Sign(signBytes, privKey)
+	sig, err := s.Sign(signBytes)
 	if err != nil {
 		return err
 	}
 
 	e.Signature = hexutil.Encode(sig)
 
-	sig, err = hexutil.Decode(e.Signature)
-	if err != nil {
-		return err
-	}
-
-	return err
+	return nil
 }
 
 // Verify ...
-func (e *Event) Verify() (bool, error) {
+func (e *Event) Verify() (ok bool, err error) {
+	profiling.Do(context.Background(), profiling.SignatureVerification, func(context.Context) {
+		ok, err = e.verify()
+	})
+	return ok, err
+}
+
+func (e *Event) verify() (bool, error) {
 
 	//first check signatures on internal transactions
 	for _, itx := range e.Body.InternalTransactions {
+		if !itx.Body.Type.SignedByPeer() {
+			continue
+		}
+
 		ok, err := itx.Verify()
 
 		if err != nil {
@@ -274,7 +313,11 @@ func (e *Event) Unmarshal(data []byte) error {
 //Hash returns sha256 hash of body
 func (e *Event) GetHash() ([]byte, error) {
 	if len(e.Hash) == 0 {
-		hash, err := e.Body.Hash()
+		var hash []byte
+		var err error
+		profiling.Do(context.Background(), profiling.EventHash, func(context.Context) {
+			hash, err = e.Body.Hash()
+		})
 		if err != nil {
 			return nil, err
 		}
@@ -297,16 +340,16 @@ func (e *Event) GetHex() string {
 
 // SetRound ...
 func (e *Event) SetRound(r int) {
-	if e.round == nil {
-		e.round = new(int)
+	if e.Round == nil {
+		e.Round = new(int)
 	}
 
-	*e.round = r
+	*e.Round = r
 }
 
 // GetRound ...
 func (e *Event) GetRound() *int {
-	return e.round
+	return e.Round
 }
 
 // SetLamportTimestamp ...
@@ -359,6 +402,7 @@ func (e *Event) ToWire() WireEvent {
 		Body: WireBody{
 			Transactions:         e.Body.Transactions,
 			InternalTransactions: e.Body.InternalTransactions,
+			PayloadTypes:         e.Body.PayloadTypes,
 			SelfParentIndex:      e.Body.SelfParentIndex,
 			OtherParentCreatorID: e.Body.OtherParentCreatorID,
 			OtherParentIndex:     e.Body.OtherParentIndex,
@@ -393,6 +437,7 @@ func (a ByTopologicalOrder) Less(i, j int) bool {
 // ByLamportTimestamp implements sort.Interface for []Event based on
 // the lamportTimestamp field.
 // THIS IS A TOTAL ORDER
+// Sorting its SortCache is faster.
 type ByLamportTimestamp []*Event
 
 // Len ...
@@ -414,9 +459,7 @@ func (a ByLamportTimestamp) Less(i, j int) bool {
 		return it < jt
 	}
 
-	wsi, _ := hexutil.Decode(a[i].Signature)
-	wsj, _ := hexutil.Decode(a[j].Signature)
-	return new(big.Int).SetBytes(wsi).Cmp(new(big.Int).SetBytes(wsj)) < 0
+	return lessSignature(a[i].Signature, a[j].Signature)
 }
 
 // WireBody ...
@@ -424,6 +467,11 @@ type WireBody struct {
 	Transactions         [][]byte
 	InternalTransactions []InternalTransaction
 	BlockSignatures      []WireBlockSignature
+	PayloadTypes         []PayloadType `json:",omitempty"`
+	// Coded replaces Transactions when they travel as shards
+	Coded *CodedPayload `json:",omitempty"`
+	// TxHashes replaces Transactions when the receiver pulls them
+	TxHashes [][]byte `json:",omitempty"`
 
 	CreatorID            uint32
 	OtherParentCreatorID uint32
@@ -469,6 +517,7 @@ type FrameEvent struct {
 //SortedFrameEvents implements sort.Interface for []FameEvent based on
 //the lamportTimestamp field.
 //THIS IS A TOTAL ORDER
+//Sorting its SortCache is faster.
 type SortedFrameEvents []*FrameEvent
 
 // Len ...
@@ -483,7 +532,5 @@ func (a SortedFrameEvents) Less(i, j int) bool {
 		return a[i].LamportTimestamp < a[j].LamportTimestamp
 	}
 
-	wsi, _ := hexutil.Decode(a[i].Core.Signature)
-	wsj, _ := hexutil.Decode(a[j].Core.Signature)
-	return new(big.Int).SetBytes(wsi).Cmp(new(big.Int).SetBytes(wsj)) < 0
+	return lessSignature(a[i].Core.Signature, a[j].Core.Signature)
 }
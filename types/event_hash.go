@@ -0,0 +1,248 @@
+package types
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"hash"
+	"strconv"
+	"sync"
+
+	"golang.org/x/crypto/sha3"
+)
+
+// hashChunk is the size above which the buffer of a bodyHasher is written to
+// the Keccak state
+const hashChunk = 4096
+
+// base64Chunk is the size of the byte slices encoded at once. It is a
+// multiple of 3, so that the encodings of consecutive chunks concatenate.
+const base64Chunk = 3 * hashChunk / 4
+
+// keccakState is implemented by the Keccak hashes of sha3
+type keccakState interface {
+	hash.Hash
+	Read([]byte) (int, error)
+}
+
+var hasherPool = sync.Pool{
+	New: func() interface{} {
+		return &bodyHasher{
+			buf:   make([]byte, 0, 2*hashChunk),
+			state: sha3.NewLegacyKeccak256().(keccakState),
+		}
+	},
+}
+
+// bodyHasher hashes the encoding of an EventBody without allocating it. It
+// writes the same bytes as the json.Encoder of EventBody.Marshal, which
+// define the hash of an Event, into a reusable buffer which it streams to a
+// Keccak state. The values whose encoding is not trivial, like strings which
+// must be escaped or InternalTransactions, are rare, and encoded with
+// encoding/json.
+type bodyHasher struct {
+	buf     []byte
+	scratch []byte
+	state   keccakState
+	err     error
+}
+
+// hashBody returns the hash of the JSON encoding of an EventBody. Without
+// wire, the wire fields are encoded as zeros, like in MarshalSign.
+func hashBody(body *EventBody, wire bool) ([]byte, error) {
+	h := hasherPool.Get().(*bodyHasher)
+	defer hasherPool.Put(h)
+
+	h.buf = h.buf[:0]
+	h.state.Reset()
+	h.err = nil
+
+	h.body(body, wire)
+	if h.err != nil {
+		return nil, h.err
+	}
+
+	h.state.Write(h.buf)
+
+	//Read squeezes the state in place, where Sum would copy it
+	sum := make([]byte, 32)
+	h.state.Read(sum)
+	return sum, nil
+}
+
+// flush writes the buffer to the state once it is large enough
+func (h *bodyHasher) flush() {
+	if len(h.buf) >= hashChunk {
+		h.state.Write(h.buf)
+		h.buf = h.buf[:0]
+	}
+}
+
+func (h *bodyHasher) raw(s string) {
+	h.buf = append(h.buf, s...)
+	h.flush()
+}
+
+func (h *bodyHasher) int(v int64) {
+	h.buf = strconv.AppendInt(h.buf, v, 10)
+}
+
+func (h *bodyHasher) uint(v uint64) {
+	h.buf = strconv.AppendUint(h.buf, v, 10)
+}
+
+// bytes encodes b in base64, like encoding/json, by chunks
+func (h *bodyHasher) bytes(b []byte) {
+	if b == nil {
+		h.raw("null")
+		return
+	}
+
+	h.buf = append(h.buf, '"')
+	for len(b) > 0 {
+		n := len(b)
+		if n > base64Chunk {
+			n = base64Chunk
+		}
+
+		size := base64.StdEncoding.EncodedLen(n)
+		if cap(h.buf)-len(h.buf) < size {
+			h.state.Write(h.buf)
+			h.buf = h.buf[:0]
+		}
+
+		l := len(h.buf)
+		h.buf = h.buf[:l+size]
+		base64.StdEncoding.Encode(h.buf[l:], b[:n])
+		h.flush()
+
+		b = b[n:]
+	}
+	h.buf = append(h.buf, '"')
+}
+
+func (h *bodyHasher) string(s string) {
+	if !jsonSafe(s) {
+		h.json(s)
+		return
+	}
+
+	h.buf = append(h.buf, '"')
+	h.buf = append(h.buf, s...)
+	h.buf = append(h.buf, '"')
+	h.flush()
+}
+
+// json encodes v with encoding/json
+func (h *bodyHasher) json(v interface{}) {
+	data, err := json.Marshal(v)
+	if err != nil && h.err == nil {
+		h.err = err
+	}
+	h.buf = append(h.buf, data...)
+	h.flush()
+}
+
+// jsonSafe returns true if encoding/json writes s as is between quotes
+func jsonSafe(s string) bool {
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if c < 0x20 || c > 0x7e || c == '"' || c == '\\' || c == '<' || c == '>' || c == '&' {
+			return false
+		}
+	}
+	return true
+}
+
+func (h *bodyHasher) body(b *EventBody, wire bool) {
+	h.raw(`{"Transactions":`)
+	if b.Transactions == nil {
+		h.raw("null")
+	} else {
+		h.raw("[")
+		for i, tx := range b.Transactions {
+			if i > 0 {
+				h.raw(",")
+			}
+			h.bytes(tx)
+		}
+		h.raw("]")
+	}
+
+	h.raw(`,"InternalTransactions":`)
+	if b.InternalTransactions == nil {
+		h.raw("null")
+	} else {
+		h.json(b.InternalTransactions)
+	}
+
+	h.raw(`,"Parents":`)
+	if b.Parents == nil {
+		h.raw("null")
+	} else {
+		h.raw("[")
+		for i, p := range b.Parents {
+			if i > 0 {
+				h.raw(",")
+			}
+			h.string(p)
+		}
+		h.raw("]")
+	}
+
+	h.raw(`,"Creator":`)
+	h.bytes(b.Creator)
+
+	h.raw(`,"Index":`)
+	h.int(int64(b.Index))
+
+	h.raw(`,"BlockSignatures":`)
+	if b.BlockSignatures == nil {
+		h.raw("null")
+	} else {
+		h.raw("[")
+		for i, bs := range b.BlockSignatures {
+			if i > 0 {
+				h.raw(",")
+			}
+			h.raw(`{"Validator":`)
+			h.bytes(bs.Validator)
+			h.raw(`,"Index":`)
+			h.int(int64(bs.Index))
+			h.raw(`,"Signature":`)
+			h.string(bs.Signature)
+			h.raw("}")
+		}
+		h.raw("]")
+	}
+
+	//a slice of a uint8 type is encoded like a []byte
+	if len(b.PayloadTypes) > 0 {
+		h.scratch = h.scratch[:0]
+		for _, t := range b.PayloadTypes {
+			h.scratch = append(h.scratch, byte(t))
+		}
+		h.raw(`,"PayloadTypes":`)
+		h.bytes(h.scratch)
+	}
+
+	var creatorID, otherParentCreatorID uint32
+	var selfParentIndex, otherParentIndex int
+	if wire {
+		creatorID = b.CreatorID
+		otherParentCreatorID = b.OtherParentCreatorID
+		selfParentIndex = b.SelfParentIndex
+		otherParentIndex = b.OtherParentIndex
+	}
+
+	h.raw(`,"CreatorID":`)
+	h.uint(uint64(creatorID))
+	h.raw(`,"OtherParentCreatorID":`)
+	h.uint(uint64(otherParentCreatorID))
+	h.raw(`,"SelfParentIndex":`)
+	h.int(int64(selfParentIndex))
+	h.raw(`,"OtherParentIndex":`)
+	h.int(int64(otherParentIndex))
+
+	//json.Encoder terminates values with a newline
+	h.raw("}\n")
+}
@@ -0,0 +1,103 @@
+package types
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+
+	"github.com/bolaxy/crypto"
+)
+
+// ForkEvidence proves that a creator equivocated by signing two different
+// Events with the same index. Only the signed bodies are kept, so the evidence
+// can be checked by anyone who knows the creator's public key.
+type ForkEvidence struct {
+	A *Event
+	B *Event
+}
+
+// NewForkEvidence checks that a and b are two different Events with the same
+// creator and index, and returns the corresponding ForkEvidence. The Events
+// are ordered by hash so that all the nodes produce the same record.
+func NewForkEvidence(a, b *Event) (*ForkEvidence, error) {
+	ev := &ForkEvidence{
+		A: &Event{Body: a.Body, Signature: a.Signature},
+		B: &Event{Body: b.Body, Signature: b.Signature},
+	}
+
+	if ev.A.GetHex() > ev.B.GetHex() {
+		ev.A, ev.B = ev.B, ev.A
+	}
+
+	if err := ev.check(); err != nil {
+		return nil, err
+	}
+
+	return ev, nil
+}
+
+func (f *ForkEvidence) check() error {
+	if f.A == nil || f.B == nil {
+		return fmt.Errorf("fork evidence is missing an event")
+	}
+	if !bytes.Equal(f.A.Body.Creator, f.B.Body.Creator) {
+		return fmt.Errorf("fork evidence events have different creators")
+	}
+	if f.A.Index() != f.B.Index() {
+		return fmt.Errorf("fork evidence events have different indexes: %d, %d", f.A.Index(), f.B.Index())
+	}
+	if f.A.GetHex() == f.B.GetHex() {
+		return fmt.Errorf("fork evidence events are identical")
+	}
+	return nil
+}
+
+// Creator returns the hex public key of the equivocating creator
+func (f *ForkEvidence) Creator() string {
+	return f.A.GetCreator()
+}
+
+// Index returns the index at which the creator forked
+func (f *ForkEvidence) Index() int {
+	return f.A.Index()
+}
+
+// Verify checks the consistency of the evidence and the signatures of both
+// Events
+func (f *ForkEvidence) Verify() (bool, error) {
+	if err := f.check(); err != nil {
+		return false, err
+	}
+
+	for _, e := range []*Event{f.A, f.B} {
+		ok, err := e.Verify()
+		if err != nil || !ok {
+			return false, err
+		}
+	}
+
+	return true, nil
+}
+
+// Hash ...
+func (f *ForkEvidence) Hash() ([]byte, error) {
+	ha, err := f.A.GetHash()
+	if err != nil {
+		return nil, err
+	}
+	hb, err := f.B.GetHash()
+	if err != nil {
+		return nil, err
+	}
+	return crypto.Keccak256(ha, hb), nil
+}
+
+// Marshal ...
+func (f *ForkEvidence) Marshal() ([]byte, error) {
+	return json.Marshal(f)
+}
+
+// Unmarshal ...
+func (f *ForkEvidence) Unmarshal(data []byte) error {
+	return json.Unmarshal(data, f)
+}
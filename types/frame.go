@@ -15,8 +15,9 @@ type Frame struct {
 	Round    int // RoundReceived
 	Peers    []*conf.Peer
 	Roots    map[string]*Root
-	Events   []*FrameEvent        // Events with RoundReceived = Round
-	PeerSets map[int][]*conf.Peer // [round] => Peers
+	Events   []*FrameEvent            // Events with RoundReceived = Round
+	PeerSets map[int][]*conf.Peer     // [round] => Peers
+	Params   map[int]*ConsensusParams `json:",omitempty"` // [round] => params set from round
 }
 
 // SortedFrameEvents ...
@@ -26,10 +27,46 @@ func (f *Frame) SortedFrameEvents() []*FrameEvent {
 		sorted = append(sorted, r.Events...)
 	}
 	sorted = append(sorted, f.Events...)
-	sort.Sort(sorted)
+	sort.Sort(sorted.SortCache())
 	return sorted
 }
 
+// PeerSetRoot returns the root of the MMR of the history of the PeerSets of
+// the Frame, whose leaves are given by PeerSetHistory
+func (f *Frame) PeerSetRoot() ([]byte, error) {
+	_, leaves, err := PeerSetHistory(f.PeerSets)
+	if err != nil {
+		return nil, err
+	}
+
+	mmr := &MMR{}
+	for _, l := range leaves {
+		mmr.Append(l)
+	}
+	return mmr.Root(), nil
+}
+
+// ProtocolVersion returns the ProtocolVersion in force at the round of the
+// Frame, given by its Params
+func (f *Frame) ProtocolVersion() int {
+	from := -1
+	for r := range f.Params {
+		if r <= f.Round && r > from {
+			from = r
+		}
+	}
+	return f.Params[from].Version()
+}
+
+// BlockPeerSetRoot returns the PeerSetRoot of the Blocks of the Frame, nil
+// before the activation of ProtocolPeerSetRoot
+func (f *Frame) BlockPeerSetRoot() ([]byte, error) {
+	if f.ProtocolVersion() < ProtocolPeerSetRoot {
+		return nil, nil
+	}
+	return f.PeerSetRoot()
+}
+
 // Marshal - json encoding of Frame
 func (f *Frame) Marshal() ([]byte, error) {
 	b := new(bytes.Buffer)
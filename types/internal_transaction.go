@@ -8,6 +8,7 @@ import (
 	"github.com/bolaxy/common"
 	"github.com/bolaxy/common/hexutil"
 	"github.com/bolaxy/config"
+	"github.com/bolaxy/core/signer"
 
 	"github.com/bolaxy/crypto"
 )
@@ -29,6 +30,20 @@ const (
 	PARACHAINADD
 	// PARACHAIN_DEL
 	PARACHAINDEL
+
+	// PEER_SLASH proposes the removal of a peer caught equivocating
+	PEERSLASH
+	// PEER_EVICT proposes the removal of a peer which stopped creating events
+	PEEREVICT
+	// PEER_VOTE is the vote of a validator on a membership change, when the
+	// changes are decided by vote
+	PEERVOTE
+	// PARAM_UPDATE proposes new ConsensusParams, which apply from the start
+	// of an epoch
+	PARAMUPDATE
+	// UPGRADE_SIGNAL signals that a validator runs code which implements a
+	// protocol version
+	UPGRADESIGNAL
 )
 
 // String ...
@@ -42,16 +57,41 @@ func (t TransactionType) String() string {
 		return "PARACHAIN_ADD"
 	case PARACHAINDEL:
 		return "PARACHAIN_DEL"
+	case PEERSLASH:
+		return "PEER_SLASH"
+	case PEEREVICT:
+		return "PEER_EVICT"
+	case PEERVOTE:
+		return "PEER_VOTE"
+	case PARAMUPDATE:
+		return "PARAM_UPDATE"
+	case UPGRADESIGNAL:
+		return "UPGRADE_SIGNAL"
 	default:
 		return "Unknown TransactionType"
 	}
 }
 
+// SignedByPeer returns true if the InternalTransactions of the type are signed
+// by their Peer. PEER_SLASH and PEER_EVICT are submitted by other peers
+// against their Peer, and are checked by the Membership when committed.
+func (t TransactionType) SignedByPeer() bool {
+	return t != PEERSLASH && t != PEEREVICT
+}
+
 // InternalTransactionBody ...
 type InternalTransactionBody struct {
 	Type TransactionType
 	Peer conf.Peer
 	Id   common.Address //投票的合约地址
+
+	Evidence *ForkEvidence `json:",omitempty"` //set for PEER_SLASH
+
+	Proposal []byte `json:",omitempty"` //set for PEER_VOTE: hash of the body voted on
+	Approve  bool   `json:",omitempty"` //set for PEER_VOTE
+
+	Params  *ConsensusParams `json:",omitempty"` //set for PARAM_UPDATE
+	Version int              `json:",omitempty"` //set for UPGRADE_SIGNAL
 }
 
 //Marshal - json encoding of body
@@ -99,6 +139,46 @@ func NewInternalTransactionLeave(peer conf.Peer) InternalTransaction {
 	return NewInternalTransaction(PEERREMOVE, peer, common.Address{})
 }
 
+// NewInternalTransactionSlash proposes the removal of the peer which created
+// the Events of the evidence.
+func NewInternalTransactionSlash(peer conf.Peer, evidence *ForkEvidence) InternalTransaction {
+	itx := NewInternalTransaction(PEERSLASH, peer, common.Address{})
+	itx.Body.Evidence = evidence
+	return itx
+}
+
+// NewInternalTransactionEvict proposes the removal of an inactive peer. It is
+// accepted only if the peer's inactivity can be established from the
+// committed Events.
+func NewInternalTransactionEvict(peer conf.Peer) InternalTransaction {
+	return NewInternalTransaction(PEEREVICT, peer, common.Address{})
+}
+
+// NewInternalTransactionVote is the vote of voter on the membership change
+// proposed by an InternalTransaction. It must be signed by voter.
+func NewInternalTransactionVote(voter conf.Peer, proposal InternalTransaction, approve bool) InternalTransaction {
+	itx := NewInternalTransaction(PEERVOTE, voter, common.Address{})
+	itx.Body.Proposal, _ = proposal.Body.Hash()
+	itx.Body.Approve = approve
+	return itx
+}
+
+// NewInternalTransactionParams proposes new ConsensusParams. It must be signed
+// by peer, a validator.
+func NewInternalTransactionParams(peer conf.Peer, params ConsensusParams) InternalTransaction {
+	itx := NewInternalTransaction(PARAMUPDATE, peer, common.Address{})
+	itx.Body.Params = &params
+	return itx
+}
+
+// NewInternalTransactionUpgrade signals that peer is ready for a protocol
+// version. It must be signed by peer, a validator.
+func NewInternalTransactionUpgrade(peer conf.Peer, version int) InternalTransaction {
+	itx := NewInternalTransaction(UPGRADESIGNAL, peer, common.Address{})
+	itx.Body.Version = version
+	return itx
+}
+
 // Marshal ...
 func (t *InternalTransaction) Marshal() ([]byte, error) {
 	var b bytes.Buffer
@@ -127,19 +207,24 @@ func (t *InternalTransaction) Unmarshal(data []byte) error {
 
 //Sign returns the ecdsa signature of the SHA256 hash of the transaction's body
 func (t *InternalTransaction) Sign(privKey *ecdsa.PrivateKey) error {
+	return t.SignWith(signer.NewLocal(privKey))
+}
+
+// SignWith signs the transaction's body with s
+func (t *InternalTransaction) SignWith(s signer.Signer) error {
 	signBytes, err := t.Body.Hash()
 	if err != nil {
 		return err
 	}
 
-	sig, err := crypto.Sign(signBytes, privKey)
+	sig, err := s.Sign(signBytes)
 	if err != nil {
 		return err
 	}
 
 	t.Signature = hexutil.Encode(sig)
 
-	return err
+	return nil
 }
 
 // Verify ...
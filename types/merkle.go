@@ -0,0 +1,117 @@
+package types
+
+import (
+	"bytes"
+	"fmt"
+
+	"github.com/bolaxy/crypto"
+)
+
+// Leaves and inner nodes are hashed with different prefixes so that an inner
+// node can not be passed off as a leaf.
+var (
+	merkleLeafPrefix = []byte{0x00}
+	merkleNodePrefix = []byte{0x01}
+)
+
+// MerkleLeaf returns the hash of an item as a leaf of a Merkle tree
+func MerkleLeaf(item []byte) []byte {
+	return crypto.Keccak256(merkleLeafPrefix, item)
+}
+
+func merkleNode(left, right []byte) []byte {
+	return crypto.Keccak256(merkleNodePrefix, left, right)
+}
+
+// MerkleRoot computes the root of the binary Merkle tree of items. When a
+// level has an odd number of nodes, the last one is promoted to the next
+// level unchanged. The root of an empty list is the hash of nothing.
+func MerkleRoot(items [][]byte) []byte {
+	if len(items) == 0 {
+		return crypto.Keccak256(nil)
+	}
+
+	level := make([][]byte, len(items))
+	for i, item := range items {
+		level[i] = MerkleLeaf(item)
+	}
+
+	return merkleRootFromLeaves(level)
+}
+
+func merkleRootFromLeaves(level [][]byte) []byte {
+	for len(level) > 1 {
+		next := make([][]byte, 0, (len(level)+1)/2)
+		for i := 0; i < len(level); i += 2 {
+			if i+1 == len(level) {
+				next = append(next, level[i])
+				continue
+			}
+			next = append(next, merkleNode(level[i], level[i+1]))
+		}
+		level = next
+	}
+	return level[0]
+}
+
+// MerkleProofStep is a sibling hash on the path from a leaf to the root
+type MerkleProofStep struct {
+	Hash []byte
+	Left bool //true if the sibling is on the left
+}
+
+// MerkleProof proves the inclusion of an item at a position of a list
+type MerkleProof struct {
+	Index int
+	Steps []MerkleProofStep
+}
+
+// NewMerkleProof creates the inclusion proof of items[index]
+func NewMerkleProof(items [][]byte, index int) (*MerkleProof, error) {
+	if index < 0 || index >= len(items) {
+		return nil, fmt.Errorf("merkle proof index %d out of range [0, %d)", index, len(items))
+	}
+
+	level := make([][]byte, len(items))
+	for i, item := range items {
+		level[i] = MerkleLeaf(item)
+	}
+
+	proof := &MerkleProof{Index: index}
+	pos := index
+
+	for len(level) > 1 {
+		if pos%2 == 1 {
+			proof.Steps = append(proof.Steps, MerkleProofStep{Hash: level[pos-1], Left: true})
+		} else if pos+1 < len(level) {
+			proof.Steps = append(proof.Steps, MerkleProofStep{Hash: level[pos+1], Left: false})
+		}
+
+		next := make([][]byte, 0, (len(level)+1)/2)
+		for i := 0; i < len(level); i += 2 {
+			if i+1 == len(level) {
+				next = append(next, level[i])
+				continue
+			}
+			next = append(next, merkleNode(level[i], level[i+1]))
+		}
+
+		level = next
+		pos /= 2
+	}
+
+	return proof, nil
+}
+
+// Verify returns true if the proof links item to root
+func (p *MerkleProof) Verify(root []byte, item []byte) bool {
+	h := MerkleLeaf(item)
+	for _, s := range p.Steps {
+		if s.Left {
+			h = merkleNode(s.Hash, h)
+		} else {
+			h = merkleNode(h, s.Hash)
+		}
+	}
+	return bytes.Equal(h, root)
+}
@@ -0,0 +1,98 @@
+package types
+
+// GasHook prices the payloads of Events and Blocks, so that an application can
+// meter the usage of each creator and charge fees or enforce quotas on top of
+// consensus. It must be deterministic when the estimates feed consensus.
+type GasHook interface {
+	// TransactionGas prices a transaction of the given type
+	TransactionGas(tx []byte, t PayloadType) uint64
+	// InternalTransactionGas prices an InternalTransaction
+	InternalTransactionGas(itx *InternalTransaction) uint64
+}
+
+// SizeGas is a GasHook which charges a fixed amount per transaction, plus an
+// amount per byte. InternalTransactions are charged on their encoding.
+type SizeGas struct {
+	PerTx   uint64
+	PerByte uint64
+}
+
+// TransactionGas ...
+func (g SizeGas) TransactionGas(tx []byte, t PayloadType) uint64 {
+	return g.PerTx + g.PerByte*uint64(len(tx))
+}
+
+// InternalTransactionGas ...
+func (g SizeGas) InternalTransactionGas(itx *InternalTransaction) uint64 {
+	return g.PerTx + g.PerByte*uint64(itx.SerializedSize())
+}
+
+// payloadGas sums the gas of transactions tagged with types, which is empty
+// or parallel to txs, and of InternalTransactions
+func payloadGas(h GasHook, txs [][]byte, types []PayloadType, itxs []InternalTransaction) uint64 {
+	var gas uint64
+	for i, tx := range txs {
+		gas += h.TransactionGas(tx, payloadTypeAt(types, i))
+	}
+	for i := range itxs {
+		gas += h.InternalTransactionGas(&itxs[i])
+	}
+	return gas
+}
+
+// payloadSize returns the total size of transactions
+func payloadSize(txs [][]byte) int {
+	size := 0
+	for _, tx := range txs {
+		size += len(tx)
+	}
+	return size
+}
+
+// SerializedSize returns the size of the encoding of the InternalTransaction,
+// signature included
+func (t *InternalTransaction) SerializedSize() int {
+	data, _ := t.Marshal()
+	return len(data)
+}
+
+// GasEstimate prices the InternalTransaction with h
+func (t *InternalTransaction) GasEstimate(h GasHook) uint64 {
+	return h.InternalTransactionGas(t)
+}
+
+// SerializedSize returns the size of the encoding of the Event, signature
+// included, as it is stored
+func (e *Event) SerializedSize() int {
+	data, _ := e.Marshal()
+	return len(data)
+}
+
+// PayloadSize returns the total size of the transactions of the Event
+func (e *Event) PayloadSize() int {
+	return payloadSize(e.Body.Transactions)
+}
+
+// GasEstimate prices the transactions and InternalTransactions of the Event
+// with h. The Block signatures are not charged.
+func (e *Event) GasEstimate(h GasHook) uint64 {
+	return payloadGas(h, e.Body.Transactions, e.Body.PayloadTypes, e.Body.InternalTransactions)
+}
+
+// SerializedSize returns the size of the encoding of the Block, signatures
+// included, as it is stored
+func (b *Block) SerializedSize() int {
+	data, _ := b.Marshal()
+	return len(data)
+}
+
+// PayloadSize returns the total size of the transactions of the Block
+func (b *Block) PayloadSize() int {
+	return payloadSize(b.Body.Transactions)
+}
+
+// GasEstimate prices the transactions and InternalTransactions of the Block
+// with h. The receipts and signatures are not charged.
+func (b *Block) GasEstimate(h GasHook) uint64 {
+	return payloadGas(h, b.Body.Transactions, b.Body.PayloadTypes, b.Body.InternalTransactions)
+}
@@ -0,0 +1,243 @@
+package types
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"math/bits"
+	"sort"
+
+	"github.com/bolaxy/config"
+	"github.com/bolaxy/crypto"
+)
+
+// MMR is a Merkle mountain range: an append-only list of leaves hashed into
+// perfect binary Merkle trees, the peaks, one per bit of its size, from the
+// highest to the lowest. Appending only merges the lowest peaks, so the root
+// of a longer range commits to every shorter one.
+type MMR struct {
+	size  int
+	peaks [][]byte
+}
+
+// Append adds the leaf hash of an item, as given by MerkleLeaf
+func (m *MMR) Append(leaf []byte) {
+	m.peaks = append(m.peaks, leaf)
+	for height := 0; m.size>>uint(height)&1 == 1; height++ {
+		n := len(m.peaks)
+		m.peaks = append(m.peaks[:n-2], merkleNode(m.peaks[n-2], m.peaks[n-1]))
+	}
+	m.size++
+}
+
+// Size returns the number of leaves
+func (m *MMR) Size() int {
+	return m.size
+}
+
+// Root bags the peaks, from the lowest to the highest, with the size
+func (m *MMR) Root() []byte {
+	return bagPeaks(m.size, m.peaks)
+}
+
+func bagPeaks(size int, peaks [][]byte) []byte {
+	var acc []byte
+	for i := len(peaks) - 1; i >= 0; i-- {
+		if acc == nil {
+			acc = peaks[i]
+		} else {
+			acc = merkleNode(peaks[i], acc)
+		}
+	}
+
+	var n [8]byte
+	binary.BigEndian.PutUint64(n[:], uint64(size))
+	return crypto.Keccak256(n[:], acc)
+}
+
+// MMRProof proves the inclusion of a leaf in an MMR of a given size
+type MMRProof struct {
+	Index int
+	Size  int
+	Steps []MerkleProofStep // from the leaf to its peak
+	Peaks [][]byte
+}
+
+// NewMMRProof creates the inclusion proof of leaves[index] in the MMR of the
+// leaves, which are leaf hashes as given by MerkleLeaf
+func NewMMRProof(leaves [][]byte, index int) (*MMRProof, error) {
+	if index < 0 || index >= len(leaves) {
+		return nil, fmt.Errorf("mmr proof index %d out of range [0, %d)", index, len(leaves))
+	}
+
+	proof := &MMRProof{Index: index, Size: len(leaves)}
+
+	start := 0
+	for _, height := range peakHeights(len(leaves)) {
+		end := start + 1<<uint(height)
+		level := leaves[start:end]
+
+		if index >= start && index < end {
+			pos := index - start
+			for len(level) > 1 {
+				if pos%2 == 1 {
+					proof.Steps = append(proof.Steps, MerkleProofStep{Hash: level[pos-1], Left: true})
+				} else {
+					proof.Steps = append(proof.Steps, MerkleProofStep{Hash: level[pos+1], Left: false})
+				}
+				level = nextLevel(level)
+				pos /= 2
+			}
+		} else {
+			for len(level) > 1 {
+				level = nextLevel(level)
+			}
+		}
+
+		proof.Peaks = append(proof.Peaks, level[0])
+		start = end
+	}
+
+	return proof, nil
+}
+
+// Verify returns true if the proof links leaf, a leaf hash as given by
+// MerkleLeaf, to root
+func (p *MMRProof) Verify(root []byte, leaf []byte) bool {
+	if p.Index < 0 || p.Index >= p.Size {
+		return false
+	}
+
+	heights := peakHeights(p.Size)
+	if len(p.Peaks) != len(heights) {
+		return false
+	}
+
+	start := 0
+	for i, height := range heights {
+		end := start + 1<<uint(height)
+		if p.Index >= end {
+			start = end
+			continue
+		}
+
+		if len(p.Steps) != height {
+			return false
+		}
+		h := leaf
+		for _, s := range p.Steps {
+			if s.Left {
+				h = merkleNode(s.Hash, h)
+			} else {
+				h = merkleNode(h, s.Hash)
+			}
+		}
+		if !bytes.Equal(h, p.Peaks[i]) {
+			return false
+		}
+		break
+	}
+
+	return bytes.Equal(bagPeaks(p.Size, p.Peaks), root)
+}
+
+// peakHeights returns the heights of the peaks of an MMR of size leaves,
+// from the highest
+func peakHeights(size int) []int {
+	res := []int{}
+	for h := bits.Len(uint(size)) - 1; h >= 0; h-- {
+		if size>>uint(h)&1 == 1 {
+			res = append(res, h)
+		}
+	}
+	return res
+}
+
+// nextLevel hashes the pairs of a level of a perfect binary tree
+func nextLevel(level [][]byte) [][]byte {
+	next := make([][]byte, len(level)/2)
+	for i := range next {
+		next[i] = merkleNode(level[2*i], level[2*i+1])
+	}
+	return next
+}
+
+// PeerSetLeaf returns the leaf hash of a PeerSet in the history of the
+// PeerSets, which records the round from which it applies
+func PeerSetLeaf(round int, peersHash []byte) []byte {
+	var r [8]byte
+	binary.BigEndian.PutUint64(r[:], uint64(round))
+	return MerkleLeaf(append(r[:], peersHash...))
+}
+
+// PeerSetHistory returns the leaves of the history of the PeerSets, in round
+// order, with their rounds
+func PeerSetHistory(peerSets map[int][]*conf.Peer) ([]int, [][]byte, error) {
+	rounds := make([]int, 0, len(peerSets))
+	for r := range peerSets {
+		rounds = append(rounds, r)
+	}
+	sort.Ints(rounds)
+
+	leaves := make([][]byte, len(rounds))
+	for i, r := range rounds {
+		hash, err := conf.NewPeerSet(peerSets[r]).Hash()
+		if err != nil {
+			return nil, nil, err
+		}
+		leaves[i] = PeerSetLeaf(r, hash)
+	}
+
+	return rounds, leaves, nil
+}
+
+// PeerSetProof proves that a PeerSet, applying from Round, is in the history
+// committed by the PeerSetRoot of a Block
+type PeerSetProof struct {
+	Round int
+	Peers []*conf.Peer
+	Proof *MMRProof
+}
+
+// NewPeerSetProof creates the proof of the PeerSet of round in the history of
+// a Frame, where it must have been set
+func NewPeerSetProof(frame *Frame, round int) (*PeerSetProof, error) {
+	rounds, leaves, err := PeerSetHistory(frame.PeerSets)
+	if err != nil {
+		return nil, err
+	}
+
+	i := sort.SearchInts(rounds, round)
+	if i == len(rounds) || rounds[i] != round {
+		return nil, fmt.Errorf("no peer-set set at round %d in frame %d", round, frame.Round)
+	}
+
+	proof, err := NewMMRProof(leaves, i)
+	if err != nil {
+		return nil, err
+	}
+
+	return &PeerSetProof{
+		Round: round,
+		Peers: frame.PeerSets[round],
+		Proof: proof,
+	}, nil
+}
+
+// Verify checks the proof against the PeerSetRoot of a Block, which the
+// caller verified
+func (p *PeerSetProof) Verify(root []byte) error {
+	if p.Proof == nil {
+		return fmt.Errorf("peer-set proof without mmr proof")
+	}
+
+	hash, err := conf.NewPeerSet(p.Peers).Hash()
+	if err != nil {
+		return err
+	}
+
+	if !p.Proof.Verify(root, PeerSetLeaf(p.Round, hash)) {
+		return fmt.Errorf("peer-set of round %d not in the committed history", p.Round)
+	}
+	return nil
+}
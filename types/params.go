@@ -0,0 +1,89 @@
+package types
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/bolaxy/crypto"
+)
+
+// Protocol versions. A network runs ProtocolInitial until the validators
+// signal that they are ready for a later version, with UPGRADE_SIGNAL
+// InternalTransactions, which then activates from an agreed round.
+const (
+	// ProtocolInitial is the version of a network which never upgraded
+	ProtocolInitial = 0
+	// ProtocolWhitened orders the Events of the Frames with TieBreakWhitened
+	ProtocolWhitened = 1
+	// ProtocolPeerSetRoot sets the PeerSetRoot of the Blocks
+	ProtocolPeerSetRoot = 2
+	// ProtocolLatest is the latest version implemented. A node stops
+	// producing Blocks from the activation of a later version.
+	ProtocolLatest = ProtocolPeerSetRoot
+)
+
+// ConsensusParams are the tunables of a network which are changed on-chain,
+// by PARAM_UPDATE InternalTransactions, instead of the Config of each node.
+// A zero field leaves the value of the Config of the nodes.
+type ConsensusParams struct {
+	MaxBlockTxs       int           // BlockLimits.MaxTxs
+	MaxBlockBytes     int           // BlockLimits.MaxBytes
+	HeartbeatInterval time.Duration // of the Creator
+	SyncLimit         int
+	SuspendLimit      int
+	// ProtocolVersion is activated by UPGRADE_SIGNAL transactions, and kept
+	// by the PARAM_UPDATE ones
+	ProtocolVersion int `json:",omitempty"`
+}
+
+// Validate ...
+func (p *ConsensusParams) Validate() error {
+	if p.MaxBlockTxs < 0 {
+		return fmt.Errorf("MaxBlockTxs must not be negative, got %d", p.MaxBlockTxs)
+	}
+	if p.MaxBlockBytes < 0 {
+		return fmt.Errorf("MaxBlockBytes must not be negative, got %d", p.MaxBlockBytes)
+	}
+	if p.HeartbeatInterval < 0 {
+		return fmt.Errorf("HeartbeatInterval must not be negative, got %v", p.HeartbeatInterval)
+	}
+	if p.SyncLimit < 0 {
+		return fmt.Errorf("SyncLimit must not be negative, got %d", p.SyncLimit)
+	}
+	if p.SuspendLimit < 0 {
+		return fmt.Errorf("SuspendLimit must not be negative, got %d", p.SuspendLimit)
+	}
+	if p.ProtocolVersion < 0 {
+		return fmt.Errorf("ProtocolVersion must not be negative, got %d", p.ProtocolVersion)
+	}
+	return nil
+}
+
+// BlockLimits returns the limits set by the params, or else by limits
+func (p *ConsensusParams) BlockLimits(limits BlockLimits) BlockLimits {
+	if p.MaxBlockTxs > 0 {
+		limits.MaxTxs = p.MaxBlockTxs
+	}
+	if p.MaxBlockBytes > 0 {
+		limits.MaxBytes = p.MaxBlockBytes
+	}
+	return limits
+}
+
+// Hash ...
+func (p *ConsensusParams) Hash() ([]byte, error) {
+	data, err := json.Marshal(p)
+	if err != nil {
+		return nil, err
+	}
+	return crypto.Keccak256(data), nil
+}
+
+// Version returns the ProtocolVersion, ProtocolInitial if p is nil
+func (p *ConsensusParams) Version() int {
+	if p == nil {
+		return ProtocolInitial
+	}
+	return p.ProtocolVersion
+}
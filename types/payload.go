@@ -0,0 +1,80 @@
+package types
+
+import "fmt"
+
+// PayloadType tags the transactions of Events and Blocks so that a Block can
+// carry heterogeneous payloads. Untagged transactions are PayloadApp.
+type PayloadType uint8
+
+const (
+	// PayloadApp is an application transaction
+	PayloadApp PayloadType = iota
+	// PayloadOracle is data reported by an oracle
+	PayloadOracle
+	// PayloadCheckpointAttestation is a signed attestation of a checkpoint
+	PayloadCheckpointAttestation
+	// PayloadDKG is a message of a distributed key generation
+	PayloadDKG
+	// PayloadParachain is a message destined for a parachain
+	PayloadParachain
+)
+
+// String ...
+func (t PayloadType) String() string {
+	switch t {
+	case PayloadApp:
+		return "APP"
+	case PayloadOracle:
+		return "ORACLE"
+	case PayloadCheckpointAttestation:
+		return "CHECKPOINT_ATTESTATION"
+	case PayloadDKG:
+		return "DKG"
+	case PayloadParachain:
+		return "PARACHAIN"
+	default:
+		return fmt.Sprintf("PayloadType(%d)", uint8(t))
+	}
+}
+
+// payloadTypeAt returns the type of the i-th transaction given a list of
+// types which is either empty, meaning all the transactions are PayloadApp,
+// or parallel to the transactions.
+func payloadTypeAt(types []PayloadType, i int) PayloadType {
+	if i < len(types) {
+		return types[i]
+	}
+	return PayloadApp
+}
+
+// checkPayloadTypes returns an error if types is neither empty nor parallel to
+// txs
+func checkPayloadTypes(txs [][]byte, types []PayloadType) error {
+	if len(types) != 0 && len(types) != len(txs) {
+		return fmt.Errorf("%d payload types for %d transactions", len(types), len(txs))
+	}
+	return nil
+}
+
+// FilterTransactions returns the transactions of type want. types is either
+// empty or parallel to txs.
+func FilterTransactions(txs [][]byte, types []PayloadType, want PayloadType) [][]byte {
+	res := [][]byte{}
+	for i, tx := range txs {
+		if payloadTypeAt(types, i) == want {
+			res = append(res, tx)
+		}
+	}
+	return res
+}
+
+// compactPayloadTypes returns nil if all the types are PayloadApp, so that
+// untagged Events and Blocks are encoded as before.
+func compactPayloadTypes(types []PayloadType) []PayloadType {
+	for _, t := range types {
+		if t != PayloadApp {
+			return types
+		}
+	}
+	return nil
+}
@@ -0,0 +1,87 @@
+package types
+
+import (
+	"strings"
+	"sync"
+
+	"github.com/bolaxy/common/hexutil"
+	"github.com/bolaxy/crypto"
+)
+
+// MaxInternedPubKeys bounds the number of keys of a PubKeyTable, so that
+// Events with made up creators can not grow it forever. The keys beyond it
+// are converted on every call.
+const MaxInternedPubKeys = 1 << 16
+
+// PubKey is an interned public key
+type PubKey struct {
+	// Hex is the canonical string of the key: the upper case hex of the
+	// compressed key, which keys the PeerSets and the caches
+	Hex string
+	// ID is the ID of the Peer of the key
+	ID uint32
+}
+
+// PubKeyTable interns public keys: it maps the bytes of an uncompressed key,
+// like the Creator of an EventBody or the Validator of a BlockSignature, to
+// its PubKey, so that they are encoded once. It is safe for concurrent use.
+type PubKeyTable struct {
+	lock  sync.RWMutex
+	byKey map[string]PubKey
+	byID  map[uint32]PubKey
+}
+
+// PubKeys is the PubKeyTable used by Events and BlockSignatures
+var PubKeys = NewPubKeyTable()
+
+// NewPubKeyTable ...
+func NewPubKeyTable() *PubKeyTable {
+	return &PubKeyTable{
+		byKey: make(map[string]PubKey),
+		byID:  make(map[uint32]PubKey),
+	}
+}
+
+// Intern returns the PubKey of the bytes of an uncompressed key, or the zero
+// PubKey, which is in no PeerSet, if they are not a valid key
+func (t *PubKeyTable) Intern(pub []byte) PubKey {
+	t.lock.RLock()
+	pk, ok := t.byKey[string(pub)]
+	t.lock.RUnlock()
+	if ok {
+		return pk
+	}
+
+	key, err := crypto.UnmarshalPubkey(pub)
+	if err != nil {
+		return PubKey{}
+	}
+	compressed := crypto.CompressPubkey(key)
+	pk = PubKey{
+		Hex: strings.ToUpper(hexutil.Encode(compressed)),
+		ID:  crypto.Hash32(compressed),
+	}
+
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if len(t.byKey) < MaxInternedPubKeys {
+		t.byKey[string(pub)] = pk
+		t.byID[pk.ID] = pk
+	}
+	return pk
+}
+
+// ByID returns the PubKey interned with an ID
+func (t *PubKeyTable) ByID(id uint32) (PubKey, bool) {
+	t.lock.RLock()
+	defer t.lock.RUnlock()
+	pk, ok := t.byID[id]
+	return pk, ok
+}
+
+// Len returns the number of interned keys
+func (t *PubKeyTable) Len() int {
+	t.lock.RLock()
+	defer t.lock.RUnlock()
+	return len(t.byKey)
+}
@@ -0,0 +1,43 @@
+package types
+
+import (
+	conf "github.com/bolaxy/config"
+)
+
+// SignatureQuorum summarises the Signatures of a Block with respect to a
+// PeerSet
+type SignatureQuorum struct {
+	Signed   int // number of Signatures from members of the PeerSet
+	Required int // SuperMajority of the PeerSet
+	Total    int // size of the PeerSet
+}
+
+// NewSignatureQuorum counts the Signatures of a Block from validators of a
+// PeerSet. Signatures from other validators are ignored. The Signatures are
+// assumed to have been verified when they were added to the Block.
+func NewSignatureQuorum(b *Block, peerSet *conf.PeerSet) SignatureQuorum {
+	q := SignatureQuorum{
+		Required: peerSet.SuperMajority(),
+		Total:    peerSet.Len(),
+	}
+
+	for validator := range b.Signatures {
+		if _, ok := peerSet.ByPubKey[validator]; ok {
+			q.Signed++
+		}
+	}
+
+	return q
+}
+
+// Reached returns true if the Block has enough Signatures
+func (q SignatureQuorum) Reached() bool {
+	return q.Signed >= q.Required
+}
+
+// IsFinal returns true if a SuperMajority of the PeerSet signed the Block.
+// Applications should delay irreversible side effects of a Block until it is
+// final.
+func (b *Block) IsFinal(peerSet *conf.PeerSet) bool {
+	return NewSignatureQuorum(b, peerSet).Reached()
+}
@@ -102,6 +102,17 @@ func (r *RoundInfo) Witnesses() []string {
 	return res
 }
 
+//UndecidedWitnesses returns the witnesses whose fame is not decided yet
+func (r *RoundInfo) UndecidedWitnesses() []string {
+	res := []string{}
+	for x, e := range r.CreatedEvents {
+		if e.Witness && e.Famous == common.Undefined {
+			res = append(res, x)
+		}
+	}
+	return res
+}
+
 //FamousWitnesses returns famous witnesses
 func (r *RoundInfo) FamousWitnesses() []string {
 	res := make([]string, 0, len(r.CreatedEvents))
@@ -147,3 +158,9 @@ func (r *RoundInfo) Unmarshal(data []byte) error {
 func (r *RoundInfo) IsQueued() bool {
 	return r.queued
 }
+
+// SetQueued marks the round as queued for processing. The flag is not
+// serialized, a reloaded round is re-queued by the consensus.
+func (r *RoundInfo) SetQueued() {
+	r.queued = true
+}
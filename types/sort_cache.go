@@ -0,0 +1,141 @@
+package types
+
+import (
+	"bytes"
+
+	"github.com/bolaxy/common/hexutil"
+	"github.com/bolaxy/crypto"
+)
+
+// TieBreak selects the order of the Events of a Frame which have the same
+// Lamport timestamp. All the nodes of a network must use the same.
+type TieBreak uint8
+
+const (
+	// TieBreakSignature orders them by signature. A creator can grind its
+	// signature, by varying the body of its Event, to be ordered first.
+	TieBreakSignature TieBreak = iota
+	// TieBreakWhitened orders them by the hash of their signature and of
+	// the randomness of their round received, which is only known once the
+	// Events are created, so that the order can not be ground.
+	TieBreakWhitened
+)
+
+// String ...
+func (t TieBreak) String() string {
+	switch t {
+	case TieBreakSignature:
+		return "signature"
+	case TieBreakWhitened:
+		return "whitened"
+	default:
+		return "unknown"
+	}
+}
+
+// sortKey is the position of an Event in the total order of ByLamportTimestamp
+// and SortedFrameEvents: its Lamport timestamp, then its signature read as a
+// big-endian integer.
+type sortKey struct {
+	timestamp int
+	signature []byte
+}
+
+// newSortKey decodes the signature once. Leading zeros are trimmed, so that
+// comparing the lengths, then the bytes, compares the integers.
+func newSortKey(timestamp int, signature string) sortKey {
+	sig, _ := hexutil.Decode(signature)
+	return sortKey{
+		timestamp: timestamp,
+		signature: bytes.TrimLeft(sig, "\x00"),
+	}
+}
+
+// newWhitenedSortKey replaces the signature with its hash with seed
+func newWhitenedSortKey(timestamp int, signature string, seed []byte) sortKey {
+	sig, _ := hexutil.Decode(signature)
+	return sortKey{
+		timestamp: timestamp,
+		signature: bytes.TrimLeft(crypto.Keccak256(seed, sig), "\x00"),
+	}
+}
+
+func (k *sortKey) less(o *sortKey) bool {
+	if k.timestamp != o.timestamp {
+		return k.timestamp < o.timestamp
+	}
+	return compareSignatures(k.signature, o.signature) < 0
+}
+
+// compareSignatures compares trimmed signatures as integers
+func compareSignatures(a, b []byte) int {
+	if len(a) != len(b) {
+		if len(a) < len(b) {
+			return -1
+		}
+		return 1
+	}
+	return bytes.Compare(a, b)
+}
+
+// lessSignature orders the hex encoded signatures of Events with the same
+// Lamport timestamp
+func lessSignature(a, b string) bool {
+	sa, _ := hexutil.Decode(a)
+	sb, _ := hexutil.Decode(b)
+	return compareSignatures(bytes.TrimLeft(sa, "\x00"), bytes.TrimLeft(sb, "\x00")) < 0
+}
+
+// SortCache implements sort.Interface with the sort keys of a slice computed
+// beforehand, so that the signatures are decoded once per element instead of
+// in every call to Less. Swap moves the keys along with the slice.
+type SortCache struct {
+	keys []sortKey
+	swap func(i, j int)
+}
+
+// Len ...
+func (c *SortCache) Len() int { return len(c.keys) }
+
+// Swap ...
+func (c *SortCache) Swap(i, j int) {
+	c.keys[i], c.keys[j] = c.keys[j], c.keys[i]
+	c.swap(i, j)
+}
+
+// Less ...
+func (c *SortCache) Less(i, j int) bool { return c.keys[i].less(&c.keys[j]) }
+
+// SortCache returns a SortCache which sorts a like ByLamportTimestamp. Events
+// without a Lamport timestamp come first.
+func (a ByLamportTimestamp) SortCache() *SortCache {
+	keys := make([]sortKey, len(a))
+	for i, e := range a {
+		t := -1
+		if e.LamportTimestamp != nil {
+			t = *e.LamportTimestamp
+		}
+		keys[i] = newSortKey(t, e.Signature)
+	}
+	return &SortCache{keys: keys, swap: a.Swap}
+}
+
+// SortCache returns a SortCache which sorts a like SortedFrameEvents
+func (a SortedFrameEvents) SortCache() *SortCache {
+	keys := make([]sortKey, len(a))
+	for i, fe := range a {
+		keys[i] = newSortKey(fe.LamportTimestamp, fe.Core.Signature)
+	}
+	return &SortCache{keys: keys, swap: a.Swap}
+}
+
+// WhitenedSortCache returns a SortCache which sorts a like SortedFrameEvents,
+// except that the Events with the same Lamport timestamp are ordered by the
+// hash of seed and their signature, as in TieBreakWhitened
+func (a SortedFrameEvents) WhitenedSortCache(seed []byte) *SortCache {
+	keys := make([]sortKey, len(a))
+	for i, fe := range a {
+		keys[i] = newWhitenedSortKey(fe.LamportTimestamp, fe.Core.Signature, seed)
+	}
+	return &SortCache{keys: keys, swap: a.Swap}
+}
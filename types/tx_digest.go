@@ -0,0 +1,41 @@
+package types
+
+import (
+	"errors"
+
+	"github.com/bolaxy/crypto"
+)
+
+// ErrDigestedPayload is returned for a WireEvent whose transactions were not
+// pulled from the hashes which replaced them
+var ErrDigestedPayload = errors.New("event transactions not pulled")
+
+// TxHash returns the hash which identifies a transaction whose body is pulled
+// on demand
+func TxHash(tx []byte) []byte {
+	return crypto.Keccak256(tx)
+}
+
+// Digested returns a copy of the WireEvent whose transactions are replaced by
+// their hashes, or the WireEvent itself if it has no transactions
+func (we WireEvent) Digested() WireEvent {
+	if len(we.Body.Transactions) == 0 {
+		return we
+	}
+
+	hashes := make([][]byte, len(we.Body.Transactions))
+	for i, tx := range we.Body.Transactions {
+		hashes[i] = TxHash(tx)
+	}
+	we.Body.Transactions = nil
+	we.Body.TxHashes = hashes
+	return we
+}
+
+// Filled returns a copy of the WireEvent with its transactions, once pulled
+// for its TxHashes
+func (we WireEvent) Filled(txs [][]byte) WireEvent {
+	we.Body.Transactions = txs
+	we.Body.TxHashes = nil
+	return we
+}
@@ -0,0 +1,115 @@
+package types
+
+// WireEventBatch encodes a sequence of WireEvents as runs of consecutive
+// Events of the same creator, which share its CreatorID and a base index.
+// Sync responses often contain long runs of one participant, whose Events
+// then only carry what differs between them. The order of the Events is
+// kept.
+type WireEventBatch struct {
+	Runs []WireEventRun
+}
+
+// WireEventRun holds consecutive WireEvents of one creator. The Index of the
+// first Event is BaseIndex, and the Index of the next ones follows the
+// previous one, apart from their IndexGap.
+type WireEventRun struct {
+	CreatorID uint32
+	BaseIndex int
+	Events    []WireRunEvent
+}
+
+// WireRunEvent is a WireEvent without the fields given by its run. Its Index
+// is the Index of the previous Event of the run plus 1 plus IndexGap, and its
+// SelfParentIndex is its Index minus 1 minus SelfParentGap, so that both gaps
+// are usually 0 and left out.
+type WireRunEvent struct {
+	Transactions         [][]byte
+	InternalTransactions []InternalTransaction
+	BlockSignatures      []WireBlockSignature
+	PayloadTypes         []PayloadType `json:",omitempty"`
+	Coded                *CodedPayload `json:",omitempty"`
+	TxHashes             [][]byte      `json:",omitempty"`
+
+	OtherParentCreatorID uint32
+	OtherParentIndex     int
+	IndexGap             int `json:",omitempty"`
+	SelfParentGap        int `json:",omitempty"`
+
+	Signature string
+}
+
+// NewWireEventBatch groups events in runs of the same creator
+func NewWireEventBatch(events []WireEvent) *WireEventBatch {
+	b := &WireEventBatch{}
+
+	var run *WireEventRun
+	prev := 0
+	for _, we := range events {
+		if run == nil || we.Body.CreatorID != run.CreatorID {
+			b.Runs = append(b.Runs, WireEventRun{
+				CreatorID: we.Body.CreatorID,
+				BaseIndex: we.Body.Index,
+			})
+			run = &b.Runs[len(b.Runs)-1]
+			prev = we.Body.Index - 1
+		}
+
+		run.Events = append(run.Events, WireRunEvent{
+			Transactions:         we.Body.Transactions,
+			InternalTransactions: we.Body.InternalTransactions,
+			BlockSignatures:      we.Body.BlockSignatures,
+			PayloadTypes:         we.Body.PayloadTypes,
+			Coded:                we.Body.Coded,
+			TxHashes:             we.Body.TxHashes,
+			OtherParentCreatorID: we.Body.OtherParentCreatorID,
+			OtherParentIndex:     we.Body.OtherParentIndex,
+			IndexGap:             we.Body.Index - prev - 1,
+			SelfParentGap:        we.Body.Index - we.Body.SelfParentIndex - 1,
+			Signature:            we.Signature,
+		})
+		prev = we.Body.Index
+	}
+
+	return b
+}
+
+// Len returns the number of Events in the batch
+func (b *WireEventBatch) Len() int {
+	n := 0
+	for _, r := range b.Runs {
+		n += len(r.Events)
+	}
+	return n
+}
+
+// Events returns the WireEvents of the batch, in order
+func (b *WireEventBatch) Events() []WireEvent {
+	res := make([]WireEvent, 0, b.Len())
+
+	for _, r := range b.Runs {
+		prev := r.BaseIndex - 1
+		for _, e := range r.Events {
+			index := prev + 1 + e.IndexGap
+
+			res = append(res, WireEvent{
+				Body: WireBody{
+					Transactions:         e.Transactions,
+					InternalTransactions: e.InternalTransactions,
+					BlockSignatures:      e.BlockSignatures,
+					PayloadTypes:         e.PayloadTypes,
+					Coded:                e.Coded,
+					TxHashes:             e.TxHashes,
+					CreatorID:            r.CreatorID,
+					OtherParentCreatorID: e.OtherParentCreatorID,
+					Index:                index,
+					SelfParentIndex:      index - 1 - e.SelfParentGap,
+					OtherParentIndex:     e.OtherParentIndex,
+				},
+				Signature: e.Signature,
+			})
+			prev = index
+		}
+	}
+
+	return res
+}